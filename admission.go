@@ -0,0 +1,78 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"fmt"
+
+	"github.com/prometheus/tsdb/labels"
+)
+
+// AdmissionStage is the point of the write path at which an AdmissionFunc
+// is consulted.
+type AdmissionStage int
+
+const (
+	// AdmitSeries is the stage before a new series is created.
+	AdmitSeries AdmissionStage = iota
+	// AdmitCommit is the stage before the samples of an appender are committed.
+	AdmitCommit
+)
+
+func (s AdmissionStage) String() string {
+	switch s {
+	case AdmitSeries:
+		return "series"
+	case AdmitCommit:
+		return "commit"
+	}
+	return fmt.Sprintf("AdmissionStage(%d)", int(s))
+}
+
+// AdmissionRequest describes a write pending admission.
+type AdmissionRequest struct {
+	Stage AdmissionStage
+	// Labels of the series about to be created in the AdmitSeries stage.
+	Labels labels.Labels
+	// Number of series created and samples added by the appender in the
+	// AdmitCommit stage.
+	Series, Samples int
+}
+
+// AdmissionFunc decides whether a write is admitted, e.g. based on per-tenant
+// quotas. A non-nil error rejects the write and is returned to the appender's
+// caller as the reason of an *AdmissionError.
+type AdmissionFunc func(AdmissionRequest) error
+
+// AdmissionError is returned by appenders if an AdmissionFunc rejected a write.
+// A rejected commit rolls back all samples of the appender.
+type AdmissionError struct {
+	Stage  AdmissionStage
+	Reason error
+}
+
+func (e *AdmissionError) Error() string {
+	return fmt.Sprintf("%s rejected: %s", e.Stage, e.Reason)
+}
+
+// admit consults the head's admission function about a write.
+func (h *Head) admit(req AdmissionRequest) error {
+	if h.admission == nil {
+		return nil
+	}
+	if err := h.admission(req); err != nil {
+		return &AdmissionError{Stage: req.Stage, Reason: err}
+	}
+	return nil
+}
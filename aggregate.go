@@ -0,0 +1,317 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"math"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/tsdb/chunks"
+	"github.com/prometheus/tsdb/labels"
+)
+
+// AggregationOp is the function combining the values of aggregated series.
+type AggregationOp int
+
+// The supported aggregation functions.
+const (
+	AggregateSum AggregationOp = iota
+	AggregateMin
+	AggregateMax
+	AggregateCount
+)
+
+func (op AggregationOp) String() string {
+	switch op {
+	case AggregateSum:
+		return "sum"
+	case AggregateMin:
+		return "min"
+	case AggregateMax:
+		return "max"
+	case AggregateCount:
+		return "count"
+	}
+	return "<unknown>"
+}
+
+// AggregationRule derives new series from the series of the head while it is
+// compacted into a block, similar to a recording rule. The aggregated series
+// are written into the block alongside the original ones.
+type AggregationRule struct {
+	// Matchers select the series to aggregate. They must not select the
+	// series produced by the rule.
+	Matchers []labels.Matcher
+	// By lists the labels that are kept from the selected series. If it is
+	// empty, all labels except those in Without are kept. Series with the
+	// same remaining labels are aggregated into one.
+	By      []string
+	Without []string
+	// Name, if set, replaces the metric name of the aggregated series.
+	Name string
+	Op   AggregationOp
+	// Interval is the step in milliseconds at which aggregated samples are
+	// computed. Each step aggregates the most recent sample of every series
+	// within the interval starting at it. Only samples of the block being
+	// written are considered; a step starting before the block is stamped
+	// with the block's start.
+	Interval int64
+}
+
+func (r *AggregationRule) validate() error {
+	if r.Interval <= 0 {
+		return errors.Errorf("invalid interval %d", r.Interval)
+	}
+	if len(r.Matchers) == 0 {
+		return errors.New("no matchers")
+	}
+	if r.Op < AggregateSum || r.Op > AggregateCount {
+		return errors.Errorf("unknown aggregation %d", r.Op)
+	}
+	return nil
+}
+
+// groupLabels returns the labels of the aggregated series the series with the
+// given labels belongs to.
+func (r *AggregationRule) groupLabels(lset labels.Labels) labels.Labels {
+	var res labels.Labels
+
+	for _, l := range lset {
+		if l.Name == metricNameLabel && r.Name != "" {
+			continue
+		}
+		if len(r.By) > 0 && !containsString(r.By, l.Name) {
+			continue
+		}
+		if len(r.By) == 0 && containsString(r.Without, l.Name) {
+			continue
+		}
+		res = append(res, l)
+	}
+	if r.Name != "" {
+		res = append(res, labels.Label{Name: metricNameLabel, Value: r.Name})
+		sort.Sort(res)
+	}
+	return res
+}
+
+func containsString(s []string, v string) bool {
+	for _, x := range s {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+// aggregate accumulates the values of a group of series at one step.
+type aggregate struct {
+	v float64
+	n int
+}
+
+func (a *aggregate) add(op AggregationOp, v float64) {
+	if a.n == 0 {
+		a.v = v
+	} else {
+		switch op {
+		case AggregateSum:
+			a.v += v
+		case AggregateMin:
+			a.v = math.Min(a.v, v)
+		case AggregateMax:
+			a.v = math.Max(a.v, v)
+		}
+	}
+	a.n++
+}
+
+func (a *aggregate) value(op AggregationOp) float64 {
+	if op == AggregateCount {
+		return float64(a.n)
+	}
+	return a.v
+}
+
+// aggregationStep returns the start of the step of the given interval that
+// holds the sample at t. Steps start at multiples of the interval, except
+// that a step starting before mint starts at mint.
+func aggregationStep(t, interval, mint int64) int64 {
+	// The remainder keeps the sign of t, which rounds negative timestamps up.
+	mod := t % interval
+	if mod < 0 {
+		mod += interval
+	}
+	if step := t - mod; step > mint {
+		return step
+	}
+	return mint
+}
+
+// aggregateBlock evaluates the rules against the samples of b within [mint, maxt)
+// and returns a head holding the aggregated series. If rules produce series
+// with the same labels, their identical samples are deduplicated, while
+// differing values at the same timestamp fail the evaluation.
+func aggregateBlock(b BlockReader, rules []AggregationRule, mint, maxt int64) (*Head, error) {
+	ir, err := b.Index()
+	if err != nil {
+		return nil, errors.Wrap(err, "open index reader")
+	}
+	defer ir.Close()
+
+	cr, err := b.Chunks()
+	if err != nil {
+		return nil, errors.Wrap(err, "open chunk reader")
+	}
+	defer cr.Close()
+
+	tr, err := b.Tombstones()
+	if err != nil {
+		return nil, errors.Wrap(err, "open tombstone reader")
+	}
+	defer tr.Close()
+
+	type group struct {
+		lset  labels.Labels
+		op    AggregationOp
+		steps map[int64]*aggregate
+	}
+	// Groups are distinct per rule even if their labels are equal.
+	type groupKey struct {
+		rule int
+		lset string
+	}
+	var (
+		groups = map[groupKey]*group{}
+		order  []*group
+	)
+	for i, r := range rules {
+		p, err := PostingsForMatchers(ir, r.Matchers...)
+		if err != nil {
+			return nil, errors.Wrapf(err, "rule %d: select series", i)
+		}
+		var (
+			lset labels.Labels
+			chks []chunks.Meta
+		)
+		for p.Next() {
+			if err := ir.Series(p.At(), &lset, &chks); err != nil {
+				if errors.Cause(err) == ErrNotFound {
+					continue
+				}
+				return nil, errors.Wrapf(err, "rule %d: read series", i)
+			}
+			intervals, err := tr.Get(p.At())
+			if err != nil {
+				return nil, errors.Wrapf(err, "rule %d: read tombstones", i)
+			}
+			glset := r.groupLabels(lset)
+			k := groupKey{rule: i, lset: glset.String()}
+
+			g, ok := groups[k]
+			if !ok {
+				g = &group{lset: glset, op: r.Op, steps: map[int64]*aggregate{}}
+				groups[k] = g
+				order = append(order, g)
+			}
+			// The most recent sample of the series within each step.
+			latest := map[int64]float64{}
+
+			for _, c := range chks {
+				if c.MaxTime < mint || c.MinTime >= maxt {
+					continue
+				}
+				chk, err := cr.Chunk(c.Ref)
+				if err != nil {
+					return nil, errors.Wrapf(err, "rule %d: read chunk", i)
+				}
+				it := chk.Iterator()
+				if len(intervals) > 0 {
+					it = &deletedIterator{it: it, intervals: intervals}
+				}
+				for it.Next() {
+					t, v := it.At()
+					if t < mint || t >= maxt || math.IsNaN(v) {
+						continue
+					}
+					latest[aggregationStep(t, r.Interval, mint)] = v
+				}
+				if err := it.Err(); err != nil {
+					return nil, errors.Wrapf(err, "rule %d: iterate chunk", i)
+				}
+			}
+			for step, v := range latest {
+				a, ok := g.steps[step]
+				if !ok {
+					a = &aggregate{}
+					g.steps[step] = a
+				}
+				a.add(r.Op, v)
+			}
+		}
+		if err := p.Err(); err != nil {
+			return nil, errors.Wrapf(err, "rule %d: select series", i)
+		}
+	}
+	// Append all samples in time order for the head to accept them.
+	type result struct {
+		g *group
+		t int64
+	}
+	var res []result
+	for _, g := range order {
+		for t := range g.steps {
+			res = append(res, result{g: g, t: t})
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].t != res[j].t {
+			return res[i].t < res[j].t
+		}
+		return labels.Compare(res[i].g.lset, res[j].g.lset) < 0
+	})
+
+	h, err := NewHead(nil, nil, nil, maxt-mint)
+	if err != nil {
+		return nil, err
+	}
+	app := h.Appender()
+
+	for i, r := range res {
+		v := r.g.steps[r.t].value(r.g.op)
+
+		// The head would keep an arbitrary one of several samples of a series
+		// with the same timestamp.
+		if i > 0 && res[i-1].t == r.t && res[i-1].g.lset.Equals(r.g.lset) {
+			prev := res[i-1].g.steps[r.t].value(res[i-1].g.op)
+			if math.Float64bits(prev) != math.Float64bits(v) {
+				app.Rollback()
+				h.Close()
+				return nil, errors.Errorf("conflicting aggregated samples for %s at %d: %v and %v", r.g.lset, r.t, prev, v)
+			}
+			continue
+		}
+		if _, err := app.Add(r.g.lset, r.t, v); err != nil {
+			app.Rollback()
+			h.Close()
+			return nil, errors.Wrapf(err, "add aggregated sample for %s", r.g.lset)
+		}
+	}
+	if err := app.Commit(); err != nil {
+		h.Close()
+		return nil, errors.Wrap(err, "commit aggregated samples")
+	}
+	return h, nil
+}
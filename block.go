@@ -17,6 +17,7 @@ package tsdb
 import (
 	"encoding/binary"
 	"encoding/json"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -24,6 +25,7 @@ import (
 
 	"github.com/oklog/ulid"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/tsdb/chunkenc"
 	"github.com/prometheus/tsdb/chunks"
 	"github.com/prometheus/tsdb/index"
@@ -59,10 +61,13 @@ type IndexWriter interface {
 }
 
 // IndexReader provides reading access of serialized index data.
+// Implementations must be safe for concurrent use by multiple goroutines.
+// The postings, string tuples and iterators they return are not and must only
+// be consumed by one goroutine at a time.
 type IndexReader interface {
-	// Symbols returns a set of string symbols that may occur in series' labels
-	// and indices.
-	Symbols() (map[string]struct{}, error)
+	// Symbols returns an iterator over the string symbols that may occur in
+	// series' labels and indices in sorted order.
+	Symbols() index.StringIter
 
 	// LabelValues returns the possible label values.
 	LabelValues(names ...string) (index.StringTuples, error)
@@ -73,6 +78,10 @@ type IndexReader interface {
 	// background garbage collections.
 	Postings(name, value string) (index.Postings, error)
 
+	// PrefixPostings returns the union of postings lists of all label pairs with
+	// the given name and a value starting with prefix.
+	PrefixPostings(name, prefix string) (index.Postings, error)
+
 	// SortedPostings returns a postings list that is reordered to be sorted
 	// by the label set of the underlying series.
 	SortedPostings(index.Postings) index.Postings
@@ -82,9 +91,22 @@ type IndexReader interface {
 	// Returns ErrNotFound if the ref does not resolve to a known series.
 	Series(ref uint64, lset *labels.Labels, chks *[]chunks.Meta) error
 
+	// SeriesStats returns the number of chunks, samples and bytes of the series
+	// identified by the reference without decoding its chunks.
+	// Returns ErrNotFound if the ref does not resolve to a known series.
+	SeriesStats(ref uint64) (index.SeriesStats, error)
+
 	// LabelIndices returns a list of string tuples for which a label value index exists.
 	LabelIndices() ([][]string, error)
 
+	// LabelSketches returns sketches estimating the number of values of each label name.
+	LabelSketches() (map[string]*index.HyperLogLog, error)
+
+	// PostingsStats returns the limit label pairs with the most series and
+	// with the largest postings lists in bytes. A limit of zero or less
+	// returns all label pairs.
+	PostingsStats(limit int) (*index.PostingsStats, error)
+
 	// Close releases the underlying resources of the reader.
 	Close() error
 }
@@ -111,6 +133,7 @@ type ChunkWriter interface {
 }
 
 // ChunkReader provides reading access of serialized time series data.
+// Implementations must be safe for concurrent use by multiple goroutines.
 type ChunkReader interface {
 	// Chunk returns the series data chunk with the given reference.
 	Chunk(ref uint64) (chunkenc.Chunk, error)
@@ -155,6 +178,38 @@ type BlockMeta struct {
 
 	// Version of the index format.
 	Version int `json:"version"`
+
+	// ExternalLabels identify the source of the block's data, e.g. its cluster
+	// and replica. They are not part of the series in the block.
+	ExternalLabels map[string]string `json:"externalLabels,omitempty"`
+
+	// PendingDeletion is set once the block is being deleted. Such blocks are
+	// never loaded and their deletion is retried until it succeeds.
+	PendingDeletion bool `json:"pendingDeletion,omitempty"`
+
+	// Checksums holds CRC32 checksums of the index and chunk files taken when
+	// the block was written. They are keyed by the slash-separated path of the
+	// files relative to the block directory.
+	Checksums map[string]uint32 `json:"checksums,omitempty"`
+
+	// Shards is the number of shards the series of the block are partitioned
+	// into by the hash of their labels. Each shard has its own index and chunks
+	// in a subdirectory of the block. Zero for unsharded blocks.
+	Shards int `json:"shards,omitempty"`
+
+	// RetentionOverride is set for blocks beyond the default retention that
+	// only hold series retained by overrides. It is the shortest retention in
+	// milliseconds of the overrides the series were selected by.
+	RetentionOverride uint64 `json:"retentionOverride,omitempty"`
+
+	// LabelRanges hold the smallest and largest values of selected labels
+	// with numeric values, which allow to skip the block for queries whose
+	// matchers select values outside of them.
+	LabelRanges map[string]LabelRange `json:"labelRanges,omitempty"`
+
+	// TimestampUnit is the unit of the timestamps in the block. Empty for
+	// milliseconds.
+	TimestampUnit TimestampUnit `json:"timestampUnit,omitempty"`
 }
 
 // BlockStats contains stats about contents of a block.
@@ -182,12 +237,63 @@ type BlockMetaCompaction struct {
 	// Short descriptions of the direct blocks that were used to create
 	// this block.
 	Parents []BlockDesc `json:"parents,omitempty"`
-	Failed  bool        `json:"failed,omitempty"`
+	// Failed is set once compacting the block failed too often. Such blocks
+	// are no longer considered for compaction.
+	Failed bool `json:"failed,omitempty"`
+	// Number of failed attempts to compact the block.
+	Failures int `json:"failures,omitempty"`
+	// Records of the creation of the block and of all blocks it was created
+	// from, ordered by time.
+	History []CompactionRecord `json:"history,omitempty"`
+}
+
+// CompactionRecord describes the creation of a block.
+type CompactionRecord struct {
+	ULID  ulid.ULID `json:"ulid"`
+	Level int       `json:"level"`
+	// ULIDs of the blocks the block was created from. It is empty for blocks
+	// persisted from the head.
+	Parents []ulid.ULID `json:"parents,omitempty"`
+	// Time of the creation in milliseconds since epoch, as encoded in the ULID.
+	// If ULIDs are deterministic, it is the maximum timestamp of the block's
+	// data instead.
+	Time int64 `json:"time"`
 }
 
 const indexFilename = "index"
 const metaFilename = "meta.json"
 
+// removeBlockDir deletes the block in dir. The block is marked for deletion in
+// its meta file first, which is removed last. Deleting files may fail while they
+// are still in use, e.g. memory mapped on Windows. The marker then ensures that
+// the partially deleted block is not loaded again and the deletion is retried.
+// Files are removed through the throttle, which may be nil.
+func removeBlockDir(dir string, t *deletionThrottle) error {
+	if meta, err := readMetaFile(dir); err == nil && !meta.PendingDeletion {
+		meta.PendingDeletion = true
+
+		if err := writeMetaFile(dir, meta); err != nil {
+			return errors.Wrap(err, "mark block for deletion")
+		}
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, f := range files {
+		if f.Name() == metaFilename {
+			continue
+		}
+		if err := t.removeAll(filepath.Join(dir, f.Name())); err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(dir)
+}
+
 func chunkDir(dir string) string { return filepath.Join(dir, "chunks") }
 
 func readMetaFile(dir string) (*BlockMeta, error) {
@@ -207,6 +313,211 @@ func readMetaFile(dir string) (*BlockMeta, error) {
 	return &m, nil
 }
 
+// checksummedFiles returns the slash-separated paths of the index and chunk
+// files of the block in dir, relative to dir.
+func checksummedFiles(dir string) ([]string, error) {
+	shards, err := ioutil.ReadDir(filepath.Join(dir, shardsDirname))
+	if os.IsNotExist(err) {
+		return dataFiles(dir, "")
+	}
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+
+	for _, s := range shards {
+		fs, err := dataFiles(filepath.Join(dir, shardsDirname, s.Name()), shardsDirname+"/"+s.Name()+"/")
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, fs...)
+	}
+	return files, nil
+}
+
+// dataFiles returns the index and chunk files in dir with the given prefix.
+func dataFiles(dir, prefix string) ([]string, error) {
+	files := []string{prefix + indexFilename}
+
+	if _, err := os.Stat(index.PostingsFilename(filepath.Join(dir, indexFilename))); err == nil {
+		files = append(files, prefix+filepath.Base(index.PostingsFilename(indexFilename)))
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	seqs, err := sequenceFiles(chunkDir(dir))
+	if err != nil {
+		return nil, err
+	}
+	for _, fn := range seqs {
+		files = append(files, prefix+"chunks/"+filepath.Base(fn))
+	}
+	return files, nil
+}
+
+// blockChecksums returns the checksums of the files of the block in dir. If
+// wrap is set, the files are read through the readers it returns.
+func blockChecksums(dir string, wrap func(io.Reader) io.Reader) (map[string]uint32, error) {
+	files, err := checksummedFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	sums := make(map[string]uint32, len(files))
+
+	for _, fn := range files {
+		sum, err := fileChecksum(filepath.Join(dir, filepath.FromSlash(fn)), wrap)
+		if err != nil {
+			return nil, err
+		}
+		sums[fn] = sum
+	}
+	return sums, nil
+}
+
+func fileChecksum(fn string, wrap func(io.Reader) io.Reader) (uint32, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if wrap != nil {
+		r = wrap(f)
+	}
+	h := newCRC32()
+	if _, err := io.Copy(h, r); err != nil {
+		return 0, errors.Wrapf(err, "read %s", fn)
+	}
+	return h.Sum32(), nil
+}
+
+// VerifyBlock compares the index and chunk files of the block in dir against
+// the checksums recorded in its meta file. Unlike opening the block, it detects
+// corruptions without decoding the files. Blocks written before checksums were
+// recorded are not verified.
+func VerifyBlock(dir string) error {
+	return verifyChecksums(dir, nil)
+}
+
+// verifyChecksums is like VerifyBlock but reads the files through the readers
+// returned by wrap if it is set.
+func verifyChecksums(dir string, wrap func(io.Reader) io.Reader) error {
+	meta, err := readMetaFile(dir)
+	if err != nil {
+		return errors.Wrap(err, "read meta")
+	}
+	if meta.Checksums == nil {
+		return nil
+	}
+	sums, err := blockChecksums(dir, wrap)
+	if err != nil {
+		return errors.Wrap(err, "compute checksums")
+	}
+	var merr MultiError
+
+	for fn, exp := range meta.Checksums {
+		sum, ok := sums[fn]
+		if !ok {
+			merr.Add(errors.Errorf("file %s missing", fn))
+		} else if sum != exp {
+			merr.Add(errors.Errorf("checksum mismatch for %s: expected %08x, got %08x", fn, exp, sum))
+		}
+	}
+	for fn := range sums {
+		if _, ok := meta.Checksums[fn]; !ok {
+			merr.Add(errors.Errorf("unexpected file %s", fn))
+		}
+	}
+	return merr.Err()
+}
+
+// VerifyBlockOrder checks that the series of the block in dir are stored in
+// increasing order of their label sets and that all postings lists are sorted
+// by series reference. Queries and compactions merge series and postings
+// relying on both and silently return wrong results for blocks violating them.
+func VerifyBlockOrder(dir string) error {
+	meta, err := readMetaFile(dir)
+	if err != nil {
+		return errors.Wrap(err, "read meta")
+	}
+	for _, d := range dataDirs(dir, meta) {
+		ir, err := openIndexReader(d, false)
+		if err != nil {
+			return errors.Wrap(err, "open index")
+		}
+		err = verifyIndexOrder(ir)
+		ir.Close()
+		if err != nil {
+			return errors.Wrapf(err, "verify index in %s", d)
+		}
+	}
+	return nil
+}
+
+func verifyIndexOrder(ir IndexReader) error {
+	p, err := ir.Postings(index.AllPostingsKey())
+	if err != nil {
+		return errors.Wrap(err, "read all postings")
+	}
+	var (
+		lset, prev labels.Labels
+		chks       []chunks.Meta
+		first      = true
+	)
+	for p.Next() {
+		if err := ir.Series(p.At(), &lset, &chks); err != nil {
+			return errors.Wrapf(err, "read series %d", p.At())
+		}
+		if !first && labels.Compare(lset, prev) <= 0 {
+			return errors.Errorf("series %s with reference %d not sorted after %s", lset, p.At(), prev)
+		}
+		prev, first = append(prev[:0], lset...), false
+	}
+	if p.Err() != nil {
+		return errors.Wrap(p.Err(), "iterate all postings")
+	}
+	names, err := ir.LabelIndices()
+	if err != nil {
+		return errors.Wrap(err, "read label indices")
+	}
+	an, av := index.AllPostingsKey()
+	pairs := [][2]string{{an, av}}
+
+	for _, n := range names {
+		if len(n) != 1 {
+			continue
+		}
+		tpls, err := ir.LabelValues(n[0])
+		if err != nil {
+			return errors.Wrapf(err, "read values of label %q", n[0])
+		}
+		for i := 0; i < tpls.Len(); i++ {
+			v, err := tpls.At(i)
+			if err != nil {
+				return errors.Wrapf(err, "read values of label %q", n[0])
+			}
+			pairs = append(pairs, [2]string{n[0], v[0]})
+		}
+	}
+	for _, l := range pairs {
+		p, err := ir.Postings(l[0], l[1])
+		if err != nil {
+			return errors.Wrapf(err, "read postings %s=%q", l[0], l[1])
+		}
+		var last uint64
+		for i := 0; p.Next(); i++ {
+			if i > 0 && p.At() <= last {
+				return errors.Errorf("postings %s=%q: reference %d not sorted after %d", l[0], l[1], p.At(), last)
+			}
+			last = p.At()
+		}
+		if p.Err() != nil {
+			return errors.Wrapf(p.Err(), "iterate postings %s=%q", l[0], l[1])
+		}
+	}
+	return nil
+}
+
 func writeMetaFile(dir string, meta *BlockMeta) error {
 	meta.Version = 1
 
@@ -250,27 +561,68 @@ type Block struct {
 	chunkr     ChunkReader
 	indexr     IndexReader
 	tombstones TombstoneReader
+
+	// chunkCache is consulted before chunks are read if set.
+	chunkCache ChunkCache
+	// readMetrics counts reads of the block if set.
+	readMetrics *blockReadMetrics
 }
 
 // OpenBlock opens the block in the directory. It can be passed a chunk pool, which is used
 // to instantiate chunk structs.
 func OpenBlock(dir string, pool chunkenc.Pool) (*Block, error) {
+	return openBlock(dir, pool, false)
+}
+
+// openBlock opens the block in the directory. If pread is set, its files are
+// read with pread instead of being mapped into memory.
+func openBlock(dir string, pool chunkenc.Pool, pread bool) (*Block, error) {
 	meta, err := readMetaFile(dir)
 	if err != nil {
 		return nil, err
 	}
+	if meta.Shards > 0 {
+		return openShardedBlock(dir, meta, pool, pread)
+	}
+	ir, err := openIndexReader(dir, pread)
+	if err != nil {
+		return nil, err
+	}
+	return openBlockWithIndex(dir, pool, pread, ir)
+}
+
+func openIndexReader(dir string, pread bool) (*index.Reader, error) {
+	if pread {
+		return index.NewPreadFileReader(filepath.Join(dir, indexFilename))
+	}
+	return index.NewFileReader(filepath.Join(dir, indexFilename))
+}
+
+func openChunkReader(dir string, pool chunkenc.Pool, pread bool) (*chunks.Reader, error) {
+	if pread {
+		return chunks.NewPreadDirReader(chunkDir(dir), pool)
+	}
+	return chunks.NewDirReader(chunkDir(dir), pool)
+}
 
-	cr, err := chunks.NewDirReader(chunkDir(dir), pool)
+// openBlockWithIndex opens the block in the directory with the given index
+// reader. The index reader is closed if opening the block fails.
+func openBlockWithIndex(dir string, pool chunkenc.Pool, pread bool, ir *index.Reader) (*Block, error) {
+	meta, err := readMetaFile(dir)
 	if err != nil {
+		ir.Close()
 		return nil, err
 	}
-	ir, err := index.NewFileReader(filepath.Join(dir, "index"))
+	cr, err := openChunkReader(dir, pool, pread)
 	if err != nil {
+		ir.Close()
 		return nil, err
 	}
 
 	tr, err := readTombstones(dir)
 	if err != nil {
+		ir.Close()
+		cr.Close()
 		return nil, err
 	}
 
@@ -295,6 +647,62 @@ func OpenBlock(dir string, pool chunkenc.Pool) (*Block, error) {
 	return pb, nil
 }
 
+// openShardedBlock opens the block in the directory whose series are partitioned
+// into shards. Its readers fan out across the indices and chunks of all shards.
+func openShardedBlock(dir string, meta *BlockMeta, pool chunkenc.Pool, pread bool) (*Block, error) {
+	var (
+		ir = &shardedIndexReader{}
+		cr = &shardedChunkReader{}
+	)
+	closeReaders := func() {
+		ir.Close()
+		cr.Close()
+	}
+	for i, d := range dataDirs(dir, meta) {
+		sir, err := openIndexReader(d, pread)
+		if err != nil {
+			closeReaders()
+			return nil, errors.Wrapf(err, "open index of shard %d", i)
+		}
+		ir.shards = append(ir.shards, sir)
+
+		scr, err := openChunkReader(d, pool, pread)
+		if err != nil {
+			closeReaders()
+			return nil, errors.Wrapf(err, "open chunks of shard %d", i)
+		}
+		cr.shards = append(cr.shards, scr)
+	}
+	tr, err := readTombstones(dir)
+	if err != nil {
+		closeReaders()
+		return nil, err
+	}
+	// The symbol table size is that of an unsharded index of the same series.
+	syms := ir.Symbols()
+	tmp := make([]byte, 8)
+	symTblSize := uint64(0)
+	for syms.Next() {
+		s := syms.At()
+		symTblSize += uint64(binary.PutUvarint(tmp, uint64(len(s))))
+		symTblSize += uint64(len(s))
+	}
+	if err := syms.Err(); err != nil {
+		closeReaders()
+		return nil, errors.Wrap(err, "read symbols")
+	}
+
+	pb := &Block{
+		dir:             dir,
+		meta:            *meta,
+		chunkr:          cr,
+		indexr:          ir,
+		tombstones:      tr,
+		symbolTableSize: symTblSize,
+	}
+	return pb, nil
+}
+
 // Close closes the on-disk block. It blocks as long as there are readers reading from the block.
 func (pb *Block) Close() error {
 	pb.mtx.Lock()
@@ -322,6 +730,11 @@ func (pb *Block) Dir() string { return pb.dir }
 // Meta returns meta information about the block.
 func (pb *Block) Meta() BlockMeta { return pb.meta }
 
+// ExternalLabels returns the external labels the block was created with.
+func (pb *Block) ExternalLabels() labels.Labels {
+	return labels.FromMap(pb.meta.ExternalLabels)
+}
+
 // ErrClosing is returned when a block is in the process of being closed.
 var ErrClosing = errors.New("block is closing")
 
@@ -341,7 +754,11 @@ func (pb *Block) Index() (IndexReader, error) {
 	if err := pb.startRead(); err != nil {
 		return nil, err
 	}
-	return blockIndexReader{ir: pb.indexr, b: pb}, nil
+	return blockIndexReader{
+		ir:       pb.indexr,
+		b:        pb,
+		postings: pb.readMetrics.forBlock(pb.meta.ULID).postingsLookups,
+	}, nil
 }
 
 // Chunks returns a new ChunkReader against the block data.
@@ -349,7 +766,23 @@ func (pb *Block) Chunks() (ChunkReader, error) {
 	if err := pb.startRead(); err != nil {
 		return nil, err
 	}
-	return blockChunkReader{ChunkReader: pb.chunkr, b: pb}, nil
+	var (
+		cr = pb.chunkr
+		rc = pb.readMetrics.forBlock(pb.meta.ULID)
+	)
+	if rc.chunkBytesRead != nil {
+		cr = &meteredChunkReader{ChunkReader: cr, bytes: rc.chunkBytesRead}
+	}
+	if pb.chunkCache != nil {
+		cr = &cachedChunkReader{
+			ChunkReader: cr,
+			cache:       pb.chunkCache,
+			block:       pb.meta.ULID,
+			hits:        rc.chunkCacheHits,
+			misses:      rc.chunkCacheMiss,
+		}
+	}
+	return blockChunkReader{ChunkReader: cr, b: pb}, nil
 }
 
 // Tombstones returns a new TombstoneReader against the block data.
@@ -370,14 +803,26 @@ func (pb *Block) setCompactionFailed() error {
 	return writeMetaFile(pb.dir, &pb.meta)
 }
 
+// recordCompactionFailure counts a failed attempt to compact the block. After
+// maxAttempts failures the block is marked as failed.
+func (pb *Block) recordCompactionFailure(maxAttempts int) error {
+	pb.meta.Compaction.Failures++
+	if pb.meta.Compaction.Failures >= maxAttempts {
+		pb.meta.Compaction.Failed = true
+	}
+	return writeMetaFile(pb.dir, &pb.meta)
+}
+
 type blockIndexReader struct {
 	ir IndexReader
 	b  *Block
+
+	// postings counts postings lookups if set.
+	postings prometheus.Counter
 }
 
-func (r blockIndexReader) Symbols() (map[string]struct{}, error) {
-	s, err := r.ir.Symbols()
-	return s, errors.Wrapf(err, "block: %s", r.b.Meta().ULID)
+func (r blockIndexReader) Symbols() index.StringIter {
+	return r.ir.Symbols()
 }
 
 func (r blockIndexReader) LabelValues(names ...string) (index.StringTuples, error) {
@@ -386,10 +831,21 @@ func (r blockIndexReader) LabelValues(names ...string) (index.StringTuples, erro
 }
 
 func (r blockIndexReader) Postings(name, value string) (index.Postings, error) {
+	if r.postings != nil {
+		r.postings.Inc()
+	}
 	p, err := r.ir.Postings(name, value)
 	return p, errors.Wrapf(err, "block: %s", r.b.Meta().ULID)
 }
 
+func (r blockIndexReader) PrefixPostings(name, prefix string) (index.Postings, error) {
+	if r.postings != nil {
+		r.postings.Inc()
+	}
+	p, err := r.ir.PrefixPostings(name, prefix)
+	return p, errors.Wrapf(err, "block: %s", r.b.Meta().ULID)
+}
+
 func (r blockIndexReader) SortedPostings(p index.Postings) index.Postings {
 	return r.ir.SortedPostings(p)
 }
@@ -402,11 +858,26 @@ func (r blockIndexReader) Series(ref uint64, lset *labels.Labels, chks *[]chunks
 	)
 }
 
+func (r blockIndexReader) SeriesStats(ref uint64) (index.SeriesStats, error) {
+	s, err := r.ir.SeriesStats(ref)
+	return s, errors.Wrapf(err, "block: %s", r.b.Meta().ULID)
+}
+
 func (r blockIndexReader) LabelIndices() ([][]string, error) {
 	ss, err := r.ir.LabelIndices()
 	return ss, errors.Wrapf(err, "block: %s", r.b.Meta().ULID)
 }
 
+func (r blockIndexReader) LabelSketches() (map[string]*index.HyperLogLog, error) {
+	s, err := r.ir.LabelSketches()
+	return s, errors.Wrapf(err, "block: %s", r.b.Meta().ULID)
+}
+
+func (r blockIndexReader) PostingsStats(limit int) (*index.PostingsStats, error) {
+	s, err := r.ir.PostingsStats(limit)
+	return s, errors.Wrapf(err, "block: %s", r.b.Meta().ULID)
+}
+
 func (r blockIndexReader) Close() error {
 	r.b.pendingReaders.Done()
 	return nil
@@ -524,24 +995,46 @@ func (pb *Block) Snapshot(dir string) error {
 		return errors.Wrap(err, "create snapshot block dir")
 	}
 
-	chunksDir := chunkDir(blockDir)
-	if err := os.MkdirAll(chunksDir, 0777); err != nil {
-		return errors.Wrap(err, "create snapshot chunk dir")
-	}
-
-	// Hardlink meta, index and tombstones
+	// Hardlink meta and tombstones
 	for _, fname := range []string{
 		metaFilename,
-		indexFilename,
 		tombstoneFilename,
 	} {
 		if err := os.Link(filepath.Join(pb.dir, fname), filepath.Join(blockDir, fname)); err != nil {
 			return errors.Wrapf(err, "create snapshot %s", fname)
 		}
 	}
+	if pb.meta.Shards == 0 {
+		return snapshotData(pb.dir, blockDir)
+	}
+	for i := 0; i < pb.meta.Shards; i++ {
+		if err := snapshotData(shardDir(pb.dir, i), shardDir(blockDir, i)); err != nil {
+			return errors.Wrapf(err, "shard %d", i)
+		}
+	}
+	return nil
+}
+
+// snapshotData hardlinks the index and chunks in src into dst.
+func snapshotData(src, dst string) error {
+	chunksDir := chunkDir(dst)
+	if err := os.MkdirAll(chunksDir, 0777); err != nil {
+		return errors.Wrap(err, "create snapshot chunk dir")
+	}
+
+	// Hardlink the index
+	if err := os.Link(filepath.Join(src, indexFilename), filepath.Join(dst, indexFilename)); err != nil {
+		return errors.Wrapf(err, "create snapshot %s", indexFilename)
+	}
+	pfn := index.PostingsFilename(indexFilename)
+	if _, err := os.Stat(filepath.Join(src, pfn)); err == nil {
+		if err := os.Link(filepath.Join(src, pfn), filepath.Join(dst, pfn)); err != nil {
+			return errors.Wrapf(err, "create snapshot %s", pfn)
+		}
+	}
 
 	// Hardlink the chunks
-	curChunkDir := chunkDir(pb.dir)
+	curChunkDir := chunkDir(src)
 	files, err := ioutil.ReadDir(curChunkDir)
 	if err != nil {
 		return errors.Wrap(err, "ReadDir the current chunk dir")
@@ -0,0 +1,121 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"time"
+
+	"github.com/oklog/ulid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/tsdb/chunkenc"
+)
+
+// blockAgeBuckets are the upper bounds of the age buckets by which block read
+// metrics are labeled. Blocks older than the last bound are labeled "+Inf".
+var blockAgeBuckets = []struct {
+	age   time.Duration
+	label string
+}{
+	{age: 6 * time.Hour, label: "6h"},
+	{age: 24 * time.Hour, label: "1d"},
+	{age: 7 * 24 * time.Hour, label: "7d"},
+	{age: 30 * 24 * time.Hour, label: "30d"},
+}
+
+// blockAgeLabel returns the age bucket of the block with the given ULID. The
+// age of a block is the time since the timestamp of its ULID.
+func blockAgeLabel(id ulid.ULID, now time.Time) string {
+	age := now.Sub(ulid.Time(id.Time()))
+
+	for _, b := range blockAgeBuckets {
+		if age <= b.age {
+			return b.label
+		}
+	}
+	return "+Inf"
+}
+
+// blockReadMetrics counts reads of persisted blocks by their age, which shows
+// whether queries mostly hit recent or old blocks.
+type blockReadMetrics struct {
+	postingsLookups *prometheus.CounterVec
+	chunkBytesRead  *prometheus.CounterVec
+	chunkCacheHits  *prometheus.CounterVec
+	chunkCacheMiss  *prometheus.CounterVec
+}
+
+func newBlockReadMetrics(r prometheus.Registerer) *blockReadMetrics {
+	m := &blockReadMetrics{
+		postingsLookups: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "prometheus_tsdb_block_postings_lookups_total",
+			Help: "Number of postings lists looked up in the index of blocks, by block age.",
+		}, []string{"age"}),
+		chunkBytesRead: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "prometheus_tsdb_block_chunk_bytes_read_total",
+			Help: "Number of bytes of chunk data read from the chunk files of blocks, by block age.",
+		}, []string{"age"}),
+		chunkCacheHits: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "prometheus_tsdb_block_chunk_cache_hits_total",
+			Help: "Number of chunks of blocks read from the chunk cache, by block age.",
+		}, []string{"age"}),
+		chunkCacheMiss: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "prometheus_tsdb_block_chunk_cache_misses_total",
+			Help: "Number of chunks of blocks not found in the chunk cache, by block age.",
+		}, []string{"age"}),
+	}
+	if r != nil {
+		r.MustRegister(m.postingsLookups, m.chunkBytesRead, m.chunkCacheHits, m.chunkCacheMiss)
+	}
+	return m
+}
+
+// blockReadCounters are the read metrics of a single block. Nil counters are
+// not updated.
+type blockReadCounters struct {
+	postingsLookups prometheus.Counter
+	chunkBytesRead  prometheus.Counter
+	chunkCacheHits  prometheus.Counter
+	chunkCacheMiss  prometheus.Counter
+}
+
+// forBlock returns the counters of the block with the given ULID at its
+// current age.
+func (m *blockReadMetrics) forBlock(id ulid.ULID) blockReadCounters {
+	if m == nil {
+		return blockReadCounters{}
+	}
+	age := blockAgeLabel(id, time.Now())
+
+	return blockReadCounters{
+		postingsLookups: m.postingsLookups.WithLabelValues(age),
+		chunkBytesRead:  m.chunkBytesRead.WithLabelValues(age),
+		chunkCacheHits:  m.chunkCacheHits.WithLabelValues(age),
+		chunkCacheMiss:  m.chunkCacheMiss.WithLabelValues(age),
+	}
+}
+
+// meteredChunkReader counts the bytes of chunk data read.
+type meteredChunkReader struct {
+	ChunkReader
+	bytes prometheus.Counter
+}
+
+func (r *meteredChunkReader) Chunk(ref uint64) (chunkenc.Chunk, error) {
+	c, err := r.ChunkReader.Chunk(ref)
+	if err != nil {
+		return nil, err
+	}
+	r.bytes.Add(float64(len(c.Bytes())))
+	return c, nil
+}
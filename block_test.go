@@ -15,12 +15,18 @@ package tsdb
 
 import (
 	"io/ioutil"
+	"math"
 	"math/rand"
 	"os"
 	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/tsdb/chunks"
 	"github.com/prometheus/tsdb/index"
 	"github.com/prometheus/tsdb/labels"
 	"github.com/prometheus/tsdb/testutil"
@@ -58,6 +64,227 @@ func TestSetCompactionFailed(t *testing.T) {
 	testutil.Equals(t, true, b.meta.Compaction.Failed)
 }
 
+func TestOpenBlock_Pread(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "test")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	b := createPopulatedBlock(t, tmpdir, 10, 20)
+	defer b.Close()
+
+	pb, err := openBlock(b.Dir(), nil, true)
+	testutil.Ok(t, err)
+	defer pb.Close()
+
+	q, err := NewBlockQuerier(b, math.MinInt64, math.MaxInt64)
+	testutil.Ok(t, err)
+	defer q.Close()
+
+	pq, err := NewBlockQuerier(pb, math.MinInt64, math.MaxInt64)
+	testutil.Ok(t, err)
+	defer pq.Close()
+
+	m := labels.NewMustRegexpMatcher("", ".*")
+	exp := query(t, q, m)
+	testutil.Equals(t, 10, len(exp))
+	testutil.Equals(t, exp, query(t, pq, m))
+}
+
+func TestVerifyBlock(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "test")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	b := createPopulatedBlock(t, tmpdir, 10, 20)
+	testutil.Ok(t, b.Close())
+
+	meta := b.Meta()
+	testutil.Equals(t, 2, len(meta.Checksums))
+	testutil.Ok(t, VerifyBlock(b.Dir()))
+
+	// Tombstones are not covered as they change after the block was written.
+	testutil.Ok(t, writeTombstoneFile(b.Dir(), NewMemTombstones()))
+	testutil.Ok(t, VerifyBlock(b.Dir()))
+
+	fn := filepath.Join(chunkDir(b.Dir()), "000001")
+	data, err := ioutil.ReadFile(fn)
+	testutil.Ok(t, err)
+	data[len(data)/2] ^= 0xff
+	testutil.Ok(t, ioutil.WriteFile(fn, data, 0666))
+
+	testutil.NotOk(t, VerifyBlock(b.Dir()))
+
+	// Blocks without checksums are not verified.
+	meta.Checksums = nil
+	testutil.Ok(t, writeMetaFile(b.Dir(), &meta))
+	testutil.Ok(t, VerifyBlock(b.Dir()))
+}
+
+func TestVerifyBlockOrder(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "test")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	b := createPopulatedBlock(t, tmpdir, 10, 20)
+	testutil.Ok(t, b.Close())
+	testutil.Ok(t, VerifyBlockOrder(b.Dir()))
+
+	newIndex := func() mockIndex {
+		ix := newMockIndex()
+		testutil.Ok(t, ix.AddSeries(1, labels.FromStrings("a", "1")))
+		testutil.Ok(t, ix.AddSeries(2, labels.FromStrings("a", "2")))
+		testutil.Ok(t, ix.WriteLabelIndex([]string{"a"}, []string{"1", "2"}))
+		testutil.Ok(t, ix.WritePostings("a", "1", index.NewListPostings([]uint64{1})))
+		testutil.Ok(t, ix.WritePostings("a", "2", index.NewListPostings([]uint64{2})))
+		return ix
+	}
+	ix := newIndex()
+	testutil.Ok(t, ix.WritePostings("", "", index.NewListPostings([]uint64{1, 2})))
+	testutil.Ok(t, verifyIndexOrder(ix))
+
+	// Series not sorted by their labels.
+	ix = newIndex()
+	testutil.Ok(t, ix.WritePostings("", "", index.NewListPostings([]uint64{2, 1})))
+	testutil.NotOk(t, verifyIndexOrder(ix))
+
+	// Postings not sorted by reference.
+	ix = newIndex()
+	testutil.Ok(t, ix.WritePostings("", "", index.NewListPostings([]uint64{1, 2})))
+	ix.postings[labels.Label{Name: "a", Value: "1"}] = []uint64{2, 1}
+	testutil.NotOk(t, verifyIndexOrder(ix))
+}
+
+func TestOpenBlock_Corrupt(t *testing.T) {
+	for _, fn := range []string{indexFilename, tombstoneFilename} {
+		t.Run(fn, func(t *testing.T) {
+			tmpdir, err := ioutil.TempDir("", "test")
+			testutil.Ok(t, err)
+			defer os.RemoveAll(tmpdir)
+
+			b := createPopulatedBlock(t, tmpdir, 10, 20)
+			testutil.Ok(t, b.Close())
+
+			path := filepath.Join(b.Dir(), fn)
+			data, err := ioutil.ReadFile(path)
+			testutil.Ok(t, err)
+			// Damage the checksum at the end of the file.
+			data[len(data)-1] ^= 0xff
+			testutil.Ok(t, ioutil.WriteFile(path, data, 0666))
+
+			_, err = OpenBlock(b.Dir(), nil)
+			testutil.NotOk(t, err)
+			testutil.Assert(t, IsCorrupt(err), "unexpected error: %s", err)
+			testutil.Equals(t, path, errors.Cause(err).(*ErrCorrupt).File)
+		})
+	}
+}
+
+func TestBlock_ConcurrentReads(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "test")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	b := createPopulatedBlock(t, tmpdir, 100, 300)
+	defer b.Close()
+
+	testutil.Ok(t, readConcurrently(b, 8, 20))
+}
+
+// readConcurrently reads all series and chunks of b from several goroutines
+// sharing the same index and chunk readers. It is meant to be run with the
+// race detector enabled.
+func readConcurrently(b BlockReader, workers, iterations int) error {
+	ir, err := b.Index()
+	if err != nil {
+		return err
+	}
+	defer ir.Close()
+
+	cr, err := b.Chunks()
+	if err != nil {
+		return err
+	}
+	defer cr.Close()
+
+	var (
+		wg   sync.WaitGroup
+		errc = make(chan error, workers)
+	)
+	read := func() error {
+		names, err := ir.LabelIndices()
+		if err != nil {
+			return errors.Wrap(err, "label indices")
+		}
+		for _, n := range names {
+			tpls, err := ir.LabelValues(n...)
+			if err != nil {
+				return errors.Wrap(err, "label values")
+			}
+			for i := 0; i < tpls.Len(); i++ {
+				if _, err := tpls.At(i); err != nil {
+					return errors.Wrap(err, "label value")
+				}
+			}
+		}
+		syms := ir.Symbols()
+		for syms.Next() {
+		}
+		if err := syms.Err(); err != nil {
+			return errors.Wrap(err, "symbols")
+		}
+		p, err := ir.Postings(index.AllPostingsKey())
+		if err != nil {
+			return errors.Wrap(err, "postings")
+		}
+		p = ir.SortedPostings(p)
+
+		var (
+			lset labels.Labels
+			chks []chunks.Meta
+		)
+		for p.Next() {
+			if err := ir.Series(p.At(), &lset, &chks); err != nil {
+				if errors.Cause(err) == ErrNotFound {
+					continue
+				}
+				return errors.Wrap(err, "series")
+			}
+			for _, c := range chks {
+				chk, err := cr.Chunk(c.Ref)
+				if err != nil {
+					if errors.Cause(err) == ErrNotFound {
+						continue
+					}
+					return errors.Wrap(err, "chunk")
+				}
+				it := chk.Iterator()
+				for it.Next() {
+				}
+				if err := it.Err(); err != nil {
+					return errors.Wrap(err, "iterate chunk")
+				}
+			}
+		}
+		return errors.Wrap(p.Err(), "postings")
+	}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < iterations; j++ {
+				if err := read(); err != nil {
+					errc <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errc)
+
+	return <-errc
+}
+
 // createEmpty block creates a block with the given meta but without any data.
 func createEmptyBlock(t *testing.T, dir string, meta *BlockMeta) *Block {
 	testutil.Ok(t, os.MkdirAll(dir, 0777))
@@ -117,3 +344,23 @@ func createPopulatedBlock(tb testing.TB, dir string, nSeries, nSamples int) *Blo
 	testutil.Ok(tb, err)
 	return blk
 }
+
+func TestBlockAgeLabel(t *testing.T) {
+	now := time.Now()
+
+	cases := []struct {
+		age time.Duration
+		exp string
+	}{
+		{age: 0, exp: "6h"},
+		{age: 5 * time.Hour, exp: "6h"},
+		{age: 7 * time.Hour, exp: "1d"},
+		{age: 3 * 24 * time.Hour, exp: "7d"},
+		{age: 10 * 24 * time.Hour, exp: "30d"},
+		{age: 365 * 24 * time.Hour, exp: "+Inf"},
+	}
+	for _, c := range cases {
+		id := ulid.MustNew(ulid.Timestamp(now.Add(-c.age)), nil)
+		testutil.Equals(t, c.exp, blockAgeLabel(id, now))
+	}
+}
@@ -157,6 +157,7 @@ func Checkpoint(w *wal.WAL, from, to int, keep func(id uint64) bool, mint int64)
 	var (
 		series  []RefSeries
 		samples []RefSample
+		ints    []RefIntSample
 		tstones []Stone
 		dec     RecordDecoder
 		enc     RecordEncoder
@@ -164,7 +165,7 @@ func Checkpoint(w *wal.WAL, from, to int, keep func(id uint64) bool, mint int64)
 		recs    [][]byte
 	)
 	for r.Next() {
-		series, samples, tstones = series[:0], samples[:0], tstones[:0]
+		series, samples, ints, tstones = series[:0], samples[:0], ints[:0], tstones[:0]
 
 		// We don't reset the buffer since we batch up multiple records
 		// before writing them to the checkpoint.
@@ -209,6 +210,23 @@ func Checkpoint(w *wal.WAL, from, to int, keep func(id uint64) bool, mint int64)
 			stats.TotalSamples += len(samples)
 			stats.DroppedSamples += len(samples) - len(repl)
 
+		case RecordIntSamples:
+			ints, err = dec.IntSamples(rec, ints)
+			if err != nil {
+				return nil, errors.Wrap(err, "decode integer samples")
+			}
+			repl := ints[:0]
+			for _, s := range ints {
+				if s.T >= mint {
+					repl = append(repl, s)
+				}
+			}
+			if len(repl) > 0 {
+				buf = enc.IntSamples(repl, buf)
+			}
+			stats.TotalSamples += len(ints)
+			stats.DroppedSamples += len(ints) - len(repl)
+
 		case RecordTombstones:
 			tstones, err = dec.Tombstones(rec, tstones)
 			if err != nil {
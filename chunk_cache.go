@@ -0,0 +1,150 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/oklog/ulid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/tsdb/chunkenc"
+)
+
+// ChunkCache caches the data of chunks of persisted blocks. It is consulted
+// before chunks are read from disk. Chunks of a block never change, so
+// entries do not have to be invalidated. Implementations, e.g. backed by
+// memcached or Redis, must be safe for concurrent use.
+type ChunkCache interface {
+	// Get returns the cached data of the chunk with the given reference in
+	// the block.
+	Get(block ulid.ULID, ref uint64) ([]byte, bool)
+	// Set caches the data of a chunk. The data must not be modified afterwards.
+	Set(block ulid.ULID, ref uint64, data []byte)
+}
+
+type chunkCacheKey struct {
+	block ulid.ULID
+	ref   uint64
+}
+
+type chunkCacheEntry struct {
+	key  chunkCacheKey
+	data []byte
+}
+
+// lruChunkCache is an in-memory ChunkCache evicting the least recently used
+// chunks once their data exceeds the maximum size.
+type lruChunkCache struct {
+	mtx      sync.Mutex
+	maxBytes int
+	bytes    int
+	entries  map[chunkCacheKey]*list.Element
+	lru      *list.List
+
+	hits   prometheus.Counter
+	misses prometheus.Counter
+}
+
+// NewLRUChunkCache returns an in-memory ChunkCache holding up to maxBytes of
+// chunk data.
+func NewLRUChunkCache(r prometheus.Registerer, maxBytes int) ChunkCache {
+	c := &lruChunkCache{
+		maxBytes: maxBytes,
+		entries:  map[chunkCacheKey]*list.Element{},
+		lru:      list.New(),
+		hits: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "prometheus_tsdb_chunk_cache_hits_total",
+			Help: "Number of chunks read from the in-memory chunk cache.",
+		}),
+		misses: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "prometheus_tsdb_chunk_cache_misses_total",
+			Help: "Number of chunks not found in the in-memory chunk cache.",
+		}),
+	}
+	if r != nil {
+		r.MustRegister(c.hits, c.misses)
+	}
+	return c
+}
+
+func (c *lruChunkCache) Get(block ulid.ULID, ref uint64) ([]byte, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	e, ok := c.entries[chunkCacheKey{block: block, ref: ref}]
+	if !ok {
+		c.misses.Inc()
+		return nil, false
+	}
+	c.hits.Inc()
+	c.lru.MoveToFront(e)
+
+	return e.Value.(*chunkCacheEntry).data, true
+}
+
+func (c *lruChunkCache) Set(block ulid.ULID, ref uint64, data []byte) {
+	if len(data) > c.maxBytes {
+		return
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	k := chunkCacheKey{block: block, ref: ref}
+	if _, ok := c.entries[k]; ok {
+		return
+	}
+	c.entries[k] = c.lru.PushFront(&chunkCacheEntry{key: k, data: data})
+	c.bytes += len(data)
+
+	for c.bytes > c.maxBytes {
+		e := c.lru.Remove(c.lru.Back()).(*chunkCacheEntry)
+		delete(c.entries, e.key)
+		c.bytes -= len(e.data)
+	}
+}
+
+// cachedChunkReader reads chunks of a block through the cache. Cached data
+// holds the encoding of the chunk in its first byte.
+type cachedChunkReader struct {
+	ChunkReader
+	cache ChunkCache
+	block ulid.ULID
+
+	// hits and misses count cache lookups of the block if set.
+	hits, misses prometheus.Counter
+}
+
+func (r *cachedChunkReader) Chunk(ref uint64) (chunkenc.Chunk, error) {
+	if b, ok := r.cache.Get(r.block, ref); ok && len(b) > 0 {
+		if r.hits != nil {
+			r.hits.Inc()
+		}
+		return chunkenc.FromData(chunkenc.Encoding(b[0]), b[1:])
+	}
+	if r.misses != nil {
+		r.misses.Inc()
+	}
+	c, err := r.ChunkReader.Chunk(ref)
+	if err != nil {
+		return nil, err
+	}
+	// The chunk data may be memory mapped and must be copied.
+	b := make([]byte, 1+len(c.Bytes()))
+	b[0] = byte(c.Encoding())
+	copy(b[1:], c.Bytes())
+
+	r.cache.Set(r.block, ref, b)
+	return c, nil
+}
@@ -0,0 +1,179 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"sync"
+
+	"github.com/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/tsdb/chunks"
+)
+
+// chunkFetchPool bounds the number of chunks that are fetched and decoded
+// concurrently for a query. It is shared by all series of the query.
+type chunkFetchPool struct {
+	sem chan struct{}
+	wg  sync.WaitGroup
+}
+
+func newChunkFetchPool(n int) *chunkFetchPool {
+	return &chunkFetchPool{sem: make(chan struct{}, n)}
+}
+
+// size returns the number of chunks a series fetches ahead of its iterator.
+func (p *chunkFetchPool) size() int {
+	return cap(p.sem)
+}
+
+// tryGo runs f in a new goroutine if the pool has a free worker. It returns
+// false otherwise.
+func (p *chunkFetchPool) tryGo(f func()) bool {
+	select {
+	case p.sem <- struct{}{}:
+	default:
+		return false
+	}
+	p.wg.Add(1)
+
+	go func() {
+		defer func() {
+			<-p.sem
+			p.wg.Done()
+		}()
+		f()
+	}()
+	return true
+}
+
+// wait blocks until all running fetches are done. It must be called before
+// the chunk readers of the query are closed.
+func (p *chunkFetchPool) wait() {
+	p.wg.Wait()
+}
+
+// chunkFetch is the result of fetching and decoding a single chunk.
+type chunkFetch struct {
+	done chan struct{}
+	ts   []int64
+	vs   []float64
+	err  error
+	// Int chunks are not decoded to not lose the precision of their values.
+	ints chunkenc.Chunk
+}
+
+func (f *chunkFetch) iterator() chunkenc.Iterator {
+	if f.err != nil {
+		return &errChunkIterator{err: f.err}
+	}
+	if f.ints != nil {
+		return f.ints.Iterator()
+	}
+	return &sampleSliceIterator{ts: f.ts, vs: f.vs, i: -1}
+}
+
+// chunkPrefetcher fetches the chunks of a series ahead of the iterator consuming them.
+// Chunks for which the pool has no free worker are fetched once they are needed.
+type chunkPrefetcher struct {
+	chunks  []chunks.Meta
+	reader  ChunkReader
+	pool    *chunkFetchPool
+	fetches []*chunkFetch
+
+	// last is the most recently consumed fetch, which is kept for iterators
+	// seeking within the same chunk.
+	last  *chunkFetch
+	lastI int
+}
+
+func newChunkPrefetcher(chks []chunks.Meta, r ChunkReader, p *chunkFetchPool) *chunkPrefetcher {
+	return &chunkPrefetcher{
+		chunks:  chks,
+		reader:  r,
+		pool:    p,
+		fetches: make([]*chunkFetch, len(chks)),
+		lastI:   -1,
+	}
+}
+
+// iterator returns an iterator over the i-th chunk and schedules fetches for
+// the chunks following it.
+func (p *chunkPrefetcher) iterator(i int) chunkenc.Iterator {
+	if i == p.lastI {
+		return p.last.iterator()
+	}
+	for j := i; j < len(p.chunks) && j < i+p.pool.size(); j++ {
+		if p.fetches[j] != nil {
+			continue
+		}
+		f := &chunkFetch{done: make(chan struct{})}
+		ref := p.chunks[j].Ref
+
+		if p.pool.tryGo(func() { p.fetch(f, ref) }) {
+			p.fetches[j] = f
+		}
+	}
+	f := p.fetches[i]
+	if f == nil {
+		f = &chunkFetch{done: make(chan struct{})}
+		p.fetch(f, p.chunks[i].Ref)
+	}
+	<-f.done
+
+	// Only the fetch being consumed is retained.
+	p.fetches[i] = nil
+	p.last, p.lastI = f, i
+
+	return f.iterator()
+}
+
+func (p *chunkPrefetcher) fetch(f *chunkFetch, ref uint64) {
+	defer close(f.done)
+
+	c, err := p.reader.Chunk(ref)
+	if err != nil {
+		f.err = err
+		return
+	}
+	if c.Encoding() == chunkenc.EncInt {
+		f.ints = c
+		return
+	}
+	f.ts, f.vs, f.err = chunkenc.Decode(c, nil, nil)
+}
+
+// sampleSliceIterator iterates over decoded samples of a chunk.
+type sampleSliceIterator struct {
+	ts []int64
+	vs []float64
+	i  int
+}
+
+func (it *sampleSliceIterator) At() (int64, float64) {
+	return it.ts[it.i], it.vs[it.i]
+}
+
+func (it *sampleSliceIterator) Next() bool {
+	it.i++
+	return it.i < len(it.ts)
+}
+
+func (it *sampleSliceIterator) Err() error { return nil }
+
+type errChunkIterator struct {
+	err error
+}
+
+func (it *errChunkIterator) At() (int64, float64) { return 0, 0 }
+func (it *errChunkIterator) Next() bool           { return false }
+func (it *errChunkIterator) Err() error           { return it.err }
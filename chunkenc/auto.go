@@ -0,0 +1,74 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunkenc
+
+import "math"
+
+// maxAutoPrecision is the highest number of decimal digits Recode considers for
+// storing values as scaled integers.
+const maxAutoPrecision = 6
+
+// Recode analyzes the samples of c and returns a chunk holding the same samples
+// in the encoding expected to store them most compactly. Integral, constant or
+// slowly changing decimal values are stored in an exact ScaledChunk if it is
+// smaller than c, all other chunks are returned unchanged.
+// Recode is lossless, values are retained bit by bit.
+func Recode(c Chunk) (Chunk, error) {
+	if c.Encoding() != EncXOR {
+		return c, nil
+	}
+	ts, vs, err := Decode(c, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	p, ok := exactPrecision(vs)
+	if !ok {
+		return c, nil
+	}
+	sc := NewExactScaledChunk(p)
+	app, err := sc.Appender()
+	if err != nil {
+		return nil, err
+	}
+	for i := range ts {
+		app.Append(ts[i], vs[i])
+	}
+	if len(sc.Bytes()) >= len(c.Bytes()) {
+		return c, nil
+	}
+	return sc, nil
+}
+
+// exactPrecision returns the lowest number of decimal digits at which all
+// values are represented exactly as scaled integers. Values that cannot be
+// scaled at all, such as NaN, are stored unmodified and do not count.
+func exactPrecision(vs []float64) (int, bool) {
+	for p := 0; p <= maxAutoPrecision; p++ {
+		ok := true
+		for _, v := range vs {
+			i, sok := toScaled(v, p)
+			if !sok {
+				continue
+			}
+			if math.Float64bits(fromScaled(i, p)) != math.Float64bits(v) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return p, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,97 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunkenc
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/prometheus/tsdb/testutil"
+)
+
+func TestRecode(t *testing.T) {
+	cases := []struct {
+		name      string
+		value     func(i int) float64
+		enc       Encoding
+		precision int
+	}{
+		{
+			name:  "counter",
+			value: func(i int) float64 { return float64(i * (rand.Intn(1000) + 1)) },
+			enc:   EncScaled,
+		},
+		{
+			name:  "constant",
+			value: func(i int) float64 { return 1 },
+			enc:   EncScaled,
+		},
+		{
+			name: "decimal",
+			value: func(i int) float64 {
+				if i == 3 {
+					return math.NaN()
+				}
+				return float64(rand.Intn(100000)) / 100
+			},
+			enc:       EncScaled,
+			precision: 2,
+		},
+		{
+			name:  "noise",
+			value: func(i int) float64 { return rand.NormFloat64() },
+			enc:   EncXOR,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			xc := NewXORChunk()
+			app, err := xc.Appender()
+			testutil.Ok(t, err)
+
+			var exp []pair
+			for i := 0; i < 16; i++ {
+				p := pair{t: int64(i) * 15000, v: c.value(i)}
+				app.Append(p.t, p.v)
+				exp = append(exp, p)
+			}
+			rc, err := Recode(xc)
+			testutil.Ok(t, err)
+			testutil.Equals(t, c.enc, rc.Encoding())
+
+			if sc, ok := rc.(*ScaledChunk); ok {
+				testutil.Assert(t, sc.Exact(), "recoded chunk is not exact")
+				testutil.Equals(t, c.precision, sc.Precision())
+			}
+			// Later samples must be retained exactly as well.
+			app, err = rc.Appender()
+			testutil.Ok(t, err)
+			for _, v := range []float64{0.123456789, 1e300, -1} {
+				p := pair{t: exp[len(exp)-1].t + 15000, v: v}
+				app.Append(p.t, p.v)
+				exp = append(exp, p)
+			}
+			ts, vs, err := Decode(rc, nil, nil)
+			testutil.Ok(t, err)
+			testutil.Equals(t, len(exp), len(ts))
+
+			for i := range exp {
+				testutil.Equals(t, exp[i].t, ts[i])
+				testutil.Assert(t, math.Float64bits(exp[i].v) == math.Float64bits(vs[i]),
+					"sample %d: expected %v, got %v", i, exp[i].v, vs[i])
+			}
+		})
+	}
+}
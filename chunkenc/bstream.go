@@ -53,6 +53,12 @@ func newBReader(b []byte) *bstream {
 	return &bstream{stream: b, count: 8}
 }
 
+// resetReader makes b read stream from its start.
+func (b *bstream) resetReader(stream []byte) {
+	b.stream = stream
+	b.count = 8
+}
+
 func newBWriter(size int) *bstream {
 	return &bstream{stream: make([]byte, 0, size), count: 0}
 }
@@ -176,6 +182,28 @@ func (b *bstream) readByte() (byte, error) {
 	return byt, nil
 }
 
+// skipBits advances the stream by nbits without reading them.
+func (b *bstream) skipBits(nbits int) error {
+	if len(b.stream) == 0 {
+		return io.EOF
+	}
+	if nbits <= int(b.count) {
+		b.count -= uint8(nbits)
+		return nil
+	}
+	// Skip the rest of the current byte and as many following ones as
+	// needed. The last of them becomes the current byte.
+	nbits -= int(b.count)
+	n := (nbits + 7) / 8
+
+	if n >= len(b.stream) {
+		return io.EOF
+	}
+	b.stream = b.stream[n:]
+	b.count = uint8(8*n - nbits)
+	return nil
+}
+
 func (b *bstream) readBits(nbits int) (uint64, error) {
 	var u uint64
 
@@ -29,6 +29,10 @@ func (e Encoding) String() string {
 		return "none"
 	case EncXOR:
 		return "XOR"
+	case EncScaled:
+		return "scaled"
+	case EncInt:
+		return "int"
 	}
 	return "<unknown>"
 }
@@ -37,6 +41,8 @@ func (e Encoding) String() string {
 const (
 	EncNone Encoding = iota
 	EncXOR
+	EncScaled
+	EncInt
 )
 
 // Chunk holds a sequence of sample pairs that can be iterated over and appended to.
@@ -53,6 +59,10 @@ func FromData(e Encoding, d []byte) (Chunk, error) {
 	switch e {
 	case EncXOR:
 		return &XORChunk{b: &bstream{count: 0, stream: d}}, nil
+	case EncScaled:
+		return &ScaledChunk{b: &bstream{count: 0, stream: d}}, nil
+	case EncInt:
+		return &IntChunk{b: d}, nil
 	}
 	return nil, fmt.Errorf("unknown chunk encoding: %d", e)
 }
@@ -69,6 +79,99 @@ type Iterator interface {
 	Next() bool
 }
 
+// IntAppender is implemented by appenders of chunks storing integer values.
+// Their Append drops values that are not integers, see IntValue.
+type IntAppender interface {
+	Appender
+	AppendInt(t int64, v int64)
+}
+
+// IntIterator is implemented by iterators of chunks storing integer values.
+// AtInt returns the current value without converting it to float64.
+type IntIterator interface {
+	Iterator
+	AtInt() (int64, int64)
+}
+
+// Decoder is implemented by chunks that decode all their samples at once
+// instead of one by one through an Iterator.
+type Decoder interface {
+	// Decode appends the timestamps and values of all samples to ts and vs
+	// and returns the extended slices.
+	Decode(ts []int64, vs []float64) ([]int64, []float64, error)
+}
+
+// Decode appends the timestamps and values of all samples in c to ts and vs and
+// returns the extended slices. Nothing is allocated if ts and vs have capacity
+// for NumSamples more samples. Chunks implementing Decoder are decoded by it,
+// all others are read through their iterator.
+func Decode(c Chunk, ts []int64, vs []float64) ([]int64, []float64, error) {
+	if d, ok := c.(Decoder); ok {
+		return d.Decode(ts, vs)
+	}
+	ts, vs = grow(ts, vs, c.NumSamples())
+
+	it := c.Iterator()
+	for it.Next() {
+		t, v := it.At()
+		ts = append(ts, t)
+		vs = append(vs, v)
+	}
+	return ts, vs, it.Err()
+}
+
+// TimestampIterable is implemented by chunks that can iterate over their
+// timestamps without decoding their values.
+type TimestampIterable interface {
+	// TimestampIterator returns an iterator whose At always reports a zero
+	// value.
+	TimestampIterator() Iterator
+}
+
+// TimestampIterator returns an iterator over the samples of c for consumers that
+// only need their timestamps. Values reported by the iterator are undefined.
+// Chunks implementing TimestampIterable skip decoding the values altogether.
+func TimestampIterator(c Chunk) Iterator {
+	if ti, ok := c.(TimestampIterable); ok {
+		return ti.TimestampIterator()
+	}
+	return c.Iterator()
+}
+
+// ResettableIterator is implemented by chunk iterators that can be reused to
+// iterate over other chunks.
+type ResettableIterator interface {
+	Iterator
+	// Reset restarts the iterator at the first sample of c. It returns false
+	// and leaves the iterator unchanged if c has an unsupported type.
+	Reset(c Chunk) bool
+}
+
+// ReuseIterator returns an iterator over the samples of c. If it implements
+// ResettableIterator and supports c, it is reset and returned instead of
+// allocating a new iterator. It must no longer be used by the caller.
+func ReuseIterator(it Iterator, c Chunk) Iterator {
+	if ri, ok := it.(ResettableIterator); ok && ri.Reset(c) {
+		return ri
+	}
+	return c.Iterator()
+}
+
+// grow ensures that ts and vs have capacity for n more samples.
+func grow(ts []int64, vs []float64, n int) ([]int64, []float64) {
+	if cap(ts)-len(ts) < n {
+		nts := make([]int64, len(ts), len(ts)+n)
+		copy(nts, ts)
+		ts = nts
+	}
+	if cap(vs)-len(vs) < n {
+		nvs := make([]float64, len(vs), len(vs)+n)
+		copy(nvs, vs)
+		vs = nvs
+	}
+	return ts, vs
+}
+
 // NewNopIterator returns a new chunk iterator that does not hold any data.
 func NewNopIterator() Iterator {
 	return nopIterator{}
@@ -87,7 +190,9 @@ type Pool interface {
 
 // Pool is a memory pool of chunk objects.
 type pool struct {
-	xor sync.Pool
+	xor    sync.Pool
+	scaled sync.Pool
+	ints   sync.Pool
 }
 
 func NewPool() Pool {
@@ -97,6 +202,16 @@ func NewPool() Pool {
 				return &XORChunk{b: &bstream{}}
 			},
 		},
+		scaled: sync.Pool{
+			New: func() interface{} {
+				return &ScaledChunk{b: &bstream{}}
+			},
+		},
+		ints: sync.Pool{
+			New: func() interface{} {
+				return &IntChunk{}
+			},
+		},
 	}
 }
 
@@ -107,6 +222,15 @@ func (p *pool) Get(e Encoding, b []byte) (Chunk, error) {
 		c.b.stream = b
 		c.b.count = 0
 		return c, nil
+	case EncScaled:
+		c := p.scaled.Get().(*ScaledChunk)
+		c.b.stream = b
+		c.b.count = 0
+		return c, nil
+	case EncInt:
+		c := p.ints.Get().(*IntChunk)
+		c.b = b
+		return c, nil
 	}
 	return nil, errors.Errorf("invalid encoding %q", e)
 }
@@ -124,6 +248,21 @@ func (p *pool) Put(c Chunk) error {
 		xc.b.stream = nil
 		xc.b.count = 0
 		p.xor.Put(c)
+	case EncScaled:
+		sc, ok := c.(*ScaledChunk)
+		if !ok {
+			return nil
+		}
+		sc.b.stream = nil
+		sc.b.count = 0
+		p.scaled.Put(c)
+	case EncInt:
+		ic, ok := c.(*IntChunk)
+		if !ok {
+			return nil
+		}
+		ic.b = nil
+		p.ints.Put(c)
 	default:
 		return errors.Errorf("invalid encoding %q", c.Encoding())
 	}
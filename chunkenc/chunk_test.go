@@ -89,6 +89,19 @@ func testChunk(c Chunk) error {
 	if !reflect.DeepEqual(exp, res) {
 		return fmt.Errorf("unexpected result\n\ngot: %v\n\nexp: %v", res, exp)
 	}
+
+	// Decoding appends to the given buffers.
+	tbuf, vbuf, err := Decode(c, []int64{1}, make([]float64, 1, len(exp)+1))
+	if err != nil {
+		return err
+	}
+	res = res[:0]
+	for i := range tbuf[1:] {
+		res = append(res, pair{t: tbuf[i+1], v: vbuf[i+1]})
+	}
+	if !reflect.DeepEqual(exp, res) {
+		return fmt.Errorf("unexpected decode result\n\ngot: %v\n\nexp: %v", res, exp)
+	}
 	return nil
 }
 
@@ -154,6 +167,121 @@ func BenchmarkXORIterator(b *testing.B) {
 	})
 }
 
+func BenchmarkXORDecode(b *testing.B) {
+	c := NewXORChunk()
+	app, err := c.Appender()
+	testutil.Ok(b, err)
+
+	for i := 0; i < 120; i++ {
+		app.Append(int64(i)*1000, float64(i))
+	}
+	var (
+		ts = make([]int64, 0, 120)
+		vs = make([]float64, 0, 120)
+	)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		ts, vs, err = Decode(c, ts[:0], vs[:0])
+		testutil.Ok(b, err)
+	}
+}
+
+func TestTimestampIterator(t *testing.T) {
+	for _, c := range []Chunk{NewXORChunk(), NewScaledChunk(2), NewExactScaledChunk(1)} {
+		app, err := c.Appender()
+		testutil.Ok(t, err)
+
+		var (
+			exp []int64
+			ts  = int64(1234123324)
+			v   = 1243535.123
+		)
+		for i := 0; i < 300; i++ {
+			ts += int64(rand.Intn(100000) + 1)
+			switch i % 4 {
+			case 0:
+				v = rand.Float64()
+			case 1:
+				v += float64(rand.Intn(1 << uint(rand.Intn(40))))
+			}
+			app.Append(ts, v)
+			exp = append(exp, ts)
+		}
+		var res []int64
+		it := TimestampIterator(c)
+		for it.Next() {
+			ts, _ := it.At()
+			res = append(res, ts)
+		}
+		testutil.Ok(t, it.Err())
+		testutil.Equals(t, exp, res)
+	}
+}
+
+func BenchmarkXORTimestampIterator(b *testing.B) {
+	c := NewXORChunk()
+	app, err := c.Appender()
+	testutil.Ok(b, err)
+
+	for i := 0; i < 120; i++ {
+		app.Append(int64(i)*1000, rand.Float64())
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		it := TimestampIterator(c)
+		for it.Next() {
+		}
+		testutil.Ok(b, it.Err())
+	}
+}
+
+func TestReuseIterator(t *testing.T) {
+	var (
+		chks []Chunk
+		exp  [][]pair
+	)
+	for _, c := range []Chunk{NewXORChunk(), NewScaledChunk(2), NewXORChunk(), NewExactScaledChunk(1)} {
+		app, err := c.Appender()
+		testutil.Ok(t, err)
+
+		var ps []pair
+		for i := 0; i < 100+rand.Intn(100); i++ {
+			p := pair{t: int64(i) * 1000, v: float64(rand.Intn(1000))}
+			app.Append(p.t, p.v)
+			ps = append(ps, p)
+		}
+		chks = append(chks, c)
+		exp = append(exp, ps)
+	}
+	var it Iterator
+	for i, c := range chks {
+		if it == nil {
+			it = c.Iterator()
+		} else {
+			it = ReuseIterator(it, c)
+		}
+		var res []pair
+		for it.Next() {
+			t, v := it.At()
+			res = append(res, pair{t: t, v: v})
+		}
+		testutil.Ok(t, it.Err())
+		testutil.Equals(t, exp[i], res)
+	}
+	// Iterators of the same encoding are reset without allocating.
+	it = chks[0].Iterator()
+	allocs := testing.AllocsPerRun(10, func() {
+		it = ReuseIterator(it, chks[2])
+		for it.Next() {
+		}
+	})
+	testutil.Equals(t, 0.0, allocs)
+}
+
 func BenchmarkXORAppender(b *testing.B) {
 	benchmarkAppender(b, func() Chunk {
 		return NewXORChunk()
@@ -0,0 +1,212 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunkenc
+
+import (
+	"encoding/binary"
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+// IntChunk holds samples with int64 values. Unlike with the other encodings,
+// values are not converted to float64 and keep their full precision.
+//
+// The chunk starts with the number of samples, followed by the first timestamp
+// and value, the timestamp and value deltas of the second sample and the
+// delta of timestamp deltas and value deltas of all further samples. All
+// numbers are varint encoded. As samples are byte-aligned, chunks read from
+// their data can be appended to.
+type IntChunk struct {
+	b []byte
+}
+
+const intHeaderSize = 2
+
+// NewIntChunk returns a new chunk for samples with integer values.
+func NewIntChunk() *IntChunk {
+	return &IntChunk{b: make([]byte, intHeaderSize, 128)}
+}
+
+// Encoding returns the encoding type.
+func (c *IntChunk) Encoding() Encoding {
+	return EncInt
+}
+
+// Bytes returns the underlying byte slice of the chunk.
+func (c *IntChunk) Bytes() []byte {
+	return c.b
+}
+
+// NumSamples returns the number of samples in the chunk.
+func (c *IntChunk) NumSamples() int {
+	return int(binary.BigEndian.Uint16(c.b))
+}
+
+// Appender implements the Chunk interface. The returned appender implements
+// IntAppender.
+func (c *IntChunk) Appender() (Appender, error) {
+	it := c.iterator()
+
+	// Restore the state of the appender from the existing samples.
+	for it.Next() {
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	return &intAppender{
+		c:      c,
+		t:      it.t,
+		v:      it.v,
+		tDelta: it.tDelta,
+	}, nil
+}
+
+func (c *IntChunk) iterator() *intIterator {
+	return &intIterator{
+		b:        c.b[intHeaderSize:],
+		numTotal: binary.BigEndian.Uint16(c.b),
+	}
+}
+
+// Iterator implements the Chunk interface. The returned iterator implements
+// IntIterator.
+func (c *IntChunk) Iterator() Iterator {
+	return c.iterator()
+}
+
+type intAppender struct {
+	c   *IntChunk
+	buf [binary.MaxVarintLen64]byte
+
+	t, v   int64
+	tDelta int64
+}
+
+// Append adds v as an integer. Values that IntValue does not accept are
+// dropped, callers must reject them beforehand.
+func (a *intAppender) Append(t int64, v float64) {
+	if iv, ok := IntValue(v); ok {
+		a.AppendInt(t, iv)
+	}
+}
+
+// IntValue returns v as an integer if it is a whole number within the range
+// of int64. NaN and infinite values are not accepted.
+func IntValue(v float64) (int64, bool) {
+	// The float64 bounds of int64 are exactly -2^63 and 2^63, the latter
+	// being out of range.
+	if v != math.Trunc(v) || v < math.MinInt64 || v >= -math.MinInt64 {
+		return 0, false
+	}
+	return int64(v), true
+}
+
+func (a *intAppender) AppendInt(t int64, v int64) {
+	num := binary.BigEndian.Uint16(a.c.b)
+
+	switch num {
+	case 0:
+		a.putVarint(t)
+		a.putVarint(v)
+	case 1:
+		a.tDelta = t - a.t
+		a.putVarint(a.tDelta)
+		a.putVarint(v - a.v)
+	default:
+		tDelta := t - a.t
+		a.putVarint(tDelta - a.tDelta)
+		a.putVarint(v - a.v)
+		a.tDelta = tDelta
+	}
+	a.t, a.v = t, v
+
+	binary.BigEndian.PutUint16(a.c.b, num+1)
+}
+
+func (a *intAppender) putVarint(x int64) {
+	n := binary.PutVarint(a.buf[:], x)
+	a.c.b = append(a.c.b, a.buf[:n]...)
+}
+
+type intIterator struct {
+	b        []byte
+	numTotal uint16
+	numRead  uint16
+
+	t, v   int64
+	tDelta int64
+	err    error
+}
+
+// Reset implements the ResettableIterator interface.
+func (it *intIterator) Reset(c Chunk) bool {
+	ic, ok := c.(*IntChunk)
+	if !ok {
+		return false
+	}
+	*it = intIterator{
+		b:        ic.b[intHeaderSize:],
+		numTotal: binary.BigEndian.Uint16(ic.b),
+	}
+	return true
+}
+
+func (it *intIterator) At() (int64, float64) {
+	return it.t, float64(it.v)
+}
+
+func (it *intIterator) AtInt() (int64, int64) {
+	return it.t, it.v
+}
+
+func (it *intIterator) Err() error {
+	return it.err
+}
+
+func (it *intIterator) Next() bool {
+	if it.err != nil || it.numRead == it.numTotal {
+		return false
+	}
+	switch it.numRead {
+	case 0:
+		it.t = it.varint()
+		it.v = it.varint()
+	case 1:
+		it.tDelta = it.varint()
+		it.t += it.tDelta
+		it.v += it.varint()
+	default:
+		it.tDelta += it.varint()
+		it.t += it.tDelta
+		it.v += it.varint()
+	}
+	if it.err != nil {
+		return false
+	}
+	it.numRead++
+	return true
+}
+
+func (it *intIterator) varint() int64 {
+	x, n := binary.Varint(it.b)
+	if n <= 0 {
+		if it.err == nil {
+			it.err = errors.Errorf("invalid varint in sample %d", it.numRead)
+		}
+		return 0
+	}
+	it.b = it.b[n:]
+	return x
+}
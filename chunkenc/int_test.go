@@ -0,0 +1,138 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunkenc
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/prometheus/tsdb/testutil"
+)
+
+func TestIntChunk(t *testing.T) {
+	type intPair struct {
+		t, v int64
+	}
+	var (
+		c   = NewIntChunk()
+		exp []intPair
+		ts  = int64(1234123324)
+		v   = int64(math.MaxInt64 - 1000)
+	)
+	for i := 0; i < 300; i++ {
+		ts += int64(rand.Intn(10000) + 1)
+		v += int64(rand.Intn(200) - 100)
+
+		val := v
+		switch i {
+		case 100:
+			val = math.MinInt64
+		case 101:
+			val = 0
+		}
+		// Start with a new appender every sample.
+		app, err := c.Appender()
+		testutil.Ok(t, err)
+		app.(IntAppender).AppendInt(ts, val)
+
+		exp = append(exp, intPair{t: ts, v: val})
+	}
+	testutil.Equals(t, len(exp), c.NumSamples())
+
+	cc, err := FromData(EncInt, c.Bytes())
+	testutil.Ok(t, err)
+
+	for _, chk := range []Chunk{c, cc} {
+		var res []intPair
+		it := chk.Iterator().(IntIterator)
+		for it.Next() {
+			ts, v := it.AtInt()
+			res = append(res, intPair{t: ts, v: v})
+		}
+		testutil.Ok(t, it.Err())
+		testutil.Equals(t, exp, res)
+	}
+}
+
+func TestIntChunk_AppendFloat(t *testing.T) {
+	c := NewIntChunk()
+	app, err := c.Appender()
+	testutil.Ok(t, err)
+	app.Append(1, 2)
+	app.Append(2, 2.7)
+	app.Append(3, math.NaN())
+	app.Append(4, math.Inf(1))
+	app.Append(5, -3)
+
+	ts, vs, err := Decode(c, nil, nil)
+	testutil.Ok(t, err)
+	testutil.Equals(t, []int64{1, 5}, ts)
+	testutil.Equals(t, []float64{2, -3}, vs)
+}
+
+func TestIntValue(t *testing.T) {
+	for _, c := range []struct {
+		v   float64
+		exp int64
+		ok  bool
+	}{
+		{v: 0, exp: 0, ok: true},
+		{v: -3, exp: -3, ok: true},
+		{v: 1 << 53, exp: 1 << 53, ok: true},
+		{v: math.MinInt64, exp: math.MinInt64, ok: true},
+		{v: 1 << 63},
+		{v: -(1 << 64)},
+		{v: 2.5},
+		{v: math.NaN()},
+		{v: math.Inf(1)},
+		{v: math.Inf(-1)},
+	} {
+		v, ok := IntValue(c.v)
+		testutil.Equals(t, c.ok, ok)
+		testutil.Equals(t, c.exp, v)
+	}
+}
+
+func TestPool_Int(t *testing.T) {
+	c := NewIntChunk()
+	app, err := c.Appender()
+	testutil.Ok(t, err)
+	app.(IntAppender).AppendInt(1, 1<<60+1)
+
+	p := NewPool()
+	pc, err := p.Get(EncInt, c.Bytes())
+	testutil.Ok(t, err)
+	testutil.Equals(t, EncInt, pc.Encoding())
+
+	it := pc.Iterator().(IntIterator)
+	testutil.Assert(t, it.Next(), "missing sample")
+	ts, v := it.AtInt()
+	testutil.Equals(t, int64(1), ts)
+	testutil.Equals(t, int64(1<<60+1), v)
+
+	testutil.Ok(t, p.Put(pc))
+}
+
+func BenchmarkIntIterator(b *testing.B) {
+	benchmarkIterator(b, func() Chunk {
+		return NewIntChunk()
+	})
+}
+
+func BenchmarkIntAppender(b *testing.B) {
+	benchmarkAppender(b, func() Chunk {
+		return NewIntChunk()
+	})
+}
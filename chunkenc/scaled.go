@@ -0,0 +1,456 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunkenc
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// The range of decimal digits values of a ScaledChunk can be rounded to.
+const (
+	MinPrecision = -15
+	MaxPrecision = 15
+)
+
+// Values whose scaled integer exceeds this magnitude are stored unscaled.
+const maxScaled = 1 << 53
+
+// ScaledChunk holds samples whose values are rounded to a fixed number of
+// decimal digits and stored as deltas of scaled integers. It is a lossy
+// encoding that is considerably smaller than XOR for data that does not need
+// full float64 precision, e.g. sensor readings. Values that cannot be
+// scaled, such as NaN, are stored unmodified.
+// Exact chunks store values that are not represented exactly at their precision
+// unmodified as well, which makes them lossless for any data.
+//
+// The chunk starts with the number of samples, the precision and a flag byte,
+// followed by the timestamps encoded like in XOR chunks and the value deltas.
+type ScaledChunk struct {
+	b *bstream
+}
+
+const (
+	scaledHeaderSize = 4
+	scaledFlagExact  = 1
+)
+
+// NewScaledChunk returns a new chunk rounding values to the given number of
+// decimal digits. Negative precisions round to powers of ten, e.g. -2 rounds
+// to hundreds. The precision is clamped to [MinPrecision, MaxPrecision].
+func NewScaledChunk(precision int) *ScaledChunk {
+	return newScaledChunk(precision, 0)
+}
+
+// NewExactScaledChunk returns a new lossless chunk storing values as scaled
+// integers if they are exactly represented with the given number of decimal
+// digits.
+func NewExactScaledChunk(precision int) *ScaledChunk {
+	return newScaledChunk(precision, scaledFlagExact)
+}
+
+func newScaledChunk(precision int, flags byte) *ScaledChunk {
+	b := make([]byte, scaledHeaderSize, 128)
+	b[2] = byte(int8(clampPrecision(precision)))
+	b[3] = flags
+	return &ScaledChunk{b: &bstream{stream: b, count: 0}}
+}
+
+func clampPrecision(p int) int {
+	if p < MinPrecision {
+		return MinPrecision
+	}
+	if p > MaxPrecision {
+		return MaxPrecision
+	}
+	return p
+}
+
+// Round returns v rounded the way it is stored by a ScaledChunk with the given
+// precision.
+func Round(v float64, precision int) float64 {
+	p := clampPrecision(precision)
+
+	i, ok := toScaled(v, p)
+	if !ok {
+		return v
+	}
+	return fromScaled(i, p)
+}
+
+// toScaled returns v scaled by 10^p and rounded to an integer. It returns false
+// if v cannot be represented that way.
+func toScaled(v float64, p int) (int64, bool) {
+	var x float64
+	if p >= 0 {
+		x = v * math.Pow10(p)
+	} else {
+		x = v / math.Pow10(-p)
+	}
+	x = math.Floor(x + 0.5)
+
+	if math.IsNaN(x) || x >= maxScaled || x <= -maxScaled {
+		return 0, false
+	}
+	return int64(x), true
+}
+
+func fromScaled(i int64, p int) float64 {
+	if p >= 0 {
+		return float64(i) / math.Pow10(p)
+	}
+	return float64(i) * math.Pow10(-p)
+}
+
+// Encoding returns the encoding type.
+func (c *ScaledChunk) Encoding() Encoding {
+	return EncScaled
+}
+
+// Bytes returns the underlying byte slice of the chunk.
+func (c *ScaledChunk) Bytes() []byte {
+	return c.b.bytes()
+}
+
+// NumSamples returns the number of samples in the chunk.
+func (c *ScaledChunk) NumSamples() int {
+	return int(binary.BigEndian.Uint16(c.Bytes()))
+}
+
+// Precision returns the number of decimal digits values are rounded to.
+func (c *ScaledChunk) Precision() int {
+	return int(int8(c.Bytes()[2]))
+}
+
+// Exact returns whether the chunk stores all values without loss.
+func (c *ScaledChunk) Exact() bool {
+	return c.Bytes()[3]&scaledFlagExact != 0
+}
+
+// Appender implements the Chunk interface.
+func (c *ScaledChunk) Appender() (Appender, error) {
+	it := c.iterator()
+
+	// Restore the state of the appender from the existing samples.
+	for it.Next() {
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	return &scaledAppender{
+		b:         c.b,
+		precision: it.precision,
+		exact:     c.Exact(),
+		t:         it.t,
+		tDelta:    it.tDelta,
+		scaled:    it.scaled,
+	}, nil
+}
+
+func (c *ScaledChunk) iterator() *scaledIterator {
+	return &scaledIterator{
+		br:        newBReader(c.b.bytes()[scaledHeaderSize:]),
+		numTotal:  binary.BigEndian.Uint16(c.b.bytes()),
+		precision: c.Precision(),
+	}
+}
+
+// Iterator implements the Chunk interface.
+func (c *ScaledChunk) Iterator() Iterator {
+	return c.iterator()
+}
+
+// TimestampIterator implements the TimestampIterable interface.
+func (c *ScaledChunk) TimestampIterator() Iterator {
+	it := c.iterator()
+	it.skipValues = true
+	return it
+}
+
+// Decode implements the Decoder interface.
+func (c *ScaledChunk) Decode(ts []int64, vs []float64) ([]int64, []float64, error) {
+	ts, vs = grow(ts, vs, c.NumSamples())
+
+	it := c.iterator()
+	for it.Next() {
+		ts = append(ts, it.t)
+		vs = append(vs, it.val)
+	}
+	return ts, vs, it.err
+}
+
+type scaledAppender struct {
+	b         *bstream
+	precision int
+	exact     bool
+
+	t      int64
+	tDelta uint64
+	// scaled is the most recent value that could be scaled. Deltas of
+	// following values are relative to it.
+	scaled int64
+}
+
+func (a *scaledAppender) Append(t int64, v float64) {
+	var tDelta uint64
+	num := binary.BigEndian.Uint16(a.b.bytes())
+
+	buf := make([]byte, binary.MaxVarintLen64)
+
+	switch num {
+	case 0:
+		for _, b := range buf[:binary.PutVarint(buf, t)] {
+			a.b.writeByte(b)
+		}
+	case 1:
+		tDelta = uint64(t - a.t)
+
+		for _, b := range buf[:binary.PutUvarint(buf, tDelta)] {
+			a.b.writeByte(b)
+		}
+	default:
+		tDelta = uint64(t - a.t)
+		dod := int64(tDelta - a.tDelta)
+
+		switch {
+		case dod == 0:
+			a.b.writeBit(zero)
+		case bitRange(dod, 14):
+			a.b.writeBits(0x02, 2) // '10'
+			a.b.writeBits(uint64(dod), 14)
+		case bitRange(dod, 17):
+			a.b.writeBits(0x06, 3) // '110'
+			a.b.writeBits(uint64(dod), 17)
+		case bitRange(dod, 20):
+			a.b.writeBits(0x0e, 4) // '1110'
+			a.b.writeBits(uint64(dod), 20)
+		default:
+			a.b.writeBits(0x0f, 4) // '1111'
+			a.b.writeBits(uint64(dod), 64)
+		}
+	}
+	a.writeValue(v)
+
+	a.t = t
+	a.tDelta = tDelta
+	binary.BigEndian.PutUint16(a.b.bytes(), num+1)
+}
+
+func (a *scaledAppender) writeValue(v float64) {
+	i, ok := toScaled(v, a.precision)
+	if ok && a.exact {
+		ok = math.Float64bits(fromScaled(i, a.precision)) == math.Float64bits(v)
+	}
+	if !ok {
+		a.b.writeBits(0x1f, 5) // '11111'
+		a.b.writeBits(math.Float64bits(v), 64)
+		return
+	}
+	d := i - a.scaled
+	a.scaled = i
+
+	switch {
+	case d == 0:
+		a.b.writeBit(zero)
+	case bitRange(d, 8):
+		a.b.writeBits(0x02, 2) // '10'
+		a.b.writeBits(uint64(d), 8)
+	case bitRange(d, 16):
+		a.b.writeBits(0x06, 3) // '110'
+		a.b.writeBits(uint64(d), 16)
+	case bitRange(d, 32):
+		a.b.writeBits(0x0e, 4) // '1110'
+		a.b.writeBits(uint64(d), 32)
+	default:
+		a.b.writeBits(0x1e, 5) // '11110'
+		a.b.writeBits(uint64(d), 64)
+	}
+}
+
+type scaledIterator struct {
+	br        *bstream
+	numTotal  uint16
+	numRead   uint16
+	precision int
+	// If skipValues is set, values are skipped instead of decoded.
+	skipValues bool
+
+	t      int64
+	val    float64
+	tDelta uint64
+	scaled int64
+	err    error
+}
+
+// Reset implements the ResettableIterator interface. The iterator keeps
+// skipping values if it did so before.
+func (it *scaledIterator) Reset(c Chunk) bool {
+	sc, ok := c.(*ScaledChunk)
+	if !ok {
+		return false
+	}
+	b := sc.b.bytes()
+	it.br.resetReader(b[scaledHeaderSize:])
+
+	*it = scaledIterator{
+		br:         it.br,
+		numTotal:   binary.BigEndian.Uint16(b),
+		precision:  sc.Precision(),
+		skipValues: it.skipValues,
+	}
+	return true
+}
+
+func (it *scaledIterator) At() (int64, float64) {
+	return it.t, it.val
+}
+
+func (it *scaledIterator) Err() error {
+	return it.err
+}
+
+func (it *scaledIterator) Next() bool {
+	if it.err != nil || it.numRead == it.numTotal {
+		return false
+	}
+	switch it.numRead {
+	case 0:
+		t, err := binary.ReadVarint(it.br)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		it.t = t
+	case 1:
+		tDelta, err := binary.ReadUvarint(it.br)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		it.tDelta = tDelta
+		it.t += int64(tDelta)
+	default:
+		d, err := it.readPrefix(4)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		var dod int64
+
+		switch d {
+		case 0x00:
+		case 0x02:
+			dod, err = it.readSigned(14)
+		case 0x06:
+			dod, err = it.readSigned(17)
+		case 0x0e:
+			dod, err = it.readSigned(20)
+		case 0x0f:
+			dod, err = it.readSigned(64)
+		}
+		if err != nil {
+			it.err = err
+			return false
+		}
+		it.tDelta = uint64(int64(it.tDelta) + dod)
+		it.t += int64(it.tDelta)
+	}
+	if err := it.readValue(); err != nil {
+		it.err = err
+		return false
+	}
+	it.numRead++
+	return true
+}
+
+func (it *scaledIterator) readValue() error {
+	d, err := it.readPrefix(5)
+	if err != nil {
+		return err
+	}
+	if it.skipValues {
+		return it.skipValue(d)
+	}
+	var delta int64
+
+	switch d {
+	case 0x00:
+	case 0x02:
+		delta, err = it.readSigned(8)
+	case 0x06:
+		delta, err = it.readSigned(16)
+	case 0x0e:
+		delta, err = it.readSigned(32)
+	case 0x1e:
+		delta, err = it.readSigned(64)
+	case 0x1f:
+		bits, err := it.br.readBits(64)
+		if err != nil {
+			return err
+		}
+		it.val = math.Float64frombits(bits)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	it.scaled += delta
+	it.val = fromScaled(it.scaled, it.precision)
+	return nil
+}
+
+// skipValue skips the value following the prefix d.
+func (it *scaledIterator) skipValue(d byte) error {
+	switch d {
+	case 0x02:
+		return it.br.skipBits(8)
+	case 0x06:
+		return it.br.skipBits(16)
+	case 0x0e:
+		return it.br.skipBits(32)
+	case 0x1e, 0x1f:
+		return it.br.skipBits(64)
+	}
+	return nil
+}
+
+// readPrefix reads a prefix of up to max one bits terminated by a zero bit.
+func (it *scaledIterator) readPrefix(max int) (byte, error) {
+	var d byte
+	for i := 0; i < max; i++ {
+		d <<= 1
+		bit, err := it.br.readBit()
+		if err != nil {
+			return 0, err
+		}
+		if bit == zero {
+			break
+		}
+		d |= 1
+	}
+	return d, nil
+}
+
+// readSigned reads a signed integer of sz bits as written for values within
+// bitRange(x, sz).
+func (it *scaledIterator) readSigned(sz uint8) (int64, error) {
+	bits, err := it.br.readBits(int(sz))
+	if err != nil {
+		return 0, err
+	}
+	if sz < 64 && bits > (1<<(sz-1)) {
+		bits = bits - (1 << sz)
+	}
+	return int64(bits), nil
+}
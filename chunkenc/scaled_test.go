@@ -0,0 +1,147 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunkenc
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/prometheus/tsdb/testutil"
+)
+
+func TestScaledChunk(t *testing.T) {
+	for _, precision := range []int{-2, 0, 1, 3} {
+		c := NewScaledChunk(precision)
+		testutil.Equals(t, precision, c.Precision())
+
+		var (
+			exp []pair
+			app Appender
+			err error
+			ts  = int64(1234123324)
+			v   = 21.5
+		)
+		for i := 0; i < 300; i++ {
+			ts += int64(rand.Intn(10000) + 1)
+			v += rand.NormFloat64() * math.Pow10(rand.Intn(8)-2)
+
+			val := v
+			switch i {
+			case 100:
+				val = math.NaN()
+			case 101:
+				val = math.Inf(-1)
+			case 102:
+				val = 1e300
+			}
+			// Start with a new appender every 10th sample. This emulates starting
+			// appending to a partially filled chunk.
+			if i%10 == 0 {
+				app, err = c.Appender()
+				testutil.Ok(t, err)
+			}
+			app.Append(ts, val)
+
+			exp = append(exp, pair{t: ts, v: Round(val, precision)})
+		}
+		testutil.Equals(t, len(exp), c.NumSamples())
+
+		cc, err := FromData(EncScaled, c.Bytes())
+		testutil.Ok(t, err)
+
+		for _, chk := range []Chunk{c, cc} {
+			var res []pair
+			it := chk.Iterator()
+			for it.Next() {
+				ts, v := it.At()
+				res = append(res, pair{t: ts, v: v})
+			}
+			testutil.Ok(t, it.Err())
+			testutil.Equals(t, len(exp), len(res))
+
+			for i := range exp {
+				testutil.Equals(t, exp[i].t, res[i].t)
+				testutil.Assert(t, math.Float64bits(exp[i].v) == math.Float64bits(res[i].v),
+					"sample %d: expected %v, got %v", i, exp[i].v, res[i].v)
+				if !math.IsNaN(exp[i].v) && !math.IsInf(exp[i].v, 0) {
+					testutil.Assert(t, math.Abs(exp[i].v-Round(exp[i].v, precision)) == 0, "rounding is not idempotent")
+				}
+			}
+		}
+	}
+}
+
+func TestRound(t *testing.T) {
+	testutil.Equals(t, 21.5, Round(21.46, 1))
+	testutil.Equals(t, -21.5, Round(-21.46, 1))
+	testutil.Equals(t, 1200.0, Round(1234.5, -2))
+	testutil.Equals(t, 0.001, Round(0.00095, 3))
+	testutil.Equals(t, 1e300, Round(1e300, 3))
+	testutil.Assert(t, math.IsNaN(Round(math.NaN(), 3)), "NaN not preserved")
+	testutil.Equals(t, Round(0.123456789, MaxPrecision), Round(0.123456789, 100))
+}
+
+func TestScaledChunk_Size(t *testing.T) {
+	var (
+		xc = NewXORChunk()
+		sc = NewScaledChunk(1)
+		v  = 21.5
+	)
+	xapp, err := xc.Appender()
+	testutil.Ok(t, err)
+	sapp, err := sc.Appender()
+	testutil.Ok(t, err)
+
+	// Sensor readings with noise beyond the precision of the sensor.
+	for i := 0; i < 120; i++ {
+		v += rand.NormFloat64() / 10
+		xapp.Append(int64(i)*15000, v)
+		sapp.Append(int64(i)*15000, v)
+	}
+	testutil.Assert(t, 4*len(sc.Bytes()) < len(xc.Bytes()),
+		"scaled chunk of %d bytes not considerably smaller than XOR chunk of %d bytes", len(sc.Bytes()), len(xc.Bytes()))
+}
+
+func TestPool_Scaled(t *testing.T) {
+	c := NewScaledChunk(2)
+	app, err := c.Appender()
+	testutil.Ok(t, err)
+	app.Append(1, 1.234)
+
+	p := NewPool()
+	pc, err := p.Get(EncScaled, c.Bytes())
+	testutil.Ok(t, err)
+	testutil.Equals(t, EncScaled, pc.Encoding())
+
+	it := pc.Iterator()
+	testutil.Assert(t, it.Next(), "missing sample")
+	ts, v := it.At()
+	testutil.Equals(t, int64(1), ts)
+	testutil.Equals(t, 1.23, v)
+
+	testutil.Ok(t, p.Put(pc))
+}
+
+func BenchmarkScaledIterator(b *testing.B) {
+	benchmarkIterator(b, func() Chunk {
+		return NewScaledChunk(3)
+	})
+}
+
+func BenchmarkScaledAppender(b *testing.B) {
+	benchmarkAppender(b, func() Chunk {
+		return NewScaledChunk(3)
+	})
+}
@@ -117,6 +117,25 @@ func (c *XORChunk) Iterator() Iterator {
 	return c.iterator()
 }
 
+// TimestampIterator implements the TimestampIterable interface.
+func (c *XORChunk) TimestampIterator() Iterator {
+	it := c.iterator()
+	it.skipValues = true
+	return it
+}
+
+// Decode implements the Decoder interface.
+func (c *XORChunk) Decode(ts []int64, vs []float64) ([]int64, []float64, error) {
+	ts, vs = grow(ts, vs, c.NumSamples())
+
+	it := c.iterator()
+	for it.Next() {
+		ts = append(ts, it.t)
+		vs = append(vs, it.val)
+	}
+	return ts, vs, it.err
+}
+
 type xorAppender struct {
 	b *bstream
 
@@ -227,6 +246,8 @@ type xorIterator struct {
 
 	t   int64
 	val float64
+	// If skipValues is set, values are skipped instead of decoded.
+	skipValues bool
 
 	leading  uint8
 	trailing uint8
@@ -235,6 +256,24 @@ type xorIterator struct {
 	err    error
 }
 
+// Reset implements the ResettableIterator interface. The iterator keeps
+// skipping values if it did so before.
+func (it *xorIterator) Reset(c Chunk) bool {
+	xc, ok := c.(*XORChunk)
+	if !ok {
+		return false
+	}
+	b := xc.b.bytes()
+	it.br.resetReader(b[2:])
+
+	*it = xorIterator{
+		br:         it.br,
+		numTotal:   binary.BigEndian.Uint16(b),
+		skipValues: it.skipValues,
+	}
+	return true
+}
+
 func (it *xorIterator) At() (int64, float64) {
 	return it.t, it.val
 }
@@ -254,12 +293,21 @@ func (it *xorIterator) Next() bool {
 			it.err = err
 			return false
 		}
+		it.t = t
+
+		if it.skipValues {
+			if err := it.br.skipBits(64); err != nil {
+				it.err = err
+				return false
+			}
+			it.numRead++
+			return true
+		}
 		v, err := it.br.readBits(64)
 		if err != nil {
 			it.err = err
 			return false
 		}
-		it.t = t
 		it.val = math.Float64frombits(v)
 
 		it.numRead++
@@ -371,6 +419,14 @@ func (it *xorIterator) readValue() bool {
 		}
 
 		mbits := int(64 - it.leading - it.trailing)
+		if it.skipValues {
+			if err := it.br.skipBits(mbits); err != nil {
+				it.err = err
+				return false
+			}
+			it.numRead++
+			return true
+		}
 		bits, err := it.br.readBits(mbits)
 		if err != nil {
 			it.err = err
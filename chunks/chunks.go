@@ -63,12 +63,6 @@ func (cm *Meta) OverlapsClosedInterval(mint, maxt int64) bool {
 	return cm.MinTime <= maxt && mint <= cm.MaxTime
 }
 
-var (
-	errInvalidSize     = fmt.Errorf("invalid size")
-	errInvalidFlag     = fmt.Errorf("invalid flag")
-	errInvalidChecksum = fmt.Errorf("invalid checksum")
-)
-
 var castagnoliTable *crc32.Table
 
 func init() {
@@ -282,7 +276,7 @@ func (b realByteSlice) Sub(start, end int) ByteSlice {
 }
 
 // Reader implements a SeriesReader for a serialized byte stream
-// of series data.
+// of series data. It is safe for concurrent use.
 type Reader struct {
 	// The underlying bytes holding the encoded series data.
 	bs []ByteSlice
@@ -298,11 +292,15 @@ func newReader(bs []ByteSlice, cs []io.Closer, pool chunkenc.Pool) (*Reader, err
 
 	for i, b := range cr.bs {
 		if b.Len() < 4 {
-			return nil, errors.Wrapf(errInvalidSize, "validate magic in segment %d", i)
+			return nil, errors.Wrapf(fileutil.NewErrCorrupt(b, 0, "magic number exceeds size %d", b.Len()), "segment %d", i)
 		}
 		// Verify magic number.
-		if m := binary.BigEndian.Uint32(b.Range(0, 4)); m != MagicChunks {
-			return nil, errors.Errorf("invalid magic number %x", m)
+		h, err := fileutil.ReadRange(b, 0, 4)
+		if err != nil {
+			return nil, errors.Wrapf(err, "segment %d", i)
+		}
+		if m := binary.BigEndian.Uint32(h); m != MagicChunks {
+			return nil, errors.Wrapf(fileutil.NewErrCorrupt(b, 0, "invalid magic number %x", m), "segment %d", i)
 		}
 	}
 	return &cr, nil
@@ -317,8 +315,19 @@ func NewReader(bs []ByteSlice, pool chunkenc.Pool) (*Reader, error) {
 }
 
 // NewDirReader returns a new Reader against sequentially numbered files in the
-// given directory.
+// given directory. The files are mapped into memory. Files that cannot be mapped
+// are read with pread.
 func NewDirReader(dir string, pool chunkenc.Pool) (*Reader, error) {
+	return newDirReader(dir, pool, false)
+}
+
+// NewPreadDirReader returns a new Reader against sequentially numbered files in
+// the given directory, which are read with pread instead of being mapped into memory.
+func NewPreadDirReader(dir string, pool chunkenc.Pool) (*Reader, error) {
+	return newDirReader(dir, pool, true)
+}
+
+func newDirReader(dir string, pool chunkenc.Pool, pread bool) (*Reader, error) {
 	files, err := sequenceFiles(dir)
 	if err != nil {
 		return nil, err
@@ -331,12 +340,13 @@ func NewDirReader(dir string, pool chunkenc.Pool) (*Reader, error) {
 	var cs []io.Closer
 
 	for _, fn := range files {
-		f, err := fileutil.OpenMmapFile(fn)
+		f, err := fileutil.OpenReadableFile(fn, pread)
 		if err != nil {
-			return nil, errors.Wrapf(err, "mmap files")
+			closeAll(cs...)
+			return nil, errors.Wrapf(err, "open chunk files")
 		}
 		cs = append(cs, f)
-		bs = append(bs, realByteSlice(f.Bytes()))
+		bs = append(bs, f)
 	}
 	return newReader(bs, cs, pool)
 }
@@ -351,24 +361,85 @@ func (s *Reader) Chunk(ref uint64) (chunkenc.Chunk, error) {
 		off = int((ref << 32) >> 32)
 	)
 	if seq >= len(s.bs) {
-		return nil, errors.Errorf("reference sequence %d out of range", seq)
+		return nil, fileutil.NewErrCorrupt(nil, off, "reference sequence %d out of range", seq)
 	}
 	b := s.bs[seq]
 
 	if off >= b.Len() {
-		return nil, errors.Errorf("offset %d beyond data size %d", off, b.Len())
+		return nil, fileutil.NewErrCorrupt(b, off, "offset exceeds size %d", b.Len())
+	}
+	// Chunks are followed by their checksum, so this only reaches the end of
+	// the slice for damaged references.
+	r, err := fileutil.ReadRange(b, off, varintEnd(b, off))
+	if err != nil {
+		return nil, err
+	}
+	l, n := binary.Uvarint(r)
+	if n <= 0 {
+		return nil, fileutil.NewErrCorrupt(b, off, "reading chunk length failed with %d", n)
+	}
+	// The length does not include the encoding byte.
+	if off+n+1+int(l) > b.Len() {
+		return nil, fileutil.NewErrCorrupt(b, off, "chunk of length %d exceeds size %d", l, b.Len())
+	}
+	r, err = fileutil.ReadRange(b, off+n, off+n+1+int(l))
+	if err != nil {
+		return nil, err
+	}
+	c, err := s.pool.Get(chunkenc.Encoding(r[0]), r[1:])
+	if err != nil {
+		return nil, fileutil.NewErrCorrupt(b, off, "%s", err)
+	}
+	return c, nil
+}
+
+// varintEnd returns the end of the range holding a chunk length at off.
+func varintEnd(b ByteSlice, off int) int {
+	if end := off + binary.MaxVarintLen32; end < b.Len() {
+		return end
 	}
-	// With the minimum chunk length this should never cause us reading
-	// over the end of the slice.
-	r := b.Range(off, off+binary.MaxVarintLen32)
+	return b.Len()
+}
 
+// Verify checks the chunk with the given reference against its checksum.
+func (s *Reader) Verify(ref uint64) error {
+	var (
+		seq = int(ref >> 32)
+		off = int((ref << 32) >> 32)
+	)
+	if seq >= len(s.bs) {
+		return fileutil.NewErrCorrupt(nil, off, "reference sequence %d out of range", seq)
+	}
+	b := s.bs[seq]
+
+	if off >= b.Len() {
+		return fileutil.NewErrCorrupt(b, off, "offset exceeds size %d", b.Len())
+	}
+	r, err := fileutil.ReadRange(b, off, varintEnd(b, off))
+	if err != nil {
+		return err
+	}
 	l, n := binary.Uvarint(r)
 	if n <= 0 {
-		return nil, errors.Errorf("reading chunk length failed with %d", n)
+		return fileutil.NewErrCorrupt(b, off, "reading chunk length failed with %d", n)
 	}
-	r = b.Range(off+n, off+n+int(l))
+	start := off + n
+	end := start + 1 + int(l)
 
-	return s.pool.Get(chunkenc.Encoding(r[0]), r[1:1+l])
+	if end+crc32.Size > b.Len() {
+		return fileutil.NewErrCorrupt(b, off, "chunk of length %d exceeds size %d", l, b.Len())
+	}
+	r, err = fileutil.ReadRange(b, start, end+crc32.Size)
+	if err != nil {
+		return err
+	}
+	h := newCRC32()
+	h.Write(r[:end-start])
+
+	if exp := binary.BigEndian.Uint32(r[end-start:]); h.Sum32() != exp {
+		return fileutil.NewErrCorrupt(b, off, "chunk checksum mismatch")
+	}
+	return nil
 }
 
 func nextSequenceFile(dir string) (string, int, error) {
@@ -16,6 +16,8 @@ package chunks
 import (
 	"testing"
 
+	"github.com/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/tsdb/fileutil"
 	"github.com/prometheus/tsdb/testutil"
 )
 
@@ -25,4 +27,19 @@ func TestReaderWithInvalidBuffer(t *testing.T) {
 
 	_, err := r.Chunk(0)
 	testutil.NotOk(t, err)
+	testutil.Assert(t, fileutil.IsCorrupt(err), "unexpected error: %s", err)
+}
+
+func TestReaderWithCorruptChunks(t *testing.T) {
+	for _, b := range []realByteSlice{
+		// Chunk length exceeding the segment.
+		{0x0a, 0x01, 0x00},
+		// Unknown chunk encoding.
+		{0x01, 0xff, 0x00},
+	} {
+		r := &Reader{bs: []ByteSlice{b}, pool: chunkenc.NewPool()}
+
+		_, err := r.Chunk(0)
+		testutil.Assert(t, fileutil.IsCorrupt(err), "unexpected error: %v", err)
+	}
 }
@@ -34,6 +34,7 @@ import (
 	"github.com/pkg/errors"
 	"github.com/prometheus/tsdb"
 	"github.com/prometheus/tsdb/labels"
+	"github.com/prometheus/tsdb/tsdbutil"
 	"gopkg.in/alecthomas/kingpin.v2"
 )
 
@@ -48,6 +49,24 @@ func main() {
 		listCmd              = cli.Command("ls", "list db blocks")
 		listCmdHumanReadable = listCmd.Flag("human-readable", "print human readable values").Short('h').Bool()
 		listPath             = listCmd.Arg("db path", "database path (default is benchout/storage)").Default("benchout/storage").String()
+		migrateCmd           = cli.Command("migrate", "rewrite block indexes into the latest format version")
+		migratePath          = migrateCmd.Arg("db path", "database path (default is benchout/storage)").Default("benchout/storage").String()
+		importInfluxCmd      = cli.Command("import-influx", "backfill InfluxDB line protocol into new blocks")
+		importInfluxOut      = importInfluxCmd.Flag("out", "set the output path").Default("benchout/storage").String()
+		importInfluxBlock    = importInfluxCmd.Flag("block-duration", "duration covered by each block").Default("2h").Duration()
+		importInfluxPrec     = importInfluxCmd.Flag("precision", "precision of the timestamps").Default("ns").Enum("ns", "us", "ms", "s")
+		importInfluxFile     = importInfluxCmd.Arg("file", "input file with line protocol").Required().String()
+		restoreCmd           = cli.Command("restore", "copy blocks from a backup into a data directory")
+		restoreSrc           = restoreCmd.Arg("backup path", "directory holding the backed up blocks").Required().String()
+		restoreDst           = restoreCmd.Arg("db path", "database path (default is benchout/storage)").Default("benchout/storage").String()
+		splitCmd             = cli.Command("split", "split an oversized block into smaller blocks")
+		splitOut             = splitCmd.Flag("out", "set the output path, which must not be the directory of the block").Required().String()
+		splitBySeries        = splitCmd.Flag("series", "shard the block by series instead of slicing its time range").Bool()
+		splitPath            = splitCmd.Arg("block path", "path of the block to split").Required().String()
+		splitN               = splitCmd.Arg("n", "number of blocks to split into").Required().Int()
+		verifyCmd            = cli.Command("verify", "verify the checksums of a block")
+		verifyOrder          = verifyCmd.Flag("order", "also verify that series are sorted by labels and postings by reference").Bool()
+		verifyPath           = verifyCmd.Arg("block path", "path of the block to verify").Required().String()
 	)
 
 	switch kingpin.MustParse(cli.Parse(os.Args[1:])) {
@@ -64,6 +83,32 @@ func main() {
 			exitWithError(err)
 		}
 		printBlocks(db.Blocks(), listCmdHumanReadable)
+	case migrateCmd.FullCommand():
+		logger := log.NewLogfmtLogger(log.NewSyncWriter(os.Stderr))
+		if err := tsdb.MigrateIndexes(logger, *migratePath); err != nil {
+			exitWithError(err)
+		}
+	case importInfluxCmd.FullCommand():
+		if err := importInflux(*importInfluxFile, *importInfluxOut, *importInfluxBlock, *importInfluxPrec); err != nil {
+			exitWithError(err)
+		}
+	case restoreCmd.FullCommand():
+		if err := restore(*restoreSrc, *restoreDst); err != nil {
+			exitWithError(err)
+		}
+	case splitCmd.FullCommand():
+		if err := split(*splitPath, *splitOut, *splitN, *splitBySeries); err != nil {
+			exitWithError(err)
+		}
+	case verifyCmd.FullCommand():
+		if err := tsdb.VerifyBlock(*verifyPath); err != nil {
+			exitWithError(err)
+		}
+		if *verifyOrder {
+			if err := tsdb.VerifyBlockOrder(*verifyPath); err != nil {
+				exitWithError(err)
+			}
+		}
 	}
 	flag.CommandLine.Set("log.level", "debug")
 }
@@ -352,6 +397,61 @@ func readPrometheusLabels(r io.Reader, n int) ([]labels.Labels, error) {
 	return mets, nil
 }
 
+func importInflux(file, out string, blockDuration time.Duration, precision string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	prec := map[string]time.Duration{
+		"ns": time.Nanosecond,
+		"us": time.Microsecond,
+		"ms": time.Millisecond,
+		"s":  time.Second,
+	}[precision]
+
+	if err := os.MkdirAll(out, 0777); err != nil {
+		return err
+	}
+	logger := log.NewLogfmtLogger(log.NewSyncWriter(os.Stderr))
+
+	ids, err := tsdbutil.ImportLineProtocol(logger, f, out, int64(blockDuration/time.Millisecond), prec)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("imported %d blocks into %s\n", len(ids), out)
+	return nil
+}
+
+func restore(src, dst string) error {
+	logger := log.NewLogfmtLogger(log.NewSyncWriter(os.Stderr))
+
+	res, err := tsdb.Restore(logger, src, dst)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("restored %d blocks into %s\n", len(res.Blocks), dst)
+	return nil
+}
+
+func split(dir, out string, n int, bySeries bool) error {
+	logger := log.NewLogfmtLogger(log.NewSyncWriter(os.Stderr))
+
+	mode := tsdb.SplitByTime
+	if bySeries {
+		mode = tsdb.SplitBySeries
+	}
+	ids, err := tsdb.SplitBlock(logger, dir, out, n, mode)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		fmt.Println(id)
+	}
+	return nil
+}
+
 func exitWithError(err error) {
 	fmt.Fprintln(os.Stderr, err)
 	os.Exit(1)
@@ -14,12 +14,17 @@
 package tsdb
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"math/rand"
 	"os"
 	"path/filepath"
 	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-kit/kit/log"
@@ -69,11 +74,55 @@ type LeveledCompactor struct {
 	logger    log.Logger
 	ranges    []int64
 	chunkPool chunkenc.Pool
+
+	// Derive ULIDs of new blocks from their time range and parents instead of
+	// randomness and the current time.
+	deterministicULIDs bool
+	// External labels attached to blocks written from other block readers.
+	externalLabels labels.Labels
+	timestampUnit  TimestampUnit
+
+	// Number of failed attempts after which blocks are no longer compacted.
+	maxAttempts int
+	// Read blocks with pread instead of mapping them into memory.
+	pread bool
+	// Compression of the label index and postings sections of written indices.
+	indexCompression index.Compression
+	// Write postings of new indices into a separate file.
+	separatePostings bool
+	// Number of shards the series of new blocks are partitioned into. Blocks
+	// are not sharded if it is less than two.
+	shards int
+	// Rules evaluated against blocks written from the head.
+	aggregationRules []AggregationRule
+	// Labels whose value ranges are recorded in the meta of new blocks.
+	rangeLabels []string
+
+	// Sets of blocks whose compaction failed, keyed by their directories.
+	backoffMtx sync.Mutex
+	backoffs   map[string]compactionBackoff
+}
+
+const (
+	defaultMaxCompactionAttempts = 3
+
+	minCompactionBackoff = 1 * time.Minute
+	maxCompactionBackoff = 1 * time.Hour
+)
+
+// compactionBackoff delays retries of a failed compaction.
+type compactionBackoff struct {
+	failures int
+	delay    time.Duration
+	next     time.Time
 }
 
 type compactorMetrics struct {
 	ran          prometheus.Counter
 	failed       prometheus.Counter
+	skipped      prometheus.Counter
+	backingOff   prometheus.Gauge
+	failedBlocks prometheus.Gauge
 	duration     prometheus.Histogram
 	chunkSize    prometheus.Histogram
 	chunkSamples prometheus.Histogram
@@ -91,6 +140,18 @@ func newCompactorMetrics(r prometheus.Registerer) *compactorMetrics {
 		Name: "prometheus_tsdb_compactions_failed_total",
 		Help: "Total number of compactions that failed for the partition.",
 	})
+	m.skipped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "prometheus_tsdb_compactions_skipped_total",
+		Help: "Total number of planned compactions that were skipped as they failed recently.",
+	})
+	m.backingOff = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "prometheus_tsdb_compactions_backing_off",
+		Help: "Number of block sets whose compaction is retried after a failure.",
+	})
+	m.failedBlocks = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "prometheus_tsdb_compaction_failed_blocks",
+		Help: "Number of blocks excluded from compaction after failing too often.",
+	})
 	m.duration = prometheus.NewHistogram(prometheus.HistogramOpts{
 		Name:    "prometheus_tsdb_compaction_duration_seconds",
 		Help:    "Duration of compaction runs",
@@ -116,6 +177,9 @@ func newCompactorMetrics(r prometheus.Registerer) *compactorMetrics {
 		r.MustRegister(
 			m.ran,
 			m.failed,
+			m.skipped,
+			m.backingOff,
+			m.failedBlocks,
 			m.duration,
 			m.chunkRange,
 			m.chunkSamples,
@@ -134,16 +198,20 @@ func NewLeveledCompactor(r prometheus.Registerer, l log.Logger, ranges []int64,
 		pool = chunkenc.NewPool()
 	}
 	return &LeveledCompactor{
-		ranges:    ranges,
-		chunkPool: pool,
-		logger:    l,
-		metrics:   newCompactorMetrics(r),
+		ranges:      ranges,
+		chunkPool:   pool,
+		logger:      l,
+		metrics:     newCompactorMetrics(r),
+		maxAttempts: defaultMaxCompactionAttempts,
+		backoffs:    map[string]compactionBackoff{},
 	}, nil
 }
 
 type dirMeta struct {
 	dir  string
 	meta *BlockMeta
+	// noCompact is set if the block is marked to be excluded from compaction.
+	noCompact bool
 }
 
 // Plan returns a list of compactable blocks in the provided directory.
@@ -156,15 +224,77 @@ func (c *LeveledCompactor) Plan(dir string) ([]string, error) {
 		return nil, nil
 	}
 
-	var dms []dirMeta
+	var (
+		dms    []dirMeta
+		failed int
+	)
 	for _, dir := range dirs {
 		meta, err := readMetaFile(dir)
 		if err != nil {
 			return nil, err
 		}
-		dms = append(dms, dirMeta{dir, meta})
+		// Blocks being deleted are not loaded and must not be compacted.
+		if meta.PendingDeletion {
+			continue
+		}
+		if meta.Compaction.Failed {
+			failed++
+		}
+		// Unreadable markers still exclude the block to be safe.
+		mark, err := readBlockMark(dir, NoCompactMarkFilename)
+		if err != nil {
+			level.Warn(c.logger).Log("msg", "read no-compact marker", "dir", dir, "err", err)
+		}
+		dms = append(dms, dirMeta{dir: dir, meta: meta, noCompact: mark != nil || err != nil})
+	}
+	c.metrics.failedBlocks.Set(float64(failed))
+
+	if len(dms) == 0 {
+		return nil, nil
+	}
+	res, err := c.plan(dms)
+	if err != nil || len(res) == 0 {
+		return res, err
+	}
+	// Do not retry a failed compaction before its backoff expired.
+	c.backoffMtx.Lock()
+	defer c.backoffMtx.Unlock()
+
+	if b, ok := c.backoffs[backoffKey(res)]; ok && time.Now().Before(b.next) {
+		c.metrics.skipped.Inc()
+		return nil, nil
+	}
+	return res, nil
+}
+
+func backoffKey(dirs []string) string {
+	return strings.Join(dirs, ",")
+}
+
+// trackAttempt updates the backoff of the given block set after a compaction attempt.
+func (c *LeveledCompactor) trackAttempt(dirs []string, err error) {
+	c.backoffMtx.Lock()
+	defer c.backoffMtx.Unlock()
+
+	key := backoffKey(dirs)
+
+	if err == nil {
+		delete(c.backoffs, key)
+	} else {
+		b := c.backoffs[key]
+		b.failures++
+		b.delay = exponential(b.delay, minCompactionBackoff, maxCompactionBackoff)
+		b.next = time.Now().Add(b.delay)
+		c.backoffs[key] = b
+
+		level.Warn(c.logger).Log(
+			"msg", "compaction failed, backing off",
+			"failures", b.failures,
+			"retry_in", b.delay,
+			"blocks", fmt.Sprintf("%v", dirs),
+		)
 	}
-	return c.plan(dms)
+	c.metrics.backingOff.Set(float64(len(c.backoffs)))
 }
 
 func (c *LeveledCompactor) plan(dms []dirMeta) ([]string, error) {
@@ -190,6 +320,9 @@ func (c *LeveledCompactor) plan(dms []dirMeta) ([]string, error) {
 		if meta.MaxTime-meta.MinTime < c.ranges[len(c.ranges)/2] {
 			break
 		}
+		if dms[i].noCompact {
+			continue
+		}
 
 		if float64(meta.Stats.NumTombstones)/float64(meta.Stats.NumSeries+1) > 0.05 {
 			return []string{dms[i].dir}, nil
@@ -216,9 +349,10 @@ func (c *LeveledCompactor) selectDirs(ds []dirMeta) []dirMeta {
 
 	Outer:
 		for _, p := range parts {
-			// Do not select the range if it has a block whose compaction failed.
+			// Do not select the range if it has a block whose compaction failed
+			// or that is excluded from compaction.
 			for _, dm := range p {
-				if dm.meta.Compaction.Failed {
+				if dm.meta.Compaction.Failed || dm.noCompact {
 					continue Outer
 				}
 			}
@@ -304,6 +438,8 @@ func compactBlockMetas(uid ulid.ULID, blocks ...*BlockMeta) *BlockMeta {
 		})
 	}
 	res.Compaction.Level++
+	res.ExternalLabels = commonExternalLabels(blocks...)
+	res.TimestampUnit = blocks[0].TimestampUnit
 
 	for s := range sources {
 		res.Compaction.Sources = append(res.Compaction.Sources, s)
@@ -311,22 +447,126 @@ func compactBlockMetas(uid ulid.ULID, blocks ...*BlockMeta) *BlockMeta {
 	sort.Slice(res.Compaction.Sources, func(i, j int) bool {
 		return res.Compaction.Sources[i].Compare(res.Compaction.Sources[j]) < 0
 	})
+	res.Compaction.History = compactionHistory(res, blocks...)
 
 	return res
 }
 
+// compactionRecord returns the record of the block's creation.
+func (m *BlockMeta) compactionRecord() CompactionRecord {
+	r := CompactionRecord{
+		ULID:  m.ULID,
+		Level: m.Compaction.Level,
+		Time:  int64(m.ULID.Time()),
+	}
+	for _, p := range m.Compaction.Parents {
+		r.Parents = append(r.Parents, p.ULID)
+	}
+	return r
+}
+
+// compactionHistory returns the history of the block. Blocks written before
+// histories were recorded only report their own creation.
+func (m *BlockMeta) compactionHistory() []CompactionRecord {
+	if len(m.Compaction.History) > 0 {
+		return m.Compaction.History
+	}
+	return []CompactionRecord{m.compactionRecord()}
+}
+
+// compactionHistory returns the history of the block created from the parents,
+// which consists of their histories and the record of its own creation.
+func compactionHistory(meta *BlockMeta, parents ...*BlockMeta) []CompactionRecord {
+	var (
+		res  []CompactionRecord
+		seen = map[ulid.ULID]struct{}{}
+	)
+	for _, p := range parents {
+		for _, r := range p.compactionHistory() {
+			if _, ok := seen[r.ULID]; ok {
+				continue
+			}
+			seen[r.ULID] = struct{}{}
+			res = append(res, r)
+		}
+	}
+	res = append(res, meta.compactionRecord())
+
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].Time < res[j].Time
+	})
+	return res
+}
+
+// commonExternalLabels returns the external labels shared by all blocks.
+func commonExternalLabels(blocks ...*BlockMeta) map[string]string {
+	var res map[string]string
+
+	for i, b := range blocks {
+		if i == 0 {
+			res = make(map[string]string, len(b.ExternalLabels))
+			for n, v := range b.ExternalLabels {
+				res[n] = v
+			}
+			continue
+		}
+		for n, v := range res {
+			if b.ExternalLabels[n] != v {
+				delete(res, n)
+			}
+		}
+	}
+	if len(res) == 0 {
+		return nil
+	}
+	return res
+}
+
+// newULID returns an ID for a new block spanning [mint, maxt] that is created
+// from the blocks with the given ULIDs.
+func (c *LeveledCompactor) newULID(mint, maxt int64, parents ...ulid.ULID) ulid.ULID {
+	if !c.deterministicULIDs {
+		entropy := rand.New(rand.NewSource(time.Now().UnixNano()))
+		return ulid.MustNew(ulid.Now(), entropy)
+	}
+	// The entropy is a hash of all inputs so that a new block never gets the
+	// ID of a parent, even if both end at the same timestamp.
+	h := sha256.New()
+	var buf [binary.MaxVarintLen64]byte
+	h.Write(buf[:binary.PutVarint(buf[:], mint)])
+	h.Write(buf[:binary.PutVarint(buf[:], maxt)])
+
+	sorted := append([]ulid.ULID(nil), parents...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Compare(sorted[j]) < 0 })
+	for _, p := range sorted {
+		h.Write(p[:])
+	}
+
+	// ULIDs hold milliseconds.
+	ms := uint64(maxt / int64(time.Millisecond/c.timestampUnit.Duration()))
+	if maxt < 0 {
+		ms = 0
+	} else if ms > ulid.MaxTime() {
+		ms = ulid.MaxTime()
+	}
+	return ulid.MustNew(ms, bytes.NewReader(h.Sum(nil)))
+}
+
 // Compact creates a new block in the compactor's directory from the blocks in the
 // provided directories.
 func (c *LeveledCompactor) Compact(dest string, dirs ...string) (uid ulid.ULID, err error) {
+	defer func() { c.trackAttempt(dirs, err) }()
+
 	var (
 		blocks []BlockReader
 		bs     []*Block
 		metas  []*BlockMeta
 		uids   []string
+		start  = time.Now()
 	)
 
 	for _, d := range dirs {
-		b, err := OpenBlock(d, c.chunkPool)
+		b, err := openBlock(d, c.chunkPool, c.pread)
 		if err != nil {
 			return uid, err
 		}
@@ -343,8 +583,23 @@ func (c *LeveledCompactor) Compact(dest string, dirs ...string) (uid ulid.ULID,
 		uids = append(uids, meta.ULID.String())
 	}
 
-	entropy := rand.New(rand.NewSource(time.Now().UnixNano()))
-	uid = ulid.MustNew(ulid.Now(), entropy)
+	if err := checkTimestampUnits(metas...); err != nil {
+		return uid, err
+	}
+	var (
+		parents    = make([]ulid.ULID, 0, len(metas))
+		mint, maxt = metas[0].MinTime, metas[0].MaxTime
+	)
+	for _, m := range metas {
+		parents = append(parents, m.ULID)
+		if m.MinTime < mint {
+			mint = m.MinTime
+		}
+		if m.MaxTime > maxt {
+			maxt = m.MaxTime
+		}
+	}
+	uid = c.newULID(mint, maxt, parents...)
 
 	meta := compactBlockMetas(uid, metas...)
 	err = c.write(dest, meta, blocks...)
@@ -356,6 +611,7 @@ func (c *LeveledCompactor) Compact(dest string, dirs ...string) (uid ulid.ULID,
 			"maxt", meta.MaxTime,
 			"ulid", meta.ULID,
 			"sources", fmt.Sprintf("%v", uids),
+			"duration", time.Since(start),
 		)
 		return uid, nil
 	}
@@ -364,8 +620,8 @@ func (c *LeveledCompactor) Compact(dest string, dirs ...string) (uid ulid.ULID,
 	merr.Add(err)
 
 	for _, b := range bs {
-		if err := b.setCompactionFailed(); err != nil {
-			merr.Add(errors.Wrapf(err, "setting compaction failed for block: %s", b.Dir()))
+		if err := b.recordCompactionFailure(c.maxAttempts); err != nil {
+			merr.Add(errors.Wrapf(err, "record compaction failure for block: %s", b.Dir()))
 		}
 	}
 
@@ -373,8 +629,12 @@ func (c *LeveledCompactor) Compact(dest string, dirs ...string) (uid ulid.ULID,
 }
 
 func (c *LeveledCompactor) Write(dest string, b BlockReader, mint, maxt int64, parent *BlockMeta) (ulid.ULID, error) {
-	entropy := rand.New(rand.NewSource(time.Now().UnixNano()))
-	uid := ulid.MustNew(ulid.Now(), entropy)
+	start := time.Now()
+	var parents []ulid.ULID
+	if parent != nil {
+		parents = append(parents, parent.ULID)
+	}
+	uid := c.newULID(mint, maxt, parents...)
 
 	meta := &BlockMeta{
 		ULID:    uid,
@@ -384,18 +644,46 @@ func (c *LeveledCompactor) Write(dest string, b BlockReader, mint, maxt int64, p
 	meta.Compaction.Level = 1
 	meta.Compaction.Sources = []ulid.ULID{uid}
 
+	if len(c.externalLabels) > 0 {
+		meta.ExternalLabels = c.externalLabels.Map()
+	}
+	meta.TimestampUnit = c.timestampUnit
+
 	if parent != nil {
 		meta.Compaction.Parents = []BlockDesc{
 			{ULID: parent.ULID, MinTime: parent.MinTime, MaxTime: parent.MaxTime},
 		}
+		// A rewritten block keeps the origin and unit of its parent.
+		meta.ExternalLabels = parent.ExternalLabels
+		meta.TimestampUnit = parent.TimestampUnit
+		meta.Compaction.History = compactionHistory(meta, parent)
+	} else {
+		meta.Compaction.History = compactionHistory(meta)
 	}
 
-	err := c.write(dest, meta, b)
-	if err != nil {
+	blocks := []BlockReader{b}
+
+	// Rewritten blocks already hold the aggregated series of their parent.
+	if parent == nil && len(c.aggregationRules) > 0 {
+		h, err := aggregateBlock(b, c.aggregationRules, mint, maxt)
+		if err != nil {
+			return uid, errors.Wrap(err, "evaluate aggregation rules")
+		}
+		defer h.Close()
+
+		blocks = append(blocks, &rangeHead{head: h, mint: mint, maxt: maxt - 1})
+	}
+	if err := c.write(dest, meta, blocks...); err != nil {
 		return uid, err
 	}
 
-	level.Info(c.logger).Log("msg", "write block", "mint", meta.MinTime, "maxt", meta.MaxTime, "ulid", meta.ULID)
+	level.Info(c.logger).Log(
+		"msg", "write block",
+		"mint", meta.MinTime,
+		"maxt", meta.MaxTime,
+		"ulid", meta.ULID,
+		"duration", time.Since(start),
+	)
 	return uid, nil
 }
 
@@ -444,11 +732,72 @@ func (c *LeveledCompactor) write(dest string, meta *BlockMeta, blocks ...BlockRe
 		return err
 	}
 
-	// Populate chunk and index files into temporary directory with
-	// data of all blocks.
+	if c.shards > 1 {
+		err = c.populateShards(tmp, meta, blocks)
+	} else {
+		err = c.populateDir(tmp, meta, blocks)
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(c.rangeLabels) > 0 {
+		if meta.LabelRanges, err = readLabelRanges(tmp, meta, c.rangeLabels); err != nil {
+			return errors.Wrap(err, "read label ranges")
+		}
+	}
+	if meta.Checksums, err = blockChecksums(tmp, nil); err != nil {
+		return errors.Wrap(err, "compute checksums")
+	}
+	if err = writeMetaFile(tmp, meta); err != nil {
+		return errors.Wrap(err, "write merged meta")
+	}
+
+	// Create an empty tombstones file.
+	if err := writeTombstoneFile(tmp, NewMemTombstones()); err != nil {
+		return errors.Wrap(err, "write new tombstones file")
+	}
+
+	df, err := fileutil.OpenDir(tmp)
+	if err != nil {
+		return errors.Wrap(err, "open temporary block dir")
+	}
+	defer func() {
+		if df != nil {
+			df.Close()
+		}
+	}()
+
+	if err := fileutil.Fsync(df); err != nil {
+		return errors.Wrap(err, "sync temporary dir file")
+	}
+
+	// Close temp dir before rename block dir (for windows platform).
+	if err = df.Close(); err != nil {
+		return errors.Wrap(err, "close temporary dir")
+	}
+	df = nil
+
+	// Block successfully written, make visible. An existing block with the
+	// same ULID is never replaced, as it may be one of the compacted blocks.
+	if err := renameBlockDir(tmp, dir); err != nil {
+		return errors.Wrap(err, "rename block dir")
+	}
+
+	return nil
+}
+
+// populateDir writes the index and chunks holding the union of the provided
+// blocks into dir.
+func (c *LeveledCompactor) populateDir(dir string, meta *BlockMeta, blocks []BlockReader) (err error) {
+	if err = os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+
+	// Populate chunk and index files with data of all blocks.
 	var chunkw ChunkWriter
 
-	chunkw, err = chunks.NewWriter(chunkDir(tmp))
+	chunkw, err = chunks.NewWriter(chunkDir(dir))
 	if err != nil {
 		return errors.Wrap(err, "open chunk writer")
 	}
@@ -463,20 +812,19 @@ func (c *LeveledCompactor) write(dest string, meta *BlockMeta, blocks ...BlockRe
 		}
 	}
 
-	indexw, err := index.NewWriter(filepath.Join(tmp, indexFilename))
+	indexw, err := index.NewWriter(filepath.Join(dir, indexFilename))
 	if err != nil {
 		return errors.Wrap(err, "open index writer")
 	}
 	defer indexw.Close()
 
+	indexw.Compression = c.indexCompression
+	indexw.SeparatePostings = c.separatePostings
+
 	if err := c.populateBlock(blocks, meta, indexw, chunkw); err != nil {
 		return errors.Wrap(err, "write compaction")
 	}
 
-	if err = writeMetaFile(tmp, meta); err != nil {
-		return errors.Wrap(err, "write merged meta")
-	}
-
 	// We are explicitly closing them here to check for error even
 	// though these are covered under defer. This is because in Windows,
 	// you cannot delete these unless they are closed and the defer is to
@@ -487,37 +835,48 @@ func (c *LeveledCompactor) write(dest string, meta *BlockMeta, blocks ...BlockRe
 	if err = indexw.Close(); err != nil {
 		return errors.Wrap(err, "close index writer")
 	}
+	return nil
+}
 
-	// Create an empty tombstones file.
-	if err := writeTombstoneFile(tmp, NewMemTombstones()); err != nil {
-		return errors.Wrap(err, "write new tombstones file")
+// populateShards partitions the series of the provided blocks into the shards
+// of a block in dir. The shards are written concurrently.
+func (c *LeveledCompactor) populateShards(dir string, meta *BlockMeta, blocks []BlockReader) error {
+	var (
+		wg    sync.WaitGroup
+		metas = make([]BlockMeta, c.shards)
+		errs  = make([]error, c.shards)
+	)
+	for i := 0; i < c.shards; i++ {
+		readers := make([]BlockReader, 0, len(blocks))
+		for _, b := range blocks {
+			readers = append(readers, &shardReader{BlockReader: b, shard: uint64(i), shards: uint64(c.shards)})
+		}
+		metas[i] = *meta
+		metas[i].Stats = BlockStats{}
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = c.populateDir(shardDir(dir, i), &metas[i], readers)
+		}(i)
 	}
+	wg.Wait()
 
-	df, err := fileutil.OpenDir(tmp)
-	if err != nil {
-		return errors.Wrap(err, "open temporary block dir")
-	}
-	defer func() {
-		if df != nil {
-			df.Close()
+	var merr MultiError
+	for i, err := range errs {
+		if err != nil {
+			merr.Add(errors.Wrapf(err, "shard %d", i))
 		}
-	}()
-
-	if err := fileutil.Fsync(df); err != nil {
-		return errors.Wrap(err, "sync temporary dir file")
 	}
-
-	// Close temp dir before rename block dir (for windows platform).
-	if err = df.Close(); err != nil {
-		return errors.Wrap(err, "close temporary dir")
+	if err := merr.Err(); err != nil {
+		return err
 	}
-	df = nil
-
-	// Block successfully written, make visible and remove old ones.
-	if err := renameFile(tmp, dir); err != nil {
-		return errors.Wrap(err, "rename block dir")
+	for _, m := range metas {
+		meta.Stats.NumSeries += m.Stats.NumSeries
+		meta.Stats.NumChunks += m.Stats.NumChunks
+		meta.Stats.NumSamples += m.Stats.NumSamples
 	}
-
+	meta.Shards = c.shards
 	return nil
 }
 
@@ -554,12 +913,12 @@ func (c *LeveledCompactor) populateBlock(blocks []BlockReader, meta *BlockMeta,
 		}
 		closers = append(closers, tombsr)
 
-		symbols, err := indexr.Symbols()
-		if err != nil {
-			return errors.Wrap(err, "read symbols")
+		symbols := indexr.Symbols()
+		for symbols.Next() {
+			allSymbols[symbols.At()] = struct{}{}
 		}
-		for s := range symbols {
-			allSymbols[s] = struct{}{}
+		if err := symbols.Err(); err != nil {
+			return errors.Wrap(err, "read symbols")
 		}
 
 		all, err := indexr.Postings(index.AllPostingsKey())
@@ -610,16 +969,16 @@ func (c *LeveledCompactor) populateBlock(blocks []BlockReader, meta *BlockMeta,
 				if !chk.OverlapsClosedInterval(dranges[0].Mint, dranges[len(dranges)-1].Maxt) {
 					continue
 				}
-				newChunk := chunkenc.NewXORChunk()
+				newChunk := newChunkLike(chk.Chunk)
 				app, err := newChunk.Appender()
 				if err != nil {
 					return err
 				}
 
-				it := &deletedIterator{it: chk.Chunk.Iterator(), intervals: dranges}
+				cit := chk.Chunk.Iterator()
+				it := &deletedIterator{it: cit, intervals: dranges}
 				for it.Next() {
-					ts, v := it.At()
-					app.Append(ts, v)
+					appendSample(app, cit)
 				}
 
 				chks[i].Chunk = newChunk
@@ -662,11 +1021,18 @@ func (c *LeveledCompactor) populateBlock(blocks []BlockReader, meta *BlockMeta,
 		return errors.Wrap(set.Err(), "iterate compaction set")
 	}
 
+	// Write label indices in a stable order to produce reproducible output.
+	names := make([]string, 0, len(values))
+	for n := range values {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
 	s := make([]string, 0, 256)
-	for n, v := range values {
+	for _, n := range names {
 		s = s[:0]
 
-		for x := range v {
+		for x := range values[n] {
 			s = append(s, x)
 		}
 		if err := indexw.WriteLabelIndex([]string{n}, s); err != nil {
@@ -863,3 +1229,35 @@ func renameFile(from, to string) error {
 	}
 	return pdir.Close()
 }
+
+// renameBlockDir moves the block directory from to the path to. Unlike
+// renameFile, it fails if to already exists.
+func renameBlockDir(from, to string) error {
+	if _, err := os.Stat(to); err == nil {
+		return errors.Errorf("block directory %s already exists", to)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	return renameFile(from, to)
+}
+
+// newChunkLike returns an empty chunk to re-encode the samples of c into.
+// Integer chunks keep their encoding to not lose precision.
+func newChunkLike(c chunkenc.Chunk) chunkenc.Chunk {
+	if c.Encoding() == chunkenc.EncInt {
+		return chunkenc.NewIntChunk()
+	}
+	return chunkenc.NewXORChunk()
+}
+
+// appendSample appends the current sample of it to app. Integer values are
+// copied exactly if both support them.
+func appendSample(app chunkenc.Appender, it chunkenc.Iterator) {
+	if iapp, ok := app.(chunkenc.IntAppender); ok {
+		if iit, ok := it.(chunkenc.IntIterator); ok {
+			iapp.AppendInt(iit.AtInt())
+			return
+		}
+	}
+	app.Append(it.At())
+}
@@ -14,15 +14,19 @@
 package tsdb
 
 import (
+	"fmt"
 	"io/ioutil"
 	"math"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
 	"github.com/pkg/errors"
 	"github.com/prometheus/tsdb/chunks"
+	"github.com/prometheus/tsdb/labels"
 	"github.com/prometheus/tsdb/testutil"
 )
 
@@ -368,6 +372,150 @@ func TestRangeWithFailedCompactionWontGetSelected(t *testing.T) {
 	}
 }
 
+func TestCommonExternalLabels(t *testing.T) {
+	cases := []struct {
+		blocks []map[string]string
+		exp    map[string]string
+	}{
+		{
+			blocks: []map[string]string{nil, nil},
+			exp:    nil,
+		},
+		{
+			blocks: []map[string]string{{"cluster": "a", "replica": "1"}},
+			exp:    map[string]string{"cluster": "a", "replica": "1"},
+		},
+		{
+			blocks: []map[string]string{
+				{"cluster": "a", "replica": "1"},
+				{"cluster": "a", "replica": "2"},
+			},
+			exp: map[string]string{"cluster": "a"},
+		},
+		{
+			blocks: []map[string]string{{"cluster": "a"}, nil},
+			exp:    nil,
+		},
+	}
+	for _, c := range cases {
+		var metas []*BlockMeta
+		for _, l := range c.blocks {
+			metas = append(metas, &BlockMeta{ExternalLabels: l})
+		}
+		testutil.Equals(t, c.exp, commonExternalLabels(metas...))
+	}
+}
+
+func TestLeveledCompactor_FailureBackoff(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "test")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	compactor, err := NewLeveledCompactor(nil, log.NewNopLogger(), []int64{20, 60}, nil)
+	testutil.Ok(t, err)
+	compactor.maxAttempts = 2
+
+	var dirs []string
+	for i := 0; i < 2; i++ {
+		b := createPopulatedBlock(t, tmpdir, 1, 10)
+		testutil.Ok(t, b.Close())
+		dirs = append(dirs, b.Dir())
+	}
+	// Compactions fail without the chunks of the first block.
+	testutil.Ok(t, os.RemoveAll(chunkDir(dirs[0])))
+	testutil.Ok(t, os.MkdirAll(chunkDir(dirs[0]), 0777))
+
+	for i := 1; i <= 2; i++ {
+		_, err = compactor.Compact(tmpdir, dirs...)
+		testutil.NotOk(t, err)
+
+		meta, err := readMetaFile(dirs[0])
+		testutil.Ok(t, err)
+		testutil.Equals(t, i, meta.Compaction.Failures)
+		testutil.Equals(t, i == 2, meta.Compaction.Failed)
+	}
+	b := compactor.backoffs[backoffKey(dirs)]
+	testutil.Equals(t, 2, b.failures)
+	testutil.Equals(t, 2*minCompactionBackoff, b.delay)
+
+	// A successful compaction resets the backoff.
+	compactor.trackAttempt(dirs, nil)
+	testutil.Equals(t, 0, len(compactor.backoffs))
+}
+
+func TestLeveledCompactor_PlanSkipsBackoff(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "test")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	for i := int64(0); i < 4; i++ {
+		meta := &BlockMeta{ULID: ulid.MustNew(uint64(i), nil), MinTime: i * 20, MaxTime: (i + 1) * 20}
+		b := createEmptyBlock(t, filepath.Join(tmpdir, meta.ULID.String()), meta)
+		testutil.Ok(t, b.Close())
+	}
+	compactor, err := NewLeveledCompactor(nil, log.NewNopLogger(), []int64{20, 60}, nil)
+	testutil.Ok(t, err)
+
+	plan, err := compactor.Plan(tmpdir)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 3, len(plan))
+
+	compactor.trackAttempt(plan, errors.New("compaction failed"))
+
+	res, err := compactor.Plan(tmpdir)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, len(res))
+
+	// Once the backoff expired the blocks are planned again.
+	b := compactor.backoffs[backoffKey(plan)]
+	b.next = time.Now()
+	compactor.backoffs[backoffKey(plan)] = b
+
+	res, err = compactor.Plan(tmpdir)
+	testutil.Ok(t, err)
+	testutil.Equals(t, plan, res)
+}
+
+func TestLeveledCompactor_PlanSkipsNoCompact(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "test")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	var dirs []string
+	for i := int64(0); i < 4; i++ {
+		meta := &BlockMeta{ULID: ulid.MustNew(uint64(i), nil), MinTime: i * 20, MaxTime: (i + 1) * 20}
+		dirs = append(dirs, filepath.Join(tmpdir, meta.ULID.String()))
+		b := createEmptyBlock(t, dirs[i], meta)
+		testutil.Ok(t, b.Close())
+	}
+	compactor, err := NewLeveledCompactor(nil, log.NewNopLogger(), []int64{20, 60}, nil)
+	testutil.Ok(t, err)
+
+	testutil.Ok(t, MarkBlockNoCompact(dirs[1], "broken"))
+
+	mark, err := readBlockMark(dirs[1], NoCompactMarkFilename)
+	testutil.Ok(t, err)
+	testutil.Equals(t, "broken", mark.Reason)
+
+	res, err := compactor.Plan(tmpdir)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, len(res))
+
+	// Unreadable markers exclude the block as well.
+	fn := filepath.Join(dirs[1], NoCompactMarkFilename)
+	testutil.Ok(t, ioutil.WriteFile(fn, []byte("{"), 0666))
+
+	res, err = compactor.Plan(tmpdir)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, len(res))
+
+	testutil.Ok(t, os.Remove(fn))
+
+	res, err = compactor.Plan(tmpdir)
+	testutil.Ok(t, err)
+	testutil.Equals(t, dirs[:3], res)
+}
+
 func TestCompactionFailWillCleanUpTempDir(t *testing.T) {
 	compactor, err := NewLeveledCompactor(nil, log.NewNopLogger(), []int64{
 		20,
@@ -387,6 +535,90 @@ func TestCompactionFailWillCleanUpTempDir(t *testing.T) {
 	testutil.Assert(t, os.IsNotExist(err), "directory is not cleaned up")
 }
 
+func TestLeveledCompactor_Deterministic(t *testing.T) {
+	head, err := NewHead(nil, nil, nil, 1000)
+	testutil.Ok(t, err)
+	defer head.Close()
+
+	app := head.Appender()
+	for i := 0; i < 50; i++ {
+		lset := labels.FromStrings(
+			"a", fmt.Sprintf("%d", i%7),
+			fmt.Sprintf("n%d", i%5), fmt.Sprintf("v%d", i),
+		)
+		for ts := int64(0); ts < 2000; ts += 100 {
+			_, err := app.Add(lset, ts, float64(i)*float64(ts))
+			testutil.Ok(t, err)
+		}
+	}
+	testutil.Ok(t, app.Commit())
+
+	// Persist the head into two blocks and compact them, which is done
+	// independently by each replica.
+	replicate := func() string {
+		dir, err := ioutil.TempDir("", "deterministic")
+		testutil.Ok(t, err)
+
+		compactor, err := NewLeveledCompactor(nil, log.NewNopLogger(), []int64{1000, 2000}, nil)
+		testutil.Ok(t, err)
+		compactor.deterministicULIDs = true
+
+		var dirs []string
+		for _, mint := range []int64{0, 1000} {
+			rh := &rangeHead{head: head, mint: mint, maxt: mint + 999}
+			uid, err := compactor.Write(dir, rh, mint, mint+1000, nil)
+			testutil.Ok(t, err)
+			dirs = append(dirs, filepath.Join(dir, uid.String()))
+		}
+		uid, err := compactor.Compact(dir, dirs...)
+		testutil.Ok(t, err)
+
+		// The compacted block must not take the ID of the block ending at the
+		// same timestamp, which would be overwritten by it.
+		for _, d := range dirs {
+			testutil.Assert(t, filepath.Base(d) != uid.String(), "compacted block has ID of parent %s", d)
+		}
+		return dir
+	}
+	dir1, dir2 := replicate(), replicate()
+	defer os.RemoveAll(dir1)
+	defer os.RemoveAll(dir2)
+
+	var files int
+	err = filepath.Walk(dir1, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir1, path)
+		testutil.Ok(t, err)
+
+		b1, err := ioutil.ReadFile(path)
+		testutil.Ok(t, err)
+		b2, err := ioutil.ReadFile(filepath.Join(dir2, rel))
+		testutil.Ok(t, err)
+
+		testutil.Assert(t, string(b1) == string(b2), "file %s differs between replicas", rel)
+		files++
+		return nil
+	})
+	testutil.Ok(t, err)
+	testutil.Assert(t, files > 0, "no block files written")
+
+	// Writing a block with the ID of an existing one fails instead of
+	// replacing it.
+	compactor, err := NewLeveledCompactor(nil, log.NewNopLogger(), []int64{1000}, nil)
+	testutil.Ok(t, err)
+	compactor.deterministicULIDs = true
+
+	uid, err := compactor.Write(dir1, &rangeHead{head: head, mint: 0, maxt: 999}, 0, 1000, nil)
+	testutil.NotOk(t, err)
+
+	_, err = readMetaFile(filepath.Join(dir1, uid.String()))
+	testutil.Ok(t, err)
+	_, err = os.Stat(filepath.Join(dir1, uid.String()+".tmp"))
+	testutil.Assert(t, os.IsNotExist(err), "temporary block dir is not cleaned up")
+}
+
 func metaRange(name string, mint, maxt int64, stats *BlockStats) dirMeta {
 	meta := &BlockMeta{MinTime: mint, MaxTime: maxt}
 	if stats != nil {
@@ -16,6 +16,7 @@ package tsdb
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -27,6 +28,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-kit/kit/log"
@@ -36,6 +38,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/tsdb/chunkenc"
 	"github.com/prometheus/tsdb/fileutil"
+	"github.com/prometheus/tsdb/index"
 	"github.com/prometheus/tsdb/labels"
 	"github.com/prometheus/tsdb/wal"
 	"golang.org/x/sync/errgroup"
@@ -46,23 +49,245 @@ import (
 var DefaultOptions = &Options{
 	WALFlushInterval:  5 * time.Second,
 	RetentionDuration: 15 * 24 * 60 * 60 * 1000, // 15 days in milliseconds
-	BlockRanges:       ExponentialBlockRanges(int64(2*time.Hour)/1e6, 3, 5),
+	MinBlockDuration:  2 * time.Hour,
+	MaxBlockDuration:  50 * time.Hour,
 	NoLockfile:        false,
 }
 
+// blockRangeStepSize is the factor between successive block ranges derived
+// from the minimum and maximum block durations.
+const blockRangeStepSize = 5
+
 // Options of the DB storage.
 type Options struct {
 	// The interval at which the write ahead log is flushed to disk.
 	WALFlushInterval time.Duration
 
-	// Duration of persisted data to keep.
+	// TimestampUnit is the unit of the timestamps of appended samples. It is
+	// recorded in the meta information of persisted blocks, blocks of other
+	// units are neither loaded nor compacted. Empty for milliseconds.
+	TimestampUnit TimestampUnit
+
+	// Duration of persisted data to keep in units of the timestamps.
 	RetentionDuration uint64
 
-	// The sizes of the Blocks.
+	// RetentionOverrides keep the series matching them for longer than
+	// RetentionDuration. When a block falls out of the retention, the series
+	// matching any override still in effect are copied into a new block
+	// before it is deleted.
+	RetentionOverrides []RetentionOverride
+
+	// BlockDeletionBatchSize is the maximum number of obsolete blocks deleted
+	// by each reload, oldest first. Remaining blocks are deleted by later
+	// reloads. Zero deletes all obsolete blocks at once.
+	BlockDeletionBatchSize int
+
+	// BlockDeletionRate limits the bytes per second at which the files of
+	// deleted blocks are removed, which avoids I/O spikes when deleting large
+	// blocks. Zero disables the limit.
+	BlockDeletionRate int64
+
+	// BlockDeletionTruncateStep, if set, shrinks files of deleted blocks in
+	// steps of the given number of bytes before unlinking them, so that file
+	// systems free their space incrementally.
+	BlockDeletionTruncateStep int64
+
+	// The sizes of the Blocks in units of the timestamps. If empty, they are
+	// derived from MinBlockDuration and MaxBlockDuration.
 	BlockRanges []int64
 
+	// MinBlockDuration is the time range of blocks persisted from the head.
+	// Compaction merges them into blocks growing by a factor of 5 per level
+	// up to MaxBlockDuration. Zero values fall back to the DefaultOptions.
+	MinBlockDuration time.Duration
+	MaxBlockDuration time.Duration
+
 	// NoLockfile disables creation and consideration of a lock file.
 	NoLockfile bool
+
+	// WALOnly writes data only to the write ahead log. No blocks are persisted
+	// or loaded and the head only retains about the smallest block range of data
+	// for queries. It is meant for agents that forward data by tailing the WAL.
+	WALOnly bool
+
+	// Limits on the number of series and samples returned through each Querier
+	// and on the approximate bytes of memory they occupy. Zero disables the
+	// respective limit.
+	MaxQuerySeries  int64
+	MaxQuerySamples int64
+	MaxQueryBytes   int64
+
+	// Logger receives structured events about block loads, compactions, WAL
+	// repairs, retention deletions and detected corruptions. It is used if no
+	// logger is passed to Open.
+	Logger log.Logger
+
+	// Tracer, if set, traces postings resolution as well as series and chunk
+	// reads of queriers.
+	Tracer Tracer
+
+	// AppendObserver, if set, is notified about appended samples, commits and
+	// newly created series.
+	AppendObserver AppendObserver
+
+	// CommitHook, if set, receives the samples of every commit once they were
+	// written to the WAL, e.g. to replicate them synchronously.
+	CommitHook CommitHook
+
+	// BlocksChanged, if set, is called after the set of loaded blocks changed,
+	// e.g. through compactions, retention or deletions, so that embedders can
+	// invalidate caches. It is called synchronously and must not call methods
+	// of the DB that load or delete blocks.
+	BlocksChanged func(BlocksChange)
+
+	// Admission, if set, is consulted before new series are created and before
+	// appended samples are committed. It may reject writes, e.g. of tenants
+	// exceeding their quota.
+	Admission AdmissionFunc
+
+	// MaxFutureTolerance is how far ahead of the current time samples may be.
+	// Appends of later samples fail with ErrTooFarInFuture. Zero accepts
+	// samples at any time in the future.
+	MaxFutureTolerance time.Duration
+
+	// ChunkPrecision, if set, returns the number of decimal digits to which
+	// the values of the series with the given labels are rounded. Chunks of
+	// such series use a lossy encoding that is much smaller for low precision
+	// data. Series for which it returns false keep full float64 precision.
+	ChunkPrecision func(labels.Labels) (int, bool)
+
+	// AutoChunkEncoding makes the head analyze the first samples of each
+	// chunk and switch to a more compact lossless encoding if the values
+	// allow for it, e.g. for integral or constant values.
+	AutoChunkEncoding bool
+
+	// IntegerSeries, if set, selects the series whose values are integers.
+	// They are stored as int64 in chunks of their own without losing
+	// precision to a float64 conversion. Samples are added to them through
+	// the IntAppender interface of appenders. Float values added to them
+	// must be whole numbers within the range of int64, others including
+	// staleness markers fail with ErrNotInteger.
+	IntegerSeries func(labels.Labels) bool
+
+	// HeadSnapshotOnShutdown makes Close write a snapshot of the series and
+	// chunks of the head. It is loaded on the next start instead of replaying
+	// the WAL unless the WAL was written to in the meantime.
+	HeadSnapshotOnShutdown bool
+
+	// LabelValidation, if set, is applied to the label sets of new series.
+	// Appends of series failing it return an *InvalidLabelsError.
+	LabelValidation *LabelValidation
+
+	// DeterministicULIDs derives the ULIDs of new blocks from their time range
+	// and the ULIDs of their parents instead of randomness and the current time.
+	// Replicas compacting the same data then produce identical blocks which can
+	// be verified by hash.
+	DeterministicULIDs bool
+
+	// ExternalLabels are attached to the meta information of blocks persisted
+	// from the head. Compacted blocks keep the external labels common to all
+	// their parents.
+	ExternalLabels labels.Labels
+
+	// QueryExternalLabels adds the ExternalLabels to all series returned by
+	// queriers and strips matchers on them, e.g. for federation setups.
+	QueryExternalLabels bool
+
+	// MaxCompactionAttempts is the number of times compacting a set of blocks
+	// is attempted, with exponential backoff in between, before its blocks are
+	// excluded from compaction. Zero uses a default of 3 attempts.
+	MaxCompactionAttempts int
+
+	// UsePread reads block files with pread instead of mapping them into
+	// memory, which behaves badly on network filesystems such as NFS or CIFS.
+	// Files that cannot be mapped are always read with pread.
+	UsePread bool
+
+	// CompressIndex compresses the label index and postings sections of newly
+	// written block indices, trading CPU time for disk space and page cache.
+	CompressIndex bool
+
+	// SeparatePostings writes the postings of newly written block indices
+	// into a separate file, keeping the frequently accessed symbols and
+	// series of the index small and page cache friendly.
+	SeparatePostings bool
+
+	// BlockShards partitions the series of newly written blocks into as many
+	// shards by the hash of their labels. Each shard has its own index and
+	// chunks, which are written concurrently during compactions. Queries fan
+	// out across the shards. Values below two write unsharded blocks.
+	BlockShards int
+
+	// AggregationRules are evaluated against the head whenever it is written
+	// into a block. The series they produce are stored in the block along
+	// with the original ones and must not collide with them.
+	AggregationRules []AggregationRule
+
+	// RangeLabels lists labels with numeric values, such as "le", whose
+	// smallest and largest values are recorded in the meta of new blocks.
+	// Queries matching values outside of them skip the block.
+	RangeLabels []string
+
+	// QueryCacheSize is the maximum number of series references cached for the
+	// label matchers of queries against persisted blocks. The cache is dropped
+	// whenever the set of blocks changes. Zero disables the cache.
+	QueryCacheSize int
+
+	// ChunkFetchConcurrency is the maximum number of chunks a query against
+	// persisted blocks fetches and decodes concurrently. Series iterators read
+	// up to that many chunks ahead. Zero reads chunks sequentially.
+	ChunkFetchConcurrency int
+
+	// ScrubRate, if set, makes the DB continuously verify the checksums of
+	// the files of all loaded blocks in the background, reading no more than
+	// that many bytes per second. Corrupted blocks are logged and reported by
+	// Status before they are hit by queries or compactions.
+	ScrubRate int64
+
+	// ChunkCache, if set, caches the chunks read by queries against persisted
+	// blocks. NewLRUChunkCache returns an in-memory implementation.
+	ChunkCache ChunkCache
+
+	// MaxConcurrentSelects is the maximum number of queriers executing
+	// selects at once across the DB. A querier holds a slot from its first
+	// select until all returned series sets are exhausted or it is closed.
+	// Further selects wait for a free slot until their context is canceled or
+	// QueryQueueTimeout expires. Zero disables the limit.
+	MaxConcurrentSelects int
+	QueryQueueTimeout    time.Duration
+
+	// ActiveQueryLogSize is the number of selects of open queriers recorded
+	// in the queries.active file of the DB directory. Queries left in the
+	// file by a crash, e.g. for running out of memory, are logged on Open.
+	// Further selects are not recorded. Zero disables the log.
+	ActiveQueryLogSize int
+
+	// Downloader, if set, fetches blocks from a bucket for queries reaching
+	// before the oldest data on local disk.
+	Downloader *Downloader
+}
+
+// blockRanges returns the block ranges in the given timestamp unit starting at
+// min and growing exponentially while not exceeding max.
+func blockRanges(min, max time.Duration, unit TimestampUnit) ([]int64, error) {
+	if min == 0 {
+		min = DefaultOptions.MinBlockDuration
+	}
+	if max == 0 {
+		max = DefaultOptions.MaxBlockDuration
+	}
+	if min < unit.Duration() {
+		return nil, errors.Errorf("min block duration %s must be at least 1%s", min, unit)
+	}
+	if max < min {
+		return nil, errors.Errorf("max block duration %s is smaller than min block duration %s", max, min)
+	}
+	var rngs []int64
+
+	for r := min; r <= max; r *= blockRangeStepSize {
+		rngs = append(rngs, unit.FromDuration(r))
+	}
+	return rngs, nil
 }
 
 // Appender allows appending a batch of data. It must be completed with a
@@ -90,6 +315,37 @@ type Appender interface {
 	Rollback() error
 }
 
+// IntAppender is implemented by appenders that can add integer values without
+// converting them to float64. Appenders of the DB and the head implement it.
+// Integer values of series that do not store integers are converted to float64
+// and float values added to integer series are truncated.
+type IntAppender interface {
+	Appender
+
+	// AddInt is like Add for an integer value.
+	AddInt(l labels.Labels, t int64, v int64) (uint64, error)
+
+	// AddIntFast is like AddFast for an integer value.
+	AddIntFast(ref uint64, t int64, v int64) error
+}
+
+// CreatedTimestampAppender is implemented by appenders that can record the time
+// at which a counter was created. Appenders of the DB and the head implement it.
+// A zero sample is added at the created timestamp ahead of the first sample of
+// the counter, which makes rates over counters that only existed shortly
+// account for their increase from zero.
+type CreatedTimestampAppender interface {
+	Appender
+
+	// AddCreated adds a zero sample at the created timestamp ct for the
+	// series, which must be before the timestamp t of the sample added next.
+	// Nothing is added if the series has samples at or after ct already.
+	AddCreated(l labels.Labels, t, ct int64) (uint64, error)
+
+	// AddCreatedFast is like AddCreated for the referenced series.
+	AddCreatedFast(ref uint64, t, ct int64) error
+}
+
 // DB handles reads and writes of time series falling into
 // a hashed partition of a seriedb.
 type DB struct {
@@ -98,16 +354,31 @@ type DB struct {
 
 	logger    log.Logger
 	metrics   *dbMetrics
-	opts      *Options
 	chunkPool chunkenc.Pool
 	compactor Compactor
 
+	// optsMtx guards opts, which is replaced by ApplyConfig.
+	optsMtx sync.RWMutex
+	opts    *Options
+
 	// Mutex for that must be held when modifying the general block layout.
 	mtx    sync.RWMutex
 	blocks []*Block
 
 	head *Head
 
+	// blockReads counts reads of loaded blocks.
+	blockReads *blockReadMetrics
+	// queryCache is nil if disabled.
+	queryCache *queryCache
+	// queryGate is nil if disabled.
+	queryGate *queryGate
+	// queryLog is nil if disabled.
+	queryLog *activeQueryLog
+	// scrubber is nil if disabled. scrubDonec is closed once it stopped.
+	scrubber   *scrubber
+	scrubDonec chan struct{}
+
 	compactc chan struct{}
 	donec    chan struct{}
 	stopc    chan struct{}
@@ -115,6 +386,20 @@ type DB struct {
 	// cmtx is used to control compactions and deletions.
 	cmtx               sync.Mutex
 	compactionsEnabled bool
+
+	// freeSpace returns the free disk space in bytes of the filesystem holding a directory.
+	freeSpace func(dir string) (uint64, error)
+
+	// Unix time in nanoseconds of the last successful compaction. Accessed atomically.
+	lastCompaction int64
+	// Number of corrupted blocks found by the last reload. Accessed atomically.
+	corruptedBlocks int64
+
+	// Blocks marked for deletion through MarkBlockForDeletion whose files are
+	// removed once their readers are closed.
+	deletionsMtx     sync.Mutex
+	pendingDeletions map[ulid.ULID]struct{}
+	deletions        sync.WaitGroup
 }
 
 type dbMetrics struct {
@@ -123,6 +408,7 @@ type dbMetrics struct {
 	reloads              prometheus.Counter
 	reloadsFailed        prometheus.Counter
 	compactionsTriggered prometheus.Counter
+	compactionsDeferred  prometheus.Counter
 	cutoffs              prometheus.Counter
 	cutoffsFailed        prometheus.Counter
 	startTime            prometheus.GaugeFunc
@@ -165,6 +451,10 @@ func newDBMetrics(db *DB, r prometheus.Registerer) *dbMetrics {
 		Name: "prometheus_tsdb_compactions_triggered_total",
 		Help: "Total number of triggered compactions for the partition.",
 	})
+	m.compactionsDeferred = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "prometheus_tsdb_compactions_deferred_total",
+		Help: "Total number of compactions deferred due to insufficient disk space.",
+	})
 	m.cutoffs = prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "prometheus_tsdb_retention_cutoffs_total",
 		Help: "Number of times the database cut off block data from disk.",
@@ -198,6 +488,7 @@ func newDBMetrics(db *DB, r prometheus.Registerer) *dbMetrics {
 			m.cutoffs,
 			m.cutoffsFailed,
 			m.compactionsTriggered,
+			m.compactionsDeferred,
 			m.startTime,
 			m.tombCleanTimer,
 		)
@@ -210,11 +501,27 @@ func Open(dir string, l log.Logger, r prometheus.Registerer, opts *Options) (db
 	if err := os.MkdirAll(dir, 0777); err != nil {
 		return nil, err
 	}
+	if opts == nil {
+		opts = DefaultOptions
+	}
+	if l == nil {
+		l = opts.Logger
+	}
 	if l == nil {
 		l = log.NewNopLogger()
 	}
-	if opts == nil {
-		opts = DefaultOptions
+	if err := validateOptions(opts); err != nil {
+		return nil, err
+	}
+	if len(opts.BlockRanges) == 0 {
+		rngs, err := blockRanges(opts.MinBlockDuration, opts.MaxBlockDuration, opts.TimestampUnit)
+		if err != nil {
+			return nil, err
+		}
+		// Don't modify the options passed by the caller.
+		o := *opts
+		o.BlockRanges = rngs
+		opts = &o
 	}
 	// Fixup bad format written by Prometheus 2.1.
 	if err := repairBadIndexVersion(l, dir); err != nil {
@@ -234,8 +541,11 @@ func Open(dir string, l log.Logger, r prometheus.Registerer, opts *Options) (db
 		stopc:              make(chan struct{}),
 		compactionsEnabled: true,
 		chunkPool:          chunkenc.NewPool(),
+		freeSpace:          fileutil.FreeSpace,
+		pendingDeletions:   map[ulid.ULID]struct{}{},
 	}
 	db.metrics = newDBMetrics(db, r)
+	db.blockReads = newBlockReadMetrics(r)
 
 	if !opts.NoLockfile {
 		absdir, err := filepath.Abs(dir)
@@ -249,10 +559,14 @@ func Open(dir string, l log.Logger, r prometheus.Registerer, opts *Options) (db
 		db.lockf = lockf
 	}
 
-	db.compactor, err = NewLeveledCompactor(r, l, opts.BlockRanges, db.chunkPool)
+	compactor, err := NewLeveledCompactor(r, l, opts.BlockRanges, db.chunkPool)
 	if err != nil {
 		return nil, errors.Wrap(err, "create leveled compactor")
 	}
+	compactor.deterministicULIDs = opts.DeterministicULIDs
+	compactor.pread = opts.UsePread
+	configureCompactor(compactor, opts)
+	db.compactor = compactor
 
 	wlog, err := wal.New(l, r, filepath.Join(dir, "wal"))
 	if err != nil {
@@ -262,6 +576,34 @@ func Open(dir string, l log.Logger, r prometheus.Registerer, opts *Options) (db
 	if err != nil {
 		return nil, err
 	}
+	db.head.observer = opts.AppendObserver
+	db.head.commitHook = opts.CommitHook
+	db.head.admission = opts.Admission
+	db.head.validation = opts.LabelValidation
+	db.head.chunkPrecision = opts.ChunkPrecision
+	db.head.autoChunkEncoding = opts.AutoChunkEncoding
+	db.head.integerSeries = opts.IntegerSeries
+	db.head.snapshotOnShutdown = opts.HeadSnapshotOnShutdown
+	db.head.timestampUnit = opts.TimestampUnit
+	db.head.futureTolerance = opts.TimestampUnit.FromDuration(opts.MaxFutureTolerance)
+
+	if opts.QueryCacheSize > 0 {
+		db.queryCache = newQueryCache(r, opts.QueryCacheSize)
+	}
+	if opts.MaxConcurrentSelects > 0 {
+		db.queryGate = newQueryGate(r, opts.MaxConcurrentSelects, opts.QueryQueueTimeout)
+	}
+	if opts.ActiveQueryLogSize > 0 {
+		db.queryLog, err = openActiveQueryLog(l, dir, opts.ActiveQueryLogSize)
+		if err != nil {
+			return nil, errors.Wrap(err, "open active query log")
+		}
+	}
+
+	// Rebuild the newest block from the WAL if a crash left it corrupted.
+	if err := repairNewestBlock(l, dir, compactor, opts.BlockRanges[0]); err != nil {
+		return nil, errors.Wrap(err, "repair newest block")
+	}
 	if err := db.reload(); err != nil {
 		return nil, err
 	}
@@ -271,9 +613,107 @@ func Open(dir string, l log.Logger, r prometheus.Registerer, opts *Options) (db
 
 	go db.run()
 
+	if opts.ScrubRate > 0 && !opts.WALOnly {
+		db.scrubber = newScrubber(db, r, opts.ScrubRate)
+		db.scrubDonec = make(chan struct{})
+
+		go func() {
+			defer close(db.scrubDonec)
+			db.scrubber.run(db.stopc)
+		}()
+	}
 	return db, nil
 }
 
+// validateOptions checks the options that are applied on Open and ApplyConfig.
+func validateOptions(opts *Options) error {
+	if err := opts.TimestampUnit.validate(); err != nil {
+		return err
+	}
+	if opts.BlockShards > MaxBlockShards {
+		return errors.Errorf("number of block shards %d exceeds maximum of %d", opts.BlockShards, MaxBlockShards)
+	}
+	if opts.MaxCompactionAttempts < 0 {
+		return errors.Errorf("invalid number of compaction attempts %d", opts.MaxCompactionAttempts)
+	}
+	for i := range opts.AggregationRules {
+		if err := opts.AggregationRules[i].validate(); err != nil {
+			return errors.Wrapf(err, "invalid aggregation rule %d", i)
+		}
+	}
+	return nil
+}
+
+// configureCompactor applies the compaction settings of opts to c.
+func configureCompactor(c *LeveledCompactor, opts *Options) {
+	c.externalLabels = opts.ExternalLabels
+	c.timestampUnit = opts.TimestampUnit
+	c.maxAttempts = defaultMaxCompactionAttempts
+	if opts.MaxCompactionAttempts > 0 {
+		c.maxAttempts = opts.MaxCompactionAttempts
+	}
+	c.indexCompression = index.CompressionNone
+	if opts.CompressIndex {
+		c.indexCompression = index.CompressionSnappy
+	}
+	c.separatePostings = opts.SeparatePostings
+	c.shards = opts.BlockShards
+	c.aggregationRules = opts.AggregationRules
+	c.rangeLabels = opts.RangeLabels
+}
+
+func (db *DB) options() *Options {
+	db.optsMtx.RLock()
+	defer db.optsMtx.RUnlock()
+	return db.opts
+}
+
+// ApplyConfig changes the options of a running DB. Only the retention, block
+// deletions, the query limits, the external labels and the settings of blocks
+// written by future compactions are applied, which are RetentionDuration,
+// RetentionOverrides, BlockDeletionBatchSize, BlockDeletionRate,
+// BlockDeletionTruncateStep, MaxQuerySeries, MaxQuerySamples, MaxQueryBytes,
+// ExternalLabels, QueryExternalLabels, MaxCompactionAttempts, CompressIndex,
+// SeparatePostings, BlockShards, AggregationRules and RangeLabels. All other
+// options are ignored and require reopening the DB. Queriers opened before
+// keep the previous limits.
+func (db *DB) ApplyConfig(opts *Options) error {
+	if err := validateOptions(opts); err != nil {
+		return err
+	}
+	// Wait for running compactions and deletions, which read the options.
+	db.cmtx.Lock()
+	defer db.cmtx.Unlock()
+
+	o := *db.options()
+	o.RetentionDuration = opts.RetentionDuration
+	o.RetentionOverrides = opts.RetentionOverrides
+	o.BlockDeletionBatchSize = opts.BlockDeletionBatchSize
+	o.BlockDeletionRate = opts.BlockDeletionRate
+	o.BlockDeletionTruncateStep = opts.BlockDeletionTruncateStep
+	o.MaxQuerySeries = opts.MaxQuerySeries
+	o.MaxQuerySamples = opts.MaxQuerySamples
+	o.MaxQueryBytes = opts.MaxQueryBytes
+	o.ExternalLabels = opts.ExternalLabels
+	o.QueryExternalLabels = opts.QueryExternalLabels
+	o.MaxCompactionAttempts = opts.MaxCompactionAttempts
+	o.CompressIndex = opts.CompressIndex
+	o.SeparatePostings = opts.SeparatePostings
+	o.BlockShards = opts.BlockShards
+	o.AggregationRules = opts.AggregationRules
+	o.RangeLabels = opts.RangeLabels
+
+	if c, ok := db.compactor.(*LeveledCompactor); ok {
+		configureCompactor(c, &o)
+	}
+	db.optsMtx.Lock()
+	db.opts = &o
+	db.optsMtx.Unlock()
+
+	level.Info(db.logger).Log("msg", "applied new configuration", "retention", o.RetentionDuration)
+	return nil
+}
+
 // Dir returns the directory of the database.
 func (db *DB) Dir() string {
 	return db.dir
@@ -315,7 +755,7 @@ func (db *DB) run() {
 }
 
 func (db *DB) beyondRetention(meta *BlockMeta) bool {
-	if db.opts.RetentionDuration == 0 {
+	if db.options().RetentionDuration == 0 {
 		return false
 	}
 
@@ -328,7 +768,7 @@ func (db *DB) beyondRetention(meta *BlockMeta) bool {
 	}
 
 	last := blocks[len(db.blocks)-1]
-	mint := last.Meta().MaxTime - int64(db.opts.RetentionDuration)
+	mint := last.Meta().MaxTime - int64(db.options().RetentionDuration)
 
 	return meta.MaxTime < mint
 }
@@ -345,6 +785,22 @@ type dbAppender struct {
 	db *DB
 }
 
+func (a dbAppender) AddInt(l labels.Labels, t int64, v int64) (uint64, error) {
+	return a.Appender.(IntAppender).AddInt(l, t, v)
+}
+
+func (a dbAppender) AddIntFast(ref uint64, t int64, v int64) error {
+	return a.Appender.(IntAppender).AddIntFast(ref, t, v)
+}
+
+func (a dbAppender) AddCreated(l labels.Labels, t, ct int64) (uint64, error) {
+	return a.Appender.(CreatedTimestampAppender).AddCreated(l, t, ct)
+}
+
+func (a dbAppender) AddCreatedFast(ref uint64, t, ct int64) error {
+	return a.Appender.(CreatedTimestampAppender).AddCreatedFast(ref, t, ct)
+}
+
 func (a dbAppender) Commit() error {
 	err := a.Appender.Commit()
 
@@ -359,7 +815,11 @@ func (a dbAppender) Commit() error {
 	return err
 }
 
-// Compact data if possible. After successful compaction blocks are reloaded
+// Compact data if possible. Whenever the head spans more than 1.5 times the
+// smallest block range, its oldest block range is persisted as a new block. That
+// range is then truncated from the head, which removes it from memory and
+// checkpoints the WAL segments holding its data.
+// After successful compaction blocks are reloaded
 // which will also trigger blocks to be deleted that fall out of the retention
 // window.
 // If no blocks are compacted, the retention window state doesn't change. Thus,
@@ -373,6 +833,9 @@ func (db *DB) compact() (err error) {
 	if !db.compactionsEnabled {
 		return nil
 	}
+	if db.options().WALOnly {
+		return db.truncateWALOnly()
+	}
 
 	// Check whether we have pending head blocks that are ready to be persisted.
 	// They have the highest priority.
@@ -384,10 +847,15 @@ func (db *DB) compact() (err error) {
 		}
 		// The head has a compactable range if 1.5 level 0 ranges are between the oldest
 		// and newest timestamp. The 0.5 acts as a buffer of the appendable window.
-		if db.head.MaxTime()-db.head.MinTime() <= db.opts.BlockRanges[0]/2*3 {
+		if db.head.MaxTime()-db.head.MinTime() <= db.options().BlockRanges[0]/2*3 {
 			break
 		}
-		mint, maxt := rangeForTimestamp(db.head.MinTime(), db.opts.BlockRanges[0])
+		mint, maxt := rangeForTimestamp(db.head.MinTime(), db.options().BlockRanges[0])
+
+		// The head may start within the range if its beginning was flushed before.
+		if m := db.head.MinTime(); m > mint {
+			mint = m
+		}
 
 		// Wrap head into a range that bounds all reads to it.
 		head := &rangeHead{
@@ -404,12 +872,18 @@ func (db *DB) compact() (err error) {
 		if _, err = db.compactor.Write(db.dir, head, mint, maxt, nil); err != nil {
 			return errors.Wrap(err, "persist head block")
 		}
+		atomic.StoreInt64(&db.lastCompaction, time.Now().UnixNano())
 
 		runtime.GC()
 
 		if err := db.reload(); err != nil {
 			return errors.Wrap(err, "reload blocks")
 		}
+		// Reloading truncates the head to the most recent block already. Do it
+		// explicitly so the cut does not depend on which blocks are on disk.
+		if err := db.head.Truncate(maxt); err != nil {
+			return errors.Wrap(err, "head truncate failed")
+		}
 		runtime.GC()
 	}
 
@@ -428,10 +902,16 @@ func (db *DB) compact() (err error) {
 			return nil
 		default:
 		}
+		// Compaction is retried in the next cycle, hopefully after retention
+		// freed up disk space.
+		if !db.canCompact(plan) {
+			break
+		}
 
 		if _, err := db.compactor.Compact(db.dir, plan...); err != nil {
 			return errors.Wrapf(err, "compact %s", plan)
 		}
+		atomic.StoreInt64(&db.lastCompaction, time.Now().UnixNano())
 		runtime.GC()
 
 		if err := db.reload(); err != nil {
@@ -443,6 +923,146 @@ func (db *DB) compact() (err error) {
 	return nil
 }
 
+// canCompact returns whether the filesystem holding the database has enough free
+// space to compact the blocks in dirs. The compacted block is estimated to be as
+// large as the blocks it is created from. Compaction is not deferred if the free
+// space cannot be determined.
+func (db *DB) canCompact(dirs []string) bool {
+	var size int64
+
+	for _, d := range dirs {
+		s, err := dirSize(d)
+		if err != nil {
+			level.Warn(db.logger).Log("msg", "estimate compaction size", "dir", d, "err", err)
+			return true
+		}
+		size += s
+	}
+	free, err := db.freeSpace(db.dir)
+	if err != nil {
+		if err != fileutil.ErrFreeSpaceUnsupported {
+			level.Warn(db.logger).Log("msg", "determine free disk space", "err", err)
+		}
+		return true
+	}
+	if free >= uint64(size) {
+		return true
+	}
+	db.metrics.compactionsDeferred.Inc()
+	level.Warn(db.logger).Log(
+		"msg", "defer compaction due to insufficient disk space",
+		"blocks", fmt.Sprintf("%v", dirs),
+		"required", size,
+		"free", free,
+	)
+	return false
+}
+
+// truncateWALOnly drops the oldest block ranges from the head instead of persisting
+// them once the head spans 1.5 times the smallest block range.
+func (db *DB) truncateWALOnly() error {
+	for db.head.MaxTime()-db.head.MinTime() > db.options().BlockRanges[0]/2*3 {
+		select {
+		case <-db.stopc:
+			return nil
+		default:
+		}
+		_, maxt := rangeForTimestamp(db.head.MinTime(), db.options().BlockRanges[0])
+
+		if err := db.head.Truncate(maxt); err != nil {
+			return errors.Wrap(err, "head truncate failed")
+		}
+	}
+	return nil
+}
+
+// Status describes the state of a DB.
+type Status struct {
+	// WALReplayedCleanly is false if the WAL was found corrupted on startup
+	// and had to be repaired, which may have discarded data.
+	WALReplayedCleanly bool
+	// LastCompaction is the time of the last successful compaction. It is
+	// zero if no compaction succeeded since the DB was opened.
+	LastCompaction time.Time
+	// PendingCompactions is the number of head blocks ready to be persisted
+	// plus one if persisted blocks are ready to be compacted.
+	PendingCompactions int
+	// CorruptedBlocks is the number of blocks with unreadable meta information
+	// found by the last reload.
+	CorruptedBlocks int
+	// Time range of the data in the head.
+	HeadMinTime, HeadMaxTime int64
+	// ScrubCorruptedBlocks is the number of loaded blocks whose files did
+	// not match their checksums when last verified by the scrubber.
+	ScrubCorruptedBlocks int
+	// PendingDeletions lists the blocks marked for deletion through
+	// MarkBlockForDeletion that are still waiting for readers to be closed,
+	// sorted by ULID.
+	PendingDeletions []ulid.ULID
+}
+
+// Status returns the current status of the DB. It is cheap enough to be
+// called by health and readiness checks.
+func (db *DB) Status() (Status, error) {
+	s := Status{
+		WALReplayedCleanly: !db.head.walRepaired,
+		CorruptedBlocks:    int(atomic.LoadInt64(&db.corruptedBlocks)),
+		HeadMinTime:        db.head.MinTime(),
+		HeadMaxTime:        db.head.MaxTime(),
+	}
+	if t := atomic.LoadInt64(&db.lastCompaction); t != 0 {
+		s.LastCompaction = time.Unix(0, t)
+	}
+	if db.scrubber != nil {
+		s.ScrubCorruptedBlocks = db.scrubber.corrupted()
+	}
+	for id := range db.pendingDeletionIDs() {
+		s.PendingDeletions = append(s.PendingDeletions, id)
+	}
+	sort.Slice(s.PendingDeletions, func(i, j int) bool {
+		return s.PendingDeletions[i].Compare(s.PendingDeletions[j]) < 0
+	})
+	// Count the head blocks the same way compact() cuts them.
+	rng := db.options().BlockRanges[0]
+	for mint := s.HeadMinTime; s.HeadMaxTime-mint > rng/2*3; {
+		s.PendingCompactions++
+		_, mint = rangeForTimestamp(mint, rng)
+	}
+	if db.options().WALOnly {
+		return s, nil
+	}
+	plan, err := db.planLoaded()
+	if err != nil {
+		return s, errors.Wrap(err, "plan compaction")
+	}
+	if len(plan) > 0 {
+		s.PendingCompactions++
+	}
+	return s, nil
+}
+
+// planLoaded plans a compaction of the loaded blocks. Unlike Compactor.Plan it
+// does not read the block directories, which may concurrently be compacted.
+func (db *DB) planLoaded() ([]string, error) {
+	lc, ok := db.compactor.(*LeveledCompactor)
+	if !ok {
+		return db.compactor.Plan(db.dir)
+	}
+	var dms []dirMeta
+
+	db.mtx.RLock()
+	for _, b := range db.blocks {
+		meta := b.Meta()
+		dms = append(dms, dirMeta{dir: b.Dir(), meta: &meta})
+	}
+	db.mtx.RUnlock()
+
+	if len(dms) == 0 {
+		return nil, nil
+	}
+	return lc.plan(dms)
+}
+
 func (db *DB) getBlock(id ulid.ULID) (*Block, bool) {
 	for _, b := range db.blocks {
 		if b.Meta().ULID == id {
@@ -452,10 +1072,83 @@ func (db *DB) getBlock(id ulid.ULID) (*Block, bool) {
 	return nil, false
 }
 
+// MarkBlockForDeletion marks the loaded block with the given ID for deletion
+// and unloads it, so that it is not seen by new queriers. Its files are removed
+// in the background once all readers of the block are closed. If the process
+// exits before, the deletion is completed on the next startup.
+func (db *DB) MarkBlockForDeletion(id ulid.ULID) error {
+	db.cmtx.Lock()
+	defer db.cmtx.Unlock()
+
+	b, ok := db.getBlock(id)
+	if !ok {
+		return errors.Wrapf(ErrNotFound, "block %s", id)
+	}
+	if err := MarkBlockForDeletion(b.Dir(), "deleted through API"); err != nil {
+		return errors.Wrap(err, "mark block")
+	}
+	db.mtx.Lock()
+	oldBlocks := db.blocks
+	blocks := make([]*Block, 0, len(oldBlocks)-1)
+	for _, o := range oldBlocks {
+		if o != b {
+			blocks = append(blocks, o)
+		}
+	}
+	db.blocks = blocks
+	db.mtx.Unlock()
+
+	db.blocksChanged(oldBlocks, blocks)
+
+	db.deletionsMtx.Lock()
+	db.pendingDeletions[id] = struct{}{}
+	db.deletionsMtx.Unlock()
+
+	db.deletions.Add(1)
+	go func() {
+		defer db.deletions.Done()
+
+		// Wait for pending readers.
+		if err := b.Close(); err != nil {
+			level.Warn(db.logger).Log("msg", "closing block failed", "err", err)
+		}
+		// Reloads must not see the block while it is removed.
+		db.cmtx.Lock()
+		defer db.cmtx.Unlock()
+
+		if err := removeBlockDir(b.Dir(), db.deletionThrottle()); err != nil {
+			level.Warn(db.logger).Log("msg", "deleting block failed, retrying later", "ulid", id, "err", err)
+		} else {
+			level.Info(db.logger).Log("msg", "deleted block marked for deletion", "ulid", id)
+		}
+		db.deletionsMtx.Lock()
+		delete(db.pendingDeletions, id)
+		db.deletionsMtx.Unlock()
+	}()
+	return nil
+}
+
+// pendingDeletionIDs returns the blocks marked for deletion through
+// MarkBlockForDeletion that were not removed yet.
+func (db *DB) pendingDeletionIDs() map[ulid.ULID]struct{} {
+	db.deletionsMtx.Lock()
+	defer db.deletionsMtx.Unlock()
+
+	res := make(map[ulid.ULID]struct{}, len(db.pendingDeletions))
+	for id := range db.pendingDeletions {
+		res[id] = struct{}{}
+	}
+	return res
+}
+
 // reload on-disk blocks and trigger head truncation if new blocks appeared. It takes
 // a list of block directories which should be deleted during reload.
 // Blocks that are obsolete due to replacement or retention will be deleted.
 func (db *DB) reload() (err error) {
+	// Blocks are neither written nor read in WAL only mode.
+	if db.options().WALOnly {
+		return nil
+	}
 	defer func() {
 		if err != nil {
 			db.metrics.reloadsFailed.Inc()
@@ -475,9 +1168,12 @@ func (db *DB) reload() (err error) {
 	// blocks with their parents, we can pick up the deletion where it left off during a crash.
 	var (
 		blocks     []*Block
+		pending    = db.pendingDeletionIDs()
 		corrupted  = map[ulid.ULID]error{}
 		opened     = map[ulid.ULID]struct{}{}
 		deleteable = map[ulid.ULID]struct{}{}
+		expired    = map[ulid.ULID]struct{}{}
+		retain     []*BlockMeta
 	)
 	for _, dir := range dirs {
 		meta, err := readMetaFile(dir)
@@ -494,21 +1190,75 @@ func (db *DB) reload() (err error) {
 			corrupted[ulid] = err
 			continue
 		}
-		if db.beyondRetention(meta) {
+		// Blocks marked for deletion through the API are removed once their
+		// readers are closed.
+		if _, ok := pending[meta.ULID]; ok {
+			continue
+		}
+		// Finish deletions that did not complete before.
+		if meta.PendingDeletion {
 			deleteable[meta.ULID] = struct{}{}
 			continue
 		}
+		if unit := db.options().TimestampUnit; !meta.TimestampUnit.Equal(unit) {
+			return errors.Errorf("block %s has timestamp unit %s but the database uses %s", meta.ULID, meta.TimestampUnit, unit)
+		}
+		// Only delete blocks whose marker is intact.
+		if mark, err := readBlockMark(dir, DeletionMarkFilename); err != nil {
+			level.Warn(db.logger).Log("msg", "read deletion marker", "dir", dir, "err", err)
+		} else if mark != nil {
+			level.Info(db.logger).Log("msg", "deleting block marked for deletion", "ulid", meta.ULID, "reason", mark.Reason)
+			deleteable[meta.ULID] = struct{}{}
+			continue
+		}
+		if db.beyondRetention(meta) {
+			overrides, retention := db.activeRetentionOverrides(meta)
+			if len(overrides) == 0 {
+				deleteable[meta.ULID] = struct{}{}
+				expired[meta.ULID] = struct{}{}
+				continue
+			}
+			if meta.RetentionOverride != retention {
+				retain = append(retain, meta)
+			}
+		}
 		for _, b := range meta.Compaction.Parents {
 			deleteable[b.ULID] = struct{}{}
 		}
 	}
+	// Copy the series of expired blocks that are retained by overrides before
+	// deleting them. Blocks whose series were already copied before a crash
+	// are deleted right away.
+	for _, meta := range retain {
+		if _, ok := deleteable[meta.ULID]; ok {
+			expired[meta.ULID] = struct{}{}
+			continue
+		}
+		overrides, retention := db.activeRetentionOverrides(meta)
+
+		dir, err := db.retainSeries(meta, overrides, retention)
+		if err != nil {
+			level.Warn(db.logger).Log("msg", "retaining series failed, retrying later", "ulid", meta.ULID, "err", err)
+			continue
+		}
+		if dir != "" {
+			dirs = append(dirs, dir)
+		}
+		deleteable[meta.ULID] = struct{}{}
+		expired[meta.ULID] = struct{}{}
+	}
+	atomic.StoreInt64(&db.corruptedBlocks, int64(len(corrupted)))
+
 	// Blocks we failed to open should all be those we are want to delete anyway.
 	for c, err := range corrupted {
 		if _, ok := deleteable[c]; !ok {
+			level.Error(db.logger).Log("msg", "corrupted block", "ulid", c, "err", err)
 			return errors.Wrapf(err, "unexpected corrupted block %s", c)
 		}
 	}
 	// Load new blocks into memory.
+	var toOpen []string
+
 	for _, dir := range dirs {
 		meta, err := readMetaFile(dir)
 		if err != nil {
@@ -518,19 +1268,31 @@ func (db *DB) reload() (err error) {
 		if _, ok := deleteable[meta.ULID]; ok {
 			continue
 		}
+		if _, ok := pending[meta.ULID]; ok {
+			continue
+		}
 		// See if we already have the block in memory or open it otherwise.
-		b, ok := db.getBlock(meta.ULID)
-		if !ok {
-			b, err = OpenBlock(dir, db.chunkPool)
-			if err != nil {
-				return errors.Wrapf(err, "open block %s", dir)
-			}
+		if b, ok := db.getBlock(meta.ULID); ok {
+			blocks = append(blocks, b)
+			opened[meta.ULID] = struct{}{}
+			continue
 		}
+		toOpen = append(toOpen, dir)
+	}
+	newBlocks, err := db.openBlocks(toOpen)
+	if err != nil {
+		return err
+	}
+	for _, b := range newBlocks {
 		blocks = append(blocks, b)
-		opened[meta.ULID] = struct{}{}
+		opened[b.Meta().ULID] = struct{}{}
 	}
 	sort.Slice(blocks, func(i, j int) bool {
-		return blocks[i].Meta().MinTime < blocks[j].Meta().MinTime
+		mi, mj := blocks[i].Meta(), blocks[j].Meta()
+		if mi.MinTime != mj.MinTime {
+			return mi.MinTime < mj.MinTime
+		}
+		return mi.ULID.Compare(mj.ULID) < 0
 	})
 	if err := validateBlockSequence(blocks); err != nil {
 		return errors.Wrap(err, "invalid block sequence")
@@ -543,6 +1305,10 @@ func (db *DB) reload() (err error) {
 	db.blocks = blocks
 	db.mtx.Unlock()
 
+	if !sameBlocks(oldBlocks, blocks) {
+		db.blocksChanged(oldBlocks, blocks)
+	}
+
 	// Drop old blocks from memory.
 	for _, b := range oldBlocks {
 		if _, ok := opened[b.Meta().ULID]; ok {
@@ -552,10 +1318,25 @@ func (db *DB) reload() (err error) {
 			level.Warn(db.logger).Log("msg", "closing block failed", "err", err)
 		}
 	}
-	// Delete all obsolete blocks. None of them are opened any longer.
-	for ulid := range deleteable {
-		if err := os.RemoveAll(filepath.Join(db.dir, ulid.String())); err != nil {
-			return errors.Wrapf(err, "delete obsolete block %s", ulid)
+	// Delete all obsolete blocks. None of them are opened any longer. Blocks that
+	// cannot be deleted yet or exceed the batch size are deleted by the next
+	// reload or on startup.
+	var (
+		batch    = db.deletionBatch(deleteable)
+		throttle = db.deletionThrottle()
+	)
+	if deferred := len(deleteable) - len(batch); deferred > 0 {
+		level.Info(db.logger).Log("msg", "deferring deletion of obsolete blocks", "blocks", deferred)
+	}
+	for _, ulid := range batch {
+		if err := removeBlockDir(filepath.Join(db.dir, ulid.String()), throttle); err != nil {
+			level.Warn(db.logger).Log("msg", "deleting block failed, retrying later", "ulid", ulid, "err", err)
+			continue
+		}
+		if _, ok := expired[ulid]; ok {
+			level.Info(db.logger).Log("msg", "deleted block beyond retention", "ulid", ulid)
+		} else {
+			level.Debug(db.logger).Log("msg", "deleted obsolete block", "ulid", ulid)
 		}
 	}
 
@@ -569,6 +1350,72 @@ func (db *DB) reload() (err error) {
 	return errors.Wrap(db.head.Truncate(maxt), "head truncate failed")
 }
 
+// openBlocks opens the blocks in the given directories concurrently, which
+// bounds the startup time of DBs with many blocks by the disk rather than by
+// decoding index headers and tombstones. If any block fails to open, all
+// others are closed again.
+func (db *DB) openBlocks(dirs []string) ([]*Block, error) {
+	var (
+		blocks = make([]*Block, len(dirs))
+		errs   = make([]error, len(dirs))
+		dirc   = make(chan int)
+		wg     sync.WaitGroup
+		opts   = db.options()
+	)
+	workers := runtime.GOMAXPROCS(0)
+	if workers > len(dirs) {
+		workers = len(dirs)
+	}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range dirc {
+				blocks[i], errs[i] = openBlock(dirs[i], db.chunkPool, opts.UsePread)
+			}
+		}()
+	}
+	for i := range dirs {
+		dirc <- i
+	}
+	close(dirc)
+	wg.Wait()
+
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		for _, b := range blocks {
+			if b != nil {
+				b.Close()
+			}
+		}
+		level.Error(db.logger).Log("msg", "open block failed", "dir", dirs[i], "err", err)
+		return nil, errors.Wrapf(err, "open block %s", dirs[i])
+	}
+	for _, b := range blocks {
+		b.chunkCache = opts.ChunkCache
+		b.readMetrics = db.blockReads
+
+		meta := b.Meta()
+		level.Info(db.logger).Log("msg", "loaded block", "ulid", meta.ULID, "mint", meta.MinTime, "maxt", meta.MaxTime)
+	}
+	return blocks, nil
+}
+
+// sameBlocks returns whether a and b hold the same blocks in the same order.
+func sameBlocks(a, b []*Block) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Meta().ULID != b[i].Meta().ULID {
+			return false
+		}
+	}
+	return true
+}
+
 // validateBlockSequence returns error if given block meta files indicate that some blocks overlaps within sequence.
 func validateBlockSequence(bs []*Block) error {
 	if len(bs) <= 1 {
@@ -692,7 +1539,10 @@ func (db *DB) String() string {
 	return "HEAD"
 }
 
-// Blocks returns the databases persisted blocks.
+// Blocks returns the databases persisted blocks sorted by their minimum time
+// and ULID. The returned slice is never modified, changes of the loaded blocks
+// replace it. Callers may iterate it while blocks are loaded and deleted, but
+// blocks removed in the meantime are closed.
 func (db *DB) Blocks() []*Block {
 	db.mtx.RLock()
 	defer db.mtx.RUnlock()
@@ -700,6 +1550,256 @@ func (db *DB) Blocks() []*Block {
 	return db.blocks
 }
 
+// BlocksChange describes a change of the loaded blocks of a DB.
+type BlocksChange struct {
+	// Blocks are the loaded blocks after the change as returned by DB.Blocks.
+	Blocks []*Block
+	// Added and Removed are the ULIDs of the newly loaded and of the unloaded
+	// blocks.
+	Added, Removed []ulid.ULID
+}
+
+// blocksChanged purges caches of the previously loaded blocks and calls the
+// BlocksChanged hook. Blocks not in old were added, blocks in old that are not
+// loaded any longer were removed.
+func (db *DB) blocksChanged(old, blocks []*Block) {
+	if db.queryCache != nil {
+		db.queryCache.purge()
+	}
+	hook := db.options().BlocksChanged
+	if hook == nil {
+		return
+	}
+	var (
+		change = BlocksChange{Blocks: blocks}
+		loaded = make(map[ulid.ULID]struct{}, len(blocks))
+		prev   = make(map[ulid.ULID]struct{}, len(old))
+	)
+	for _, b := range old {
+		prev[b.Meta().ULID] = struct{}{}
+	}
+	for _, b := range blocks {
+		id := b.Meta().ULID
+		loaded[id] = struct{}{}
+
+		if _, ok := prev[id]; !ok {
+			change.Added = append(change.Added, id)
+		}
+	}
+	for _, b := range old {
+		if _, ok := loaded[b.Meta().ULID]; !ok {
+			change.Removed = append(change.Removed, b.Meta().ULID)
+		}
+	}
+	hook(change)
+}
+
+// DiskStats describes the disk usage of a database in bytes.
+type DiskStats struct {
+	// Blocks holds the usage of each loaded block.
+	Blocks []BlockDiskStats
+	// BlocksTotal is the size of all loaded blocks.
+	BlocksTotal int64
+	// Tombstones is the size of the tombstones of all loaded blocks.
+	Tombstones int64
+	// WAL is the size of the write ahead log including its checkpoints.
+	WAL int64
+	// Tmp is the size of temporary files, which are left behind by interrupted
+	// compactions and writes.
+	Tmp int64
+	// Total is the size of all files in the database directory.
+	Total int64
+}
+
+// BlockDiskStats describes the disk usage of a block in bytes.
+type BlockDiskStats struct {
+	ULID ulid.ULID
+	// Index includes separately stored postings and index headers.
+	Index      int64
+	Chunks     int64
+	Tombstones int64
+	// Total includes all files of the block.
+	Total int64
+}
+
+// DiskStats returns the disk usage of the database. Files in the database
+// directory that belong to neither the WAL, a loaded block nor are temporary,
+// e.g. blocks pending deletion, are only accounted for in the total.
+func (db *DB) DiskStats() (DiskStats, error) {
+	var res DiskStats
+
+	db.mtx.RLock()
+	blocks := make(map[string]int, len(db.blocks))
+	res.Blocks = make([]BlockDiskStats, len(db.blocks))
+
+	for i, b := range db.blocks {
+		res.Blocks[i].ULID = b.Meta().ULID
+		blocks[filepath.Base(b.Dir())] = i
+	}
+	db.mtx.RUnlock()
+
+	err := filepath.Walk(db.dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			// Files may be removed concurrently, e.g. after compactions.
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(db.dir, p)
+		if err != nil {
+			return err
+		}
+		var (
+			parts = strings.Split(filepath.ToSlash(rel), "/")
+			size  = fi.Size()
+		)
+		res.Total += size
+
+		for _, part := range parts {
+			if strings.HasSuffix(part, ".tmp") {
+				res.Tmp += size
+				return nil
+			}
+		}
+		if parts[0] == "wal" {
+			res.WAL += size
+			return nil
+		}
+		i, ok := blocks[parts[0]]
+		if !ok || len(parts) < 2 {
+			return nil
+		}
+		b := &res.Blocks[i]
+		b.Total += size
+
+		// Files of shards are accounted like those of unsharded blocks.
+		if parts[1] == shardsDirname && len(parts) > 3 {
+			parts = parts[2:]
+		}
+
+		switch {
+		case parts[1] == "chunks":
+			b.Chunks += size
+		case parts[1] == tombstoneFilename:
+			b.Tombstones += size
+		case strings.HasPrefix(parts[1], indexFilename):
+			b.Index += size
+		}
+		return nil
+	})
+	if err != nil {
+		return DiskStats{}, errors.Wrap(err, "walk database directory")
+	}
+	for _, b := range res.Blocks {
+		res.BlocksTotal += b.Total
+		res.Tombstones += b.Tombstones
+	}
+	return res, nil
+}
+
+// Lineage returns the compaction records of the block with the given ULID and
+// of all blocks it was created from, ordered by time. The block does not need
+// to exist anymore as long as a loaded block was created from it.
+// Returns ErrNotFound if no loaded block descends from the block.
+func (db *DB) Lineage(id ulid.ULID) ([]CompactionRecord, error) {
+	db.mtx.RLock()
+	defer db.mtx.RUnlock()
+
+	for _, b := range db.blocks {
+		meta := b.Meta()
+		if res := lineage(meta.compactionHistory(), id); res != nil {
+			return res, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// lineage returns the records of the block with the given ULID and its
+// ancestors from history, or nil if it holds no record of the block.
+func lineage(history []CompactionRecord, id ulid.ULID) []CompactionRecord {
+	records := make(map[ulid.ULID]CompactionRecord, len(history))
+	for _, r := range history {
+		records[r.ULID] = r
+	}
+	if _, ok := records[id]; !ok {
+		return nil
+	}
+	ancestors := map[ulid.ULID]struct{}{}
+	queue := []ulid.ULID{id}
+
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+
+		if _, ok := ancestors[cur]; ok {
+			continue
+		}
+		ancestors[cur] = struct{}{}
+		queue = append(queue, records[cur].Parents...)
+	}
+	var res []CompactionRecord
+	for _, r := range history {
+		if _, ok := ancestors[r.ULID]; ok {
+			res = append(res, r)
+		}
+	}
+	return res
+}
+
+// LabelCardinalities returns the estimated number of distinct values of each
+// label name across all blocks and the head. The estimates are based on sketches
+// persisted in the block indices and don't require enumerating label values.
+func (db *DB) LabelCardinalities() (map[string]uint64, error) {
+	db.mtx.RLock()
+	defer db.mtx.RUnlock()
+
+	sketches := map[string]*index.HyperLogLog{}
+
+	add := func(ir IndexReader) error {
+		s, err := ir.LabelSketches()
+		if err != nil {
+			return err
+		}
+		for name, hll := range s {
+			if cur, ok := sketches[name]; ok {
+				cur.Merge(hll)
+			} else {
+				sketches[name] = hll
+			}
+		}
+		return nil
+	}
+	for _, b := range db.blocks {
+		ir, err := b.Index()
+		if err != nil {
+			return nil, errors.Wrapf(err, "open index of block %s", b.Meta().ULID)
+		}
+		err = add(ir)
+		ir.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	ir, err := db.head.Index()
+	if err != nil {
+		return nil, errors.Wrap(err, "open head index")
+	}
+	defer ir.Close()
+
+	if err := add(ir); err != nil {
+		return nil, err
+	}
+	res := make(map[string]uint64, len(sketches))
+	for name, hll := range sketches {
+		res[name] = hll.Estimate()
+	}
+	return res, nil
+}
+
 // Head returns the databases's head.
 func (db *DB) Head() *Head {
 	return db.head
@@ -709,6 +1809,9 @@ func (db *DB) Head() *Head {
 func (db *DB) Close() error {
 	close(db.stopc)
 	<-db.donec
+	if db.scrubDonec != nil {
+		<-db.scrubDonec
+	}
 
 	db.mtx.Lock()
 	defer db.mtx.Unlock()
@@ -723,10 +1826,14 @@ func (db *DB) Close() error {
 	var merr MultiError
 
 	merr.Add(g.Wait())
+	db.deletions.Wait()
 
 	if db.lockf != nil {
 		merr.Add(db.lockf.Release())
 	}
+	if db.queryLog != nil {
+		merr.Add(db.queryLog.Close())
+	}
 	merr.Add(db.head.Close())
 	return merr.Err()
 }
@@ -779,39 +1886,146 @@ func (db *DB) Snapshot(dir string, withHead bool) error {
 	return errors.Wrap(err, "snapshot head block")
 }
 
+// FlushHead persists all data currently in the head into blocks and truncates
+// the head accordingly. Afterwards, no samples older than the flushed ones can
+// be appended anymore.
+func (db *DB) FlushHead() error {
+	db.cmtx.Lock()
+	defer db.cmtx.Unlock()
+
+	if db.options().WALOnly {
+		return errors.New("cannot flush head in WAL only mode")
+	}
+	for !db.head.empty() {
+		mint := db.head.MinTime()
+		_, maxt := rangeForTimestamp(mint, db.options().BlockRanges[0])
+
+		// Cut the last block right after the most recent sample.
+		final := false
+		if m := db.head.MaxTime() + 1; m <= maxt {
+			maxt, final = m, true
+		}
+		head := &rangeHead{head: db.head, mint: mint, maxt: maxt - 1}
+
+		if _, err := db.compactor.Write(db.dir, head, mint, maxt, nil); err != nil {
+			return errors.Wrap(err, "persist head block")
+		}
+		atomic.StoreInt64(&db.lastCompaction, time.Now().UnixNano())
+
+		if err := db.reload(); err != nil {
+			return errors.Wrap(err, "reload blocks")
+		}
+		atomic.StoreInt64(&db.head.flushedTime, maxt)
+
+		if err := db.head.Truncate(maxt); err != nil {
+			return errors.Wrap(err, "head truncate failed")
+		}
+		if final {
+			break
+		}
+	}
+	return nil
+}
+
 // Querier returns a new querier over the data partition for the given time range.
 // A goroutine must not handle more than one open Querier.
 func (db *DB) Querier(mint, maxt int64) (Querier, error) {
-	var blocks []BlockReader
+	return db.QuerierContext(context.Background(), mint, maxt)
+}
 
+// QuerierContext is like Querier but stops waiting for a free query slot
+// and for blocks to be downloaded once the context is canceled.
+func (db *DB) QuerierContext(ctx context.Context, mint, maxt int64) (Querier, error) {
+	var (
+		blocks  []BlockReader
+		persist []*Block
+	)
 	db.mtx.RLock()
-	defer db.mtx.RUnlock()
 
 	for _, b := range db.blocks {
 		if b.OverlapsClosedInterval(mint, maxt) {
 			blocks = append(blocks, b)
+			persist = append(persist, b)
 		}
 	}
 	if maxt >= db.head.MinTime() {
 		blocks = append(blocks, db.head)
 	}
+	localMin := db.head.MinTime()
+	if len(db.blocks) > 0 {
+		localMin = db.blocks[0].Meta().MinTime
+	}
+	var cacheKey string
+	if db.queryCache != nil {
+		cacheKey = queryCacheKey(persist, mint, maxt)
+	}
 
 	sq := &querier{
 		blocks: make([]Querier, 0, len(blocks)),
 	}
+	opts := db.options()
+
+	var fetch *chunkFetchPool
+	if n := opts.ChunkFetchConcurrency; n > 0 {
+		fetch = newChunkFetchPool(n)
+	}
 	for _, b := range blocks {
-		q, err := NewBlockQuerier(b, mint, maxt)
+		q, err := newBlockQuerier(b, mint, maxt, opts.Tracer)
 		if err == nil {
+			// The head changes with every append and is never cached.
+			if pb, ok := b.(*Block); ok && db.queryCache != nil {
+				q.cache = db.queryCache
+				q.cacheKey = fmt.Sprintf("%s/%s", cacheKey, pb.Meta().ULID)
+			}
+			// Head chunks are still appended to and are always read sequentially.
+			if _, ok := b.(*Block); ok {
+				q.fetch = fetch
+			}
 			sq.blocks = append(sq.blocks, q)
 			continue
 		}
 		// If we fail, all previously opened queriers must be closed.
+		db.mtx.RUnlock()
 		for _, q := range sq.blocks {
 			q.Close()
 		}
 		return nil, errors.Wrapf(err, "open querier for block %s", b)
 	}
-	return sq, nil
+	// Block queriers keep their blocks open, so the lock is not needed to
+	// download remote blocks, which would block reloads for the transfer.
+	db.mtx.RUnlock()
+
+	if d := opts.Downloader; d != nil && mint < localMin {
+		qs, err := d.queriers(ctx, mint, maxt, localMin)
+		if err != nil {
+			for _, q := range sq.blocks {
+				q.Close()
+			}
+			return nil, errors.Wrap(err, "open queriers for remote blocks")
+		}
+		// Blocks in the bucket may overlap with each other.
+		sq.blocks = append(qs, sq.blocks...)
+		sq.overlapping = len(qs) > 0
+	}
+	var q Querier = sq
+
+	if opts.QueryExternalLabels {
+		q = NewExternalLabelsQuerier(q, opts.ExternalLabels)
+	}
+	if opts.MaxQuerySeries > 0 || opts.MaxQuerySamples > 0 || opts.MaxQueryBytes > 0 {
+		q = NewLimitedQuerier(q, QueryLimits{
+			MaxSeries:  opts.MaxQuerySeries,
+			MaxSamples: opts.MaxQuerySamples,
+			MaxBytes:   opts.MaxQueryBytes,
+		})
+	}
+	if db.queryLog != nil {
+		q = &loggedQuerier{Querier: q, log: db.queryLog, mint: mint, maxt: maxt}
+	}
+	if db.queryGate != nil {
+		q = &gatedQuerier{Querier: q, ctx: ctx, gate: db.queryGate}
+	}
+	return q, nil
 }
 
 func rangeForTimestamp(t int64, width int64) (mint, maxt int64) {
@@ -14,7 +14,10 @@
 package tsdb
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math"
 	"math/rand"
@@ -22,11 +25,16 @@ import (
 	"path"
 	"path/filepath"
 	"sort"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/go-kit/kit/log"
 	"github.com/oklog/ulid"
 	"github.com/pkg/errors"
+	prom_testutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/tsdb/chunkenc"
 	"github.com/prometheus/tsdb/chunks"
 	"github.com/prometheus/tsdb/index"
 	"github.com/prometheus/tsdb/labels"
@@ -921,19 +929,78 @@ func TestDB_Retention(t *testing.T) {
 	testutil.Ok(t, db.Close())
 
 	// reopen DB from snapshot
+	var buf bytes.Buffer
 	db, err = Open(snap, nil, nil, &Options{
 		RetentionDuration: 10,
 		BlockRanges:       []int64{50},
+		Logger:            log.NewLogfmtLogger(&buf),
 	})
 	testutil.Ok(t, err)
 	defer db.Close()
 
 	testutil.Equals(t, 2, len(db.blocks))
+	testutil.Equals(t, 2, strings.Count(buf.String(), `msg="loaded block"`))
 
 	// Reload blocks, which should drop blocks beyond the retention boundary.
 	testutil.Ok(t, db.reload())
 	testutil.Equals(t, 1, len(db.blocks))
 	testutil.Equals(t, int64(100), db.blocks[0].meta.MaxTime) // To verify its the right block.
+	testutil.Assert(t, strings.Contains(buf.String(), `msg="deleted block beyond retention"`), "retention deletion not logged")
+}
+
+func TestDB_RetentionOverrides(t *testing.T) {
+	db, close := openTestDB(t, &Options{
+		BlockRanges:       []int64{1000},
+		RetentionDuration: 1500,
+		RetentionOverrides: []RetentionOverride{
+			{Matchers: []labels.Matcher{labels.NewEqualMatcher("job", "billing")}, Duration: 10000},
+			{Matchers: []labels.Matcher{labels.NewEqualMatcher("job", "audit")}, Duration: 2500},
+		},
+	})
+	defer close()
+	defer db.Close()
+
+	jobs := []string{"billing", "audit", "other"}
+
+	app := db.Appender()
+	for ts := int64(0); ts < 6000; ts += 100 {
+		for _, job := range jobs {
+			_, err := app.Add(labels.FromStrings("job", job), ts, float64(ts))
+			testutil.Ok(t, err)
+		}
+	}
+	testutil.Ok(t, app.Commit())
+	testutil.Ok(t, db.compact())
+	testutil.Ok(t, db.reload())
+
+	maxt := db.Blocks()[len(db.Blocks())-1].Meta().MaxTime
+	testutil.Equals(t, int64(5000), maxt)
+
+	// Blocks up to 3000 are beyond the default retention, the ones up to 2000
+	// beyond the retention of the audit series as well.
+	mint := map[string]int64{"billing": 0, "audit": 2000, "other": 3000}
+
+	q, err := db.Querier(0, 6000)
+	testutil.Ok(t, err)
+	defer q.Close()
+
+	res := query(t, q, labels.NewMustRegexpMatcher("job", ".+"))
+	for _, job := range jobs {
+		smpls := res[labels.FromStrings("job", job).String()]
+		testutil.Assert(t, len(smpls) > 0, "no samples for job %s", job)
+		testutil.Equals(t, mint[job], smpls[0].t)
+		testutil.Equals(t, int64(5900), smpls[len(smpls)-1].t)
+	}
+	for _, b := range db.Blocks() {
+		switch meta := b.Meta(); {
+		case meta.MaxTime <= 2000:
+			testutil.Equals(t, uint64(10000), meta.RetentionOverride)
+		case meta.MaxTime <= 3000:
+			testutil.Equals(t, uint64(2500), meta.RetentionOverride)
+		default:
+			testutil.Equals(t, uint64(0), meta.RetentionOverride)
+		}
+	}
 }
 
 func TestNotMatcherSelectsLabelsUnsetSeries(t *testing.T) {
@@ -992,6 +1059,18 @@ func TestNotMatcherSelectsLabelsUnsetSeries(t *testing.T) {
 			labels.Not(labels.NewMustRegexpMatcher("labelname", "labelvalue")),
 		},
 		series: labelpairs[:1],
+	}, {
+		selector: labels.Selector{
+			labels.Not(labels.NewEqualMatcher("a", "abcd")),
+			labels.Not(labels.NewEqualMatcher("labelname", "labelvalue")),
+		},
+		series: []labels.Labels{},
+	}, {
+		selector: labels.Selector{
+			labels.Not(labels.NewEqualMatcher("b", "abc")),
+			labels.Not(labels.NewMustRegexpMatcher("labelname", "label.*")),
+		},
+		series: labelpairs[:1],
 	}}
 
 	q, err := db.Querier(0, 10)
@@ -1009,6 +1088,447 @@ func TestNotMatcherSelectsLabelsUnsetSeries(t *testing.T) {
 	}
 }
 
+func TestLabelValuesFor(t *testing.T) {
+	db, close := openTestDB(t, nil)
+	defer close()
+
+	// Added in reverse label order so series IDs and label order differ.
+	app := db.Appender()
+	for _, lbls := range []labels.Labels{
+		labels.FromStrings("job", "b", "instance", "3"),
+		labels.FromStrings("job", "b", "instance", "2"),
+		labels.FromStrings("job", "a", "instance", "2"),
+		labels.FromStrings("job", "a", "instance", "1"),
+		labels.FromStrings("team", "x"),
+	} {
+		_, err := app.Add(lbls, 0, 1)
+		testutil.Ok(t, err)
+	}
+	// Series outside of the time range of the querier or deleted are ignored
+	// if matchers are given.
+	_, err := app.Add(labels.FromStrings("job", "c", "instance", "4"), 100, 1)
+	testutil.Ok(t, err)
+	testutil.Ok(t, app.Commit())
+	testutil.Ok(t, db.Delete(0, 10, labels.NewEqualMatcher("instance", "3")))
+
+	cases := []struct {
+		name     string
+		selector labels.Selector
+		values   []string
+	}{{
+		name:   "instance",
+		values: []string{"1", "2", "3", "4"},
+	}, {
+		name:     "instance",
+		selector: labels.Selector{labels.NewEqualMatcher("job", "a")},
+		values:   []string{"1", "2"},
+	}, {
+		name:     "instance",
+		selector: labels.Selector{labels.Not(labels.NewEqualMatcher("job", "a"))},
+		values:   []string{"2"},
+	}, {
+		name:     "job",
+		selector: labels.Selector{labels.NewMustRegexpMatcher("instance", "[23]")},
+		values:   []string{"a", "b"},
+	}, {
+		name:     "job",
+		selector: labels.Selector{labels.NewEqualMatcher("team", "x")},
+		values:   nil,
+	}, {
+		name:     "job",
+		selector: labels.Selector{labels.NewEqualMatcher("job", "c")},
+		values:   nil,
+	}}
+
+	q, err := db.Querier(0, 10)
+	testutil.Ok(t, err)
+	defer q.Close()
+
+	for _, c := range cases {
+		values, err := q.LabelValuesFor(c.name, c.selector...)
+		testutil.Ok(t, err)
+		testutil.Equals(t, c.values, values)
+	}
+}
+
+func TestLabelNamesFor(t *testing.T) {
+	db, close := openTestDB(t, nil)
+	defer close()
+
+	app := db.Appender()
+	for _, lbls := range []labels.Labels{
+		labels.FromStrings("job", "a", "instance", "1"),
+		labels.FromStrings("job", "b", "instance", "2", "zone", "z1"),
+		labels.FromStrings("team", "x", "owner", "o"),
+	} {
+		_, err := app.Add(lbls, 0, 1)
+		testutil.Ok(t, err)
+	}
+	// Series outside of the time range of the querier or deleted are ignored
+	// if matchers are given.
+	_, err := app.Add(labels.FromStrings("job", "c", "region", "r"), 100, 1)
+	testutil.Ok(t, err)
+	testutil.Ok(t, app.Commit())
+	testutil.Ok(t, db.Delete(0, 10, labels.NewEqualMatcher("zone", "z1")))
+
+	cases := []struct {
+		selector labels.Selector
+		names    []string
+	}{{
+		names: []string{"instance", "job", "owner", "region", "team", "zone"},
+	}, {
+		selector: labels.Selector{labels.NewEqualMatcher("job", "a")},
+		names:    []string{"instance", "job"},
+	}, {
+		selector: labels.Selector{labels.NewMustRegexpMatcher("job", ".+")},
+		names:    []string{"instance", "job"},
+	}, {
+		selector: labels.Selector{labels.Not(labels.NewEqualMatcher("team", "x"))},
+		names:    []string{"instance", "job"},
+	}, {
+		selector: labels.Selector{labels.NewEqualMatcher("job", "c")},
+		names:    []string{},
+	}}
+
+	q, err := db.Querier(0, 10)
+	testutil.Ok(t, err)
+	defer q.Close()
+
+	for _, c := range cases {
+		names, err := q.LabelNamesFor(c.selector...)
+		testutil.Ok(t, err)
+		testutil.Equals(t, c.names, names)
+	}
+}
+
+func TestDB_LabelCardinalities(t *testing.T) {
+	db, close := openTestDB(t, nil)
+	defer close()
+
+	app := db.Appender()
+	for i := 0; i < 100; i++ {
+		_, err := app.Add(labels.FromStrings("job", "a", "instance", strconv.Itoa(i)), 0, 1)
+		testutil.Ok(t, err)
+	}
+	testutil.Ok(t, app.Commit())
+
+	card, err := db.LabelCardinalities()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 2, len(card))
+	testutil.Equals(t, uint64(1), card["job"])
+	testutil.Assert(t, card["instance"] >= 90 && card["instance"] <= 110, "unexpected estimate %d", card["instance"])
+}
+
+func TestSelectShards(t *testing.T) {
+	db, close := openTestDB(t, nil)
+	defer close()
+
+	app := db.Appender()
+	for i := 0; i < 100; i++ {
+		_, err := app.Add(labels.FromStrings("job", "a", "instance", strconv.Itoa(i)), 5, 1)
+		testutil.Ok(t, err)
+	}
+	testutil.Ok(t, app.Commit())
+
+	q, err := db.Querier(0, 10)
+	testutil.Ok(t, err)
+	defer q.Close()
+
+	ss, err := q.Select(labels.NewEqualMatcher("job", "a"))
+	testutil.Ok(t, err)
+	all, err := expandSeriesSet(ss)
+	testutil.Ok(t, err)
+
+	var (
+		seen   = map[uint64]struct{}{}
+		shards = uint64(4)
+	)
+	for i := uint64(0); i < shards; i++ {
+		// Hints without a time range do not restrict the querier's.
+		ss, err := q.SelectWithHints(&SelectHints{ShardCount: shards, ShardIndex: i}, labels.NewEqualMatcher("job", "a"))
+		testutil.Ok(t, err)
+		res, err := expandSeriesSet(ss)
+		testutil.Ok(t, err)
+		testutil.Assert(t, len(res) < len(all), "shard %d holds all series", i)
+
+		for _, lset := range res {
+			h := lset.Hash()
+			_, ok := seen[h]
+			testutil.Assert(t, !ok, "series %s selected by multiple shards", lset)
+			seen[h] = struct{}{}
+		}
+	}
+	testutil.Equals(t, len(all), len(seen))
+
+	_, err = q.SelectWithHints(&SelectHints{ShardCount: shards, ShardIndex: shards}, labels.NewEqualMatcher("job", "a"))
+	testutil.NotOk(t, err)
+}
+
+func TestDB_HeadCut(t *testing.T) {
+	opts := *DefaultOptions
+	opts.BlockRanges = []int64{1000}
+
+	db, close := openTestDB(t, &opts)
+	defer close()
+	defer db.Close()
+
+	db.DisableCompactions()
+
+	app := db.Appender()
+	for ts := int64(0); ts <= 2000; ts += 100 {
+		_, err := app.Add(labels.FromStrings("a", "1"), ts, float64(ts))
+		testutil.Ok(t, err)
+	}
+	// A series only present in the range that will be persisted.
+	_, err := app.Add(labels.FromStrings("a", "2"), 500, 1)
+	testutil.Ok(t, err)
+	testutil.Ok(t, app.Commit())
+
+	db.EnableCompactions()
+	testutil.Ok(t, db.compact())
+
+	testutil.Equals(t, 1, len(db.Blocks()))
+	meta := db.Blocks()[0].Meta()
+	testutil.Equals(t, int64(0), meta.MinTime)
+	testutil.Equals(t, int64(1000), meta.MaxTime)
+	testutil.Equals(t, uint64(2), meta.Stats.NumSeries)
+
+	// The persisted range is removed from the head.
+	testutil.Equals(t, int64(1000), db.head.MinTime())
+	all, err := index.ExpandPostings(db.head.postings.Get(index.AllPostingsKey()))
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(all))
+
+	// All data remains queryable across the block and the head.
+	q, err := db.Querier(0, 2000)
+	testutil.Ok(t, err)
+	defer q.Close()
+
+	res := query(t, q, labels.NewEqualMatcher("a", "1"))
+	testutil.Equals(t, 21, len(res[`{a="1"}`]))
+	res = query(t, q, labels.NewEqualMatcher("a", "2"))
+	testutil.Equals(t, map[string][]sample{`{a="2"}`: {{500, 1}}}, res)
+}
+
+func TestDB_Status(t *testing.T) {
+	opts := *DefaultOptions
+	opts.BlockRanges = []int64{1000}
+
+	db, close := openTestDB(t, &opts)
+	defer close()
+	defer db.Close()
+
+	db.DisableCompactions()
+
+	app := db.Appender()
+	for ts := int64(0); ts <= 3500; ts += 100 {
+		_, err := app.Add(labels.FromStrings("a", "1"), ts, float64(ts))
+		testutil.Ok(t, err)
+	}
+	testutil.Ok(t, app.Commit())
+
+	s, err := db.Status()
+	testutil.Ok(t, err)
+	testutil.Equals(t, Status{
+		WALReplayedCleanly: true,
+		PendingCompactions: 2,
+		HeadMinTime:        0,
+		HeadMaxTime:        3500,
+	}, s)
+
+	db.EnableCompactions()
+	testutil.Ok(t, db.compact())
+
+	s, err = db.Status()
+	testutil.Ok(t, err)
+	testutil.Assert(t, !s.LastCompaction.IsZero(), "last compaction not set")
+	testutil.Equals(t, 0, s.PendingCompactions)
+	testutil.Equals(t, 0, s.CorruptedBlocks)
+	testutil.Equals(t, int64(2000), s.HeadMinTime)
+}
+
+func TestDB_FlushHead(t *testing.T) {
+	opts := *DefaultOptions
+	opts.BlockRanges = []int64{1000}
+
+	db, close := openTestDB(t, &opts)
+	defer close()
+	defer db.Close()
+
+	db.DisableCompactions()
+
+	app := db.Appender()
+	for ts := int64(0); ts <= 2500; ts += 100 {
+		_, err := app.Add(labels.FromStrings("a", "1"), ts, float64(ts))
+		testutil.Ok(t, err)
+	}
+	testutil.Ok(t, app.Commit())
+
+	testutil.Ok(t, db.FlushHead())
+
+	var rngs [][2]int64
+	for _, b := range db.Blocks() {
+		rngs = append(rngs, [2]int64{b.Meta().MinTime, b.Meta().MaxTime})
+	}
+	testutil.Equals(t, [][2]int64{{0, 1000}, {1000, 2000}, {2000, 2501}}, rngs)
+	testutil.Assert(t, db.head.empty(), "head not empty after flush")
+
+	// Flushing an empty head does not create blocks.
+	testutil.Ok(t, db.FlushHead())
+	testutil.Equals(t, 3, len(db.Blocks()))
+
+	// Samples in the flushed range are rejected.
+	app = db.Appender()
+	_, err := app.Add(labels.FromStrings("a", "1"), 2400, 0)
+	testutil.Equals(t, ErrOutOfBounds, errors.Cause(err))
+	_, err = app.Add(labels.FromStrings("a", "1"), 2600, 2600)
+	testutil.Ok(t, err)
+	testutil.Ok(t, app.Commit())
+
+	q, err := db.Querier(0, 3000)
+	testutil.Ok(t, err)
+	defer q.Close()
+
+	res := query(t, q, labels.NewEqualMatcher("a", "1"))
+	testutil.Equals(t, 27, len(res[`{a="1"}`]))
+}
+
+func TestDB_ExternalLabels(t *testing.T) {
+	opts := *DefaultOptions
+	opts.BlockRanges = []int64{1000}
+	opts.ExternalLabels = labels.FromStrings("cluster", "a", "replica", "1")
+
+	db, close := openTestDB(t, &opts)
+	defer close()
+	defer db.Close()
+
+	app := db.Appender()
+	_, err := app.Add(labels.FromStrings("a", "1"), 100, 1)
+	testutil.Ok(t, err)
+	testutil.Ok(t, app.Commit())
+
+	testutil.Ok(t, db.FlushHead())
+	testutil.Equals(t, 1, len(db.Blocks()))
+
+	b := db.Blocks()[0]
+	testutil.Equals(t, opts.ExternalLabels, b.ExternalLabels())
+
+	meta, err := readMetaFile(b.Dir())
+	testutil.Ok(t, err)
+	testutil.Equals(t, map[string]string{"cluster": "a", "replica": "1"}, meta.ExternalLabels)
+}
+
+func TestDB_PendingDeletion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	var dirs []string
+	for i := 0; i < 2; i++ {
+		b := createPopulatedBlock(t, dir, 1, 1)
+		testutil.Ok(t, b.Close())
+		dirs = append(dirs, b.Dir())
+	}
+	// Simulate a deletion that was interrupted after removing the chunks.
+	meta, err := readMetaFile(dirs[0])
+	testutil.Ok(t, err)
+	meta.PendingDeletion = true
+	testutil.Ok(t, writeMetaFile(dirs[0], meta))
+	testutil.Ok(t, os.RemoveAll(chunkDir(dirs[0])))
+
+	db, err := Open(dir, nil, nil, nil)
+	testutil.Ok(t, err)
+	defer db.Close()
+
+	testutil.Equals(t, 1, len(db.Blocks()))
+	testutil.Equals(t, dirs[1], db.Blocks()[0].Dir())
+
+	_, err = os.Stat(dirs[0])
+	testutil.Assert(t, os.IsNotExist(err), "block pending deletion was not deleted")
+}
+
+func TestBlockRanges(t *testing.T) {
+	const h = int64(time.Hour / time.Millisecond)
+
+	cases := []struct {
+		min, max time.Duration
+		exp      []int64
+		err      bool
+	}{
+		{exp: []int64{2 * h, 10 * h, 50 * h}},
+		{min: 2 * time.Hour, max: 36 * time.Hour, exp: []int64{2 * h, 10 * h}},
+		{min: 24 * time.Hour, max: 24 * time.Hour, exp: []int64{24 * h}},
+		{min: 24 * time.Hour, max: time.Hour, err: true},
+		{min: time.Microsecond, err: true},
+	}
+	for _, c := range cases {
+		rngs, err := blockRanges(c.min, c.max, TimestampMilliseconds)
+		if c.err {
+			testutil.NotOk(t, err)
+			continue
+		}
+		testutil.Ok(t, err)
+		testutil.Equals(t, c.exp, rngs)
+	}
+
+	// Options are used as is if block ranges are set explicitly.
+	db, close := openTestDB(t, &Options{
+		BlockRanges:      []int64{1000},
+		MinBlockDuration: time.Hour,
+	})
+	defer close()
+	testutil.Equals(t, []int64{1000}, db.opts.BlockRanges)
+	testutil.Ok(t, db.Close())
+
+	db, close = openTestDB(t, &Options{MinBlockDuration: 24 * time.Hour, MaxBlockDuration: 24 * time.Hour})
+	defer close()
+	testutil.Equals(t, []int64{24 * h}, db.opts.BlockRanges)
+	testutil.Equals(t, 0, len(DefaultOptions.BlockRanges))
+	testutil.Ok(t, db.Close())
+}
+
+func TestDB_WALOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_wal_only")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := &Options{
+		BlockRanges: []int64{1000},
+		WALOnly:     true,
+	}
+	db, err := Open(dir, nil, nil, opts)
+	testutil.Ok(t, err)
+
+	app := db.Appender()
+	for ts := int64(0); ts <= 3000; ts += 100 {
+		_, err := app.Add(labels.FromStrings("a", "1"), ts, float64(ts))
+		testutil.Ok(t, err)
+	}
+	testutil.Ok(t, app.Commit())
+	testutil.Ok(t, db.compact())
+
+	// No block is written and old data is dropped from the head.
+	dirs, err := blockDirs(dir)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, len(dirs))
+	testutil.Equals(t, int64(2000), db.head.MinTime())
+
+	q, err := db.Querier(0, 3000)
+	testutil.Ok(t, err)
+	res := query(t, q, labels.NewEqualMatcher("a", "1"))
+	testutil.Equals(t, 11, len(res[`{a="1"}`]))
+	testutil.Ok(t, q.Close())
+	testutil.Ok(t, db.Close())
+
+	// Persisted blocks are ignored on startup.
+	testutil.Ok(t, createPopulatedBlock(t, dir, 1, 1).Close())
+
+	db, err = Open(dir, nil, nil, opts)
+	testutil.Ok(t, err)
+	defer db.Close()
+	testutil.Equals(t, 0, len(db.Blocks()))
+}
+
 func expandSeriesSet(ss SeriesSet) ([]labels.Labels, error) {
 	result := []labels.Labels{}
 	for ss.Next() {
@@ -1118,7 +1638,7 @@ func TestChunkAtBlockBoundary(t *testing.T) {
 
 	app := db.Appender()
 
-	blockRange := DefaultOptions.BlockRanges[0]
+	blockRange := int64(DefaultOptions.MinBlockDuration / time.Millisecond)
 	label := labels.FromStrings("foo", "bar")
 
 	for i := int64(0); i < 3; i++ {
@@ -1172,7 +1692,7 @@ func TestQuerierWithBoundaryChunks(t *testing.T) {
 
 	app := db.Appender()
 
-	blockRange := DefaultOptions.BlockRanges[0]
+	blockRange := int64(DefaultOptions.MinBlockDuration / time.Millisecond)
 	label := labels.FromStrings("foo", "bar")
 
 	for i := int64(0); i < 5; i++ {
@@ -1308,7 +1828,7 @@ func TestCorrectNumTombstones(t *testing.T) {
 	defer close()
 	defer db.Close()
 
-	blockRange := DefaultOptions.BlockRanges[0]
+	blockRange := int64(DefaultOptions.MinBlockDuration / time.Millisecond)
 	label := labels.FromStrings("foo", "bar")
 
 	app := db.Appender()
@@ -1337,3 +1857,1420 @@ func TestCorrectNumTombstones(t *testing.T) {
 	testutil.Ok(t, db.Delete(9, 11, labels.NewEqualMatcher("foo", "bar")))
 	testutil.Equals(t, uint64(3), db.blocks[0].meta.Stats.NumTombstones)
 }
+
+type countingObserver struct {
+	appended, committed int
+	series              []labels.Labels
+}
+
+func (o *countingObserver) OnAppend(ref uint64, t int64, v float64) { o.appended++ }
+func (o *countingObserver) OnCommit(samples int)                    { o.committed += samples }
+
+func (o *countingObserver) OnSeriesCreated(ref uint64, lset labels.Labels) {
+	o.series = append(o.series, lset)
+}
+
+func TestDB_AppendObserver(t *testing.T) {
+	o := &countingObserver{}
+
+	db, close := openTestDB(t, &Options{AppendObserver: o})
+	defer close()
+	defer db.Close()
+
+	app := db.Appender()
+	for i := int64(0); i < 5; i++ {
+		_, err := app.Add(labels.FromStrings("a", "1"), i, 1)
+		testutil.Ok(t, err)
+	}
+	_, err := app.Add(labels.FromStrings("a", "2"), 0, 1)
+	testutil.Ok(t, err)
+	testutil.Ok(t, app.Commit())
+
+	// Rolled back samples are appended but never committed.
+	app = db.Appender()
+	_, err = app.Add(labels.FromStrings("a", "1"), 10, 1)
+	testutil.Ok(t, err)
+	testutil.Ok(t, app.Rollback())
+
+	testutil.Equals(t, 7, o.appended)
+	testutil.Equals(t, 6, o.committed)
+	testutil.Equals(t, []labels.Labels{labels.FromStrings("a", "1"), labels.FromStrings("a", "2")}, o.series)
+}
+
+func TestDB_Admission(t *testing.T) {
+	var (
+		errQuota = errors.New("tenant over quota")
+		reqs     []AdmissionRequest
+	)
+	admit := func(r AdmissionRequest) error {
+		reqs = append(reqs, r)
+
+		if r.Stage == AdmitSeries && r.Labels.Get("tenant") == "b" {
+			return errQuota
+		}
+		if r.Stage == AdmitCommit && r.Samples > 2 {
+			return errQuota
+		}
+		return nil
+	}
+	db, close := openTestDB(t, &Options{Admission: admit})
+	defer close()
+	defer db.Close()
+
+	app := db.Appender()
+	_, err := app.Add(labels.FromStrings("tenant", "a"), 0, 1)
+	testutil.Ok(t, err)
+	_, err = app.Add(labels.FromStrings("tenant", "a"), 1, 1)
+	testutil.Ok(t, err)
+
+	_, err = app.Add(labels.FromStrings("tenant", "b"), 0, 1)
+	aerr, ok := errors.Cause(err).(*AdmissionError)
+	testutil.Assert(t, ok, "unexpected error %v", err)
+	testutil.Equals(t, AdmitSeries, aerr.Stage)
+	testutil.Equals(t, errQuota, aerr.Reason)
+
+	testutil.Ok(t, app.Commit())
+
+	testutil.Equals(t, []AdmissionRequest{
+		{Stage: AdmitSeries, Labels: labels.FromStrings("tenant", "a")},
+		{Stage: AdmitSeries, Labels: labels.FromStrings("tenant", "b")},
+		{Stage: AdmitCommit, Series: 1, Samples: 2},
+	}, reqs)
+
+	// A rejected commit rolls back all samples of the appender.
+	app = db.Appender()
+	for i := int64(2); i < 5; i++ {
+		_, err = app.Add(labels.FromStrings("tenant", "a"), i, 1)
+		testutil.Ok(t, err)
+	}
+	err = app.Commit()
+	aerr, ok = errors.Cause(err).(*AdmissionError)
+	testutil.Assert(t, ok, "unexpected error %v", err)
+	testutil.Equals(t, AdmitCommit, aerr.Stage)
+
+	q, err := db.Querier(0, 10)
+	testutil.Ok(t, err)
+	defer q.Close()
+
+	testutil.Equals(t, map[string][]sample{
+		labels.FromStrings("tenant", "a").String(): {{0, 1}, {1, 1}},
+	}, query(t, q, labels.NewEqualMatcher("tenant", "a")))
+}
+
+func TestDB_QueryCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	b := createPopulatedBlock(t, dir, 10, 5)
+	testutil.Ok(t, b.Close())
+
+	db, err := Open(dir, nil, nil, &Options{QueryCacheSize: 10})
+	testutil.Ok(t, err)
+	defer db.Close()
+
+	all := labels.NewMustRegexpMatcher("__name__", ".+")
+
+	q, err := db.Querier(0, 4000)
+	testutil.Ok(t, err)
+	exp := query(t, q, all)
+	testutil.Ok(t, q.Close())
+	testutil.Equals(t, 10, len(exp))
+	testutil.Equals(t, 1, len(db.queryCache.entries))
+
+	// Repeated queries are answered from the cache.
+	q, err = db.Querier(0, 4000)
+	testutil.Ok(t, err)
+	testutil.Equals(t, exp, query(t, q, all))
+	testutil.Ok(t, q.Close())
+	testutil.Equals(t, 1, len(db.queryCache.entries))
+
+	// Another time range is cached separately and evicts the least recently
+	// used entry beyond the cache size.
+	q, err = db.Querier(0, 3000)
+	testutil.Ok(t, err)
+	query(t, q, all)
+	testutil.Ok(t, q.Close())
+	testutil.Equals(t, 1, len(db.queryCache.entries))
+	testutil.Equals(t, 10, db.queryCache.refs)
+
+	// Changing the set of blocks invalidates the cache.
+	testutil.Ok(t, os.RemoveAll(b.Dir()))
+	testutil.Ok(t, db.reload())
+	testutil.Equals(t, 0, len(db.queryCache.entries))
+
+	q, err = db.Querier(0, 4000)
+	testutil.Ok(t, err)
+	testutil.Equals(t, map[string][]sample{}, query(t, q, all))
+	testutil.Ok(t, q.Close())
+}
+
+func TestDB_OpenBlocksConcurrently(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	var metas []*BlockMeta
+	for i := 0; i < 20; i++ {
+		meta := &BlockMeta{ULID: ulid.MustNew(uint64(i), nil), MinTime: int64(i) * 100, MaxTime: int64(i+1) * 100}
+		b := createEmptyBlock(t, filepath.Join(dir, meta.ULID.String()), meta)
+		testutil.Ok(t, b.Close())
+		metas = append(metas, meta)
+	}
+	db, err := Open(dir, nil, nil, nil)
+	testutil.Ok(t, err)
+
+	blocks := db.Blocks()
+	testutil.Equals(t, len(metas), len(blocks))
+	for i, b := range blocks {
+		testutil.Equals(t, metas[i].ULID, b.Meta().ULID)
+	}
+	testutil.Ok(t, db.Close())
+
+	// A single block failing to open fails the DB.
+	testutil.Ok(t, os.Remove(filepath.Join(dir, metas[7].ULID.String(), indexFilename)))
+
+	_, err = Open(dir, nil, nil, nil)
+	testutil.NotOk(t, err)
+}
+
+func TestDB_DeletionMark(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	b := createPopulatedBlock(t, dir, 1, 5)
+	testutil.Ok(t, b.Close())
+
+	db, err := Open(dir, nil, nil, nil)
+	testutil.Ok(t, err)
+	defer db.Close()
+	testutil.Equals(t, 1, len(db.Blocks()))
+
+	testutil.Ok(t, MarkBlockForDeletion(b.Dir(), "bad data"))
+	testutil.Ok(t, db.reload())
+
+	testutil.Equals(t, 0, len(db.Blocks()))
+	_, err = os.Stat(b.Dir())
+	testutil.Assert(t, os.IsNotExist(err), "block marked for deletion not deleted")
+}
+
+func TestDB_MarkBlockForDeletion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	b := createPopulatedBlock(t, dir, 1, 5)
+	testutil.Ok(t, b.Close())
+	id := b.Meta().ULID
+
+	// The ULID of the second block sorts before the first one.
+	meta := &BlockMeta{ULID: ulid.MustNew(2, nil), MinTime: 5000, MaxTime: 10000, Version: 1}
+	testutil.Ok(t, createEmptyBlock(t, filepath.Join(dir, meta.ULID.String()), meta).Close())
+	ids := []ulid.ULID{meta.ULID, id}
+
+	db, err := Open(dir, nil, nil, nil)
+	testutil.Ok(t, err)
+	defer db.Close()
+
+	err = db.MarkBlockForDeletion(ulid.MustNew(1, nil))
+	testutil.Equals(t, ErrNotFound, errors.Cause(err))
+
+	// An open querier keeps the blocks from being removed.
+	q, err := db.Querier(0, 10)
+	testutil.Ok(t, err)
+
+	// Pending deletions are reported in ULID order.
+	testutil.Ok(t, db.MarkBlockForDeletion(ids[1]))
+	testutil.Ok(t, db.MarkBlockForDeletion(ids[0]))
+	testutil.Equals(t, 0, len(db.Blocks()))
+
+	for i := 0; i < 10; i++ {
+		status, err := db.Status()
+		testutil.Ok(t, err)
+		testutil.Equals(t, ids, status.PendingDeletions)
+	}
+
+	// The block is neither loaded again nor removed by reloads.
+	testutil.Ok(t, db.reload())
+	testutil.Equals(t, 0, len(db.Blocks()))
+	_, err = os.Stat(filepath.Join(b.Dir(), DeletionMarkFilename))
+	testutil.Ok(t, err)
+
+	testutil.Ok(t, q.Close())
+	db.deletions.Wait()
+
+	_, err = os.Stat(b.Dir())
+	testutil.Assert(t, os.IsNotExist(err), "block marked for deletion not deleted")
+
+	status, err := db.Status()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, len(status.PendingDeletions))
+}
+
+func TestDB_BlocksChanged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	var ids []ulid.ULID
+	for i := 2; i >= 1; i-- {
+		id := ulid.MustNew(uint64(i), nil)
+		createEmptyBlock(t, filepath.Join(dir, id.String()), &BlockMeta{
+			ULID:       id,
+			MinTime:    int64(i * 100),
+			MaxTime:    int64((i + 1) * 100),
+			Compaction: BlockMetaCompaction{Level: 1, Sources: []ulid.ULID{id}},
+		}).Close()
+		ids = append([]ulid.ULID{id}, ids...)
+	}
+	var changes []BlocksChange
+
+	db, err := Open(dir, nil, nil, &Options{
+		BlockRanges: []int64{100},
+		BlocksChanged: func(c BlocksChange) {
+			changes = append(changes, c)
+		},
+	})
+	testutil.Ok(t, err)
+	defer db.Close()
+
+	// Blocks loaded on startup are added in order of their time range.
+	testutil.Equals(t, 1, len(changes))
+	testutil.Equals(t, ids, changes[0].Added)
+	testutil.Equals(t, 0, len(changes[0].Removed))
+	testutil.Equals(t, db.Blocks(), changes[0].Blocks)
+
+	// Reloads without changes do not notify.
+	testutil.Ok(t, db.reload())
+	testutil.Equals(t, 1, len(changes))
+
+	testutil.Ok(t, db.MarkBlockForDeletion(ids[0]))
+	testutil.Equals(t, 2, len(changes))
+	testutil.Equals(t, 0, len(changes[1].Added))
+	testutil.Equals(t, []ulid.ULID{ids[0]}, changes[1].Removed)
+	testutil.Equals(t, 1, len(changes[1].Blocks))
+	testutil.Equals(t, ids[1], changes[1].Blocks[0].Meta().ULID)
+}
+
+func TestDB_ApplyConfig(t *testing.T) {
+	db, close := openTestDB(t, nil)
+	defer close()
+	defer db.Close()
+
+	app := db.Appender()
+	for i := 0; i < 3; i++ {
+		_, err := app.Add(labels.FromStrings("a", strconv.Itoa(i)), 0, 1)
+		testutil.Ok(t, err)
+	}
+	testutil.Ok(t, app.Commit())
+
+	testutil.NotOk(t, db.ApplyConfig(&Options{BlockShards: MaxBlockShards + 1}))
+	testutil.NotOk(t, db.ApplyConfig(&Options{MaxCompactionAttempts: -1}))
+
+	testutil.Ok(t, db.ApplyConfig(&Options{
+		RetentionDuration: 1000,
+		MaxQuerySeries:    2,
+		BlockShards:       4,
+		CompressIndex:     true,
+		// Options that cannot be changed are ignored.
+		WALOnly: true,
+	}))
+	testutil.Equals(t, uint64(1000), db.options().RetentionDuration)
+	testutil.Equals(t, false, db.options().WALOnly)
+
+	c := db.compactor.(*LeveledCompactor)
+	testutil.Equals(t, 4, c.shards)
+	testutil.Equals(t, index.CompressionSnappy, c.indexCompression)
+	testutil.Equals(t, defaultMaxCompactionAttempts, c.maxAttempts)
+
+	q, err := db.Querier(0, 10)
+	testutil.Ok(t, err)
+	defer q.Close()
+
+	ss, err := q.Select(labels.NewMustRegexpMatcher("a", ".+"))
+	testutil.Ok(t, err)
+	for ss.Next() {
+	}
+	_, ok := errors.Cause(ss.Err()).(*LimitExceededError)
+	testutil.Assert(t, ok, "unexpected error %v", ss.Err())
+}
+
+func TestDB_ChunkCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	b := createPopulatedBlock(t, dir, 10, 5)
+	testutil.Ok(t, b.Close())
+
+	cache := NewLRUChunkCache(nil, 1<<20)
+
+	db, err := Open(dir, nil, nil, &Options{ChunkCache: cache})
+	testutil.Ok(t, err)
+	defer db.Close()
+
+	all := labels.NewMustRegexpMatcher("__name__", ".+")
+
+	q, err := db.Querier(0, 4000)
+	testutil.Ok(t, err)
+	exp := query(t, q, all)
+	testutil.Ok(t, q.Close())
+	testutil.Equals(t, 10, len(exp))
+
+	lc := cache.(*lruChunkCache)
+	testutil.Equals(t, 10, len(lc.entries))
+
+	// Chunks are now served from the cache.
+	q, err = db.Querier(0, 4000)
+	testutil.Ok(t, err)
+	testutil.Equals(t, exp, query(t, q, all))
+	testutil.Ok(t, q.Close())
+	testutil.Equals(t, 10, len(lc.entries))
+
+	// Least recently used chunks are evicted.
+	c := NewLRUChunkCache(nil, 10).(*lruChunkCache)
+	c.Set(b.Meta().ULID, 1, make([]byte, 5))
+	c.Set(b.Meta().ULID, 2, make([]byte, 5))
+	_, ok := c.Get(b.Meta().ULID, 1)
+	testutil.Assert(t, ok, "chunk not cached")
+	c.Set(b.Meta().ULID, 3, make([]byte, 5))
+
+	_, ok = c.Get(b.Meta().ULID, 2)
+	testutil.Assert(t, !ok, "chunk not evicted")
+	_, ok = c.Get(b.Meta().ULID, 1)
+	testutil.Assert(t, ok, "chunk evicted")
+}
+
+func TestDB_Scrub(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	b := createPopulatedBlock(t, dir, 10, 5)
+	testutil.Ok(t, b.Close())
+
+	// Damage chunk data, which is not read when the block is opened.
+	fn := filepath.Join(b.Dir(), "chunks", "000001")
+	data, err := ioutil.ReadFile(fn)
+	testutil.Ok(t, err)
+	data[len(data)-1] ^= 0xff
+	testutil.Ok(t, ioutil.WriteFile(fn, data, 0666))
+
+	db, err := Open(dir, nil, nil, &Options{ScrubRate: 1 << 30})
+	testutil.Ok(t, err)
+	defer db.Close()
+
+	for i := 0; ; i++ {
+		status, err := db.Status()
+		testutil.Ok(t, err)
+		if status.ScrubCorruptedBlocks == 1 {
+			break
+		}
+		testutil.Assert(t, i < 100, "corrupted block not detected")
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Reads are throttled to the rate of the scrubber.
+	s := newScrubber(db, nil, 10000)
+	r := &throttledReader{r: bytes.NewReader(make([]byte, 1000)), s: s, start: time.Now()}
+
+	n, err := io.Copy(ioutil.Discard, r)
+	testutil.Ok(t, err)
+	testutil.Equals(t, int64(1000), n)
+	testutil.Assert(t, time.Since(r.start) >= 90*time.Millisecond, "reads not throttled")
+}
+
+func TestDB_QueryGate(t *testing.T) {
+	db, close := openTestDB(t, &Options{
+		MaxConcurrentSelects: 1,
+		QueryQueueTimeout:    50 * time.Millisecond,
+	})
+	defer close()
+	defer db.Close()
+
+	app := db.Appender()
+	_, err := app.Add(labels.FromStrings("a", "b"), 0, 1)
+	testutil.Ok(t, err)
+	testutil.Ok(t, app.Commit())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	q, err := db.QuerierContext(ctx, 0, 10)
+	testutil.Ok(t, err)
+	defer q.Close()
+
+	testutil.Equals(t, map[string][]sample{
+		`{a="b"}`: {{t: 0, v: 1}},
+	}, query(t, q, labels.NewEqualMatcher("a", "b")))
+
+	// Occupy the only slot. Selects time out or fail once canceled.
+	testutil.Ok(t, db.queryGate.start(context.Background()))
+
+	_, err = q.Select(labels.NewEqualMatcher("a", "b"))
+	testutil.Equals(t, ErrQueryQueueTimeout, err)
+
+	cancel()
+	_, err = q.Select(labels.NewEqualMatcher("a", "b"))
+	testutil.Equals(t, context.Canceled, err)
+
+	// Queued selects proceed once the slot is released.
+	errc := make(chan error)
+	go func() {
+		q, err := db.Querier(0, 10)
+		if err != nil {
+			errc <- err
+			return
+		}
+		defer q.Close()
+		_, err = q.Select(labels.NewEqualMatcher("a", "b"))
+		errc <- err
+	}()
+	db.queryGate.done()
+	testutil.Ok(t, <-errc)
+
+	// Slots are held until series sets are exhausted or their querier closed.
+	// Selects of the same querier share its slot.
+	q1, err := db.Querier(0, 10)
+	testutil.Ok(t, err)
+	ss1, err := q1.Select(labels.NewEqualMatcher("a", "b"))
+	testutil.Ok(t, err)
+	ss2, err := q1.Select(labels.NewEqualMatcher("a", "b"))
+	testutil.Ok(t, err)
+
+	q2, err := db.Querier(0, 10)
+	testutil.Ok(t, err)
+	defer q2.Close()
+
+	for _, ss := range []SeriesSet{ss1, ss2} {
+		_, err = q2.Select(labels.NewEqualMatcher("a", "b"))
+		testutil.Equals(t, ErrQueryQueueTimeout, err)
+
+		for ss.Next() {
+		}
+		testutil.Ok(t, ss.Err())
+	}
+	ss, err := q2.Select(labels.NewEqualMatcher("a", "b"))
+	testutil.Ok(t, err)
+
+	_, err = q1.Select(labels.NewEqualMatcher("a", "b"))
+	testutil.Equals(t, ErrQueryQueueTimeout, err)
+	testutil.Ok(t, q1.Close())
+
+	testutil.Assert(t, ss.Next(), "series set empty")
+	testutil.Ok(t, q2.Close())
+
+	// Selects after closing a querier fail and don't take the slot.
+	_, err = q2.Select(labels.NewEqualMatcher("a", "b"))
+	testutil.NotOk(t, err)
+	testutil.Ok(t, db.queryGate.start(context.Background()))
+	db.queryGate.done()
+}
+
+func TestDB_Count(t *testing.T) {
+	db, close := openTestDB(t, &Options{
+		BlockRanges: []int64{1000},
+	})
+	defer close()
+	defer db.Close()
+
+	app := db.Appender()
+	for ts := int64(0); ts <= 3000; ts += 100 {
+		_, err := app.Add(labels.FromStrings("a", "1"), ts, 1)
+		testutil.Ok(t, err)
+		_, err = app.Add(labels.FromStrings("a", "2"), ts, 1)
+		testutil.Ok(t, err)
+		if ts >= 2500 {
+			_, err = app.Add(labels.FromStrings("a", "3"), ts, 1)
+			testutil.Ok(t, err)
+		}
+	}
+	testutil.Ok(t, app.Commit())
+	testutil.Ok(t, db.compact())
+	testutil.Equals(t, 2, len(db.Blocks()))
+
+	cases := []struct {
+		mint, maxt int64
+		matchers   []labels.Matcher
+		series     int
+		samples    int64
+	}{
+		{
+			mint: 0, maxt: 3000,
+			matchers: []labels.Matcher{labels.NewMustRegexpMatcher("a", ".+")},
+			series:   3,
+			samples:  31 + 31 + 6,
+		}, {
+			mint: 0, maxt: 3000,
+			matchers: []labels.Matcher{labels.NewEqualMatcher("a", "1")},
+			series:   1,
+			samples:  31,
+		}, {
+			mint: 0, maxt: 999,
+			matchers: []labels.Matcher{labels.NewMustRegexpMatcher("a", ".+")},
+			series:   2,
+			samples:  20,
+		}, {
+			mint: 0, maxt: 3000,
+			matchers: []labels.Matcher{labels.NewEqualMatcher("a", "4")},
+		},
+	}
+	for _, c := range cases {
+		q, err := db.Querier(c.mint, c.maxt)
+		testutil.Ok(t, err)
+
+		series, samples, err := q.Count(c.matchers...)
+		testutil.Ok(t, err)
+		testutil.Equals(t, c.series, series)
+		testutil.Equals(t, c.samples, samples)
+
+		testutil.Ok(t, q.Close())
+	}
+}
+
+func TestDB_Exists(t *testing.T) {
+	db, close := openTestDB(t, &Options{
+		BlockRanges: []int64{1000},
+	})
+	defer close()
+	defer db.Close()
+
+	app := db.Appender()
+	for ts := int64(0); ts <= 3000; ts += 100 {
+		_, err := app.Add(labels.FromStrings("a", "1"), ts, 1)
+		testutil.Ok(t, err)
+		if ts >= 2500 {
+			_, err = app.Add(labels.FromStrings("a", "2"), ts, 1)
+			testutil.Ok(t, err)
+		}
+	}
+	testutil.Ok(t, app.Commit())
+	testutil.Ok(t, db.compact())
+	testutil.Equals(t, 2, len(db.Blocks()))
+
+	testutil.Ok(t, db.Delete(0, 500, labels.NewEqualMatcher("a", "1")))
+
+	cases := []struct {
+		mint, maxt int64
+		matcher    labels.Matcher
+		exists     bool
+	}{
+		{mint: 0, maxt: 3000, matcher: labels.NewEqualMatcher("a", "1"), exists: true},
+		{mint: 2800, maxt: 3000, matcher: labels.NewEqualMatcher("a", "2"), exists: true},
+		{mint: 0, maxt: 999, matcher: labels.NewEqualMatcher("a", "2")},
+		{mint: 0, maxt: 3000, matcher: labels.NewEqualMatcher("a", "3")},
+		{mint: 4000, maxt: 5000, matcher: labels.NewMustRegexpMatcher("a", ".+")},
+	}
+	for _, c := range cases {
+		q, err := db.Querier(c.mint, c.maxt)
+		testutil.Ok(t, err)
+
+		ok, err := q.Exists(c.matcher)
+		testutil.Ok(t, err)
+		testutil.Equals(t, c.exists, ok)
+
+		testutil.Ok(t, q.Close())
+	}
+}
+
+func TestDB_Lineage(t *testing.T) {
+	db, close := openTestDB(t, &Options{
+		BlockRanges: []int64{1000, 3000},
+	})
+	defer close()
+	defer db.Close()
+
+	app := db.Appender()
+	for ts := int64(0); ts <= 6000; ts += 100 {
+		_, err := app.Add(labels.FromStrings("a", "1"), ts, 1)
+		testutil.Ok(t, err)
+	}
+	testutil.Ok(t, app.Commit())
+	testutil.Ok(t, db.compact())
+
+	var compacted *BlockMeta
+	for _, b := range db.Blocks() {
+		if m := b.Meta(); m.Compaction.Level == 2 {
+			compacted = &m
+		}
+	}
+	testutil.Assert(t, compacted != nil, "no compacted block")
+	testutil.Equals(t, 3, len(compacted.Compaction.Parents))
+
+	res, err := db.Lineage(compacted.ULID)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 4, len(res))
+	testutil.Equals(t, compacted.ULID, res[3].ULID)
+	testutil.Equals(t, 2, res[3].Level)
+
+	for i, p := range compacted.Compaction.Parents {
+		testutil.Equals(t, p.ULID, res[3].Parents[i])
+
+		// Deleted parents can still be traced.
+		pres, err := db.Lineage(p.ULID)
+		testutil.Ok(t, err)
+		testutil.Equals(t, []CompactionRecord{{ULID: p.ULID, Level: 1, Time: int64(p.ULID.Time())}}, pres)
+	}
+
+	_, err = db.Lineage(ulid.MustNew(ulid.Now(), nil))
+	testutil.Equals(t, ErrNotFound, err)
+}
+
+func TestDB_CompactionDeferredOnLowDiskSpace(t *testing.T) {
+	db, close := openTestDB(t, &Options{
+		BlockRanges: []int64{1000, 3000},
+	})
+	defer close()
+	defer db.Close()
+
+	var free uint64
+	db.freeSpace = func(string) (uint64, error) { return free, nil }
+
+	app := db.Appender()
+	for ts := int64(0); ts <= 6000; ts += 100 {
+		_, err := app.Add(labels.FromStrings("a", "1"), ts, 1)
+		testutil.Ok(t, err)
+	}
+	testutil.Ok(t, app.Commit())
+
+	// The head is persisted but blocks are not compacted further.
+	testutil.Ok(t, db.compact())
+	testutil.Equals(t, 5, len(db.Blocks()))
+
+	dirs, err := blockDirs(db.Dir())
+	testutil.Ok(t, err)
+	testutil.Equals(t, 5, len(dirs))
+
+	free = 1 << 30
+	testutil.Ok(t, db.compact())
+	testutil.Equals(t, 3, len(db.Blocks()))
+	testutil.Equals(t, 2, db.Blocks()[0].Meta().Compaction.Level)
+}
+
+func TestDB_DiskStats(t *testing.T) {
+	db, close := openTestDB(t, &Options{
+		BlockRanges: []int64{1000},
+	})
+	defer close()
+	defer db.Close()
+
+	app := db.Appender()
+	for ts := int64(0); ts <= 3000; ts += 100 {
+		_, err := app.Add(labels.FromStrings("a", "1"), ts, 1)
+		testutil.Ok(t, err)
+		_, err = app.Add(labels.FromStrings("a", "2"), ts, 1)
+		testutil.Ok(t, err)
+	}
+	testutil.Ok(t, app.Commit())
+	testutil.Ok(t, db.compact())
+	testutil.Ok(t, db.Delete(0, 500, labels.NewEqualMatcher("a", "1")))
+
+	// Leftovers of an interrupted compaction.
+	tmp := filepath.Join(db.Dir(), "01CZZZZZZZZZZZZZZZZZZZZZZZ.tmp")
+	testutil.Ok(t, os.MkdirAll(tmp, 0777))
+	testutil.Ok(t, ioutil.WriteFile(filepath.Join(tmp, "index"), make([]byte, 100), 0666))
+
+	stats, err := db.DiskStats()
+	testutil.Ok(t, err)
+
+	blocks := db.Blocks()
+	testutil.Equals(t, len(blocks), len(stats.Blocks))
+	testutil.Equals(t, int64(100), stats.Tmp)
+	testutil.Assert(t, stats.WAL > 0, "WAL size not reported")
+
+	var total, tombstones int64
+	for i, b := range stats.Blocks {
+		testutil.Equals(t, blocks[i].Meta().ULID, b.ULID)
+		testutil.Assert(t, b.Index > 0 && b.Chunks > 0, "block files not reported")
+		testutil.Assert(t, b.Index+b.Chunks+b.Tombstones < b.Total, "meta file not included in block total")
+
+		size, err := dirSize(blocks[i].Dir())
+		testutil.Ok(t, err)
+		testutil.Equals(t, size, b.Total)
+
+		total += b.Total
+		tombstones += b.Tombstones
+	}
+	testutil.Equals(t, total, stats.BlocksTotal)
+	testutil.Equals(t, tombstones, stats.Tombstones)
+	testutil.Assert(t, stats.Tombstones > 0, "tombstones not reported")
+	testutil.Assert(t, stats.Total >= stats.BlocksTotal+stats.WAL+stats.Tmp, "total smaller than its parts")
+}
+
+func TestDB_RepairNewestBlockFromWAL(t *testing.T) {
+	db, close := openTestDB(t, &Options{
+		BlockRanges: []int64{1000},
+	})
+	defer close()
+
+	app := db.Appender()
+	for ts := int64(0); ts <= 3000; ts += 100 {
+		_, err := app.Add(labels.FromStrings("a", "1"), ts, float64(ts))
+		testutil.Ok(t, err)
+	}
+	testutil.Ok(t, app.Commit())
+	testutil.Ok(t, db.compact())
+
+	blocks := db.Blocks()
+	testutil.Assert(t, len(blocks) > 0, "no blocks persisted")
+	broken := blocks[len(blocks)-1].Meta()
+
+	q, err := db.Querier(0, 3000)
+	testutil.Ok(t, err)
+	expected := query(t, q, labels.NewEqualMatcher("a", "1"))
+	testutil.Ok(t, q.Close())
+	testutil.Ok(t, db.Close())
+
+	// Flip a byte in the last chunk of the newest block as a torn write would.
+	fn := filepath.Join(db.Dir(), broken.ULID.String(), "chunks", "000001")
+	b, err := ioutil.ReadFile(fn)
+	testutil.Ok(t, err)
+	b[len(b)-5] ^= 0xff
+	testutil.Ok(t, ioutil.WriteFile(fn, b, 0666))
+
+	db, err = Open(db.Dir(), nil, nil, db.opts)
+	testutil.Ok(t, err)
+
+	blocks = db.Blocks()
+	rebuilt := blocks[len(blocks)-1].Meta()
+	testutil.Assert(t, rebuilt.ULID != broken.ULID, "block was not rebuilt")
+	testutil.Equals(t, broken.MinTime, rebuilt.MinTime)
+	testutil.Equals(t, broken.MaxTime, rebuilt.MaxTime)
+	testutil.Equals(t, broken.Stats.NumSamples, rebuilt.Stats.NumSamples)
+
+	q, err = db.Querier(0, 3000)
+	testutil.Ok(t, err)
+	testutil.Equals(t, expected, query(t, q, labels.NewEqualMatcher("a", "1")))
+	testutil.Ok(t, q.Close())
+
+	// The rebuilt block is checked on the next startup and only then.
+	testutil.Ok(t, db.Close())
+	db, err = Open(db.Dir(), nil, nil, db.opts)
+	testutil.Ok(t, err)
+	testutil.Ok(t, db.Close())
+
+	id, err := readCheckedBlock(db.Dir())
+	testutil.Ok(t, err)
+	testutil.Equals(t, rebuilt.ULID, id)
+
+	fn = filepath.Join(db.Dir(), rebuilt.ULID.String(), "chunks", "000001")
+	b, err = ioutil.ReadFile(fn)
+	testutil.Ok(t, err)
+	b[len(b)-5] ^= 0xff
+	testutil.Ok(t, ioutil.WriteFile(fn, b, 0666))
+
+	db, err = Open(db.Dir(), nil, nil, db.opts)
+	testutil.Ok(t, err)
+	defer db.Close()
+
+	blocks = db.Blocks()
+	testutil.Equals(t, rebuilt.ULID, blocks[len(blocks)-1].Meta().ULID)
+}
+
+func TestDB_ChunkFetchConcurrency(t *testing.T) {
+	db, close := openTestDB(t, &Options{
+		BlockRanges:           []int64{10000},
+		ChunkFetchConcurrency: 3,
+	})
+	defer close()
+	defer db.Close()
+
+	// Long series spanning many chunks in each block.
+	app := db.Appender()
+	for ts := int64(0); ts <= 30000; ts += 10 {
+		for _, v := range []string{"1", "2", "3"} {
+			_, err := app.Add(labels.FromStrings("a", v), ts, float64(ts))
+			testutil.Ok(t, err)
+		}
+	}
+	testutil.Ok(t, app.Commit())
+	testutil.Ok(t, db.compact())
+	testutil.Assert(t, len(db.Blocks()) > 0, "no blocks persisted")
+
+	q, err := db.Querier(0, 30000)
+	testutil.Ok(t, err)
+	res := query(t, q, labels.NewEqualMatcher("a", "1"))
+
+	var exp []sample
+	for ts := int64(0); ts <= 30000; ts += 10 {
+		exp = append(exp, sample{t: ts, v: float64(ts)})
+	}
+	testutil.Equals(t, map[string][]sample{`{a="1"}`: exp}, res)
+
+	// Seeking skips chunks that were already fetched ahead.
+	m, err := labels.NewRegexpMatcher("a", ".+")
+	testutil.Ok(t, err)
+	ss, err := q.Select(m)
+	testutil.Ok(t, err)
+	for ss.Next() {
+		it := ss.At().Iterator()
+		testutil.Assert(t, it.Seek(5005), "seek failed")
+		ts, _ := it.At()
+		testutil.Equals(t, int64(5010), ts)
+		testutil.Assert(t, it.Seek(5020), "seek within chunk failed")
+		ts, _ = it.At()
+		testutil.Equals(t, int64(5020), ts)
+		testutil.Assert(t, it.Seek(25000), "seek failed")
+		ts, _ = it.At()
+		testutil.Equals(t, int64(25000), ts)
+		testutil.Ok(t, it.Err())
+	}
+	testutil.Ok(t, ss.Err())
+	testutil.Ok(t, q.Close())
+}
+
+func TestDB_MetricSchemas(t *testing.T) {
+	db, close := openTestDB(t, &Options{
+		LabelValidation: &LabelValidation{
+			Schemas: map[string]MetricSchema{
+				"up": {
+					Required: []string{"job", "instance"},
+				},
+				"requests": {
+					Required: []string{"job"},
+					Allowed:  []string{"code"},
+				},
+				"latency": {
+					Allowed:        []string{"job"},
+					DropDisallowed: true,
+				},
+			},
+		},
+	})
+	defer close()
+	defer db.Close()
+
+	cases := []struct {
+		lset   labels.Labels
+		label  string
+		reason error
+	}{
+		{
+			lset: labels.FromStrings("__name__", "up", "job", "a", "instance", "1", "zone", "x"),
+		}, {
+			lset:   labels.FromStrings("__name__", "up", "job", "a"),
+			label:  "instance",
+			reason: ErrMissingLabel,
+		}, {
+			lset: labels.FromStrings("__name__", "requests", "job", "a", "code", "200"),
+		}, {
+			lset:   labels.FromStrings("__name__", "requests", "job", "a", "path", "/"),
+			label:  "path",
+			reason: ErrLabelNotAllowed,
+		}, {
+			lset: labels.FromStrings("__name__", "latency", "job", "a", "instance", "1"),
+		}, {
+			lset: labels.FromStrings("__name__", "latency", "job", "a", "instance", "2"),
+		}, {
+			lset: labels.FromStrings("__name__", "other", "path", "/"),
+		},
+	}
+	app := db.Appender()
+	for i, c := range cases {
+		_, err := app.Add(c.lset, int64(i), 1)
+		if c.reason == nil {
+			testutil.Ok(t, err)
+			continue
+		}
+		verr, ok := errors.Cause(err).(*InvalidLabelsError)
+		testutil.Assert(t, ok, "unexpected error %v", err)
+		testutil.Equals(t, c.reason, verr.Reason)
+		testutil.Equals(t, c.label, verr.Label)
+	}
+	testutil.Ok(t, app.Commit())
+
+	// Relabeled series are counted once when they are created.
+	testutil.Equals(t, 1.0, prom_testutil.ToFloat64(db.head.metrics.schemaViolations.WithLabelValues("relabeled")))
+
+	q, err := db.Querier(0, 10)
+	testutil.Ok(t, err)
+	defer q.Close()
+
+	// Disallowed labels are dropped, merging the latency series into one.
+	testutil.Equals(t, map[string][]sample{
+		`{__name__="up",instance="1",job="a",zone="x"}`: {{t: 0, v: 1}},
+		`{__name__="requests",code="200",job="a"}`:      {{t: 2, v: 1}},
+		`{__name__="latency",job="a"}`:                  {{t: 4, v: 1}, {t: 5, v: 1}},
+		`{__name__="other",path="/"}`:                   {{t: 6, v: 1}},
+	}, query(t, q, labels.NewMustRegexpMatcher("__name__", ".+")))
+}
+
+func TestDB_LabelValidation(t *testing.T) {
+	db, close := openTestDB(t, &Options{
+		LabelValidation: &LabelValidation{
+			RequireMetricName: true,
+			AllowedNameChar:   PrometheusNameChar,
+		},
+	})
+	defer close()
+	defer db.Close()
+
+	cases := []struct {
+		lset   labels.Labels
+		label  string
+		reason error
+	}{
+		{
+			lset: labels.FromStrings("__name__", "up", "job", "a"),
+		}, {
+			lset:   labels.Labels{{Name: "job", Value: "a"}, {Name: "__name__", Value: "up"}},
+			label:  "__name__",
+			reason: ErrLabelsNotSorted,
+		}, {
+			lset:   labels.Labels{{Name: "__name__", Value: "up"}, {Name: "job", Value: "a"}, {Name: "job", Value: "b"}},
+			label:  "job",
+			reason: ErrDuplicateLabelName,
+		}, {
+			lset:   labels.Labels{{Name: "", Value: "a"}, {Name: "__name__", Value: "up"}},
+			reason: ErrEmptyLabelName,
+		}, {
+			lset:   labels.FromStrings("job", "a"),
+			reason: ErrMissingMetricName,
+		}, {
+			lset:   labels.FromStrings("__name__", "up", "job", "\xff"),
+			label:  "job",
+			reason: ErrInvalidUTF8,
+		}, {
+			lset:   labels.FromStrings("__name__", "up", "job-name", "a"),
+			label:  "job-name",
+			reason: ErrInvalidLabelChar,
+		}, {
+			lset:   labels.FromStrings("__name__", "up", "0job", "a"),
+			label:  "0job",
+			reason: ErrInvalidLabelChar,
+		},
+	}
+	app := db.Appender()
+	for _, c := range cases {
+		_, err := app.Add(c.lset, 0, 1)
+		if c.reason == nil {
+			testutil.Ok(t, err)
+			continue
+		}
+		verr, ok := errors.Cause(err).(*InvalidLabelsError)
+		testutil.Assert(t, ok, "unexpected error %v", err)
+		testutil.Equals(t, c.reason, verr.Reason)
+		testutil.Equals(t, c.label, verr.Label)
+	}
+	testutil.Ok(t, app.Commit())
+
+	q, err := db.Querier(0, 1)
+	testutil.Ok(t, err)
+	defer q.Close()
+
+	testutil.Equals(t, map[string][]sample{
+		`{__name__="up",job="a"}`: {{t: 0, v: 1}},
+	}, query(t, q, labels.NewEqualMatcher("__name__", "up")))
+}
+
+func TestDB_ChunkPrecision(t *testing.T) {
+	db, close := openTestDB(t, &Options{
+		BlockRanges: []int64{1000},
+		ChunkPrecision: func(lset labels.Labels) (int, bool) {
+			return 1, lset.Get("type") == "sensor"
+		},
+	})
+	defer close()
+	defer db.Close()
+
+	var (
+		sensor  = labels.FromStrings("type", "sensor")
+		precise = labels.FromStrings("type", "precise")
+		exp     = map[string][]sample{}
+	)
+	app := db.Appender()
+	for ts := int64(0); ts < 2000; ts += 100 {
+		v := 20 + float64(ts)/3
+
+		_, err := app.Add(sensor, ts, v)
+		testutil.Ok(t, err)
+		_, err = app.Add(precise, ts, v)
+		testutil.Ok(t, err)
+
+		exp[sensor.String()] = append(exp[sensor.String()], sample{t: ts, v: chunkenc.Round(v, 1)})
+		exp[precise.String()] = append(exp[precise.String()], sample{t: ts, v: v})
+	}
+	testutil.Ok(t, app.Commit())
+
+	// A duplicate of a rounded sample is no amendment.
+	app = db.Appender()
+	_, err := app.Add(sensor, 1900, 20+1900.0/3+0.01)
+	testutil.Ok(t, err)
+	testutil.Ok(t, app.Rollback())
+
+	q, err := db.Querier(0, 2000)
+	testutil.Ok(t, err)
+	testutil.Equals(t, exp, query(t, q, labels.NewMustRegexpMatcher("type", ".+")))
+	testutil.Ok(t, q.Close())
+
+	// Persisted chunks keep the lossy encoding.
+	testutil.Ok(t, db.FlushHead())
+	testutil.Assert(t, len(db.Blocks()) > 0, "no blocks persisted")
+
+	for _, b := range db.Blocks() {
+		ir, err := b.Index()
+		testutil.Ok(t, err)
+		cr, err := b.Chunks()
+		testutil.Ok(t, err)
+
+		p, err := ir.Postings("type", "sensor")
+		testutil.Ok(t, err)
+		var (
+			lset labels.Labels
+			chks []chunks.Meta
+		)
+		for p.Next() {
+			testutil.Ok(t, ir.Series(p.At(), &lset, &chks))
+			for _, c := range chks {
+				chk, err := cr.Chunk(c.Ref)
+				testutil.Ok(t, err)
+				testutil.Equals(t, chunkenc.EncScaled, chk.Encoding())
+			}
+		}
+		testutil.Ok(t, p.Err())
+		testutil.Ok(t, ir.Close())
+		testutil.Ok(t, cr.Close())
+	}
+	q, err = db.Querier(0, 2000)
+	testutil.Ok(t, err)
+	testutil.Equals(t, exp, query(t, q, labels.NewMustRegexpMatcher("type", ".+")))
+	testutil.Ok(t, q.Close())
+}
+
+func TestDB_AggregationRules(t *testing.T) {
+	db, close := openTestDB(t, &Options{
+		BlockRanges: []int64{1000},
+		AggregationRules: []AggregationRule{
+			{
+				Matchers: []labels.Matcher{labels.NewEqualMatcher("__name__", "requests")},
+				By:       []string{"job"},
+				Name:     "job:requests:sum",
+				Op:       AggregateSum,
+				Interval: 100,
+			}, {
+				Matchers: []labels.Matcher{labels.NewEqualMatcher("__name__", "requests")},
+				Without:  []string{"instance"},
+				Op:       AggregateCount,
+				Interval: 200,
+			},
+		},
+	})
+	defer close()
+	defer db.Close()
+
+	app := db.Appender()
+	for ts := int64(0); ts < 3000; ts += 100 {
+		_, err := app.Add(labels.FromStrings("__name__", "requests", "job", "a", "instance", "1"), ts, 1)
+		testutil.Ok(t, err)
+		_, err = app.Add(labels.FromStrings("__name__", "requests", "job", "a", "instance", "2"), ts+50, 2)
+		testutil.Ok(t, err)
+	}
+	testutil.Ok(t, app.Commit())
+	testutil.Ok(t, db.compact())
+	testutil.Equals(t, 2, len(db.Blocks()))
+
+	// Only blocks written from the head hold aggregated series. Each step holds
+	// the most recent sample of each series within the interval starting at it.
+	exp := map[string][]sample{}
+	sum := labels.FromStrings("__name__", "job:requests:sum", "job", "a").String()
+	count := labels.FromStrings("__name__", "requests", "job", "a").String()
+
+	for ts := int64(0); ts < 2000; ts += 100 {
+		exp[sum] = append(exp[sum], sample{t: ts, v: 3})
+
+		if ts%200 == 0 {
+			exp[count] = append(exp[count], sample{t: ts, v: 2})
+		}
+	}
+	q, err := db.Querier(0, 3000)
+	testutil.Ok(t, err)
+	defer q.Close()
+
+	res := query(t, q, labels.NewEqualMatcher("job", "a"), labels.NewMustRegexpMatcher("instance", "^$"))
+	testutil.Equals(t, exp, res)
+}
+
+func TestAggregateBlock_SameSeries(t *testing.T) {
+	h, err := NewHead(nil, nil, nil, 1000)
+	testutil.Ok(t, err)
+	defer h.Close()
+
+	app := h.Appender()
+	for ts := int64(0); ts < 1000; ts += 100 {
+		_, err := app.Add(labels.FromStrings("__name__", "requests", "job", "a"), ts, 5)
+		testutil.Ok(t, err)
+	}
+	testutil.Ok(t, app.Commit())
+
+	rule := func(op AggregationOp) AggregationRule {
+		return AggregationRule{
+			Matchers: []labels.Matcher{labels.NewEqualMatcher("__name__", "requests")},
+			By:       []string{"job"},
+			Name:     "job:requests",
+			Op:       op,
+			Interval: 100,
+		}
+	}
+	// Identical samples of rules producing the same series are deduplicated.
+	ah, err := aggregateBlock(h, []AggregationRule{rule(AggregateSum), rule(AggregateSum)}, 0, 1000)
+	testutil.Ok(t, err)
+	defer ah.Close()
+
+	q, err := NewBlockQuerier(ah, 0, 1000)
+	testutil.Ok(t, err)
+	res := query(t, q, labels.NewEqualMatcher("__name__", "job:requests"))
+	testutil.Ok(t, q.Close())
+	testutil.Equals(t, 1, len(res))
+	testutil.Equals(t, 10, len(res[`{__name__="job:requests",job="a"}`]))
+
+	// Differing samples fail the evaluation.
+	_, err = aggregateBlock(h, []AggregationRule{rule(AggregateSum), rule(AggregateCount)}, 0, 1000)
+	testutil.NotOk(t, err)
+}
+
+func TestAggregationStep(t *testing.T) {
+	for _, c := range []struct {
+		t, mint, exp int64
+	}{
+		{t: 0, mint: 0, exp: 0},
+		{t: 99, mint: 0, exp: 0},
+		{t: 100, mint: 0, exp: 100},
+		{t: 999, mint: 0, exp: 900},
+		{t: -1, mint: -1000, exp: -100},
+		{t: -100, mint: -1000, exp: -100},
+		{t: -101, mint: -1000, exp: -200},
+		// Steps starting before the block start at the block's start.
+		{t: 1020, mint: 1010, exp: 1010},
+		{t: -50, mint: -60, exp: -60},
+	} {
+		testutil.Equals(t, c.exp, aggregationStep(c.t, 100, c.mint))
+	}
+}
+
+func TestDB_LabelRanges(t *testing.T) {
+	db, close := openTestDB(t, &Options{
+		BlockRanges: []int64{1000},
+		RangeLabels: []string{"shard", "zone"},
+	})
+	defer close()
+	defer db.Close()
+
+	app := db.Appender()
+	for ts := int64(0); ts < 3000; ts += 100 {
+		// Shards move up by ten in each block range.
+		for i := int64(0); i < 3; i++ {
+			shard := strconv.FormatInt(ts/1000*10+i, 10)
+			_, err := app.Add(labels.FromStrings("shard", shard, "zone", "a"), ts, 1)
+			testutil.Ok(t, err)
+		}
+	}
+	testutil.Ok(t, app.Commit())
+	testutil.Ok(t, db.compact())
+	testutil.Equals(t, 2, len(db.Blocks()))
+
+	for i, b := range db.Blocks() {
+		testutil.Equals(t, map[string]LabelRange{
+			"shard": {Min: strconv.Itoa(i * 10), Max: strconv.Itoa(i*10 + 2)},
+		}, b.Meta().LabelRanges)
+	}
+	ranges := db.Blocks()[1].Meta().LabelRanges
+	testutil.Assert(t, labelRangesExclude(ranges, []labels.Matcher{labels.NewRangeMatcher("shard", 0, 9)}), "range not excluded")
+	testutil.Assert(t, labelRangesExclude(ranges, []labels.Matcher{labels.NewEqualMatcher("shard", "2")}), "value not excluded")
+	testutil.Assert(t, !labelRangesExclude(ranges, []labels.Matcher{labels.NewRangeMatcher("shard", 5, 10)}), "overlapping range excluded")
+	testutil.Assert(t, !labelRangesExclude(ranges, []labels.Matcher{labels.NewEqualMatcher("shard", "")}), "empty value excluded")
+
+	q, err := db.Querier(0, 3000)
+	testutil.Ok(t, err)
+	defer q.Close()
+
+	res := query(t, q, labels.NewRangeMatcher("shard", 1, 11))
+	testutil.Equals(t, 4, len(res))
+	for _, s := range []string{"1", "2", "10", "11"} {
+		testutil.Equals(t, 10, len(res[labels.FromStrings("shard", s, "zone", "a").String()]))
+	}
+}
+
+func TestDB_CommitHook(t *testing.T) {
+	var committed []RefSample
+
+	opts := *DefaultOptions
+	opts.CommitHook = func(samples []RefSample) {
+		for _, s := range samples {
+			committed = append(committed, RefSample{Ref: s.Ref, T: s.T, V: s.V})
+		}
+	}
+	db, close := openTestDB(t, &opts)
+	defer close()
+	defer db.Close()
+
+	app := db.Appender()
+	ref, err := app.Add(labels.FromStrings("a", "b"), 1, 1)
+	testutil.Ok(t, err)
+	testutil.Ok(t, app.AddFast(ref, 2, 2))
+	testutil.Ok(t, app.Commit())
+
+	testutil.Equals(t, []RefSample{{Ref: ref, T: 1, V: 1}, {Ref: ref, T: 2, V: 2}}, committed)
+
+	// Rolled back samples are not passed to the hook.
+	committed = nil
+
+	app = db.Appender()
+	testutil.Ok(t, app.AddFast(ref, 3, 3))
+	testutil.Ok(t, app.Rollback())
+	testutil.Equals(t, 0, len(committed))
+
+	// Duplicates of the latest sample are not added to the head again.
+	app = db.Appender()
+	testutil.Ok(t, app.AddFast(ref, 2, 2))
+	testutil.Ok(t, app.AddFast(ref, 4, 4))
+	testutil.Ok(t, app.Commit())
+
+	testutil.Equals(t, []RefSample{{Ref: ref, T: 4, V: 4}}, committed)
+}
+
+func TestDB_TimestampUnit(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "test")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	db, err := Open(tmpdir, nil, nil, &Options{TimestampUnit: TimestampNanoseconds})
+	testutil.Ok(t, err)
+	testutil.Equals(t, int64(2*time.Hour), db.opts.BlockRanges[0])
+
+	app := db.Appender()
+	for _, ts := range []time.Duration{0, time.Hour, 4 * time.Hour} {
+		_, err := app.Add(labels.FromStrings("a", "b"), int64(ts), 1)
+		testutil.Ok(t, err)
+	}
+	testutil.Ok(t, app.Commit())
+	testutil.Ok(t, db.compact())
+
+	blocks := db.Blocks()
+	testutil.Equals(t, 1, len(blocks))
+	testutil.Equals(t, TimestampNanoseconds, blocks[0].Meta().TimestampUnit)
+	testutil.Ok(t, db.Close())
+
+	// Blocks of another unit are not loaded.
+	_, err = Open(tmpdir, nil, nil, nil)
+	testutil.NotOk(t, err)
+
+	_, err = Open(tmpdir, nil, nil, &Options{TimestampUnit: "s"})
+	testutil.NotOk(t, err)
+
+	// Blocks of different units are not compacted together.
+	dir := filepath.Join(tmpdir, "other")
+	createEmptyBlock(t, dir, &BlockMeta{
+		ULID:    ulid.MustNew(1, nil),
+		MinTime: int64(2 * time.Hour),
+		MaxTime: int64(4 * time.Hour),
+	}).Close()
+
+	c, err := NewLeveledCompactor(nil, log.NewNopLogger(), []int64{int64(2 * time.Hour)}, nil)
+	testutil.Ok(t, err)
+	_, err = c.Compact(tmpdir, blocks[0].Dir(), dir)
+	testutil.NotOk(t, err)
+}
+
+func TestDB_IntegerSeries(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "test")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	opts := &Options{
+		IntegerSeries: func(lset labels.Labels) bool {
+			return lset.Get("type") == "int"
+		},
+	}
+	db, err := Open(tmpdir, nil, nil, opts)
+	testutil.Ok(t, err)
+
+	var (
+		intSeries   = labels.FromStrings("type", "int")
+		floatSeries = labels.FromStrings("type", "float")
+		hour        = int64(time.Hour / time.Millisecond)
+	)
+	app := db.Appender().(IntAppender)
+	ref, err := app.AddInt(intSeries, 0, 1<<60+1)
+	testutil.Ok(t, err)
+	testutil.Ok(t, app.AddIntFast(ref, hour, 1<<60+3))
+	// Float values must be integers.
+	testutil.Ok(t, app.AddFast(ref, 4*hour, 7))
+	for _, v := range []float64{7.9, math.NaN(), math.Float64frombits(staleNaN), math.Inf(-1), 1 << 63} {
+		testutil.Equals(t, ErrNotInteger, errors.Cause(app.AddFast(ref, 5*hour, v)))
+	}
+	_, err = app.AddInt(floatSeries, 0, 1<<60+1)
+	testutil.Ok(t, err)
+	testutil.Ok(t, app.Commit())
+
+	check := func() {
+		q, err := db.Querier(math.MinInt64, math.MaxInt64)
+		testutil.Ok(t, err)
+		defer q.Close()
+
+		ss, err := q.Select(labels.NewEqualMatcher("type", "int"))
+		testutil.Ok(t, err)
+		testutil.Assert(t, ss.Next(), "integer series not found")
+
+		var vals []int64
+		it := ss.At().Iterator().(IntSeriesIterator)
+		for it.Next() {
+			_, v, ok := it.AtInt()
+			testutil.Assert(t, ok, "value not stored as integer")
+			vals = append(vals, v)
+		}
+		testutil.Ok(t, it.Err())
+		testutil.Equals(t, []int64{1<<60 + 1, 1<<60 + 3, 7}, vals)
+
+		testutil.Equals(t, map[string][]sample{
+			`{type="float"}`: {{t: 0, v: float64(1<<60 + 1)}},
+		}, query(t, q, labels.NewEqualMatcher("type", "float")))
+	}
+	check()
+
+	// Integer samples are replayed from the WAL.
+	testutil.Ok(t, db.Close())
+	db, err = Open(tmpdir, nil, nil, opts)
+	testutil.Ok(t, err)
+	defer db.Close()
+	check()
+
+	// Integer chunks are persisted in blocks.
+	testutil.Ok(t, db.compact())
+	testutil.Equals(t, 1, len(db.Blocks()))
+	check()
+}
+
+func TestDB_CreatedTimestamp(t *testing.T) {
+	db, close := openTestDB(t, nil)
+	defer close()
+	defer db.Close()
+
+	lset := labels.FromStrings("__name__", "requests_total")
+
+	app := db.Appender().(CreatedTimestampAppender)
+	ref, err := app.AddCreated(lset, 1000, 500)
+	testutil.Ok(t, err)
+	testutil.Ok(t, app.AddFast(ref, 1000, 5))
+	testutil.Ok(t, app.Commit())
+
+	// The created timestamp of the following samples is before the latest
+	// sample and not added again.
+	app = db.Appender().(CreatedTimestampAppender)
+	testutil.Ok(t, app.AddCreatedFast(ref, 2000, 500))
+	testutil.Ok(t, app.AddFast(ref, 2000, 7))
+	testutil.Equals(t, ErrCreatedAfterSample, app.AddCreatedFast(ref, 2000, 2000))
+	testutil.Ok(t, app.Commit())
+
+	// A counter reset comes with a new created timestamp.
+	app = db.Appender().(CreatedTimestampAppender)
+	testutil.Ok(t, app.AddCreatedFast(ref, 4000, 3000))
+	testutil.Ok(t, app.AddFast(ref, 4000, 1))
+	testutil.Ok(t, app.Commit())
+
+	q, err := db.Querier(0, 5000)
+	testutil.Ok(t, err)
+	defer q.Close()
+
+	testutil.Equals(t, map[string][]sample{
+		lset.String(): {{500, 0}, {1000, 5}, {2000, 7}, {3000, 0}, {4000, 1}},
+	}, query(t, q, labels.NewEqualMatcher("__name__", "requests_total")))
+}
@@ -0,0 +1,112 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/oklog/ulid"
+)
+
+// deletionThrottle limits the rate at which files of deleted blocks are
+// removed. A nil throttle removes files at once.
+type deletionThrottle struct {
+	// Bytes per second, zero for no limit.
+	rate int64
+	// Size by which files are truncated before they are unlinked, zero
+	// to unlink them right away.
+	truncateStep int64
+
+	sleep func(time.Duration)
+}
+
+// deletionThrottle returns the throttle for block deletions configured in the
+// options or nil if deletions are not throttled.
+func (db *DB) deletionThrottle() *deletionThrottle {
+	opts := db.options()
+	if opts.BlockDeletionRate <= 0 && opts.BlockDeletionTruncateStep <= 0 {
+		return nil
+	}
+	return &deletionThrottle{
+		rate:         opts.BlockDeletionRate,
+		truncateStep: opts.BlockDeletionTruncateStep,
+		sleep:        time.Sleep,
+	}
+}
+
+// removeAll removes path and everything it contains like os.RemoveAll.
+func (t *deletionThrottle) removeAll(path string) error {
+	if t == nil {
+		return os.RemoveAll(path)
+	}
+	err := filepath.Walk(path, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() {
+			return t.removeFile(p, fi.Size())
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.RemoveAll(path)
+}
+
+// removeFile truncates the file in steps if configured and unlinks it. It
+// waits for the time the rate limit allots to the removed bytes.
+func (t *deletionThrottle) removeFile(path string, size int64) error {
+	for t.truncateStep > 0 && size > t.truncateStep {
+		size -= t.truncateStep
+		if err := os.Truncate(path, size); err != nil {
+			return err
+		}
+		t.wait(t.truncateStep)
+	}
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	t.wait(size)
+	return nil
+}
+
+func (t *deletionThrottle) wait(n int64) {
+	if t.rate > 0 && n > 0 {
+		t.sleep(time.Duration(float64(n) / float64(t.rate) * float64(time.Second)))
+	}
+}
+
+// deletionBatch returns the blocks of ids to delete by the current reload,
+// which are the oldest existing ones up to the configured batch size.
+func (db *DB) deletionBatch(ids map[ulid.ULID]struct{}) []ulid.ULID {
+	res := make([]ulid.ULID, 0, len(ids))
+	for id := range ids {
+		// Parents of compacted blocks were usually deleted before.
+		if _, err := os.Stat(filepath.Join(db.dir, id.String())); os.IsNotExist(err) {
+			continue
+		}
+		res = append(res, id)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Compare(res[j]) < 0
+	})
+	if n := db.options().BlockDeletionBatchSize; n > 0 && len(res) > n {
+		res = res[:n]
+	}
+	return res
+}
@@ -0,0 +1,89 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/oklog/ulid"
+	"github.com/prometheus/tsdb/testutil"
+)
+
+func TestDeletionThrottle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deletion")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	testutil.Ok(t, os.MkdirAll(filepath.Join(dir, "a", "b"), 0777))
+	testutil.Ok(t, ioutil.WriteFile(filepath.Join(dir, "a", "b", "f"), make([]byte, 10), 0666))
+
+	var slept []time.Duration
+	throttle := &deletionThrottle{
+		rate:         100,
+		truncateStep: 4,
+		sleep:        func(d time.Duration) { slept = append(slept, d) },
+	}
+	testutil.Ok(t, throttle.removeAll(filepath.Join(dir, "a")))
+
+	// The file is truncated to 6 and 2 bytes before it is removed.
+	testutil.Equals(t, []time.Duration{40 * time.Millisecond, 40 * time.Millisecond, 20 * time.Millisecond}, slept)
+
+	_, err = os.Stat(filepath.Join(dir, "a"))
+	testutil.Assert(t, os.IsNotExist(err), "directory not removed")
+
+	// Removing directories that do not exist succeeds.
+	testutil.Ok(t, throttle.removeAll(filepath.Join(dir, "a")))
+}
+
+func TestDB_BlockDeletionBatchSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deletion")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	for i := 0; i < 3; i++ {
+		id := ulid.MustNew(uint64(i), nil)
+		bdir := filepath.Join(dir, id.String())
+
+		createEmptyBlock(t, bdir, &BlockMeta{
+			ULID:       id,
+			MinTime:    int64(i * 100),
+			MaxTime:    int64((i + 1) * 100),
+			Compaction: BlockMetaCompaction{Level: 1, Sources: []ulid.ULID{id}},
+		}).Close()
+		testutil.Ok(t, MarkBlockForDeletion(bdir, "test"))
+	}
+	db, err := Open(dir, nil, nil, &Options{
+		BlockRanges:            []int64{100},
+		BlockDeletionBatchSize: 2,
+		BlockDeletionRate:      1 << 30,
+	})
+	testutil.Ok(t, err)
+	defer db.Close()
+
+	// Opening the DB deletes the two oldest blocks.
+	dirs, err := blockDirs(dir)
+	testutil.Ok(t, err)
+	testutil.Equals(t, []string{filepath.Join(dir, ulid.MustNew(2, nil).String())}, dirs)
+	testutil.Equals(t, 0, len(db.Blocks()))
+
+	testutil.Ok(t, db.reload())
+
+	dirs, err = blockDirs(dir)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, len(dirs))
+}
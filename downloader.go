@@ -0,0 +1,600 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/tsdb/fileutil"
+	"github.com/prometheus/tsdb/index"
+)
+
+// DownloaderOptions configure a Downloader.
+type DownloaderOptions struct {
+	// MaxBytes is the size of downloaded blocks kept on local disk. The least
+	// recently queried blocks are evicted beyond it. Zero keeps all blocks.
+	MaxBytes int64
+
+	// RefreshInterval is the time after which the list of blocks in the
+	// bucket is refreshed by queries. Defaults to one minute.
+	RefreshInterval time.Duration
+
+	// LazyIndex downloads only a small header of each block's index, which
+	// holds its TOC, symbols and offset tables. All other parts of the index
+	// are range-read from the bucket on demand. This bounds the cost of the
+	// first query of a block at the expense of subsequent ones.
+	LazyIndex bool
+}
+
+const indexHeaderFilename = "index-header"
+
+// Downloader fetches blocks from a bucket on demand for queries whose time
+// range exceeds the data on local disk, e.g. of blocks a Shipper deleted
+// after their local retention. Downloaded blocks are cached in a local
+// directory, which must not be the directory of a database.
+type Downloader struct {
+	logger log.Logger
+	dir    string
+	bkt    Bucket
+	opts   DownloaderOptions
+	pool   chunkenc.Pool
+
+	// dmtx serializes downloads of blocks.
+	dmtx sync.Mutex
+	// pendingEvictions tracks evicted blocks that are not deleted yet.
+	pendingEvictions sync.WaitGroup
+
+	mtx sync.Mutex
+	// Metas of the blocks in the bucket sorted by time.
+	metas     []BlockMeta
+	refreshed time.Time
+	// Downloaded blocks in the order of their last use.
+	blocks map[ulid.ULID]*list.Element
+	lru    *list.List
+	size   int64
+
+	downloads prometheus.Counter
+	evictions prometheus.Counter
+	cacheSize prometheus.GaugeFunc
+}
+
+type downloadedBlock struct {
+	block *Block
+	size  int64
+}
+
+// NewDownloader returns a downloader for blocks in bkt that caches them in
+// dir. Blocks downloaded into dir before are reused.
+func NewDownloader(logger log.Logger, r prometheus.Registerer, dir string, bkt Bucket, opts *DownloaderOptions) (*Downloader, error) {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	if opts == nil {
+		opts = &DownloaderOptions{}
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	d := &Downloader{
+		logger: logger,
+		dir:    dir,
+		bkt:    bkt,
+		opts:   *opts,
+		pool:   chunkenc.NewPool(),
+		blocks: map[ulid.ULID]*list.Element{},
+		lru:    list.New(),
+		downloads: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "prometheus_tsdb_downloader_downloads_total",
+			Help: "Number of blocks downloaded from the bucket.",
+		}),
+		evictions: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "prometheus_tsdb_downloader_evictions_total",
+			Help: "Number of downloaded blocks evicted from local disk.",
+		}),
+	}
+	d.cacheSize = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "prometheus_tsdb_downloader_cache_size_bytes",
+		Help: "Size of the downloaded blocks on local disk.",
+	}, func() float64 {
+		d.mtx.Lock()
+		defer d.mtx.Unlock()
+		return float64(d.size)
+	})
+	if d.opts.RefreshInterval <= 0 {
+		d.opts.RefreshInterval = time.Minute
+	}
+	if err := d.loadCached(); err != nil {
+		return nil, errors.Wrap(err, "load downloaded blocks")
+	}
+	if r != nil {
+		r.MustRegister(d.downloads, d.evictions, d.cacheSize)
+	}
+	return d, nil
+}
+
+// loadCached opens the blocks downloaded before and removes incomplete
+// downloads.
+func (d *Downloader) loadCached() error {
+	files, err := ioutil.ReadDir(d.dir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range files {
+		fn := filepath.Join(d.dir, fi.Name())
+
+		if strings.HasSuffix(fi.Name(), ".tmp") {
+			if err := os.RemoveAll(fn); err != nil {
+				return err
+			}
+			continue
+		}
+		if !isBlockDir(fi) {
+			continue
+		}
+		b, err := d.openDownloaded(fn)
+		if err != nil {
+			level.Warn(d.logger).Log("msg", "removing unreadable downloaded block", "dir", fn, "err", err)
+			if err := os.RemoveAll(fn); err != nil {
+				return err
+			}
+			continue
+		}
+		size, err := dirSize(fn)
+		if err != nil {
+			b.Close()
+			return err
+		}
+		d.blocks[b.Meta().ULID] = d.lru.PushBack(&downloadedBlock{block: b, size: size})
+		d.size += size
+	}
+	return nil
+}
+
+// Querier returns a querier over the blocks in the bucket overlapping the
+// time range. Blocks in the bucket may overlap.
+func (d *Downloader) Querier(ctx context.Context, mint, maxt int64) (Querier, error) {
+	qs, err := d.queriers(ctx, mint, maxt, math.MaxInt64)
+	if err != nil {
+		return nil, err
+	}
+	return &querier{blocks: qs, overlapping: true}, nil
+}
+
+// queriers returns queriers for all blocks in the bucket that overlap the
+// time range, restricted to samples before the given timestamp. Blocks
+// straddling it are queried up to it only.
+func (d *Downloader) queriers(ctx context.Context, mint, maxt, before int64) ([]Querier, error) {
+	metas, err := d.refresh(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "list blocks in bucket")
+	}
+	if maxt >= before {
+		maxt = before - 1
+	}
+	var qs []Querier
+
+	for _, meta := range metas {
+		if meta.MinTime > maxt || meta.MaxTime <= mint {
+			continue
+		}
+		q, err := d.open(ctx, meta, mint, maxt)
+		if err != nil {
+			for _, q := range qs {
+				q.Close()
+			}
+			return nil, errors.Wrapf(err, "open downloaded block %s", meta.ULID)
+		}
+		qs = append(qs, q)
+	}
+	return qs, nil
+}
+
+// refresh returns the metas of the blocks in the bucket, listing them again
+// if the refresh interval passed.
+func (d *Downloader) refresh(ctx context.Context) ([]BlockMeta, error) {
+	d.mtx.Lock()
+	if time.Since(d.refreshed) < d.opts.RefreshInterval {
+		defer d.mtx.Unlock()
+		return d.metas, nil
+	}
+	d.mtx.Unlock()
+
+	var metas []BlockMeta
+
+	err := d.bkt.Iter(ctx, "", func(name string) error {
+		id, err := ulid.Parse(strings.TrimSuffix(name, "/"))
+		if err != nil || !strings.HasSuffix(name, "/") {
+			return nil
+		}
+		meta, err := d.readMeta(ctx, id)
+		if err != nil {
+			// The block may still be uploading.
+			level.Warn(d.logger).Log("msg", "reading meta of block in bucket failed", "ulid", id, "err", err)
+			return nil
+		}
+		metas = append(metas, *meta)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Blocks that were compacted into other blocks in the bucket hold the
+	// same data and are skipped.
+	compacted := map[ulid.ULID]struct{}{}
+	for _, m := range metas {
+		for _, id := range m.Compaction.Sources {
+			if id != m.ULID {
+				compacted[id] = struct{}{}
+			}
+		}
+	}
+	res := metas[:0]
+	for _, m := range metas {
+		if _, ok := compacted[m.ULID]; !ok {
+			res = append(res, m)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].MinTime < res[j].MinTime })
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	d.metas, d.refreshed = res, time.Now()
+	return res, nil
+}
+
+func (d *Downloader) readMeta(ctx context.Context, id ulid.ULID) (*BlockMeta, error) {
+	r, err := d.bkt.Get(ctx, path.Join(id.String(), metaFilename))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var m BlockMeta
+
+	if err := json.NewDecoder(r).Decode(&m); err != nil {
+		return nil, err
+	}
+	if m.Version != 1 {
+		return nil, errors.Errorf("unexpected meta file version %d", m.Version)
+	}
+	return &m, nil
+}
+
+// Downloaded blocks may be evicted by concurrent downloads before they are
+// opened. open downloads them again up to downloadAttempts times, waiting
+// increasingly longer in between.
+const (
+	downloadAttempts = 3
+	downloadBackoff  = 100 * time.Millisecond
+)
+
+// open returns a querier for the block, downloading it first if necessary.
+func (d *Downloader) open(ctx context.Context, meta BlockMeta, mint, maxt int64) (Querier, error) {
+	backoff := downloadBackoff
+
+	for attempt := 0; ; attempt++ {
+		d.mtx.Lock()
+		if e, ok := d.blocks[meta.ULID]; ok {
+			d.lru.MoveToFront(e)
+
+			// The querier holds the block open even if it is evicted afterwards.
+			q, err := d.blockQuerier(ctx, e.Value.(*downloadedBlock).block, mint, maxt)
+			d.mtx.Unlock()
+			return q, err
+		}
+		d.mtx.Unlock()
+
+		if attempt == downloadAttempts {
+			return nil, errors.Errorf("block evicted before it was opened after %d downloads", attempt)
+		}
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+		if err := d.download(ctx, meta.ULID); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// blockQuerier returns a querier for the downloaded block. Ranges of its index
+// that are read from the bucket are read with ctx.
+func (d *Downloader) blockQuerier(ctx context.Context, b *Block, mint, maxt int64) (*blockQuerier, error) {
+	cb := contextBlock{
+		Block: b,
+		ra: &bucketReaderAt{
+			ctx:  ctx,
+			bkt:  d.bkt,
+			name: path.Join(filepath.Base(b.Dir()), indexFilename),
+		},
+	}
+	q, err := newBlockQuerier(cb, mint, maxt, nil)
+	if err != nil {
+		return nil, err
+	}
+	q.labelRanges = b.Meta().LabelRanges
+	return q, nil
+}
+
+// contextBlock is a downloaded block whose index is read from the bucket with
+// the context of a single query, so that cancelling the query cancels reads.
+type contextBlock struct {
+	*Block
+	ra io.ReaderAt
+}
+
+func (b contextBlock) Index() (IndexReader, error) {
+	ir, err := b.Block.Index()
+	if err != nil {
+		return nil, err
+	}
+	bir := ir.(blockIndexReader)
+	if r, ok := bir.ir.(*index.Reader); ok {
+		bir.ir = r.WithReaderAt(b.ra)
+	}
+	return bir, nil
+}
+
+// download fetches the block from the bucket and adds it to the cache.
+func (d *Downloader) download(ctx context.Context, id ulid.ULID) error {
+	d.dmtx.Lock()
+	defer d.dmtx.Unlock()
+
+	// Another query may have downloaded the block in the meantime.
+	d.mtx.Lock()
+	_, ok := d.blocks[id]
+	d.mtx.Unlock()
+	if ok {
+		return nil
+	}
+	dir := filepath.Join(d.dir, id.String())
+	tmp := dir + ".tmp"
+
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
+	}
+	if err := d.downloadBlock(ctx, id, tmp); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	if err := fileutil.Rename(tmp, dir); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	size, err := dirSize(dir)
+	if err != nil {
+		return err
+	}
+	b, err := d.openDownloaded(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	d.downloads.Inc()
+	level.Info(d.logger).Log("msg", "downloaded block", "ulid", id, "bytes", size)
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	d.blocks[id] = d.lru.PushFront(&downloadedBlock{block: b, size: size})
+	d.size += size
+
+	d.evict()
+	return nil
+}
+
+// evict removes the least recently used blocks beyond the maximum size but
+// always keeps the most recent one. It must be called with mtx held.
+func (d *Downloader) evict() {
+	if d.opts.MaxBytes <= 0 {
+		return
+	}
+	for d.size > d.opts.MaxBytes && d.lru.Len() > 1 {
+		e := d.lru.Remove(d.lru.Back()).(*downloadedBlock)
+		delete(d.blocks, e.block.Meta().ULID)
+		d.size -= e.size
+		d.evictions.Inc()
+
+		// Closing waits for pending queriers of the block to finish.
+		d.pendingEvictions.Add(1)
+		go func(b *Block) {
+			defer d.pendingEvictions.Done()
+
+			if err := b.Close(); err != nil {
+				level.Warn(d.logger).Log("msg", "closing evicted block failed", "ulid", b.Meta().ULID, "err", err)
+			}
+			if err := os.RemoveAll(b.Dir()); err != nil {
+				level.Warn(d.logger).Log("msg", "deleting evicted block failed", "ulid", b.Meta().ULID, "err", err)
+			}
+		}(e.block)
+	}
+}
+
+// downloadBlock fetches the block into the local directory. With a lazy
+// index, only a header of the index is built from range reads.
+func (d *Downloader) downloadBlock(ctx context.Context, id ulid.ULID, dst string) error {
+	indexName := path.Join(id.String(), indexFilename)
+
+	skip := ""
+	if d.opts.LazyIndex {
+		skip = indexName
+	}
+	if err := d.downloadDir(ctx, id.String()+"/", dst, skip); err != nil {
+		return err
+	}
+	if !d.opts.LazyIndex {
+		return nil
+	}
+	// The indices of sharded blocks are downloaded in full.
+	if _, err := os.Stat(filepath.Join(dst, shardsDirname)); err == nil {
+		return nil
+	}
+	size, err := d.bkt.ObjectSize(ctx, indexName)
+	if err != nil {
+		return errors.Wrap(err, "get index size")
+	}
+	hdr, err := index.BuildHeader(&bucketReaderAt{ctx: ctx, bkt: d.bkt, name: indexName}, size)
+	if err != nil {
+		return errors.Wrap(err, "build index header")
+	}
+	return ioutil.WriteFile(filepath.Join(dst, indexHeaderFilename), hdr, 0666)
+}
+
+// downloadDir fetches all objects below the bucket directory except skip into
+// the local directory.
+func (d *Downloader) downloadDir(ctx context.Context, src, dst, skip string) error {
+	if err := os.MkdirAll(dst, 0777); err != nil {
+		return err
+	}
+	return d.bkt.Iter(ctx, src, func(name string) error {
+		fn := filepath.Join(dst, path.Base(name))
+
+		switch {
+		case name == skip:
+			return nil
+		case strings.HasSuffix(name, "/"):
+			return d.downloadDir(ctx, name, fn, skip)
+		}
+		return d.downloadFile(ctx, name, fn)
+	})
+}
+
+func (d *Downloader) downloadFile(ctx context.Context, name, fn string) error {
+	r, err := d.bkt.Get(ctx, name)
+	if err != nil {
+		return errors.Wrapf(err, "get %s", name)
+	}
+	defer r.Close()
+
+	f, err := os.Create(fn)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return errors.Wrapf(err, "copy %s", name)
+	}
+	return f.Close()
+}
+
+// openDownloaded opens the downloaded block in dir. If the block only holds
+// a header of its index, the index is range-read from the bucket.
+func (d *Downloader) openDownloaded(dir string) (*Block, error) {
+	hdr, err := ioutil.ReadFile(filepath.Join(dir, indexHeaderFilename))
+	if os.IsNotExist(err) {
+		return openBlock(dir, d.pool, false)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Queriers read from the bucket with their own context. This reader is
+	// only used to open the index, which is served from the header.
+	r := &bucketReaderAt{
+		ctx:  context.Background(),
+		bkt:  d.bkt,
+		name: path.Join(filepath.Base(dir), indexFilename),
+	}
+	// Separately stored postings are downloaded in full.
+	var postings fileutil.ReadableFile
+
+	pfn := index.PostingsFilename(filepath.Join(dir, indexFilename))
+	if _, err := os.Stat(pfn); err == nil {
+		if postings, err = fileutil.OpenReadableFile(pfn, false); err != nil {
+			return nil, errors.Wrap(err, "open postings file")
+		}
+	}
+	ir, err := index.NewHeaderReader(hdr, r, postings)
+	if err != nil {
+		if postings != nil {
+			postings.Close()
+		}
+		return nil, errors.Wrap(err, "open index header")
+	}
+	return openBlockWithIndex(dir, d.pool, false, ir)
+}
+
+// bucketReaderAt reads ranges of an object in a bucket.
+type bucketReaderAt struct {
+	ctx  context.Context
+	bkt  Bucket
+	name string
+}
+
+func (r *bucketReaderAt) ReadAt(b []byte, off int64) (int, error) {
+	rc, err := r.bkt.GetRange(r.ctx, r.name, off, int64(len(b)))
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+
+	return io.ReadFull(rc, b)
+}
+
+// Close closes all downloaded blocks. They remain on disk for reuse. It waits
+// for the queriers of evicted blocks to be closed.
+func (d *Downloader) Close() error {
+	d.pendingEvictions.Wait()
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	var merr MultiError
+
+	for e := d.lru.Front(); e != nil; e = e.Next() {
+		merr.Add(e.Value.(*downloadedBlock).block.Close())
+	}
+	d.blocks = map[ulid.ULID]*list.Element{}
+	d.lru.Init()
+	d.size = 0
+
+	return merr.Err()
+}
+
+func dirSize(dir string) (int64, error) {
+	var size int64
+
+	err := filepath.Walk(dir, func(_ string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			size += fi.Size()
+		}
+		return nil
+	})
+	return size, err
+}
@@ -0,0 +1,177 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/tsdb/labels"
+	"github.com/prometheus/tsdb/testutil"
+)
+
+func TestDownloader(t *testing.T) {
+	bdir, err := ioutil.TempDir("", "bucket")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(bdir)
+
+	cdir, err := ioutil.TempDir("", "cache")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(cdir)
+
+	// Blocks are laid out in a bucket as they are on disk.
+	for i := 0; i < 2; i++ {
+		testutil.Ok(t, createPopulatedBlock(t, bdir, 2, 5).Close())
+	}
+	d, err := NewDownloader(nil, nil, cdir, NewDirBucket(bdir), &DownloaderOptions{MaxBytes: 1})
+	testutil.Ok(t, err)
+
+	q, err := d.Querier(context.Background(), 0, 10000)
+	testutil.Ok(t, err)
+	res := query(t, q, labels.NewMustRegexpMatcher("__name__", ".+"))
+	testutil.Ok(t, q.Close())
+
+	// The overlapping blocks are merged.
+	testutil.Equals(t, 2, len(res))
+	for _, smpls := range res {
+		testutil.Equals(t, 5, len(smpls))
+	}
+	// Only the most recently used block is kept beyond the maximum size.
+	testutil.Equals(t, 1, len(d.blocks))
+	testutil.Ok(t, d.Close())
+
+	// Downloaded blocks are reused after a restart.
+	d, err = NewDownloader(nil, nil, cdir, NewDirBucket(bdir), nil)
+	testutil.Ok(t, err)
+	defer d.Close()
+	testutil.Equals(t, 1, len(d.blocks))
+
+	dir, err := ioutil.TempDir("", "test")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := Open(filepath.Join(dir, "db"), nil, nil, &Options{Downloader: d})
+	testutil.Ok(t, err)
+	defer db.Close()
+
+	// Queries before the local data are answered from the bucket.
+	q, err = db.Querier(0, 10000)
+	testutil.Ok(t, err)
+	testutil.Equals(t, res, query(t, q, labels.NewMustRegexpMatcher("__name__", ".+")))
+	testutil.Ok(t, q.Close())
+	testutil.Equals(t, 2, len(d.blocks))
+}
+
+func TestDownloader_StraddlingBlock(t *testing.T) {
+	bdir, err := ioutil.TempDir("", "bucket")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(bdir)
+
+	cdir, err := ioutil.TempDir("", "cache")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(cdir)
+
+	// The block in the bucket holds samples at 0, 1000, ..., 4000.
+	testutil.Ok(t, createPopulatedBlock(t, bdir, 1, 5).Close())
+
+	d, err := NewDownloader(nil, nil, cdir, NewDirBucket(bdir), nil)
+	testutil.Ok(t, err)
+	defer d.Close()
+
+	q, err := d.Querier(context.Background(), 0, 10000)
+	testutil.Ok(t, err)
+	ss, err := q.Select(labels.NewMustRegexpMatcher("__name__", ".+"))
+	testutil.Ok(t, err)
+	testutil.Assert(t, ss.Next(), "no series in bucket")
+	lset := ss.At().Labels()
+	testutil.Ok(t, ss.Err())
+
+	remote := query(t, q, labels.NewMustRegexpMatcher("__name__", ".+"))
+	testutil.Ok(t, q.Close())
+
+	dir, err := ioutil.TempDir("", "test")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := Open(filepath.Join(dir, "db"), nil, nil, &Options{Downloader: d})
+	testutil.Ok(t, err)
+	defer db.Close()
+
+	// The local data starts within the time range of the block.
+	app := db.Appender()
+	_, err = app.Add(lset, 2000, -1)
+	testutil.Ok(t, err)
+	testutil.Ok(t, app.Commit())
+
+	// Samples of the block before the local data are still returned and
+	// those after it are not merged with the local ones.
+	smpls := remote[lset.String()]
+	exp := map[string][]sample{
+		lset.String(): {smpls[0], smpls[1], {t: 2000, v: -1}},
+	}
+	q, err = db.Querier(0, 10000)
+	testutil.Ok(t, err)
+	testutil.Equals(t, exp, query(t, q, labels.NewMustRegexpMatcher("__name__", ".+")))
+	testutil.Ok(t, q.Close())
+}
+
+func TestDownloader_LazyIndex(t *testing.T) {
+	bdir, err := ioutil.TempDir("", "bucket")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(bdir)
+
+	b := createPopulatedBlock(t, bdir, 10, 5)
+	testutil.Ok(t, b.Close())
+	id := b.Meta().ULID
+
+	var res [2]map[string][]sample
+
+	for i, lazy := range []bool{false, true} {
+		cdir, err := ioutil.TempDir("", "cache")
+		testutil.Ok(t, err)
+		defer os.RemoveAll(cdir)
+
+		d, err := NewDownloader(nil, nil, cdir, NewDirBucket(bdir), &DownloaderOptions{LazyIndex: lazy})
+		testutil.Ok(t, err)
+
+		q, err := d.Querier(context.Background(), 0, 10000)
+		testutil.Ok(t, err)
+		res[i] = query(t, q, labels.NewMustRegexpMatcher("__name__", ".+"))
+		testutil.Ok(t, q.Close())
+
+		if lazy {
+			// Cancelling a query cancels its reads from the bucket.
+			ctx, cancel := context.WithCancel(context.Background())
+			q, err := d.Querier(ctx, 0, 10000)
+			testutil.Ok(t, err)
+			cancel()
+
+			_, err = q.Select(labels.NewMustRegexpMatcher("__name__", ".+"))
+			testutil.Equals(t, context.Canceled, errors.Cause(err))
+			testutil.Ok(t, q.Close())
+		}
+		testutil.Ok(t, d.Close())
+
+		_, err = os.Stat(filepath.Join(cdir, id.String(), indexFilename))
+		testutil.Equals(t, lazy, os.IsNotExist(err))
+		_, err = os.Stat(filepath.Join(cdir, id.String(), indexHeaderFilename))
+		testutil.Equals(t, !lazy, os.IsNotExist(err))
+	}
+	testutil.Equals(t, 10, len(res[0]))
+	testutil.Equals(t, res[0], res[1])
+}
@@ -92,7 +92,7 @@ func (d *decbuf) uvarintStr() string {
 	if d.e != nil {
 		return ""
 	}
-	if len(d.b) < int(l) {
+	if uint64(len(d.b)) < l {
 		d.e = errInvalidSize
 		return ""
 	}
@@ -101,6 +101,21 @@ func (d *decbuf) uvarintStr() string {
 	return s
 }
 
+// uvarintLen reads the number of entries of a list that each take at least
+// minSize bytes. It fails if the remaining bytes cannot hold that many entries,
+// so the result is safe for sizing allocations.
+func (d *decbuf) uvarintLen(minSize int) int {
+	l := d.uvarint64()
+	if d.e != nil {
+		return 0
+	}
+	if l > uint64(len(d.b)/minSize) {
+		d.e = errInvalidSize
+		return 0
+	}
+	return int(l)
+}
+
 func (d *decbuf) varint64() int64 {
 	if d.e != nil {
 		return 0
@@ -131,7 +146,7 @@ func (d *decbuf) be64() uint64 {
 	if d.e != nil {
 		return 0
 	}
-	if len(d.b) < 4 {
+	if len(d.b) < 8 {
 		d.e = errInvalidSize
 		return 0
 	}
@@ -170,7 +185,7 @@ func (d *decbuf) decbuf(l int) decbuf {
 	if d.e != nil {
 		return decbuf{e: d.e}
 	}
-	if l > len(d.b) {
+	if l < 0 || l > len(d.b) {
 		return decbuf{e: errInvalidSize}
 	}
 	r := decbuf{b: d.b[:l]}
@@ -0,0 +1,183 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"sort"
+
+	"github.com/prometheus/tsdb/labels"
+)
+
+// NewExternalLabelsQuerier returns a querier adding the external labels lset
+// to every series returned by q. External labels take precedence over stored
+// labels of the same name.
+//
+// Matchers on external label names are evaluated against the external value
+// and stripped before the remaining matchers are passed to q. If one of them
+// does not match, no series are selected.
+//
+// Series sets remain ordered by the stored labels, which may differ from the
+// order of the returned label sets.
+func NewExternalLabelsQuerier(q Querier, lset labels.Labels) Querier {
+	if len(lset) == 0 {
+		return q
+	}
+	return &externalLabelsQuerier{Querier: q, lset: lset}
+}
+
+type externalLabelsQuerier struct {
+	Querier
+	lset labels.Labels
+}
+
+// strip removes matchers on external labels from ms. It returns false if one
+// of them does not match the external value. If only matchers on external
+// labels were given, all series are selected.
+func (q *externalLabelsQuerier) strip(ms []labels.Matcher) ([]labels.Matcher, bool) {
+	res := make([]labels.Matcher, 0, len(ms))
+
+	for _, m := range ms {
+		v, ok := q.external(m.Name())
+		if !ok {
+			res = append(res, m)
+			continue
+		}
+		if !m.Matches(v) {
+			return nil, false
+		}
+	}
+	if len(res) == 0 && len(ms) > 0 {
+		res = append(res, matchAll)
+	}
+	return res, true
+}
+
+var matchAll = labels.NewMustRegexpMatcher("", ".*")
+
+func (q *externalLabelsQuerier) external(name string) (string, bool) {
+	for _, l := range q.lset {
+		if l.Name == name {
+			return l.Value, true
+		}
+	}
+	return "", false
+}
+
+func (q *externalLabelsQuerier) Select(ms ...labels.Matcher) (SeriesSet, error) {
+	return q.SelectWithHints(nil, ms...)
+}
+
+func (q *externalLabelsQuerier) SelectWithHints(hints *SelectHints, ms ...labels.Matcher) (SeriesSet, error) {
+	ms, ok := q.strip(ms)
+	if !ok {
+		return EmptySeriesSet(), nil
+	}
+	ss, err := q.Querier.SelectWithHints(hints, ms...)
+	if err != nil {
+		return nil, err
+	}
+	return &externalLabelsSeriesSet{SeriesSet: ss, lset: q.lset}, nil
+}
+
+func (q *externalLabelsQuerier) LabelValues(name string) ([]string, error) {
+	if v, ok := q.external(name); ok {
+		return []string{v}, nil
+	}
+	return q.Querier.LabelValues(name)
+}
+
+func (q *externalLabelsQuerier) LabelValuesFor(name string, ms ...labels.Matcher) ([]string, error) {
+	ms, ok := q.strip(ms)
+	if !ok {
+		return nil, nil
+	}
+	v, ok := q.external(name)
+	if !ok {
+		return q.Querier.LabelValuesFor(name, ms...)
+	}
+	if exists, err := q.exists(ms); err != nil || !exists {
+		return nil, err
+	}
+	return []string{v}, nil
+}
+
+func (q *externalLabelsQuerier) LabelNamesFor(ms ...labels.Matcher) ([]string, error) {
+	ms, ok := q.strip(ms)
+	if !ok {
+		return nil, nil
+	}
+	names, err := q.Querier.LabelNamesFor(ms...)
+	if err != nil || len(names) == 0 {
+		return names, err
+	}
+	ext := make([]string, 0, len(q.lset))
+	for _, l := range q.lset {
+		ext = append(ext, l.Name)
+	}
+	return mergeStrings(names, ext), nil
+}
+
+func (q *externalLabelsQuerier) Count(ms ...labels.Matcher) (int, int64, error) {
+	ms, ok := q.strip(ms)
+	if !ok {
+		return 0, 0, nil
+	}
+	return q.Querier.Count(ms...)
+}
+
+func (q *externalLabelsQuerier) Exists(ms ...labels.Matcher) (bool, error) {
+	ms, ok := q.strip(ms)
+	if !ok {
+		return false, nil
+	}
+	return q.exists(ms)
+}
+
+// exists is like Exists for already stripped matchers. Without any matchers
+// left, all series are considered.
+func (q *externalLabelsQuerier) exists(ms []labels.Matcher) (bool, error) {
+	if len(ms) == 0 {
+		ms = []labels.Matcher{matchAll}
+	}
+	return q.Querier.Exists(ms...)
+}
+
+type externalLabelsSeriesSet struct {
+	SeriesSet
+	lset labels.Labels
+}
+
+func (s *externalLabelsSeriesSet) At() Series {
+	return &externalLabelsSeries{Series: s.SeriesSet.At(), lset: s.lset}
+}
+
+type externalLabelsSeries struct {
+	Series
+	lset labels.Labels
+}
+
+func (s *externalLabelsSeries) Labels() labels.Labels {
+	stored := s.Series.Labels()
+	res := make(labels.Labels, 0, len(stored)+len(s.lset))
+
+	for _, l := range stored {
+		if s.lset.Get(l.Name) == "" {
+			res = append(res, l)
+		}
+	}
+	res = append(res, s.lset...)
+	sort.Sort(res)
+
+	return res
+}
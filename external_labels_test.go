@@ -0,0 +1,103 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"testing"
+
+	"github.com/prometheus/tsdb/labels"
+	"github.com/prometheus/tsdb/testutil"
+)
+
+func TestExternalLabelsQuerier(t *testing.T) {
+	opts := *DefaultOptions
+	opts.ExternalLabels = labels.FromStrings("cluster", "a", "replica", "1")
+	opts.QueryExternalLabels = true
+
+	db, close := openTestDB(t, &opts)
+	defer close()
+	defer db.Close()
+
+	app := db.Appender()
+	_, err := app.Add(labels.FromStrings("job", "x"), 0, 1)
+	testutil.Ok(t, err)
+	// External labels override stored labels of the same name.
+	_, err = app.Add(labels.FromStrings("job", "y", "replica", "2"), 0, 2)
+	testutil.Ok(t, err)
+	testutil.Ok(t, app.Commit())
+
+	q, err := db.Querier(0, 10)
+	testutil.Ok(t, err)
+	defer q.Close()
+
+	cases := []struct {
+		ms  []labels.Matcher
+		exp map[string][]sample
+	}{
+		{
+			ms: []labels.Matcher{labels.NewEqualMatcher("job", "x")},
+			exp: map[string][]sample{
+				`{cluster="a",job="x",replica="1"}`: {{0, 1}},
+			},
+		},
+		{
+			ms: []labels.Matcher{labels.NewEqualMatcher("cluster", "a")},
+			exp: map[string][]sample{
+				`{cluster="a",job="x",replica="1"}`: {{0, 1}},
+				`{cluster="a",job="y",replica="1"}`: {{0, 2}},
+			},
+		},
+		{
+			ms: []labels.Matcher{labels.NewEqualMatcher("replica", "1"), labels.NewEqualMatcher("job", "y")},
+			exp: map[string][]sample{
+				`{cluster="a",job="y",replica="1"}`: {{0, 2}},
+			},
+		},
+		{
+			ms:  []labels.Matcher{labels.NewEqualMatcher("replica", "2")},
+			exp: map[string][]sample{},
+		},
+		{
+			ms:  []labels.Matcher{labels.NewEqualMatcher("cluster", "b"), labels.NewEqualMatcher("job", "x")},
+			exp: map[string][]sample{},
+		},
+	}
+	for _, c := range cases {
+		testutil.Equals(t, c.exp, query(t, q, c.ms...))
+
+		n, _, err := q.Count(c.ms...)
+		testutil.Ok(t, err)
+		testutil.Equals(t, len(c.exp), n)
+	}
+
+	vals, err := q.LabelValues("cluster")
+	testutil.Ok(t, err)
+	testutil.Equals(t, []string{"a"}, vals)
+
+	vals, err = q.LabelValuesFor("replica", labels.NewEqualMatcher("job", "x"))
+	testutil.Ok(t, err)
+	testutil.Equals(t, []string{"1"}, vals)
+
+	vals, err = q.LabelValuesFor("job", labels.NewEqualMatcher("cluster", "a"))
+	testutil.Ok(t, err)
+	testutil.Equals(t, []string{"x", "y"}, vals)
+
+	names, err := q.LabelNamesFor(labels.NewEqualMatcher("job", "x"))
+	testutil.Ok(t, err)
+	testutil.Equals(t, []string{"cluster", "job", "replica"}, names)
+
+	ok, err := q.Exists(labels.NewEqualMatcher("cluster", "b"))
+	testutil.Ok(t, err)
+	testutil.Assert(t, !ok, "series exist for non-matching external label")
+}
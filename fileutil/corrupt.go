@@ -0,0 +1,65 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fileutil
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// ErrCorrupt is returned if data read from a file is damaged, e.g. because of
+// a checksum mismatch or an invalid length. It is usually wrapped with further
+// context; use IsCorrupt to check for it.
+type ErrCorrupt struct {
+	// File is the path of the damaged file. It is empty if the data was not
+	// read from a file.
+	File string
+	// Offset is the position of the damaged data within the file. It is
+	// negative if unknown.
+	Offset int64
+	// Reason describes the damage.
+	Reason string
+}
+
+// NewErrCorrupt returns an ErrCorrupt for damaged data at offset off of r. The
+// file is set if r has a Name method, like the files of OpenReadableFile.
+func NewErrCorrupt(r interface{}, off int, format string, args ...interface{}) *ErrCorrupt {
+	e := &ErrCorrupt{
+		Offset: int64(off),
+		Reason: fmt.Sprintf(format, args...),
+	}
+	if f, ok := r.(interface{ Name() string }); ok {
+		e.File = f.Name()
+	}
+	return e
+}
+
+func (e *ErrCorrupt) Error() string {
+	switch {
+	case e.File == "" && e.Offset < 0:
+		return fmt.Sprintf("corrupted data: %s", e.Reason)
+	case e.File == "":
+		return fmt.Sprintf("corrupted data at offset %d: %s", e.Offset, e.Reason)
+	case e.Offset < 0:
+		return fmt.Sprintf("corrupted file %s: %s", e.File, e.Reason)
+	}
+	return fmt.Sprintf("corrupted file %s at offset %d: %s", e.File, e.Offset, e.Reason)
+}
+
+// IsCorrupt returns whether err was caused by an ErrCorrupt.
+func IsCorrupt(err error) bool {
+	_, ok := errors.Cause(err).(*ErrCorrupt)
+	return ok
+}
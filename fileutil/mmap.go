@@ -43,6 +43,21 @@ func (f *MmapFile) File() *os.File {
 	return f.f
 }
 
+// Name returns the path the file was opened with.
+func (f *MmapFile) Name() string {
+	return f.f.Name()
+}
+
 func (f *MmapFile) Bytes() []byte {
 	return f.b
 }
+
+// Len returns the size of the mapped file.
+func (f *MmapFile) Len() int {
+	return len(f.b)
+}
+
+// Range returns the mapped bytes in [start, end).
+func (f *MmapFile) Range(start, end int) []byte {
+	return f.b[start:end]
+}
@@ -0,0 +1,123 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fileutil
+
+import (
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// ReadableFile provides random access to the contents of a file.
+type ReadableFile interface {
+	// Len returns the size of the file.
+	Len() int
+	// Range returns the bytes of the file in [start, end). Files read with
+	// pread implement RangeReader to report failed reads.
+	Range(start, end int) []byte
+	// Name returns the path the file was opened with.
+	Name() string
+
+	io.Closer
+}
+
+// RangeReader is implemented by byte slices whose ranges are read from a file
+// or a remote store on access and may thus fail to be read.
+type RangeReader interface {
+	// ReadRange returns the bytes in [start, end) or the error reading them.
+	ReadRange(start, end int) ([]byte, error)
+}
+
+// ReadRange returns the bytes of b in [start, end). If b implements RangeReader,
+// errors reading the range are returned instead of the bytes Range would return.
+func ReadRange(b interface{ Range(start, end int) []byte }, start, end int) ([]byte, error) {
+	if rr, ok := b.(RangeReader); ok {
+		return rr.ReadRange(start, end)
+	}
+	return b.Range(start, end), nil
+}
+
+// OpenReadableFile opens the file at path for random access. The file is mapped
+// into memory unless pread is set or mapping it fails, in which case ranges are
+// read with pread instead.
+func OpenReadableFile(path string, pread bool) (ReadableFile, error) {
+	if !pread {
+		if f, err := OpenMmapFile(path); err == nil {
+			return f, nil
+		}
+	}
+	return OpenPreadFile(path)
+}
+
+// PreadFile reads ranges of a file with pread. It is an alternative to MmapFile
+// for filesystems on which memory mapping behaves badly, such as NFS or CIFS.
+type PreadFile struct {
+	f    *os.File
+	size int
+}
+
+// OpenPreadFile opens the file at path for reading ranges with pread.
+func OpenPreadFile(path string) (*PreadFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "open file")
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, errors.Wrap(err, "stat")
+	}
+	return &PreadFile{f: f, size: int(info.Size())}, nil
+}
+
+// Len returns the size of the file.
+func (f *PreadFile) Len() int {
+	return f.size
+}
+
+// Range reads the bytes in [start, end) into a new slice. It returns nil if
+// the read fails. Use ReadRange to retrieve the error.
+func (f *PreadFile) Range(start, end int) []byte {
+	b, err := f.ReadRange(start, end)
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+// ReadRange reads the bytes in [start, end) into a new slice. Reads ending
+// beyond the end of the file fail with io.ErrUnexpectedEOF.
+func (f *PreadFile) ReadRange(start, end int) ([]byte, error) {
+	b := make([]byte, end-start)
+
+	n, err := f.f.ReadAt(b, int64(start))
+	if n == len(b) {
+		return b, nil
+	}
+	if err == nil || err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return nil, err
+}
+
+// Name returns the path the file was opened with.
+func (f *PreadFile) Name() string {
+	return f.f.Name()
+}
+
+// Close closes the underlying file.
+func (f *PreadFile) Close() error {
+	return f.f.Close()
+}
@@ -0,0 +1,52 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fileutil
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/tsdb/testutil"
+)
+
+func TestPreadFile(t *testing.T) {
+	dir := testutil.NewTemporaryDirectory("test_pread", t)
+	defer dir.Close()
+
+	fn := filepath.Join(dir.Path(), "file")
+	testutil.Ok(t, ioutil.WriteFile(fn, []byte("0123456789"), 0666))
+
+	f, err := OpenPreadFile(fn)
+	testutil.Ok(t, err)
+	defer f.Close()
+
+	testutil.Equals(t, 10, f.Len())
+	testutil.Equals(t, []byte("2345"), f.Range(2, 6))
+
+	b, err := ReadRange(f, 6, 10)
+	testutil.Ok(t, err)
+	testutil.Equals(t, []byte("6789"), b)
+
+	// Reads of a file truncated after opening it fail rather than returning zeros.
+	testutil.Ok(t, os.Truncate(fn, 4))
+
+	_, err = ReadRange(f, 2, 6)
+	testutil.Equals(t, io.ErrUnexpectedEOF, err)
+	_, err = ReadRange(f, 6, 10)
+	testutil.Equals(t, io.ErrUnexpectedEOF, err)
+	testutil.Assert(t, f.Range(2, 6) == nil, "failed read returned data")
+}
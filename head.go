@@ -29,13 +29,25 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/tsdb/chunkenc"
 	"github.com/prometheus/tsdb/chunks"
+	"github.com/prometheus/tsdb/fileutil"
 	"github.com/prometheus/tsdb/index"
 	"github.com/prometheus/tsdb/labels"
 	"github.com/prometheus/tsdb/wal"
 )
 
+// ErrCorrupt is returned if data of a block is damaged. Unlike ErrNotFound, it
+// indicates that the data exists but cannot be read. Errors are usually wrapped
+// with further context; use IsCorrupt to check for it.
+type ErrCorrupt = fileutil.ErrCorrupt
+
+// IsCorrupt returns whether err was caused by damaged data.
+func IsCorrupt(err error) bool {
+	return fileutil.IsCorrupt(err)
+}
+
 var (
-	// ErrNotFound is returned if a looked up resource was not found.
+	// ErrNotFound is returned if a looked up resource was not found. It is
+	// never returned for data that exists but is damaged.
 	ErrNotFound = errors.Errorf("not found")
 
 	// ErrOutOfOrderSample is returned if an appended sample has a
@@ -43,14 +55,45 @@ var (
 	ErrOutOfOrderSample = errors.New("out of order sample")
 
 	// ErrAmendSample is returned if an appended sample has the same timestamp
-	// as the most recent sample but a different value.
+	// as the most recent sample but a different value. This usually indicates
+	// several writers for the same series. Exact duplicates are dropped instead.
 	ErrAmendSample = errors.New("amending sample")
 
 	// ErrOutOfBounds is returned if an appended sample is out of the
 	// writable time range.
 	ErrOutOfBounds = errors.New("out of bounds")
+
+	// ErrTooFarInFuture is returned if an appended sample is further ahead of
+	// the current time than the configured tolerance.
+	ErrTooFarInFuture = errors.New("too far in the future")
+
+	// ErrCreatedAfterSample is returned if the created timestamp of a
+	// counter is not before the timestamp of the sample it is passed with.
+	ErrCreatedAfterSample = errors.New("created timestamp not before sample")
+
+	// ErrNotInteger is returned if a float value appended to a series storing
+	// integers is not a whole number within the range of int64. This includes
+	// NaN, infinities and staleness markers.
+	ErrNotInteger = errors.New("value not an integer")
 )
 
+// staleNaN is the bit pattern of the NaN value Prometheus appends as a
+// staleness marker.
+const staleNaN uint64 = 0x7ff0000000000002
+
+// intValue returns v as an integer for series storing integers.
+func intValue(v float64) (int64, error) {
+	iv, ok := chunkenc.IntValue(v)
+	if ok {
+		return iv, nil
+	}
+	// Integer chunks cannot mark series as stale.
+	if math.Float64bits(v) == staleNaN {
+		return 0, errors.Wrap(ErrNotInteger, "staleness marker")
+	}
+	return 0, errors.Wrapf(ErrNotInteger, "value %v", v)
+}
+
 // Head handles reads and writes of time series data within a time window.
 type Head struct {
 	chunkRange int64
@@ -63,8 +106,13 @@ type Head struct {
 	minTime, maxTime int64
 	lastSeriesID     uint64
 
+	// All samples before flushedTime were flushed into blocks by the DB.
+	flushedTime int64
+
 	// All series addressable by their ID or hash.
 	series *stripeSeries
+	// Series recently removed by garbage collections.
+	retired *retiredSeries
 
 	symMtx  sync.RWMutex
 	symbols map[string]struct{}
@@ -73,7 +121,55 @@ type Head struct {
 	postings *index.MemPostings // postings lists for terms
 
 	tombstones *memTombstones
-}
+
+	// walRepaired is set if the WAL had to be repaired during Init.
+	walRepaired bool
+
+	observer   AppendObserver
+	admission  AdmissionFunc
+	validation *LabelValidation
+
+	// chunkPrecision, if set, selects the series whose values are rounded.
+	chunkPrecision func(labels.Labels) (int, bool)
+	// autoChunkEncoding enables the selection of chunk encodings by the
+	// samples of each chunk for series that are not rounded.
+	autoChunkEncoding bool
+	// integerSeries, if set, selects the series storing integer values.
+	integerSeries func(labels.Labels) bool
+
+	// Samples more than futureTolerance ahead of the current time are
+	// rejected. Zero accepts samples at any time in the future.
+	futureTolerance int64
+	timestampUnit   TimestampUnit
+
+	// snapshotOnShutdown makes Close write a snapshot of the head, which
+	// Init loads instead of replaying the WAL.
+	snapshotOnShutdown bool
+
+	commitHook CommitHook
+}
+
+// AppendObserver is notified about appends to the head. It allows embedders to
+// feed their own telemetry without depending on the Prometheus client library.
+// The methods are called synchronously on the append path and must not block.
+type AppendObserver interface {
+	// OnAppend is called for every sample accepted by an appender, regardless
+	// of whether it is committed or rolled back later on.
+	OnAppend(ref uint64, t int64, v float64)
+	// OnCommit is called after an appender committed the given number of samples.
+	OnCommit(samples int)
+	// OnSeriesCreated is called for every new series created by an appender.
+	OnSeriesCreated(ref uint64, lset labels.Labels)
+}
+
+// CommitHook is called with the samples of every commit after they were
+// written to the WAL and added to the head. Samples the head did not add, e.g.
+// duplicates of the latest sample of a series, are not included. It is called
+// synchronously before Commit returns, which allows replicating writes without
+// reading back the WAL. The slice is only valid for the duration of the call.
+// Values of integer series are converted to float64, which loses precision
+// for values beyond ±2^53.
+type CommitHook func(samples []RefSample)
 
 type headMetrics struct {
 	activeAppenders         prometheus.Gauge
@@ -88,6 +184,10 @@ type headMetrics struct {
 	minTime                 prometheus.GaugeFunc
 	maxTime                 prometheus.GaugeFunc
 	samplesAppended         prometheus.Counter
+	duplicateSamples        prometheus.Counter
+	amendedSamples          prometheus.Counter
+	createdSamples          prometheus.Counter
+	schemaViolations        *prometheus.CounterVec
 	walTruncateDuration     prometheus.Summary
 	headTruncateFail        prometheus.Counter
 	headTruncateTotal       prometheus.Counter
@@ -156,6 +256,22 @@ func newHeadMetrics(h *Head, r prometheus.Registerer) *headMetrics {
 		Name: "prometheus_tsdb_head_samples_appended_total",
 		Help: "Total number of appended samples.",
 	})
+	m.duplicateSamples = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "prometheus_tsdb_head_duplicate_samples_total",
+		Help: "Total number of appended samples dropped for being identical to the most recent sample of their series.",
+	})
+	m.amendedSamples = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "prometheus_tsdb_head_amended_samples_total",
+		Help: "Total number of appended samples rejected for having the timestamp of the most recent sample of their series but a different value.",
+	})
+	m.createdSamples = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "prometheus_tsdb_head_created_timestamp_samples_total",
+		Help: "Total number of zero samples appended at the created timestamp of counters.",
+	})
+	m.schemaViolations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "prometheus_tsdb_head_schema_violations_total",
+		Help: "Total number of new series not conforming to the schema of their metric, by whether they were rejected or relabeled.",
+	}, []string{"action"})
 	m.headTruncateFail = prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "prometheus_tsdb_head_truncations_failed_total",
 		Help: "Total number of head truncations that failed.",
@@ -196,6 +312,10 @@ func newHeadMetrics(h *Head, r prometheus.Registerer) *headMetrics {
 			m.gcDuration,
 			m.walTruncateDuration,
 			m.samplesAppended,
+			m.duplicateSamples,
+			m.amendedSamples,
+			m.createdSamples,
+			m.schemaViolations,
 			m.headTruncateFail,
 			m.headTruncateTotal,
 			m.checkpointDeleteFail,
@@ -216,57 +336,81 @@ func NewHead(r prometheus.Registerer, l log.Logger, wal *wal.WAL, chunkRange int
 		return nil, errors.Errorf("invalid chunk range %d", chunkRange)
 	}
 	h := &Head{
-		wal:        wal,
-		logger:     l,
-		chunkRange: chunkRange,
-		minTime:    math.MaxInt64,
-		maxTime:    math.MinInt64,
-		series:     newStripeSeries(),
-		values:     map[string]stringset{},
-		symbols:    map[string]struct{}{},
-		postings:   index.NewUnorderedMemPostings(),
-		tombstones: NewMemTombstones(),
+		wal:         wal,
+		logger:      l,
+		chunkRange:  chunkRange,
+		minTime:     math.MaxInt64,
+		maxTime:     math.MinInt64,
+		flushedTime: math.MinInt64,
+		series:      newStripeSeries(),
+		retired:     newRetiredSeries(),
+		values:      map[string]stringset{},
+		symbols:     map[string]struct{}{},
+		postings:    index.NewUnorderedMemPostings(),
+		tombstones:  NewMemTombstones(),
 	}
 	h.metrics = newHeadMetrics(h, r)
 
 	return h, nil
 }
 
+// walSamples is a batch of float and integer samples read from the WAL.
+type walSamples struct {
+	samples []RefSample
+	ints    []RefIntSample
+}
+
 // processWALSamples adds a partition of samples it receives to the head and passes
 // them on to other workers.
 // Samples before the mint timestamp are discarded.
 func (h *Head) processWALSamples(
 	minValidTime int64,
 	partition, total uint64,
-	input <-chan []RefSample, output chan<- []RefSample,
+	input <-chan walSamples, output chan<- walSamples,
 ) (unknownRefs uint64) {
 	defer close(output)
 
 	mint, maxt := int64(math.MaxInt64), int64(math.MinInt64)
 
-	for samples := range input {
-		for _, s := range samples {
-			if s.T < minValidTime || s.Ref%total != partition {
-				continue
-			}
-			ms := h.series.getByID(s.Ref)
-			if ms == nil {
-				unknownRefs++
-				continue
-			}
-			_, chunkCreated := ms.append(s.T, s.V)
-			if chunkCreated {
-				h.metrics.chunksCreated.Inc()
-				h.metrics.chunks.Inc()
-			}
-			if s.T > maxt {
-				maxt = s.T
+	// series returns the series of a sample if it belongs to the partition.
+	series := func(ref uint64, t int64) *memSeries {
+		if t < minValidTime || ref%total != partition {
+			return nil
+		}
+		ms := h.series.getByID(ref)
+		if ms == nil {
+			unknownRefs++
+			return nil
+		}
+		if t > maxt {
+			maxt = t
+		}
+		if t < mint {
+			mint = t
+		}
+		return ms
+	}
+	chunkCreated := func(created bool) {
+		if created {
+			h.metrics.chunksCreated.Inc()
+			h.metrics.chunks.Inc()
+		}
+	}
+
+	for b := range input {
+		for _, s := range b.samples {
+			if ms := series(s.Ref, s.T); ms != nil {
+				_, created := ms.append(s.T, s.V)
+				chunkCreated(created)
 			}
-			if s.T < mint {
-				mint = s.T
+		}
+		for _, s := range b.ints {
+			if ms := series(s.Ref, s.T); ms != nil {
+				_, created := ms.appendInt(s.T, s.V)
+				chunkCreated(created)
 			}
 		}
-		output <- samples
+		output <- b
 	}
 	h.updateMinMaxTime(mint, maxt)
 
@@ -312,22 +456,22 @@ func (h *Head) loadWAL(r *wal.Reader) error {
 	var (
 		wg         sync.WaitGroup
 		n          = runtime.GOMAXPROCS(0)
-		firstInput = make(chan []RefSample, 300)
+		firstInput = make(chan walSamples, 300)
 		input      = firstInput
 	)
 	wg.Add(n)
 
 	for i := 0; i < n; i++ {
-		output := make(chan []RefSample, 300)
+		output := make(chan walSamples, 300)
 
-		go func(i int, input <-chan []RefSample, output chan<- []RefSample) {
+		go func(i int, input <-chan walSamples, output chan<- walSamples) {
 			unknown := h.processWALSamples(minValidTime, uint64(i), uint64(n), input, output)
 			atomic.AddUint64(&unknownRefs, unknown)
 			wg.Done()
 		}(i, input, output)
 
 		// The output feeds the next worker goroutine. For the last worker,
-		// it feeds the initial input again to reuse the RefSample slices.
+		// it feeds the initial input again to reuse the sample slices.
 		input = output
 	}
 
@@ -335,67 +479,96 @@ func (h *Head) loadWAL(r *wal.Reader) error {
 		dec     RecordDecoder
 		series  []RefSeries
 		samples []RefSample
+		ints    []RefIntSample
 		tstones []Stone
 	)
-	for r.Next() {
-		series, samples, tstones = series[:0], samples[:0], tstones[:0]
-		rec := r.Record()
-
-		switch dec.Type(rec) {
-		case RecordSeries:
-			series, err := dec.Series(rec, series)
-			if err != nil {
-				return errors.Wrap(err, "decode series")
-			}
-			for _, s := range series {
-				h.getOrCreateWithID(s.Ref, s.Labels.Hash(), s.Labels)
+	// Records are read in a closure so that the workers are always drained, even on
+	// error. Samples decoded before a corruption are thus still applied to the head.
+	err := func() error {
+		for r.Next() {
+			series, samples, ints, tstones = series[:0], samples[:0], ints[:0], tstones[:0]
+			rec := r.Record()
+
+			switch dec.Type(rec) {
+			case RecordSeries:
+				series, err := dec.Series(rec, series)
+				if err != nil {
+					return errors.Wrap(err, "decode series")
+				}
+				for _, s := range series {
+					h.getOrCreateWithID(s.Ref, s.Labels.Hash(), s.Labels)
 
-				if h.lastSeriesID < s.Ref {
-					h.lastSeriesID = s.Ref
+					if h.lastSeriesID < s.Ref {
+						h.lastSeriesID = s.Ref
+					}
 				}
-			}
-		case RecordSamples:
-			samples, err := dec.Samples(rec, samples)
-			if err != nil {
-				return errors.Wrap(err, "decode samples")
-			}
-			// We split up the samples into chunks of 5000 samples or less.
-			// With O(300 * #cores) in-flight sample batches, large scrapes could otherwise
-			// cause thousands of very large in flight buffers occupying large amounts
-			// of unused memory.
-			for len(samples) > 0 {
-				n := 5000
-				if len(samples) < n {
-					n = len(samples)
+			case RecordSamples:
+				samples, err := dec.Samples(rec, samples)
+				if err != nil {
+					return errors.Wrap(err, "decode samples")
 				}
-				var buf []RefSample
-				select {
-				case buf = <-input:
-				default:
+				// We split up the samples into chunks of 5000 samples or less.
+				// With O(300 * #cores) in-flight sample batches, large scrapes could otherwise
+				// cause thousands of very large in flight buffers occupying large amounts
+				// of unused memory.
+				for len(samples) > 0 {
+					n := 5000
+					if len(samples) < n {
+						n = len(samples)
+					}
+					var b walSamples
+					select {
+					case b = <-input:
+					default:
+					}
+					firstInput <- walSamples{
+						samples: append(b.samples[:0], samples[:n]...),
+						ints:    b.ints[:0],
+					}
+					samples = samples[n:]
 				}
-				firstInput <- append(buf[:0], samples[:n]...)
-				samples = samples[n:]
-			}
-		case RecordTombstones:
-			tstones, err := dec.Tombstones(rec, tstones)
-			if err != nil {
-				return errors.Wrap(err, "decode tombstones")
-			}
-			for _, s := range tstones {
-				for _, itv := range s.intervals {
-					if itv.Maxt < minValidTime {
-						continue
+			case RecordIntSamples:
+				ints, err := dec.IntSamples(rec, ints)
+				if err != nil {
+					return errors.Wrap(err, "decode integer samples")
+				}
+				// Integer samples pass the same workers to keep the order of
+				// samples in the WAL.
+				for len(ints) > 0 {
+					n := 5000
+					if len(ints) < n {
+						n = len(ints)
+					}
+					var b walSamples
+					select {
+					case b = <-input:
+					default:
+					}
+					firstInput <- walSamples{
+						samples: b.samples[:0],
+						ints:    append(b.ints[:0], ints[:n]...),
 					}
-					h.tombstones.addInterval(s.ref, itv)
+					ints = ints[n:]
 				}
+			case RecordTombstones:
+				tstones, err := dec.Tombstones(rec, tstones)
+				if err != nil {
+					return errors.Wrap(err, "decode tombstones")
+				}
+				for _, s := range tstones {
+					for _, itv := range s.intervals {
+						if itv.Maxt < minValidTime {
+							continue
+						}
+						h.tombstones.addInterval(s.ref, itv)
+					}
+				}
+			default:
+				return errors.Errorf("invalid record type %v", dec.Type(rec))
 			}
-		default:
-			return errors.Errorf("invalid record type %v", dec.Type(rec))
 		}
-	}
-	if r.Err() != nil {
 		return errors.Wrap(r.Err(), "read records")
-	}
+	}()
 
 	// Signal termination to first worker and wait for last one to close its output channel.
 	close(firstInput)
@@ -406,7 +579,7 @@ func (h *Head) loadWAL(r *wal.Reader) error {
 	if unknownRefs > 0 {
 		level.Warn(h.logger).Log("msg", "unknown series references", "count", unknownRefs)
 	}
-	return nil
+	return err
 }
 
 // Init loads data from the write ahead log and prepares the head for writes.
@@ -416,6 +589,9 @@ func (h *Head) Init() error {
 	if h.wal == nil {
 		return nil
 	}
+	if h.loadSnapshot() {
+		return nil
+	}
 
 	// Backfill the checkpoint first if it exists.
 	dir, startFrom, err := LastCheckpoint(h.wal.Dir())
@@ -449,13 +625,21 @@ func (h *Head) Init() error {
 		return nil
 	}
 	level.Warn(h.logger).Log("msg", "encountered WAL error, attempting repair", "err", err)
+	h.walRepaired = true
 
 	if err := h.wal.Repair(err); err != nil {
+		level.Error(h.logger).Log("msg", "WAL repair failed", "err", err)
 		return errors.Wrap(err, "repair corrupted WAL")
 	}
+	level.Info(h.logger).Log("msg", "WAL repair completed")
 	return nil
 }
 
+// empty returns true if the head holds no series.
+func (h *Head) empty() bool {
+	return h.MinTime() == math.MaxInt64 || !h.postings.Get(index.AllPostingsKey()).Next()
+}
+
 // Truncate removes old data before mint from the head.
 func (h *Head) Truncate(mint int64) (err error) {
 	defer func() {
@@ -572,17 +756,14 @@ func (h *rangeHead) Tombstones() (TombstoneReader, error) {
 // initAppender is a helper to initialize the time bounds of the head
 // upon the first sample it receives.
 type initAppender struct {
-	app  Appender
+	app  *headAppender
 	head *Head
 }
 
 func (a *initAppender) Add(lset labels.Labels, t int64, v float64) (uint64, error) {
-	if a.app != nil {
-		return a.app.Add(lset, t, v)
+	if err := a.init(t); err != nil {
+		return 0, err
 	}
-	a.head.initTime(t)
-	a.app = a.head.appender()
-
 	return a.app.Add(lset, t, v)
 }
 
@@ -593,6 +774,48 @@ func (a *initAppender) AddFast(ref uint64, t int64, v float64) error {
 	return a.app.AddFast(ref, t, v)
 }
 
+func (a *initAppender) AddInt(lset labels.Labels, t int64, v int64) (uint64, error) {
+	if err := a.init(t); err != nil {
+		return 0, err
+	}
+	return a.app.AddInt(lset, t, v)
+}
+
+func (a *initAppender) AddIntFast(ref uint64, t int64, v int64) error {
+	if a.app == nil {
+		return ErrNotFound
+	}
+	return a.app.AddIntFast(ref, t, v)
+}
+
+func (a *initAppender) AddCreated(lset labels.Labels, t, ct int64) (uint64, error) {
+	if err := a.init(t); err != nil {
+		return 0, err
+	}
+	return a.app.AddCreated(lset, t, ct)
+}
+
+func (a *initAppender) AddCreatedFast(ref uint64, t, ct int64) error {
+	if a.app == nil {
+		return ErrNotFound
+	}
+	return a.app.AddCreatedFast(ref, t, ct)
+}
+
+// init initializes the head with the timestamp of the first sample.
+func (a *initAppender) init(t int64) error {
+	if a.app != nil {
+		return nil
+	}
+	// Samples far in the future must not determine the time window of the head.
+	if t > a.head.maxValidTime() {
+		return ErrTooFarInFuture
+	}
+	a.head.initTime(t)
+	a.app = a.head.appender()
+	return nil
+}
+
 func (a *initAppender) Commit() error {
 	if a.app == nil {
 		return nil
@@ -620,15 +843,30 @@ func (h *Head) Appender() Appender {
 }
 
 func (h *Head) appender() *headAppender {
+	// Samples must neither be too far behind the most recent ones nor fall
+	// into a range that was flushed already.
+	minValidTime := h.MaxTime() - h.chunkRange/2
+	if m := atomic.LoadInt64(&h.flushedTime); m > minValidTime {
+		minValidTime = m
+	}
 	return &headAppender{
 		head:         h,
-		minValidTime: h.MaxTime() - h.chunkRange/2,
+		minValidTime: minValidTime,
+		maxValidTime: h.maxValidTime(),
 		mint:         math.MaxInt64,
 		maxt:         math.MinInt64,
 		samples:      h.getAppendBuffer(),
 	}
 }
 
+// maxValidTime returns the highest timestamp that may currently be appended.
+func (h *Head) maxValidTime() int64 {
+	if h.futureTolerance == 0 {
+		return math.MaxInt64
+	}
+	return h.timestampUnit.Now() + h.futureTolerance
+}
+
 func (h *Head) getAppendBuffer() []RefSample {
 	b := h.appendPool.Get()
 	if b == nil {
@@ -656,60 +894,261 @@ func (h *Head) putBytesBuffer(b []byte) {
 type headAppender struct {
 	head         *Head
 	minValidTime int64 // No samples below this timestamp are allowed.
+	maxValidTime int64 // No samples above this timestamp are allowed.
 	mint, maxt   int64
 
-	series  []RefSeries
-	samples []RefSample
+	series     []RefSeries
+	samples    []RefSample
+	intSamples []RefIntSample
 }
 
 func (a *headAppender) Add(lset labels.Labels, t int64, v float64) (uint64, error) {
-	if t < a.minValidTime {
-		return 0, ErrOutOfBounds
+	ref, err := a.seriesRef(lset, t)
+	if err != nil {
+		return 0, err
+	}
+	return ref, a.AddFast(ref, t, v)
+}
+
+func (a *headAppender) AddInt(lset labels.Labels, t int64, v int64) (uint64, error) {
+	ref, err := a.seriesRef(lset, t)
+	if err != nil {
+		return 0, err
+	}
+	return ref, a.AddIntFast(ref, t, v)
+}
+
+func (a *headAppender) AddCreated(lset labels.Labels, t, ct int64) (uint64, error) {
+	if ct >= t {
+		return 0, ErrCreatedAfterSample
+	}
+	ref, err := a.seriesRef(lset, t)
+	if err != nil {
+		return 0, err
+	}
+	return ref, a.AddCreatedFast(ref, t, ct)
+}
+
+// AddCreatedFast adds a zero sample at ct unless the series has samples at or
+// after it already. Created timestamps before the range of the head are
+// ignored as the counter's samples there cannot be amended anymore.
+func (a *headAppender) AddCreatedFast(ref uint64, t, ct int64) error {
+	if ct >= t {
+		return ErrCreatedAfterSample
+	}
+	if err := a.checkTime(t); err != nil {
+		return err
+	}
+	if ct < a.minValidTime {
+		return nil
+	}
+
+	s, lset := a.head.seriesByRef(ref)
+	if s == nil {
+		if lset == nil {
+			return errors.Wrap(ErrNotFound, "unknown series")
+		}
+		if _, err := a.AddCreated(lset, t, ct); err != nil {
+			return err
+		}
+		return nil
+	}
+	// Series with uncommitted samples may have samples after ct already.
+	s.Lock()
+	c := s.head()
+	skip := s.pendingCommit || (c != nil && c.maxTime >= ct)
+	s.Unlock()
+
+	if skip {
+		return nil
+	}
+	var err error
+	if s.integer {
+		err = a.addInt(s, ct, 0)
+	} else {
+		err = a.add(s, ct, 0)
 	}
+	if err == nil {
+		a.head.metrics.createdSamples.Inc()
+	}
+	return err
+}
 
-	s, created := a.head.getOrCreate(lset.Hash(), lset)
+// seriesRef returns the reference of the series with the given labels for a
+// sample at t, creating the series if it does not exist yet.
+func (a *headAppender) seriesRef(lset labels.Labels, t int64) (uint64, error) {
+	if err := a.checkTime(t); err != nil {
+		return 0, err
+	}
+
+	var (
+		hash      = lset.Hash()
+		relabeled bool
+	)
+	if (a.head.admission != nil || a.head.validation != nil) && a.head.series.getByHash(hash, lset) == nil {
+		var err error
+		if lset, relabeled, err = a.head.validate(lset); err != nil {
+			return 0, err
+		}
+		hash = lset.Hash()
+
+		// Relabeled series may exist already.
+		if a.head.series.getByHash(hash, lset) == nil {
+			if err := a.head.admit(AdmissionRequest{Stage: AdmitSeries, Labels: lset}); err != nil {
+				return 0, err
+			}
+		}
+	}
+	s, created := a.head.getOrCreate(hash, lset)
 	if created {
+		if relabeled {
+			a.head.metrics.schemaViolations.WithLabelValues("relabeled").Inc()
+		}
 		a.series = append(a.series, RefSeries{
 			Ref:    s.ref,
 			Labels: lset,
 		})
+		if o := a.head.observer; o != nil {
+			o.OnSeriesCreated(s.ref, lset)
+		}
 	}
-	return s.ref, a.AddFast(s.ref, t, v)
+	return s.ref, nil
 }
 
-func (a *headAppender) AddFast(ref uint64, t int64, v float64) error {
+func (a *headAppender) checkTime(t int64) error {
 	if t < a.minValidTime {
 		return ErrOutOfBounds
 	}
+	if t > a.maxValidTime {
+		return ErrTooFarInFuture
+	}
+	return nil
+}
+
+// AddFast converts v to an integer if the series stores integers and fails
+// with ErrNotInteger if it is none.
+func (a *headAppender) AddFast(ref uint64, t int64, v float64) error {
+	if err := a.checkTime(t); err != nil {
+		return err
+	}
 
-	s := a.head.series.getByID(ref)
+	s, lset := a.head.seriesByRef(ref)
 	if s == nil {
-		return errors.Wrap(ErrNotFound, "unknown series")
+		// Recreate series that were removed from the head while the caller
+		// still held their reference.
+		if lset == nil {
+			return errors.Wrap(ErrNotFound, "unknown series")
+		}
+		if _, err := a.Add(lset, t, v); err != nil {
+			return err
+		}
+		return nil
 	}
-	s.Lock()
-	if err := s.appendable(t, v); err != nil {
-		s.Unlock()
+	if s.integer {
+		iv, err := intValue(v)
+		if err != nil {
+			return err
+		}
+		return a.addInt(s, t, iv)
+	}
+	return a.add(s, t, v)
+}
+
+// AddIntFast converts v to float64 if the series does not store integers.
+func (a *headAppender) AddIntFast(ref uint64, t int64, v int64) error {
+	if err := a.checkTime(t); err != nil {
 		return err
 	}
-	s.pendingCommit = true
-	s.Unlock()
 
-	if t < a.mint {
-		a.mint = t
+	s, lset := a.head.seriesByRef(ref)
+	if s == nil {
+		if lset == nil {
+			return errors.Wrap(ErrNotFound, "unknown series")
+		}
+		if _, err := a.AddInt(lset, t, v); err != nil {
+			return err
+		}
+		return nil
 	}
-	if t > a.maxt {
-		a.maxt = t
+	if !s.integer {
+		return a.add(s, t, float64(v))
 	}
+	return a.addInt(s, t, v)
+}
 
+func (a *headAppender) add(s *memSeries, t int64, v float64) error {
+	// Values are rounded ahead of all checks and the WAL so that they match
+	// the values read back from the series.
+	if s.lossy {
+		v = chunkenc.Round(v, s.precision)
+	}
+	s.Lock()
+	dup, err := s.appendable(t, v)
+	if err == nil && !dup {
+		s.pendingCommit = true
+	}
+	s.Unlock()
+
+	if ok, err := a.accept(t, dup, err); !ok {
+		return err
+	}
 	a.samples = append(a.samples, RefSample{
-		Ref:    ref,
+		Ref:    s.ref,
 		T:      t,
 		V:      v,
 		series: s,
 	})
+	if o := a.head.observer; o != nil {
+		o.OnAppend(s.ref, t, v)
+	}
 	return nil
 }
 
+func (a *headAppender) addInt(s *memSeries, t int64, v int64) error {
+	s.Lock()
+	dup, err := s.appendableInt(t, v)
+	if err == nil && !dup {
+		s.pendingCommit = true
+	}
+	s.Unlock()
+
+	if ok, err := a.accept(t, dup, err); !ok {
+		return err
+	}
+	a.intSamples = append(a.intSamples, RefIntSample{
+		Ref:    s.ref,
+		T:      t,
+		V:      v,
+		series: s,
+	})
+	if o := a.head.observer; o != nil {
+		o.OnAppend(s.ref, t, float64(v))
+	}
+	return nil
+}
+
+// accept returns whether a sample at t with the given appendable result is
+// added to the appender and tracks its timestamp if so.
+func (a *headAppender) accept(t int64, dup bool, err error) (bool, error) {
+	if err != nil {
+		if err == ErrAmendSample {
+			a.head.metrics.amendedSamples.Inc()
+		}
+		return false, err
+	}
+	if dup {
+		a.head.metrics.duplicateSamples.Inc()
+		return false, nil
+	}
+	if t < a.mint {
+		a.mint = t
+	}
+	if t > a.maxt {
+		a.maxt = t
+	}
+	return true, nil
+}
+
 func (a *headAppender) log() error {
 	if a.head.wal == nil {
 		return nil
@@ -737,10 +1176,29 @@ func (a *headAppender) log() error {
 			return errors.Wrap(err, "log samples")
 		}
 	}
+	if len(a.intSamples) > 0 {
+		rec = enc.IntSamples(a.intSamples, buf)
+		buf = rec[:0]
+
+		if err := a.head.wal.Log(rec); err != nil {
+			return errors.Wrap(err, "log integer samples")
+		}
+	}
 	return nil
 }
 
 func (a *headAppender) Commit() error {
+	err := a.head.admit(AdmissionRequest{
+		Stage:   AdmitCommit,
+		Series:  len(a.series),
+		Samples: len(a.samples) + len(a.intSamples),
+	})
+	if err != nil {
+		if rerr := a.Rollback(); rerr != nil {
+			return errors.Wrap(rerr, "rollback rejected commit")
+		}
+		return err
+	}
 	defer a.head.metrics.activeAppenders.Dec()
 	defer a.head.putAppendBuffer(a.samples)
 
@@ -748,7 +1206,8 @@ func (a *headAppender) Commit() error {
 		return errors.Wrap(err, "write to WAL")
 	}
 
-	total := len(a.samples)
+	// Samples added to the head are moved to the front for the commit hook.
+	committed := a.samples[:0]
 
 	for _, s := range a.samples {
 		s.series.Lock()
@@ -756,18 +1215,41 @@ func (a *headAppender) Commit() error {
 		s.series.pendingCommit = false
 		s.series.Unlock()
 
-		if !ok {
-			total--
+		if ok {
+			committed = append(committed, s)
 		}
 		if chunkCreated {
 			a.head.metrics.chunks.Inc()
 			a.head.metrics.chunksCreated.Inc()
 		}
 	}
+	for _, s := range a.intSamples {
+		s.series.Lock()
+		ok, chunkCreated := s.series.appendInt(s.T, s.V)
+		s.series.pendingCommit = false
+		s.series.Unlock()
+
+		if ok {
+			committed = append(committed, RefSample{Ref: s.Ref, T: s.T, V: float64(s.V), series: s.series})
+		}
+		if chunkCreated {
+			a.head.metrics.chunks.Inc()
+			a.head.metrics.chunksCreated.Inc()
+		}
+	}
+	total := len(committed)
 
 	a.head.metrics.samplesAppended.Add(float64(total))
 	a.head.updateMinMaxTime(a.mint, a.maxt)
 
+	if a.head.commitHook != nil && total > 0 {
+		a.head.commitHook(committed)
+	}
+
+	if o := a.head.observer; o != nil {
+		o.OnCommit(total)
+	}
+
 	return nil
 }
 
@@ -778,11 +1260,16 @@ func (a *headAppender) Rollback() error {
 		s.series.pendingCommit = false
 		s.series.Unlock()
 	}
+	for _, s := range a.intSamples {
+		s.series.Lock()
+		s.series.pendingCommit = false
+		s.series.Unlock()
+	}
 	a.head.putAppendBuffer(a.samples)
 
 	// Series are created in the head memory regardless of rollback. Thus we have
 	// to log them to the WAL in any case.
-	a.samples = nil
+	a.samples, a.intSamples = nil, nil
 	return a.log()
 }
 
@@ -835,8 +1322,13 @@ func (h *Head) gc() {
 	mint := h.MinTime()
 
 	// Drop old chunks and remember series IDs and hashes if they can be
-	// deleted entirely.
-	deleted, chunksRemoved := h.series.gc(mint)
+	// deleted entirely. Removed series are retired before their IDs can be
+	// looked up again.
+	h.retired.mtx.Lock()
+	deleted, retired, chunksRemoved := h.series.gc(mint)
+	h.retired.add(retired)
+	h.retired.mtx.Unlock()
+
 	seriesRemoved := len(deleted)
 
 	h.metrics.seriesRemoved.Add(float64(seriesRemoved))
@@ -914,12 +1406,19 @@ func (h *Head) MaxTime() int64 {
 	return atomic.LoadInt64(&h.maxTime)
 }
 
-// Close flushes the WAL and closes the head.
+// Close flushes the WAL and closes the head. If enabled, a snapshot of the
+// head is written afterwards.
 func (h *Head) Close() error {
 	if h.wal == nil {
 		return nil
 	}
-	return h.wal.Close()
+	if err := h.wal.Close(); err != nil {
+		return err
+	}
+	if h.snapshotOnShutdown {
+		return errors.Wrap(h.writeSnapshot(), "write head snapshot")
+	}
+	return nil
 }
 
 type headChunkReader struct {
@@ -997,16 +1496,17 @@ func (h *headIndexReader) Close() error {
 	return nil
 }
 
-func (h *headIndexReader) Symbols() (map[string]struct{}, error) {
+func (h *headIndexReader) Symbols() index.StringIter {
 	h.head.symMtx.RLock()
-	defer h.head.symMtx.RUnlock()
-
-	res := make(map[string]struct{}, len(h.head.symbols))
+	res := make([]string, 0, len(h.head.symbols))
 
 	for s := range h.head.symbols {
-		res[s] = struct{}{}
+		res = append(res, s)
 	}
-	return res, nil
+	h.head.symMtx.RUnlock()
+
+	sort.Strings(res)
+	return index.NewStringListIter(res)
 }
 
 // LabelValues returns the possible label values
@@ -1031,6 +1531,22 @@ func (h *headIndexReader) Postings(name, value string) (index.Postings, error) {
 	return h.head.postings.Get(name, value), nil
 }
 
+// PrefixPostings returns the union of postings lists of all label pairs with
+// the given name and a value starting with prefix.
+func (h *headIndexReader) PrefixPostings(name, prefix string) (index.Postings, error) {
+	var its []index.Postings
+
+	h.head.symMtx.RLock()
+	for v := range h.head.values[name] {
+		if strings.HasPrefix(v, prefix) {
+			its = append(its, h.head.postings.Get(name, v))
+		}
+	}
+	h.head.symMtx.RUnlock()
+
+	return index.Merge(its...), nil
+}
+
 func (h *headIndexReader) SortedPostings(p index.Postings) index.Postings {
 	ep := make([]uint64, 0, 128)
 
@@ -1084,6 +1600,30 @@ func (h *headIndexReader) Series(ref uint64, lbls *labels.Labels, chks *[]chunks
 	return nil
 }
 
+// SeriesStats returns the stats of the series' chunks within the reader's time range.
+func (h *headIndexReader) SeriesStats(ref uint64) (index.SeriesStats, error) {
+	s := h.head.series.getByID(ref)
+
+	if s == nil {
+		h.head.metrics.seriesNotFound.Inc()
+		return index.SeriesStats{}, ErrNotFound
+	}
+	s.Lock()
+	defer s.Unlock()
+
+	var stats index.SeriesStats
+
+	for _, c := range s.chunks {
+		if !c.OverlapsClosedInterval(h.mint, h.maxt) {
+			continue
+		}
+		stats.Chunks++
+		stats.Samples += uint64(c.chunk.NumSamples())
+		stats.Bytes += uint64(len(c.chunk.Bytes()))
+	}
+	return stats, nil
+}
+
 func (h *headIndexReader) LabelIndices() ([][]string, error) {
 	h.head.symMtx.RLock()
 	defer h.head.symMtx.RUnlock()
@@ -1096,6 +1636,29 @@ func (h *headIndexReader) LabelIndices() ([][]string, error) {
 	return res, nil
 }
 
+// LabelSketches returns sketches built from the label values currently in the head.
+func (h *headIndexReader) LabelSketches() (map[string]*index.HyperLogLog, error) {
+	h.head.symMtx.RLock()
+	defer h.head.symMtx.RUnlock()
+
+	res := make(map[string]*index.HyperLogLog, len(h.head.values))
+
+	for name, values := range h.head.values {
+		hll := index.NewHyperLogLog()
+		for v := range values {
+			hll.Add(v)
+		}
+		res[name] = hll
+	}
+	return res, nil
+}
+
+// PostingsStats returns the label pairs of the head with the most series.
+// Postings lists of the head hold 8 bytes per series.
+func (h *headIndexReader) PostingsStats(limit int) (*index.PostingsStats, error) {
+	return index.TopPostingsStats(h.head.postings.Stats(), limit), nil
+}
+
 func (h *Head) getOrCreate(hash uint64, lset labels.Labels) (*memSeries, bool) {
 	// Just using `getOrSet` below would be semantically sufficient, but we'd create
 	// a new series on every sample inserted via Add(), which causes allocations
@@ -1105,14 +1668,47 @@ func (h *Head) getOrCreate(hash uint64, lset labels.Labels) (*memSeries, bool) {
 		return s, false
 	}
 
+	// Recently removed series keep their ID so that references held by
+	// appenders remain valid. The series is recreated before the ID can be
+	// looked up again.
+	h.retired.mtx.Lock()
+	if id, ok := h.retired.take(hash, lset); ok {
+		defer h.retired.mtx.Unlock()
+		return h.getOrCreateWithID(id, hash, lset)
+	}
+	h.retired.mtx.Unlock()
+
 	// Optimistically assume that we are the first one to create the series.
 	id := atomic.AddUint64(&h.lastSeriesID, 1)
 
 	return h.getOrCreateWithID(id, hash, lset)
 }
 
+// seriesByRef returns the series with the given ID. If it was removed from the
+// head recently, it returns nil and the label set of the series instead.
+func (h *Head) seriesByRef(ref uint64) (*memSeries, labels.Labels) {
+	if s := h.series.getByID(ref); s != nil {
+		return s, nil
+	}
+	h.retired.mtx.Lock()
+	defer h.retired.mtx.Unlock()
+
+	// The series may have been recreated or retired since.
+	if s := h.series.getByID(ref); s != nil {
+		return s, nil
+	}
+	return nil, h.retired.get(ref)
+}
+
 func (h *Head) getOrCreateWithID(id, hash uint64, lset labels.Labels) (*memSeries, bool) {
 	s := newMemSeries(lset, id, h.chunkRange)
+	if h.integerSeries != nil {
+		s.integer = h.integerSeries(lset)
+	}
+	if h.chunkPrecision != nil && !s.integer {
+		s.precision, s.lossy = h.chunkPrecision(lset)
+	}
+	s.autoEncode = h.autoChunkEncoding && !s.lossy && !s.integer
 
 	s, created := h.series.getOrSet(hash, s)
 	if !created {
@@ -1182,6 +1778,88 @@ func (m seriesHashmap) del(hash uint64, lset labels.Labels) {
 	}
 }
 
+// retiredSeriesGCs is the number of garbage collections for which the IDs of
+// removed series remain valid. The head is garbage collected whenever it is
+// truncated, usually once per chunk range.
+const retiredSeriesGCs = 4
+
+// retiredSeries holds the IDs and label sets of series removed from the head by
+// the last retiredSeriesGCs garbage collections. Series appended to again are
+// recreated under their previous ID. IDs retired by earlier garbage collections
+// are released.
+type retiredSeries struct {
+	// mtx must be held while calling any method. It is also held while series
+	// are removed from the head and retired, and while they are taken and
+	// recreated, so that IDs resolve to either a series or a retired series.
+	mtx    sync.Mutex
+	gcs    int
+	byID   map[uint64]retiredSeriesEntry
+	byHash map[uint64][]uint64
+}
+
+type retiredSeriesEntry struct {
+	lset labels.Labels
+	gc   int
+}
+
+func newRetiredSeries() *retiredSeries {
+	return &retiredSeries{
+		byID:   map[uint64]retiredSeriesEntry{},
+		byHash: map[uint64][]uint64{},
+	}
+}
+
+// add retires the series removed by a garbage collection and releases those
+// retired retiredSeriesGCs garbage collections before.
+func (r *retiredSeries) add(series map[uint64]labels.Labels) {
+	r.gcs++
+
+	for id, e := range r.byID {
+		if e.gc <= r.gcs-retiredSeriesGCs {
+			r.del(id, e.lset.Hash())
+		}
+	}
+	for id, lset := range series {
+		r.byID[id] = retiredSeriesEntry{lset: lset, gc: r.gcs}
+		h := lset.Hash()
+		r.byHash[h] = append(r.byHash[h], id)
+	}
+}
+
+// get returns the label set of the retired series with the given ID or nil.
+func (r *retiredSeries) get(id uint64) labels.Labels {
+	return r.byID[id].lset
+}
+
+// take returns the ID of the retired series with the given label set and
+// removes it from the retired series.
+func (r *retiredSeries) take(hash uint64, lset labels.Labels) (uint64, bool) {
+	for _, id := range r.byHash[hash] {
+		if r.byID[id].lset.Equals(lset) {
+			r.del(id, hash)
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+func (r *retiredSeries) del(id, hash uint64) {
+	delete(r.byID, id)
+
+	ids := r.byHash[hash]
+	for i, x := range ids {
+		if x != id {
+			continue
+		}
+		if len(ids) == 1 {
+			delete(r.byHash, hash)
+		} else {
+			r.byHash[hash] = append(ids[:i:i], ids[i+1:]...)
+		}
+		return
+	}
+}
+
 // stripeSeries locks modulo ranges of IDs and hashes to reduce lock contention.
 // The locks are padded to not be on the same cache line. Filling the padded space
 // with the maps was profiled to be slower – likely due to the additional pointer
@@ -1217,9 +1895,10 @@ func newStripeSeries() *stripeSeries {
 
 // gc garbage collects old chunks that are strictly before mint and removes
 // series entirely that have no chunks left.
-func (s *stripeSeries) gc(mint int64) (map[uint64]struct{}, int) {
+func (s *stripeSeries) gc(mint int64) (map[uint64]struct{}, map[uint64]labels.Labels, int) {
 	var (
 		deleted  = map[uint64]struct{}{}
+		retired  = map[uint64]labels.Labels{}
 		rmChunks = 0
 	)
 	// Run through all series and truncate old chunks. Mark those with no
@@ -1249,6 +1928,7 @@ func (s *stripeSeries) gc(mint int64) (map[uint64]struct{}, int) {
 				}
 
 				deleted[series.ref] = struct{}{}
+				retired[series.ref] = series.lset
 				s.hashes[i].del(hash, series.lset)
 				delete(s.series[j], series.ref)
 
@@ -1263,7 +1943,7 @@ func (s *stripeSeries) gc(mint int64) (map[uint64]struct{}, int) {
 		s.locks[i].Unlock()
 	}
 
-	return deleted, rmChunks
+	return deleted, retired, rmChunks
 }
 
 func (s *stripeSeries) getByID(id uint64) *memSeries {
@@ -1325,9 +2005,20 @@ type memSeries struct {
 
 	nextAt        int64 // Timestamp at which to cut the next chunk.
 	lastValue     float64
+	lastInt       int64
 	sampleBuf     [4]sample
 	pendingCommit bool // Whether there are samples waiting to be committed to this series.
 
+	// If lossy is set, values are rounded to precision decimal digits and
+	// stored in scaled chunks.
+	lossy     bool
+	precision int
+	// If autoEncode is set, chunks are recoded once they hold enough samples
+	// to choose their encoding.
+	autoEncode bool
+	// If integer is set, values are stored as integers in int chunks.
+	integer bool
+
 	app chunkenc.Appender // Current appender for the chunk.
 }
 
@@ -1352,6 +2043,12 @@ func (s *memSeries) cut(mint int64) *memChunk {
 		minTime: mint,
 		maxTime: math.MinInt64,
 	}
+	if s.lossy {
+		c.chunk = chunkenc.NewScaledChunk(s.precision)
+	}
+	if s.integer {
+		c.chunk = chunkenc.NewIntChunk()
+	}
 	s.chunks = append(s.chunks, c)
 
 	// Set upper bound on when the next chunk must be started. An earlier timestamp
@@ -1376,25 +2073,37 @@ func newMemSeries(lset labels.Labels, id uint64, chunkRange int64) *memSeries {
 	return s
 }
 
-// appendable checks whether the given sample is valid for appending to the series.
-func (s *memSeries) appendable(t int64, v float64) error {
+// appendable checks whether the given sample can be appended to the series. It
+// reports exact duplicates of the most recent sample, which need not be appended.
+func (s *memSeries) appendable(t int64, v float64) (bool, error) {
+	return s.appendableSample(t, math.Float64bits(s.lastValue) == math.Float64bits(v))
+}
+
+// appendableInt is like appendable for series storing integer values.
+func (s *memSeries) appendableInt(t, v int64) (bool, error) {
+	return s.appendableSample(t, s.lastInt == v)
+}
+
+// appendableSample checks whether a sample at t can be appended. sameValue
+// reports whether its value equals the most recent one.
+func (s *memSeries) appendableSample(t int64, sameValue bool) (bool, error) {
 	c := s.head()
 	if c == nil {
-		return nil
+		return false, nil
 	}
 
 	if t > c.maxTime {
-		return nil
+		return false, nil
 	}
 	if t < c.maxTime {
-		return ErrOutOfOrderSample
+		return false, ErrOutOfOrderSample
 	}
 	// We are allowing exact duplicates as we can encounter them in valid cases
 	// like federation and erroring out at that time would be extremely noisy.
-	if math.Float64bits(s.lastValue) != math.Float64bits(v) {
-		return ErrAmendSample
+	if !sameValue {
+		return false, ErrAmendSample
 	}
-	return nil
+	return true, nil
 }
 
 func (s *memSeries) chunk(id int) *memChunk {
@@ -1425,14 +2134,69 @@ func (s *memSeries) truncateChunksBefore(mint int64) (removed int) {
 	return k
 }
 
-// append adds the sample (t, v) to the series.
+// append adds the sample (t, v) to the series. If the series stores integers,
+// values that are not integers are not added.
 func (s *memSeries) append(t int64, v float64) (success, chunkCreated bool) {
+	if s.integer {
+		iv, ok := chunkenc.IntValue(v)
+		if !ok {
+			return false, false
+		}
+		return s.appendInt(t, iv)
+	}
+	c, chunkCreated := s.appendChunk(t)
+	if c == nil {
+		return false, chunkCreated
+	}
+	s.app.Append(t, v)
+
+	c.maxTime = t
+
+	if s.autoEncode && c.chunk.NumSamples() == autoEncodeSamples {
+		s.recode(c)
+	}
+
+	s.lastValue = v
+	s.bufferSample(t, v)
+
+	return true, chunkCreated
+}
+
+// appendInt adds the sample (t, v) to the series. The value is converted to
+// float64 if the series does not store integers.
+func (s *memSeries) appendInt(t, v int64) (success, chunkCreated bool) {
+	if !s.integer {
+		return s.append(t, float64(v))
+	}
+	c, chunkCreated := s.appendChunk(t)
+	if c == nil {
+		return false, chunkCreated
+	}
+	// Chunks restored from a snapshot may predate the series storing integers.
+	if app, ok := s.app.(chunkenc.IntAppender); ok {
+		app.AppendInt(t, v)
+	} else {
+		s.app.Append(t, float64(v))
+	}
+
+	c.maxTime = t
+
+	s.lastInt = v
+	s.lastValue = float64(v)
+	s.bufferSample(t, float64(v))
+
+	return true, chunkCreated
+}
+
+// appendChunk returns the chunk a sample at t is appended to, cutting a new
+// one if needed. It returns nil if the sample is out of order.
+func (s *memSeries) appendChunk(t int64) (c *memChunk, chunkCreated bool) {
 	// Based on Gorilla white papers this offers near-optimal compression ratio
 	// so anything bigger that this has diminishing returns and increases
 	// the time range within which we have to decompress all samples.
 	const samplesPerChunk = 120
 
-	c := s.head()
+	c = s.head()
 
 	if c == nil {
 		c = s.cut(t)
@@ -1442,7 +2206,7 @@ func (s *memSeries) append(t int64, v float64) (success, chunkCreated bool) {
 
 	// Out of order sample.
 	if c.maxTime >= t {
-		return false, chunkCreated
+		return nil, chunkCreated
 	}
 	// If we reach 25% of a chunk's desired sample count, set a definitive time
 	// at which to start the next chunk.
@@ -1454,18 +2218,34 @@ func (s *memSeries) append(t int64, v float64) (success, chunkCreated bool) {
 		c = s.cut(t)
 		chunkCreated = true
 	}
-	s.app.Append(t, v)
-
-	c.maxTime = t
-
-	s.lastValue = v
+	return c, chunkCreated
+}
 
+// bufferSample keeps the sample (t, v) in the buffer of the most recent samples.
+func (s *memSeries) bufferSample(t int64, v float64) {
 	s.sampleBuf[0] = s.sampleBuf[1]
 	s.sampleBuf[1] = s.sampleBuf[2]
 	s.sampleBuf[2] = s.sampleBuf[3]
 	s.sampleBuf[3] = sample{t: t, v: v}
+}
 
-	return true, chunkCreated
+// autoEncodeSamples is the number of samples after which the encoding of a head
+// chunk is chosen.
+const autoEncodeSamples = 16
+
+// recode replaces the chunk c with one in the encoding best suited for its
+// samples. The chunk is kept if it cannot be recoded.
+func (s *memSeries) recode(c *memChunk) {
+	nc, err := chunkenc.Recode(c.chunk)
+	if err != nil || nc == c.chunk {
+		return
+	}
+	app, err := nc.Appender()
+	if err != nil {
+		return
+	}
+	c.chunk = nc
+	s.app = app
 }
 
 // computeChunkEndTime estimates the end timestamp based the beginning of a chunk,
@@ -1488,7 +2268,9 @@ func (s *memSeries) iterator(id int) chunkenc.Iterator {
 		return chunkenc.NewNopIterator()
 	}
 
-	if id-s.firstChunkID < len(s.chunks)-1 {
+	// Int chunks are byte-aligned and appending never modifies the bytes of
+	// existing samples.
+	if id-s.firstChunkID < len(s.chunks)-1 || c.chunk.Encoding() == chunkenc.EncInt {
 		return c.chunk.Iterator()
 	}
 	// Serve the last 4 samples for the last chunk from the sample buffer
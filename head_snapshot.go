@@ -0,0 +1,422 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/tsdb/fileutil"
+	"github.com/prometheus/tsdb/labels"
+	"github.com/prometheus/tsdb/wal"
+)
+
+// headSnapshotDirname is the directory within the WAL directory holding the
+// snapshot of the head written on shutdown. It is stored in the segmented
+// format of the WAL itself so that its records are checksummed.
+const headSnapshotDirname = "head_snapshot"
+
+// Types of the records of a head snapshot. Tombstones are stored in regular
+// tombstone records.
+const (
+	snapshotRecordMeta   RecordType = 101
+	snapshotRecordSeries RecordType = 102
+)
+
+// snapshotRecordSize is the size above which series records are flushed.
+const snapshotRecordSize = 1 << 20
+
+// headSnapshot is the decoded content of a head snapshot.
+type headSnapshot struct {
+	// Index and size of the last WAL segment at the time of the snapshot.
+	// The snapshot is stale if the WAL was written to afterwards.
+	walSegment   int
+	walSize      int64
+	lastSeriesID uint64
+
+	series []*snapshotSeries
+	stones []Stone
+}
+
+type snapshotSeries struct {
+	ref       uint64
+	lset      labels.Labels
+	nextAt    int64
+	sampleBuf [4]sample
+	chunks    []*memChunk
+	app       chunkenc.Appender
+}
+
+// writeSnapshot writes the series, chunks and tombstones of the head into the
+// snapshot directory. The WAL must be closed.
+func (h *Head) writeSnapshot() error {
+	start := time.Now()
+
+	_, last, err := h.wal.Segments()
+	if err != nil {
+		return errors.Wrap(err, "get segment range")
+	}
+	fi, err := os.Stat(wal.SegmentName(h.wal.Dir(), last))
+	if err != nil {
+		return errors.Wrap(err, "stat last segment")
+	}
+
+	dir := filepath.Join(h.wal.Dir(), headSnapshotDirname)
+	tmp := dir + ".tmp"
+
+	if err := os.RemoveAll(tmp); err != nil {
+		return errors.Wrap(err, "remove previous temporary snapshot")
+	}
+	if err := os.MkdirAll(tmp, 0777); err != nil {
+		return errors.Wrap(err, "create snapshot dir")
+	}
+	w, err := wal.New(nil, nil, tmp)
+	if err != nil {
+		return errors.Wrap(err, "open snapshot")
+	}
+	defer func() {
+		if w != nil {
+			w.Close()
+		}
+		os.RemoveAll(tmp)
+	}()
+
+	buf := encbuf{}
+	buf.putByte(byte(snapshotRecordMeta))
+	buf.putUvarint(last)
+	buf.putVarint64(fi.Size())
+	buf.putBE64(h.lastSeriesID)
+
+	if err := w.Log(buf.get()); err != nil {
+		return errors.Wrap(err, "write snapshot meta")
+	}
+
+	numSeries := 0
+	buf.reset()
+	buf.putByte(byte(snapshotRecordSeries))
+
+	for i := 0; i < stripeSize; i++ {
+		h.series.locks[i].RLock()
+
+		for _, s := range h.series.series[i] {
+			s.Lock()
+			encodeSnapshotSeries(&buf, s)
+			s.Unlock()
+			numSeries++
+		}
+		h.series.locks[i].RUnlock()
+
+		if buf.len() >= snapshotRecordSize {
+			if err := w.Log(buf.get()); err != nil {
+				return errors.Wrap(err, "write snapshot series")
+			}
+			buf.reset()
+			buf.putByte(byte(snapshotRecordSeries))
+		}
+	}
+	if buf.len() > 1 {
+		if err := w.Log(buf.get()); err != nil {
+			return errors.Wrap(err, "write snapshot series")
+		}
+	}
+
+	var stones []Stone
+	err = h.tombstones.Iter(func(ref uint64, ivs Intervals) error {
+		stones = append(stones, Stone{ref: ref, intervals: ivs})
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "iterate tombstones")
+	}
+	if len(stones) > 0 {
+		var enc RecordEncoder
+		if err := w.Log(enc.Tombstones(stones, nil)); err != nil {
+			return errors.Wrap(err, "write snapshot tombstones")
+		}
+	}
+
+	err = w.Close()
+	w = nil
+	if err != nil {
+		return errors.Wrap(err, "close snapshot")
+	}
+	if err := fileutil.Replace(tmp, dir); err != nil {
+		return errors.Wrap(err, "rename snapshot")
+	}
+	level.Info(h.logger).Log("msg", "head snapshot written", "series", numSeries, "duration", time.Since(start))
+	return nil
+}
+
+func encodeSnapshotSeries(buf *encbuf, s *memSeries) {
+	buf.putBE64(s.ref)
+	buf.putUvarint(len(s.lset))
+	for _, l := range s.lset {
+		buf.putUvarintStr(l.Name)
+		buf.putUvarintStr(l.Value)
+	}
+	buf.putVarint64(s.nextAt)
+	for _, smpl := range s.sampleBuf {
+		buf.putVarint64(smpl.t)
+		buf.putBE64(math.Float64bits(smpl.v))
+	}
+	buf.putUvarint(len(s.chunks))
+	for _, c := range s.chunks {
+		buf.putVarint64(c.minTime)
+		buf.putVarint64(c.maxTime)
+		buf.putByte(byte(c.chunk.Encoding()))
+		buf.putUvarint(len(c.chunk.Bytes()))
+		buf.putBytes(c.chunk.Bytes())
+	}
+}
+
+// readSnapshot reads and fully decodes the head snapshot in dir.
+func readSnapshot(dir string) (*headSnapshot, error) {
+	sr, err := wal.NewSegmentsReader(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "open snapshot")
+	}
+	defer sr.Close()
+
+	var (
+		r    = wal.NewReader(sr)
+		snap *headSnapshot
+		dec  RecordDecoder
+	)
+	for r.Next() {
+		rec := r.Record()
+		if len(rec) == 0 {
+			return nil, errors.New("empty snapshot record")
+		}
+		if snap == nil && RecordType(rec[0]) != snapshotRecordMeta {
+			return nil, errors.New("snapshot does not start with meta record")
+		}
+		switch RecordType(rec[0]) {
+		case snapshotRecordMeta:
+			d := decbuf{b: rec[1:]}
+			snap = &headSnapshot{
+				walSegment:   d.uvarint(),
+				walSize:      d.varint64(),
+				lastSeriesID: d.be64(),
+			}
+			if d.err() != nil {
+				return nil, errors.Wrap(d.err(), "decode snapshot meta")
+			}
+		case snapshotRecordSeries:
+			d := decbuf{b: rec[1:]}
+			for d.len() > 0 && d.err() == nil {
+				s, err := decodeSnapshotSeries(&d)
+				if err != nil {
+					return nil, err
+				}
+				snap.series = append(snap.series, s)
+			}
+			if d.err() != nil {
+				return nil, errors.Wrap(d.err(), "decode snapshot series")
+			}
+		case RecordTombstones:
+			stones, err := dec.Tombstones(rec, nil)
+			if err != nil {
+				return nil, errors.Wrap(err, "decode snapshot tombstones")
+			}
+			snap.stones = append(snap.stones, stones...)
+		default:
+			return nil, errors.Errorf("invalid snapshot record type %d", rec[0])
+		}
+	}
+	if err := r.Err(); err != nil {
+		return nil, errors.Wrap(err, "read snapshot records")
+	}
+	if snap == nil {
+		return nil, errors.New("empty snapshot")
+	}
+	return snap, nil
+}
+
+func decodeSnapshotSeries(d *decbuf) (*snapshotSeries, error) {
+	s := &snapshotSeries{ref: d.be64()}
+
+	// Label names and values take at least a byte each.
+	s.lset = make(labels.Labels, d.uvarintLen(2))
+	for i := range s.lset {
+		s.lset[i].Name = d.uvarintStr()
+		s.lset[i].Value = d.uvarintStr()
+	}
+	s.nextAt = d.varint64()
+	for i := range s.sampleBuf {
+		s.sampleBuf[i].t = d.varint64()
+		s.sampleBuf[i].v = math.Float64frombits(d.be64())
+	}
+	// Chunks take at least four bytes.
+	s.chunks = make([]*memChunk, d.uvarintLen(4))
+	for i := range s.chunks {
+		mint, maxt := d.varint64(), d.varint64()
+		enc := chunkenc.Encoding(d.byte())
+		cb := d.decbuf(d.uvarint())
+		if d.err() != nil {
+			return nil, errors.Wrap(d.err(), "decode snapshot series")
+		}
+		// The record buffer is reused by the reader.
+		c, err := chunkenc.FromData(enc, append([]byte(nil), cb.get()...))
+		if err != nil {
+			return nil, errors.Wrapf(err, "decode chunk of series %d", s.ref)
+		}
+		s.chunks[i] = &memChunk{chunk: c, minTime: mint, maxTime: maxt}
+	}
+	if d.err() != nil {
+		return nil, errors.Wrap(d.err(), "decode snapshot series")
+	}
+	if len(s.chunks) > 0 {
+		// Chunks decoded from their data cannot be appended to. Samples are
+		// written at bit offsets and the unused bits of the last byte are lost.
+		// The open chunk is thus rebuilt from its samples.
+		last := s.chunks[len(s.chunks)-1]
+
+		c, app, err := rebuildChunk(last.chunk)
+		if err != nil {
+			return nil, errors.Wrapf(err, "rebuild open chunk of series %d", s.ref)
+		}
+		last.chunk, s.app = c, app
+	}
+	return s, nil
+}
+
+// rebuildChunk returns an appendable chunk of the same encoding holding the
+// samples of c.
+func rebuildChunk(c chunkenc.Chunk) (chunkenc.Chunk, chunkenc.Appender, error) {
+	var nc chunkenc.Chunk
+
+	switch c := c.(type) {
+	case *chunkenc.IntChunk:
+		// Int chunks are byte-aligned and can be appended to as they are.
+		app, err := c.Appender()
+		return c, app, err
+	case *chunkenc.ScaledChunk:
+		if c.Exact() {
+			nc = chunkenc.NewExactScaledChunk(c.Precision())
+		} else {
+			nc = chunkenc.NewScaledChunk(c.Precision())
+		}
+	default:
+		nc = chunkenc.NewXORChunk()
+	}
+	ts, vs, err := chunkenc.Decode(c, nil, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	app, err := nc.Appender()
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := range ts {
+		app.Append(ts[i], vs[i])
+	}
+	return nc, app, nil
+}
+
+// lastIntValue returns the value of the last sample of c if it stores integers.
+func lastIntValue(c chunkenc.Chunk) int64 {
+	var v int64
+	if it, ok := c.Iterator().(chunkenc.IntIterator); ok {
+		for it.Next() {
+			_, v = it.AtInt()
+		}
+	}
+	return v
+}
+
+// loadSnapshot restores the head from the snapshot written on the last
+// shutdown. It returns false if there is no snapshot or if it is stale or
+// unreadable, in which case the head was not modified and the WAL must be
+// replayed. The snapshot is removed in any case as the WAL is written to
+// afterwards.
+func (h *Head) loadSnapshot() bool {
+	dir := filepath.Join(h.wal.Dir(), headSnapshotDirname)
+
+	if _, err := os.Stat(dir); err != nil {
+		return false
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			level.Warn(h.logger).Log("msg", "remove head snapshot", "err", err)
+		}
+	}()
+	start := time.Now()
+
+	snap, err := readSnapshot(dir)
+	if err != nil {
+		level.Warn(h.logger).Log("msg", "reading head snapshot failed, replaying WAL", "err", err)
+		return false
+	}
+	_, last, err := h.wal.Segments()
+	if err != nil {
+		level.Warn(h.logger).Log("msg", "get segment range, replaying WAL", "err", err)
+		return false
+	}
+	fi, err := os.Stat(wal.SegmentName(h.wal.Dir(), last))
+	if err != nil {
+		level.Warn(h.logger).Log("msg", "stat last segment, replaying WAL", "err", err)
+		return false
+	}
+	if last != snap.walSegment || fi.Size() != snap.walSize {
+		level.Info(h.logger).Log("msg", "head snapshot is stale, replaying WAL")
+		return false
+	}
+
+	minValidTime := h.MinTime()
+	// If the min time is still uninitialized (no persisted blocks yet),
+	// we accept all chunks from the snapshot.
+	if minValidTime == math.MaxInt64 {
+		minValidTime = math.MinInt64
+	}
+	for _, s := range snap.series {
+		ms, _ := h.getOrCreateWithID(s.ref, s.lset.Hash(), s.lset)
+
+		// Drop chunks that were already persisted in blocks.
+		chunks := s.chunks
+		for len(chunks) > 0 && chunks[0].maxTime < minValidTime {
+			chunks = chunks[1:]
+		}
+		if len(chunks) == 0 {
+			continue
+		}
+		ms.chunks = chunks
+		ms.app = s.app
+		ms.nextAt = s.nextAt
+		ms.sampleBuf = s.sampleBuf
+		ms.lastValue = s.sampleBuf[3].v
+		ms.lastInt = lastIntValue(chunks[len(chunks)-1].chunk)
+
+		h.metrics.chunksCreated.Add(float64(len(chunks)))
+		h.metrics.chunks.Add(float64(len(chunks)))
+		h.updateMinMaxTime(chunks[0].minTime, chunks[len(chunks)-1].maxTime)
+	}
+	if h.lastSeriesID < snap.lastSeriesID {
+		h.lastSeriesID = snap.lastSeriesID
+	}
+	for _, s := range snap.stones {
+		for _, itv := range s.intervals {
+			if itv.Maxt < minValidTime {
+				continue
+			}
+			h.tombstones.addInterval(s.ref, itv)
+		}
+	}
+	level.Info(h.logger).Log("msg", "head restored from snapshot", "series", len(snap.series), "duration", time.Since(start))
+	return true
+}
@@ -17,9 +17,14 @@ import (
 	"io/ioutil"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"sort"
+	"strconv"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/pkg/errors"
 	"github.com/prometheus/tsdb/chunkenc"
 	"github.com/prometheus/tsdb/chunks"
 	"github.com/prometheus/tsdb/index"
@@ -150,6 +155,106 @@ func TestHead_ReadWAL(t *testing.T) {
 	testutil.Equals(t, []sample{{100, 3}}, expandChunk(s100.iterator(0)))
 }
 
+func TestHead_StableRefsAcrossTruncation(t *testing.T) {
+	h, err := NewHead(nil, nil, nil, 1000)
+	testutil.Ok(t, err)
+	defer h.Close()
+
+	lsets := []labels.Labels{
+		labels.FromStrings("a", "1"),
+		labels.FromStrings("a", "2"),
+		labels.FromStrings("a", "3"),
+		labels.FromStrings("a", "4"),
+	}
+	var refs []uint64
+
+	app := h.Appender()
+	for _, lset := range lsets {
+		ref, err := app.Add(lset, 100, 1)
+		testutil.Ok(t, err)
+		refs = append(refs, ref)
+	}
+	// Only the last series keeps receiving samples.
+	testutil.Ok(t, app.AddFast(refs[3], 2500, 1))
+	testutil.Ok(t, app.Commit())
+
+	testutil.Ok(t, h.Truncate(2000))
+	for _, ref := range refs[:3] {
+		testutil.Assert(t, h.series.getByID(ref) == nil, "series %d not removed", ref)
+	}
+
+	// Appending by reference or by labels recreates the series under its previous reference.
+	app = h.Appender()
+	testutil.Ok(t, app.AddFast(refs[0], 2600, 1))
+	ref, err := app.Add(lsets[1], 2600, 1)
+	testutil.Ok(t, err)
+	testutil.Equals(t, refs[1], ref)
+	testutil.Ok(t, app.Commit())
+
+	for i, ref := range refs[:2] {
+		s := h.series.getByID(ref)
+		testutil.Assert(t, s != nil, "series %d not recreated", ref)
+		testutil.Equals(t, lsets[i], s.lset)
+	}
+
+	// References of series that were not appended to remain valid for the
+	// following truncations and are released afterwards.
+	for i := 1; i < retiredSeriesGCs; i++ {
+		testutil.Ok(t, h.Truncate(2500+int64(i)))
+
+		s, lset := h.seriesByRef(refs[2])
+		testutil.Assert(t, s == nil, "series %d recreated", refs[2])
+		testutil.Equals(t, lsets[2], lset)
+	}
+	testutil.Ok(t, h.Truncate(2550))
+
+	app = h.Appender()
+	err = app.AddFast(refs[2], 2700, 1)
+	testutil.Equals(t, ErrNotFound, errors.Cause(err))
+	testutil.Ok(t, app.Rollback())
+}
+
+func TestHead_RetiredRefsResolveDuringRecreation(t *testing.T) {
+	h, err := NewHead(nil, nil, nil, 1000)
+	testutil.Ok(t, err)
+	defer h.Close()
+
+	const n = 100
+
+	refs := make([]uint64, 0, n)
+	lsets := make([]labels.Labels, 0, n)
+
+	app := h.Appender()
+	for i := 0; i < n; i++ {
+		lset := labels.FromStrings("a", strconv.Itoa(i))
+		ref, err := app.Add(lset, 100, 1)
+		testutil.Ok(t, err)
+		refs = append(refs, ref)
+		lsets = append(lsets, lset)
+	}
+	testutil.Ok(t, app.Commit())
+	testutil.Ok(t, h.Truncate(2000))
+
+	// Recreating series by their labels while resolving their references must
+	// never leave a reference unresolvable.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		app := h.Appender()
+		for _, lset := range lsets {
+			_, err := app.Add(lset, 2100, 1)
+			testutil.Ok(t, err)
+		}
+		testutil.Ok(t, app.Commit())
+	}()
+	for _, ref := range refs {
+		s, lset := h.seriesByRef(ref)
+		testutil.Assert(t, s != nil || lset != nil, "reference %d not resolvable", ref)
+	}
+	wg.Wait()
+}
+
 func TestHead_Truncate(t *testing.T) {
 	h, err := NewHead(nil, nil, nil, 1000)
 	testutil.Ok(t, err)
@@ -860,3 +965,255 @@ func TestHead_LogRollback(t *testing.T) {
 	testutil.Assert(t, ok, "expected series record but got %+v", recs[0])
 	testutil.Equals(t, []RefSeries{{Ref: 1, Labels: labels.FromStrings("a", "b")}}, series)
 }
+
+func TestHead_SeriesStats(t *testing.T) {
+	h, err := NewHead(nil, nil, nil, 1000)
+	testutil.Ok(t, err)
+	defer h.Close()
+
+	app := h.Appender()
+	for i := int64(0); i < 300; i++ {
+		_, err := app.Add(labels.FromStrings("a", "1"), i*10, float64(i))
+		testutil.Ok(t, err)
+	}
+	testutil.Ok(t, app.Commit())
+
+	s := h.series.getByHash(labels.FromStrings("a", "1").Hash(), labels.FromStrings("a", "1"))
+	testutil.Assert(t, s != nil, "series not found")
+
+	var bytes uint64
+	for _, c := range s.chunks {
+		bytes += uint64(len(c.chunk.Bytes()))
+	}
+
+	stats, err := h.indexRange(0, 3000).SeriesStats(s.ref)
+	testutil.Ok(t, err)
+	testutil.Equals(t, index.SeriesStats{Chunks: len(s.chunks), Samples: 300, Bytes: bytes}, stats)
+
+	// Only chunks within the range are included.
+	stats, err = h.indexRange(0, 100).SeriesStats(s.ref)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, stats.Chunks)
+
+	_, err = h.indexRange(0, 3000).SeriesStats(s.ref + 1)
+	testutil.Equals(t, ErrNotFound, err)
+}
+
+func TestHead_FutureTolerance(t *testing.T) {
+	h, err := NewHead(nil, nil, nil, 1000)
+	testutil.Ok(t, err)
+	defer h.Close()
+
+	h.futureTolerance = int64(10 * time.Minute / time.Millisecond)
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	lset := labels.FromStrings("a", "1")
+
+	// A sample far in the future does not initialize the head.
+	app := h.Appender()
+	_, err = app.Add(lset, now+int64(time.Hour/time.Millisecond), 0)
+	testutil.Equals(t, ErrTooFarInFuture, err)
+
+	ref, err := app.Add(lset, now, 0)
+	testutil.Ok(t, err)
+	testutil.Equals(t, ErrTooFarInFuture, app.AddFast(ref, now+int64(time.Hour/time.Millisecond), 0))
+	testutil.Ok(t, app.AddFast(ref, now+1000, 0))
+	testutil.Ok(t, app.Commit())
+	testutil.Equals(t, now+1000, h.MaxTime())
+
+	// Samples before the writable window are still out of bounds.
+	app = h.Appender()
+	_, err = app.Add(lset, now-10000, 0)
+	testutil.Equals(t, ErrOutOfBounds, err)
+	testutil.Ok(t, app.Rollback())
+}
+
+func TestHead_DuplicateSamples(t *testing.T) {
+	h, err := NewHead(nil, nil, nil, 1000)
+	testutil.Ok(t, err)
+	defer h.Close()
+
+	lset := labels.FromStrings("a", "1")
+
+	app := h.Appender()
+	ref, err := app.Add(lset, 100, 1)
+	testutil.Ok(t, err)
+	testutil.Ok(t, app.Commit())
+
+	// Identical duplicates are dropped without being appended.
+	happ := h.appender()
+	testutil.Ok(t, happ.AddFast(ref, 100, 1))
+	testutil.Equals(t, 0, len(happ.samples))
+
+	testutil.Equals(t, ErrAmendSample, happ.AddFast(ref, 100, 2))
+	testutil.Equals(t, ErrOutOfOrderSample, happ.AddFast(ref, 99, 2))
+	testutil.Ok(t, happ.AddFast(ref, 101, 2))
+	testutil.Ok(t, happ.Commit())
+
+	s := h.series.getByID(ref)
+	testutil.Equals(t, 2, s.chunks[0].chunk.NumSamples())
+}
+
+func TestHead_AutoChunkEncoding(t *testing.T) {
+	h, err := NewHead(nil, nil, nil, 100000)
+	testutil.Ok(t, err)
+	defer h.Close()
+	h.autoChunkEncoding = true
+
+	var (
+		ints  = labels.FromStrings("a", "ints")
+		noise = labels.FromStrings("a", "noise")
+		exp   = map[string][]sample{}
+	)
+	app := h.Appender()
+	for i := 0; i < 100; i++ {
+		ts := int64(i) * 100
+		iv, nv := float64(i*i), rand.NormFloat64()
+
+		_, err := app.Add(ints, ts, iv)
+		testutil.Ok(t, err)
+		_, err = app.Add(noise, ts, nv)
+		testutil.Ok(t, err)
+
+		exp[ints.String()] = append(exp[ints.String()], sample{t: ts, v: iv})
+		exp[noise.String()] = append(exp[noise.String()], sample{t: ts, v: nv})
+	}
+	testutil.Ok(t, app.Commit())
+
+	testutil.Equals(t, chunkenc.EncScaled, h.series.getByHash(ints.Hash(), ints).chunks[0].chunk.Encoding())
+	testutil.Equals(t, chunkenc.EncXOR, h.series.getByHash(noise.Hash(), noise).chunks[0].chunk.Encoding())
+
+	q, err := NewBlockQuerier(h, 0, 10000)
+	testutil.Ok(t, err)
+	defer q.Close()
+	testutil.Equals(t, exp, query(t, q, labels.NewMustRegexpMatcher("a", ".+")))
+}
+
+func TestHead_ConcurrentReads(t *testing.T) {
+	h, err := NewHead(nil, nil, nil, 10000)
+	testutil.Ok(t, err)
+	defer h.Close()
+
+	lbls, err := labels.ReadLabels("testdata/20kseries.json", 100)
+	testutil.Ok(t, err)
+
+	add := func(ts int64) error {
+		app := h.Appender()
+		for _, l := range lbls {
+			if _, err := app.Add(l, ts, rand.Float64()); err != nil {
+				return err
+			}
+		}
+		return app.Commit()
+	}
+	for ts := int64(0); ts < 100; ts++ {
+		testutil.Ok(t, add(ts))
+	}
+	// Keep appending while the head is read.
+	var (
+		done = make(chan struct{})
+		errc = make(chan error, 1)
+	)
+	go func() {
+		ts := int64(100)
+		for {
+			select {
+			case <-done:
+				errc <- nil
+				return
+			default:
+			}
+			if err := add(ts); err != nil {
+				errc <- err
+				return
+			}
+			ts++
+		}
+	}()
+	err = readConcurrently(h, 8, 10)
+	close(done)
+
+	testutil.Ok(t, err)
+	testutil.Ok(t, <-errc)
+}
+
+func TestHead_Snapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_head_snapshot")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	openHead := func() *Head {
+		w, err := wal.New(nil, nil, dir)
+		testutil.Ok(t, err)
+		h, err := NewHead(nil, nil, w, 100000)
+		testutil.Ok(t, err)
+		h.snapshotOnShutdown = true
+		h.autoChunkEncoding = true
+		return h
+	}
+	h := openHead()
+	testutil.Ok(t, h.Init())
+
+	exp := map[string][]sample{}
+	add := func(h *Head, from, to int) {
+		app := h.Appender()
+		for i := from; i < to; i++ {
+			for _, lset := range []labels.Labels{
+				labels.FromStrings("a", "ints"),
+				labels.FromStrings("a", "noise"),
+			} {
+				v := float64(i)
+				if lset.Get("a") == "noise" {
+					v = rand.Float64()
+				}
+				_, err := app.Add(lset, int64(i)*100, v)
+				testutil.Ok(t, err)
+				exp[lset.String()] = append(exp[lset.String()], sample{t: int64(i) * 100, v: v})
+			}
+		}
+		testutil.Ok(t, app.Commit())
+	}
+	// Write enough samples to cut multiple chunks.
+	add(h, 0, 500)
+
+	testutil.Ok(t, h.Delete(0, 950, labels.NewEqualMatcher("a", "ints")))
+	exp[labels.FromStrings("a", "ints").String()] = exp[labels.FromStrings("a", "ints").String()][10:]
+
+	testutil.Ok(t, h.Close())
+
+	h = openHead()
+	testutil.Assert(t, h.loadSnapshot(), "snapshot not loaded")
+	h.postings.EnsureOrder()
+
+	// The snapshot is removed once it was loaded.
+	_, err = os.Stat(filepath.Join(dir, headSnapshotDirname))
+	testutil.Assert(t, os.IsNotExist(err), "snapshot not removed")
+
+	// Appends continue the restored chunks.
+	add(h, 500, 600)
+
+	q, err := NewBlockQuerier(h, 0, 100000)
+	testutil.Ok(t, err)
+	testutil.Equals(t, exp, query(t, q, labels.NewMustRegexpMatcher("a", ".+")))
+	testutil.Ok(t, q.Close())
+	testutil.Ok(t, h.Close())
+
+	// A snapshot the WAL was written to after is stale and the WAL is
+	// replayed instead.
+	w, err := wal.New(nil, nil, dir)
+	testutil.Ok(t, err)
+	var enc RecordEncoder
+	testutil.Ok(t, w.Log(enc.Series([]RefSeries{{Ref: 1000, Labels: labels.FromStrings("a", "new")}}, nil)))
+	testutil.Ok(t, w.Close())
+
+	h = openHead()
+	defer h.Close()
+
+	testutil.Assert(t, !h.loadSnapshot(), "stale snapshot loaded")
+	testutil.Ok(t, h.Init())
+	testutil.Assert(t, h.series.getByID(1000) != nil, "WAL not replayed")
+
+	q, err = NewBlockQuerier(h, 0, 100000)
+	testutil.Ok(t, err)
+	defer q.Close()
+	testutil.Equals(t, exp, query(t, q, labels.NewMustRegexpMatcher("a", ".+")))
+}
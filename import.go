@@ -0,0 +1,213 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/tsdb/fileutil"
+)
+
+// ImportOptions configures DB.ImportBlocks.
+type ImportOptions struct {
+	// NewULIDs assigns new ULIDs to all imported blocks. Otherwise only blocks
+	// whose ULID exists in the data directory already are assigned a new one.
+	NewULIDs bool
+	// Copy copies the files of the blocks instead of hard-linking them, which
+	// keeps the source directory independent of the DB. Files that cannot be
+	// linked, e.g. across file systems, are always copied.
+	Copy bool
+}
+
+// ImportBlocks imports all blocks in the directory src of another DB, e.g. to
+// seed a new node with existing data. All blocks are verified before any of
+// them is added to the data directory. Blocks overlapping each other, blocks
+// of the DB or the time range of the head are rejected as the DB cannot load
+// overlapping blocks. A compaction is triggered after the blocks were loaded.
+func (db *DB) ImportBlocks(src string, opts *ImportOptions) ([]RestoredBlock, error) {
+	if opts == nil {
+		opts = &ImportOptions{}
+	}
+	if db.options().WALOnly {
+		return nil, errors.New("cannot import blocks in WAL only mode")
+	}
+	db.cmtx.Lock()
+	defer db.cmtx.Unlock()
+
+	srcDirs, err := blockDirs(src)
+	if err != nil {
+		return nil, errors.Wrapf(err, "list block dirs in %q", src)
+	}
+	var (
+		metas   []BlockMeta
+		imports []*BlockMeta
+		dirs    []string
+	)
+	for _, b := range db.Blocks() {
+		metas = append(metas, b.Meta())
+	}
+	for _, d := range srcDirs {
+		meta, err := db.verifyImport(d)
+		if err != nil {
+			return nil, errors.Wrapf(err, "verify block %q", d)
+		}
+		if meta == nil {
+			continue
+		}
+		if !db.head.empty() && meta.MaxTime > db.head.MinTime() {
+			return nil, errors.Errorf("block %s overlaps the head starting at %d", meta.ULID, db.head.MinTime())
+		}
+		metas = append(metas, *meta)
+		imports = append(imports, meta)
+		dirs = append(dirs, d)
+	}
+	sort.Slice(metas, func(i, j int) bool {
+		return metas[i].MinTime < metas[j].MinTime
+	})
+	if overlaps := OverlappingBlocks(metas); len(overlaps) > 0 {
+		return nil, errors.Errorf("imported blocks overlap: %s", overlaps)
+	}
+
+	var (
+		res     []RestoredBlock
+		entropy = rand.New(rand.NewSource(time.Now().UnixNano()))
+	)
+	for i, meta := range imports {
+		rb := RestoredBlock{Source: meta.ULID, ULID: meta.ULID}
+
+		// Blocks pending deletion may still occupy their directory.
+		if _, err := os.Stat(filepath.Join(db.dir, meta.ULID.String())); err == nil || opts.NewULIDs {
+			rb.ULID = ulid.MustNew(ulid.Now(), entropy)
+		}
+		meta.ULID = rb.ULID
+
+		if err := importBlock(dirs[i], filepath.Join(db.dir, rb.ULID.String()), meta, opts.Copy); err != nil {
+			return res, errors.Wrapf(err, "import block %s", rb.Source)
+		}
+		level.Info(db.logger).Log("msg", "imported block", "source", rb.Source, "ulid", rb.ULID, "mint", meta.MinTime, "maxt", meta.MaxTime)
+
+		res = append(res, rb)
+	}
+	if len(res) == 0 {
+		return nil, nil
+	}
+	if err := db.reload(); err != nil {
+		return res, errors.Wrap(err, "reload blocks")
+	}
+	select {
+	case db.compactc <- struct{}{}:
+	default:
+	}
+	return res, nil
+}
+
+// verifyImport checks that the block in dir can be imported and returns its
+// meta. It returns nil for blocks that are being deleted.
+func (db *DB) verifyImport(dir string) (*BlockMeta, error) {
+	meta, err := readMetaFile(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "read meta")
+	}
+	if meta.PendingDeletion {
+		return nil, nil
+	}
+	if mark, err := readBlockMark(dir, DeletionMarkFilename); err != nil || mark != nil {
+		return nil, err
+	}
+	if unit := db.options().TimestampUnit; !meta.TimestampUnit.Equal(unit) {
+		return nil, errors.Errorf("block has timestamp unit %s but the database uses %s", meta.TimestampUnit, unit)
+	}
+	if err := VerifyBlock(dir); err != nil {
+		return nil, errors.Wrap(err, "verify checksums")
+	}
+	b, err := OpenBlock(dir, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "open block")
+	}
+	return meta, b.Close()
+}
+
+// importBlock hard-links or copies the block in src to dst and replaces its
+// meta file with meta. The block only appears in dst once it is complete.
+func importBlock(src, dst string, meta *BlockMeta, forceCopy bool) error {
+	tmp := dst + ".tmp"
+
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
+	}
+	err := linkDir(src, tmp, forceCopy)
+	if err == nil {
+		// The meta file is replaced by a rename and a linked source file
+		// remains unchanged.
+		err = writeMetaFile(tmp, meta)
+	}
+	if err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	return fileutil.Rename(tmp, dst)
+}
+
+// linkDir recreates the directory tree of src in dst and hard-links all files.
+// Files are copied if forceCopy is set or they cannot be linked.
+func linkDir(src, dst string, forceCopy bool) error {
+	return filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		if fi.IsDir() {
+			return os.MkdirAll(target, 0777)
+		}
+		if !forceCopy && os.Link(path, target) == nil {
+			return nil
+		}
+		return copyFile(path, target)
+	})
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
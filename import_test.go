@@ -0,0 +1,101 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/oklog/ulid"
+	"github.com/prometheus/tsdb/labels"
+	"github.com/prometheus/tsdb/testutil"
+)
+
+func TestDB_ImportBlocks(t *testing.T) {
+	src, err := ioutil.TempDir("", "import")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(src)
+
+	b := createPopulatedBlock(t, src, 2, 10)
+	source := b.Meta()
+	testutil.Ok(t, b.Close())
+
+	db, close := openTestDB(t, nil)
+	defer close()
+	defer db.Close()
+
+	res, err := db.ImportBlocks(src, nil)
+	testutil.Ok(t, err)
+	testutil.Equals(t, []RestoredBlock{{Source: source.ULID, ULID: source.ULID}}, res)
+	testutil.Equals(t, 1, len(db.Blocks()))
+
+	q, err := db.Querier(source.MinTime, source.MaxTime)
+	testutil.Ok(t, err)
+	series := query(t, q, labels.NewMustRegexpMatcher("", ".*"))
+	testutil.Ok(t, q.Close())
+	testutil.Equals(t, 2, len(series))
+
+	// Blocks overlapping blocks of the DB are rejected, even with new ULIDs.
+	_, err = db.ImportBlocks(src, &ImportOptions{NewULIDs: true})
+	testutil.NotOk(t, err)
+	testutil.Equals(t, 1, len(db.Blocks()))
+
+	// Blocks with an existing ULID are assigned a new one.
+	src2, err := ioutil.TempDir("", "import")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(src2)
+
+	createEmptyBlock(t, filepath.Join(src2, source.ULID.String()), &BlockMeta{
+		ULID:       source.ULID,
+		MinTime:    source.MaxTime,
+		MaxTime:    source.MaxTime + 1000,
+		Compaction: BlockMetaCompaction{Level: 1, Sources: []ulid.ULID{source.ULID}},
+	}).Close()
+
+	res, err = db.ImportBlocks(src2, &ImportOptions{Copy: true})
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(res))
+	testutil.Equals(t, source.ULID, res[0].Source)
+	testutil.Assert(t, res[0].ULID != source.ULID, "conflicting ULID not rewritten")
+	testutil.Equals(t, 2, len(db.Blocks()))
+
+	// The source blocks are left unchanged.
+	meta, err := readMetaFile(filepath.Join(src2, source.ULID.String()))
+	testutil.Ok(t, err)
+	testutil.Equals(t, source.ULID, meta.ULID)
+
+	// Blocks overlapping the head are rejected.
+	app := db.Appender()
+	_, err = app.Add(labels.FromStrings("a", "b"), source.MaxTime+5000, 1)
+	testutil.Ok(t, err)
+	testutil.Ok(t, app.Commit())
+
+	src3, err := ioutil.TempDir("", "import")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(src3)
+
+	id := ulid.MustNew(100, nil)
+	createEmptyBlock(t, filepath.Join(src3, id.String()), &BlockMeta{
+		ULID:       id,
+		MinTime:    source.MaxTime + 1000,
+		MaxTime:    source.MaxTime + 10000,
+		Compaction: BlockMetaCompaction{Level: 1, Sources: []ulid.ULID{id}},
+	}).Close()
+
+	_, err = db.ImportBlocks(src3, nil)
+	testutil.NotOk(t, err)
+	testutil.Equals(t, 2, len(db.Blocks()))
+}
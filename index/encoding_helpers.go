@@ -54,6 +54,12 @@ func (e *encbuf) putUvarintStr(s string) {
 	e.putString(s)
 }
 
+// yoloString returns a string backed by b without copying it.
+// It must only be used for short-lived comparisons.
+func yoloString(b []byte) string {
+	return *((*string)(unsafe.Pointer(&b)))
+}
+
 // putHash appends a hash over the buffers current contents to the buffer.
 func (e *encbuf) putHash(h hash.Hash) {
 	h.Reset()
@@ -88,7 +94,7 @@ func (d *decbuf) uvarintStr() string {
 	if d.e != nil {
 		return ""
 	}
-	if len(d.b) < int(l) {
+	if uint64(len(d.b)) < l {
 		d.e = errInvalidSize
 		return ""
 	}
@@ -97,6 +103,36 @@ func (d *decbuf) uvarintStr() string {
 	return s
 }
 
+// uvarintBytes returns a length-prefixed byte slice without copying it.
+func (d *decbuf) uvarintBytes() []byte {
+	l := d.uvarint64()
+	if d.e != nil {
+		return nil
+	}
+	if uint64(len(d.b)) < l {
+		d.e = errInvalidSize
+		return nil
+	}
+	b := d.b[:l]
+	d.b = d.b[l:]
+	return b
+}
+
+// uvarintLen reads the number of entries of a list that each take at least
+// minSize bytes. It fails if the remaining bytes cannot hold that many entries,
+// so the result is safe for sizing allocations.
+func (d *decbuf) uvarintLen(minSize int) int {
+	l := d.uvarint64()
+	if d.e != nil {
+		return 0
+	}
+	if l > uint64(len(d.b)/minSize) {
+		d.e = errInvalidSize
+		return 0
+	}
+	return int(l)
+}
+
 func (d *decbuf) varint64() int64 {
 	if d.e != nil {
 		return 0
@@ -127,7 +163,7 @@ func (d *decbuf) be64() uint64 {
 	if d.e != nil {
 		return 0
 	}
-	if len(d.b) < 4 {
+	if len(d.b) < 8 {
 		d.e = errInvalidSize
 		return 0
 	}
@@ -166,7 +202,7 @@ func (d *decbuf) decbuf(l int) decbuf {
 	if d.e != nil {
 		return decbuf{e: d.e}
 	}
-	if l > len(d.b) {
+	if l < 0 || l > len(d.b) {
 		return decbuf{e: errInvalidSize}
 	}
 	r := decbuf{b: d.b[:l]}
@@ -0,0 +1,253 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package index
+
+import (
+	"encoding/binary"
+	"io"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/tsdb/fileutil"
+)
+
+const (
+	// MagicIndexHeader 4 bytes at the head of an index header file.
+	MagicIndexHeader = 0xBAAAD7E1
+
+	indexHeaderFormatV1 = 1
+)
+
+// headerRegion is a byte range of an index file held by its header.
+type headerRegion struct {
+	off  int
+	data []byte
+}
+
+// BuildHeader reads the regions of the index of the given size from r that
+// are required to open a Reader: the format version, the TOC, the symbol
+// table and the offset tables of label indices and postings. It returns them
+// encoded as an index header, which is much smaller than the index itself.
+// Separately stored postings are not part of the header.
+func BuildHeader(r io.ReaderAt, size int64) ([]byte, error) {
+	readAt := func(off, l int) ([]byte, error) {
+		if off < 0 || int64(off+l) > size {
+			return nil, fileutil.NewErrCorrupt(r, off, "range of length %d exceeds size %d", l, size)
+		}
+		b := make([]byte, l)
+		if n, err := r.ReadAt(b, int64(off)); err != nil && !(err == io.EOF && n == l) {
+			return nil, err
+		}
+		return b, nil
+	}
+	// readSection reads the section at off, which starts with its length and
+	// ends with a checksum.
+	readSection := func(off int) (headerRegion, error) {
+		b, err := readAt(off, 4)
+		if err != nil {
+			return headerRegion{}, err
+		}
+		data, err := readAt(off, 4+int(binary.BigEndian.Uint32(b))+4)
+		return headerRegion{off: off, data: data}, err
+	}
+
+	head, err := readAt(0, 5)
+	if err != nil {
+		return nil, errors.Wrap(err, "read index header")
+	}
+	if m := binary.BigEndian.Uint32(head); m != MagicIndex {
+		return nil, fileutil.NewErrCorrupt(r, 0, "invalid magic number %x", m)
+	}
+	version := int(head[4])
+	if version < indexFormatV1 || version > FormatVersion {
+		return nil, errors.Errorf("unknown index file version %d", version)
+	}
+	var flags byte
+	if version >= indexFormatV8 {
+		if head, err = readAt(0, 6); err != nil {
+			return nil, errors.Wrap(err, "read index header")
+		}
+		flags = head[5]
+	}
+
+	tocLen := indexTOCLen
+	if version >= indexFormatV4 {
+		tocLen = indexTOCLenV4
+	}
+	toc, err := readAt(int(size)-tocLen, tocLen)
+	if err != nil {
+		return nil, errors.Wrap(err, "read TOC")
+	}
+	d := decbuf{b: toc[:len(toc)-4]}
+	if d.crc32() != binary.BigEndian.Uint32(toc[len(toc)-4:]) {
+		return nil, fileutil.NewErrCorrupt(r, int(size)-tocLen, "TOC checksum mismatch")
+	}
+	// The series, label indices and postings sections are skipped.
+	symbols := int(d.be64())
+	d.be64()
+	d.be64()
+	labelIndicesTable := int(d.be64())
+	d.be64()
+	postingsTable := int(d.be64())
+
+	if d.err() != nil {
+		return nil, errors.Wrap(d.err(), "read TOC")
+	}
+	regions := []headerRegion{
+		{off: 0, data: head},
+		{off: int(size) - tocLen, data: toc},
+	}
+	sections := []int{symbols, labelIndicesTable}
+	if flags&flagSeparatePostings == 0 {
+		sections = append(sections, postingsTable)
+	}
+	for _, off := range sections {
+		if off == 0 {
+			continue
+		}
+		reg, err := readSection(off)
+		if err != nil {
+			return nil, errors.Wrapf(err, "read section at %d", off)
+		}
+		regions = append(regions, reg)
+	}
+	sort.Slice(regions, func(i, j int) bool { return regions[i].off < regions[j].off })
+
+	e := encbuf{}
+	e.putBE32(MagicIndexHeader)
+	e.putByte(indexHeaderFormatV1)
+	e.putBE64int64(size)
+	e.putBE32int(len(regions))
+
+	for _, reg := range regions {
+		e.putBE64int(reg.off)
+		e.putBE32int(len(reg.data))
+		e.putBytes(reg.data)
+	}
+	h := newCRC32()
+	h.Write(e.get())
+	e.putHash(h)
+
+	return e.get(), nil
+}
+
+// headerByteSlice serves the regions of an index held by its header from
+// memory and reads all other ranges from the full index.
+type headerByteSlice struct {
+	size    int
+	regions []headerRegion
+	r       io.ReaderAt
+}
+
+func (b *headerByteSlice) Len() int {
+	return b.size
+}
+
+// Range returns the bytes in [start, end). It returns nil if reading from the
+// full index fails. Readers within this package use ReadRange instead.
+func (b *headerByteSlice) Range(start, end int) []byte {
+	res, err := b.ReadRange(start, end)
+	if err != nil {
+		return nil
+	}
+	return res
+}
+
+// ReadRange returns the bytes in [start, end) or the error reading them from
+// the full index.
+func (b *headerByteSlice) ReadRange(start, end int) ([]byte, error) {
+	i := sort.Search(len(b.regions), func(i int) bool {
+		return b.regions[i].off+len(b.regions[i].data) >= end
+	})
+	if i < len(b.regions) && b.regions[i].off <= start {
+		reg := b.regions[i]
+		return reg.data[start-reg.off : end-reg.off], nil
+	}
+	res := make([]byte, end-start)
+
+	n, err := b.r.ReadAt(res, int64(start))
+	if n == len(res) {
+		return res, nil
+	}
+	if err == nil || err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return nil, errors.Wrapf(err, "read index range [%d, %d)", start, end)
+}
+
+// WithReaderAt returns a reader for the same index that reads ranges not held
+// by its header from ra instead. It allows binding reads to the context of a
+// single query. Closing the returned reader has no effect; r must be closed as
+// usual. Readers not opened from a header are returned unchanged.
+func (r *Reader) WithReaderAt(ra io.ReaderAt) *Reader {
+	hb, ok := r.b.(*headerByteSlice)
+	if !ok {
+		return r
+	}
+	nr := *r
+	nr.b = &headerByteSlice{size: hb.size, regions: hb.regions, r: ra}
+	if r.pb == r.b {
+		nr.pb = nr.b
+	}
+	nr.c = nil
+	return &nr
+}
+
+// NewHeaderReader returns a reader for an index from its header. Ranges of
+// the index that are not held by the header are read from r on demand, which
+// must provide the index the header was built from. Separately stored postings
+// are read from postings, which is closed along with the reader if it is an
+// io.Closer. It may be nil otherwise.
+func NewHeaderReader(header []byte, r io.ReaderAt, postings ByteSlice) (*Reader, error) {
+	if len(header) < 4+1+8+4+4 {
+		return nil, fileutil.NewErrCorrupt(nil, 0, "index header exceeds size %d", len(header))
+	}
+	d := decbuf{b: header[:len(header)-4]}
+
+	if d.crc32() != binary.BigEndian.Uint32(header[len(header)-4:]) {
+		return nil, fileutil.NewErrCorrupt(nil, 0, "index header checksum mismatch")
+	}
+	if m := d.be32(); m != MagicIndexHeader {
+		return nil, fileutil.NewErrCorrupt(nil, 0, "invalid index header magic number %x", m)
+	}
+	if v := d.byte(); v != indexHeaderFormatV1 {
+		return nil, errors.Errorf("unknown index header version %d", v)
+	}
+	b := &headerByteSlice{
+		size: int(d.be64int64()),
+		r:    r,
+	}
+	n := d.be32int()
+
+	for i := 0; i < n && d.err() == nil; i++ {
+		off := int(d.be64())
+		l := d.be32int()
+		if d.err() != nil {
+			break
+		}
+		data := d.decbuf(l)
+		if data.err() != nil {
+			return nil, errors.Wrap(data.err(), "read index header region")
+		}
+		b.regions = append(b.regions, headerRegion{off: off, data: data.get()})
+	}
+	if d.err() != nil {
+		return nil, errors.Wrap(d.err(), "read index header")
+	}
+	var c io.Closer
+	if pc, ok := postings.(io.Closer); ok {
+		c = pc
+	}
+	return newReader(b, postings, c)
+}
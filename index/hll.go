@@ -0,0 +1,89 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package index
+
+import (
+	"math"
+	"math/bits"
+
+	"github.com/cespare/xxhash"
+	"github.com/prometheus/tsdb/fileutil"
+)
+
+// hllPrecision is the number of hash bits used to select a register. It results
+// in 1KiB sketches with a standard error of about 3%.
+const hllPrecision = 10
+
+// HyperLogLog is a sketch estimating the number of distinct strings added to it.
+type HyperLogLog struct {
+	regs []uint8
+}
+
+// NewHyperLogLog returns an empty sketch.
+func NewHyperLogLog() *HyperLogLog {
+	return &HyperLogLog{regs: make([]uint8, 1<<hllPrecision)}
+}
+
+// newHyperLogLogFromRegisters returns a sketch backed by a copy of the given registers.
+func newHyperLogLogFromRegisters(regs []byte) (*HyperLogLog, error) {
+	if len(regs) != 1<<hllPrecision {
+		return nil, fileutil.NewErrCorrupt(nil, -1, "unexpected number of sketch registers %d", len(regs))
+	}
+	h := NewHyperLogLog()
+	copy(h.regs, regs)
+	return h, nil
+}
+
+// Add adds a string to the sketch.
+func (h *HyperLogLog) Add(s string) {
+	x := xxhash.Sum64String(s)
+	i := x >> (64 - hllPrecision)
+	// Set a guard bit so the rank is bounded by the remaining hash bits.
+	r := uint8(bits.LeadingZeros64(x<<hllPrecision|1<<(hllPrecision-1))) + 1
+
+	if r > h.regs[i] {
+		h.regs[i] = r
+	}
+}
+
+// Merge adds all strings of the other sketch to h.
+func (h *HyperLogLog) Merge(o *HyperLogLog) {
+	for i, r := range o.regs {
+		if r > h.regs[i] {
+			h.regs[i] = r
+		}
+	}
+}
+
+// Estimate returns the approximate number of distinct strings in the sketch.
+func (h *HyperLogLog) Estimate() uint64 {
+	var (
+		m     = float64(len(h.regs))
+		sum   float64
+		zeros int
+	)
+	for _, r := range h.regs {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	est := 0.7213 / (1 + 1.079/m) * m * m / sum
+
+	// Use linear counting for small cardinalities where the raw estimate is biased.
+	if est <= 2.5*m && zeros > 0 {
+		est = m * math.Log(m/float64(zeros))
+	}
+	return uint64(est + 0.5)
+}
@@ -0,0 +1,47 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package index
+
+import (
+	"math"
+	"strconv"
+	"testing"
+
+	"github.com/prometheus/tsdb/testutil"
+)
+
+func TestHyperLogLog(t *testing.T) {
+	for _, n := range []int{0, 1, 10, 100, 1000, 10000, 100000} {
+		hll := NewHyperLogLog()
+		for i := 0; i < n; i++ {
+			// Adding values twice must not affect the estimate.
+			hll.Add(strconv.Itoa(i))
+			hll.Add(strconv.Itoa(i))
+		}
+		est := float64(hll.Estimate())
+		testutil.Assert(t, math.Abs(est-float64(n)) <= 0.1*float64(n), "estimate %v for %d values", est, n)
+	}
+}
+
+func TestHyperLogLog_Merge(t *testing.T) {
+	a, b := NewHyperLogLog(), NewHyperLogLog()
+	for i := 0; i < 5000; i++ {
+		a.Add(strconv.Itoa(i))
+		b.Add(strconv.Itoa(i + 2500))
+	}
+	a.Merge(b)
+
+	est := float64(a.Estimate())
+	testutil.Assert(t, math.Abs(est-7500) <= 750, "estimate %v for 7500 values", est)
+}
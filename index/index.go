@@ -16,7 +16,6 @@ package index
 import (
 	"bufio"
 	"encoding/binary"
-	"fmt"
 	"hash"
 	"hash/crc32"
 	"io"
@@ -26,6 +25,7 @@ import (
 	"sort"
 	"strings"
 
+	"github.com/golang/snappy"
 	"github.com/pkg/errors"
 	"github.com/prometheus/tsdb/chunks"
 	"github.com/prometheus/tsdb/fileutil"
@@ -35,9 +35,60 @@ import (
 const (
 	// MagicIndex 4 bytes at the head of an index file.
 	MagicIndex = 0xBAAAD700
+	// MagicPostings 4 bytes at the head of a separate postings file.
+	MagicPostings = 0xBAAAD702
+
+	postingsFormatV1 = 1
 
 	indexFormatV1 = 1
 	indexFormatV2 = 2
+	indexFormatV3 = 3
+	indexFormatV4 = 4
+	indexFormatV5 = 5
+	indexFormatV6 = 6
+	indexFormatV7 = 7
+	indexFormatV8 = 8
+	indexFormatV9 = 9
+
+	// FormatVersion is the format version of index files written by the Writer.
+	FormatVersion = indexFormatV9
+)
+
+// Flags of an index file. Since format version 8 they are stored in a byte
+// following the version.
+const (
+	// flagSeparatePostings is set if the postings sections and the postings
+	// offset table are stored in a separate file.
+	flagSeparatePostings byte = 1 << iota
+)
+
+// PostingsFilename returns the name of the file holding the postings of the
+// index file with the given name if they are stored separately.
+func PostingsFilename(indexFn string) string {
+	return indexFn + ".postings"
+}
+
+// Compression is the codec of an index section. Since format version 5 it is
+// stored in a flag byte ahead of the contents of label index and postings sections.
+type Compression byte
+
+const (
+	// CompressionNone stores sections uncompressed.
+	CompressionNone Compression = 0
+	// CompressionSnappy compresses sections with the Snappy block format.
+	CompressionSnappy Compression = 1
+)
+
+// Sections smaller than this are not worth compressing.
+const minCompressionSize = 256
+
+// Number of delta encoded postings between restart points at which Seek can
+// resume decoding. Long postings lists, which are commonly seeked through
+// sparsely when intersected with shorter ones, get denser restart points.
+const (
+	postingsRestartInterval     = 64
+	longPostingsRestartInterval = 16
+	longPostingsLen             = 1 << 14
 )
 
 type indexWriterSeries struct {
@@ -118,11 +169,36 @@ type Writer struct {
 	seriesOffsets map[uint64]uint64 // offsets of series
 	labelIndexes  []hashEntry       // label index offsets
 	postings      []hashEntry       // postings lists offsets
+	sketches      []labelSketch     // cardinality sketches of label names
 
 	// Hold last series to validate that clients insert new series in order.
 	lastSeries labels.Labels
 
+	// SortSeries accepts series in any order. They are held in memory and
+	// written sorted by their label sets once all series were added.
+	// Series with equal label sets are written once if their chunks are
+	// equal as well and rejected otherwise.
+	SortSeries    bool
+	pendingSeries []pendingSeries
+	pendingRefs   map[uint64]struct{}
+
 	crc32 hash.Hash
+	// Checksum of the index file written so far.
+	sum hash.Hash32
+
+	// Compression of label index and postings sections. Sections are only
+	// stored compressed if that reduces their size.
+	Compression Compression
+	cbuf        []byte
+
+	// SeparatePostings writes the postings sections and the postings offset
+	// table into a separate file named by PostingsFilename. This keeps the
+	// index file, which is accessed for every series, small.
+	SeparatePostings bool
+	fn               string
+	// The index file and position in it while writing the postings file.
+	indexf   *os.File
+	indexPos uint64
 
 	Version int
 }
@@ -134,9 +210,16 @@ type indexTOC struct {
 	labelIndicesTable uint64
 	postings          uint64
 	postingsTable     uint64
+	labelSketches     uint64
+}
+
+type labelSketch struct {
+	name string
+	hll  *HyperLogLog
 }
 
-// NewWriter returns a new Writer to the given filename. It serializes data in format version 2.
+// NewWriter returns a new Writer to the given filename. It serializes data in the
+// latest format version.
 func NewWriter(fn string) (*Writer, error) {
 	dir := filepath.Dir(fn)
 
@@ -159,6 +242,7 @@ func NewWriter(fn string) (*Writer, error) {
 	}
 
 	iw := &Writer{
+		fn:    fn,
 		f:     f,
 		fbuf:  bufio.NewWriterSize(f, 1<<22),
 		pos:   0,
@@ -173,9 +257,7 @@ func NewWriter(fn string) (*Writer, error) {
 		symbols:       make(map[string]uint32, 1<<13),
 		seriesOffsets: make(map[uint64]uint64, 1<<16),
 		crc32:         newCRC32(),
-	}
-	if err := iw.writeMeta(); err != nil {
-		return nil, err
+		sum:           newCRC32(),
 	}
 	return iw, nil
 }
@@ -184,6 +266,9 @@ func (w *Writer) write(bufs ...[]byte) error {
 	for _, b := range bufs {
 		n, err := w.fbuf.Write(b)
 		w.pos += uint64(n)
+		if w.indexf == nil {
+			w.sum.Write(b[:n])
+		}
 		if err != nil {
 			return err
 		}
@@ -217,6 +302,22 @@ func (w *Writer) ensureStage(s indexWriterStage) error {
 	if w.stage > s {
 		return errors.Errorf("invalid stage %q, currently at %q", s, w.stage)
 	}
+	if w.stage == idxStageSeries {
+		if err := w.writePendingSeries(); err != nil {
+			return err
+		}
+	}
+	// The header is written lazily as it depends on the writer's options.
+	if w.stage == idxStageNone {
+		if err := w.writeMeta(); err != nil {
+			return err
+		}
+	}
+	if w.SeparatePostings && w.stage < idxStagePostings && s >= idxStagePostings {
+		if err := w.openPostingsFile(); err != nil {
+			return errors.Wrap(err, "open postings file")
+		}
+	}
 
 	// Mark start of sections in table of contents.
 	switch s {
@@ -232,13 +333,28 @@ func (w *Writer) ensureStage(s indexWriterStage) error {
 		w.toc.postings = w.pos
 
 	case idxStageDone:
+		if w.SeparatePostings {
+			w.toc.postingsTable = w.pos
+			if err := w.writeOffsetTable(w.postings); err != nil {
+				return err
+			}
+			if err := w.closePostingsFile(); err != nil {
+				return errors.Wrap(err, "close postings file")
+			}
+		}
+		w.toc.labelSketches = w.pos
+		if err := w.writeLabelSketches(); err != nil {
+			return err
+		}
 		w.toc.labelIndicesTable = w.pos
 		if err := w.writeOffsetTable(w.labelIndexes); err != nil {
 			return err
 		}
-		w.toc.postingsTable = w.pos
-		if err := w.writeOffsetTable(w.postings); err != nil {
-			return err
+		if !w.SeparatePostings {
+			w.toc.postingsTable = w.pos
+			if err := w.writeOffsetTable(w.postings); err != nil {
+				return err
+			}
 		}
 		if err := w.writeTOC(); err != nil {
 			return err
@@ -250,18 +366,144 @@ func (w *Writer) ensureStage(s indexWriterStage) error {
 }
 
 func (w *Writer) writeMeta() error {
+	var flags byte
+	if w.SeparatePostings {
+		flags |= flagSeparatePostings
+	}
 	w.buf1.reset()
 	w.buf1.putBE32(MagicIndex)
-	w.buf1.putByte(indexFormatV2)
+	w.buf1.putByte(FormatVersion)
+	w.buf1.putByte(flags)
+
+	return w.write(w.buf1.get())
+}
+
+// openPostingsFile directs all subsequent writes to the postings file.
+func (w *Writer) openPostingsFile() error {
+	if err := w.fbuf.Flush(); err != nil {
+		return err
+	}
+	fn := PostingsFilename(w.fn)
+
+	if err := os.RemoveAll(fn); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(fn, os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	df, err := fileutil.OpenDir(filepath.Dir(fn))
+	if err != nil {
+		f.Close()
+		return err
+	}
+	defer df.Close()
+
+	if err := fileutil.Fsync(df); err != nil {
+		f.Close()
+		return errors.Wrap(err, "sync dir")
+	}
+	w.indexf, w.indexPos = w.f, w.pos
+	w.f, w.pos = f, 0
+	w.fbuf.Reset(f)
+
+	w.buf1.reset()
+	w.buf1.putBE32(MagicPostings)
+	w.buf1.putByte(postingsFormatV1)
 
 	return w.write(w.buf1.get())
 }
 
+// closePostingsFile completes the postings file and directs all subsequent
+// writes to the index file again.
+func (w *Writer) closePostingsFile() error {
+	if err := w.fbuf.Flush(); err != nil {
+		return err
+	}
+	if err := fileutil.Fsync(w.f); err != nil {
+		return err
+	}
+	if err := w.f.Close(); err != nil {
+		return err
+	}
+	w.f, w.pos = w.indexf, w.indexPos
+	w.indexf = nil
+	w.fbuf.Reset(w.f)
+
+	return nil
+}
+
+type pendingSeries struct {
+	ref    uint64
+	lset   labels.Labels
+	chunks []chunks.Meta
+}
+
 // AddSeries adds the series one at a time along with its chunks.
+// Series must be added in increasing order of their label sets unless
+// SortSeries is set.
 func (w *Writer) AddSeries(ref uint64, lset labels.Labels, chunks ...chunks.Meta) error {
 	if err := w.ensureStage(idxStageSeries); err != nil {
 		return err
 	}
+	if !w.SortSeries {
+		return w.addSeries(ref, lset, chunks)
+	}
+	if w.pendingRefs == nil {
+		w.pendingRefs = map[uint64]struct{}{}
+	}
+	if _, ok := w.pendingRefs[ref]; ok {
+		return errors.Errorf("series with reference %d already added", ref)
+	}
+	w.pendingRefs[ref] = struct{}{}
+
+	// The caller may reuse the label set and chunks.
+	w.pendingSeries = append(w.pendingSeries, pendingSeries{
+		ref:    ref,
+		lset:   append(labels.Labels(nil), lset...),
+		chunks: append(chunks[:0:0], chunks...),
+	})
+	return nil
+}
+
+// writePendingSeries writes the series held back by SortSeries in order.
+func (w *Writer) writePendingSeries() error {
+	ps := w.pendingSeries
+	w.pendingSeries, w.pendingRefs = nil, nil
+
+	sort.SliceStable(ps, func(i, j int) bool {
+		return labels.Compare(ps[i].lset, ps[j].lset) < 0
+	})
+	for i, s := range ps {
+		if i == 0 || labels.Compare(s.lset, ps[i-1].lset) != 0 {
+			if err := w.addSeries(s.ref, s.lset, s.chunks); err != nil {
+				return err
+			}
+			continue
+		}
+		prev := ps[i-1]
+		if !equalChunkMetas(s.chunks, prev.chunks) {
+			return errors.Errorf("conflicting series with label set %q added with references %d and %d", s.lset, prev.ref, s.ref)
+		}
+		// Both references resolve to the series written first.
+		w.seriesOffsets[s.ref] = w.seriesOffsets[prev.ref]
+	}
+	return nil
+}
+
+func equalChunkMetas(a, b []chunks.Meta) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Ref != b[i].Ref || a[i].MinTime != b[i].MinTime || a[i].MaxTime != b[i].MaxTime {
+			return false
+		}
+	}
+	return true
+}
+
+func (w *Writer) addSeries(ref uint64, lset labels.Labels, chunks []chunks.Meta) error {
 	if labels.Compare(lset, w.lastSeries) <= 0 {
 		return errors.Errorf("out-of-order series added with label set %q", lset)
 	}
@@ -316,6 +558,9 @@ func (w *Writer) AddSeries(ref uint64, lset labels.Labels, chunks ...chunks.Meta
 			w.buf2.putVarint64(int64(c.Ref) - ref0)
 			ref0 = int64(c.Ref)
 		}
+		stats := seriesStats(chunks)
+		w.buf2.putUvarint64(stats.Samples)
+		w.buf2.putUvarint64(stats.Bytes)
 	}
 
 	w.buf1.reset()
@@ -353,9 +598,17 @@ func (w *Writer) AddSymbols(sym map[string]struct{}) error {
 
 	w.symbols = make(map[string]uint32, len(symbols))
 
+	var prev string
+
 	for index, s := range symbols {
 		w.symbols[s] = uint32(index)
-		w.buf2.putUvarintStr(s)
+
+		// Symbols are front coded, i.e. stored as the length of the prefix they
+		// share with their predecessor followed by the remaining suffix.
+		p := sharedPrefixLen(prev, s)
+		w.buf2.putUvarint(p)
+		w.buf2.putUvarintStr(s[p:])
+		prev = s
 	}
 
 	w.buf1.putBE32int(w.buf2.len())
@@ -379,6 +632,14 @@ func (w *Writer) WriteLabelIndex(names []string, values []string) error {
 	}
 	sort.Sort(valt)
 
+	if len(names) == 1 {
+		hll := NewHyperLogLog()
+		for _, v := range values {
+			hll.Add(v)
+		}
+		w.sketches = append(w.sketches, labelSketch{name: names[0], hll: hll})
+	}
+
 	// Align beginning to 4 bytes for more efficient index list scans.
 	if err := w.addPadding(4); err != nil {
 		return err
@@ -402,27 +663,69 @@ func (w *Writer) WriteLabelIndex(names []string, values []string) error {
 		w.buf2.putBE32(index)
 	}
 
+	err = w.writeFlaggedSection(w.buf2.get())
+	return errors.Wrap(err, "write label index")
+}
+
+// writeFlaggedSection writes data as a section whose contents start with a flag
+// byte marking their compression.
+func (w *Writer) writeFlaggedSection(data []byte) error {
+	flag := CompressionNone
+
+	if w.Compression == CompressionSnappy && len(data) >= minCompressionSize {
+		w.cbuf = snappy.Encode(w.cbuf[:cap(w.cbuf)], data)
+
+		if len(w.cbuf) < len(data) {
+			data, flag = w.cbuf, CompressionSnappy
+		}
+	}
 	w.buf1.reset()
-	w.buf1.putBE32int(w.buf2.len())
+	w.buf1.putBE32int(1 + len(data))
+	w.buf1.putByte(byte(flag))
 
-	w.buf2.putHash(w.crc32)
+	w.crc32.Reset()
+	w.crc32.Write(w.buf1.get()[4:])
+	w.crc32.Write(data)
 
-	err = w.write(w.buf1.get(), w.buf2.get())
-	return errors.Wrap(err, "write label index")
+	return w.write(w.buf1.get(), data, w.crc32.Sum(nil))
 }
 
-// writeOffsetTable writes a sequence of readable hash entries.
+// sharedPrefixLen returns the length of the common prefix of a and b.
+func sharedPrefixLen(a, b string) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
+
+// writeOffsetTable writes a sequence of readable hash entries sorted by their keys.
+// It is followed by the positions of each entry relative to the start of the table
+// so that readers can binary search it without loading it into memory.
 func (w *Writer) writeOffsetTable(entries []hashEntry) error {
+	sort.Slice(entries, func(i, j int) bool {
+		return compareKeys(entries[i].keys, entries[j].keys) < 0
+	})
+
 	w.buf2.reset()
 	w.buf2.putBE32int(len(entries))
 
+	positions := w.uint32s[:0]
+
 	for _, e := range entries {
+		// The table's length field precedes the buffer contents.
+		positions = append(positions, uint32(4+w.buf2.len()))
+
 		w.buf2.putUvarint(len(e.keys))
 		for _, k := range e.keys {
 			w.buf2.putUvarintStr(k)
 		}
 		w.buf2.putUvarint64(e.offset)
 	}
+	for _, p := range positions {
+		w.buf2.putBE32(p)
+	}
+	w.uint32s = positions
 
 	w.buf1.reset()
 	w.buf1.putBE32int(w.buf2.len())
@@ -431,7 +734,32 @@ func (w *Writer) writeOffsetTable(entries []hashEntry) error {
 	return w.write(w.buf1.get(), w.buf2.get())
 }
 
-const indexTOCLen = 6*8 + 4
+// writeLabelSketches writes the cardinality sketches of all single label name indices.
+func (w *Writer) writeLabelSketches() error {
+	sort.Slice(w.sketches, func(i, j int) bool {
+		return w.sketches[i].name < w.sketches[j].name
+	})
+
+	w.buf2.reset()
+	w.buf2.putBE32int(len(w.sketches))
+
+	for _, s := range w.sketches {
+		w.buf2.putUvarintStr(s.name)
+		w.buf2.putByte(hllPrecision)
+		w.buf2.putBytes(s.hll.regs)
+	}
+
+	w.buf1.reset()
+	w.buf1.putBE32int(w.buf2.len())
+	w.buf2.putHash(w.crc32)
+
+	return errors.Wrap(w.write(w.buf1.get(), w.buf2.get()), "write label sketches")
+}
+
+const (
+	indexTOCLen   = 6*8 + 4
+	indexTOCLenV4 = 7*8 + 4
+)
 
 func (w *Writer) writeTOC() error {
 	w.buf1.reset()
@@ -442,6 +770,7 @@ func (w *Writer) writeTOC() error {
 	w.buf1.putBE64(w.toc.labelIndicesTable)
 	w.buf1.putBE64(w.toc.postings)
 	w.buf1.putBE64(w.toc.postingsTable)
+	w.buf1.putBE64(w.toc.labelSketches)
 
 	w.buf1.putHash(w.crc32)
 
@@ -483,23 +812,62 @@ func (w *Writer) WritePostings(name, value string, it Postings) error {
 	}
 	sort.Sort(uint32slice(refs))
 
-	w.buf2.reset()
-	w.buf2.putBE32int(len(refs))
-
-	for _, r := range refs {
-		w.buf2.putBE32(r)
+	// References of duplicate series added with SortSeries share an offset.
+	if w.SortSeries {
+		refs = uniqueUint32s(refs)
 	}
-	w.uint32s = refs
 
 	w.buf1.reset()
-	w.buf1.putBE32int(w.buf2.len())
+	w.buf2.reset()
+	putDeltaPostings(&w.buf2, &w.buf1, refs)
 
-	w.buf2.putHash(w.crc32)
+	w.uint32s = refs
 
-	err := w.write(w.buf1.get(), w.buf2.get())
+	err := w.writeFlaggedSection(w.buf2.get())
 	return errors.Wrap(err, "write postings")
 }
 
+// putDeltaPostings encodes the sorted refs as varint deltas to their predecessors.
+// The deltas are written into tmp first, as they are preceded by a table of
+// restart points holding a ref and the offset of its delta.
+func putDeltaPostings(e, tmp *encbuf, refs []uint32) {
+	interval := postingsRestartInterval
+	if len(refs) >= longPostingsLen {
+		interval = longPostingsRestartInterval
+	}
+	e.putBE32int(len(refs))
+	e.putBE32int(interval)
+
+	var prev uint32
+
+	for i, r := range refs {
+		// Restart points store their full ref.
+		if i%interval == 0 {
+			e.putBE32(r)
+			e.putBE32int(tmp.len())
+			prev = 0
+		}
+		tmp.putUvarint32(r - prev)
+		prev = r
+	}
+	e.putBytes(tmp.get())
+}
+
+// uniqueUint32s removes consecutive duplicates from s in place.
+func uniqueUint32s(s []uint32) []uint32 {
+	if len(s) == 0 {
+		return s
+	}
+	j := 0
+	for _, v := range s[1:] {
+		if v != s[j] {
+			j++
+			s[j] = v
+		}
+	}
+	return s[:j+1]
+}
+
 type uint32slice []uint32
 
 func (s uint32slice) Len() int           { return len(s) }
@@ -511,6 +879,27 @@ type hashEntry struct {
 	offset uint64
 }
 
+// compareKeys compares two key tuples element-wise. If one is a prefix
+// of the other, the shorter one comes first.
+func compareKeys(a, b []string) int {
+	l := len(a)
+	if len(b) < l {
+		l = len(b)
+	}
+	for i := 0; i < l; i++ {
+		if d := strings.Compare(a[i], b[i]); d != 0 {
+			return d
+		}
+	}
+	return len(a) - len(b)
+}
+
+// Checksum returns the CRC32 checksum of the index file, which is complete once
+// the writer is closed. It does not cover a separately written postings file.
+func (w *Writer) Checksum() uint32 {
+	return w.sum.Sum32()
+}
+
 func (w *Writer) Close() error {
 	if err := w.ensureStage(idxStageDone); err != nil {
 		return err
@@ -532,36 +921,131 @@ type StringTuples interface {
 	At(i int) ([]string, error)
 }
 
+// StringIter iterates over a sorted list of strings.
+type StringIter interface {
+	// Next advances the iterator and returns true if another value was found.
+	Next() bool
+	// At returns the value at the current iterator position.
+	At() string
+	// Err returns the last error of the iterator.
+	Err() error
+}
+
+// NewStringListIter returns a StringIter over the strings, which must be sorted.
+func NewStringListIter(s []string) StringIter {
+	return &stringListIter{l: s, cur: -1}
+}
+
+type stringListIter struct {
+	l   []string
+	cur int
+}
+
+func (s *stringListIter) Next() bool {
+	s.cur++
+	return s.cur < len(s.l)
+}
+func (s *stringListIter) At() string { return s.l[s.cur] }
+func (s *stringListIter) Err() error { return nil }
+
+// MergeStringIters returns a StringIter over the sorted union of the strings
+// of all iterators.
+func MergeStringIters(its ...StringIter) StringIter {
+	if len(its) == 0 {
+		return NewStringListIter(nil)
+	}
+	if len(its) == 1 {
+		return its[0]
+	}
+	l := len(its) / 2
+	return newMergedStringIter(MergeStringIters(its[:l]...), MergeStringIters(its[l:]...))
+}
+
+type mergedStringIter struct {
+	a, b        StringIter
+	aok, bok    bool
+	initialized bool
+	cur         string
+}
+
+func newMergedStringIter(a, b StringIter) *mergedStringIter {
+	return &mergedStringIter{a: a, b: b}
+}
+
+func (m *mergedStringIter) Next() bool {
+	if !m.initialized {
+		m.aok, m.bok = m.a.Next(), m.b.Next()
+		m.initialized = true
+	}
+	switch {
+	case !m.aok && !m.bok:
+		return false
+	case !m.bok:
+		m.cur = m.a.At()
+		m.aok = m.a.Next()
+	case !m.aok:
+		m.cur = m.b.At()
+		m.bok = m.b.Next()
+	default:
+		a, b := m.a.At(), m.b.At()
+		switch {
+		case a < b:
+			m.cur = a
+			m.aok = m.a.Next()
+		case a > b:
+			m.cur = b
+			m.bok = m.b.Next()
+		default:
+			m.cur = a
+			m.aok, m.bok = m.a.Next(), m.b.Next()
+		}
+	}
+	return true
+}
+
+func (m *mergedStringIter) At() string { return m.cur }
+
+func (m *mergedStringIter) Err() error {
+	if err := m.a.Err(); err != nil {
+		return err
+	}
+	return m.b.Err()
+}
+
+// Reader reads an index from a byte slice. All of its state is populated when it
+// is created and never modified afterwards, so it is safe for concurrent use.
 type Reader struct {
 	// The underlying byte slice holding the encoded series data.
 	b   ByteSlice
 	toc indexTOC
+	// The byte slice holding postings sections and the postings offset table.
+	// It is the same as b unless postings are stored in a separate file.
+	pb ByteSlice
 
 	// Close that releases the underlying resources of the byte slice.
 	c io.Closer
 
-	// Cached hashmaps of section offsets.
-	labels   map[string]uint64
-	postings map[labels.Label]uint64
+	// Offset tables of label index and postings sections.
+	labels   offsetTable
+	postings offsetTable
 	// Cache of read symbols. Strings that are returned when reading from the
 	// block are always backed by true strings held in here rather than
 	// strings that are backed by byte slices from the mmap'd index file. This
 	// prevents memory faults when applications work with read symbols after
 	// the block has been unmapped.
 	symbols map[uint32]string
+	// The values of symbols in sorted order.
+	sortedSymbols []string
 
 	dec *Decoder
 
-	crc32 hash.Hash32
-
 	version int
+	flags   byte
 }
 
-var (
-	errInvalidSize     = fmt.Errorf("invalid size")
-	errInvalidFlag     = fmt.Errorf("invalid flag")
-	errInvalidChecksum = fmt.Errorf("invalid checksum")
-)
+// errInvalidSize is returned when decoding data that is shorter than its
+// encoded lengths claim.
+var errInvalidSize = fileutil.NewErrCorrupt(nil, -1, "invalid size")
 
 // ByteSlice abstracts a byte slice.
 type ByteSlice interface {
@@ -584,40 +1068,144 @@ func (b realByteSlice) Sub(start, end int) ByteSlice {
 }
 
 // NewReader returns a new IndexReader on the given byte slice. It automatically
-// handles different format versions.
+// handles different format versions. Indices with separately stored postings
+// must be opened with NewReaderWithPostings.
 func NewReader(b ByteSlice) (*Reader, error) {
-	return newReader(b, nil)
+	return newReader(b, nil, nil)
+}
+
+// NewReaderWithPostings returns a new IndexReader on the given byte slices of
+// an index and its separately stored postings.
+func NewReaderWithPostings(b, postings ByteSlice) (*Reader, error) {
+	return newReader(b, postings, nil)
 }
 
 // NewFileReader returns a new index reader against the given index file.
+// The file is mapped into memory. If that fails, it is read with pread.
+// Separately stored postings are read from the file named by PostingsFilename.
 func NewFileReader(path string) (*Reader, error) {
-	f, err := fileutil.OpenMmapFile(path)
+	return newFileReader(path, false)
+}
+
+// NewPreadFileReader returns a new index reader against the given index file,
+// which is read with pread instead of being mapped into memory.
+func NewPreadFileReader(path string) (*Reader, error) {
+	return newFileReader(path, true)
+}
+
+func newFileReader(path string, pread bool) (*Reader, error) {
+	f, err := fileutil.OpenReadableFile(path, pread)
+	if err != nil {
+		return nil, err
+	}
+	if indexFlags(f)&flagSeparatePostings == 0 {
+		r, err := newReader(f, nil, f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return r, nil
+	}
+	pf, err := fileutil.OpenReadableFile(PostingsFilename(path), pread)
+	if err != nil {
+		f.Close()
+		return nil, errors.Wrap(err, "open postings file")
+	}
+	c := closers{f, pf}
+
+	r, err := newReader(f, pf, c)
 	if err != nil {
+		c.Close()
 		return nil, err
 	}
-	return newReader(realByteSlice(f.Bytes()), f)
+	return r, nil
+}
+
+// closers closes all its elements.
+type closers []io.Closer
+
+func (cs closers) Close() error {
+	var err error
+	for _, c := range cs {
+		if e := c.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// indexFlags returns the flags of the index in b. They are zero for format
+// versions before 8 and invalid indices.
+func indexFlags(b ByteSlice) byte {
+	if b.Len() < 6 {
+		return 0
+	}
+	h, err := fileutil.ReadRange(b, 0, 6)
+	if err != nil || binary.BigEndian.Uint32(h) != MagicIndex || h[4] < indexFormatV8 {
+		return 0
+	}
+	return h[5]
 }
 
-func newReader(b ByteSlice, c io.Closer) (*Reader, error) {
+func newReader(b, pb ByteSlice, c io.Closer) (*Reader, error) {
 	r := &Reader{
-		b:        b,
-		c:        c,
-		symbols:  map[uint32]string{},
-		labels:   map[string]uint64{},
-		postings: map[labels.Label]uint64{},
-		crc32:    newCRC32(),
+		b:       b,
+		pb:      pb,
+		c:       c,
+		symbols: map[uint32]string{},
 	}
 
 	// Verify header.
 	if b.Len() < 5 {
-		return nil, errors.Wrap(errInvalidSize, "index header")
+		return nil, fileutil.NewErrCorrupt(b, 0, "index header exceeds size %d", b.Len())
+	}
+	h, err := fileutil.ReadRange(b, 0, 5)
+	if err != nil {
+		return nil, err
 	}
-	if m := binary.BigEndian.Uint32(r.b.Range(0, 4)); m != MagicIndex {
-		return nil, errors.Errorf("invalid magic number %x", m)
+	if m := binary.BigEndian.Uint32(h); m != MagicIndex {
+		return nil, fileutil.NewErrCorrupt(b, 0, "invalid magic number %x", m)
 	}
-	r.version = int(r.b.Range(4, 5)[0])
+	r.version = int(h[4])
 
-	if r.version != 1 && r.version != 2 {
+	if r.version >= indexFormatV8 {
+		if b.Len() < 6 {
+			return nil, fileutil.NewErrCorrupt(b, 0, "index header exceeds size %d", b.Len())
+		}
+		f, err := fileutil.ReadRange(b, 5, 6)
+		if err != nil {
+			return nil, err
+		}
+		r.flags = f[0]
+	}
+	if r.flags&flagSeparatePostings == 0 {
+		r.pb = b
+	} else if pb == nil {
+		return nil, errors.New("postings are stored in a separate file")
+	} else if pb.Len() < 5 {
+		return nil, fileutil.NewErrCorrupt(pb, 0, "postings file header exceeds size %d", pb.Len())
+	} else if ph, err := fileutil.ReadRange(pb, 0, 5); err != nil {
+		return nil, errors.Wrap(err, "read postings file header")
+	} else if m := binary.BigEndian.Uint32(ph); m != MagicPostings {
+		return nil, fileutil.NewErrCorrupt(pb, 0, "invalid postings file magic number %x", m)
+	} else if v := ph[4]; v != postingsFormatV1 {
+		return nil, errors.Errorf("unknown postings file version %d", v)
+	}
+
+	// Pick the offset table implementation for the format version. Version specific
+	// handling of symbols and series references is done while reading them.
+	var openOffsetTable func(b ByteSlice, off uint64, n int) (offsetTable, error)
+
+	switch r.version {
+	case indexFormatV1, indexFormatV2:
+		openOffsetTable = func(b ByteSlice, off uint64, n int) (offsetTable, error) {
+			return r.readMapOffsetTable(b, off, n)
+		}
+	case indexFormatV3, indexFormatV4, indexFormatV5, indexFormatV6, indexFormatV7, indexFormatV8, indexFormatV9:
+		openOffsetTable = func(b ByteSlice, off uint64, _ int) (offsetTable, error) {
+			return r.newDiskOffsetTable(b, off)
+		}
+	default:
 		return nil, errors.Errorf("unknown index file version %d", r.version)
 	}
 
@@ -627,26 +1215,10 @@ func newReader(b ByteSlice, c io.Closer) (*Reader, error) {
 	if err := r.readSymbols(int(r.toc.symbols)); err != nil {
 		return nil, errors.Wrap(err, "read symbols")
 	}
-	var err error
-
-	err = r.readOffsetTable(r.toc.labelIndicesTable, func(key []string, off uint64) error {
-		if len(key) != 1 {
-			return errors.Errorf("unexpected key length %d", len(key))
-		}
-		r.labels[key[0]] = off
-		return nil
-	})
-	if err != nil {
+	if r.labels, err = openOffsetTable(r.b, r.toc.labelIndicesTable, 1); err != nil {
 		return nil, errors.Wrap(err, "read label index table")
 	}
-	err = r.readOffsetTable(r.toc.postingsTable, func(key []string, off uint64) error {
-		if len(key) != 2 {
-			return errors.Errorf("unexpected key length %d", len(key))
-		}
-		r.postings[labels.Label{Name: key[0], Value: key[1]}] = off
-		return nil
-	})
-	if err != nil {
+	if r.postings, err = openOffsetTable(r.pb, r.toc.postingsTable, 2); err != nil {
 		return nil, errors.Wrap(err, "read postings table")
 	}
 
@@ -660,40 +1232,210 @@ func (r *Reader) Version() int {
 	return r.version
 }
 
+// LabelSketches returns cardinality sketches of the values of each label name.
+// Indices written before format version 4 don't persist sketches, so they
+// are built from the label indices instead.
+func (r *Reader) LabelSketches() (map[string]*HyperLogLog, error) {
+	res := map[string]*HyperLogLog{}
+
+	if r.version < indexFormatV4 {
+		names, err := r.LabelIndices()
+		if err != nil {
+			return nil, err
+		}
+		for _, n := range names {
+			if len(n) != 1 {
+				continue
+			}
+			tpls, err := r.LabelValues(n[0])
+			if err != nil {
+				return nil, err
+			}
+			hll := NewHyperLogLog()
+			for i := 0; i < tpls.Len(); i++ {
+				t, err := tpls.At(i)
+				if err != nil {
+					return nil, err
+				}
+				hll.Add(t[0])
+			}
+			res[n[0]] = hll
+		}
+		return res, nil
+	}
+
+	d := r.decbufAt(int(r.toc.labelSketches))
+	cnt := d.be32int()
+
+	// Each sketch holds at least its name length, precision and registers.
+	if d.err() == nil && cnt > d.len()/(2+1<<hllPrecision) {
+		return nil, errors.Wrapf(errInvalidSize, "read %d label sketches", cnt)
+	}
+
+	for i := 0; i < cnt && d.err() == nil; i++ {
+		name := d.uvarintStr()
+		if p := d.byte(); p != hllPrecision && d.err() == nil {
+			return nil, fileutil.NewErrCorrupt(r.b, int(r.toc.labelSketches), "unsupported sketch precision %d", p)
+		}
+		regs := d.decbuf(1 << hllPrecision)
+		if regs.err() != nil {
+			return nil, errors.Wrap(regs.err(), "read label sketches")
+		}
+		hll, err := newHyperLogLogFromRegisters(regs.get())
+		if err != nil {
+			return nil, err
+		}
+		res[name] = hll
+	}
+	if d.err() != nil {
+		return nil, errors.Wrap(d.err(), "read label sketches")
+	}
+	return res, nil
+}
+
 // Range marks a byte range.
 type Range struct {
 	Start, End int64
 }
 
 // PostingsRanges returns a new map of byte range in the underlying index file
-// for all postings lists.
+// for all postings lists. If postings are stored in a separate file, the ranges
+// refer to that file.
 func (r *Reader) PostingsRanges() (map[labels.Label]Range, error) {
 	m := map[labels.Label]Range{}
 
-	for l, start := range r.postings {
-		d := r.decbufAt(int(start))
+	err := r.postings.iter(func(key []string, start uint64) error {
+		if len(key) != 2 {
+			return fileutil.NewErrCorrupt(r.pb, int(r.toc.postingsTable), "unexpected key length %d", len(key))
+		}
+		d := decbufAt(r.pb, int(start))
 		if d.err() != nil {
-			return nil, d.err()
+			return d.err()
 		}
-		m[l] = Range{
+		m[labels.Label{Name: key[0], Value: key[1]}] = Range{
 			Start: int64(start) + 4,
 			End:   int64(start) + 4 + int64(d.len()),
 		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 	return m, nil
 }
 
-func (r *Reader) readTOC() error {
-	if r.b.Len() < indexTOCLen {
-		return errInvalidSize
-	}
-	b := r.b.Range(r.b.Len()-indexTOCLen, r.b.Len())
+// PostingsStat describes the postings list of a label pair.
+type PostingsStat struct {
+	Label labels.Label
+	// Series is the number of series with the label pair.
+	Series int
+	// Bytes is the size of the postings list as stored.
+	Bytes int
+}
 
-	expCRC := binary.BigEndian.Uint32(b[len(b)-4:])
-	d := decbuf{b: b[:len(b)-4]}
+// PostingsStats lists the label pairs with the largest postings lists.
+type PostingsStats struct {
+	// BySeries holds the label pairs with the most series in descending order.
+	BySeries []PostingsStat
+	// BySize holds the label pairs with the largest postings lists in bytes
+	// in descending order.
+	BySize []PostingsStat
+}
+
+// TopPostingsStats returns the limit label pairs with the most series and
+// the largest postings lists among stats. A limit of zero or less keeps all.
+func TopPostingsStats(stats []PostingsStat, limit int) *PostingsStats {
+	if limit <= 0 || limit > len(stats) {
+		limit = len(stats)
+	}
+	top := func(less func(a, b PostingsStat) bool) []PostingsStat {
+		s := make([]PostingsStat, len(stats))
+		copy(s, stats)
+		sort.Slice(s, func(i, j int) bool {
+			if less(s[i], s[j]) {
+				return true
+			}
+			if less(s[j], s[i]) {
+				return false
+			}
+			// Break ties deterministically.
+			if s[i].Label.Name != s[j].Label.Name {
+				return s[i].Label.Name < s[j].Label.Name
+			}
+			return s[i].Label.Value < s[j].Label.Value
+		})
+		return s[:limit]
+	}
+	return &PostingsStats{
+		BySeries: top(func(a, b PostingsStat) bool { return a.Series > b.Series }),
+		BySize:   top(func(a, b PostingsStat) bool { return a.Bytes > b.Bytes }),
+	}
+}
+
+// PostingsStats returns the limit label pairs with the most series and the
+// largest postings lists. A limit of zero or less returns all label pairs.
+// The list of all postings is not included.
+func (r *Reader) PostingsStats(limit int) (*PostingsStats, error) {
+	var stats []PostingsStat
+
+	err := r.postings.iter(func(key []string, off uint64) error {
+		if len(key) != 2 {
+			return fileutil.NewErrCorrupt(r.pb, int(r.toc.postingsTable), "unexpected key length %d", len(key))
+		}
+		if key[0] == allPostingsKey.Name && key[1] == allPostingsKey.Value {
+			return nil
+		}
+		size := decbufAt(r.pb, int(off))
+		if size.err() != nil {
+			return errors.Wrap(size.err(), "get postings entry")
+		}
+		d := r.sectionAt(r.pb, int(off))
+		if d.err() != nil {
+			return errors.Wrap(d.err(), "get postings entry")
+		}
+		var (
+			n   int
+			err error
+		)
+		if r.version >= indexFormatV7 {
+			n, _, err = r.dec.DeltaPostings(d.get())
+		} else {
+			n, _, err = r.dec.Postings(d.get())
+		}
+		if err != nil {
+			return errors.Wrap(err, "decode postings")
+		}
+		stats = append(stats, PostingsStat{
+			Label:  labels.Label{Name: key[0], Value: key[1]},
+			Series: n,
+			Bytes:  size.len(),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return TopPostingsStats(stats, limit), nil
+}
+
+func (r *Reader) readTOC() error {
+	tocLen := indexTOCLen
+	if r.version >= indexFormatV4 {
+		tocLen = indexTOCLenV4
+	}
+	if r.b.Len() < tocLen {
+		return fileutil.NewErrCorrupt(r.b, 0, "TOC exceeds size %d", r.b.Len())
+	}
+	b, err := fileutil.ReadRange(r.b, r.b.Len()-tocLen, r.b.Len())
+	if err != nil {
+		return err
+	}
+
+	expCRC := binary.BigEndian.Uint32(b[len(b)-4:])
+	d := decbuf{b: b[:len(b)-4]}
 
 	if d.crc32() != expCRC {
-		return errors.Wrap(errInvalidChecksum, "read TOC")
+		return fileutil.NewErrCorrupt(r.b, r.b.Len()-tocLen, "TOC checksum mismatch")
 	}
 
 	r.toc.symbols = d.be64()
@@ -703,6 +1445,9 @@ func (r *Reader) readTOC() error {
 	r.toc.postings = d.be64()
 	r.toc.postingsTable = d.be64()
 
+	if r.version >= indexFormatV4 {
+		r.toc.labelSketches = d.be64()
+	}
 	return d.err()
 }
 
@@ -710,26 +1455,74 @@ func (r *Reader) readTOC() error {
 // after offset to hold the big endian encoded content length, followed by the contents and the expected
 // checksum.
 func (r *Reader) decbufAt(off int) decbuf {
-	if r.b.Len() < off+4 {
-		return decbuf{e: errInvalidSize}
+	return decbufAt(r.b, off)
+}
+
+// decbufAt is like Reader.decbufAt but decodes from the given byte slice.
+func decbufAt(bs ByteSlice, off int) decbuf {
+	if bs.Len() < off+4 {
+		return decbuf{e: fileutil.NewErrCorrupt(bs, off, "section length exceeds size %d", bs.Len())}
+	}
+	b, err := fileutil.ReadRange(bs, off, off+4)
+	if err != nil {
+		return decbuf{e: err}
 	}
-	b := r.b.Range(off, off+4)
 	l := int(binary.BigEndian.Uint32(b))
 
-	if r.b.Len() < off+4+l+4 {
-		return decbuf{e: errInvalidSize}
+	if bs.Len() < off+4+l+4 {
+		return decbuf{e: fileutil.NewErrCorrupt(bs, off, "section of length %d exceeds size %d", l, bs.Len())}
 	}
 
 	// Load bytes holding the contents plus a CRC32 checksum.
-	b = r.b.Range(off+4, off+4+l+4)
+	b, err = fileutil.ReadRange(bs, off+4, off+4+l+4)
+	if err != nil {
+		return decbuf{e: err}
+	}
 	dec := decbuf{b: b[:len(b)-4]}
 
 	if exp := binary.BigEndian.Uint32(b[len(b)-4:]); dec.crc32() != exp {
-		return decbuf{e: errInvalidChecksum}
+		return decbuf{e: fileutil.NewErrCorrupt(bs, off, "section checksum mismatch")}
 	}
 	return dec
 }
 
+// sectionAt returns a decoding buffer over the contents of the label index or
+// postings section at the given offset in b. Since format version 5 the
+// contents start with a flag byte and are decompressed if necessary.
+func (r *Reader) sectionAt(b ByteSlice, off int) decbuf {
+	d := decbufAt(b, off)
+	if r.version < indexFormatV5 || d.err() != nil {
+		return d
+	}
+	switch c := Compression(d.byte()); c {
+	case CompressionNone:
+		return d
+	case CompressionSnappy:
+		n, err := snappy.DecodedLen(d.get())
+		if err != nil {
+			return decbuf{e: fileutil.NewErrCorrupt(b, off, "decompress section: %s", err)}
+		}
+		if n > d.len()*maxSnappyRatio {
+			return decbuf{e: fileutil.NewErrCorrupt(b, off, "decompressed size %d exceeds limit for %d bytes", n, d.len())}
+		}
+		db, err := snappy.Decode(nil, d.get())
+		if err != nil {
+			return decbuf{e: fileutil.NewErrCorrupt(b, off, "decompress section: %s", err)}
+		}
+		return decbuf{b: db}
+	default:
+		if d.err() != nil {
+			return d
+		}
+		return decbuf{e: fileutil.NewErrCorrupt(b, off, "unknown compression %d", c)}
+	}
+}
+
+// maxSnappyRatio is the largest ratio at which Snappy compresses data, as a
+// copy element of 3 bytes yields at most 64 bytes. It bounds the decompressed
+// size of sections.
+const maxSnappyRatio = 22
+
 // decbufUvarintAt returns a new decoding buffer. It expects the first bytes
 // after offset to hold the uvarint-encoded buffers length, followed by the contents and the expected
 // checksum.
@@ -737,25 +1530,30 @@ func (r *Reader) decbufUvarintAt(off int) decbuf {
 	// We never have to access this method at the far end of the byte slice. Thus just checking
 	// against the MaxVarintLen32 is sufficient.
 	if r.b.Len() < off+binary.MaxVarintLen32 {
-		return decbuf{e: errInvalidSize}
+		return decbuf{e: fileutil.NewErrCorrupt(r.b, off, "entry length exceeds size %d", r.b.Len())}
+	}
+	b, err := fileutil.ReadRange(r.b, off, off+binary.MaxVarintLen32)
+	if err != nil {
+		return decbuf{e: err}
 	}
-	b := r.b.Range(off, off+binary.MaxVarintLen32)
-
 	l, n := binary.Uvarint(b)
 	if n <= 0 || n > binary.MaxVarintLen32 {
-		return decbuf{e: errors.Errorf("invalid uvarint %d", n)}
+		return decbuf{e: fileutil.NewErrCorrupt(r.b, off, "invalid uvarint %d", n)}
 	}
 
 	if r.b.Len() < off+n+int(l)+4 {
-		return decbuf{e: errInvalidSize}
+		return decbuf{e: fileutil.NewErrCorrupt(r.b, off, "entry of length %d exceeds size %d", l, r.b.Len())}
 	}
 
 	// Load bytes holding the contents plus a CRC32 checksum.
-	b = r.b.Range(off+n, off+n+int(l)+4)
+	b, err = fileutil.ReadRange(r.b, off+n, off+n+int(l)+4)
+	if err != nil {
+		return decbuf{e: err}
+	}
 	dec := decbuf{b: b[:len(b)-4]}
 
 	if dec.crc32() != binary.BigEndian.Uint32(b[len(b)-4:]) {
-		return decbuf{e: errInvalidChecksum}
+		return decbuf{e: fileutil.NewErrCorrupt(r.b, off, "entry checksum mismatch")}
 	}
 	return dec
 }
@@ -776,33 +1574,52 @@ func (r *Reader) readSymbols(off int) error {
 		nextPos = basePos + uint32(origLen-d.len())
 	)
 
-	if r.version == 2 {
+	if r.version >= indexFormatV2 {
 		nextPos = 0
 	}
 
+	var prev string
+
 	for d.err() == nil && d.len() > 0 && cnt > 0 {
-		s := d.uvarintStr()
+		var s string
+
+		if r.version >= indexFormatV6 {
+			p := d.uvarint()
+			if p > len(prev) {
+				return fileutil.NewErrCorrupt(r.b, off, "shared prefix length %d exceeds previous symbol", p)
+			}
+			s = prev[:p] + d.uvarintStr()
+		} else {
+			s = d.uvarintStr()
+		}
 		r.symbols[nextPos] = s
+		r.sortedSymbols = append(r.sortedSymbols, s)
+		prev = s
 
-		if r.version == 2 {
+		if r.version >= indexFormatV2 {
 			nextPos++
 		} else {
 			nextPos = basePos + uint32(origLen-d.len())
 		}
 		cnt--
 	}
+	// Writers store symbols sorted. Don't rely on it for indices written by
+	// other implementations.
+	if !sort.StringsAreSorted(r.sortedSymbols) {
+		sort.Strings(r.sortedSymbols)
+	}
 	return errors.Wrap(d.err(), "read symbols")
 }
 
 // readOffsetTable reads an offset table at the given position calls f for each
 // found entry.f
 // If f returns an error it stops decoding and returns the received error,
-func (r *Reader) readOffsetTable(off uint64, f func([]string, uint64) error) error {
-	d := r.decbufAt(int(off))
+func (r *Reader) readOffsetTable(b ByteSlice, off uint64, f func([]string, uint64) error) error {
+	d := decbufAt(b, int(off))
 	cnt := d.be32()
 
 	for d.err() == nil && d.len() > 0 && cnt > 0 {
-		keyCount := d.uvarint()
+		keyCount := d.uvarintLen(1)
 		keys := make([]string, 0, keyCount)
 
 		for i := 0; i < keyCount; i++ {
@@ -820,27 +1637,295 @@ func (r *Reader) readOffsetTable(off uint64, f func([]string, uint64) error) err
 	return d.err()
 }
 
+// offsetTable resolves tuples of strings to the offsets of index sections.
+type offsetTable interface {
+	// get returns the offset stored for the given keys and whether it exists.
+	get(keys ...string) (uint64, bool, error)
+	// iter calls f for each entry in the table. It stops and returns
+	// the first error returned by f.
+	iter(f func(keys []string, off uint64) error) error
+	// scan calls f for the entries in key order, starting at the first entry
+	// whose keys are not less than from. It stops once f returns false.
+	scan(from []string, f func(keys []string, off uint64) bool) error
+}
+
+// mapOffsetTable is an offset table fully loaded into memory. It is used for
+// index formats whose offset tables are not sorted.
+type mapOffsetTable map[string]uint64
+
+// mapOffsetTableKey joins keys into a key of a mapOffsetTable. Each key is
+// prefixed with its length as label values may contain any byte.
+func mapOffsetTableKey(keys []string) string {
+	var (
+		b   []byte
+		buf [binary.MaxVarintLen64]byte
+	)
+	for _, k := range keys {
+		b = append(b, buf[:binary.PutUvarint(buf[:], uint64(len(k)))]...)
+		b = append(b, k...)
+	}
+	return string(b)
+}
+
+// splitMapOffsetTableKey returns the keys joined by mapOffsetTableKey.
+func splitMapOffsetTableKey(k string) []string {
+	var keys []string
+
+	for b := []byte(k); len(b) > 0; {
+		l, n := binary.Uvarint(b)
+		b = b[n:]
+		keys = append(keys, string(b[:l]))
+		b = b[l:]
+	}
+	return keys
+}
+
+func (t mapOffsetTable) get(keys ...string) (uint64, bool, error) {
+	off, ok := t[mapOffsetTableKey(keys)]
+	return off, ok, nil
+}
+
+func (t mapOffsetTable) iter(f func([]string, uint64) error) error {
+	for k, off := range t {
+		if err := f(splitMapOffsetTableKey(k), off); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t mapOffsetTable) scan(from []string, f func([]string, uint64) bool) error {
+	var keys [][]string
+
+	for k := range t {
+		if ks := splitMapOffsetTableKey(k); compareKeys(ks, from) >= 0 {
+			keys = append(keys, ks)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return compareKeys(keys[i], keys[j]) < 0
+	})
+	for _, k := range keys {
+		if !f(k, t[mapOffsetTableKey(k)]) {
+			break
+		}
+	}
+	return nil
+}
+
+// readMapOffsetTable reads the offset table at off into memory. All keys
+// must be of length n.
+func (r *Reader) readMapOffsetTable(b ByteSlice, off uint64, n int) (mapOffsetTable, error) {
+	t := mapOffsetTable{}
+
+	err := r.readOffsetTable(b, off, func(keys []string, o uint64) error {
+		if len(keys) != n {
+			return fileutil.NewErrCorrupt(b, int(off), "unexpected key length %d", len(keys))
+		}
+		t[mapOffsetTableKey(keys)] = o
+		return nil
+	})
+	return t, err
+}
+
+// offsetTableSampling is the interval at which the keys of entries in
+// on-disk offset tables are held in memory.
+const offsetTableSampling = 32
+
+// diskOffsetTable is an offset table whose entries are sorted by their keys. It
+// is read directly from the underlying byte slice and only holds the keys of
+// every offsetTableSampling-th entry in memory. Lookups find the closest
+// sampled entry and scan the table from there.
+// A fixed size array of entry positions trails the entries and provides
+// random access to them.
+type diskOffsetTable struct {
+	b      ByteSlice
+	start  int // Position of the table in the byte slice.
+	posOff int // Position of the array of entry positions.
+	cnt    int
+
+	sampled [][]string
+}
+
+// newDiskOffsetTable verifies the offset table at off in b and returns a reader for it.
+func (r *Reader) newDiskOffsetTable(b ByteSlice, off uint64) (*diskOffsetTable, error) {
+	d := decbufAt(b, int(off))
+	l := d.len()
+	cnt := d.be32int()
+
+	if d.err() != nil {
+		return nil, d.err()
+	}
+	if 4*cnt > d.len() {
+		return nil, fileutil.NewErrCorrupt(b, int(off), "%d offset table positions exceed its length %d", cnt, d.len())
+	}
+	t := &diskOffsetTable{
+		b:       b,
+		start:   int(off),
+		posOff:  int(off) + 4 + l - 4*cnt,
+		cnt:     cnt,
+		sampled: make([][]string, 0, (cnt+offsetTableSampling-1)/offsetTableSampling),
+	}
+	for i := 0; i < cnt; i += offsetTableSampling {
+		keys, _, err := t.at(i)
+		if err != nil {
+			return nil, errors.Wrapf(err, "read offset table entry %d", i)
+		}
+		t.sampled = append(t.sampled, keys)
+	}
+	return t, nil
+}
+
+// entry returns a decoding buffer starting at the i-th entry.
+func (t *diskOffsetTable) entry(i int) decbuf {
+	p := t.posOff + 4*i
+	b, err := fileutil.ReadRange(t.b, p, p+4)
+	if err != nil {
+		return decbuf{e: err}
+	}
+	pos := t.start + int(binary.BigEndian.Uint32(b))
+
+	if pos >= t.posOff {
+		return decbuf{e: fileutil.NewErrCorrupt(t.b, p, "offset table entry position %d exceeds table", pos)}
+	}
+	b, err = fileutil.ReadRange(t.b, pos, t.posOff)
+	if err != nil {
+		return decbuf{e: err}
+	}
+	return decbuf{b: b}
+}
+
+// at decodes the keys and offset of the i-th entry.
+func (t *diskOffsetTable) at(i int) ([]string, uint64, error) {
+	d := t.entry(i)
+	n := d.uvarintLen(1)
+	keys := make([]string, 0, n)
+
+	for k := 0; k < n; k++ {
+		keys = append(keys, d.uvarintStr())
+	}
+	off := d.uvarint64()
+
+	return keys, off, d.err()
+}
+
+// cmp compares the keys of the i-th entry to the given keys. If they are
+// equal, the entry's offset is returned as well.
+func (t *diskOffsetTable) cmp(i int, keys []string) (int, uint64, error) {
+	d := t.entry(i)
+	n := d.uvarintLen(1)
+
+	for k := 0; k < n; k++ {
+		b := d.uvarintBytes()
+		if d.err() != nil {
+			return 0, 0, d.err()
+		}
+		if k >= len(keys) {
+			return 1, 0, nil
+		}
+		if c := strings.Compare(yoloString(b), keys[k]); c != 0 {
+			return c, 0, nil
+		}
+	}
+	off := d.uvarint64()
+	if d.err() != nil {
+		return 0, 0, d.err()
+	}
+	if n < len(keys) {
+		return -1, 0, nil
+	}
+	return 0, off, nil
+}
+
+// seek returns the position of the first entry whose keys are not less than
+// the given keys.
+func (t *diskOffsetTable) seek(keys []string) (int, error) {
+	// Find the last sampled entry not greater than keys and scan from there on.
+	j := sort.Search(len(t.sampled), func(j int) bool {
+		return compareKeys(t.sampled[j], keys) > 0
+	})
+	if j == 0 {
+		return 0, nil
+	}
+	i := (j - 1) * offsetTableSampling
+
+	for ; i < t.cnt; i++ {
+		c, _, err := t.cmp(i, keys)
+		if err != nil {
+			return 0, err
+		}
+		if c >= 0 {
+			break
+		}
+	}
+	return i, nil
+}
+
+func (t *diskOffsetTable) get(keys ...string) (uint64, bool, error) {
+	i, err := t.seek(keys)
+	if err != nil || i == t.cnt {
+		return 0, false, err
+	}
+	c, off, err := t.cmp(i, keys)
+	if err != nil || c != 0 {
+		return 0, false, err
+	}
+	return off, true, nil
+}
+
+func (t *diskOffsetTable) iter(f func([]string, uint64) error) error {
+	for i := 0; i < t.cnt; i++ {
+		keys, off, err := t.at(i)
+		if err != nil {
+			return err
+		}
+		if err := f(keys, off); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *diskOffsetTable) scan(from []string, f func([]string, uint64) bool) error {
+	i, err := t.seek(from)
+	if err != nil {
+		return err
+	}
+	for ; i < t.cnt; i++ {
+		keys, off, err := t.at(i)
+		if err != nil {
+			return err
+		}
+		if !f(keys, off) {
+			break
+		}
+	}
+	return nil
+}
+
 // Close the reader and its underlying resources.
 func (r *Reader) Close() error {
+	if r.c == nil {
+		return nil
+	}
 	return r.c.Close()
 }
 
+// lookupSymbol returns the symbol at the given offset. All symbols are
+// converted to strings once when the reader is opened, so lookups neither
+// decode nor allocate.
 func (r *Reader) lookupSymbol(o uint32) (string, error) {
 	s, ok := r.symbols[o]
 	if !ok {
-		return "", errors.Errorf("unknown symbol offset %d", o)
+		return "", fileutil.NewErrCorrupt(r.b, -1, "unknown symbol offset %d", o)
 	}
 	return s, nil
 }
 
-// Symbols returns a set of symbols that exist within the index.
-func (r *Reader) Symbols() (map[string]struct{}, error) {
-	res := make(map[string]struct{}, len(r.symbols))
-
-	for _, s := range r.symbols {
-		res[s] = struct{}{}
-	}
-	return res, nil
+// Symbols returns an iterator over the symbols that exist within the index
+// in sorted order.
+func (r *Reader) Symbols() StringIter {
+	return NewStringListIter(r.sortedSymbols)
 }
 
 // SymbolTable returns the symbol table that is used to resolve symbol references.
@@ -850,10 +1935,10 @@ func (r *Reader) SymbolTable() map[uint32]string {
 
 // LabelValues returns value tuples that exist for the given label name tuples.
 func (r *Reader) LabelValues(names ...string) (StringTuples, error) {
-	const sep = "\xff"
-
-	key := strings.Join(names, sep)
-	off, ok := r.labels[key]
+	off, ok, err := r.labels.get(names...)
+	if err != nil {
+		return nil, errors.Wrap(err, "read label index table")
+	}
 	if !ok {
 		// XXX(fabxc): hot fix. Should return a partial data error and handle cases
 		// where the entire block has no data gracefully.
@@ -861,7 +1946,7 @@ func (r *Reader) LabelValues(names ...string) (StringTuples, error) {
 		//return nil, fmt.Errorf("label index doesn't exist")
 	}
 
-	d := r.decbufAt(int(off))
+	d := r.sectionAt(r.b, int(off))
 
 	nc := d.be32int()
 	d.be32() // consume unused value entry count.
@@ -869,12 +1954,10 @@ func (r *Reader) LabelValues(names ...string) (StringTuples, error) {
 	if d.err() != nil {
 		return nil, errors.Wrap(d.err(), "read label value index")
 	}
-	st := &serializedStringTuples{
-		idsCount: nc,
-		idsBytes: d.get(),
-		lookup:   r.lookupSymbol,
+	if nc == 0 || d.len()%(4*nc) != 0 {
+		return nil, errors.Wrapf(errInvalidSize, "read label value index of %d bytes for tuples of length %d", d.len(), nc)
 	}
-	return st, nil
+	return newSerializedStringTuples(d.get(), nc, r.lookupSymbol), nil
 }
 
 type emptyStringTuples struct{}
@@ -884,12 +1967,14 @@ func (emptyStringTuples) Len() int                   { return 0 }
 
 // LabelIndices returns a for which labels or label tuples value indices exist.
 func (r *Reader) LabelIndices() ([][]string, error) {
-	const sep = "\xff"
-
 	res := [][]string{}
 
-	for s := range r.labels {
-		res = append(res, strings.Split(s, sep))
+	err := r.labels.iter(func(key []string, _ uint64) error {
+		res = append(res, key)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 	return res, nil
 }
@@ -897,9 +1982,9 @@ func (r *Reader) LabelIndices() ([][]string, error) {
 // Series reads the series with the given ID and writes its labels and chunks into lbls and chks.
 func (r *Reader) Series(id uint64, lbls *labels.Labels, chks *[]chunks.Meta) error {
 	offset := id
-	// In version 2 series IDs are no longer exact references but series are 16-byte padded
+	// Since version 2 series IDs are no longer exact references but series are 16-byte padded
 	// and the ID is the multiple of 16 of the actual position.
-	if r.version == 2 {
+	if r.version >= indexFormatV2 {
 		offset = id * 16
 	}
 	d := r.decbufUvarintAt(int(offset))
@@ -909,20 +1994,117 @@ func (r *Reader) Series(id uint64, lbls *labels.Labels, chks *[]chunks.Meta) err
 	return errors.Wrap(r.dec.Series(d.get(), lbls, chks), "read series")
 }
 
+// SeriesStats summarizes the chunks of a series.
+type SeriesStats struct {
+	// Chunks is the number of chunks of the series.
+	Chunks int
+	// Samples and Bytes are the total number of samples and the encoded size
+	// of the chunks. They are zero if unknown, which is the case for indices
+	// before format version 9 and series added without chunk data.
+	Samples uint64
+	Bytes   uint64
+}
+
+// seriesStats returns the stats of the given chunks if all of them hold data.
+func seriesStats(chks []chunks.Meta) SeriesStats {
+	stats := SeriesStats{Chunks: len(chks)}
+
+	for _, c := range chks {
+		if c.Chunk == nil {
+			return SeriesStats{Chunks: len(chks)}
+		}
+		stats.Samples += uint64(c.Chunk.NumSamples())
+		stats.Bytes += uint64(len(c.Chunk.Bytes()))
+	}
+	return stats
+}
+
+// SeriesStats returns the stats of the series with the given ID. They are
+// read from the series entry without decoding any chunks.
+func (r *Reader) SeriesStats(id uint64) (SeriesStats, error) {
+	offset := id
+	if r.version >= indexFormatV2 {
+		offset = id * 16
+	}
+	d := r.decbufUvarintAt(int(offset))
+	if d.err() != nil {
+		return SeriesStats{}, d.err()
+	}
+	// Skip the label references.
+	for k := d.uvarintLen(2); k > 0 && d.err() == nil; k-- {
+		d.uvarint()
+		d.uvarint()
+	}
+	stats := SeriesStats{Chunks: d.uvarintLen(3)}
+
+	if stats.Chunks > 0 {
+		// Skip the chunk metas, which take three varints each.
+		for i := 0; i < 3*stats.Chunks && d.err() == nil; i++ {
+			d.uvarint64()
+		}
+		if r.version >= indexFormatV9 {
+			stats.Samples = d.uvarint64()
+			stats.Bytes = d.uvarint64()
+		}
+	}
+	return stats, errors.Wrap(d.err(), "read series stats")
+}
+
 // Postings returns a postings list for the given label pair.
 func (r *Reader) Postings(name, value string) (Postings, error) {
-	off, ok := r.postings[labels.Label{
-		Name:  name,
-		Value: value,
-	}]
+	off, ok, err := r.postings.get(name, value)
+	if err != nil {
+		return nil, errors.Wrap(err, "read postings table")
+	}
 	if !ok {
 		return EmptyPostings(), nil
 	}
-	d := r.decbufAt(int(off))
+	return r.postingsAt(off)
+}
+
+// PrefixPostings returns the union of the postings lists of all label pairs with the
+// given name and a value starting with prefix. They are found with a single range scan
+// over the postings table.
+func (r *Reader) PrefixPostings(name, prefix string) (Postings, error) {
+	var offs []uint64
+
+	err := r.postings.scan([]string{name, prefix}, func(keys []string, off uint64) bool {
+		if len(keys) != 2 || keys[0] != name || !strings.HasPrefix(keys[1], prefix) {
+			return false
+		}
+		offs = append(offs, off)
+		return true
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "read postings table")
+	}
+
+	its := make([]Postings, 0, len(offs))
+	for _, off := range offs {
+		p, err := r.postingsAt(off)
+		if err != nil {
+			return nil, err
+		}
+		its = append(its, p)
+	}
+	return Merge(its...), nil
+}
+
+// postingsAt returns the postings list stored at the given offset.
+func (r *Reader) postingsAt(off uint64) (Postings, error) {
+	d := r.sectionAt(r.pb, int(off))
 	if d.err() != nil {
 		return nil, errors.Wrap(d.err(), "get postings entry")
 	}
-	_, p, err := r.dec.Postings(d.get())
+	var (
+		p   Postings
+		err error
+	)
+	if r.version >= indexFormatV7 {
+		_, p, err = r.dec.DeltaPostings(d.get())
+	} else {
+		_, p, err = r.dec.Postings(d.get())
+	}
 	if err != nil {
 		return nil, errors.Wrap(err, "decode postings")
 	}
@@ -935,6 +2117,96 @@ func (r *Reader) SortedPostings(p Postings) Postings {
 	return p
 }
 
+// Rewrite writes the full contents of the reader into the writer, which must not
+// have been written to yet, and closes it. It allows converting index files
+// of older format versions into the one written by the Writer.
+func Rewrite(w *Writer, r *Reader) error {
+	symbols := map[string]struct{}{}
+
+	for it := r.Symbols(); it.Next(); {
+		symbols[it.At()] = struct{}{}
+	}
+	if err := w.AddSymbols(symbols); err != nil {
+		return errors.Wrap(err, "add symbols")
+	}
+
+	rngs, err := r.PostingsRanges()
+	if err != nil {
+		return errors.Wrap(err, "read postings table")
+	}
+	keys := make([]labels.Label, 0, len(rngs))
+	for l := range rngs {
+		keys = append(keys, l)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return compareKeys([]string{keys[i].Name, keys[i].Value}, []string{keys[j].Name, keys[j].Value}) < 0
+	})
+
+	// Older indices do not necessarily contain a postings list of all series.
+	// Every series is part of at least one postings list however.
+	its := make([]Postings, 0, len(keys))
+	for _, l := range keys {
+		p, err := r.Postings(l.Name, l.Value)
+		if err != nil {
+			return errors.Wrapf(err, "read postings %s", l)
+		}
+		its = append(its, p)
+	}
+	var (
+		all  = Merge(its...)
+		lset labels.Labels
+		chks []chunks.Meta
+	)
+	// Series references are ordered by the series' labels in all format versions.
+	for all.Next() {
+		if err := r.Series(all.At(), &lset, &chks); err != nil {
+			return errors.Wrapf(err, "read series %d", all.At())
+		}
+		if err := w.AddSeries(all.At(), lset, chks...); err != nil {
+			return errors.Wrap(err, "add series")
+		}
+	}
+	if err := all.Err(); err != nil {
+		return errors.Wrap(err, "iterate series")
+	}
+
+	names, err := r.LabelIndices()
+	if err != nil {
+		return errors.Wrap(err, "read label index table")
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return compareKeys(names[i], names[j]) < 0
+	})
+	for _, n := range names {
+		tpls, err := r.LabelValues(n...)
+		if err != nil {
+			return errors.Wrapf(err, "read label index %s", n)
+		}
+		values := make([]string, 0, tpls.Len()*len(n))
+		for i := 0; i < tpls.Len(); i++ {
+			t, err := tpls.At(i)
+			if err != nil {
+				return errors.Wrapf(err, "read label index %s", n)
+			}
+			values = append(values, t...)
+		}
+		if err := w.WriteLabelIndex(n, values); err != nil {
+			return errors.Wrap(err, "write label index")
+		}
+	}
+
+	for _, l := range keys {
+		p, err := r.Postings(l.Name, l.Value)
+		if err != nil {
+			return errors.Wrapf(err, "read postings %s", l)
+		}
+		if err := w.WritePostings(l.Name, l.Value, p); err != nil {
+			return errors.Wrap(err, "write postings")
+		}
+	}
+	return w.Close()
+}
+
 type stringTuples struct {
 	length  int      // tuple length
 	entries []string // flattened tuple entries
@@ -947,20 +2219,22 @@ func NewStringTuples(entries []string, length int) (*stringTuples, error) {
 	return &stringTuples{entries: entries, length: length}, nil
 }
 
-func (t *stringTuples) Len() int                   { return len(t.entries) / t.length }
-func (t *stringTuples) At(i int) ([]string, error) { return t.entries[i : i+t.length], nil }
+func (t *stringTuples) Len() int { return len(t.entries) / t.length }
+func (t *stringTuples) At(i int) ([]string, error) {
+	return t.entries[i*t.length : (i+1)*t.length], nil
+}
 
 func (t *stringTuples) Swap(i, j int) {
-	c := make([]string, t.length)
-	copy(c, t.entries[i:i+t.length])
+	i, j = i*t.length, j*t.length
 
 	for k := 0; k < t.length; k++ {
-		t.entries[i+k] = t.entries[j+k]
-		t.entries[j+k] = c[k]
+		t.entries[i+k], t.entries[j+k] = t.entries[j+k], t.entries[i+k]
 	}
 }
 
 func (t *stringTuples) Less(i, j int) bool {
+	i, j = i*t.length, j*t.length
+
 	for k := 0; k < t.length; k++ {
 		d := strings.Compare(t.entries[i+k], t.entries[j+k])
 
@@ -974,33 +2248,85 @@ func (t *stringTuples) Less(i, j int) bool {
 	return false
 }
 
+// serializedStringTuples are the tuples of a label value index. They hold the
+// symbol references of all tuples, which are looked up on access unless the
+// tuples were decoded.
 type serializedStringTuples struct {
 	idsCount int
 	idsBytes []byte // bytes containing the ids pointing to the string in the lookup table.
 	lookup   func(uint32) (string, error)
+
+	n int // number of tuples
+	// entries holds the strings of all tuples once they were decoded.
+	entries []string
+}
+
+func newSerializedStringTuples(b []byte, idsCount int, lookup func(uint32) (string, error)) *serializedStringTuples {
+	return &serializedStringTuples{
+		idsCount: idsCount,
+		idsBytes: b,
+		lookup:   lookup,
+		n:        len(b) / (4 * idsCount),
+	}
 }
 
 func (t *serializedStringTuples) Len() int {
-	return len(t.idsBytes) / (4 * t.idsCount)
+	return t.n
 }
 
 func (t *serializedStringTuples) At(i int) ([]string, error) {
-	if len(t.idsBytes) < (i+t.idsCount)*4 {
-		return nil, errInvalidSize
+	if i < 0 || i >= t.n {
+		return nil, errors.Wrapf(errInvalidSize, "tuple %d of %d", i, t.n)
+	}
+	if t.entries != nil {
+		start, end := i*t.idsCount, (i+1)*t.idsCount
+		return t.entries[start:end:end], nil
 	}
-	res := make([]string, 0, t.idsCount)
+	res := make([]string, t.idsCount)
+	return res, t.read(i, res)
+}
 
-	for k := 0; k < t.idsCount; k++ {
-		offset := binary.BigEndian.Uint32(t.idsBytes[(i+k)*4:])
+// read looks up the strings of the i-th tuple into res.
+func (t *serializedStringTuples) read(i int, res []string) error {
+	for k := range res {
+		offset := binary.BigEndian.Uint32(t.idsBytes[(i*t.idsCount+k)*4:])
 
 		s, err := t.lookup(offset)
 		if err != nil {
-			return nil, errors.Wrap(err, "symbol lookup")
+			return errors.Wrap(err, "symbol lookup")
 		}
-		res = append(res, s)
+		res[k] = s
 	}
+	return nil
+}
 
-	return res, nil
+// decode looks up the strings of all tuples, after which At returns them
+// without further lookups or allocations.
+func (t *serializedStringTuples) decode() error {
+	if t.entries != nil {
+		return nil
+	}
+	entries := make([]string, t.n*t.idsCount)
+
+	for i := 0; i < t.n; i++ {
+		if err := t.read(i, entries[i*t.idsCount:(i+1)*t.idsCount]); err != nil {
+			return err
+		}
+	}
+	t.entries = entries
+	return nil
+}
+
+// DecodeStringTuples looks up the strings of all tuples returned by
+// Reader.LabelValues at once, which makes repeated access to them cheap.
+// Tuples that are held in memory already are returned as they are.
+func DecodeStringTuples(st StringTuples) (StringTuples, error) {
+	if t, ok := st.(*serializedStringTuples); ok {
+		if err := t.decode(); err != nil {
+			return nil, err
+		}
+	}
+	return st, nil
 }
 
 // Decoder provides decoding methods for the v1 and v2 index file format.
@@ -1014,7 +2340,7 @@ type Decoder struct {
 func (dec *Decoder) lookupSymbol(o uint32) (string, error) {
 	s, ok := dec.symbols[o]
 	if !ok {
-		return "", errors.Errorf("unknown symbol offset %d", o)
+		return "", fileutil.NewErrCorrupt(nil, -1, "unknown symbol offset %d", o)
 	}
 	return s, nil
 }
@@ -1030,9 +2356,23 @@ func (dec *Decoder) Postings(b []byte) (int, Postings, error) {
 	d := decbuf{b: b}
 	n := d.be32int()
 	l := d.get()
+
+	if d.err() == nil && len(l) != 4*n {
+		return 0, nil, errors.Wrapf(errInvalidSize, "%d postings in %d bytes", n, len(l))
+	}
 	return n, newBigEndianPostings(l), d.err()
 }
 
+// DeltaPostings returns a postings list for b, which holds delta encoded
+// references as written since format version 7, and its number of elements.
+func (dec *Decoder) DeltaPostings(b []byte) (int, Postings, error) {
+	p, err := newDeltaPostings(b)
+	if err != nil {
+		return 0, nil, err
+	}
+	return p.n, p, nil
+}
+
 // Series decodes a series entry from the given byte slice into lset and chks.
 func (dec *Decoder) Series(b []byte, lbls *labels.Labels, chks *[]chunks.Meta) error {
 	*lbls = (*lbls)[:0]
@@ -1040,7 +2380,8 @@ func (dec *Decoder) Series(b []byte, lbls *labels.Labels, chks *[]chunks.Meta) e
 
 	d := decbuf{b: b}
 
-	k := d.uvarint()
+	// Label references and chunk metas take at least 2 and 3 bytes.
+	k := d.uvarintLen(2)
 
 	for i := 0; i < k; i++ {
 		lno := uint32(d.uvarint())
@@ -1063,10 +2404,10 @@ func (dec *Decoder) Series(b []byte, lbls *labels.Labels, chks *[]chunks.Meta) e
 	}
 
 	// Read the chunks meta data.
-	k = d.uvarint()
+	k = d.uvarintLen(3)
 
 	if k == 0 {
-		return nil
+		return d.err()
 	}
 
 	t0 := d.varint64()
@@ -14,16 +14,21 @@
 package index
 
 import (
+	"fmt"
+	"io"
 	"io/ioutil"
 	"math/rand"
 	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/pkg/errors"
 	"github.com/prometheus/tsdb/chunkenc"
 	"github.com/prometheus/tsdb/chunks"
+	"github.com/prometheus/tsdb/fileutil"
 	"github.com/prometheus/tsdb/labels"
 	"github.com/prometheus/tsdb/testutil"
 )
@@ -50,8 +55,14 @@ func newMockIndex() mockIndex {
 	return ix
 }
 
-func (m mockIndex) Symbols() (map[string]struct{}, error) {
-	return m.symbols, nil
+func (m mockIndex) Symbols() StringIter {
+	l := make([]string, 0, len(m.symbols))
+	for s := range m.symbols {
+		l = append(l, s)
+	}
+	sort.Strings(l)
+
+	return NewStringListIter(l)
 }
 
 func (m mockIndex) AddSeries(ref uint64, l labels.Labels, chunks ...chunks.Meta) error {
@@ -234,6 +245,261 @@ func TestIndexRW_Postings(t *testing.T) {
 	testutil.Ok(t, ir.Close())
 }
 
+func TestIndexRW_SortSeries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_index_sort_series")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "index")
+
+	iw, err := NewWriter(fn)
+	testutil.Ok(t, err)
+	iw.SortSeries = true
+
+	series := []labels.Labels{
+		labels.FromStrings("a", "1", "b", "1"),
+		labels.FromStrings("a", "1", "b", "2"),
+		labels.FromStrings("a", "1", "b", "3"),
+	}
+	chks := []chunks.Meta{{Ref: 8, MinTime: 0, MaxTime: 100}}
+
+	testutil.Ok(t, iw.AddSymbols(map[string]struct{}{"a": {}, "b": {}, "1": {}, "2": {}, "3": {}}))
+
+	// Series are added out of order and one of them twice.
+	testutil.Ok(t, iw.AddSeries(3, series[2], chks...))
+	testutil.Ok(t, iw.AddSeries(1, series[0], chks...))
+	testutil.Ok(t, iw.AddSeries(4, series[2], chks...))
+	testutil.Ok(t, iw.AddSeries(2, series[1], chks...))
+	testutil.NotOk(t, iw.AddSeries(2, series[1], chks...))
+
+	testutil.Ok(t, iw.WritePostings("a", "1", newListPostings([]uint64{1, 2, 3, 4})))
+	testutil.Ok(t, iw.Close())
+
+	ir, err := NewFileReader(fn)
+	testutil.Ok(t, err)
+	defer ir.Close()
+
+	p, err := ir.Postings("a", "1")
+	testutil.Ok(t, err)
+
+	var (
+		res []labels.Labels
+		l   labels.Labels
+		c   []chunks.Meta
+	)
+	for p.Next() {
+		testutil.Ok(t, ir.Series(p.At(), &l, &c))
+		testutil.Equals(t, chks, c)
+		res = append(res, append(labels.Labels(nil), l...))
+	}
+	testutil.Ok(t, p.Err())
+	testutil.Equals(t, series, res)
+
+	// Series with equal label sets but different chunks conflict.
+	iw, err = NewWriter(filepath.Join(dir, "conflict"))
+	testutil.Ok(t, err)
+	iw.SortSeries = true
+
+	testutil.Ok(t, iw.AddSymbols(map[string]struct{}{"a": {}, "b": {}, "1": {}}))
+	testutil.Ok(t, iw.AddSeries(1, series[0], chks...))
+	testutil.Ok(t, iw.AddSeries(2, series[0], chunks.Meta{Ref: 16, MinTime: 0, MaxTime: 100}))
+	testutil.NotOk(t, iw.Close())
+}
+
+func TestIndexRW_OffsetTableLookup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_index_offset_table")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "index")
+
+	iw, err := NewWriter(fn)
+	testutil.Ok(t, err)
+
+	series := []labels.Labels{
+		labels.FromStrings("a", "1", "b", "1"),
+		labels.FromStrings("a", "1", "b", "2"),
+		labels.FromStrings("a", "2", "b", "1"),
+	}
+	err = iw.AddSymbols(map[string]struct{}{
+		"a": {},
+		"b": {},
+		"1": {},
+		"2": {},
+	})
+	testutil.Ok(t, err)
+
+	for i, s := range series {
+		testutil.Ok(t, iw.AddSeries(uint64(i+1), s))
+	}
+	testutil.Ok(t, iw.WriteLabelIndex([]string{"b"}, []string{"1", "2"}))
+	testutil.Ok(t, iw.WriteLabelIndex([]string{"a"}, []string{"1", "2"}))
+
+	// Postings are written out of order. The offset table must still be sorted.
+	testutil.Ok(t, iw.WritePostings("b", "2", newListPostings([]uint64{2})))
+	testutil.Ok(t, iw.WritePostings("a", "2", newListPostings([]uint64{3})))
+	testutil.Ok(t, iw.WritePostings("b", "1", newListPostings([]uint64{1, 3})))
+	testutil.Ok(t, iw.WritePostings("a", "1", newListPostings([]uint64{1, 2})))
+	testutil.Ok(t, iw.Close())
+
+	ir, err := NewFileReader(fn)
+	testutil.Ok(t, err)
+	defer ir.Close()
+
+	testutil.Equals(t, FormatVersion, ir.Version())
+
+	cases := []struct {
+		name, value string
+		exp         []labels.Labels
+	}{
+		{name: "a", value: "1", exp: series[:2]},
+		{name: "a", value: "2", exp: series[2:]},
+		{name: "b", value: "1", exp: []labels.Labels{series[0], series[2]}},
+		{name: "b", value: "2", exp: series[1:2]},
+		{name: "a", value: "0"},
+		{name: "a", value: "3"},
+		{name: "c", value: "1"},
+		{name: "", value: ""},
+	}
+	for _, c := range cases {
+		p, err := ir.Postings(c.name, c.value)
+		testutil.Ok(t, err)
+
+		var res []labels.Labels
+		for p.Next() {
+			var lset labels.Labels
+			var chks []chunks.Meta
+
+			testutil.Ok(t, ir.Series(p.At(), &lset, &chks))
+			res = append(res, lset)
+		}
+		testutil.Ok(t, p.Err())
+		testutil.Equals(t, c.exp, res)
+	}
+
+	tpls, err := ir.LabelValues("b")
+	testutil.Ok(t, err)
+	testutil.Equals(t, 2, tpls.Len())
+
+	tpls, err = ir.LabelValues("c")
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, tpls.Len())
+
+	idx, err := ir.LabelIndices()
+	testutil.Ok(t, err)
+	testutil.Equals(t, [][]string{{"a"}, {"b"}}, idx)
+
+	rngs, err := ir.PostingsRanges()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 4, len(rngs))
+}
+
+func TestMapOffsetTable(t *testing.T) {
+	// Keys may contain any byte, including those that could separate them.
+	entries := [][]string{
+		{"a\xffb", "c"},
+		{"a", "b\xffc"},
+		{"", "a"},
+		{"a", ""},
+	}
+	tbl := mapOffsetTable{}
+	for i, keys := range entries {
+		tbl[mapOffsetTableKey(keys)] = uint64(i)
+	}
+	testutil.Equals(t, len(entries), len(tbl))
+
+	for i, keys := range entries {
+		off, ok, err := tbl.get(keys...)
+		testutil.Ok(t, err)
+		testutil.Assert(t, ok, "keys %q not found", keys)
+		testutil.Equals(t, uint64(i), off)
+	}
+	_, ok, err := tbl.get("a", "b", "c")
+	testutil.Ok(t, err)
+	testutil.Assert(t, !ok, "unexpected entry")
+
+	var res [][]string
+	err = tbl.scan(nil, func(keys []string, off uint64) bool {
+		testutil.Equals(t, entries[off], keys)
+		res = append(res, keys)
+		return true
+	})
+	testutil.Ok(t, err)
+	testutil.Equals(t, [][]string{entries[2], entries[3], entries[1], entries[0]}, res)
+}
+
+func TestIndexRW_PrefixPostings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_index_prefix_postings")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "index")
+
+	iw, err := NewWriter(fn)
+	testutil.Ok(t, err)
+
+	// Use enough values to span several sampled offset table entries.
+	var (
+		series  []labels.Labels
+		symbols = map[string]struct{}{"a": {}, "b": {}}
+	)
+	for i := 0; i < 5*offsetTableSampling; i++ {
+		v := fmt.Sprintf("%03d", i)
+		symbols[v] = struct{}{}
+		series = append(series, labels.FromStrings("a", v, "b", v))
+	}
+	testutil.Ok(t, iw.AddSymbols(symbols))
+
+	for i, s := range series {
+		testutil.Ok(t, iw.AddSeries(uint64(i), s))
+	}
+	for _, n := range []string{"a", "b"} {
+		for i, s := range series {
+			testutil.Ok(t, iw.WritePostings(n, s.Get(n), newListPostings([]uint64{uint64(i)})))
+		}
+	}
+	testutil.Ok(t, iw.Close())
+
+	ir, err := NewFileReader(fn)
+	testutil.Ok(t, err)
+	defer ir.Close()
+
+	for i, s := range series {
+		p, err := ir.Postings("b", s.Get("b"))
+		testutil.Ok(t, err)
+		testutil.Assert(t, p.Next(), "postings for series %d missing", i)
+	}
+
+	cases := []struct {
+		name, prefix string
+		exp          int
+	}{
+		{name: "a", prefix: "", exp: len(series)},
+		{name: "a", prefix: "0", exp: 100},
+		{name: "a", prefix: "03", exp: 10},
+		{name: "b", prefix: "15", exp: 10},
+		{name: "b", prefix: "159", exp: 1},
+		{name: "b", prefix: "2", exp: 0},
+		{name: "c", prefix: "", exp: 0},
+	}
+	for _, c := range cases {
+		p, err := ir.PrefixPostings(c.name, c.prefix)
+		testutil.Ok(t, err)
+
+		refs, err := ExpandPostings(p)
+		testutil.Ok(t, err)
+		testutil.Equals(t, c.exp, len(refs))
+
+		for _, ref := range refs {
+			var lset labels.Labels
+			var chks []chunks.Meta
+
+			testutil.Ok(t, ir.Series(ref, &lset, &chks))
+			testutil.Assert(t, strings.HasPrefix(lset.Get(c.name), c.prefix), "unexpected series %s", lset)
+		}
+	}
+}
+
 func TestPersistence_index_e2e(t *testing.T) {
 	dir, err := ioutil.TempDir("", "test_persistence_e2e")
 	testutil.Ok(t, err)
@@ -388,3 +654,691 @@ func TestReaderWithInvalidBuffer(t *testing.T) {
 	db := r.decbufUvarintAt(0)
 	testutil.NotOk(t, db.err())
 }
+
+func TestDecoder_InvalidSeries(t *testing.T) {
+	dec := &Decoder{symbols: map[uint32]string{1: "a", 2: "b"}}
+
+	var e encbuf
+	e.putUvarint(1)
+	e.putUvarint(1)
+	e.putUvarint(2)
+	e.putUvarint(2)
+	e.putVarint64(1000)
+	e.putUvarint64(100)
+	e.putUvarint64(8)
+	e.putUvarint64(10)
+	e.putUvarint64(100)
+	e.putVarint64(64)
+	valid := e.get()
+
+	var (
+		lset labels.Labels
+		chks []chunks.Meta
+	)
+	testutil.Ok(t, dec.Series(valid, &lset, &chks))
+	testutil.Equals(t, 2, len(chks))
+
+	// Truncated entries must fail instead of panicking.
+	for i := 0; i < len(valid); i++ {
+		err := dec.Series(valid[:i], &lset, &chks)
+		testutil.Assert(t, fileutil.IsCorrupt(err), "unexpected error: %v", err)
+	}
+	// Counts exceeding the entry must fail before allocating.
+	for _, b := range [][]byte{
+		{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f},
+		{0x00, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01},
+		{0x00, 0x80, 0x80, 0x80, 0x80, 0x08, 0x00, 0x00, 0x00},
+	} {
+		err := dec.Series(b, &lset, &chks)
+		testutil.Assert(t, fileutil.IsCorrupt(err), "unexpected error: %v", err)
+	}
+}
+
+func TestDecbuf_InvalidLengths(t *testing.T) {
+	d := decbuf{b: []byte{1, 2, 3, 4}}
+	d.be64()
+	testutil.NotOk(t, d.err())
+
+	// A length that overflows int must not pass the bounds check.
+	var e encbuf
+	e.putUvarint64(1 << 63)
+	e.putString("abc")
+
+	d = decbuf{b: e.get()}
+	d.uvarintStr()
+	testutil.NotOk(t, d.err())
+
+	d = decbuf{b: e.get()}
+	d.uvarintBytes()
+	testutil.NotOk(t, d.err())
+
+	d = decbuf{b: e.get()}
+	d.uvarintLen(1)
+	testutil.NotOk(t, d.err())
+
+	d = decbuf{b: []byte{1, 2, 3}}
+	sub := d.decbuf(-1)
+	testutil.NotOk(t, sub.err())
+}
+
+func TestIndexRW_LabelSketches(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_index_label_sketches")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "index")
+
+	iw, err := NewWriter(fn)
+	testutil.Ok(t, err)
+
+	var (
+		values  []string
+		symbols = map[string]struct{}{"a": {}, "b": {}, "x": {}}
+	)
+	for i := 0; i < 2000; i++ {
+		v := fmt.Sprintf("%04d", i)
+		symbols[v] = struct{}{}
+		values = append(values, v)
+	}
+	testutil.Ok(t, iw.AddSymbols(symbols))
+	testutil.Ok(t, iw.WriteLabelIndex([]string{"a"}, values))
+	testutil.Ok(t, iw.WriteLabelIndex([]string{"b"}, []string{"x"}))
+	testutil.Ok(t, iw.Close())
+
+	ir, err := NewFileReader(fn)
+	testutil.Ok(t, err)
+	defer ir.Close()
+
+	sketches, err := ir.LabelSketches()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 2, len(sketches))
+	testutil.Equals(t, uint64(1), sketches["b"].Estimate())
+
+	est := float64(sketches["a"].Estimate())
+	testutil.Assert(t, est > 1800 && est < 2200, "unexpected estimate %v for 2000 values", est)
+}
+
+func TestReader_PostingsStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_index_postings_stats")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, c := range []Compression{CompressionNone, CompressionSnappy} {
+		fn := filepath.Join(dir, fmt.Sprintf("index-%d", c))
+
+		iw, err := NewWriter(fn)
+		testutil.Ok(t, err)
+		iw.Compression = c
+
+		var (
+			symbols  = map[string]struct{}{"a": {}, "b": {}, "c": {}, "x": {}, "0": {}, "1": {}}
+			postings = NewMemPostings()
+			series   []labels.Labels
+		)
+		for i := 0; i < 10; i++ {
+			symbols[strconv.Itoa(i)] = struct{}{}
+			series = append(series, labels.FromStrings("a", strconv.Itoa(i), "b", "x", "c", strconv.Itoa(i%2)))
+		}
+		testutil.Ok(t, iw.AddSymbols(symbols))
+
+		for i, lset := range series {
+			testutil.Ok(t, iw.AddSeries(uint64(i+1), lset))
+			postings.Add(uint64(i+1), lset)
+		}
+		for _, l := range postings.SortedKeys() {
+			testutil.Ok(t, iw.WritePostings(l.Name, l.Value, postings.Get(l.Name, l.Value)))
+		}
+		testutil.Ok(t, iw.Close())
+
+		ir, err := NewFileReader(fn)
+		testutil.Ok(t, err)
+
+		stats, err := ir.PostingsStats(2)
+		testutil.Ok(t, err)
+		testutil.Equals(t, 2, len(stats.BySeries))
+		testutil.Equals(t, PostingsStat{Label: labels.Label{Name: "b", Value: "x"}, Series: 10, Bytes: stats.BySeries[0].Bytes}, stats.BySeries[0])
+		testutil.Equals(t, labels.Label{Name: "c", Value: "0"}, stats.BySeries[1].Label)
+		testutil.Equals(t, 5, stats.BySeries[1].Series)
+		testutil.Equals(t, labels.Label{Name: "b", Value: "x"}, stats.BySize[0].Label)
+
+		// All label pairs but the list of all postings are returned without limit.
+		stats, err = ir.PostingsStats(0)
+		testutil.Ok(t, err)
+		testutil.Equals(t, 13, len(stats.BySeries))
+		testutil.Equals(t, 13, len(stats.BySize))
+
+		// The head reports the same series counts.
+		testutil.Equals(t, stats.BySeries[0].Series, TopPostingsStats(postings.Stats(), 1).BySeries[0].Series)
+
+		testutil.Ok(t, ir.Close())
+	}
+}
+
+func TestIndexRW_Compression(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_index_compression")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	const n = 2000
+
+	symbols := map[string]struct{}{"a": {}, "b": {}, "x": {}}
+	var (
+		series []labels.Labels
+		values []string
+		refs   []uint64
+	)
+	for i := 0; i < n; i++ {
+		v := fmt.Sprintf("%05d", i)
+		symbols[v] = struct{}{}
+		series = append(series, labels.FromStrings("a", v, "b", "x"))
+		values = append(values, v)
+		refs = append(refs, uint64(i+1))
+	}
+
+	// Write the same index with and without compression.
+	writeIndex := func(fn string, c Compression) {
+		iw, err := NewWriter(fn)
+		testutil.Ok(t, err)
+		iw.Compression = c
+
+		testutil.Ok(t, iw.AddSymbols(symbols))
+		for i, s := range series {
+			testutil.Ok(t, iw.AddSeries(refs[i], s))
+		}
+		testutil.Ok(t, iw.WriteLabelIndex([]string{"a"}, values))
+		testutil.Ok(t, iw.WriteLabelIndex([]string{"b"}, []string{"x"}))
+		testutil.Ok(t, iw.WritePostings("b", "x", newListPostings(refs)))
+		testutil.Ok(t, iw.WritePostings("a", "00001", newListPostings(refs[1:2])))
+		testutil.Ok(t, iw.Close())
+	}
+	plainFn, compressedFn := filepath.Join(dir, "plain"), filepath.Join(dir, "compressed")
+	writeIndex(plainFn, CompressionNone)
+	writeIndex(compressedFn, CompressionSnappy)
+
+	plain, err := os.Stat(plainFn)
+	testutil.Ok(t, err)
+	compressed, err := os.Stat(compressedFn)
+	testutil.Ok(t, err)
+	testutil.Assert(t, compressed.Size() < plain.Size(), "compressed index not smaller: %d >= %d", compressed.Size(), plain.Size())
+
+	for _, fn := range []string{plainFn, compressedFn} {
+		ir, err := NewFileReader(fn)
+		testutil.Ok(t, err)
+
+		tpls, err := ir.LabelValues("a")
+		testutil.Ok(t, err)
+		testutil.Equals(t, n, tpls.Len())
+		for i := 0; i < tpls.Len(); i++ {
+			v, err := tpls.At(i)
+			testutil.Ok(t, err)
+			testutil.Equals(t, []string{values[i]}, v)
+		}
+
+		// Small sections are stored uncompressed in either case.
+		tpls, err = ir.LabelValues("b")
+		testutil.Ok(t, err)
+		testutil.Equals(t, 1, tpls.Len())
+
+		p, err := ir.Postings("b", "x")
+		testutil.Ok(t, err)
+		res, err := ExpandPostings(p)
+		testutil.Ok(t, err)
+		testutil.Equals(t, n, len(res))
+
+		p, err = ir.Postings("a", "00001")
+		testutil.Ok(t, err)
+		res, err = ExpandPostings(p)
+		testutil.Ok(t, err)
+		testutil.Equals(t, 1, len(res))
+
+		testutil.Ok(t, ir.Close())
+	}
+}
+
+func TestIndexRW_FrontCodedSymbols(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_index_symbols")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "index")
+
+	symbols := map[string]struct{}{"": {}, "pod": {}}
+	plainSize := 0
+	for i := 0; i < 100; i++ {
+		s := fmt.Sprintf("frontend-deployment-7d9f8b6c5d-%05d", i)
+		symbols[s] = struct{}{}
+		plainSize += 1 + len(s)
+	}
+
+	iw, err := NewWriter(fn)
+	testutil.Ok(t, err)
+	testutil.Ok(t, iw.AddSymbols(symbols))
+	testutil.Ok(t, iw.AddSeries(1, labels.FromStrings("pod", "frontend-deployment-7d9f8b6c5d-00042")))
+	testutil.Ok(t, iw.Close())
+
+	ir, err := NewFileReader(fn)
+	testutil.Ok(t, err)
+	defer ir.Close()
+
+	res, err := expandStringIter(ir.Symbols())
+	testutil.Ok(t, err)
+	testutil.Equals(t, sortedKeys(symbols), res)
+
+	// Shared prefixes are stored only once.
+	testutil.Assert(t, int(ir.toc.series-ir.toc.symbols) < plainSize/2, "symbol table not front coded")
+
+	var (
+		lset labels.Labels
+		chks []chunks.Meta
+	)
+	// Series IDs are their offset divided by 16. The first series is padded
+	// to the next multiple of 16 from the start of the section.
+	testutil.Ok(t, ir.Series((ir.toc.series+15)/16, &lset, &chks))
+	testutil.Equals(t, labels.FromStrings("pod", "frontend-deployment-7d9f8b6c5d-00042"), lset)
+}
+
+type countingReaderAt struct {
+	io.ReaderAt
+	reads int
+}
+
+func (r *countingReaderAt) ReadAt(b []byte, off int64) (int, error) {
+	r.reads++
+	return r.ReaderAt.ReadAt(b, off)
+}
+
+type failingReaderAt struct {
+	err error
+}
+
+func (r failingReaderAt) ReadAt(b []byte, off int64) (int, error) {
+	return 0, r.err
+}
+
+func TestIndexRW_Header(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_index_header")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "index")
+
+	var series []labels.Labels
+	symbols := map[string]struct{}{"a": {}, "b": {}, "1": {}}
+	for i := 0; i < 100; i++ {
+		v := fmt.Sprintf("%03d", i)
+		symbols[v] = struct{}{}
+		series = append(series, labels.FromStrings("a", "1", "b", v))
+	}
+	iw, err := NewWriter(fn)
+	testutil.Ok(t, err)
+	testutil.Ok(t, iw.AddSymbols(symbols))
+
+	refs := make([]uint64, 0, len(series))
+	for i, s := range series {
+		testutil.Ok(t, iw.AddSeries(uint64(i+1), s))
+		refs = append(refs, uint64(i+1))
+	}
+	testutil.Ok(t, iw.WriteLabelIndex([]string{"b"}, func() []string {
+		var vals []string
+		for _, s := range series {
+			vals = append(vals, s.Get("b"))
+		}
+		return vals
+	}()))
+	testutil.Ok(t, iw.WritePostings("a", "1", newListPostings(refs)))
+	testutil.Ok(t, iw.Close())
+
+	f, err := os.Open(fn)
+	testutil.Ok(t, err)
+	defer f.Close()
+	fi, err := f.Stat()
+	testutil.Ok(t, err)
+
+	hdr, err := BuildHeader(f, fi.Size())
+	testutil.Ok(t, err)
+	testutil.Assert(t, int64(len(hdr)) < fi.Size()/2, "header not smaller than index")
+
+	// Opening the reader does not touch the full index.
+	ra := &countingReaderAt{ReaderAt: f}
+	ir, err := NewHeaderReader(hdr, ra, nil)
+	testutil.Ok(t, err)
+	defer ir.Close()
+	testutil.Equals(t, 0, ra.reads)
+
+	syms, err := expandStringIter(ir.Symbols())
+	testutil.Ok(t, err)
+	testutil.Equals(t, sortedKeys(symbols), syms)
+
+	tpls, err := ir.LabelValues("b")
+	testutil.Ok(t, err)
+	testutil.Equals(t, len(series), tpls.Len())
+
+	p, err := ir.Postings("a", "1")
+	testutil.Ok(t, err)
+
+	var (
+		lset labels.Labels
+		chks []chunks.Meta
+	)
+	for i := 0; p.Next(); i++ {
+		testutil.Ok(t, ir.Series(p.At(), &lset, &chks))
+		testutil.Equals(t, series[i], lset)
+	}
+	testutil.Ok(t, p.Err())
+	testutil.Assert(t, ra.reads > 0, "full index not read lazily")
+
+	// Failed reads of the full index fail lookups rather than returning garbage.
+	errRead := errors.New("read failed")
+	fr := ir.WithReaderAt(failingReaderAt{err: errRead})
+	testutil.Ok(t, fr.Close())
+
+	_, err = fr.Postings("a", "1")
+	testutil.Equals(t, errRead, errors.Cause(err))
+
+	p, err = ir.Postings("a", "1")
+	testutil.Ok(t, err)
+	testutil.Assert(t, p.Next(), "no postings")
+	err = fr.Series(p.At(), &lset, &chks)
+	testutil.Equals(t, errRead, errors.Cause(err))
+
+	// The original reader is unaffected.
+	testutil.Ok(t, ir.Series(p.At(), &lset, &chks))
+
+	// Corrupted headers are rejected.
+	hdr[len(hdr)/2]++
+	_, err = NewHeaderReader(hdr, ra, nil)
+	testutil.NotOk(t, err)
+}
+
+func TestIndexRW_SeparatePostings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_index_separate_postings")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	const n = 1000
+
+	symbols := map[string]struct{}{"a": {}, "b": {}, "x": {}}
+	var (
+		series []labels.Labels
+		values []string
+		refs   []uint64
+	)
+	for i := 0; i < n; i++ {
+		v := fmt.Sprintf("%04d", i)
+		symbols[v] = struct{}{}
+		series = append(series, labels.FromStrings("a", v, "b", "x"))
+		values = append(values, v)
+		refs = append(refs, uint64(i+1))
+	}
+
+	// Write the same index with postings inline and in a separate file.
+	writeIndex := func(fn string, separate bool) {
+		iw, err := NewWriter(fn)
+		testutil.Ok(t, err)
+		iw.SeparatePostings = separate
+
+		testutil.Ok(t, iw.AddSymbols(symbols))
+		for i, s := range series {
+			testutil.Ok(t, iw.AddSeries(refs[i], s))
+		}
+		testutil.Ok(t, iw.WriteLabelIndex([]string{"a"}, values))
+		testutil.Ok(t, iw.WriteLabelIndex([]string{"b"}, []string{"x"}))
+		testutil.Ok(t, iw.WritePostings("b", "x", newListPostings(refs)))
+		for i, v := range values {
+			testutil.Ok(t, iw.WritePostings("a", v, newListPostings(refs[i:i+1])))
+		}
+		testutil.Ok(t, iw.Close())
+	}
+	inlineFn, splitFn := filepath.Join(dir, "inline"), filepath.Join(dir, "split")
+	writeIndex(inlineFn, false)
+	writeIndex(splitFn, true)
+
+	_, err = os.Stat(PostingsFilename(inlineFn))
+	testutil.Assert(t, os.IsNotExist(err), "unexpected postings file for inline postings")
+	_, err = os.Stat(PostingsFilename(splitFn))
+	testutil.Ok(t, err)
+
+	inline, err := os.Stat(inlineFn)
+	testutil.Ok(t, err)
+	split, err := os.Stat(splitFn)
+	testutil.Ok(t, err)
+	testutil.Assert(t, split.Size() < inline.Size(), "index with separate postings not smaller: %d >= %d", split.Size(), inline.Size())
+
+	for _, fn := range []string{inlineFn, splitFn} {
+		ir, err := NewFileReader(fn)
+		testutil.Ok(t, err)
+
+		tpls, err := ir.LabelValues("a")
+		testutil.Ok(t, err)
+		testutil.Equals(t, n, tpls.Len())
+
+		p, err := ir.Postings("b", "x")
+		testutil.Ok(t, err)
+		res, err := ExpandPostings(p)
+		testutil.Ok(t, err)
+		testutil.Equals(t, n, len(res))
+
+		p, err = ir.Postings("a", "0042")
+		testutil.Ok(t, err)
+		res, err = ExpandPostings(p)
+		testutil.Ok(t, err)
+		testutil.Equals(t, 1, len(res))
+
+		var (
+			lset labels.Labels
+			chks []chunks.Meta
+		)
+		testutil.Ok(t, ir.Series(res[0], &lset, &chks))
+		testutil.Equals(t, series[42], lset)
+
+		testutil.Ok(t, ir.Close())
+	}
+
+	// The index cannot be read without its postings file.
+	testutil.Ok(t, os.Remove(PostingsFilename(splitFn)))
+	_, err = NewFileReader(splitFn)
+	testutil.NotOk(t, err)
+}
+
+func TestReader_SeriesStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_index_series_stats")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "index")
+
+	newChunk := func(n int) chunkenc.Chunk {
+		c := chunkenc.NewXORChunk()
+		app, err := c.Appender()
+		testutil.Ok(t, err)
+		for i := 0; i < n; i++ {
+			app.Append(int64(i), float64(i))
+		}
+		return c
+	}
+	c1, c2 := newChunk(10), newChunk(120)
+
+	iw, err := NewWriter(fn)
+	testutil.Ok(t, err)
+	testutil.Ok(t, iw.AddSymbols(map[string]struct{}{"a": {}, "1": {}, "2": {}, "3": {}}))
+	testutil.Ok(t, iw.AddSeries(1, labels.FromStrings("a", "1"),
+		chunks.Meta{Ref: 8, MinTime: 0, MaxTime: 9, Chunk: c1},
+		chunks.Meta{Ref: 100, MinTime: 10, MaxTime: 129, Chunk: c2},
+	))
+	// Without chunk data only the number of chunks is known.
+	testutil.Ok(t, iw.AddSeries(2, labels.FromStrings("a", "2"), chunks.Meta{Ref: 500, MinTime: 0, MaxTime: 9}))
+	testutil.Ok(t, iw.AddSeries(3, labels.FromStrings("a", "3")))
+	testutil.Ok(t, iw.WritePostings("a", "1", newListPostings([]uint64{1})))
+	testutil.Ok(t, iw.WritePostings("a", "2", newListPostings([]uint64{2})))
+	testutil.Ok(t, iw.WritePostings("a", "3", newListPostings([]uint64{3})))
+	testutil.Ok(t, iw.Close())
+
+	ir, err := NewFileReader(fn)
+	testutil.Ok(t, err)
+	defer ir.Close()
+
+	cases := []struct {
+		value string
+		exp   SeriesStats
+	}{
+		{
+			value: "1",
+			exp: SeriesStats{
+				Chunks:  2,
+				Samples: 130,
+				Bytes:   uint64(len(c1.Bytes()) + len(c2.Bytes())),
+			},
+		},
+		{value: "2", exp: SeriesStats{Chunks: 1}},
+		{value: "3", exp: SeriesStats{}},
+	}
+	for _, c := range cases {
+		p, err := ir.Postings("a", c.value)
+		testutil.Ok(t, err)
+		refs, err := ExpandPostings(p)
+		testutil.Ok(t, err)
+		testutil.Equals(t, 1, len(refs))
+
+		stats, err := ir.SeriesStats(refs[0])
+		testutil.Ok(t, err)
+		testutil.Equals(t, c.exp, stats)
+
+		// The stats do not interfere with reading the series.
+		var (
+			lset labels.Labels
+			chks []chunks.Meta
+		)
+		testutil.Ok(t, ir.Series(refs[0], &lset, &chks))
+		testutil.Equals(t, labels.FromStrings("a", c.value), lset)
+		testutil.Equals(t, c.exp.Chunks, len(chks))
+	}
+}
+
+func expandStringIter(it StringIter) ([]string, error) {
+	var res []string
+	for it.Next() {
+		res = append(res, it.At())
+	}
+	return res, it.Err()
+}
+
+func sortedKeys(m map[string]struct{}) []string {
+	res := make([]string, 0, len(m))
+	for s := range m {
+		res = append(res, s)
+	}
+	sort.Strings(res)
+	return res
+}
+
+func TestMergeStringIters(t *testing.T) {
+	cases := []struct {
+		in  [][]string
+		res []string
+	}{
+		{
+			in:  nil,
+			res: nil,
+		},
+		{
+			in:  [][]string{{"a", "c"}},
+			res: []string{"a", "c"},
+		},
+		{
+			in:  [][]string{{"a", "c", "e"}, {}, {"b", "c", "f"}, {"a", "z"}},
+			res: []string{"a", "b", "c", "e", "f", "z"},
+		},
+	}
+	for _, c := range cases {
+		var its []StringIter
+		for _, l := range c.in {
+			its = append(its, NewStringListIter(l))
+		}
+		res, err := expandStringIter(MergeStringIters(its...))
+		testutil.Ok(t, err)
+		testutil.Equals(t, c.res, res)
+	}
+}
+
+func TestSeriesDecoder(t *testing.T) {
+	m := newMockIndex()
+
+	var exp []series
+	for i := 0; i < 200; i++ {
+		s := series{l: labels.FromStrings("a", strconv.Itoa(i), "b", "x")}
+		n := i % 7
+		// Series exceeding the remaining buffer are allocated separately.
+		if i == 100 {
+			n = 2 * maxSeriesDecoderBuffer
+		}
+		for j := 0; j < n; j++ {
+			s.chunks = append(s.chunks, chunks.Meta{Ref: uint64(j), MinTime: int64(j), MaxTime: int64(j)})
+		}
+		testutil.Ok(t, m.AddSeries(uint64(i), s.l, s.chunks...))
+		exp = append(exp, s)
+	}
+	var (
+		dec SeriesDecoder
+		res []series
+	)
+	for i := range exp {
+		lset, chks, err := dec.Series(m, uint64(i))
+		testutil.Ok(t, err)
+		testutil.Equals(t, len(lset), cap(lset))
+		testutil.Equals(t, len(chks), cap(chks))
+
+		if len(chks) == 0 {
+			chks = nil
+		}
+		res = append(res, series{l: lset, chunks: chks})
+	}
+	// Series stay intact after further reads.
+	testutil.Equals(t, exp, res)
+
+	_, _, err := dec.Series(m, 1000)
+	testutil.NotOk(t, err)
+}
+
+func TestReader_LabelValuesTuples(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_index_tuples")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "index")
+
+	iw, err := NewWriter(fn)
+	testutil.Ok(t, err)
+
+	testutil.Ok(t, iw.AddSymbols(map[string]struct{}{
+		"a": {}, "b": {}, "1": {}, "2": {}, "3": {}, "x": {}, "y": {}, "z": {},
+	}))
+	testutil.Ok(t, iw.AddSeries(1, labels.FromStrings("a", "1", "b", "x")))
+	testutil.Ok(t, iw.WriteLabelIndex([]string{"a", "b"}, []string{"1", "x", "2", "y", "3", "z"}))
+	testutil.Ok(t, iw.Close())
+
+	ir, err := NewFileReader(fn)
+	testutil.Ok(t, err)
+	defer ir.Close()
+
+	exp := [][]string{{"1", "x"}, {"2", "y"}, {"3", "z"}}
+
+	tpls, err := ir.LabelValues("a", "b")
+	testutil.Ok(t, err)
+
+	decoded, err := ir.LabelValues("a", "b")
+	testutil.Ok(t, err)
+	decoded, err = DecodeStringTuples(decoded)
+	testutil.Ok(t, err)
+
+	for _, st := range []StringTuples{tpls, decoded} {
+		testutil.Equals(t, len(exp), st.Len())
+
+		for i := range exp {
+			res, err := st.At(i)
+			testutil.Ok(t, err)
+			testutil.Equals(t, exp[i], res)
+		}
+		_, err = st.At(len(exp))
+		testutil.NotOk(t, err)
+	}
+}
@@ -20,6 +20,8 @@ import (
 	"strings"
 	"sync"
 
+	"github.com/pkg/errors"
+	"github.com/prometheus/tsdb/fileutil"
 	"github.com/prometheus/tsdb/labels"
 )
 
@@ -173,6 +175,23 @@ func (p *MemPostings) Delete(deleted map[uint64]struct{}) {
 }
 
 // Iter calls f for each postings list. It aborts if f returns an error and returns it.
+// Stats returns the number of series of all label pairs except for the list
+// of all postings. Each reference accounts for 8 bytes.
+func (p *MemPostings) Stats() []PostingsStat {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+
+	res := make([]PostingsStat, 0, len(p.m))
+
+	for l, refs := range p.m {
+		if l == allPostingsKey {
+			continue
+		}
+		res = append(res, PostingsStat{Label: l, Series: len(refs), Bytes: 8 * len(refs)})
+	}
+	return res
+}
+
 func (p *MemPostings) Iter(f func(labels.Label, Postings) error) error {
 	p.mtx.RLock()
 	defer p.mtx.RUnlock()
@@ -543,6 +562,68 @@ func (it *listPostings) Err() error {
 	return nil
 }
 
+// NewRangePostings returns the postings of p within the range [min, max). Applied
+// to the postings of all series, it allows scanning series ranges in parallel.
+func NewRangePostings(p Postings, min, max uint64) Postings {
+	return &rangePostings{p: p, min: min, max: max}
+}
+
+// rangePostings implements the Postings interface for the postings of an
+// underlying list within a range.
+type rangePostings struct {
+	p        Postings
+	min, max uint64
+
+	started, done bool
+}
+
+func (rp *rangePostings) At() uint64 {
+	return rp.p.At()
+}
+
+func (rp *rangePostings) Next() bool {
+	if rp.done {
+		return false
+	}
+	if !rp.started {
+		rp.started = true
+		if !rp.p.Next() {
+			return rp.check(false)
+		}
+		if rp.p.At() < rp.min {
+			return rp.check(rp.p.Seek(rp.min))
+		}
+		return rp.check(true)
+	}
+	return rp.check(rp.p.Next())
+}
+
+func (rp *rangePostings) Seek(x uint64) bool {
+	if rp.done {
+		return false
+	}
+	if x < rp.min {
+		x = rp.min
+	}
+	if !rp.started && !rp.Next() {
+		return false
+	}
+	return rp.check(rp.p.Seek(x))
+}
+
+// check ends the iteration if the underlying postings left the range.
+func (rp *rangePostings) check(ok bool) bool {
+	if !ok || rp.p.At() >= rp.max {
+		rp.done = true
+		return false
+	}
+	return true
+}
+
+func (rp *rangePostings) Err() error {
+	return rp.p.Err()
+}
+
 // bigEndianPostings implements the Postings interface over a byte stream of
 // big endian numbers.
 type bigEndianPostings struct {
@@ -590,3 +671,98 @@ func (it *bigEndianPostings) Seek(x uint64) bool {
 func (it *bigEndianPostings) Err() error {
 	return nil
 }
+
+// deltaPostings implements the Postings interface over varint encoded deltas
+// with restart points as written by putDeltaPostings.
+type deltaPostings struct {
+	n, interval int
+	restarts    []byte // pairs of big endian refs and offsets into body
+	body        []byte
+
+	idx int // number of decoded entries
+	pos int // offset of the next delta in body
+	cur uint64
+	err error
+}
+
+func newDeltaPostings(b []byte) (*deltaPostings, error) {
+	d := decbuf{b: b}
+	n := d.be32int()
+	interval := d.be32int()
+
+	if d.err() != nil {
+		return nil, d.err()
+	}
+	if n > 0 && interval <= 0 {
+		return nil, fileutil.NewErrCorrupt(nil, -1, "invalid postings restart interval %d", interval)
+	}
+	nr := 0
+	if n > 0 {
+		nr = (n + interval - 1) / interval
+	}
+	restarts := d.decbuf(8 * nr)
+	if restarts.err() != nil {
+		return nil, errors.Wrap(restarts.err(), "read restart points")
+	}
+	return &deltaPostings{
+		n:        n,
+		interval: interval,
+		restarts: restarts.get(),
+		body:     d.get(),
+	}, nil
+}
+
+func (it *deltaPostings) At() uint64 {
+	return it.cur
+}
+
+func (it *deltaPostings) Next() bool {
+	if it.idx >= it.n || it.err != nil {
+		return false
+	}
+	v, n := binary.Uvarint(it.body[it.pos:])
+	if n <= 0 {
+		it.err = fileutil.NewErrCorrupt(nil, -1, "invalid postings delta at offset %d of list", it.pos)
+		return false
+	}
+	it.pos += n
+
+	if it.idx%it.interval == 0 {
+		it.cur = v
+	} else {
+		it.cur += v
+	}
+	it.idx++
+	return true
+}
+
+func (it *deltaPostings) Seek(x uint64) bool {
+	if it.idx > 0 && it.cur >= x {
+		return true
+	}
+	// Jump to the last restart point at or before x if it is ahead of the
+	// current position.
+	nr := len(it.restarts) / 8
+	i := sort.Search(nr, func(i int) bool {
+		return uint64(binary.BigEndian.Uint32(it.restarts[i*8:])) > x
+	}) - 1
+
+	if i >= 0 && i*it.interval >= it.idx {
+		pos := int(binary.BigEndian.Uint32(it.restarts[i*8+4:]))
+		if pos > len(it.body) {
+			it.err = fileutil.NewErrCorrupt(nil, -1, "invalid postings restart point offset %d", pos)
+			return false
+		}
+		it.idx, it.pos = i*it.interval, pos
+	}
+	for it.Next() {
+		if it.cur >= x {
+			return true
+		}
+	}
+	return false
+}
+
+func (it *deltaPostings) Err() error {
+	return it.err
+}
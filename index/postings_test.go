@@ -554,3 +554,147 @@ func TestIntersectWithMerge(t *testing.T) {
 	testutil.Ok(t, err)
 	testutil.Equals(t, []uint64{30}, res)
 }
+
+func TestRangePostings(t *testing.T) {
+	lst := []uint64{1, 3, 5, 7, 9, 11}
+
+	cases := []struct {
+		min, max uint64
+		res      []uint64
+	}{
+		{min: 0, max: 100, res: lst},
+		{min: 3, max: 9, res: []uint64{3, 5, 7}},
+		{min: 4, max: 10, res: []uint64{5, 7, 9}},
+		{min: 12, max: 20, res: nil},
+		{min: 5, max: 5, res: nil},
+	}
+	for _, c := range cases {
+		res, err := ExpandPostings(NewRangePostings(newListPostings(lst), c.min, c.max))
+		testutil.Ok(t, err)
+		testutil.Equals(t, c.res, res)
+	}
+
+	// Seeking below the range starts at its beginning and seeking
+	// beyond it ends the iteration.
+	p := NewRangePostings(newListPostings(lst), 4, 10)
+	testutil.Assert(t, p.Seek(2), "seek below range failed")
+	testutil.Equals(t, uint64(5), p.At())
+	testutil.Assert(t, p.Next(), "next failed")
+	testutil.Equals(t, uint64(7), p.At())
+	testutil.Assert(t, !p.Seek(10), "seek beyond range succeeded")
+	testutil.Assert(t, !p.Next(), "next after end succeeded")
+}
+
+func TestDeltaPostings(t *testing.T) {
+	var refs []uint32
+	for i, r := 0, uint32(0); i < 1000; i++ {
+		r += 16 * uint32(1+rand.Intn(10))
+		refs = append(refs, r)
+	}
+	var e, tmp encbuf
+	putDeltaPostings(&e, &tmp, refs)
+
+	testutil.Assert(t, e.len() < 2*len(refs), "delta postings too large: %d bytes", e.len())
+
+	exp := make([]uint64, 0, len(refs))
+	for _, r := range refs {
+		exp = append(exp, uint64(r))
+	}
+
+	t.Run("iteration", func(t *testing.T) {
+		p, err := newDeltaPostings(e.get())
+		testutil.Ok(t, err)
+		testutil.Equals(t, len(refs), p.n)
+
+		res, err := ExpandPostings(p)
+		testutil.Ok(t, err)
+		testutil.Equals(t, exp, res)
+	})
+
+	t.Run("seek", func(t *testing.T) {
+		p, err := newDeltaPostings(e.get())
+		testutil.Ok(t, err)
+
+		// Seek across and within restart intervals and compare against
+		// a list of the same refs.
+		var x uint64
+		for x < exp[len(exp)-1] {
+			x += uint64(rand.Intn(2000))
+
+			lp := newListPostings(exp)
+			exists := lp.Seek(x)
+
+			testutil.Equals(t, exists, p.Seek(x))
+			if !exists {
+				break
+			}
+			testutil.Equals(t, lp.At(), p.At())
+		}
+		testutil.Ok(t, p.Err())
+	})
+
+	t.Run("long", func(t *testing.T) {
+		long := make([]uint32, longPostingsLen)
+		for i := range long {
+			long[i] = uint32(16 * i)
+		}
+		var e, tmp encbuf
+		putDeltaPostings(&e, &tmp, long)
+
+		p, err := newDeltaPostings(e.get())
+		testutil.Ok(t, err)
+		testutil.Equals(t, longPostingsRestartInterval, p.interval)
+
+		testutil.Assert(t, p.Seek(16*12345+1), "seek failed")
+		testutil.Equals(t, uint64(16*12346), p.At())
+		testutil.Assert(t, !p.Seek(16*longPostingsLen), "seek beyond end succeeded")
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		var e, tmp encbuf
+		putDeltaPostings(&e, &tmp, nil)
+
+		p, err := newDeltaPostings(e.get())
+		testutil.Ok(t, err)
+		testutil.Assert(t, !p.Next(), "unexpected entry")
+		testutil.Assert(t, !p.Seek(0), "unexpected entry")
+	})
+}
+
+func BenchmarkPostingsSeek(b *testing.B) {
+	var refs []uint32
+	for i := 0; i < 1000000; i++ {
+		refs = append(refs, uint32(16*i))
+	}
+	var be, delta, tmp encbuf
+	for _, r := range refs {
+		be.putBE32(r)
+	}
+	putDeltaPostings(&delta, &tmp, refs)
+
+	// Sparse seeks, as done when intersecting a long list with a short one.
+	var targets []uint64
+	for i := 0; i < len(refs); i += 5000 {
+		targets = append(targets, uint64(refs[i]+1))
+	}
+
+	b.Run("bigEndian", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			p := newBigEndianPostings(be.get())
+			for _, x := range targets {
+				p.Seek(x)
+			}
+		}
+	})
+	b.Run("delta", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			p, err := newDeltaPostings(delta.get())
+			if err != nil {
+				b.Fatal(err)
+			}
+			for _, x := range targets {
+				p.Seek(x)
+			}
+		}
+	})
+}
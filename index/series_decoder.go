@@ -0,0 +1,84 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package index
+
+import (
+	"github.com/prometheus/tsdb/chunks"
+	"github.com/prometheus/tsdb/labels"
+)
+
+// Bounds of the number of labels and chunk metas a SeriesDecoder allocates
+// at once. Buffers grow from the minimum to the maximum size.
+const (
+	minSeriesDecoderBuffer = 32
+	maxSeriesDecoderBuffer = 512
+)
+
+// SeriesReader reads series entries into the given buffers, resetting them
+// first.
+type SeriesReader interface {
+	Series(id uint64, lset *labels.Labels, chks *[]chunks.Meta) error
+}
+
+// SeriesDecoder reads series through a SeriesReader into scratch buffers
+// that are shared by many series, which saves growing new label and chunk
+// meta slices for each series. The returned slices remain valid after
+// further reads and are capped, so appending to them never overwrites
+// other series. A buffer is released once no returned series refers to it.
+//
+// A SeriesDecoder must not be used concurrently.
+type SeriesDecoder struct {
+	lbls labels.Labels
+	chks []chunks.Meta
+}
+
+// Series reads the series with the given ID from r.
+func (d *SeriesDecoder) Series(r SeriesReader, id uint64) (labels.Labels, []chunks.Meta, error) {
+	var (
+		lset = d.lbls[len(d.lbls):]
+		chks = d.chks[len(d.chks):]
+	)
+	if err := r.Series(id, &lset, &chks); err != nil {
+		return nil, nil, err
+	}
+	lset = lset[:len(lset):len(lset)]
+	chks = chks[:len(chks):len(chks)]
+
+	// Series not fitting into the remaining buffers were appended to new
+	// slices by the reader. Following series go to a new buffer then.
+	if n := len(d.lbls); len(lset) > 0 && n < cap(d.lbls) && &lset[0] == &d.lbls[:n+1][n] {
+		d.lbls = d.lbls[:n+len(lset)]
+	} else if len(lset) > 0 && len(lset) <= maxSeriesDecoderBuffer {
+		d.lbls = make(labels.Labels, 0, seriesDecoderBufferSize(cap(d.lbls)))
+	}
+	if n := len(d.chks); len(chks) > 0 && n < cap(d.chks) && &chks[0] == &d.chks[:n+1][n] {
+		d.chks = d.chks[:n+len(chks)]
+	} else if len(chks) > 0 && len(chks) <= maxSeriesDecoderBuffer {
+		d.chks = make([]chunks.Meta, 0, seriesDecoderBufferSize(cap(d.chks)))
+	}
+	return lset, chks, nil
+}
+
+// seriesDecoderBufferSize returns the size of the buffer following one of
+// the given size.
+func seriesDecoderBufferSize(prev int) int {
+	n := 2 * prev
+	if n < minSeriesDecoderBuffer {
+		return minSeriesDecoderBuffer
+	}
+	if n > maxSeriesDecoderBuffer {
+		return maxSeriesDecoderBuffer
+	}
+	return n
+}
@@ -0,0 +1,125 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"math"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/tsdb/labels"
+)
+
+// LabelRange holds the values of a label with the smallest and largest numeric
+// value in a block. It is only recorded if all values of the label are numbers.
+type LabelRange struct {
+	Min string `json:"min"`
+	Max string `json:"max"`
+}
+
+// excludes returns whether no value within the range can match m.
+func (r LabelRange) excludes(m labels.Matcher) bool {
+	min, err := strconv.ParseFloat(r.Min, 64)
+	if err != nil {
+		return false
+	}
+	max, err := strconv.ParseFloat(r.Max, 64)
+	if err != nil {
+		return false
+	}
+	switch m := m.(type) {
+	case *labels.RangeMatcher:
+		return m.Max() < min || m.Min() > max
+	case *labels.EqualMatcher:
+		// Only numbers can be ruled out. The empty value also matches
+		// series without the label.
+		v, err := strconv.ParseFloat(m.Value(), 64)
+		return err == nil && (v < min || v > max)
+	}
+	return false
+}
+
+// labelRangesExclude returns whether the label ranges of a block rule out any
+// of its series matching all matchers.
+func labelRangesExclude(ranges map[string]LabelRange, ms []labels.Matcher) bool {
+	for _, m := range ms {
+		if r, ok := ranges[m.Name()]; ok && r.excludes(m) {
+			return true
+		}
+	}
+	return false
+}
+
+// readLabelRanges returns the ranges of the given labels across the indices of
+// the block in dir. Labels with values that are no numbers are left out.
+func readLabelRanges(dir string, meta *BlockMeta, names []string) (map[string]LabelRange, error) {
+	type bounds struct {
+		min, max   float64
+		smin, smax string
+		invalid    bool
+	}
+	all := map[string]*bounds{}
+
+	for _, d := range dataDirs(dir, meta) {
+		ir, err := openIndexReader(d, false)
+		if err != nil {
+			return nil, errors.Wrap(err, "open index")
+		}
+		for _, n := range names {
+			tpls, err := ir.LabelValues(n)
+			if err != nil {
+				ir.Close()
+				return nil, errors.Wrapf(err, "read values of label %q", n)
+			}
+			for i := 0; i < tpls.Len(); i++ {
+				v, err := tpls.At(i)
+				if err != nil {
+					ir.Close()
+					return nil, errors.Wrapf(err, "read values of label %q", n)
+				}
+				b, ok := all[n]
+				if !ok {
+					b = &bounds{}
+					all[n] = b
+				}
+				f, err := strconv.ParseFloat(v[0], 64)
+				if err != nil || math.IsNaN(f) {
+					b.invalid = true
+					continue
+				}
+				if b.smin == "" || f < b.min {
+					b.min, b.smin = f, v[0]
+				}
+				if b.smax == "" || f > b.max {
+					b.max, b.smax = f, v[0]
+				}
+			}
+		}
+		if err := ir.Close(); err != nil {
+			return nil, err
+		}
+	}
+	var res map[string]LabelRange
+
+	for n, b := range all {
+		if b.invalid || b.smin == "" {
+			continue
+		}
+		if res == nil {
+			res = map[string]LabelRange{}
+		}
+		res[n] = LabelRange{Min: b.smin, Max: b.smax}
+	}
+	return res, nil
+}
@@ -0,0 +1,126 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package labels
+
+import "sync"
+
+// maxInternedStrings bounds the number of strings a Builder keeps for reuse.
+const maxInternedStrings = 4096
+
+// Builder constructs label sets while reusing its buffers. Label names and
+// values set from byte slices are interned, so building the same label sets
+// repeatedly, e.g. once per scrape, does not allocate.
+// A Builder is not safe for concurrent use.
+type Builder struct {
+	ls      Labels
+	strings map[string]string
+}
+
+var builderPool = sync.Pool{
+	New: func() interface{} {
+		return &Builder{strings: map[string]string{}}
+	},
+}
+
+// NewBuilder returns a new builder initialized with the labels of base.
+func NewBuilder(base Labels) *Builder {
+	b := &Builder{strings: map[string]string{}}
+	return b.Reset(base)
+}
+
+// GetBuilder returns a builder from a shared pool initialized with the labels
+// of base. It should be returned with PutBuilder once it is no longer used.
+func GetBuilder(base Labels) *Builder {
+	return builderPool.Get().(*Builder).Reset(base)
+}
+
+// PutBuilder returns b to the shared pool. Neither b nor the labels it
+// returned must be used afterwards.
+func PutBuilder(b *Builder) {
+	builderPool.Put(b)
+}
+
+// Reset replaces the labels of the builder with the labels of base.
+func (b *Builder) Reset(base Labels) *Builder {
+	b.ls = append(b.ls[:0], base...)
+	return b
+}
+
+// Set sets the label with name n to v. An empty value deletes the label.
+func (b *Builder) Set(n, v string) *Builder {
+	if v == "" {
+		return b.Del(n)
+	}
+	for i, l := range b.ls {
+		if l.Name == n {
+			b.ls[i].Value = v
+			return b
+		}
+	}
+	b.ls = append(b.ls, Label{Name: n, Value: v})
+	return b
+}
+
+// SetBytes is like Set but takes the name and value as byte slices. They are
+// only converted to strings if the builder has not seen them before.
+func (b *Builder) SetBytes(n, v []byte) *Builder {
+	return b.Set(b.intern(n), b.intern(v))
+}
+
+func (b *Builder) intern(s []byte) string {
+	// The conversion in the lookup does not allocate.
+	if str, ok := b.strings[string(s)]; ok {
+		return str
+	}
+	if len(b.strings) >= maxInternedStrings {
+		b.strings = make(map[string]string, len(b.strings))
+	}
+	str := string(s)
+	b.strings[str] = str
+	return str
+}
+
+// Del deletes the labels with the given names.
+func (b *Builder) Del(ns ...string) *Builder {
+	for _, n := range ns {
+		for i, l := range b.ls {
+			if l.Name == n {
+				b.ls = append(b.ls[:i], b.ls[i+1:]...)
+				break
+			}
+		}
+	}
+	return b
+}
+
+// Sort sorts the labels by name. Labels returns sorted labels anyway, Sort
+// allows sorting ahead of time.
+func (b *Builder) Sort() *Builder {
+	// Label sets are small and mostly sorted already. Insertion sort does
+	// not allocate, unlike sort.Sort.
+	for i := 1; i < len(b.ls); i++ {
+		for j := i; j > 0 && b.ls[j].Name < b.ls[j-1].Name; j-- {
+			b.ls[j], b.ls[j-1] = b.ls[j-1], b.ls[j]
+		}
+	}
+	return b
+}
+
+// Labels returns the sorted labels of the builder. They share memory with the
+// builder and are only valid until it is modified. Callers retaining them
+// must use Copy.
+func (b *Builder) Labels() Labels {
+	b.Sort()
+	return b.ls
+}
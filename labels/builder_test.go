@@ -0,0 +1,62 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package labels
+
+import (
+	"testing"
+
+	"github.com/prometheus/tsdb/testutil"
+)
+
+func TestBuilder(t *testing.T) {
+	base := FromStrings("job", "node", "instance", "a:9100")
+
+	b := NewBuilder(base)
+	b.Set("job", "api").Set("env", "prod").SetBytes([]byte("zone"), []byte("eu")).Del("instance")
+
+	testutil.Equals(t, FromStrings("env", "prod", "job", "api", "zone", "eu"), b.Labels())
+	testutil.Equals(t, FromStrings("job", "node", "instance", "a:9100"), base)
+
+	// Empty values delete labels.
+	b.Set("zone", "")
+	testutil.Equals(t, FromStrings("env", "prod", "job", "api"), b.Labels())
+
+	// Copies are not affected by later changes.
+	ls := b.Labels().Copy()
+	b.Reset(base).Set("job", "other")
+	testutil.Equals(t, FromStrings("env", "prod", "job", "api"), ls)
+	testutil.Equals(t, FromStrings("instance", "a:9100", "job", "other"), b.Labels())
+
+	pb := GetBuilder(FromStrings("a", "1"))
+	testutil.Equals(t, FromStrings("a", "1", "b", "2"), pb.Set("b", "2").Labels())
+	PutBuilder(pb)
+}
+
+func BenchmarkBuilder(b *testing.B) {
+	var (
+		names  = [][]byte{[]byte("job"), []byte("instance"), []byte("method"), []byte("status")}
+		values = [][]byte{[]byte("node"), []byte("123.123.1.211:9090"), []byte("GET"), []byte("500")}
+		base   = FromStrings("__name__", "http_requests_total")
+	)
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		lb := GetBuilder(base)
+		for j := range names {
+			lb.SetBytes(names[j], values[j])
+		}
+		_ = lb.Labels()
+		PutBuilder(lb)
+	}
+}
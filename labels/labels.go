@@ -94,6 +94,13 @@ func (ls Labels) Equals(o Labels) bool {
 	return true
 }
 
+// Copy returns a copy of the labels that does not share memory with ls.
+func (ls Labels) Copy() Labels {
+	res := make(Labels, len(ls))
+	copy(res, ls)
+	return res
+}
+
 // Map returns a string map of the labels.
 func (ls Labels) Map() map[string]string {
 	m := make(map[string]string, len(ls))
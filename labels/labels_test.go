@@ -196,3 +196,31 @@ func BenchmarkLabelSetHash(b *testing.B) {
 	}
 	fmt.Println(res)
 }
+
+func TestSimplify(t *testing.T) {
+	cases := []struct {
+		m   Matcher
+		exp string
+	}{
+		{m: NewMustRegexpMatcher("a", "^(?:x|y|z)$"), exp: `a=~"^(?:x|y|z)$"`},
+		{m: NewMustRegexpMatcher("a", "^foo|bar$"), exp: `a=~"^foo|bar$"`},
+		{m: NewMustRegexpMatcher("a", "^(foo|bar|foobar)$"), exp: `a=~"^(?:bar|foo|foobar)$"`},
+		{m: NewMustRegexpMatcher("a", "^api-[12]$"), exp: `a=~"^(?:api-1|api-2)$"`},
+		{m: NewMustRegexpMatcher("a", "^foo$"), exp: `a="foo"`},
+		{m: NewMustRegexpMatcher("a", "^$"), exp: `a=""`},
+		// Unanchored and infinite patterns are kept.
+		{m: NewMustRegexpMatcher("a", "x|y"), exp: `a=~"x|y"`},
+		{m: NewMustRegexpMatcher("a", "^x.*$"), exp: `a=~"^x.*$"`},
+		{m: NewMustRegexpMatcher("a", "^(?i)x$"), exp: `a=~"^(?i)x$"`},
+		{m: Not(NewMustRegexpMatcher("a", "^(x|y)$")), exp: `a!~"^(?:x|y)$"`},
+		{m: NewEqualMatcher("a", "x"), exp: `a="x"`},
+	}
+	for _, c := range cases {
+		m := Simplify(c.m)
+		testutil.Equals(t, c.exp, fmt.Sprint(m))
+
+		for _, v := range []string{"", "x", "y", "z", "foo", "bar", "foobar", "api-1", "api-3", "X"} {
+			testutil.Assert(t, c.m.Matches(v) == m.Matches(v), "simplified %s differs from %s for %q", m, c.m, v)
+		}
+	}
+}
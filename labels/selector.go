@@ -14,7 +14,11 @@
 package labels
 
 import (
+	"fmt"
 	"regexp"
+	"regexp/syntax"
+	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -53,6 +57,8 @@ func (m *EqualMatcher) Matches(v string) bool { return v == m.value }
 // Value returns the matched value.
 func (m *EqualMatcher) Value() string { return m.value }
 
+func (m *EqualMatcher) String() string { return fmt.Sprintf("%s=%q", m.name, m.value) }
+
 // NewEqualMatcher returns a new matcher matching an exact label value.
 func NewEqualMatcher(name, value string) Matcher {
 	return &EqualMatcher{name: name, value: value}
@@ -65,6 +71,7 @@ type regexpMatcher struct {
 
 func (m *regexpMatcher) Name() string          { return m.name }
 func (m *regexpMatcher) Matches(v string) bool { return m.re.MatchString(v) }
+func (m *regexpMatcher) String() string        { return fmt.Sprintf("%s=~%q", m.name, m.re) }
 
 // NewRegexpMatcher returns a new matcher verifying that a value matches
 // the regular expression pattern.
@@ -95,11 +102,31 @@ type notMatcher struct {
 
 func (m *notMatcher) Matches(v string) bool { return !m.Matcher.Matches(v) }
 
+func (m *notMatcher) String() string {
+	switch inner := m.Matcher.(type) {
+	case *EqualMatcher:
+		return fmt.Sprintf("%s!=%q", inner.name, inner.value)
+	case *regexpMatcher:
+		return fmt.Sprintf("%s!~%q", inner.name, inner.re)
+	case *SetMatcher:
+		return fmt.Sprintf("%s!~%q", inner.name, inner.pattern())
+	}
+	return fmt.Sprintf("!(%v)", m.Matcher)
+}
+
 // Not inverts the matcher's matching result.
 func Not(m Matcher) Matcher {
 	return &notMatcher{m}
 }
 
+// Negated returns the matcher inverted by m if m was returned by Not.
+func Negated(m Matcher) (Matcher, bool) {
+	if nm, ok := m.(*notMatcher); ok {
+		return nm.Matcher, true
+	}
+	return nil, false
+}
+
 // PrefixMatcher implements Matcher for labels which values matches prefix.
 type PrefixMatcher struct {
 	name, prefix string
@@ -118,3 +145,189 @@ func (m *PrefixMatcher) Prefix() string { return m.prefix }
 
 // Matches implements Matcher interface.
 func (m *PrefixMatcher) Matches(v string) bool { return strings.HasPrefix(v, m.prefix) }
+
+func (m *PrefixMatcher) String() string {
+	return fmt.Sprintf("%s=~%q", m.name, regexp.QuoteMeta(m.prefix)+".*")
+}
+
+// RangeMatcher implements Matcher for labels whose values are numbers within
+// a closed interval.
+type RangeMatcher struct {
+	name     string
+	min, max float64
+}
+
+// NewRangeMatcher returns a new Matcher for label name matching numeric values
+// within [min, max].
+func NewRangeMatcher(name string, min, max float64) Matcher {
+	return &RangeMatcher{name: name, min: min, max: max}
+}
+
+// Name implements Matcher interface.
+func (m *RangeMatcher) Name() string { return m.name }
+
+// Min returns the lower bound of matching values.
+func (m *RangeMatcher) Min() float64 { return m.min }
+
+// Max returns the upper bound of matching values.
+func (m *RangeMatcher) Max() float64 { return m.max }
+
+// Matches implements Matcher interface.
+func (m *RangeMatcher) Matches(v string) bool {
+	f, err := strconv.ParseFloat(v, 64)
+	return err == nil && f >= m.min && f <= m.max
+}
+
+func (m *RangeMatcher) String() string {
+	return fmt.Sprintf("%s in [%v, %v]", m.name, m.min, m.max)
+}
+
+// SetMatcher implements Matcher for labels whose values are one of a fixed
+// set of values.
+type SetMatcher struct {
+	name   string
+	values []string
+}
+
+// NewSetMatcher returns a new Matcher for label name matching any of values.
+func NewSetMatcher(name string, values ...string) Matcher {
+	vs := append([]string(nil), values...)
+	sort.Strings(vs)
+
+	// Remove duplicates.
+	k := 0
+	for i, v := range vs {
+		if i == 0 || v != vs[k-1] {
+			vs[k] = v
+			k++
+		}
+	}
+	return &SetMatcher{name: name, values: vs[:k]}
+}
+
+// Name implements Matcher interface.
+func (m *SetMatcher) Name() string { return m.name }
+
+// Values returns the sorted matching values.
+func (m *SetMatcher) Values() []string { return m.values }
+
+// Matches implements Matcher interface.
+func (m *SetMatcher) Matches(v string) bool {
+	i := sort.SearchStrings(m.values, v)
+	return i < len(m.values) && m.values[i] == v
+}
+
+func (m *SetMatcher) String() string {
+	return fmt.Sprintf("%s=~%q", m.name, m.pattern())
+}
+
+func (m *SetMatcher) pattern() string {
+	quoted := make([]string, 0, len(m.values))
+	for _, v := range m.values {
+		quoted = append(quoted, regexp.QuoteMeta(v))
+	}
+	return "^(?:" + strings.Join(quoted, "|") + ")$"
+}
+
+// maxSetMatcherValues is the maximum number of values a regular expression may
+// match to be converted into a SetMatcher.
+const maxSetMatcherValues = 256
+
+// Simplify returns a matcher equivalent to m that can be evaluated more
+// cheaply. Regular expressions anchored at both ends that only match a finite
+// set of values, e.g. "^(?:a|b|c)$", are converted into set or equality
+// matchers. Other matchers are returned unchanged.
+func Simplify(m Matcher) Matcher {
+	switch m := m.(type) {
+	case *notMatcher:
+		if s := Simplify(m.Matcher); s != m.Matcher {
+			return Not(s)
+		}
+	case *regexpMatcher:
+		vs, ok := regexpValues(m.re.String())
+		if !ok {
+			break
+		}
+		if len(vs) == 1 {
+			return NewEqualMatcher(m.name, vs[0])
+		}
+		return NewSetMatcher(m.name, vs...)
+	}
+	return m
+}
+
+// regexpValues returns all values matched by the pattern if it is anchored at
+// both ends and only matches a small, finite set of values.
+func regexpValues(pattern string) ([]string, bool) {
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return nil, false
+	}
+	if re.Op != syntax.OpConcat || len(re.Sub) < 2 {
+		return nil, false
+	}
+	first, last := re.Sub[0], re.Sub[len(re.Sub)-1]
+	if first.Op != syntax.OpBeginText || last.Op != syntax.OpEndText {
+		return nil, false
+	}
+	return literalValues(&syntax.Regexp{Op: syntax.OpConcat, Sub: re.Sub[1 : len(re.Sub)-1]})
+}
+
+// literalValues returns the values matched by re if it is built from literals
+// and character classes only.
+func literalValues(re *syntax.Regexp) ([]string, bool) {
+	switch re.Op {
+	case syntax.OpEmptyMatch:
+		return []string{""}, true
+
+	case syntax.OpLiteral:
+		if re.Flags&syntax.FoldCase != 0 {
+			return nil, false
+		}
+		return []string{string(re.Rune)}, true
+
+	case syntax.OpCharClass:
+		var vs []string
+		for i := 0; i+1 < len(re.Rune); i += 2 {
+			for r := re.Rune[i]; r <= re.Rune[i+1]; r++ {
+				if len(vs) == maxSetMatcherValues {
+					return nil, false
+				}
+				vs = append(vs, string(r))
+			}
+		}
+		return vs, true
+
+	case syntax.OpCapture:
+		return literalValues(re.Sub[0])
+
+	case syntax.OpAlternate:
+		var vs []string
+		for _, sub := range re.Sub {
+			svs, ok := literalValues(sub)
+			if !ok || len(vs)+len(svs) > maxSetMatcherValues {
+				return nil, false
+			}
+			vs = append(vs, svs...)
+		}
+		return vs, true
+
+	case syntax.OpConcat:
+		vs := []string{""}
+		for _, sub := range re.Sub {
+			svs, ok := literalValues(sub)
+			if !ok || len(vs)*len(svs) > maxSetMatcherValues {
+				return nil, false
+			}
+			res := make([]string, 0, len(vs)*len(svs))
+			for _, v := range vs {
+				for _, sv := range svs {
+					res = append(res, v+sv)
+				}
+			}
+			vs = res
+		}
+		return vs, true
+	}
+	return nil, false
+}
@@ -0,0 +1,195 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/prometheus/tsdb/labels"
+)
+
+// QueryLimits bounds the amount of data returned through a single Querier.
+// Zero values disable the respective limit.
+type QueryLimits struct {
+	// MaxSeries is the maximum number of series returned across all Select calls.
+	MaxSeries int64
+	// MaxSamples is the maximum number of samples iterated across all series.
+	MaxSamples int64
+	// MaxBytes is the budget of memory materialized for the returned data.
+	// It is approximated from the size of the labels and postings entries of
+	// all returned series and of all iterated samples.
+	MaxBytes int64
+}
+
+// The approximate number of bytes a series reference in a postings list and a
+// decoded sample occupy.
+const (
+	postingBytes = 8
+	sampleBytes  = 16
+)
+
+// labelsBytes returns the approximate number of bytes the label set occupies.
+func labelsBytes(lset labels.Labels) int64 {
+	var n int64
+	for _, l := range lset {
+		n += int64(len(l.Name) + len(l.Value))
+	}
+	return n
+}
+
+// LimitExceededError is returned when a query exceeds one of its QueryLimits.
+type LimitExceededError struct {
+	// Resource is the limited resource, either "series", "samples" or "bytes".
+	Resource string
+	Limit    int64
+}
+
+func (e *LimitExceededError) Error() string {
+	return fmt.Sprintf("query exceeded limit of %d %s", e.Limit, e.Resource)
+}
+
+// NewLimitedQuerier returns a querier enforcing the limits on the data returned
+// by q. Once a limit is exceeded, series sets and iterators stop and return a
+// *LimitExceededError.
+func NewLimitedQuerier(q Querier, l QueryLimits) Querier {
+	return &limitedQuerier{Querier: q, limits: l}
+}
+
+type limitedQuerier struct {
+	Querier
+	limits QueryLimits
+
+	series  int64 // accessed atomically
+	samples int64 // accessed atomically
+	bytes   int64 // accessed atomically
+}
+
+func (q *limitedQuerier) Select(ms ...labels.Matcher) (SeriesSet, error) {
+	return q.SelectWithHints(nil, ms...)
+}
+
+func (q *limitedQuerier) SelectWithHints(hints *SelectHints, ms ...labels.Matcher) (SeriesSet, error) {
+	ss, err := q.Querier.SelectWithHints(hints, ms...)
+	if err != nil {
+		return nil, err
+	}
+	return &limitedSeriesSet{SeriesSet: ss, q: q}, nil
+}
+
+// addSeries accounts for a returned series and returns an error if it exceeds a limit.
+func (q *limitedQuerier) addSeries(lset labels.Labels) error {
+	n := atomic.AddInt64(&q.series, 1)
+	if q.limits.MaxSeries > 0 && n > q.limits.MaxSeries {
+		return &LimitExceededError{Resource: "series", Limit: q.limits.MaxSeries}
+	}
+	return q.addBytes(labelsBytes(lset) + postingBytes)
+}
+
+// addSample accounts for an iterated sample and returns an error if it exceeds a limit.
+func (q *limitedQuerier) addSample() error {
+	n := atomic.AddInt64(&q.samples, 1)
+	if q.limits.MaxSamples > 0 && n > q.limits.MaxSamples {
+		return &LimitExceededError{Resource: "samples", Limit: q.limits.MaxSamples}
+	}
+	return q.addBytes(sampleBytes)
+}
+
+// addBytes accounts for materialized memory and returns an error if it exceeds the budget.
+func (q *limitedQuerier) addBytes(b int64) error {
+	n := atomic.AddInt64(&q.bytes, b)
+	if q.limits.MaxBytes > 0 && n > q.limits.MaxBytes {
+		return &LimitExceededError{Resource: "bytes", Limit: q.limits.MaxBytes}
+	}
+	return nil
+}
+
+type limitedSeriesSet struct {
+	SeriesSet
+	q   *limitedQuerier
+	err error
+}
+
+func (s *limitedSeriesSet) Next() bool {
+	if s.err != nil || !s.SeriesSet.Next() {
+		return false
+	}
+	if s.err = s.q.addSeries(s.SeriesSet.At().Labels()); s.err != nil {
+		return false
+	}
+	return true
+}
+
+func (s *limitedSeriesSet) At() Series {
+	return &limitedSeries{Series: s.SeriesSet.At(), q: s.q}
+}
+
+func (s *limitedSeriesSet) Err() error {
+	if s.err != nil {
+		return s.err
+	}
+	return s.SeriesSet.Err()
+}
+
+type limitedSeries struct {
+	Series
+	q *limitedQuerier
+}
+
+func (s *limitedSeries) Iterator() SeriesIterator {
+	return &limitedSeriesIterator{SeriesIterator: s.Series.Iterator(), q: s.q}
+}
+
+type limitedSeriesIterator struct {
+	SeriesIterator
+	q   *limitedQuerier
+	err error
+
+	// Timestamp of the last counted sample. Seeks that do not advance the
+	// iterator must not count its current sample again.
+	counted bool
+	lastT   int64
+}
+
+func (it *limitedSeriesIterator) Seek(t int64) bool {
+	if it.err != nil || !it.SeriesIterator.Seek(t) {
+		return false
+	}
+	return it.add()
+}
+
+func (it *limitedSeriesIterator) Next() bool {
+	if it.err != nil || !it.SeriesIterator.Next() {
+		return false
+	}
+	return it.add()
+}
+
+func (it *limitedSeriesIterator) add() bool {
+	t, _ := it.SeriesIterator.At()
+	if it.counted && t <= it.lastT {
+		return true
+	}
+	it.counted, it.lastT = true, t
+
+	it.err = it.q.addSample()
+	return it.err == nil
+}
+
+func (it *limitedSeriesIterator) Err() error {
+	if it.err != nil {
+		return it.err
+	}
+	return it.SeriesIterator.Err()
+}
@@ -0,0 +1,200 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/tsdb/labels"
+	"github.com/prometheus/tsdb/testutil"
+)
+
+func TestLimitedQuerier(t *testing.T) {
+	opts := *DefaultOptions
+	opts.MaxQuerySeries = 5
+	opts.MaxQuerySamples = 20
+
+	db, close := openTestDB(t, &opts)
+	defer close()
+	defer db.Close()
+
+	app := db.Appender()
+	for i := 0; i < 10; i++ {
+		lset := labels.FromStrings("job", strconv.Itoa(i%2), "instance", strconv.Itoa(i))
+		for ts := int64(0); ts < 10; ts++ {
+			_, err := app.Add(lset, ts, 1)
+			testutil.Ok(t, err)
+		}
+	}
+	testutil.Ok(t, app.Commit())
+
+	cases := []struct {
+		matcher  labels.Matcher
+		series   int
+		samples  int
+		resource string
+	}{
+		{
+			matcher:  labels.NewEqualMatcher("instance", "1"),
+			series:   1,
+			samples:  10,
+			resource: "",
+		},
+		{
+			// The limit is hit on the first sample of the third series.
+			matcher:  labels.NewEqualMatcher("job", "0"),
+			series:   3,
+			samples:  20,
+			resource: "samples",
+		},
+		{
+			matcher:  labels.NewMustRegexpMatcher("job", ".+"),
+			series:   5,
+			samples:  0,
+			resource: "series",
+		},
+	}
+
+	for _, c := range cases {
+		// Limits apply per querier.
+		q, err := db.Querier(0, 10)
+		testutil.Ok(t, err)
+
+		ss, err := q.Select(c.matcher)
+		testutil.Ok(t, err)
+
+		var (
+			series, samples int
+			iterErr         error
+		)
+		for ss.Next() {
+			series++
+
+			// Don't iterate samples so only the series limit applies.
+			if c.resource == "series" {
+				continue
+			}
+			it := ss.At().Iterator()
+			for it.Next() {
+				samples++
+			}
+			if iterErr = it.Err(); iterErr != nil {
+				break
+			}
+		}
+		err = ss.Err()
+		if iterErr != nil {
+			err = iterErr
+		}
+		testutil.Equals(t, c.series, series)
+		testutil.Equals(t, c.samples, samples)
+
+		if c.resource == "" {
+			testutil.Ok(t, err)
+		} else {
+			lerr, ok := errors.Cause(err).(*LimitExceededError)
+			testutil.Assert(t, ok, "unexpected error %v", err)
+			testutil.Equals(t, c.resource, lerr.Resource)
+		}
+		testutil.Ok(t, q.Close())
+	}
+}
+
+func TestLimitedQuerier_Seek(t *testing.T) {
+	opts := *DefaultOptions
+	opts.MaxQuerySamples = 3
+
+	db, close := openTestDB(t, &opts)
+	defer close()
+	defer db.Close()
+
+	app := db.Appender()
+	for ts := int64(0); ts < 10; ts++ {
+		_, err := app.Add(labels.FromStrings("a", "b"), ts, 1)
+		testutil.Ok(t, err)
+	}
+	testutil.Ok(t, app.Commit())
+
+	q, err := db.Querier(0, 10)
+	testutil.Ok(t, err)
+	defer q.Close()
+
+	ss, err := q.Select(labels.NewEqualMatcher("a", "b"))
+	testutil.Ok(t, err)
+	testutil.Assert(t, ss.Next(), "series missing")
+	it := ss.At().Iterator()
+
+	// Seeking to the current sample repeatedly counts it only once.
+	for i := 0; i < 5; i++ {
+		testutil.Assert(t, it.Seek(5), "seek failed: %v", it.Err())
+	}
+	ts, _ := it.At()
+	testutil.Equals(t, int64(5), ts)
+
+	testutil.Assert(t, it.Next(), "next failed: %v", it.Err())
+	testutil.Assert(t, it.Next(), "next failed: %v", it.Err())
+	testutil.Assert(t, !it.Next(), "limit not applied")
+
+	lerr, ok := errors.Cause(it.Err()).(*LimitExceededError)
+	testutil.Assert(t, ok, "unexpected error %v", it.Err())
+	testutil.Equals(t, "samples", lerr.Resource)
+}
+
+func TestLimitedQuerier_Bytes(t *testing.T) {
+	db, close := openTestDB(t, nil)
+	defer close()
+	defer db.Close()
+
+	app := db.Appender()
+	for i := 0; i < 5; i++ {
+		lset := labels.FromStrings("job", "0", "instance", strconv.Itoa(i))
+		for ts := int64(0); ts < 10; ts++ {
+			_, err := app.Add(lset, ts, 1)
+			testutil.Ok(t, err)
+		}
+	}
+	testutil.Ok(t, app.Commit())
+
+	q, err := db.Querier(0, 10)
+	testutil.Ok(t, err)
+	defer q.Close()
+
+	// Each series accounts for 13 bytes of labels, a posting and 10 samples,
+	// which is 181 bytes. The budget is exceeded by the second sample of the
+	// third series.
+	q = NewLimitedQuerier(q, QueryLimits{MaxBytes: 400})
+
+	ss, err := q.Select(labels.NewEqualMatcher("job", "0"))
+	testutil.Ok(t, err)
+
+	var series, samples int
+	for ss.Next() {
+		series++
+		it := ss.At().Iterator()
+		for it.Next() {
+			samples++
+		}
+		if err = it.Err(); err != nil {
+			break
+		}
+	}
+	testutil.Equals(t, 3, series)
+	testutil.Equals(t, 21, samples)
+
+	lerr, ok := errors.Cause(err).(*LimitExceededError)
+	testutil.Assert(t, ok, "unexpected error %v", err)
+	testutil.Equals(t, "bytes", lerr.Resource)
+}
@@ -0,0 +1,109 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+)
+
+// Marker files that operators and external tools place into block directories.
+const (
+	// NoCompactMarkFilename excludes the block from compaction. Blocks of the
+	// same range are not compacted either while it is present.
+	NoCompactMarkFilename = "no-compact.json"
+	// DeletionMarkFilename makes the DB delete the block on its next reload.
+	DeletionMarkFilename = "deletion-mark.json"
+)
+
+// BlockMark is the content of a marker file.
+type BlockMark struct {
+	ID      ulid.ULID `json:"id"`
+	Version int       `json:"version"`
+	// Time is the Unix time in seconds the block was marked at.
+	Time int64 `json:"time"`
+	// Reason describes why the block was marked.
+	Reason string `json:"reason,omitempty"`
+}
+
+// MarkBlockNoCompact excludes the block in dir from compaction.
+func MarkBlockNoCompact(dir, reason string) error {
+	return writeBlockMark(dir, NoCompactMarkFilename, reason)
+}
+
+// MarkBlockForDeletion marks the block in dir to be deleted by the DB owning
+// the directory on its next reload.
+func MarkBlockForDeletion(dir, reason string) error {
+	return writeBlockMark(dir, DeletionMarkFilename, reason)
+}
+
+func writeBlockMark(dir, name, reason string) error {
+	meta, err := readMetaFile(dir)
+	if err != nil {
+		return errors.Wrap(err, "read meta")
+	}
+	m := BlockMark{
+		ID:      meta.ULID,
+		Version: 1,
+		Time:    time.Now().Unix(),
+		Reason:  reason,
+	}
+	b, err := json.MarshalIndent(&m, "", "\t")
+	if err != nil {
+		return err
+	}
+	// Make the marker appear atomically.
+	path := filepath.Join(dir, name)
+	tmp := path + ".tmp"
+
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return renameFile(tmp, path)
+}
+
+// readBlockMark returns the marker with the given name in the block in dir or
+// nil if the block is not marked.
+func readBlockMark(dir, name string) (*BlockMark, error) {
+	f, err := os.Open(filepath.Join(dir, name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var m BlockMark
+	if err := json.NewDecoder(f).Decode(&m); err != nil {
+		return nil, errors.Wrapf(err, "decode %s", name)
+	}
+	if m.Version != 1 {
+		return nil, errors.Errorf("unexpected version %d of %s", m.Version, name)
+	}
+	return &m, nil
+}
@@ -31,16 +31,99 @@ type Querier interface {
 	// Select returns a set of series that matches the given label matchers.
 	Select(...labels.Matcher) (SeriesSet, error)
 
+	// SelectWithHints is like Select but allows to describe how the returned
+	// series will be evaluated. The hints may be nil.
+	SelectWithHints(*SelectHints, ...labels.Matcher) (SeriesSet, error)
+
 	// LabelValues returns all potential values for a label name.
 	LabelValues(string) ([]string, error)
-	// LabelValuesFor returns all potential values for a label name.
-	// under the constraint of another label.
-	LabelValuesFor(string, labels.Label) ([]string, error)
+	// LabelValuesFor returns all values for a label name that occur on series
+	// matching the given label matchers. Only series with samples within the
+	// time range of the querier that are not deleted are considered. Without
+	// matchers, it returns all potential values like LabelValues.
+	LabelValuesFor(string, ...labels.Matcher) ([]string, error)
+
+	// LabelNamesFor returns all label names that occur on series matching
+	// the given label matchers. Like LabelValuesFor, it considers only series
+	// with samples within the time range of the querier that are not deleted,
+	// and all potential names without matchers.
+	LabelNamesFor(...labels.Matcher) ([]string, error)
+
+	// Count returns the number of series matching the given label matchers and
+	// the number of their samples, which are summed from index metadata without
+	// reading chunk data. Chunks partially overlapping the time range of the
+	// querier or deleted time ranges are counted in full.
+	Count(...labels.Matcher) (series int, samples int64, err error)
+
+	// Exists returns whether any series matching the given label matchers has
+	// a chunk within the time range of the querier. It stops at the first
+	// such series without reading chunk data. Like Count, it treats chunks
+	// partially overlapping deleted time ranges as present.
+	Exists(...labels.Matcher) (bool, error)
 
 	// Close releases the resources of the Querier.
 	Close() error
 }
 
+// SelectHints describes the evaluation of selected series downstream. The storage
+// may use them to avoid loading data that does not affect the evaluation result.
+type SelectHints struct {
+	// Start and End of the evaluated time range in milliseconds. They restrict
+	// the time range of the querier further unless both are zero, e.g. for
+	// hints that only select a shard.
+	Start, End int64
+	// Step between evaluations in milliseconds. Zero means a single evaluation.
+	Step int64
+	// Range of the range selector in milliseconds. Zero for instant selectors,
+	// for which Start does not restrict the time range of the querier, as
+	// their lookback before Start is unknown.
+	Range int64
+	// Func is the name of the function the series are passed to, if any.
+	Func string
+
+	// ShardCount partitions series by the hash of their labels into disjoint
+	// shards, of which only the one with ShardIndex is selected. Zero disables sharding.
+	ShardCount uint64
+	ShardIndex uint64
+}
+
+// inShard returns whether the series with the given labels belongs to the selected shard.
+func (h *SelectHints) inShard(lset labels.Labels) bool {
+	if h == nil || h.ShardCount == 0 {
+		return true
+	}
+	return lset.Hash()%h.ShardCount == h.ShardIndex
+}
+
+// hasRange returns whether the hints describe an evaluated time range.
+func (h *SelectHints) hasRange() bool {
+	return h != nil && (h.Start != 0 || h.End != 0)
+}
+
+// overlaps returns whether samples in the time range [mint, maxt] fall
+// into any of the evaluation windows described by the hints.
+func (h *SelectHints) overlaps(mint, maxt int64) bool {
+	if !h.hasRange() {
+		return true
+	}
+	if mint > h.End || (h.Range > 0 && maxt < h.Start-h.Range) {
+		return false
+	}
+	// Without gaps between range selector windows all data in range is needed.
+	if h.Step <= 0 || h.Range <= 0 || h.Range >= h.Step {
+		return true
+	}
+	// Find the first evaluation timestamp at or after mint.
+	t := h.Start
+	if mint > t {
+		t += (mint - h.Start + h.Step - 1) / h.Step * h.Step
+	}
+	if t > h.End {
+		return false
+	}
+	return t-h.Range <= maxt
+}
+
 // Series exposes a single time series.
 type Series interface {
 	// Labels returns the complete set of labels identifying the series.
@@ -54,58 +137,149 @@ type Series interface {
 // a single partition.
 type querier struct {
 	blocks []Querier
+	// overlapping is set if the data of the queriers may overlap in time.
+	overlapping bool
+}
+
+// NewFanoutQuerier returns a querier merging the results of queriers against
+// independent databases, e.g. one per tenant or retention tier. Series with
+// the same labels are merged by timestamp. For samples with the same timestamp
+// the value of the first querier holding the series is returned.
+func NewFanoutQuerier(qs ...Querier) Querier {
+	return &querier{blocks: qs, overlapping: true}
 }
 
 func (q *querier) LabelValues(n string) ([]string, error) {
-	return q.lvals(q.blocks, n)
+	return q.lvals(q.blocks, func(bq Querier) ([]string, error) {
+		return bq.LabelValues(n)
+	})
 }
 
-func (q *querier) lvals(qs []Querier, n string) ([]string, error) {
+// lvals merges the sorted string lists returned by f for each querier.
+func (q *querier) lvals(qs []Querier, f func(Querier) ([]string, error)) ([]string, error) {
 	if len(qs) == 0 {
 		return nil, nil
 	}
 	if len(qs) == 1 {
-		return qs[0].LabelValues(n)
+		return f(qs[0])
 	}
 	l := len(qs) / 2
-	s1, err := q.lvals(qs[:l], n)
+	s1, err := q.lvals(qs[:l], f)
 	if err != nil {
 		return nil, err
 	}
-	s2, err := q.lvals(qs[l:], n)
+	s2, err := q.lvals(qs[l:], f)
 	if err != nil {
 		return nil, err
 	}
 	return mergeStrings(s1, s2), nil
 }
 
-func (q *querier) LabelValuesFor(string, labels.Label) ([]string, error) {
-	return nil, fmt.Errorf("not implemented")
+func (q *querier) LabelValuesFor(n string, ms ...labels.Matcher) ([]string, error) {
+	return q.lvals(q.blocks, func(bq Querier) ([]string, error) {
+		return bq.LabelValuesFor(n, ms...)
+	})
+}
+
+func (q *querier) LabelNamesFor(ms ...labels.Matcher) ([]string, error) {
+	return q.lvals(q.blocks, func(bq Querier) ([]string, error) {
+		return bq.LabelNamesFor(ms...)
+	})
+}
+
+// seriesCounter is implemented by queriers that report the individual series
+// they count, which allows counting series present in several queriers once.
+type seriesCounter interface {
+	// countSeries calls f with the labels and number of samples of each series
+	// matching the matchers. The labels must not be retained.
+	countSeries(ms []labels.Matcher, f func(lset labels.Labels, samples int64)) error
+}
+
+func (q *querier) Count(ms ...labels.Matcher) (int, int64, error) {
+	if len(q.blocks) == 1 {
+		return q.blocks[0].Count(ms...)
+	}
+	counters := make([]seriesCounter, 0, len(q.blocks))
+
+	for _, bq := range q.blocks {
+		c, ok := bq.(seriesCounter)
+		if !ok {
+			break
+		}
+		counters = append(counters, c)
+	}
+	// Without access to the individual series, counts of all queriers are
+	// summed up as their series are assumed to be disjoint.
+	if len(counters) < len(q.blocks) {
+		var (
+			series  int
+			samples int64
+		)
+		for _, bq := range q.blocks {
+			n, m, err := bq.Count(ms...)
+			if err != nil {
+				return 0, 0, err
+			}
+			series += n
+			samples += m
+		}
+		return series, samples, nil
+	}
+	var (
+		set     = stringset{}
+		samples int64
+	)
+	for _, c := range counters {
+		err := c.countSeries(ms, func(lset labels.Labels, n int64) {
+			set.set(lset.String())
+			samples += n
+		})
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	return len(set), samples, nil
+}
+
+func (q *querier) Exists(ms ...labels.Matcher) (bool, error) {
+	for _, bq := range q.blocks {
+		ok, err := bq.Exists(ms...)
+		if err != nil || ok {
+			return ok, err
+		}
+	}
+	return false, nil
 }
 
 func (q *querier) Select(ms ...labels.Matcher) (SeriesSet, error) {
-	return q.sel(q.blocks, ms)
+	return q.sel(q.blocks, nil, ms)
+}
 
+func (q *querier) SelectWithHints(hints *SelectHints, ms ...labels.Matcher) (SeriesSet, error) {
+	return q.sel(q.blocks, hints, ms)
 }
 
-func (q *querier) sel(qs []Querier, ms []labels.Matcher) (SeriesSet, error) {
+func (q *querier) sel(qs []Querier, hints *SelectHints, ms []labels.Matcher) (SeriesSet, error) {
 	if len(qs) == 0 {
 		return EmptySeriesSet(), nil
 	}
 	if len(qs) == 1 {
-		return qs[0].Select(ms...)
+		return qs[0].SelectWithHints(hints, ms...)
 	}
 	l := len(qs) / 2
 
-	a, err := q.sel(qs[:l], ms)
+	a, err := q.sel(qs[:l], hints, ms)
 	if err != nil {
 		return nil, err
 	}
-	b, err := q.sel(qs[l:], ms)
+	b, err := q.sel(qs[l:], hints, ms)
 	if err != nil {
 		return nil, err
 	}
-	return newMergedSeriesSet(a, b), nil
+	s := newMergedSeriesSet(a, b)
+	s.overlapping = q.overlapping
+
+	return s, nil
 }
 
 func (q *querier) Close() error {
@@ -119,6 +293,12 @@ func (q *querier) Close() error {
 
 // NewBlockQuerier returns a querier against the reader.
 func NewBlockQuerier(b BlockReader, mint, maxt int64) (Querier, error) {
+	return newBlockQuerier(b, mint, maxt, nil)
+}
+
+// newBlockQuerier returns a querier against the block reader. If a tracer is
+// given, the reads of the querier are traced.
+func newBlockQuerier(b BlockReader, mint, maxt int64, tr Tracer) (*blockQuerier, error) {
 	indexr, err := b.Index()
 	if err != nil {
 		return nil, errors.Wrapf(err, "open index reader")
@@ -134,13 +314,22 @@ func NewBlockQuerier(b BlockReader, mint, maxt int64) (Querier, error) {
 		chunkr.Close()
 		return nil, errors.Wrapf(err, "open tombstone reader")
 	}
-	return &blockQuerier{
+	q := &blockQuerier{
 		mint:       mint,
 		maxt:       maxt,
 		index:      indexr,
 		chunks:     chunkr,
 		tombstones: tombsr,
-	}, nil
+	}
+	if pb, ok := b.(*Block); ok {
+		q.labelRanges = pb.Meta().LabelRanges
+	}
+	if tr != nil {
+		q.trace = newQueryTrace(tr, b, mint, maxt)
+		q.index = &tracingIndexReader{IndexReader: indexr, trace: q.trace}
+		q.chunks = &tracingChunkReader{ChunkReader: chunkr, trace: q.trace}
+	}
+	return q, nil
 }
 
 // blockQuerier provides querying access to a single block database.
@@ -150,26 +339,110 @@ type blockQuerier struct {
 	tombstones TombstoneReader
 
 	mint, maxt int64
+
+	// trace is nil if tracing is disabled.
+	trace *queryTrace
+
+	// cache is nil if postings are not cached. Its keys for the querier start
+	// with cacheKey.
+	cache    *queryCache
+	cacheKey string
+
+	// fetch is nil if chunks are read sequentially by the series iterators.
+	// Otherwise chunks are fetched concurrently ahead of the iterators.
+	fetch *chunkFetchPool
+
+	// labelRanges of the block rule out matchers without reading the index.
+	labelRanges map[string]LabelRange
 }
 
 func (q *blockQuerier) Select(ms ...labels.Matcher) (SeriesSet, error) {
-	base, err := LookupChunkSeries(q.index, q.tombstones, ms...)
+	return q.SelectWithHints(nil, ms...)
+}
+
+func (q *blockQuerier) SelectWithHints(hints *SelectHints, ms ...labels.Matcher) (SeriesSet, error) {
+	if hints != nil && hints.ShardCount > 0 && hints.ShardIndex >= hints.ShardCount {
+		return nil, errors.Errorf("shard index %d out of range for %d shards", hints.ShardIndex, hints.ShardCount)
+	}
+	var span Span
+	if q.trace != nil {
+		span = q.trace.startSpan(SpanPostings)
+		span.SetAttribute("matchers", fmt.Sprintf("%v", ms))
+	}
+	p, err := q.postings(ms...)
+	if span != nil {
+		if err != nil {
+			span.SetAttribute("error", err.Error())
+		}
+		span.End()
+	}
 	if err != nil {
 		return nil, err
 	}
+	base := &baseChunkSeries{
+		p:          p,
+		index:      q.index,
+		tombstones: q.tombstones,
+		hints:      hints,
+	}
+	mint, maxt := q.mint, q.maxt
+
+	if hints.hasRange() {
+		if m := hints.Start - hints.Range; hints.Range > 0 && m > mint {
+			mint = m
+		}
+		if hints.End < maxt {
+			maxt = hints.End
+		}
+	}
 	return &blockSeriesSet{
 		set: &populatedChunkSeries{
 			set:    base,
 			chunks: q.chunks,
-			mint:   q.mint,
-			maxt:   q.maxt,
+			mint:   mint,
+			maxt:   maxt,
+			hints:  hints,
+			lazy:   q.fetch != nil,
 		},
+		chunks: q.chunks,
+		fetch:  q.fetch,
 
-		mint: q.mint,
-		maxt: q.maxt,
+		mint: mint,
+		maxt: maxt,
 	}, nil
 }
 
+// postings returns the sorted postings of the series selected by the matchers,
+// consulting the query cache if enabled.
+func (q *blockQuerier) postings(ms ...labels.Matcher) (index.Postings, error) {
+	if labelRangesExclude(q.labelRanges, ms) {
+		return index.EmptyPostings(), nil
+	}
+	if q.cache == nil {
+		return PostingsForMatchers(q.index, ms...)
+	}
+	mk, ok := matchersKey(ms)
+	if !ok {
+		return PostingsForMatchers(q.index, ms...)
+	}
+	key := q.cacheKey + mk
+
+	if refs, ok := q.cache.get(key); ok {
+		return index.NewListPostings(refs), nil
+	}
+	p, err := PostingsForMatchers(q.index, ms...)
+	if err != nil {
+		return nil, err
+	}
+	refs, err := index.ExpandPostings(p)
+	if err != nil {
+		return nil, err
+	}
+	q.cache.set(key, refs)
+
+	return index.NewListPostings(refs), nil
+}
+
 func (q *blockQuerier) LabelValues(name string) ([]string, error) {
 	tpls, err := q.index.LabelValues(name)
 	if err != nil {
@@ -187,17 +460,206 @@ func (q *blockQuerier) LabelValues(name string) ([]string, error) {
 	return res, nil
 }
 
-func (q *blockQuerier) LabelValuesFor(string, labels.Label) ([]string, error) {
-	return nil, fmt.Errorf("not implemented")
+func (q *blockQuerier) LabelValuesFor(name string, ms ...labels.Matcher) ([]string, error) {
+	if len(ms) == 0 {
+		return q.LabelValues(name)
+	}
+	set := stringset{}
+
+	err := q.forEachSeries(ms, func(lset labels.Labels) bool {
+		if v := lset.Get(name); v != "" {
+			set.set(v)
+		}
+		return true
+	})
+	if err != nil || len(set) == 0 {
+		return nil, err
+	}
+	return set.slice(), nil
+}
+
+func (q *blockQuerier) LabelNamesFor(ms ...labels.Matcher) ([]string, error) {
+	if len(ms) == 0 {
+		names, err := q.index.LabelIndices()
+		if err != nil {
+			return nil, err
+		}
+		res := make([]string, 0, len(names))
+
+		for _, n := range names {
+			if len(n) == 1 {
+				res = append(res, n[0])
+			}
+		}
+		sort.Strings(res)
+		return res, nil
+	}
+	set := stringset{}
+
+	err := q.forEachSeries(ms, func(lset labels.Labels) bool {
+		for _, l := range lset {
+			set.set(l.Name)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return set.slice(), nil
+}
+
+func (q *blockQuerier) Count(ms ...labels.Matcher) (int, int64, error) {
+	var (
+		series  int
+		samples int64
+	)
+	err := q.countSeries(ms, func(_ labels.Labels, n int64) {
+		series++
+		samples += n
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return series, samples, nil
+}
+
+func (q *blockQuerier) Exists(ms ...labels.Matcher) (bool, error) {
+	var found bool
+
+	err := q.forEachSeries(ms, func(labels.Labels) bool {
+		found = true
+		return false
+	})
+	return found, err
+}
+
+// forEachSeries calls f with the labels of each series matching the matchers
+// that has a chunk within the time range of the querier which is not entirely
+// deleted. It stops once f returns false. The labels must not be retained.
+func (q *blockQuerier) forEachSeries(ms []labels.Matcher, f func(labels.Labels) bool) error {
+	p, err := q.postings(ms...)
+	if err != nil {
+		return err
+	}
+	var (
+		lset labels.Labels
+		chks []chunks.Meta
+	)
+	for p.Next() {
+		ref := p.At()
+
+		if err := q.index.Series(ref, &lset, &chks); err != nil {
+			// Postings may be stale. Skip if no underlying series exists.
+			if errors.Cause(err) == ErrNotFound {
+				continue
+			}
+			return err
+		}
+		intervals, err := q.tombstones.Get(ref)
+		if err != nil {
+			return errors.Wrap(err, "get tombstones")
+		}
+		for _, chk := range chks {
+			if !chk.OverlapsClosedInterval(q.mint, q.maxt) {
+				continue
+			}
+			if len(intervals) > 0 && (Interval{chk.MinTime, chk.MaxTime}).isSubrange(intervals) {
+				continue
+			}
+			if !f(lset) {
+				return nil
+			}
+			break
+		}
+	}
+	return p.Err()
+}
+
+func (q *blockQuerier) countSeries(ms []labels.Matcher, f func(labels.Labels, int64)) error {
+	p, err := q.postings(ms...)
+	if err != nil {
+		return err
+	}
+	var (
+		lset labels.Labels
+		chks []chunks.Meta
+	)
+	for p.Next() {
+		ref := p.At()
+
+		if err := q.index.Series(ref, &lset, &chks); err != nil {
+			// Postings may be stale. Skip if no underlying series exists.
+			if errors.Cause(err) == ErrNotFound {
+				continue
+			}
+			return err
+		}
+		intervals, err := q.tombstones.Get(ref)
+		if err != nil {
+			return errors.Wrap(err, "get tombstones")
+		}
+		// Only count chunks in range that are not entirely deleted.
+		n := 0
+		for _, chk := range chks {
+			if !chk.OverlapsClosedInterval(q.mint, q.maxt) {
+				continue
+			}
+			if len(intervals) > 0 && (Interval{chk.MinTime, chk.MaxTime}).isSubrange(intervals) {
+				continue
+			}
+			chks[n] = chk
+			n++
+		}
+		if n == 0 {
+			continue
+		}
+		samples, err := q.countSamples(ref, chks[:n], n == len(chks))
+		if err != nil {
+			return err
+		}
+		f(lset, samples)
+	}
+	return p.Err()
+}
+
+// countSamples returns the number of samples in the given chunks of the series.
+// If all of its chunks are given, the total from the index is used if known.
+// Otherwise the sample counts are read from the chunk headers.
+func (q *blockQuerier) countSamples(ref uint64, chks []chunks.Meta, all bool) (int64, error) {
+	if all {
+		stats, err := q.index.SeriesStats(ref)
+		if err != nil {
+			return 0, err
+		}
+		if stats.Samples > 0 {
+			return int64(stats.Samples), nil
+		}
+	}
+	var samples int64
+
+	for _, chk := range chks {
+		c, err := q.chunks.Chunk(chk.Ref)
+		if err != nil {
+			return 0, errors.Wrapf(err, "get chunk %d", chk.Ref)
+		}
+		samples += int64(c.NumSamples())
+	}
+	return samples, nil
 }
 
 func (q *blockQuerier) Close() error {
+	if q.fetch != nil {
+		q.fetch.wait()
+	}
 	var merr MultiError
 
 	merr.Add(q.index.Close())
 	merr.Add(q.chunks.Close())
 	merr.Add(q.tombstones.Close())
 
+	if q.trace != nil {
+		q.trace.end()
+	}
 	return merr.Err()
 }
 
@@ -205,57 +667,61 @@ func (q *blockQuerier) Close() error {
 // based on the given matchers. It returns a list of label names that must be manually
 // checked to not exist in series the postings list points to.
 func PostingsForMatchers(ix IndexReader, ms ...labels.Matcher) (index.Postings, error) {
-	var its []index.Postings
+	p, err := postingsForMatchers(ix, ms...)
+	if err != nil {
+		return nil, err
+	}
+	return ix.SortedPostings(p), nil
+}
+
+// postingsForMatchers is like PostingsForMatchers but returns the postings
+// ordered by series reference.
+func postingsForMatchers(ix IndexReader, ms ...labels.Matcher) (index.Postings, error) {
+	ms, ok := planMatchers(ms)
+	if !ok {
+		return index.EmptyPostings(), nil
+	}
+	var its, notIts []index.Postings
 
 	for _, m := range ms {
+		// If the matcher selects an empty value, it selects all the series which dont
+		// have the label name set too. See: https://github.com/prometheus/prometheus/issues/3575
+		// and https://github.com/prometheus/prometheus/pull/3578#issuecomment-351653555
+		// Those are removed from the result at the end instead.
+		if m.Matches("") {
+			it, err := inversePostingsForMatcher(ix, m)
+			if err != nil {
+				return nil, err
+			}
+			notIts = append(notIts, it)
+			continue
+		}
 		it, err := postingsForMatcher(ix, m)
 		if err != nil {
 			return nil, err
 		}
 		its = append(its, it)
 	}
-	return ix.SortedPostings(index.Intersect(its...)), nil
-}
-
-// tuplesByPrefix uses binary search to find prefix matches within ts.
-func tuplesByPrefix(m *labels.PrefixMatcher, ts StringTuples) ([]string, error) {
-	var outErr error
-	tslen := ts.Len()
-	i := sort.Search(tslen, func(i int) bool {
-		vs, err := ts.At(i)
+	// Only negative matchers were given, subtract from the list of all series.
+	if len(its) == 0 && len(notIts) > 0 {
+		allPostings, err := ix.Postings(index.AllPostingsKey())
 		if err != nil {
-			outErr = fmt.Errorf("Failed to read tuple %d/%d: %v", i, tslen, err)
-			return true
-		}
-		val := vs[0]
-		l := len(m.Prefix())
-		if l > len(vs) {
-			l = len(val)
+			return nil, err
 		}
-		return val[:l] >= m.Prefix()
-	})
-	if outErr != nil {
-		return nil, outErr
+		its = append(its, allPostings)
 	}
-	var matches []string
-	for ; i < tslen; i++ {
-		vs, err := ts.At(i)
-		if err != nil || !m.Matches(vs[0]) {
-			return matches, err
-		}
-		matches = append(matches, vs[0])
+	it := index.Intersect(its...)
+
+	// Subtract the series excluded by all negative matchers in a single pass.
+	if len(notIts) > 0 {
+		it = index.Without(it, index.Merge(notIts...))
 	}
-	return matches, nil
+	return it, nil
 }
 
+// postingsForMatcher returns the postings of series matching m. The matcher
+// must not match the empty value.
 func postingsForMatcher(ix IndexReader, m labels.Matcher) (index.Postings, error) {
-	// If the matcher selects an empty value, it selects all the series which dont
-	// have the label name set too. See: https://github.com/prometheus/prometheus/issues/3575
-	// and https://github.com/prometheus/prometheus/pull/3578#issuecomment-351653555
-	if m.Matches("") {
-		return postingsForUnsetLabelMatcher(ix, m)
-	}
-
 	// Fast-path for equal matching.
 	if em, ok := m.(*labels.EqualMatcher); ok {
 		it, err := ix.Postings(em.Name(), em.Value())
@@ -264,6 +730,14 @@ func postingsForMatcher(ix IndexReader, m labels.Matcher) (index.Postings, error
 		}
 		return it, nil
 	}
+	// Fast-path for prefix matching.
+	if pm, ok := m.(*labels.PrefixMatcher); ok {
+		return ix.PrefixPostings(pm.Name(), pm.Prefix())
+	}
+	// Fast-path for set matching.
+	if sm, ok := m.(*labels.SetMatcher); ok {
+		return postingsForValues(ix, sm.Name(), sm.Values())
+	}
 
 	tpls, err := ix.LabelValues(m.Name())
 	if err != nil {
@@ -271,21 +745,13 @@ func postingsForMatcher(ix IndexReader, m labels.Matcher) (index.Postings, error
 	}
 
 	var res []string
-	if pm, ok := m.(*labels.PrefixMatcher); ok {
-		res, err = tuplesByPrefix(pm, tpls)
+	for i := 0; i < tpls.Len(); i++ {
+		vals, err := tpls.At(i)
 		if err != nil {
 			return nil, err
 		}
-
-	} else {
-		for i := 0; i < tpls.Len(); i++ {
-			vals, err := tpls.At(i)
-			if err != nil {
-				return nil, err
-			}
-			if m.Matches(vals[0]) {
-				res = append(res, vals[0])
-			}
+		if m.Matches(vals[0]) {
+			res = append(res, vals[0])
 		}
 	}
 
@@ -306,7 +772,19 @@ func postingsForMatcher(ix IndexReader, m labels.Matcher) (index.Postings, error
 	return index.Merge(rit...), nil
 }
 
-func postingsForUnsetLabelMatcher(ix IndexReader, m labels.Matcher) (index.Postings, error) {
+// inversePostingsForMatcher returns the postings of series that have the label
+// of m set to a value not matched by m.
+func inversePostingsForMatcher(ix IndexReader, m labels.Matcher) (index.Postings, error) {
+	// Fast-path for negated equal and set matching. The values not matched
+	// are known without enumerating all values of the label.
+	if nm, ok := labels.Negated(m); ok {
+		switch nm := nm.(type) {
+		case *labels.EqualMatcher:
+			return ix.Postings(nm.Name(), nm.Value())
+		case *labels.SetMatcher:
+			return postingsForValues(ix, nm.Name(), nm.Values())
+		}
+	}
 	tpls, err := ix.LabelValues(m.Name())
 	if err != nil {
 		return nil, err
@@ -333,12 +811,21 @@ func postingsForUnsetLabelMatcher(ix IndexReader, m labels.Matcher) (index.Posti
 
 		rit = append(rit, it)
 	}
+	return index.Merge(rit...), nil
+}
 
-	allPostings, err := ix.Postings(index.AllPostingsKey())
-	if err != nil {
-		return nil, err
+// postingsForValues returns the union of the postings of the label pairs with
+// the given name and values. Each of them is looked up directly in the index.
+func postingsForValues(ix IndexReader, name string, values []string) (index.Postings, error) {
+	rit := make([]index.Postings, 0, len(values))
+	for _, v := range values {
+		it, err := ix.Postings(name, v)
+		if err != nil {
+			return nil, err
+		}
+		rit = append(rit, it)
 	}
-	return index.Without(allPostings, index.Merge(rit...)), nil
+	return index.Merge(rit...), nil
 }
 
 func mergeStrings(a, b []string) []string {
@@ -388,6 +875,8 @@ func EmptySeriesSet() SeriesSet {
 // the datapoints of a must be before the datapoints of b.
 type mergedSeriesSet struct {
 	a, b SeriesSet
+	// overlapping is set if series of a and b may overlap in time.
+	overlapping bool
 
 	cur          Series
 	adone, bdone bool
@@ -445,6 +934,10 @@ func (s *mergedSeriesSet) Next() bool {
 	} else if d < 0 {
 		s.cur = s.a.At()
 		s.adone = !s.a.Next()
+	} else if s.overlapping {
+		s.cur = &overlappingSeries{a: s.a.At(), b: s.b.At()}
+		s.adone = !s.a.Next()
+		s.bdone = !s.b.Next()
 	} else {
 		s.cur = &chainedSeries{series: []Series{s.a.At(), s.b.At()}}
 		s.adone = !s.a.Next()
@@ -467,6 +960,8 @@ type baseChunkSeries struct {
 	p          index.Postings
 	index      IndexReader
 	tombstones TombstoneReader
+	hints      *SelectHints
+	dec        index.SeriesDecoder
 
 	lset      labels.Labels
 	chks      []chunks.Meta
@@ -477,6 +972,10 @@ type baseChunkSeries struct {
 // LookupChunkSeries retrieves all series for the given matchers and returns a ChunkSeriesSet
 // over them. It drops chunks based on tombstones in the given reader.
 func LookupChunkSeries(ir IndexReader, tr TombstoneReader, ms ...labels.Matcher) (ChunkSeriesSet, error) {
+	return lookupChunkSeries(ir, tr, nil, ms...)
+}
+
+func lookupChunkSeries(ir IndexReader, tr TombstoneReader, hints *SelectHints, ms ...labels.Matcher) (ChunkSeriesSet, error) {
 	if tr == nil {
 		tr = NewMemTombstones()
 	}
@@ -488,6 +987,7 @@ func LookupChunkSeries(ir IndexReader, tr TombstoneReader, ms ...labels.Matcher)
 		p:          p,
 		index:      ir,
 		tombstones: tr,
+		hints:      hints,
 	}, nil
 }
 
@@ -498,15 +998,10 @@ func (s *baseChunkSeries) At() (labels.Labels, []chunks.Meta, Intervals) {
 func (s *baseChunkSeries) Err() error { return s.err }
 
 func (s *baseChunkSeries) Next() bool {
-	var (
-		lset     labels.Labels
-		chkMetas []chunks.Meta
-		err      error
-	)
-
 	for s.p.Next() {
 		ref := s.p.At()
-		if err := s.index.Series(ref, &lset, &chkMetas); err != nil {
+		lset, chkMetas, err := s.dec.Series(s.index, ref)
+		if err != nil {
 			// Postings may be stale. Skip if no underlying series exists.
 			if errors.Cause(err) == ErrNotFound {
 				continue
@@ -514,6 +1009,9 @@ func (s *baseChunkSeries) Next() bool {
 			s.err = err
 			return false
 		}
+		if !s.hints.inShard(lset) {
+			continue
+		}
 
 		s.lset = lset
 		s.chks = chkMetas
@@ -550,6 +1048,9 @@ type populatedChunkSeries struct {
 	set        ChunkSeriesSet
 	chunks     ChunkReader
 	mint, maxt int64
+	hints      *SelectHints
+	// lazy is set if the chunk data is left to be read by the series iterators.
+	lazy bool
 
 	err       error
 	chks      []chunks.Meta
@@ -584,6 +1085,14 @@ func (s *populatedChunkSeries) Next() bool {
 				chks = chks[:j]
 				break
 			}
+			// Skip chunks that are not needed for any evaluation.
+			if s.hints != nil && !s.hints.overlaps(c.MinTime, c.MaxTime) {
+				chks = append(chks[:j], chks[j+1:]...)
+				continue
+			}
+			if s.lazy {
+				continue
+			}
 
 			c.Chunk, s.err = s.chunks.Chunk(c.Ref)
 			if s.err != nil {
@@ -621,6 +1130,10 @@ type blockSeriesSet struct {
 	err error
 	cur Series
 
+	// chunks and fetch are set if the chunk data is read by the series iterators.
+	chunks ChunkReader
+	fetch  *chunkFetchPool
+
 	mint, maxt int64
 }
 
@@ -634,6 +1147,9 @@ func (s *blockSeriesSet) Next() bool {
 			maxt:   s.maxt,
 
 			intervals: dranges,
+
+			reader: s.chunks,
+			fetch:  s.fetch,
 		}
 		return true
 	}
@@ -655,6 +1171,10 @@ type chunkSeries struct {
 	mint, maxt int64
 
 	intervals Intervals
+
+	// fetch is set if the chunk data is yet to be read from reader.
+	reader ChunkReader
+	fetch  *chunkFetchPool
 }
 
 func (s *chunkSeries) Labels() labels.Labels {
@@ -662,6 +1182,9 @@ func (s *chunkSeries) Labels() labels.Labels {
 }
 
 func (s *chunkSeries) Iterator() SeriesIterator {
+	if s.fetch != nil {
+		return newPrefetchingChunkSeriesIterator(s.chunks, s.intervals, s.mint, s.maxt, newChunkPrefetcher(s.chunks, s.reader, s.fetch))
+	}
 	return newChunkSeriesIterator(s.chunks, s.intervals, s.mint, s.maxt)
 }
 
@@ -679,6 +1202,145 @@ type SeriesIterator interface {
 	Err() error
 }
 
+// IntSeriesIterator is implemented by series iterators that can return the
+// values of integer series without converting them to float64.
+type IntSeriesIterator interface {
+	SeriesIterator
+	// AtInt returns the current timestamp and integer value. It returns false
+	// if the current sample is not stored as an integer.
+	AtInt() (t int64, v int64, ok bool)
+}
+
+// ResettableSeriesIterator is implemented by series iterators that can be
+// reused to iterate over other series. Query engines reading many series can
+// thereby avoid allocating an iterator for each of them.
+type ResettableSeriesIterator interface {
+	SeriesIterator
+	// Reset restarts the iterator at the first sample of s. It returns false
+	// and leaves the iterator unchanged if s has an unsupported type.
+	Reset(s Series) bool
+}
+
+// ReuseSeriesIterator returns an iterator over the samples of s. If it
+// implements ResettableSeriesIterator and supports s, it is reset and returned
+// instead of allocating a new iterator. It must no longer be used by the caller.
+func ReuseSeriesIterator(it SeriesIterator, s Series) SeriesIterator {
+	if ri, ok := it.(ResettableSeriesIterator); ok && ri.Reset(s) {
+		return ri
+	}
+	return s.Iterator()
+}
+
+// overlappingSeries implements a series for two series with the same labels
+// whose samples may overlap in time.
+type overlappingSeries struct {
+	a, b Series
+}
+
+func (s *overlappingSeries) Labels() labels.Labels {
+	return s.a.Labels()
+}
+
+func (s *overlappingSeries) Iterator() SeriesIterator {
+	return &overlappingSeriesIterator{a: s.a.Iterator(), b: s.b.Iterator()}
+}
+
+// overlappingSeriesIterator merges the samples of two iterators by timestamp.
+// Samples of a take precedence over samples of b with the same timestamp.
+type overlappingSeriesIterator struct {
+	a, b     SeriesIterator
+	aok, bok bool
+	started  bool
+
+	cur SeriesIterator
+	dup bool // set if a and b are at the same timestamp
+}
+
+// Reset implements the ResettableSeriesIterator interface.
+func (it *overlappingSeriesIterator) Reset(s Series) bool {
+	os, ok := s.(*overlappingSeries)
+	if !ok {
+		return false
+	}
+	*it = overlappingSeriesIterator{
+		a: ReuseSeriesIterator(it.a, os.a),
+		b: ReuseSeriesIterator(it.b, os.b),
+	}
+	return true
+}
+
+func (it *overlappingSeriesIterator) Seek(t int64) bool {
+	if !it.started {
+		it.aok, it.bok = true, true
+		it.started = true
+	}
+	if it.aok {
+		it.aok = it.a.Seek(t)
+	}
+	if it.bok {
+		it.bok = it.b.Seek(t)
+	}
+	return it.pick()
+}
+
+func (it *overlappingSeriesIterator) Next() bool {
+	switch {
+	case !it.started:
+		it.aok = it.a.Next()
+		it.bok = it.b.Next()
+		it.started = true
+	case it.cur == nil:
+		return false
+	case it.cur == it.a:
+		if it.dup {
+			it.bok = it.b.Next()
+		}
+		it.aok = it.a.Next()
+	default:
+		it.bok = it.b.Next()
+	}
+	return it.pick()
+}
+
+// pick selects the iterator at the lower timestamp as the current one.
+func (it *overlappingSeriesIterator) pick() bool {
+	it.dup = false
+
+	if it.a.Err() != nil || it.b.Err() != nil {
+		it.cur = nil
+		return false
+	}
+	switch {
+	case it.aok && it.bok:
+		ta, _ := it.a.At()
+		tb, _ := it.b.At()
+
+		if ta <= tb {
+			it.cur, it.dup = it.a, ta == tb
+		} else {
+			it.cur = it.b
+		}
+	case it.aok:
+		it.cur = it.a
+	case it.bok:
+		it.cur = it.b
+	default:
+		it.cur = nil
+	}
+	return it.cur != nil
+}
+
+func (it *overlappingSeriesIterator) At() (t int64, v float64) {
+	return it.cur.At()
+}
+
+func (it *overlappingSeriesIterator) Err() error {
+	if err := it.a.Err(); err != nil {
+		return err
+	}
+	return it.b.Err()
+}
+
 // chainedSeries implements a series for a list of time-sorted series.
 // They all must have the same labels.
 type chainedSeries struct {
@@ -710,6 +1372,18 @@ func newChainedSeriesIterator(s ...Series) *chainedSeriesIterator {
 	}
 }
 
+// Reset implements the ResettableSeriesIterator interface.
+func (it *chainedSeriesIterator) Reset(s Series) bool {
+	cs, ok := s.(*chainedSeries)
+	if !ok {
+		return false
+	}
+	it.series = cs.series
+	it.i = 0
+	it.cur = ReuseSeriesIterator(it.cur, cs.series[0])
+	return true
+}
+
 func (it *chainedSeriesIterator) Seek(t int64) bool {
 	// We just scan the chained series sequentially as they are already
 	// pre-selected by relevant time and should be accessed sequentially anyway.
@@ -737,7 +1411,7 @@ func (it *chainedSeriesIterator) Next() bool {
 	}
 
 	it.i++
-	it.cur = it.series[it.i].Iterator()
+	it.cur = ReuseSeriesIterator(it.cur, it.series[it.i])
 
 	return it.Next()
 }
@@ -746,6 +1420,15 @@ func (it *chainedSeriesIterator) At() (t int64, v float64) {
 	return it.cur.At()
 }
 
+// AtInt implements the IntSeriesIterator interface.
+func (it *chainedSeriesIterator) AtInt() (t int64, v int64, ok bool) {
+	if iit, ok := it.cur.(IntSeriesIterator); ok {
+		return iit.AtInt()
+	}
+	t, _ = it.cur.At()
+	return t, 0, false
+}
+
 func (it *chainedSeriesIterator) Err() error {
 	return it.cur.Err()
 }
@@ -761,24 +1444,64 @@ type chunkSeriesIterator struct {
 	maxt, mint int64
 
 	intervals Intervals
+
+	// prefetch is nil if the chunk data is already loaded.
+	prefetch *chunkPrefetcher
+
+	// The iterator of the current chunk and the deletedIterator wrapping it
+	// are reused for the following chunks.
+	chunkIt chunkenc.Iterator
+	deleted deletedIterator
 }
 
 func newChunkSeriesIterator(cs []chunks.Meta, dranges Intervals, mint, maxt int64) *chunkSeriesIterator {
-	it := cs[0].Chunk.Iterator()
+	return newPrefetchingChunkSeriesIterator(cs, dranges, mint, maxt, nil)
+}
 
-	if len(dranges) > 0 {
-		it = &deletedIterator{it: it, intervals: dranges}
-	}
-	return &chunkSeriesIterator{
-		chunks: cs,
-		i:      0,
-		cur:    it,
+func newPrefetchingChunkSeriesIterator(cs []chunks.Meta, dranges Intervals, mint, maxt int64, p *chunkPrefetcher) *chunkSeriesIterator {
+	it := &chunkSeriesIterator{}
+	it.reset(cs, dranges, mint, maxt, p)
+	return it
+}
 
-		mint: mint,
-		maxt: maxt,
+func (it *chunkSeriesIterator) reset(cs []chunks.Meta, dranges Intervals, mint, maxt int64, p *chunkPrefetcher) {
+	it.chunks = cs
+	it.i = 0
+	it.mint, it.maxt = mint, maxt
+	it.intervals = dranges
+	it.prefetch = p
+
+	it.cur = it.chunkIterator(0)
+}
+
+// Reset implements the ResettableSeriesIterator interface.
+func (it *chunkSeriesIterator) Reset(s Series) bool {
+	cs, ok := s.(*chunkSeries)
+	if !ok {
+		return false
+	}
+	var p *chunkPrefetcher
+	if cs.fetch != nil {
+		p = newChunkPrefetcher(cs.chunks, cs.reader, cs.fetch)
+	}
+	it.reset(cs.chunks, cs.intervals, cs.mint, cs.maxt, p)
+	return true
+}
 
-		intervals: dranges,
+// chunkIterator returns an iterator over the i-th chunk without deleted samples.
+func (it *chunkSeriesIterator) chunkIterator(i int) chunkenc.Iterator {
+	if it.prefetch != nil {
+		it.chunkIt = it.prefetch.iterator(i)
+	} else if it.chunkIt != nil {
+		it.chunkIt = chunkenc.ReuseIterator(it.chunkIt, it.chunks[i].Chunk)
+	} else {
+		it.chunkIt = it.chunks[i].Chunk.Iterator()
+	}
+	if len(it.intervals) == 0 {
+		return it.chunkIt
 	}
+	it.deleted = deletedIterator{it: it.chunkIt, intervals: it.intervals}
+	return &it.deleted
 }
 
 func (it *chunkSeriesIterator) Seek(t int64) (ok bool) {
@@ -797,10 +1520,7 @@ func (it *chunkSeriesIterator) Seek(t int64) (ok bool) {
 		}
 	}
 
-	it.cur = it.chunks[it.i].Chunk.Iterator()
-	if len(it.intervals) > 0 {
-		it.cur = &deletedIterator{it: it.cur, intervals: it.intervals}
-	}
+	it.cur = it.chunkIterator(it.i)
 
 	for it.cur.Next() {
 		t0, _ := it.cur.At()
@@ -815,6 +1535,17 @@ func (it *chunkSeriesIterator) At() (t int64, v float64) {
 	return it.cur.At()
 }
 
+// AtInt implements the IntSeriesIterator interface.
+func (it *chunkSeriesIterator) AtInt() (t int64, v int64, ok bool) {
+	// The deleted iterator is at the same sample as the chunk iterator.
+	if iit, ok := it.chunkIt.(chunkenc.IntIterator); ok {
+		t, v = iit.AtInt()
+		return t, v, true
+	}
+	t, _ = it.cur.At()
+	return t, 0, false
+}
+
 func (it *chunkSeriesIterator) Next() bool {
 	if it.cur.Next() {
 		t, _ := it.cur.At()
@@ -840,10 +1571,7 @@ func (it *chunkSeriesIterator) Next() bool {
 	}
 
 	it.i++
-	it.cur = it.chunks[it.i].Chunk.Iterator()
-	if len(it.intervals) > 0 {
-		it.cur = &deletedIterator{it: it.cur, intervals: it.intervals}
-	}
+	it.cur = it.chunkIterator(it.i)
 
 	return it.Next()
 }
@@ -20,6 +20,7 @@ import (
 	"math/rand"
 	"os"
 	"sort"
+	"strings"
 	"testing"
 
 	"github.com/pkg/errors"
@@ -511,6 +512,79 @@ Outer:
 	return
 }
 
+func TestBlockQuerier_SelectWithHints(t *testing.T) {
+	ir, cr := createIdxChkReaders([]seriesSamples{{
+		lset: map[string]string{"a": "a"},
+		chunks: [][]sample{
+			{{1, 1}, {5, 5}},
+			{{7, 7}, {8, 8}, {9, 9}},
+			{{11, 11}, {15, 15}},
+			{{17, 17}, {18, 18}, {19, 19}},
+			{{21, 21}, {25, 25}},
+		},
+	}})
+	querier := &blockQuerier{
+		index:      ir,
+		chunks:     cr,
+		tombstones: NewMemTombstones(),
+
+		mint: 0,
+		maxt: 100,
+	}
+
+	cases := []struct {
+		hints *SelectHints
+		exp   []sample
+	}{
+		{
+			hints: nil,
+			exp: []sample{
+				{1, 1}, {5, 5}, {7, 7}, {8, 8}, {9, 9}, {11, 11}, {15, 15},
+				{17, 17}, {18, 18}, {19, 19}, {21, 21}, {25, 25},
+			},
+		},
+		{
+			// The querier range is narrowed to [10-2, 20].
+			hints: &SelectHints{Start: 10, End: 20, Range: 2},
+			exp:   []sample{{8, 8}, {9, 9}, {11, 11}, {15, 15}, {17, 17}, {18, 18}, {19, 19}},
+		},
+		{
+			// Instant selectors keep the samples before Start for their lookback.
+			hints: &SelectHints{Start: 10, End: 20},
+			exp: []sample{
+				{1, 1}, {5, 5}, {7, 7}, {8, 8}, {9, 9}, {11, 11}, {15, 15},
+				{17, 17}, {18, 18}, {19, 19},
+			},
+		},
+		{
+			// Only chunks overlapping the windows [8, 10], [18, 20] and [28, 30] are loaded.
+			hints: &SelectHints{Start: 10, End: 30, Step: 10, Range: 2, Func: "rate"},
+			exp:   []sample{{8, 8}, {9, 9}, {17, 17}, {18, 18}, {19, 19}},
+		},
+		{
+			// Windows without gaps require all chunks in range.
+			hints: &SelectHints{Start: 10, End: 30, Step: 10, Range: 10},
+			exp: []sample{
+				{1, 1}, {5, 5}, {7, 7}, {8, 8}, {9, 9}, {11, 11}, {15, 15},
+				{17, 17}, {18, 18}, {19, 19}, {21, 21}, {25, 25},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		res, err := querier.SelectWithHints(c.hints, labels.NewEqualMatcher("a", "a"))
+		testutil.Ok(t, err)
+
+		testutil.Assert(t, res.Next(), "missing series")
+		smpls, err := expandSeriesIterator(res.At().Iterator())
+		testutil.Ok(t, err)
+		testutil.Equals(t, c.exp, smpls)
+
+		testutil.Assert(t, !res.Next(), "unexpected series")
+		testutil.Ok(t, res.Err())
+	}
+}
+
 func TestBlockQuerierDelete(t *testing.T) {
 	newSeries := func(l map[string]string, s []sample) Series {
 		return &mockSeries{
@@ -1164,6 +1238,59 @@ func TestChunkSeriesIterator_NextWithMinTime(t *testing.T) {
 	testutil.Assert(t, it.Next() == false, "")
 }
 
+func TestChunkSeriesIterator_Reset(t *testing.T) {
+	series := []*chunkSeries{
+		{
+			chunks: []chunks.Meta{
+				chunkFromSamples([]sample{{1, 2}, {3, 4}, {5, 6}}),
+				chunkFromSamples([]sample{{7, 8}, {9, 10}}),
+			},
+			mint: 0, maxt: 20,
+		},
+		{
+			chunks: []chunks.Meta{
+				chunkFromSamples([]sample{{10, 1}, {11, 2}, {12, 3}, {13, 4}}),
+			},
+			mint: 0, maxt: 20,
+			intervals: Intervals{{11, 12}},
+		},
+		{
+			chunks: []chunks.Meta{
+				chunkFromSamples([]sample{{1, 1}, {2, 2}}),
+				chunkFromSamples([]sample{{3, 3}, {4, 4}}),
+			},
+			mint: 2, maxt: 3,
+		},
+	}
+	exp := [][]sample{
+		{{1, 2}, {3, 4}, {5, 6}, {7, 8}, {9, 10}},
+		{{10, 1}, {13, 4}},
+		{{2, 2}, {3, 3}},
+	}
+	var it SeriesIterator
+	for i, s := range series {
+		if it == nil {
+			it = s.Iterator()
+		} else {
+			it = ReuseSeriesIterator(it, s)
+		}
+		res, err := expandSeriesIterator(it)
+		testutil.Ok(t, err)
+		testutil.Equals(t, exp[i], res)
+	}
+	// Chained series reuse the iterators of their chunk series.
+	it = ReuseSeriesIterator(it, &chainedSeries{series: []Series{series[2], series[1]}})
+	res, err := expandSeriesIterator(it)
+	testutil.Ok(t, err)
+	testutil.Equals(t, append(exp[2], exp[1]...), res)
+
+	// Unsupported series fall back to their own iterator.
+	it = ReuseSeriesIterator(it, newSeries(nil, exp[0]))
+	res, err = expandSeriesIterator(it)
+	testutil.Ok(t, err)
+	testutil.Equals(t, exp[0], res)
+}
+
 func TestPopulatedCSReturnsValidChunkSlice(t *testing.T) {
 	lbls := []labels.Labels{labels.New(labels.Label{"a", "b"})}
 	chunkMetas := [][]chunks.Meta{
@@ -1430,8 +1557,14 @@ func newMockIndex() mockIndex {
 	return ix
 }
 
-func (m mockIndex) Symbols() (map[string]struct{}, error) {
-	return m.symbols, nil
+func (m mockIndex) Symbols() index.StringIter {
+	l := make([]string, 0, len(m.symbols))
+	for s := range m.symbols {
+		l = append(l, s)
+	}
+	sort.Strings(l)
+
+	return index.NewStringListIter(l)
 }
 
 func (m mockIndex) AddSeries(ref uint64, l labels.Labels, chunks ...chunks.Meta) error {
@@ -1495,6 +1628,17 @@ func (m mockIndex) Postings(name, value string) (index.Postings, error) {
 	return index.NewListPostings(m.postings[l]), nil
 }
 
+func (m mockIndex) PrefixPostings(name, prefix string) (index.Postings, error) {
+	var its []index.Postings
+
+	for _, v := range m.labelIndex[name] {
+		if strings.HasPrefix(v, prefix) {
+			its = append(its, index.NewListPostings(m.postings[labels.Label{Name: name, Value: v}]))
+		}
+	}
+	return index.Merge(its...), nil
+}
+
 func (m mockIndex) SortedPostings(p index.Postings) index.Postings {
 	ep, err := index.ExpandPostings(p)
 	if err != nil {
@@ -1518,6 +1662,46 @@ func (m mockIndex) Series(ref uint64, lset *labels.Labels, chks *[]chunks.Meta)
 	return nil
 }
 
+func (m mockIndex) SeriesStats(ref uint64) (index.SeriesStats, error) {
+	s, ok := m.series[ref]
+	if !ok {
+		return index.SeriesStats{}, ErrNotFound
+	}
+	stats := index.SeriesStats{Chunks: len(s.chunks)}
+	for _, c := range s.chunks {
+		if c.Chunk != nil {
+			stats.Samples += uint64(c.Chunk.NumSamples())
+			stats.Bytes += uint64(len(c.Chunk.Bytes()))
+		}
+	}
+	return stats, nil
+}
+
+func (m mockIndex) PostingsStats(limit int) (*index.PostingsStats, error) {
+	var stats []index.PostingsStat
+
+	for l, refs := range m.postings {
+		if l.Name == "" && l.Value == "" {
+			continue
+		}
+		stats = append(stats, index.PostingsStat{Label: l, Series: len(refs), Bytes: 4 * len(refs)})
+	}
+	return index.TopPostingsStats(stats, limit), nil
+}
+
+func (m mockIndex) LabelSketches() (map[string]*index.HyperLogLog, error) {
+	res := make(map[string]*index.HyperLogLog, len(m.labelIndex))
+
+	for k, vs := range m.labelIndex {
+		hll := index.NewHyperLogLog()
+		for _, v := range vs {
+			hll.Add(v)
+		}
+		res[k] = hll
+	}
+	return res, nil
+}
+
 func (m mockIndex) LabelIndices() ([][]string, error) {
 	res := make([][]string, 0, len(m.labelIndex))
 
@@ -1527,3 +1711,255 @@ func (m mockIndex) LabelIndices() ([][]string, error) {
 
 	return res, nil
 }
+
+func TestOverlappingSeriesIterator(t *testing.T) {
+	a := newSeries(map[string]string{"a": "1"}, []sample{{1, 1}, {3, 3}, {5, 5}, {6, 6}})
+	b := newSeries(map[string]string{"a": "1"}, []sample{{2, -2}, {3, -3}, {4, -4}, {6, -6}, {7, -7}})
+
+	s := &overlappingSeries{a: a, b: b}
+
+	res, err := expandSeriesIterator(s.Iterator())
+	testutil.Ok(t, err)
+	testutil.Equals(t, []sample{{1, 1}, {2, -2}, {3, 3}, {4, -4}, {5, 5}, {6, 6}, {7, -7}}, res)
+
+	it := s.Iterator()
+	testutil.Assert(t, it.Seek(4), "seek failed")
+	ts, v := it.At()
+	testutil.Equals(t, sample{4, -4}, sample{ts, v})
+
+	res, err = expandSeriesIterator(it)
+	testutil.Ok(t, err)
+	testutil.Equals(t, []sample{{5, 5}, {6, 6}, {7, -7}}, res)
+}
+
+func TestFanoutQuerier(t *testing.T) {
+	db1, close1 := openTestDB(t, nil)
+	defer close1()
+	defer db1.Close()
+
+	db2, close2 := openTestDB(t, nil)
+	defer close2()
+	defer db2.Close()
+
+	app1, app2 := db1.Appender(), db2.Appender()
+	for ts := int64(0); ts < 10; ts++ {
+		_, err := app1.Add(labels.FromStrings("a", "1"), ts, 1)
+		testutil.Ok(t, err)
+		_, err = app1.Add(labels.FromStrings("a", "2", "db", "1"), ts, 1)
+		testutil.Ok(t, err)
+	}
+	for ts := int64(5); ts < 15; ts++ {
+		_, err := app2.Add(labels.FromStrings("a", "1"), ts, 2)
+		testutil.Ok(t, err)
+		_, err = app2.Add(labels.FromStrings("a", "2", "db", "2"), ts, 2)
+		testutil.Ok(t, err)
+	}
+	testutil.Ok(t, app1.Commit())
+	testutil.Ok(t, app2.Commit())
+
+	q1, err := db1.Querier(0, 20)
+	testutil.Ok(t, err)
+	q2, err := db2.Querier(0, 20)
+	testutil.Ok(t, err)
+
+	q := NewFanoutQuerier(q1, q2)
+	defer q.Close()
+
+	ss, err := q.Select(labels.NewEqualMatcher("a", "1"))
+	testutil.Ok(t, err)
+
+	testutil.Assert(t, ss.Next(), "missing series")
+	testutil.Equals(t, labels.FromStrings("a", "1"), ss.At().Labels())
+
+	smpls, err := expandSeriesIterator(ss.At().Iterator())
+	testutil.Ok(t, err)
+
+	var exp []sample
+	for ts := int64(0); ts < 15; ts++ {
+		v := 1.0
+		if ts >= 10 {
+			v = 2
+		}
+		exp = append(exp, sample{ts, v})
+	}
+	testutil.Equals(t, exp, smpls)
+	testutil.Assert(t, !ss.Next(), "unexpected series")
+	testutil.Ok(t, ss.Err())
+
+	ss, err = q.Select(labels.NewEqualMatcher("a", "2"))
+	testutil.Ok(t, err)
+	lsets, err := expandSeriesSet(ss)
+	testutil.Ok(t, err)
+	testutil.Equals(t, []labels.Labels{
+		labels.FromStrings("a", "2", "db", "1"),
+		labels.FromStrings("a", "2", "db", "2"),
+	}, lsets)
+
+	vals, err := q.LabelValues("db")
+	testutil.Ok(t, err)
+	testutil.Equals(t, []string{"1", "2"}, vals)
+}
+
+func TestPlanMatchers(t *testing.T) {
+	cases := []struct {
+		ms  []labels.Matcher
+		exp []string
+	}{
+		{
+			ms: []labels.Matcher{
+				labels.Not(labels.NewEqualMatcher("c", "x")),
+				labels.NewMustRegexpMatcher("b", ".+"),
+				labels.NewMustRegexpMatcher("a", "^(?:x|y)$"),
+				labels.NewEqualMatcher("d", "x"),
+			},
+			exp: []string{`d="x"`, `a=~"^(?:x|y)$"`, `b=~".+"`, `c!="x"`},
+		},
+		{
+			ms: []labels.Matcher{
+				labels.NewEqualMatcher("a", "x"),
+				labels.NewEqualMatcher("a", "x"),
+			},
+			exp: []string{`a="x"`},
+		},
+		{
+			ms: []labels.Matcher{
+				labels.NewMustRegexpMatcher("a", "^(?:x|y|z)$"),
+				labels.Not(labels.NewEqualMatcher("a", "y")),
+				labels.NewEqualMatcher("b", "x"),
+				labels.NewMustRegexpMatcher("a", "^(?:w|x|y)$"),
+			},
+			exp: []string{`a="x"`, `b="x"`},
+		},
+		{
+			ms: []labels.Matcher{
+				labels.NewEqualMatcher("a", "x"),
+				labels.NewEqualMatcher("a", "y"),
+			},
+		},
+		{
+			ms: []labels.Matcher{
+				labels.NewMustRegexpMatcher("a", "^(?:x|y)$"),
+				labels.NewPrefixMatcher("a", "z"),
+			},
+		},
+	}
+	for _, c := range cases {
+		ms, ok := planMatchers(c.ms)
+		testutil.Equals(t, c.exp != nil, ok)
+
+		var res []string
+		for _, m := range ms {
+			res = append(res, fmt.Sprint(m))
+		}
+		testutil.Equals(t, c.exp, res)
+	}
+
+	ix := newMockIndex()
+	ix.postings[labels.Label{Name: "a", Value: "x"}] = []uint64{1}
+	ix.postings[labels.Label{Name: "a", Value: "y"}] = []uint64{2}
+	ix.postings[labels.Label{Name: "a", Value: "z"}] = []uint64{3}
+
+	p, err := PostingsForMatchers(ix, labels.NewMustRegexpMatcher("a", "^(?:x|z|w)$"))
+	testutil.Ok(t, err)
+	refs, err := index.ExpandPostings(p)
+	testutil.Ok(t, err)
+	testutil.Equals(t, []uint64{1, 3}, refs)
+
+	p, err = PostingsForMatchers(ix, labels.NewEqualMatcher("a", "x"), labels.NewEqualMatcher("a", "y"))
+	testutil.Ok(t, err)
+	refs, err = index.ExpandPostings(p)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, len(refs))
+}
+
+// noLabelValuesIndex fails on attempts to enumerate label values.
+type noLabelValuesIndex struct {
+	mockIndex
+}
+
+func (noLabelValuesIndex) LabelValues(names ...string) (index.StringTuples, error) {
+	return nil, errors.New("label values enumerated")
+}
+
+func TestPostingsForMatchers_SetLookup(t *testing.T) {
+	ix := noLabelValuesIndex{newMockIndex()}
+	ix.postings[labels.Label{Name: "a", Value: "x"}] = []uint64{1}
+	ix.postings[labels.Label{Name: "a", Value: "y"}] = []uint64{2}
+	ix.postings[labels.Label{Name: "a", Value: "z"}] = []uint64{3}
+	ix.postings[labels.Label{Name: "b", Value: "x"}] = []uint64{1, 2, 3}
+
+	cases := []struct {
+		ms  []labels.Matcher
+		exp []uint64
+	}{
+		{
+			ms:  []labels.Matcher{labels.NewMustRegexpMatcher("a", "^(?:x|z)$")},
+			exp: []uint64{1, 3},
+		},
+		{
+			ms: []labels.Matcher{
+				labels.NewEqualMatcher("b", "x"),
+				labels.Not(labels.NewMustRegexpMatcher("a", "^(?:x|z)$")),
+			},
+			exp: []uint64{2},
+		},
+		{
+			ms: []labels.Matcher{
+				labels.NewEqualMatcher("b", "x"),
+				labels.Not(labels.NewEqualMatcher("a", "y")),
+			},
+			exp: []uint64{1, 3},
+		},
+	}
+	for _, c := range cases {
+		p, err := PostingsForMatchers(ix, c.ms...)
+		testutil.Ok(t, err)
+		refs, err := index.ExpandPostings(p)
+		testutil.Ok(t, err)
+		testutil.Equals(t, c.exp, refs)
+	}
+}
+
+func TestPostingsForMatchers_NegativeOnly(t *testing.T) {
+	ix := newMockIndex()
+	ix.postings[labels.Label{Name: "a", Value: "x"}] = []uint64{1, 2}
+	ix.postings[labels.Label{Name: "a", Value: "y"}] = []uint64{3}
+	ix.postings[labels.Label{Name: "b", Value: "x"}] = []uint64{2, 4}
+	ix.labelIndex["a"] = []string{"x", "y"}
+	ix.labelIndex["b"] = []string{"x"}
+
+	an, av := index.AllPostingsKey()
+	ix.postings[labels.Label{Name: an, Value: av}] = []uint64{1, 2, 3, 4, 5}
+
+	cases := []struct {
+		ms  []labels.Matcher
+		exp []uint64
+	}{
+		{
+			ms:  []labels.Matcher{labels.Not(labels.NewEqualMatcher("a", "x"))},
+			exp: []uint64{3, 4, 5},
+		},
+		{
+			ms: []labels.Matcher{
+				labels.Not(labels.NewEqualMatcher("a", "x")),
+				labels.Not(labels.NewMustRegexpMatcher("b", "x")),
+			},
+			exp: []uint64{3, 5},
+		},
+		{
+			ms:  []labels.Matcher{labels.NewEqualMatcher("b", "")},
+			exp: []uint64{1, 3, 5},
+		},
+		{
+			ms:  []labels.Matcher{labels.NewMustRegexpMatcher("a", ".*")},
+			exp: []uint64{1, 2, 3, 4, 5},
+		},
+	}
+	for _, c := range cases {
+		p, err := PostingsForMatchers(ix, c.ms...)
+		testutil.Ok(t, err)
+		refs, err := index.ExpandPostings(p)
+		testutil.Ok(t, err)
+		testutil.Equals(t, c.exp, refs)
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"hash/fnv"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/tsdb/labels"
+)
+
+// queryCache holds the series references that label matchers selected in
+// persisted blocks, for dashboards repeating identical queries. Entries are
+// keyed by the matchers, the time range of the querier and the set of blocks
+// it spans. Entries of the least recently used queries are evicted once the
+// cached references exceed the maximum size.
+type queryCache struct {
+	mtx     sync.Mutex
+	maxRefs int
+	refs    int
+	entries map[string]*list.Element
+	lru     *list.List
+
+	hits   prometheus.Counter
+	misses prometheus.Counter
+}
+
+type queryCacheEntry struct {
+	key  string
+	refs []uint64
+}
+
+func newQueryCache(r prometheus.Registerer, maxRefs int) *queryCache {
+	c := &queryCache{
+		maxRefs: maxRefs,
+		entries: map[string]*list.Element{},
+		lru:     list.New(),
+		hits: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "prometheus_tsdb_query_cache_hits_total",
+			Help: "Number of postings lookups answered by the query cache.",
+		}),
+		misses: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "prometheus_tsdb_query_cache_misses_total",
+			Help: "Number of cacheable postings lookups not found in the query cache.",
+		}),
+	}
+	if r != nil {
+		r.MustRegister(c.hits, c.misses)
+	}
+	return c
+}
+
+// get returns the cached series references for key.
+func (c *queryCache) get(key string) ([]uint64, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		c.misses.Inc()
+		return nil, false
+	}
+	c.hits.Inc()
+	c.lru.MoveToFront(e)
+
+	return e.Value.(*queryCacheEntry).refs, true
+}
+
+// set caches the series references for key. The references must not be
+// modified afterwards.
+func (c *queryCache) set(key string, refs []uint64) {
+	if len(refs) > c.maxRefs {
+		return
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if _, ok := c.entries[key]; ok {
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&queryCacheEntry{key: key, refs: refs})
+	c.refs += len(refs)
+
+	for c.refs > c.maxRefs {
+		e := c.lru.Remove(c.lru.Back()).(*queryCacheEntry)
+		delete(c.entries, e.key)
+		c.refs -= len(e.refs)
+	}
+}
+
+// purge drops all entries. It is called whenever the set of blocks changes,
+// which invalidates all keys.
+func (c *queryCache) purge() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.entries = map[string]*list.Element{}
+	c.lru.Init()
+	c.refs = 0
+}
+
+// queryCacheKey returns the key prefix for queriers over the given blocks and
+// time range.
+func queryCacheKey(blocks []*Block, mint, maxt int64) string {
+	h := fnv.New64a()
+	for _, b := range blocks {
+		id := b.Meta().ULID
+		h.Write(id[:])
+	}
+	return fmt.Sprintf("%x/%d/%d", h.Sum64(), mint, maxt)
+}
+
+// matchersKey returns a key identifying the series selected by the matchers.
+// It returns false if any of the matchers cannot be identified by its string
+// representation.
+func matchersKey(ms []labels.Matcher) (string, bool) {
+	var buf bytes.Buffer
+
+	for _, m := range ms {
+		s, ok := m.(fmt.Stringer)
+		if !ok {
+			return "", false
+		}
+		buf.WriteByte(0xff)
+		buf.WriteString(s.String())
+	}
+	return buf.String(), true
+}
@@ -0,0 +1,185 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/tsdb/labels"
+)
+
+// ErrQueryQueueTimeout is returned by Select if it waited longer than the
+// configured queue timeout for other selects to finish.
+var ErrQueryQueueTimeout = errors.New("timed out waiting for concurrent queries to finish")
+
+var errGatedQuerierClosed = errors.New("querier closed")
+
+// queryGate limits the number of concurrently executing selects. Further
+// selects queue until a slot frees up, their context is canceled or the
+// queue timeout expires.
+type queryGate struct {
+	slots   chan struct{}
+	timeout time.Duration
+
+	waiting  prometheus.Gauge
+	timeouts prometheus.Counter
+}
+
+func newQueryGate(r prometheus.Registerer, max int, timeout time.Duration) *queryGate {
+	g := &queryGate{
+		slots:   make(chan struct{}, max),
+		timeout: timeout,
+		waiting: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "prometheus_tsdb_query_gate_waiting",
+			Help: "Number of selects waiting for a free query slot.",
+		}),
+		timeouts: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "prometheus_tsdb_query_gate_timeouts_total",
+			Help: "Number of selects that timed out or were canceled while waiting for a free query slot.",
+		}),
+	}
+	if r != nil {
+		r.MustRegister(g.waiting, g.timeouts)
+	}
+	return g
+}
+
+// start blocks until a slot is free and acquires it. Every successful call
+// must be followed by a call to done.
+func (g *queryGate) start(ctx context.Context) error {
+	select {
+	case g.slots <- struct{}{}:
+		return nil
+	default:
+	}
+	g.waiting.Inc()
+	defer g.waiting.Dec()
+
+	var timeoutc <-chan time.Time
+	if g.timeout > 0 {
+		t := time.NewTimer(g.timeout)
+		defer t.Stop()
+		timeoutc = t.C
+	}
+	select {
+	case g.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		g.timeouts.Inc()
+		return ctx.Err()
+	case <-timeoutc:
+		g.timeouts.Inc()
+		return ErrQueryQueueTimeout
+	}
+}
+
+// done releases a slot acquired by start.
+func (g *queryGate) done() {
+	<-g.slots
+}
+
+// gatedQuerier executes the selects of the wrapped querier only while holding
+// a slot of the gate. The slot is held until all series sets returned by the
+// querier are exhausted or the querier is closed. Selects of a querier already
+// holding a slot share it, so that queries iterating several series sets at
+// once cannot block themselves.
+type gatedQuerier struct {
+	Querier
+	ctx  context.Context
+	gate *queryGate
+
+	mtx sync.Mutex
+	// Number of series sets holding the slot of the querier.
+	active int
+	closed bool
+}
+
+func (q *gatedQuerier) Select(ms ...labels.Matcher) (SeriesSet, error) {
+	return q.SelectWithHints(nil, ms...)
+}
+
+func (q *gatedQuerier) SelectWithHints(hints *SelectHints, ms ...labels.Matcher) (SeriesSet, error) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	// Series sets of a closed querier never release a slot.
+	if q.closed {
+		return nil, errGatedQuerierClosed
+	}
+	if q.active == 0 {
+		if err := q.gate.start(q.ctx); err != nil {
+			return nil, err
+		}
+	}
+	ss, err := q.Querier.SelectWithHints(hints, ms...)
+	if err != nil {
+		if q.active == 0 {
+			q.gate.done()
+		}
+		return nil, err
+	}
+	q.active++
+
+	return &gatedSeriesSet{SeriesSet: ss, q: q}, nil
+}
+
+// release releases the slot held for s. The slot of the querier is released
+// once no series set holds it anymore. Closing the querier already released
+// the slots of all its series sets.
+func (q *gatedQuerier) release(s *gatedSeriesSet) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	if s.released || q.closed {
+		return
+	}
+	s.released = true
+
+	if q.active--; q.active == 0 {
+		q.gate.done()
+	}
+}
+
+func (q *gatedQuerier) Close() error {
+	q.mtx.Lock()
+	if q.active > 0 && !q.closed {
+		q.gate.done()
+	}
+	q.active = 0
+	q.closed = true
+	q.mtx.Unlock()
+
+	return q.Querier.Close()
+}
+
+// gatedSeriesSet holds the slot of its querier until it is exhausted.
+type gatedSeriesSet struct {
+	SeriesSet
+	q *gatedQuerier
+
+	// Protected by the mutex of the querier.
+	released bool
+}
+
+func (s *gatedSeriesSet) Next() bool {
+	if s.SeriesSet.Next() {
+		return true
+	}
+	s.q.release(s)
+	return false
+}
@@ -0,0 +1,201 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/tsdb/labels"
+)
+
+const (
+	activeQueriesFilename = "queries.active"
+	// activeQueryEntrySize is the fixed size of each entry in the file.
+	// Longer queries are truncated.
+	activeQueryEntrySize = 1024
+)
+
+// activeQuery is an entry of the active query log.
+type activeQuery struct {
+	Query string    `json:"query"`
+	MinT  int64     `json:"mint"`
+	MaxT  int64     `json:"maxt"`
+	Start time.Time `json:"start"`
+}
+
+// activeQueryLog records the selects of open queriers in a file of fixed size
+// entries. Entries are written without syncing, the page cache retains them
+// if the process is killed, e.g. for running out of memory.
+type activeQueryLog struct {
+	logger log.Logger
+	f      *os.File
+
+	mtx  sync.Mutex
+	free []int
+}
+
+// openActiveQueryLog logs the queries still recorded in the file in dir, which
+// were in flight when the process last terminated, and resets the file to hold
+// up to size entries.
+func openActiveQueryLog(logger log.Logger, dir string, size int) (*activeQueryLog, error) {
+	fn := filepath.Join(dir, activeQueriesFilename)
+
+	b, err := ioutil.ReadFile(fn)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "read active queries")
+	}
+	for len(b) > 0 {
+		n := activeQueryEntrySize
+		if n > len(b) {
+			n = len(b)
+		}
+		if e := bytes.TrimRight(b[:n], "\x00"); len(e) > 0 {
+			level.Warn(logger).Log("msg", "query was in flight when the process terminated", "query", string(e))
+		}
+		b = b[n:]
+	}
+
+	f, err := os.Create(fn)
+	if err != nil {
+		return nil, errors.Wrap(err, "create active queries file")
+	}
+	if err := f.Truncate(int64(size * activeQueryEntrySize)); err != nil {
+		f.Close()
+		return nil, errors.Wrap(err, "allocate active queries file")
+	}
+	l := &activeQueryLog{logger: logger, f: f}
+
+	for i := size - 1; i >= 0; i-- {
+		l.free = append(l.free, i)
+	}
+	return l, nil
+}
+
+// insert records the query and returns its entry. It returns -1 if all
+// entries are in use and the query was not recorded.
+func (l *activeQueryLog) insert(ms []labels.Matcher, mint, maxt int64) int {
+	strs := make([]string, 0, len(ms))
+	for _, m := range ms {
+		strs = append(strs, fmt.Sprint(m))
+	}
+	q := activeQuery{
+		Query: "{" + strings.Join(strs, ",") + "}",
+		MinT:  mint,
+		MaxT:  maxt,
+		Start: time.Now().UTC(),
+	}
+	b, err := json.Marshal(q)
+	for err == nil && len(b) > activeQueryEntrySize {
+		n := len(q.Query) - (len(b) - activeQueryEntrySize) - 3
+		if n < 0 {
+			n = 0
+		}
+		q.Query = q.Query[:n] + "..."
+		b, err = json.Marshal(q)
+	}
+	if err != nil {
+		level.Warn(l.logger).Log("msg", "encode active query", "err", err)
+		return -1
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if len(l.free) == 0 {
+		return -1
+	}
+	i := l.free[len(l.free)-1]
+	l.free = l.free[:len(l.free)-1]
+
+	l.write(i, b)
+	return i
+}
+
+// remove clears an entry returned by insert.
+func (l *activeQueryLog) remove(i int) {
+	if i < 0 {
+		return
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	l.write(i, nil)
+	l.free = append(l.free, i)
+}
+
+func (l *activeQueryLog) write(i int, b []byte) {
+	buf := make([]byte, activeQueryEntrySize)
+	copy(buf, b)
+
+	if _, err := l.f.WriteAt(buf, int64(i*activeQueryEntrySize)); err != nil {
+		level.Warn(l.logger).Log("msg", "write active query", "err", err)
+	}
+}
+
+// Close closes and removes the file. All queriers must be closed before.
+func (l *activeQueryLog) Close() error {
+	if err := l.f.Close(); err != nil {
+		return err
+	}
+	return os.Remove(l.f.Name())
+}
+
+// loggedQuerier records its selects in the active query log until it is closed.
+type loggedQuerier struct {
+	Querier
+	log        *activeQueryLog
+	mint, maxt int64
+
+	mtx     sync.Mutex
+	entries []int
+}
+
+func (q *loggedQuerier) Select(ms ...labels.Matcher) (SeriesSet, error) {
+	return q.SelectWithHints(nil, ms...)
+}
+
+func (q *loggedQuerier) SelectWithHints(hints *SelectHints, ms ...labels.Matcher) (SeriesSet, error) {
+	mint, maxt := q.mint, q.maxt
+	if hints.hasRange() {
+		mint, maxt = hints.Start, hints.End
+	}
+	i := q.log.insert(ms, mint, maxt)
+	if i >= 0 {
+		q.mtx.Lock()
+		q.entries = append(q.entries, i)
+		q.mtx.Unlock()
+	}
+	return q.Querier.SelectWithHints(hints, ms...)
+}
+
+func (q *loggedQuerier) Close() error {
+	q.mtx.Lock()
+	for _, i := range q.entries {
+		q.log.remove(i)
+	}
+	q.entries = nil
+	q.mtx.Unlock()
+
+	return q.Querier.Close()
+}
@@ -0,0 +1,78 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/tsdb/labels"
+	"github.com/prometheus/tsdb/testutil"
+)
+
+func TestActiveQueryLog(t *testing.T) {
+	db, close := openTestDB(t, &Options{ActiveQueryLogSize: 2})
+	defer close()
+
+	fn := filepath.Join(db.Dir(), activeQueriesFilename)
+
+	q, err := db.Querier(0, 10)
+	testutil.Ok(t, err)
+	_, err = q.Select(labels.NewEqualMatcher("a", "b"))
+	testutil.Ok(t, err)
+	_, err = q.Select(labels.NewMustRegexpMatcher("c", strings.Repeat("x", 2*activeQueryEntrySize)))
+	testutil.Ok(t, err)
+
+	// Further selects are not recorded once all entries are in use.
+	q2, err := db.Querier(0, 10)
+	testutil.Ok(t, err)
+	_, err = q2.Select(labels.NewEqualMatcher("d", "e"))
+	testutil.Ok(t, err)
+
+	b, err := ioutil.ReadFile(fn)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 2*activeQueryEntrySize, len(b))
+	testutil.Assert(t, bytes.Contains(b, []byte(`{a=\"b\"}`)), "query not recorded")
+	testutil.Assert(t, bytes.Contains(b, []byte(`...`)), "long query not truncated")
+	testutil.Assert(t, !bytes.Contains(b, []byte(`d=`)), "unexpected query recorded")
+
+	// Queries that were in flight are logged when the file is opened again.
+	tmpdir, err := ioutil.TempDir("", "test")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(tmpdir)
+	testutil.Ok(t, ioutil.WriteFile(filepath.Join(tmpdir, activeQueriesFilename), b, 0666))
+
+	var buf bytes.Buffer
+	l, err := openActiveQueryLog(log.NewLogfmtLogger(&buf), tmpdir, 1)
+	testutil.Ok(t, err)
+	testutil.Ok(t, l.Close())
+	testutil.Equals(t, 2, strings.Count(buf.String(), "in flight"))
+
+	// Closing the queriers clears their entries.
+	testutil.Ok(t, q.Close())
+	testutil.Ok(t, q2.Close())
+
+	b, err = ioutil.ReadFile(fn)
+	testutil.Ok(t, err)
+	testutil.Equals(t, make([]byte, 2*activeQueryEntrySize), b)
+
+	testutil.Ok(t, db.Close())
+	_, err = os.Stat(fn)
+	testutil.Assert(t, os.IsNotExist(err), "active query log not removed")
+}
@@ -0,0 +1,122 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/prometheus/tsdb/labels"
+)
+
+// planMatchers rewrites the matchers of a select into an equivalent list that
+// is cheaper to resolve against the index. Regular expressions matching a
+// fixed set of values become set lookups, duplicate matchers are dropped and
+// all matchers on a label restricted to a fixed set of values are merged into
+// one. The result is ordered with the most selective matchers first. It
+// returns false if the matchers cannot select any series.
+func planMatchers(ms []labels.Matcher) ([]labels.Matcher, bool) {
+	var (
+		res  = make([]labels.Matcher, 0, len(ms))
+		seen = make(map[string]struct{}, len(ms))
+	)
+	for _, m := range ms {
+		m = labels.Simplify(m)
+
+		k := fmt.Sprint(m)
+		if _, ok := seen[k]; ok {
+			continue
+		}
+		seen[k] = struct{}{}
+		res = append(res, m)
+	}
+
+	// A series matching a matcher on a fixed set of non-empty values must
+	// have one of them. Other matchers on the same label only filter them.
+	for i := 0; i < len(res); i++ {
+		vals, ok := matcherValues(res[i])
+		if !ok {
+			continue
+		}
+		name := res[i].Name()
+
+		rest := res[:i+1]
+		for _, m := range res[i+1:] {
+			if m.Name() != name {
+				rest = append(rest, m)
+				continue
+			}
+			var filtered []string
+			for _, v := range vals {
+				if m.Matches(v) {
+					filtered = append(filtered, v)
+				}
+			}
+			vals = filtered
+		}
+		if len(vals) == 0 {
+			return nil, false
+		}
+		if len(rest) < len(res) {
+			if len(vals) == 1 {
+				rest[i] = labels.NewEqualMatcher(name, vals[0])
+			} else {
+				rest[i] = labels.NewSetMatcher(name, vals...)
+			}
+			res = rest
+		}
+	}
+
+	sort.SliceStable(res, func(i, j int) bool {
+		return matcherCost(res[i]) < matcherCost(res[j])
+	})
+	return res, true
+}
+
+// matcherValues returns the values a matcher is restricted to if they are a
+// fixed set not containing the empty value.
+func matcherValues(m labels.Matcher) ([]string, bool) {
+	switch m := m.(type) {
+	case *labels.EqualMatcher:
+		if m.Value() != "" {
+			return []string{m.Value()}, true
+		}
+	case *labels.SetMatcher:
+		if !m.Matches("") {
+			return m.Values(), true
+		}
+	}
+	return nil, false
+}
+
+// matcherCost estimates the relative cost of resolving the postings of a
+// matcher and the number of series it selects.
+func matcherCost(m labels.Matcher) int {
+	// Matchers selecting the empty value are resolved by subtracting
+	// series and are applied last anyway.
+	if m.Matches("") {
+		return 5
+	}
+	switch m.(type) {
+	case *labels.EqualMatcher:
+		return 0
+	case *labels.SetMatcher:
+		return 1
+	case *labels.PrefixMatcher:
+		return 2
+	case *labels.RangeMatcher:
+		return 3
+	}
+	return 4
+}
@@ -30,6 +30,7 @@ const (
 	RecordSeries     RecordType = 1
 	RecordSamples    RecordType = 2
 	RecordTombstones RecordType = 3
+	RecordIntSamples RecordType = 4
 )
 
 type RecordLogger interface {
@@ -54,7 +55,7 @@ func (d *RecordDecoder) Type(rec []byte) RecordType {
 		return RecordInvalid
 	}
 	switch t := RecordType(rec[0]); t {
-	case RecordSeries, RecordSamples, RecordTombstones:
+	case RecordSeries, RecordSamples, RecordTombstones, RecordIntSamples:
 		return t
 	}
 	return RecordInvalid
@@ -70,7 +71,8 @@ func (d *RecordDecoder) Series(rec []byte, series []RefSeries) ([]RefSeries, err
 	for len(dec.b) > 0 && dec.err() == nil {
 		ref := dec.be64()
 
-		lset := make(labels.Labels, dec.uvarint())
+		// Label names and values take at least a byte each.
+		lset := make(labels.Labels, dec.uvarintLen(2))
 
 		for i := range lset {
 			lset[i].Name = dec.uvarintStr()
@@ -127,6 +129,41 @@ func (d *RecordDecoder) Samples(rec []byte, samples []RefSample) ([]RefSample, e
 	return samples, nil
 }
 
+// IntSamples appends the integer samples in rec to the given slice.
+func (d *RecordDecoder) IntSamples(rec []byte, samples []RefIntSample) ([]RefIntSample, error) {
+	dec := decbuf{b: rec}
+
+	if RecordType(dec.byte()) != RecordIntSamples {
+		return nil, errors.New("invalid record type")
+	}
+	if dec.len() == 0 {
+		return samples, nil
+	}
+	var (
+		baseRef  = dec.be64()
+		baseTime = dec.be64int64()
+	)
+	for len(dec.b) > 0 && dec.err() == nil {
+		dref := dec.varint64()
+		dtime := dec.varint64()
+		val := dec.varint64()
+
+		samples = append(samples, RefIntSample{
+			Ref: uint64(int64(baseRef) + dref),
+			T:   baseTime + dtime,
+			V:   val,
+		})
+	}
+
+	if dec.err() != nil {
+		return nil, errors.Wrapf(dec.err(), "decode error after %d samples", len(samples))
+	}
+	if len(dec.b) > 0 {
+		return nil, errors.Errorf("unexpected %d bytes left in entry", len(dec.b))
+	}
+	return samples, nil
+}
+
 // Tombstones appends tombstones in rec to the given slice.
 func (d *RecordDecoder) Tombstones(rec []byte, tstones []Stone) ([]Stone, error) {
 	dec := decbuf{b: rec}
@@ -197,6 +234,30 @@ func (e *RecordEncoder) Samples(samples []RefSample, b []byte) []byte {
 	return buf.get()
 }
 
+// IntSamples appends the encoded integer samples to b and returns the resulting
+// slice.
+func (e *RecordEncoder) IntSamples(samples []RefIntSample, b []byte) []byte {
+	buf := encbuf{b: b}
+	buf.putByte(byte(RecordIntSamples))
+
+	if len(samples) == 0 {
+		return buf.get()
+	}
+
+	// Like for float samples, timestamps and refs are deltas to the first sample.
+	first := samples[0]
+
+	buf.putBE64(first.Ref)
+	buf.putBE64int64(first.T)
+
+	for _, s := range samples {
+		buf.putVarint64(int64(s.Ref) - int64(first.Ref))
+		buf.putVarint64(s.T - first.T)
+		buf.putVarint64(s.V)
+	}
+	return buf.get()
+}
+
 // Tombstones appends the encoded tombstones to b and returns the resulting slice.
 func (e *RecordEncoder) Tombstones(tstones []Stone, b []byte) []byte {
 	buf := encbuf{b: b}
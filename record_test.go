@@ -15,6 +15,7 @@
 package tsdb
 
 import (
+	"math"
 	"testing"
 
 	"github.com/prometheus/tsdb/labels"
@@ -50,6 +51,15 @@ func TestRecord_EncodeDecode(t *testing.T) {
 	testutil.Ok(t, err)
 	testutil.Equals(t, samples, decSamples)
 
+	ints := []RefIntSample{
+		{Ref: 0, T: 12423423, V: math.MaxInt64},
+		{Ref: 123, T: -1231, V: math.MinInt64},
+		{Ref: 2, T: 0, V: 1<<60 + 1},
+	}
+	decInts, err := dec.IntSamples(enc.IntSamples(ints, nil), nil)
+	testutil.Ok(t, err)
+	testutil.Equals(t, ints, decInts)
+
 	// Intervals get split up into single entries. So we don't get back exactly
 	// what we put in.
 	tstones := []Stone{
@@ -71,3 +81,26 @@ func TestRecord_EncodeDecode(t *testing.T) {
 		{ref: 13, intervals: Intervals{{Mint: 5000, Maxt: 1000}}},
 	}, decTstones)
 }
+
+func TestRecord_DecodeInvalidSeries(t *testing.T) {
+	var dec RecordDecoder
+
+	// A label count far exceeding the record must fail before allocating.
+	e := encbuf{}
+	e.putByte(byte(RecordSeries))
+	e.putBE64(1)
+	e.putUvarint64(1 << 40)
+	e.putUvarintStr("a")
+	e.putUvarintStr("b")
+
+	_, err := dec.Series(e.get(), nil)
+	testutil.NotOk(t, err)
+
+	// Truncated records must fail instead of panicking.
+	var enc RecordEncoder
+	rec := enc.Series([]RefSeries{{Ref: 1, Labels: labels.FromStrings("a", "b")}}, nil)
+	for i := 2; i < len(rec); i++ {
+		_, err := dec.Series(rec[:i], nil)
+		testutil.NotOk(t, err)
+	}
+}
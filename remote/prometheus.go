@@ -0,0 +1,298 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/pkg/errors"
+	"github.com/prometheus/tsdb"
+)
+
+// The messages below are wire-compatible with the remote read messages of the
+// prometheus package in Prometheus' prompb/remote.proto and prompb/types.proto.
+// Label and LabelMatcher are shared with the Read service, Series and Chunk
+// correspond to ChunkedSeries and Chunk.
+
+// ReadRequest response types.
+const (
+	ReadRequest_SAMPLES             int32 = 0
+	ReadRequest_STREAMED_XOR_CHUNKS int32 = 1
+)
+
+type ReadRequest struct {
+	Queries               []*Query `protobuf:"bytes,1,rep,name=queries,proto3" json:"queries,omitempty"`
+	AcceptedResponseTypes []int32  `protobuf:"varint,2,rep,packed,name=accepted_response_types,json=acceptedResponseTypes,proto3" json:"accepted_response_types,omitempty"`
+}
+
+func (m *ReadRequest) Reset()         { *m = ReadRequest{} }
+func (m *ReadRequest) String() string { return proto.CompactTextString(m) }
+func (*ReadRequest) ProtoMessage()    {}
+
+type Query struct {
+	StartTimestampMs int64           `protobuf:"varint,1,opt,name=start_timestamp_ms,json=startTimestampMs,proto3" json:"start_timestamp_ms,omitempty"`
+	EndTimestampMs   int64           `protobuf:"varint,2,opt,name=end_timestamp_ms,json=endTimestampMs,proto3" json:"end_timestamp_ms,omitempty"`
+	Matchers         []*LabelMatcher `protobuf:"bytes,3,rep,name=matchers,proto3" json:"matchers,omitempty"`
+}
+
+func (m *Query) Reset()         { *m = Query{} }
+func (m *Query) String() string { return proto.CompactTextString(m) }
+func (*Query) ProtoMessage()    {}
+
+type ReadResponse struct {
+	Results []*QueryResult `protobuf:"bytes,1,rep,name=results,proto3" json:"results,omitempty"`
+}
+
+func (m *ReadResponse) Reset()         { *m = ReadResponse{} }
+func (m *ReadResponse) String() string { return proto.CompactTextString(m) }
+func (*ReadResponse) ProtoMessage()    {}
+
+type QueryResult struct {
+	Timeseries []*TimeSeries `protobuf:"bytes,1,rep,name=timeseries,proto3" json:"timeseries,omitempty"`
+}
+
+func (m *QueryResult) Reset()         { *m = QueryResult{} }
+func (m *QueryResult) String() string { return proto.CompactTextString(m) }
+func (*QueryResult) ProtoMessage()    {}
+
+type TimeSeries struct {
+	Labels  []*Label  `protobuf:"bytes,1,rep,name=labels,proto3" json:"labels,omitempty"`
+	Samples []*Sample `protobuf:"bytes,2,rep,name=samples,proto3" json:"samples,omitempty"`
+}
+
+func (m *TimeSeries) Reset()         { *m = TimeSeries{} }
+func (m *TimeSeries) String() string { return proto.CompactTextString(m) }
+func (*TimeSeries) ProtoMessage()    {}
+
+type Sample struct {
+	Value     float64 `protobuf:"fixed64,1,opt,name=value,proto3" json:"value,omitempty"`
+	Timestamp int64   `protobuf:"varint,2,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+}
+
+func (m *Sample) Reset()         { *m = Sample{} }
+func (m *Sample) String() string { return proto.CompactTextString(m) }
+func (*Sample) ProtoMessage()    {}
+
+type ChunkedReadResponse struct {
+	ChunkedSeries []*Series `protobuf:"bytes,1,rep,name=chunked_series,json=chunkedSeries,proto3" json:"chunked_series,omitempty"`
+	QueryIndex    int64     `protobuf:"varint,2,opt,name=query_index,json=queryIndex,proto3" json:"query_index,omitempty"`
+}
+
+func (m *ChunkedReadResponse) Reset()         { *m = ChunkedReadResponse{} }
+func (m *ChunkedReadResponse) String() string { return proto.CompactTextString(m) }
+func (*ChunkedReadResponse) ProtoMessage()    {}
+
+const (
+	// Maximum size of a snappy-compressed read request.
+	maxRequestBytes = 32 << 20
+
+	samplesContentType = "application/x-protobuf"
+	streamContentType  = "application/x-streamed-protobuf; proto=prometheus.ChunkedReadResponse"
+)
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ReadHandler serves the remote read protocol of Prometheus against a
+// Queryable, so that Prometheus and other systems speaking the protocol can
+// read from a TSDB without a Prometheus server in front of it.
+//
+// Clients accepting STREAMED_XOR_CHUNKS receive the samples as XOR chunks in
+// a stream of ChunkedReadResponse frames. All other clients receive a single
+// snappy-compressed ReadResponse with the raw samples.
+type ReadHandler struct {
+	db Queryable
+}
+
+// NewReadHandler returns a new ReadHandler reading from db.
+func NewReadHandler(db Queryable) *ReadHandler {
+	return &ReadHandler{db: db}
+}
+
+func (h *ReadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	req, err := decodeReadRequest(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, q := range req.Queries {
+		if _, err := matchers(q.Matchers); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	for _, t := range req.AcceptedResponseTypes {
+		if t == ReadRequest_STREAMED_XOR_CHUNKS {
+			h.serveChunks(w, req)
+			return
+		}
+		if t == ReadRequest_SAMPLES {
+			break
+		}
+	}
+	h.serveSamples(w, req)
+}
+
+func decodeReadRequest(r io.Reader) (*ReadRequest, error) {
+	compressed, err := ioutil.ReadAll(io.LimitReader(r, maxRequestBytes+1))
+	if err != nil {
+		return nil, errors.Wrap(err, "read request")
+	}
+	if len(compressed) > maxRequestBytes {
+		return nil, errors.New("request too large")
+	}
+	b, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		return nil, errors.Wrap(err, "decompress request")
+	}
+	var req ReadRequest
+	if err := proto.Unmarshal(b, &req); err != nil {
+		return nil, errors.Wrap(err, "unmarshal request")
+	}
+	return &req, nil
+}
+
+// serveSamples writes all samples of the queries in a single ReadResponse.
+func (h *ReadHandler) serveSamples(w http.ResponseWriter, req *ReadRequest) {
+	resp := &ReadResponse{Results: make([]*QueryResult, 0, len(req.Queries))}
+
+	for _, q := range req.Queries {
+		res := &QueryResult{}
+
+		err := h.selectSeries(q, func(s tsdb.Series) error {
+			ts := &TimeSeries{}
+			for _, l := range s.Labels() {
+				ts.Labels = append(ts.Labels, &Label{Name: l.Name, Value: l.Value})
+			}
+			it := s.Iterator()
+			for it.Next() {
+				t, v := it.At()
+				ts.Samples = append(ts.Samples, &Sample{Timestamp: t, Value: v})
+			}
+			res.Timeseries = append(res.Timeseries, ts)
+			return it.Err()
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		resp.Results = append(resp.Results, res)
+	}
+	b, err := proto.Marshal(resp)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", samplesContentType)
+	w.Header().Set("Content-Encoding", "snappy")
+
+	w.Write(snappy.Encode(nil, b))
+}
+
+// serveChunks streams the series of the queries in frames of a varint length,
+// the CRC32 checksum of the message and the ChunkedReadResponse message.
+// Errors after the first frame was written can only be signaled by aborting
+// the stream.
+func (h *ReadHandler) serveChunks(w http.ResponseWriter, req *ReadRequest) {
+	var (
+		written bool
+		buf     [binary.MaxVarintLen64 + 4]byte
+	)
+	flusher, _ := w.(http.Flusher)
+
+	send := func(resp *ChunkedReadResponse) error {
+		b, err := proto.Marshal(resp)
+		if err != nil {
+			return err
+		}
+		if !written {
+			w.Header().Set("Content-Type", streamContentType)
+			written = true
+		}
+		n := binary.PutUvarint(buf[:], uint64(len(b)))
+		binary.BigEndian.PutUint32(buf[n:], crc32.Checksum(b, castagnoliTable))
+
+		if _, err := w.Write(buf[:n+4]); err != nil {
+			return err
+		}
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	}
+	for i, q := range req.Queries {
+		var (
+			resp = ChunkedReadResponse{QueryIndex: int64(i)}
+			size int
+		)
+		err := h.selectSeries(q, func(series tsdb.Series) error {
+			s, n, err := encodeSeries(series)
+			if err != nil {
+				return err
+			}
+			resp.ChunkedSeries = append(resp.ChunkedSeries, s)
+			size += n
+
+			if size < responseBytes {
+				return nil
+			}
+			if err := send(&resp); err != nil {
+				return err
+			}
+			resp, size = ChunkedReadResponse{QueryIndex: int64(i)}, 0
+			return nil
+		})
+		if err == nil && len(resp.ChunkedSeries) > 0 {
+			err = send(&resp)
+		}
+		if err != nil {
+			if !written {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+	}
+}
+
+// selectSeries calls f with every series matching the query.
+func (h *ReadHandler) selectSeries(q *Query, f func(tsdb.Series) error) error {
+	ms, err := matchers(q.Matchers)
+	if err != nil {
+		return err
+	}
+	querier, err := h.db.Querier(q.StartTimestampMs, q.EndTimestampMs)
+	if err != nil {
+		return err
+	}
+	defer querier.Close()
+
+	ss, err := querier.Select(ms...)
+	if err != nil {
+		return err
+	}
+	for ss.Next() {
+		if err := f(ss.At()); err != nil {
+			return err
+		}
+	}
+	return ss.Err()
+}
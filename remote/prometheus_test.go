@@ -0,0 +1,190 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/tsdb/labels"
+	"github.com/prometheus/tsdb/testutil"
+)
+
+func TestReadHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "remote_read")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := tsdb.Open(dir, nil, nil, nil)
+	testutil.Ok(t, err)
+	defer db.Close()
+
+	app := db.Appender()
+	for i := int64(0); i < 300; i++ {
+		_, err := app.Add(labels.FromStrings("a", "1", "b", "x"), i, float64(i))
+		testutil.Ok(t, err)
+		_, err = app.Add(labels.FromStrings("a", "2", "b", "xy"), i, float64(-i))
+		testutil.Ok(t, err)
+	}
+	testutil.Ok(t, app.Commit())
+
+	srv := httptest.NewServer(NewReadHandler(db))
+	defer srv.Close()
+
+	post := func(req *ReadRequest) *http.Response {
+		b, err := proto.Marshal(req)
+		testutil.Ok(t, err)
+
+		resp, err := http.Post(srv.URL, "application/x-protobuf", bytes.NewReader(snappy.Encode(nil, b)))
+		testutil.Ok(t, err)
+		return resp
+	}
+	queries := []*Query{
+		{
+			StartTimestampMs: 10,
+			EndTimestampMs:   249,
+			Matchers:         []*LabelMatcher{{Type: LabelMatcher_EQ, Name: "a", Value: "1"}},
+		},
+		{
+			StartTimestampMs: 10,
+			EndTimestampMs:   249,
+			Matchers:         []*LabelMatcher{{Type: LabelMatcher_RE, Name: "b", Value: "x.*"}},
+		},
+	}
+	exp := []map[string]int{
+		{`{a="1",b="x"}`: 1},
+		{`{a="1",b="x"}`: 1, `{a="2",b="xy"}`: -1},
+	}
+	check := func(res []map[string][]sample) {
+		testutil.Equals(t, len(exp), len(res))
+
+		for i := range exp {
+			testutil.Equals(t, len(exp[i]), len(res[i]))
+
+			for lset, sign := range exp[i] {
+				var samples []sample
+				for j := int64(10); j < 250; j++ {
+					samples = append(samples, sample{j, float64(int64(sign) * j)})
+				}
+				testutil.Equals(t, samples, res[i][lset])
+			}
+		}
+	}
+	toLabels := func(ls []*Label) string {
+		var lset labels.Labels
+		for _, l := range ls {
+			lset = append(lset, labels.Label{Name: l.Name, Value: l.Value})
+		}
+		return lset.String()
+	}
+
+	// Clients not accepting streamed chunks receive raw samples.
+	resp := post(&ReadRequest{Queries: queries})
+	testutil.Equals(t, http.StatusOK, resp.StatusCode)
+	testutil.Equals(t, "snappy", resp.Header.Get("Content-Encoding"))
+
+	compressed, err := ioutil.ReadAll(resp.Body)
+	testutil.Ok(t, err)
+	resp.Body.Close()
+
+	b, err := snappy.Decode(nil, compressed)
+	testutil.Ok(t, err)
+
+	var rr ReadResponse
+	testutil.Ok(t, proto.Unmarshal(b, &rr))
+
+	var res []map[string][]sample
+	for _, qr := range rr.Results {
+		m := map[string][]sample{}
+		for _, ts := range qr.Timeseries {
+			for _, s := range ts.Samples {
+				m[toLabels(ts.Labels)] = append(m[toLabels(ts.Labels)], sample{s.Timestamp, s.Value})
+			}
+		}
+		res = append(res, m)
+	}
+	check(res)
+
+	// Streamed chunks are preferred if accepted.
+	resp = post(&ReadRequest{
+		Queries:               queries,
+		AcceptedResponseTypes: []int32{ReadRequest_STREAMED_XOR_CHUNKS, ReadRequest_SAMPLES},
+	})
+	testutil.Equals(t, http.StatusOK, resp.StatusCode)
+	testutil.Equals(t, streamContentType, resp.Header.Get("Content-Type"))
+
+	res = make([]map[string][]sample, len(queries))
+	r := bufio.NewReader(resp.Body)
+	for {
+		size, err := binary.ReadUvarint(r)
+		if err == io.EOF {
+			break
+		}
+		testutil.Ok(t, err)
+
+		var crc [4]byte
+		_, err = io.ReadFull(r, crc[:])
+		testutil.Ok(t, err)
+
+		b := make([]byte, size)
+		_, err = io.ReadFull(r, b)
+		testutil.Ok(t, err)
+		testutil.Equals(t, binary.BigEndian.Uint32(crc[:]), crc32.Checksum(b, castagnoliTable))
+
+		var cr ChunkedReadResponse
+		testutil.Ok(t, proto.Unmarshal(b, &cr))
+
+		m := res[cr.QueryIndex]
+		if m == nil {
+			m = map[string][]sample{}
+			res[cr.QueryIndex] = m
+		}
+		for _, s := range cr.ChunkedSeries {
+			for _, c := range s.Chunks {
+				testutil.Equals(t, uint32(chunkenc.EncXOR), c.Encoding)
+
+				chk, err := chunkenc.FromData(chunkenc.EncXOR, c.Data)
+				testutil.Ok(t, err)
+
+				it := chk.Iterator()
+				for it.Next() {
+					ts, v := it.At()
+					m[toLabels(s.Labels)] = append(m[toLabels(s.Labels)], sample{ts, v})
+				}
+				testutil.Ok(t, it.Err())
+			}
+		}
+	}
+	resp.Body.Close()
+	check(res)
+
+	// Invalid matchers are rejected.
+	resp = post(&ReadRequest{Queries: []*Query{{
+		Matchers: []*LabelMatcher{{Type: LabelMatcher_RE, Name: "a", Value: "("}},
+	}}})
+	resp.Body.Close()
+	testutil.Equals(t, http.StatusBadRequest, resp.StatusCode)
+}
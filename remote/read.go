@@ -0,0 +1,181 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package remote provides a gRPC service exposing the series of a TSDB and
+// a handler serving them over the remote read protocol of Prometheus.
+// The service is defined in read.proto. The message types and service
+// bindings below follow the layout protoc-gen-go generates for it.
+package remote
+
+import (
+	"context"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+)
+
+// LabelMatcher types.
+const (
+	LabelMatcher_EQ  int32 = 0
+	LabelMatcher_NEQ int32 = 1
+	LabelMatcher_RE  int32 = 2
+	LabelMatcher_NRE int32 = 3
+)
+
+type SelectRequest struct {
+	MinTime  int64           `protobuf:"varint,1,opt,name=min_time,json=minTime,proto3" json:"min_time,omitempty"`
+	MaxTime  int64           `protobuf:"varint,2,opt,name=max_time,json=maxTime,proto3" json:"max_time,omitempty"`
+	Matchers []*LabelMatcher `protobuf:"bytes,3,rep,name=matchers,proto3" json:"matchers,omitempty"`
+}
+
+func (m *SelectRequest) Reset()         { *m = SelectRequest{} }
+func (m *SelectRequest) String() string { return proto.CompactTextString(m) }
+func (*SelectRequest) ProtoMessage()    {}
+
+type LabelMatcher struct {
+	Type  int32  `protobuf:"varint,1,opt,name=type,proto3" json:"type,omitempty"`
+	Name  string `protobuf:"bytes,2,opt,name=name,proto3" json:"name,omitempty"`
+	Value string `protobuf:"bytes,3,opt,name=value,proto3" json:"value,omitempty"`
+}
+
+func (m *LabelMatcher) Reset()         { *m = LabelMatcher{} }
+func (m *LabelMatcher) String() string { return proto.CompactTextString(m) }
+func (*LabelMatcher) ProtoMessage()    {}
+
+type SelectResponse struct {
+	Series []*Series `protobuf:"bytes,1,rep,name=series,proto3" json:"series,omitempty"`
+}
+
+func (m *SelectResponse) Reset()         { *m = SelectResponse{} }
+func (m *SelectResponse) String() string { return proto.CompactTextString(m) }
+func (*SelectResponse) ProtoMessage()    {}
+
+type Series struct {
+	Labels []*Label `protobuf:"bytes,1,rep,name=labels,proto3" json:"labels,omitempty"`
+	Chunks []*Chunk `protobuf:"bytes,2,rep,name=chunks,proto3" json:"chunks,omitempty"`
+}
+
+func (m *Series) Reset()         { *m = Series{} }
+func (m *Series) String() string { return proto.CompactTextString(m) }
+func (*Series) ProtoMessage()    {}
+
+type Label struct {
+	Name  string `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Value string `protobuf:"bytes,2,opt,name=value,proto3" json:"value,omitempty"`
+}
+
+func (m *Label) Reset()         { *m = Label{} }
+func (m *Label) String() string { return proto.CompactTextString(m) }
+func (*Label) ProtoMessage()    {}
+
+type Chunk struct {
+	MinTime  int64  `protobuf:"varint,1,opt,name=min_time,json=minTime,proto3" json:"min_time,omitempty"`
+	MaxTime  int64  `protobuf:"varint,2,opt,name=max_time,json=maxTime,proto3" json:"max_time,omitempty"`
+	Encoding uint32 `protobuf:"varint,3,opt,name=encoding,proto3" json:"encoding,omitempty"`
+	Data     []byte `protobuf:"bytes,4,opt,name=data,proto3" json:"data,omitempty"`
+}
+
+func (m *Chunk) Reset()         { *m = Chunk{} }
+func (m *Chunk) String() string { return proto.CompactTextString(m) }
+func (*Chunk) ProtoMessage()    {}
+
+// ReadClient is the client API for the Read service.
+type ReadClient interface {
+	Select(ctx context.Context, in *SelectRequest, opts ...grpc.CallOption) (Read_SelectClient, error)
+}
+
+type readClient struct {
+	cc *grpc.ClientConn
+}
+
+// NewReadClient returns a client of the Read service.
+func NewReadClient(cc *grpc.ClientConn) ReadClient {
+	return &readClient{cc}
+}
+
+func (c *readClient) Select(ctx context.Context, in *SelectRequest, opts ...grpc.CallOption) (Read_SelectClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_Read_serviceDesc.Streams[0], "/tsdb.Read/Select", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &readSelectClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Read_SelectClient interface {
+	Recv() (*SelectResponse, error)
+	grpc.ClientStream
+}
+
+type readSelectClient struct {
+	grpc.ClientStream
+}
+
+func (x *readSelectClient) Recv() (*SelectResponse, error) {
+	m := new(SelectResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ReadServer is the server API for the Read service.
+type ReadServer interface {
+	Select(*SelectRequest, Read_SelectServer) error
+}
+
+// RegisterReadServer registers the Read service implementation with the gRPC server.
+func RegisterReadServer(s *grpc.Server, srv ReadServer) {
+	s.RegisterService(&_Read_serviceDesc, srv)
+}
+
+func _Read_Select_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(SelectRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ReadServer).Select(m, &readSelectServer{stream})
+}
+
+type Read_SelectServer interface {
+	Send(*SelectResponse) error
+	grpc.ServerStream
+}
+
+type readSelectServer struct {
+	grpc.ServerStream
+}
+
+func (x *readSelectServer) Send(m *SelectResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+var _Read_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "tsdb.Read",
+	HandlerType: (*ReadServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Select",
+			Handler:       _Read_Select_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "read.proto",
+}
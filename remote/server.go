@@ -0,0 +1,157 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"github.com/pkg/errors"
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/tsdb/labels"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// Maximum number of samples encoded into a single chunk.
+	samplesPerChunk = 120
+	// Size of chunk data after which a response is sent.
+	responseBytes = 1 << 20
+)
+
+// Queryable provides queriers over time ranges.
+type Queryable interface {
+	Querier(mint, maxt int64) (tsdb.Querier, error)
+}
+
+// Server implements the Read service against a Queryable.
+type Server struct {
+	db Queryable
+}
+
+// NewServer returns a new Server reading from db. It can be registered with
+// a gRPC server through RegisterReadServer.
+func NewServer(db Queryable) *Server {
+	return &Server{db: db}
+}
+
+// Select implements ReadServer.
+func (s *Server) Select(req *SelectRequest, stream Read_SelectServer) error {
+	ms, err := matchers(req.Matchers)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	q, err := s.db.Querier(req.MinTime, req.MaxTime)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	defer q.Close()
+
+	ss, err := q.Select(ms...)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	var (
+		resp SelectResponse
+		size int
+	)
+	for ss.Next() {
+		series, n, err := encodeSeries(ss.At())
+		if err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+		resp.Series = append(resp.Series, series)
+		size += n
+
+		if size >= responseBytes {
+			if err := stream.Send(&resp); err != nil {
+				return err
+			}
+			resp, size = SelectResponse{}, 0
+		}
+	}
+	if err := ss.Err(); err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	if len(resp.Series) > 0 {
+		return stream.Send(&resp)
+	}
+	return nil
+}
+
+// encodeSeries encodes the samples of the series into chunks and returns
+// it along with the total size of the chunk data.
+func encodeSeries(s tsdb.Series) (*Series, int, error) {
+	var (
+		res  = &Series{}
+		size int
+		chks []*chunkenc.XORChunk
+		app  chunkenc.Appender
+		err  error
+	)
+	for _, l := range s.Labels() {
+		res.Labels = append(res.Labels, &Label{Name: l.Name, Value: l.Value})
+	}
+	it := s.Iterator()
+
+	for it.Next() {
+		t, v := it.At()
+
+		if len(chks) == 0 || chks[len(chks)-1].NumSamples() >= samplesPerChunk {
+			chk := chunkenc.NewXORChunk()
+			if app, err = chk.Appender(); err != nil {
+				return nil, 0, err
+			}
+			chks = append(chks, chk)
+			res.Chunks = append(res.Chunks, &Chunk{MinTime: t, Encoding: uint32(chunkenc.EncXOR)})
+		}
+		app.Append(t, v)
+		res.Chunks[len(res.Chunks)-1].MaxTime = t
+	}
+	if err := it.Err(); err != nil {
+		return nil, 0, err
+	}
+	for i, chk := range chks {
+		res.Chunks[i].Data = chk.Bytes()
+		size += len(res.Chunks[i].Data)
+	}
+	return res, size, nil
+}
+
+func matchers(pms []*LabelMatcher) ([]labels.Matcher, error) {
+	ms := make([]labels.Matcher, 0, len(pms))
+
+	for _, pm := range pms {
+		var m labels.Matcher
+
+		switch pm.Type {
+		case LabelMatcher_EQ:
+			m = labels.NewEqualMatcher(pm.Name, pm.Value)
+		case LabelMatcher_NEQ:
+			m = labels.Not(labels.NewEqualMatcher(pm.Name, pm.Value))
+		case LabelMatcher_RE, LabelMatcher_NRE:
+			rm, err := labels.NewRegexpMatcher(pm.Name, "^(?:"+pm.Value+")$")
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid regular expression %q", pm.Value)
+			}
+			m = rm
+			if pm.Type == LabelMatcher_NRE {
+				m = labels.Not(m)
+			}
+		default:
+			return nil, errors.Errorf("unknown matcher type %d", pm.Type)
+		}
+		ms = append(ms, m)
+	}
+	return ms, nil
+}
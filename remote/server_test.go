@@ -0,0 +1,148 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/tsdb/labels"
+	"github.com/prometheus/tsdb/testutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type sample struct {
+	t int64
+	v float64
+}
+
+func TestServer_Select(t *testing.T) {
+	dir, err := ioutil.TempDir("", "remote_read")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := tsdb.Open(dir, nil, nil, nil)
+	testutil.Ok(t, err)
+	defer db.Close()
+
+	app := db.Appender()
+	for i := int64(0); i < 300; i++ {
+		_, err := app.Add(labels.FromStrings("a", "1", "b", "x"), i, float64(i))
+		testutil.Ok(t, err)
+		_, err = app.Add(labels.FromStrings("a", "2", "b", "xy"), i, float64(-i))
+		testutil.Ok(t, err)
+	}
+	testutil.Ok(t, app.Commit())
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	testutil.Ok(t, err)
+
+	srv := grpc.NewServer()
+	RegisterReadServer(srv, NewServer(db))
+	go srv.Serve(l)
+	defer srv.Stop()
+
+	cc, err := grpc.Dial(l.Addr().String(), grpc.WithInsecure())
+	testutil.Ok(t, err)
+	defer cc.Close()
+
+	client := NewReadClient(cc)
+
+	selectAll := func(req *SelectRequest) (map[string][]sample, error) {
+		stream, err := client.Select(context.Background(), req)
+		if err != nil {
+			return nil, err
+		}
+		res := map[string][]sample{}
+		for {
+			resp, err := stream.Recv()
+			if err == io.EOF {
+				return res, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			for _, s := range resp.Series {
+				var lset labels.Labels
+				for _, l := range s.Labels {
+					lset = append(lset, labels.Label{Name: l.Name, Value: l.Value})
+				}
+				for _, c := range s.Chunks {
+					testutil.Assert(t, c.MinTime <= c.MaxTime, "invalid chunk time range")
+
+					chk, err := chunkenc.FromData(chunkenc.Encoding(c.Encoding), c.Data)
+					testutil.Ok(t, err)
+
+					it := chk.Iterator()
+					for it.Next() {
+						ts, v := it.At()
+						res[lset.String()] = append(res[lset.String()], sample{ts, v})
+					}
+					testutil.Ok(t, it.Err())
+				}
+			}
+		}
+	}
+
+	cases := []struct {
+		matchers []*LabelMatcher
+		exp      map[string]int
+	}{
+		{
+			matchers: []*LabelMatcher{{Type: LabelMatcher_EQ, Name: "a", Value: "1"}},
+			exp:      map[string]int{`{a="1",b="x"}`: 1},
+		},
+		{
+			matchers: []*LabelMatcher{{Type: LabelMatcher_NEQ, Name: "a", Value: "1"}},
+			exp:      map[string]int{`{a="2",b="xy"}`: -1},
+		},
+		{
+			// Regular expressions must match the full value.
+			matchers: []*LabelMatcher{{Type: LabelMatcher_RE, Name: "b", Value: "x"}},
+			exp:      map[string]int{`{a="1",b="x"}`: 1},
+		},
+		{
+			matchers: []*LabelMatcher{{Type: LabelMatcher_NRE, Name: "b", Value: "x"}},
+			exp:      map[string]int{`{a="2",b="xy"}`: -1},
+		},
+		{
+			matchers: []*LabelMatcher{{Type: LabelMatcher_RE, Name: "b", Value: "x.*"}},
+			exp:      map[string]int{`{a="1",b="x"}`: 1, `{a="2",b="xy"}`: -1},
+		},
+	}
+	for _, c := range cases {
+		res, err := selectAll(&SelectRequest{MinTime: 10, MaxTime: 249, Matchers: c.matchers})
+		testutil.Ok(t, err)
+		testutil.Equals(t, len(c.exp), len(res))
+
+		for lset, sign := range c.exp {
+			var exp []sample
+			for i := int64(10); i < 250; i++ {
+				exp = append(exp, sample{i, float64(int64(sign) * i)})
+			}
+			testutil.Equals(t, exp, res[lset])
+		}
+	}
+
+	_, err = selectAll(&SelectRequest{Matchers: []*LabelMatcher{{Type: LabelMatcher_RE, Name: "a", Value: "("}}})
+	testutil.Equals(t, codes.InvalidArgument, status.Code(err))
+}
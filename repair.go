@@ -6,11 +6,17 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
 	"github.com/pkg/errors"
+	"github.com/prometheus/tsdb/chunks"
 	"github.com/prometheus/tsdb/fileutil"
+	"github.com/prometheus/tsdb/index"
+	"github.com/prometheus/tsdb/labels"
+	"github.com/prometheus/tsdb/wal"
 )
 
 // repairBadIndexVersion repairs an issue in index and meta.json persistence introduced in
@@ -98,3 +104,313 @@ func readBogusMetaFile(dir string) (*BlockMeta, error) {
 	}
 	return &m, nil
 }
+
+// MigrateIndexes rewrites the index files of all blocks in dir that were written
+// in an older format version than the current one.
+// It must not be run against a directory that is concurrently used by a DB.
+func MigrateIndexes(logger log.Logger, dir string) error {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	dirs, err := blockDirs(dir)
+	if err != nil {
+		return errors.Wrapf(err, "list block dirs in %q", dir)
+	}
+	for _, d := range dirs {
+		meta, err := readBogusMetaFile(d)
+		if err != nil {
+			return errors.Wrapf(err, "block dir: %q", d)
+		}
+		migrated := false
+
+		for _, dd := range dataDirs(d, meta) {
+			sum, ok, err := migrateIndex(logger, dd)
+			if err != nil {
+				return errors.Wrapf(err, "block dir: %q", dd)
+			}
+			if !ok || meta.Checksums == nil {
+				continue
+			}
+			rel, err := filepath.Rel(d, filepath.Join(dd, indexFilename))
+			if err != nil {
+				return err
+			}
+			meta.Checksums[filepath.ToSlash(rel)] = sum
+			migrated = true
+		}
+		if migrated {
+			if err := writeMetaFile(d, meta); err != nil {
+				return errors.Wrapf(err, "block dir: %q", d)
+			}
+		}
+	}
+	return nil
+}
+
+// migrateIndex rewrites the index in dir if it is in an older format version.
+// It returns whether it did so and the checksum of the rewritten index.
+func migrateIndex(logger log.Logger, dir string) (sum uint32, migrated bool, err error) {
+	fn := filepath.Join(dir, indexFilename)
+
+	r, err := index.NewFileReader(fn)
+	if err != nil {
+		return 0, false, errors.Wrap(err, "open index")
+	}
+	defer func() {
+		if r != nil {
+			r.Close()
+		}
+	}()
+
+	if r.Version() >= index.FormatVersion {
+		return 0, false, nil
+	}
+	level.Info(logger).Log(
+		"msg", "migrating index format",
+		"dir", dir,
+		"from", r.Version(),
+		"to", index.FormatVersion,
+	)
+	tmp := fn + ".tmp"
+
+	w, err := index.NewWriter(tmp)
+	if err != nil {
+		return 0, false, errors.Wrap(err, "open index writer")
+	}
+	if err := index.Rewrite(w, r); err != nil {
+		os.RemoveAll(tmp)
+		return 0, false, errors.Wrap(err, "rewrite index")
+	}
+	// Close the reader before replacing the file for Windows.
+	err = r.Close()
+	r = nil
+	if err != nil {
+		return 0, false, errors.Wrap(err, "close index")
+	}
+	return w.Checksum(), true, renameFile(tmp, fn)
+}
+
+// checkedBlockFilename holds the ULID of the newest block that was last checked
+// by repairNewestBlock.
+const checkedBlockFilename = "checked-block"
+
+// repairNewestBlock verifies the checksums of the newest block in dir. A crash can leave
+// it corrupted while the WAL still holds its samples. In that case the block is rebuilt
+// from the WAL and replaces the broken one on the next reload.
+// The block is left untouched if the WAL no longer covers all of its samples.
+// Each block is only checked the first time it is the newest one on startup. Blocks
+// are fully written before the next startup afterwards, so later corruptions are not
+// caused by a crash while writing them and are left to the scrubber.
+func repairNewestBlock(logger log.Logger, dir string, c Compactor, chunkRange int64) error {
+	meta, bdir, err := newestBlock(dir)
+	if err != nil || meta == nil {
+		return err
+	}
+	if id, err := readCheckedBlock(dir); err == nil && id == meta.ULID {
+		return nil
+	}
+	if err := repairBlock(logger, dir, bdir, meta, c, chunkRange); err != nil {
+		return err
+	}
+	return writeCheckedBlock(dir, meta.ULID)
+}
+
+func readCheckedBlock(dir string) (ulid.ULID, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, checkedBlockFilename))
+	if err != nil {
+		return ulid.ULID{}, err
+	}
+	return ulid.Parse(strings.TrimSpace(string(b)))
+}
+
+func writeCheckedBlock(dir string, id ulid.ULID) error {
+	// Make any changes to the file appear atomic.
+	fn := filepath.Join(dir, checkedBlockFilename)
+	tmp := fn + ".tmp"
+
+	if err := ioutil.WriteFile(tmp, []byte(id.String()+"\n"), 0666); err != nil {
+		return err
+	}
+	return fileutil.Rename(tmp, fn)
+}
+
+// repairBlock rebuilds the block in bdir from the WAL of the database in dir if it
+// fails verification.
+func repairBlock(logger log.Logger, dir, bdir string, meta *BlockMeta, c Compactor, chunkRange int64) error {
+	verr := verifyBlock(bdir, meta)
+	if verr == nil {
+		return nil
+	}
+	level.Warn(logger).Log("msg", "newest block failed verification", "ulid", meta.ULID, "err", verr)
+
+	// Only blocks cut from the head can be recovered from the WAL. Its samples must
+	// not have been altered by deletions either or we cannot tell whether it is complete.
+	if meta.Compaction.Level != 1 || meta.Stats.NumSamples == 0 || meta.Stats.NumTombstones > 0 {
+		level.Warn(logger).Log("msg", "block cannot be rebuilt from WAL", "ulid", meta.ULID)
+		return nil
+	}
+	h, err := NewHead(nil, logger, nil, chunkRange)
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+
+	if err := loadWALForRepair(h, filepath.Join(dir, "wal")); err != nil {
+		return errors.Wrap(err, "load WAL")
+	}
+	rh := &rangeHead{head: h, mint: meta.MinTime, maxt: meta.MaxTime - 1}
+
+	uid, err := c.Write(dir, rh, meta.MinTime, meta.MaxTime, meta)
+	if err != nil {
+		return errors.Wrap(err, "rebuild block")
+	}
+	newMeta, err := readMetaFile(filepath.Join(dir, uid.String()))
+	if err != nil {
+		return errors.Wrap(err, "read rebuilt block meta")
+	}
+	if newMeta.Stats.NumSamples != meta.Stats.NumSamples {
+		level.Warn(logger).Log(
+			"msg", "WAL does not cover block, discarding rebuilt block",
+			"ulid", meta.ULID,
+			"expected", meta.Stats.NumSamples,
+			"got", newMeta.Stats.NumSamples,
+		)
+		return errors.Wrap(os.RemoveAll(filepath.Join(dir, uid.String())), "remove rebuilt block")
+	}
+	level.Info(logger).Log("msg", "rebuilt block from WAL", "ulid", meta.ULID, "replacement", uid)
+	return nil
+}
+
+// newestBlock returns the meta and directory of the newest block in dir that is
+// not yet replaced by another block.
+func newestBlock(dir string) (*BlockMeta, string, error) {
+	dirs, err := blockDirs(dir)
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "list block dirs in %q", dir)
+	}
+	var (
+		metas    = map[string]*BlockMeta{}
+		replaced = map[ulid.ULID]struct{}{}
+	)
+	for _, d := range dirs {
+		meta, err := readMetaFile(d)
+		if err != nil || meta.PendingDeletion {
+			continue
+		}
+		metas[d] = meta
+
+		for _, p := range meta.Compaction.Parents {
+			replaced[p.ULID] = struct{}{}
+		}
+	}
+	var (
+		newest *BlockMeta
+		ndir   string
+	)
+	for d, meta := range metas {
+		if _, ok := replaced[meta.ULID]; ok {
+			continue
+		}
+		if newest == nil || meta.MaxTime > newest.MaxTime ||
+			(meta.MaxTime == newest.MaxTime && meta.ULID.Compare(newest.ULID) > 0) {
+			newest, ndir = meta, d
+		}
+	}
+	return newest, ndir, nil
+}
+
+// verifyBlock reads all series and chunks of the block in dir and checks them against
+// their checksums and the sample count recorded in meta.
+func verifyBlock(dir string, meta *BlockMeta) error {
+	var samples uint64
+
+	for _, d := range dataDirs(dir, meta) {
+		n, err := verifyBlockData(d)
+		if err != nil {
+			return err
+		}
+		samples += n
+	}
+	if samples != meta.Stats.NumSamples {
+		return errors.Errorf("block holds %d samples, meta records %d", samples, meta.Stats.NumSamples)
+	}
+	return nil
+}
+
+// verifyBlockData verifies the series and chunks in dir and returns the number
+// of samples they hold.
+func verifyBlockData(dir string) (uint64, error) {
+	ir, err := index.NewFileReader(filepath.Join(dir, indexFilename))
+	if err != nil {
+		return 0, errors.Wrap(err, "open index")
+	}
+	defer ir.Close()
+
+	cr, err := chunks.NewDirReader(chunkDir(dir), nil)
+	if err != nil {
+		return 0, errors.Wrap(err, "open chunks")
+	}
+	defer cr.Close()
+
+	p, err := ir.Postings(index.AllPostingsKey())
+	if err != nil {
+		return 0, errors.Wrap(err, "read postings")
+	}
+	var (
+		lset    labels.Labels
+		chks    []chunks.Meta
+		samples uint64
+	)
+	for p.Next() {
+		if err := ir.Series(p.At(), &lset, &chks); err != nil {
+			return 0, errors.Wrap(err, "read series")
+		}
+		for _, c := range chks {
+			if err := cr.Verify(c.Ref); err != nil {
+				return 0, errors.Wrapf(err, "verify chunk %d", c.Ref)
+			}
+			chk, err := cr.Chunk(c.Ref)
+			if err != nil {
+				return 0, errors.Wrapf(err, "read chunk %d", c.Ref)
+			}
+			samples += uint64(chk.NumSamples())
+		}
+	}
+	if p.Err() != nil {
+		return 0, errors.Wrap(p.Err(), "iterate postings")
+	}
+	return samples, nil
+}
+
+// loadWALForRepair loads the checkpoint and segments of the WAL in dir into h.
+// Unlike Head.Init it leaves the WAL untouched and keeps all samples read before
+// a corruption, which is expected at the tail of the WAL after a crash.
+func loadWALForRepair(h *Head, dir string) error {
+	cp, startFrom, err := LastCheckpoint(dir)
+	if err != nil && err != ErrNotFound {
+		return errors.Wrap(err, "find last checkpoint")
+	}
+	if err == nil {
+		sr, err := wal.NewSegmentsReader(filepath.Join(dir, cp))
+		if err != nil {
+			return errors.Wrap(err, "open checkpoint")
+		}
+		err = h.loadWAL(wal.NewReader(sr))
+		sr.Close()
+		if err != nil {
+			return errors.Wrap(err, "load checkpoint")
+		}
+		startFrom++
+	}
+	sr, err := wal.NewSegmentsRangeReader(dir, startFrom, -1)
+	if err != nil {
+		return errors.Wrap(err, "open WAL segments")
+	}
+	defer sr.Close()
+
+	err = h.loadWAL(wal.NewReader(sr))
+	if _, ok := errors.Cause(err).(*wal.CorruptionErr); ok {
+		return nil
+	}
+	return err
+}
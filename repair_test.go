@@ -1,10 +1,12 @@
 package tsdb
 
 import (
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"testing"
 
+	"github.com/go-kit/kit/log"
 	"github.com/prometheus/tsdb/chunks"
 	"github.com/prometheus/tsdb/fileutil"
 	"github.com/prometheus/tsdb/index"
@@ -107,3 +109,61 @@ func TestRepairBadIndexVersion(t *testing.T) {
 	testutil.Ok(t, err)
 	testutil.Assert(t, meta.Version == 1, "unexpected meta version %d", meta.Version)
 }
+
+func TestMigrateIndexes(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "test_migrate")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	dbDir := filepath.Join("testdata", "repair_index_version", "01BZJ9WJQPWHGNC2W4J9TA62KC")
+	tmpDbDir := filepath.Join(tmpDir, "01BZJ9WJQPWHGNC2W4J9TA62KC")
+	testutil.Ok(t, fileutil.CopyDirs(dbDir, tmpDbDir))
+
+	// Fix up the block first so it holds a valid index of an old format version.
+	testutil.Ok(t, repairBadIndexVersion(log.NewNopLogger(), tmpDir))
+
+	r, err := index.NewFileReader(filepath.Join(tmpDbDir, indexFilename))
+	testutil.Ok(t, err)
+	testutil.Assert(t, r.Version() < index.FormatVersion, "unexpected index version %d", r.Version())
+	testutil.Ok(t, r.Close())
+
+	// Record a checksum, which must be updated for the migrated index.
+	meta, err := readMetaFile(tmpDbDir)
+	testutil.Ok(t, err)
+	sum, err := fileChecksum(filepath.Join(tmpDbDir, indexFilename), nil)
+	testutil.Ok(t, err)
+	meta.Checksums = map[string]uint32{indexFilename: sum}
+	testutil.Ok(t, writeMetaFile(tmpDbDir, meta))
+
+	testutil.Ok(t, MigrateIndexes(nil, tmpDir))
+
+	meta, err = readMetaFile(tmpDbDir)
+	testutil.Ok(t, err)
+	sum, err = fileChecksum(filepath.Join(tmpDbDir, indexFilename), nil)
+	testutil.Ok(t, err)
+	testutil.Equals(t, map[string]uint32{indexFilename: sum}, meta.Checksums)
+
+	r, err = index.NewFileReader(filepath.Join(tmpDbDir, indexFilename))
+	testutil.Ok(t, err)
+	defer r.Close()
+	testutil.Equals(t, index.FormatVersion, r.Version())
+
+	p, err := r.Postings("b", "1")
+	testutil.Ok(t, err)
+	res := []labels.Labels{}
+
+	for p.Next() {
+		var lset labels.Labels
+		var chks []chunks.Meta
+		testutil.Ok(t, r.Series(p.At(), &lset, &chks))
+		res = append(res, lset)
+	}
+	testutil.Ok(t, p.Err())
+	testutil.Equals(t, []labels.Labels{
+		{{"a", "1"}, {"b", "1"}},
+		{{"a", "2"}, {"b", "1"}},
+	}, res)
+
+	// Migrating again is a no-op.
+	testutil.Ok(t, MigrateIndexes(nil, tmpDir))
+}
@@ -0,0 +1,129 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+)
+
+// RestoredBlock describes a block copied by Restore or DB.ImportBlocks.
+type RestoredBlock struct {
+	// Source is the ULID of the block in the backup directory.
+	Source ulid.ULID
+	// ULID is the ULID of the block in the data directory. It differs from
+	// Source if the data directory already held a block with the same ULID
+	// or if new ULIDs were requested for imported blocks.
+	ULID ulid.ULID
+}
+
+// RestoreResult reports the outcome of a Restore.
+type RestoreResult struct {
+	Blocks []RestoredBlock
+}
+
+// Restore copies all blocks from the backup directory src into the data directory dst.
+// Blocks whose ULID already exists in dst are assigned a new ULID. Each block only
+// appears in dst once it was copied completely so dst may be used by a running DB.
+// A DB cannot load overlapping blocks, so no block is copied if any of them overlaps
+// with another restored block or a block in dst.
+func Restore(logger log.Logger, src, dst string) (*RestoreResult, error) {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	if err := os.MkdirAll(dst, 0777); err != nil {
+		return nil, err
+	}
+	dstDirs, err := blockDirs(dst)
+	if err != nil {
+		return nil, errors.Wrapf(err, "list block dirs in %q", dst)
+	}
+	var (
+		metas    []BlockMeta
+		existing = map[ulid.ULID]struct{}{}
+	)
+	for _, d := range dstDirs {
+		meta, err := readMetaFile(d)
+		if err != nil {
+			return nil, errors.Wrapf(err, "read meta of %q", d)
+		}
+		existing[meta.ULID] = struct{}{}
+
+		if !meta.PendingDeletion {
+			metas = append(metas, *meta)
+		}
+	}
+
+	srcDirs, err := blockDirs(src)
+	if err != nil {
+		return nil, errors.Wrapf(err, "list block dirs in %q", src)
+	}
+	var (
+		res      = &RestoreResult{}
+		restores []*BlockMeta
+		dirs     []string
+		restored = map[ulid.ULID]struct{}{}
+		entropy  = rand.New(rand.NewSource(time.Now().UnixNano()))
+	)
+	for _, d := range srcDirs {
+		meta, err := readMetaFile(d)
+		if err != nil {
+			return nil, errors.Wrapf(err, "read meta of %q", d)
+		}
+		if meta.PendingDeletion {
+			continue
+		}
+		rb := RestoredBlock{Source: meta.ULID, ULID: meta.ULID}
+
+		if _, ok := existing[meta.ULID]; ok {
+			rb.ULID = ulid.MustNew(ulid.Now(), entropy)
+			level.Info(logger).Log("msg", "block already exists, assigning new ULID", "ulid", rb.Source, "new", rb.ULID)
+		}
+		meta.ULID = rb.ULID
+
+		existing[rb.ULID] = struct{}{}
+		restored[rb.ULID] = struct{}{}
+		metas = append(metas, *meta)
+		restores = append(restores, meta)
+		dirs = append(dirs, d)
+		res.Blocks = append(res.Blocks, rb)
+	}
+
+	sort.Slice(metas, func(i, j int) bool {
+		return metas[i].MinTime < metas[j].MinTime
+	})
+	// Only overlaps caused by the restore are rejected.
+	for r, ms := range OverlappingBlocks(metas) {
+		for _, m := range ms {
+			if _, ok := restored[m.ULID]; ok {
+				return nil, errors.Errorf("restored blocks overlap: %s", Overlaps{r: ms})
+			}
+		}
+	}
+	for i, meta := range restores {
+		if err := importBlock(dirs[i], filepath.Join(dst, meta.ULID.String()), meta, true); err != nil {
+			return nil, errors.Wrapf(err, "restore block %s", res.Blocks[i].Source)
+		}
+		level.Info(logger).Log("msg", "restored block", "ulid", meta.ULID, "mint", meta.MinTime, "maxt", meta.MaxTime)
+	}
+	return res, nil
+}
@@ -0,0 +1,80 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/oklog/ulid"
+	"github.com/prometheus/tsdb/testutil"
+)
+
+func TestRestore(t *testing.T) {
+	src, err := ioutil.TempDir("", "backup")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(src)
+
+	dst, err := ioutil.TempDir("", "test")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dst)
+
+	block := func(dir string, id uint64, mint, maxt int64) ulid.ULID {
+		uid := ulid.MustNew(id, nil)
+		b := createEmptyBlock(t, filepath.Join(dir, uid.String()), &BlockMeta{
+			ULID:       uid,
+			MinTime:    mint,
+			MaxTime:    maxt,
+			Compaction: BlockMetaCompaction{Level: 1, Sources: []ulid.ULID{uid}},
+		})
+		testutil.Ok(t, b.Close())
+		return uid
+	}
+	// The first backup block conflicts with an existing ULID, the second one
+	// overlaps an existing block and the third one fills a gap.
+	conflict := block(src, 1, 0, 10)
+	overlap := block(src, 2, 15, 25)
+	gap := block(src, 3, 30, 40)
+
+	block(dst, 1, 10, 20)
+
+	// No block is restored if any of them overlaps.
+	_, err = Restore(nil, src, dst)
+	testutil.NotOk(t, err)
+
+	dirs, err := blockDirs(dst)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(dirs))
+
+	testutil.Ok(t, os.RemoveAll(filepath.Join(src, overlap.String())))
+
+	res, err := Restore(nil, src, dst)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 2, len(res.Blocks))
+
+	testutil.Equals(t, conflict, res.Blocks[0].Source)
+	testutil.Assert(t, res.Blocks[0].ULID != conflict, "conflicting ULID not rewritten")
+	testutil.Equals(t, RestoredBlock{Source: gap, ULID: gap}, res.Blocks[1])
+
+	meta, err := readMetaFile(filepath.Join(dst, res.Blocks[0].ULID.String()))
+	testutil.Ok(t, err)
+	testutil.Equals(t, res.Blocks[0].ULID, meta.ULID)
+
+	db, err := Open(dst, nil, nil, nil)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 3, len(db.Blocks()))
+	testutil.Ok(t, db.Close())
+}
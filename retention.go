@@ -0,0 +1,137 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/tsdb/chunks"
+	"github.com/prometheus/tsdb/labels"
+)
+
+// RetentionOverride retains the series matching all of its matchers for a
+// different duration than the default retention of the DB.
+type RetentionOverride struct {
+	Matchers []labels.Matcher
+	// Duration is the retention of the matching series in units of the
+	// timestamps.
+	Duration uint64
+}
+
+// activeRetentionOverrides returns the overrides that still retain series of a
+// block beyond the default retention and the shortest of their durations.
+func (db *DB) activeRetentionOverrides(meta *BlockMeta) ([]RetentionOverride, uint64) {
+	if len(db.options().RetentionOverrides) == 0 {
+		return nil, 0
+	}
+	db.mtx.RLock()
+	blocks := db.blocks[:]
+	db.mtx.RUnlock()
+
+	if len(blocks) == 0 {
+		return nil, 0
+	}
+	maxt := blocks[len(blocks)-1].Meta().MaxTime
+
+	var (
+		res []RetentionOverride
+		min uint64
+	)
+	for _, o := range db.options().RetentionOverrides {
+		if meta.MaxTime < maxt-int64(o.Duration) {
+			continue
+		}
+		if len(res) == 0 || o.Duration < min {
+			min = o.Duration
+		}
+		res = append(res, o)
+	}
+	return res, min
+}
+
+// retainSeries writes the series of the block matching the given overrides
+// into a new block that lists the original one as its parent. It returns the
+// directory of the new block or an empty string if no series were retained.
+func (db *DB) retainSeries(meta *BlockMeta, overrides []RetentionOverride, retention uint64) (string, error) {
+	b, ok := db.getBlock(meta.ULID)
+	if !ok {
+		var err error
+		b, err = openBlock(filepath.Join(db.dir, meta.ULID.String()), nil, db.options().UsePread)
+		if err != nil {
+			return "", errors.Wrap(err, "open block")
+		}
+		defer b.Close()
+	}
+	r := &retainReader{BlockReader: b, overrides: overrides}
+
+	id, err := db.compactor.Write(db.dir, r, meta.MinTime, meta.MaxTime, meta)
+	if err != nil {
+		return "", errors.Wrap(err, "write block")
+	}
+	dir := filepath.Join(db.dir, id.String())
+
+	nmeta, err := readMetaFile(dir)
+	if err != nil {
+		return "", errors.Wrap(err, "read meta")
+	}
+	if nmeta.Stats.NumSamples == 0 {
+		return "", os.RemoveAll(dir)
+	}
+	nmeta.Compaction.Level = meta.Compaction.Level
+	nmeta.Compaction.Sources = meta.Compaction.Sources
+	nmeta.RetentionOverride = retention
+
+	if err := writeMetaFile(dir, nmeta); err != nil {
+		return "", errors.Wrap(err, "write meta")
+	}
+	level.Info(db.logger).Log("msg", "retained series of block beyond retention", "ulid", meta.ULID,
+		"new", id, "series", nmeta.Stats.NumSeries)
+	return dir, nil
+}
+
+// retainReader exposes only the series of a block matching any of the
+// overrides. Other series are still listed by the index but have no chunks.
+type retainReader struct {
+	BlockReader
+	overrides []RetentionOverride
+}
+
+func (r *retainReader) Index() (IndexReader, error) {
+	ir, err := r.BlockReader.Index()
+	if err != nil {
+		return nil, err
+	}
+	return &retainIndexReader{IndexReader: ir, overrides: r.overrides}, nil
+}
+
+type retainIndexReader struct {
+	IndexReader
+	overrides []RetentionOverride
+}
+
+func (r *retainIndexReader) Series(ref uint64, lset *labels.Labels, chks *[]chunks.Meta) error {
+	if err := r.IndexReader.Series(ref, lset, chks); err != nil {
+		return err
+	}
+	for _, o := range r.overrides {
+		if labels.Selector(o.Matchers).Matches(*lset) {
+			return nil
+		}
+	}
+	*chks = (*chks)[:0]
+	return nil
+}
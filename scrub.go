@@ -0,0 +1,159 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// scrubPassInterval is the minimum time between the starts of two passes of
+// the scrubber over all blocks.
+const scrubPassInterval = time.Minute
+
+var errScrubStopped = errors.New("scrubber stopped")
+
+// scrubber continuously verifies the checksums of the files of all loaded
+// blocks, reading no more than rate bytes per second.
+type scrubber struct {
+	db   *DB
+	rate int64
+
+	mtx     sync.Mutex
+	corrupt map[ulid.ULID]struct{}
+
+	bytes       prometheus.Counter
+	corruptions prometheus.Counter
+}
+
+func newScrubber(db *DB, r prometheus.Registerer, rate int64) *scrubber {
+	s := &scrubber{
+		db:      db,
+		rate:    rate,
+		corrupt: map[ulid.ULID]struct{}{},
+		bytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "prometheus_tsdb_scrub_read_bytes_total",
+			Help: "Number of bytes of block files read by the scrubber.",
+		}),
+		corruptions: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "prometheus_tsdb_scrub_corruptions_total",
+			Help: "Number of blocks the scrubber found corrupted.",
+		}),
+	}
+	if r != nil {
+		r.MustRegister(s.bytes, s.corruptions)
+	}
+	return s
+}
+
+// run scrubs all blocks repeatedly until stopc is closed.
+func (s *scrubber) run(stopc <-chan struct{}) {
+	for {
+		start := time.Now()
+
+		for _, b := range s.db.Blocks() {
+			if err := s.scrub(b, stopc); err == errScrubStopped {
+				return
+			}
+		}
+		select {
+		case <-stopc:
+			return
+		case <-time.After(scrubPassInterval - time.Since(start)):
+		}
+	}
+}
+
+func (s *scrubber) scrub(b *Block, stopc <-chan struct{}) error {
+	id := b.Meta().ULID
+
+	err := verifyChecksums(b.Dir(), func(r io.Reader) io.Reader {
+		return &throttledReader{r: r, s: s, start: time.Now(), stopc: stopc}
+	})
+	if errors.Cause(err) == errScrubStopped {
+		return errScrubStopped
+	}
+	// The block may have been deleted while it was verified.
+	s.db.mtx.RLock()
+	_, ok := s.db.getBlock(id)
+	s.db.mtx.RUnlock()
+	if !ok {
+		return nil
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if err != nil {
+		if _, ok := s.corrupt[id]; !ok {
+			s.corrupt[id] = struct{}{}
+			s.corruptions.Inc()
+		}
+		level.Error(s.db.logger).Log("msg", "scrubber found corrupted block", "ulid", id, "err", err)
+		return err
+	}
+	delete(s.corrupt, id)
+	return nil
+}
+
+// corrupted returns the number of loaded blocks found corrupted by the
+// latest verification.
+func (s *scrubber) corrupted() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	n := 0
+	s.db.mtx.RLock()
+	for id := range s.corrupt {
+		if _, ok := s.db.getBlock(id); ok {
+			n++
+		}
+	}
+	s.db.mtx.RUnlock()
+	return n
+}
+
+// throttledReader reads from r at no more than the rate of the scrubber.
+type throttledReader struct {
+	r     io.Reader
+	s     *scrubber
+	start time.Time
+	n     int64
+	stopc <-chan struct{}
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	// Read at most a tenth of a second's worth of data at once.
+	if max := r.s.rate / 10; max > 0 && int64(len(p)) > max {
+		p = p[:max]
+	}
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	r.s.bytes.Add(float64(n))
+
+	due := r.start.Add(time.Duration(float64(r.n) / float64(r.s.rate) * float64(time.Second)))
+	if d := time.Until(due); d > 0 {
+		select {
+		case <-r.stopc:
+			return n, errScrubStopped
+		case <-time.After(d):
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,427 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/tsdb/chunks"
+	"github.com/prometheus/tsdb/index"
+	"github.com/prometheus/tsdb/labels"
+)
+
+// MaxBlockShards is the maximum number of shards the series of a block can be
+// partitioned into.
+const MaxBlockShards = 1 << 8
+
+const (
+	shardsDirname = "shards"
+
+	// Series and chunk references of sharded blocks hold the shard in their
+	// upper bits and the reference within the shard in the lower ones.
+	shardRefShift = 56
+	shardRefMask  = 1<<shardRefShift - 1
+)
+
+// shardDir returns the directory holding the index and chunks of the i-th
+// shard of the block in dir.
+func shardDir(dir string, i int) string {
+	return filepath.Join(dir, shardsDirname, strconv.Itoa(i))
+}
+
+// dataDirs returns the directories holding the index and chunks of the block in
+// dir, which are the shard directories for sharded blocks.
+func dataDirs(dir string, meta *BlockMeta) []string {
+	if meta.Shards == 0 {
+		return []string{dir}
+	}
+	dirs := make([]string, 0, meta.Shards)
+	for i := 0; i < meta.Shards; i++ {
+		dirs = append(dirs, shardDir(dir, i))
+	}
+	return dirs
+}
+
+// seriesShard returns the shard out of n the series with the given labels belongs to.
+func seriesShard(lset labels.Labels, n uint64) uint64 {
+	return lset.Hash() % n
+}
+
+func shardRef(shard int, ref uint64) uint64 {
+	return uint64(shard)<<shardRefShift | ref
+}
+
+func splitShardRef(ref uint64) (int, uint64) {
+	return int(ref >> shardRefShift), ref & shardRefMask
+}
+
+// shardReader exposes only the series of a block reader that belong to a shard.
+// Other series are still listed by the index but have no chunks.
+type shardReader struct {
+	BlockReader
+	shard, shards uint64
+}
+
+func (r *shardReader) Index() (IndexReader, error) {
+	ir, err := r.BlockReader.Index()
+	if err != nil {
+		return nil, err
+	}
+	return &shardIndexReader{IndexReader: ir, shard: r.shard, shards: r.shards}, nil
+}
+
+type shardIndexReader struct {
+	IndexReader
+	shard, shards uint64
+}
+
+func (r *shardIndexReader) Series(ref uint64, lset *labels.Labels, chks *[]chunks.Meta) error {
+	if err := r.IndexReader.Series(ref, lset, chks); err != nil {
+		return err
+	}
+	if seriesShard(*lset, r.shards) != r.shard {
+		*chks = (*chks)[:0]
+	}
+	return nil
+}
+
+// shardedIndexReader fans out reads across the indices of the shards of a block.
+type shardedIndexReader struct {
+	shards []IndexReader
+}
+
+func (r *shardedIndexReader) Symbols() index.StringIter {
+	its := make([]index.StringIter, 0, len(r.shards))
+
+	for _, ir := range r.shards {
+		its = append(its, ir.Symbols())
+	}
+	return index.MergeStringIters(its...)
+}
+
+func (r *shardedIndexReader) LabelValues(names ...string) (index.StringTuples, error) {
+	var (
+		seen    = map[string]struct{}{}
+		entries []string
+	)
+	for i, ir := range r.shards {
+		tpls, err := ir.LabelValues(names...)
+		if err != nil {
+			return nil, errors.Wrapf(err, "shard %d", i)
+		}
+		for j := 0; j < tpls.Len(); j++ {
+			t, err := tpls.At(j)
+			if err != nil {
+				return nil, errors.Wrapf(err, "shard %d", i)
+			}
+			k := strings.Join(t, "\xff")
+			if _, ok := seen[k]; ok {
+				continue
+			}
+			seen[k] = struct{}{}
+			entries = append(entries, t...)
+		}
+	}
+	tpls, err := index.NewStringTuples(entries, len(names))
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(tpls)
+	return tpls, nil
+}
+
+func (r *shardedIndexReader) Postings(name, value string) (index.Postings, error) {
+	its := make([]index.Postings, 0, len(r.shards))
+
+	for i, ir := range r.shards {
+		p, err := ir.Postings(name, value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "shard %d", i)
+		}
+		its = append(its, &shardPostings{Postings: p, shard: i})
+	}
+	return index.Merge(its...), nil
+}
+
+func (r *shardedIndexReader) PrefixPostings(name, prefix string) (index.Postings, error) {
+	its := make([]index.Postings, 0, len(r.shards))
+
+	for i, ir := range r.shards {
+		p, err := ir.PrefixPostings(name, prefix)
+		if err != nil {
+			return nil, errors.Wrapf(err, "shard %d", i)
+		}
+		its = append(its, &shardPostings{Postings: p, shard: i})
+	}
+	return index.Merge(its...), nil
+}
+
+// SortedPostings merges the postings of the shards by the label sets of their
+// series. The series of each shard are sorted already.
+func (r *shardedIndexReader) SortedPostings(p index.Postings) index.Postings {
+	refs := make([][]uint64, len(r.shards))
+
+	for p.Next() {
+		s, ref := splitShardRef(p.At())
+		if s >= len(r.shards) {
+			return index.ErrPostings(errors.Errorf("invalid shard %d", s))
+		}
+		refs[s] = append(refs[s], ref)
+	}
+	if err := p.Err(); err != nil {
+		return index.ErrPostings(errors.Wrap(err, "expand postings"))
+	}
+	sp := &sortedShardPostings{r: r}
+
+	for i, l := range refs {
+		if len(l) == 0 {
+			continue
+		}
+		sp.heads = append(sp.heads, &shardPostingsHead{
+			shard: i,
+			p:     r.shards[i].SortedPostings(index.NewListPostings(l)),
+		})
+	}
+	return sp
+}
+
+func (r *shardedIndexReader) Series(ref uint64, lset *labels.Labels, chks *[]chunks.Meta) error {
+	s, ref := splitShardRef(ref)
+	if s >= len(r.shards) {
+		return ErrNotFound
+	}
+	if err := r.shards[s].Series(ref, lset, chks); err != nil {
+		return err
+	}
+	for i := range *chks {
+		(*chks)[i].Ref = shardRef(s, (*chks)[i].Ref)
+	}
+	return nil
+}
+
+func (r *shardedIndexReader) SeriesStats(ref uint64) (index.SeriesStats, error) {
+	s, ref := splitShardRef(ref)
+	if s >= len(r.shards) {
+		return index.SeriesStats{}, ErrNotFound
+	}
+	return r.shards[s].SeriesStats(ref)
+}
+
+func (r *shardedIndexReader) LabelIndices() ([][]string, error) {
+	var (
+		seen = map[string]struct{}{}
+		res  [][]string
+	)
+	for i, ir := range r.shards {
+		lis, err := ir.LabelIndices()
+		if err != nil {
+			return nil, errors.Wrapf(err, "shard %d", i)
+		}
+		for _, li := range lis {
+			k := strings.Join(li, "\xff")
+			if _, ok := seen[k]; ok {
+				continue
+			}
+			seen[k] = struct{}{}
+			res = append(res, li)
+		}
+	}
+	return res, nil
+}
+
+func (r *shardedIndexReader) LabelSketches() (map[string]*index.HyperLogLog, error) {
+	res := map[string]*index.HyperLogLog{}
+
+	for i, ir := range r.shards {
+		sketches, err := ir.LabelSketches()
+		if err != nil {
+			return nil, errors.Wrapf(err, "shard %d", i)
+		}
+		for n, s := range sketches {
+			hll, ok := res[n]
+			if !ok {
+				hll = index.NewHyperLogLog()
+				res[n] = hll
+			}
+			hll.Merge(s)
+		}
+	}
+	return res, nil
+}
+
+func (r *shardedIndexReader) PostingsStats(limit int) (*index.PostingsStats, error) {
+	sums := map[labels.Label]index.PostingsStat{}
+
+	for i, ir := range r.shards {
+		stats, err := ir.PostingsStats(0)
+		if err != nil {
+			return nil, errors.Wrapf(err, "shard %d", i)
+		}
+		for _, s := range stats.BySeries {
+			sum := sums[s.Label]
+			sum.Label = s.Label
+			sum.Series += s.Series
+			sum.Bytes += s.Bytes
+			sums[s.Label] = sum
+		}
+	}
+	res := make([]index.PostingsStat, 0, len(sums))
+	for _, s := range sums {
+		res = append(res, s)
+	}
+	return index.TopPostingsStats(res, limit), nil
+}
+
+func (r *shardedIndexReader) Close() error {
+	var merr MultiError
+	for _, ir := range r.shards {
+		merr.Add(ir.Close())
+	}
+	return merr.Err()
+}
+
+// shardPostings maps the postings of a shard to references of the sharded block.
+type shardPostings struct {
+	index.Postings
+	shard int
+}
+
+func (p *shardPostings) At() uint64 {
+	return shardRef(p.shard, p.Postings.At())
+}
+
+func (p *shardPostings) Seek(v uint64) bool {
+	switch s, ref := splitShardRef(v); {
+	case s < p.shard:
+		return p.Postings.Seek(0)
+	case s > p.shard:
+		for p.Postings.Next() {
+		}
+		return false
+	default:
+		return p.Postings.Seek(ref)
+	}
+}
+
+type shardPostingsHead struct {
+	shard int
+	p     index.Postings
+	lset  labels.Labels
+	chks  []chunks.Meta
+}
+
+// sortedShardPostings merges the sorted postings of several shards by the label
+// sets of their series.
+type sortedShardPostings struct {
+	r     *shardedIndexReader
+	heads []*shardPostingsHead
+	cur   uint64
+	init  bool
+	err   error
+}
+
+func (p *sortedShardPostings) next(h *shardPostingsHead) (bool, error) {
+	if !h.p.Next() {
+		return false, h.p.Err()
+	}
+	if err := p.r.shards[h.shard].Series(h.p.At(), &h.lset, &h.chks); err != nil {
+		return false, errors.Wrapf(err, "shard %d", h.shard)
+	}
+	return true, nil
+}
+
+func (p *sortedShardPostings) Next() bool {
+	if p.err != nil {
+		return false
+	}
+	if !p.init {
+		p.init = true
+		heads := p.heads[:0]
+
+		for _, h := range p.heads {
+			ok, err := p.next(h)
+			if err != nil {
+				p.err = err
+				return false
+			}
+			if ok {
+				heads = append(heads, h)
+			}
+		}
+		p.heads = heads
+	}
+	if len(p.heads) == 0 {
+		return false
+	}
+	// The number of shards is small, a linear scan beats a heap.
+	min := 0
+	for i, h := range p.heads[1:] {
+		if labels.Compare(h.lset, p.heads[min].lset) < 0 {
+			min = i + 1
+		}
+	}
+	h := p.heads[min]
+	p.cur = shardRef(h.shard, h.p.At())
+
+	ok, err := p.next(h)
+	if err != nil {
+		p.err = err
+		return true
+	}
+	if !ok {
+		p.heads = append(p.heads[:min], p.heads[min+1:]...)
+	}
+	return true
+}
+
+func (p *sortedShardPostings) Seek(v uint64) bool {
+	if p.init && p.cur >= v {
+		return true
+	}
+	for p.Next() {
+		if p.cur >= v {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *sortedShardPostings) At() uint64 { return p.cur }
+func (p *sortedShardPostings) Err() error { return p.err }
+
+// shardedChunkReader reads chunks from the shards of a block.
+type shardedChunkReader struct {
+	shards []ChunkReader
+}
+
+func (r *shardedChunkReader) Chunk(ref uint64) (chunkenc.Chunk, error) {
+	s, ref := splitShardRef(ref)
+	if s >= len(r.shards) {
+		return nil, errors.Errorf("invalid shard %d", s)
+	}
+	return r.shards[s].Chunk(ref)
+}
+
+func (r *shardedChunkReader) Close() error {
+	var merr MultiError
+	for _, cr := range r.shards {
+		merr.Add(cr.Close())
+	}
+	return merr.Err()
+}
@@ -0,0 +1,146 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/tsdb/chunks"
+	"github.com/prometheus/tsdb/index"
+	"github.com/prometheus/tsdb/labels"
+	"github.com/prometheus/tsdb/testutil"
+)
+
+func TestShardedBlock(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "test")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	b := createPopulatedBlock(t, filepath.Join(tmpdir, "orig"), 30, 300)
+	defer b.Close()
+	orig := b.Meta()
+
+	m := labels.NewMustRegexpMatcher("", ".*")
+	read := func(b *Block) map[string][]sample {
+		q, err := NewBlockQuerier(b, math.MinInt64, math.MaxInt64)
+		testutil.Ok(t, err)
+		defer q.Close()
+		return query(t, q, m)
+	}
+	exp := read(b)
+
+	c, err := NewLeveledCompactor(nil, log.NewNopLogger(), []int64{1000000}, nil)
+	testutil.Ok(t, err)
+	c.shards = 4
+
+	dest := filepath.Join(tmpdir, "sharded")
+	id, err := c.Write(dest, b, orig.MinTime, orig.MaxTime, nil)
+	testutil.Ok(t, err)
+
+	dir := filepath.Join(dest, id.String())
+	testutil.Ok(t, VerifyBlock(dir))
+
+	sb, err := OpenBlock(dir, nil)
+	testutil.Ok(t, err)
+	defer sb.Close()
+
+	meta := sb.Meta()
+	testutil.Equals(t, 4, meta.Shards)
+	testutil.Equals(t, orig.Stats, meta.Stats)
+
+	for i := 0; i < meta.Shards; i++ {
+		_, err = os.Stat(filepath.Join(shardDir(dir, i), indexFilename))
+		testutil.Ok(t, err)
+	}
+	testutil.Equals(t, exp, read(sb))
+
+	// Label values are merged across shards.
+	ir, err := b.Index()
+	testutil.Ok(t, err)
+	defer ir.Close()
+	sir, err := sb.Index()
+	testutil.Ok(t, err)
+	defer sir.Close()
+
+	names, err := ir.LabelIndices()
+	testutil.Ok(t, err)
+	snames, err := sir.LabelIndices()
+	testutil.Ok(t, err)
+	testutil.Equals(t, len(names), len(snames))
+
+	for _, n := range names {
+		expVals, err := ir.LabelValues(n...)
+		testutil.Ok(t, err)
+		vals, err := sir.LabelValues(n...)
+		testutil.Ok(t, err)
+		testutil.Equals(t, expVals.Len(), vals.Len())
+
+		for i := 0; i < expVals.Len(); i++ {
+			e, err := expVals.At(i)
+			testutil.Ok(t, err)
+			v, err := vals.At(i)
+			testutil.Ok(t, err)
+			testutil.Equals(t, e, v)
+		}
+	}
+
+	// Sorted postings span all shards in label order.
+	p, err := sir.Postings(index.AllPostingsKey())
+	testutil.Ok(t, err)
+	p = sir.SortedPostings(p)
+
+	var (
+		prev, lset labels.Labels
+		chks       []chunks.Meta
+		n          uint64
+	)
+	for p.Next() {
+		testutil.Ok(t, sir.Series(p.At(), &lset, &chks))
+		testutil.Assert(t, prev == nil || labels.Compare(prev, lset) < 0, "series not sorted")
+		prev = lset.Copy()
+		n++
+	}
+	testutil.Ok(t, p.Err())
+	testutil.Equals(t, orig.Stats.NumSeries, n)
+
+	// A sharded block can be compacted into an unsharded one.
+	c.shards = 0
+	id, err = c.Write(dest, sb, orig.MinTime, orig.MaxTime, nil)
+	testutil.Ok(t, err)
+
+	ub, err := OpenBlock(filepath.Join(dest, id.String()), nil)
+	testutil.Ok(t, err)
+	defer ub.Close()
+	testutil.Equals(t, 0, ub.Meta().Shards)
+	testutil.Equals(t, exp, read(ub))
+
+	// Snapshots of sharded blocks hold all shards.
+	snap := filepath.Join(tmpdir, "snap")
+	testutil.Ok(t, sb.Snapshot(snap))
+	testutil.Ok(t, VerifyBlock(filepath.Join(snap, meta.ULID.String())))
+
+	snb, err := OpenBlock(filepath.Join(snap, meta.ULID.String()), nil)
+	testutil.Ok(t, err)
+	defer snb.Close()
+	testutil.Equals(t, exp, read(snb))
+
+	// Deletions apply to the series of all shards.
+	testutil.Ok(t, sb.Delete(math.MinInt64, math.MaxInt64, m))
+	testutil.Equals(t, map[string][]sample{}, read(sb))
+}
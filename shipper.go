@@ -0,0 +1,458 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/tsdb/fileutil"
+)
+
+// Bucket is an object store that blocks are shipped to and downloaded from.
+// Object names are slash-separated paths.
+type Bucket interface {
+	// Upload writes the contents of r to the object with the given name.
+	Upload(ctx context.Context, name string, r io.Reader) error
+
+	// Get returns a reader for the object with the given name.
+	Get(ctx context.Context, name string) (io.ReadCloser, error)
+
+	// GetRange returns a reader for length bytes of the object with the given
+	// name, starting at offset off.
+	GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error)
+
+	// ObjectSize returns the size of the object with the given name in bytes.
+	ObjectSize(ctx context.Context, name string) (int64, error)
+
+	// Iter calls f for every object and directory directly below the
+	// directory dir, which is the bucket root if empty. Directory names end
+	// with a slash.
+	Iter(ctx context.Context, dir string, f func(name string) error) error
+}
+
+type dirBucket struct {
+	dir string
+}
+
+// NewDirBucket returns a bucket storing objects as files below dir, e.g. on a
+// mounted network filesystem.
+func NewDirBucket(dir string) Bucket {
+	return &dirBucket{dir: dir}
+}
+
+func (b *dirBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	fn := filepath.Join(b.dir, filepath.FromSlash(name))
+
+	if err := os.MkdirAll(filepath.Dir(fn), 0777); err != nil {
+		return err
+	}
+	tmp := fn + ".tmp"
+
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return fileutil.Rename(tmp, fn)
+}
+
+func (b *dirBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return os.Open(filepath.Join(b.dir, filepath.FromSlash(name)))
+}
+
+func (b *dirBucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(filepath.Join(b.dir, filepath.FromSlash(name)))
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.NewSectionReader(f, off, length), f}, nil
+}
+
+func (b *dirBucket) ObjectSize(ctx context.Context, name string) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	fi, err := os.Stat(filepath.Join(b.dir, filepath.FromSlash(name)))
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+func (b *dirBucket) Iter(ctx context.Context, dir string, f func(name string) error) error {
+	files, err := ioutil.ReadDir(filepath.Join(b.dir, filepath.FromSlash(dir)))
+	if err != nil {
+		return err
+	}
+	for _, fi := range files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		// Skip objects that are still being uploaded.
+		if strings.HasSuffix(fi.Name(), ".tmp") {
+			continue
+		}
+		name := path.Join(dir, fi.Name())
+		if fi.IsDir() {
+			name += "/"
+		}
+		if err := f(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ShipperOptions configure a Shipper.
+type ShipperOptions struct {
+	// Interval between synchronizations of Run. Defaults to one minute.
+	Interval time.Duration
+
+	// LocalRetention is the time range, relative to the most recent block, for
+	// which shipped blocks are kept on local disk. Older shipped blocks are
+	// deleted locally. Zero keeps all blocks.
+	LocalRetention time.Duration
+}
+
+const shipperStateFilename = "shipper.json"
+
+// shipperState is persisted in the database directory to remember which
+// blocks were uploaded across restarts.
+type shipperState struct {
+	Version  int         `json:"version"`
+	Uploaded []ulid.ULID `json:"uploaded"`
+}
+
+// Shipper uploads the blocks of a database to a bucket.
+//
+// A block is shipped once it, or all blocks it was compacted from, have been
+// uploaded. Blocks persisted from the head are uploaded as they appear. Blocks
+// compacted from sources that were not all uploaded before are uploaded as
+// well, which may overlap with blocks in the bucket.
+type Shipper struct {
+	logger log.Logger
+	db     *DB
+	bkt    Bucket
+	opts   ShipperOptions
+
+	// mtx serializes synchronizations.
+	mtx sync.Mutex
+
+	uploads        prometheus.Counter
+	uploadFailures prometheus.Counter
+	deletions      prometheus.Counter
+}
+
+// NewShipper returns a shipper uploading the blocks of db to bkt.
+func NewShipper(logger log.Logger, r prometheus.Registerer, db *DB, bkt Bucket, opts *ShipperOptions) *Shipper {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	if opts == nil {
+		opts = &ShipperOptions{}
+	}
+	s := &Shipper{
+		logger: logger,
+		db:     db,
+		bkt:    bkt,
+		opts:   *opts,
+		uploads: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "prometheus_tsdb_shipper_uploads_total",
+			Help: "Number of blocks uploaded to the bucket.",
+		}),
+		uploadFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "prometheus_tsdb_shipper_upload_failures_total",
+			Help: "Number of blocks that failed to upload to the bucket.",
+		}),
+		deletions: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "prometheus_tsdb_shipper_local_deletions_total",
+			Help: "Number of shipped blocks deleted from local disk.",
+		}),
+	}
+	if s.opts.Interval <= 0 {
+		s.opts.Interval = time.Minute
+	}
+	if r != nil {
+		r.MustRegister(s.uploads, s.uploadFailures, s.deletions)
+	}
+	return s
+}
+
+// Run synchronizes periodically until the context is canceled.
+func (s *Shipper) Run(ctx context.Context) {
+	t := time.NewTicker(s.opts.Interval)
+	defer t.Stop()
+
+	for {
+		if _, err := s.Sync(ctx); err != nil {
+			level.Error(s.logger).Log("msg", "shipping blocks failed", "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// Sync uploads all blocks that have not been shipped yet and deletes shipped
+// blocks beyond the local retention. It returns the number of uploaded blocks.
+// Blocks that failed to upload are retried on the next synchronization.
+func (s *Shipper) Sync(ctx context.Context) (uploaded int, err error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	state, err := readShipperState(s.db.Dir())
+	if err != nil {
+		return 0, errors.Wrap(err, "read shipper state")
+	}
+	done := map[ulid.ULID]struct{}{}
+	for _, id := range state.Uploaded {
+		done[id] = struct{}{}
+	}
+	var merr MultiError
+
+	for _, b := range s.db.Blocks() {
+		meta := b.Meta()
+		if shipped(meta, done) {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			merr.Add(err)
+			break
+		}
+		if err := s.upload(ctx, b); err != nil {
+			s.uploadFailures.Inc()
+			level.Warn(s.logger).Log("msg", "uploading block failed", "ulid", meta.ULID, "err", err)
+			merr.Add(errors.Wrapf(err, "upload block %s", meta.ULID))
+			continue
+		}
+		s.uploads.Inc()
+		level.Info(s.logger).Log("msg", "uploaded block", "ulid", meta.ULID)
+
+		done[meta.ULID] = struct{}{}
+		uploaded++
+
+		// Persist the state after every upload to not upload blocks again
+		// after a crash.
+		state.Uploaded = append(state.Uploaded, meta.ULID)
+		if err := writeShipperState(s.db.Dir(), state); err != nil {
+			merr.Add(errors.Wrap(err, "write shipper state"))
+			return uploaded, merr.Err()
+		}
+	}
+	if s.opts.LocalRetention > 0 {
+		merr.Add(s.deleteShipped(done))
+	}
+	merr.Add(s.pruneState(state))
+
+	return uploaded, merr.Err()
+}
+
+// shipped returns whether the block or all blocks it was compacted from are
+// marked as done.
+func shipped(meta BlockMeta, done map[ulid.ULID]struct{}) bool {
+	if _, ok := done[meta.ULID]; ok {
+		return true
+	}
+	if len(meta.Compaction.Sources) == 0 {
+		return false
+	}
+	for _, id := range meta.Compaction.Sources {
+		if _, ok := done[id]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// upload uploads all files of the block, with the meta file last. The meta
+// file thus indicates a complete block in the bucket.
+func (s *Shipper) upload(ctx context.Context, b *Block) error {
+	// Prevent the block from being closed and deleted while it is uploaded.
+	if err := b.startRead(); err != nil {
+		return err
+	}
+	defer b.pendingReaders.Done()
+
+	var files []string
+
+	err := filepath.Walk(b.Dir(), func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() || fi.Name() == metaFilename || strings.HasSuffix(fi.Name(), ".tmp") {
+			return nil
+		}
+		rel, err := filepath.Rel(b.Dir(), p)
+		if err != nil {
+			return err
+		}
+		files = append(files, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "list block files")
+	}
+	files = append(files, metaFilename)
+
+	id := b.Meta().ULID.String()
+
+	for _, fn := range files {
+		if err := s.uploadFile(ctx, filepath.Join(b.Dir(), filepath.FromSlash(fn)), path.Join(id, fn)); err != nil {
+			return errors.Wrapf(err, "upload %s", fn)
+		}
+	}
+	return nil
+}
+
+func (s *Shipper) uploadFile(ctx context.Context, src, name string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return s.bkt.Upload(ctx, name, f)
+}
+
+// deleteShipped deletes shipped blocks beyond the local retention. They are
+// marked for deletion and removed by reloading the database.
+func (s *Shipper) deleteShipped(done map[ulid.ULID]struct{}) error {
+	s.db.cmtx.Lock()
+	defer s.db.cmtx.Unlock()
+
+	blocks := s.db.Blocks()
+	if len(blocks) == 0 {
+		return nil
+	}
+	mint := blocks[len(blocks)-1].Meta().MaxTime - s.db.options().TimestampUnit.FromDuration(s.opts.LocalRetention)
+
+	var deleted int
+
+	for _, b := range blocks {
+		meta := b.Meta()
+		if meta.MaxTime >= mint || !shipped(meta, done) {
+			continue
+		}
+		meta.PendingDeletion = true
+
+		if err := writeMetaFile(b.Dir(), &meta); err != nil {
+			return errors.Wrapf(err, "mark block %s for deletion", meta.ULID)
+		}
+		level.Info(s.logger).Log("msg", "deleting shipped block beyond local retention", "ulid", meta.ULID)
+		s.deletions.Inc()
+		deleted++
+	}
+	if deleted == 0 {
+		return nil
+	}
+	return errors.Wrap(s.db.reload(), "reload blocks")
+}
+
+// pruneState drops uploaded blocks from the state that neither exist locally
+// nor are sources of local blocks.
+func (s *Shipper) pruneState(state *shipperState) error {
+	keep := map[ulid.ULID]struct{}{}
+
+	for _, b := range s.db.Blocks() {
+		meta := b.Meta()
+		keep[meta.ULID] = struct{}{}
+
+		for _, id := range meta.Compaction.Sources {
+			keep[id] = struct{}{}
+		}
+	}
+	uploaded := state.Uploaded[:0]
+
+	for _, id := range state.Uploaded {
+		if _, ok := keep[id]; ok {
+			uploaded = append(uploaded, id)
+		}
+	}
+	if len(uploaded) == len(state.Uploaded) {
+		return nil
+	}
+	state.Uploaded = uploaded
+
+	return errors.Wrap(writeShipperState(s.db.Dir(), state), "write shipper state")
+}
+
+func readShipperState(dir string) (*shipperState, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, shipperStateFilename))
+	if os.IsNotExist(err) {
+		return &shipperState{Version: 1}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var st shipperState
+
+	if err := json.Unmarshal(b, &st); err != nil {
+		return nil, err
+	}
+	if st.Version != 1 {
+		return nil, errors.Errorf("unexpected shipper state version %d", st.Version)
+	}
+	return &st, nil
+}
+
+func writeShipperState(dir string, st *shipperState) error {
+	st.Version = 1
+
+	// Make any changes to the file appear atomic.
+	fn := filepath.Join(dir, shipperStateFilename)
+	tmp := fn + ".tmp"
+
+	b, err := json.MarshalIndent(st, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(tmp, b, 0666); err != nil {
+		return err
+	}
+	return fileutil.Rename(tmp, fn)
+}
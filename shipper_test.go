@@ -0,0 +1,103 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/tsdb/testutil"
+)
+
+type failingBucket struct {
+	Bucket
+	fail bool
+}
+
+func (b *failingBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	if b.fail {
+		return errors.New("bucket unavailable")
+	}
+	return b.Bucket.Upload(ctx, name, r)
+}
+
+func TestShipper(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	bdir, err := ioutil.TempDir("", "bucket")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(bdir)
+
+	var ids []ulid.ULID
+	for i := int64(0); i < 3; i++ {
+		id := ulid.MustNew(uint64(i+1), nil)
+		b := createEmptyBlock(t, filepath.Join(dir, id.String()), &BlockMeta{
+			ULID:       id,
+			MinTime:    i * 10,
+			MaxTime:    (i + 1) * 10,
+			Compaction: BlockMetaCompaction{Level: 1, Sources: []ulid.ULID{id}},
+		})
+		testutil.Ok(t, b.Close())
+		ids = append(ids, id)
+	}
+	db, err := Open(dir, nil, nil, nil)
+	testutil.Ok(t, err)
+	defer db.Close()
+
+	bkt := &failingBucket{Bucket: NewDirBucket(bdir), fail: true}
+	s := NewShipper(nil, nil, db, bkt, &ShipperOptions{LocalRetention: 5 * time.Millisecond})
+
+	// Failed uploads are retried and keep blocks on local disk.
+	n, err := s.Sync(context.Background())
+	testutil.NotOk(t, err)
+	testutil.Equals(t, 0, n)
+	testutil.Equals(t, 3, len(db.Blocks()))
+
+	bkt.fail = false
+
+	n, err = s.Sync(context.Background())
+	testutil.Ok(t, err)
+	testutil.Equals(t, 3, n)
+
+	for _, id := range ids {
+		for _, fn := range []string{metaFilename, indexFilename, "tombstones"} {
+			_, err := os.Stat(filepath.Join(bdir, id.String(), fn))
+			testutil.Ok(t, err)
+		}
+	}
+	// Only the most recent block is within the local retention.
+	testutil.Equals(t, 1, len(db.Blocks()))
+	testutil.Equals(t, ids[2], db.Blocks()[0].Meta().ULID)
+
+	_, err = os.Stat(filepath.Join(dir, ids[0].String()))
+	testutil.Assert(t, os.IsNotExist(err), "block not deleted locally")
+
+	state, err := readShipperState(dir)
+	testutil.Ok(t, err)
+	testutil.Equals(t, []ulid.ULID{ids[2]}, state.Uploaded)
+
+	// Shipped blocks are not uploaded again.
+	n, err = s.Sync(context.Background())
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, n)
+}
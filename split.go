@@ -0,0 +1,304 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/tsdb/chunks"
+	"github.com/prometheus/tsdb/labels"
+)
+
+// SplitMode determines how SplitBlock distributes the data of a block.
+type SplitMode int
+
+const (
+	// SplitByTime splits a block into blocks covering consecutive time ranges
+	// of equal length.
+	SplitByTime SplitMode = iota
+	// SplitBySeries splits a block into blocks holding disjoint sets of series,
+	// each spanning the full time range of the block.
+	SplitBySeries
+)
+
+// SplitBlock splits the block in dir into n blocks written to dest. Blocks that
+// would hold no samples are skipped. The new blocks keep the compaction level
+// and sources of the original block but do not list it as their parent, so
+// loading them never deletes the original block.
+// The new blocks overlap with the original one, so dest must not be the
+// directory holding it. Blocks split by series also overlap with each other
+// and cannot be loaded by a DB together, so dest must not hold a DB then.
+func SplitBlock(logger log.Logger, dir, dest string, n int, mode SplitMode) ([]ulid.ULID, error) {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	if n < 1 {
+		return nil, errors.Errorf("invalid number of blocks %d", n)
+	}
+	same, err := sameDir(filepath.Dir(filepath.Clean(dir)), dest)
+	if err != nil {
+		return nil, err
+	}
+	if same {
+		return nil, errors.Errorf("destination %q holds the block to split", dest)
+	}
+	if mode == SplitBySeries {
+		db, err := isDBDir(dest)
+		if err != nil {
+			return nil, err
+		}
+		if db {
+			return nil, errors.Errorf("blocks split by series overlap and cannot be written into the DB directory %q", dest)
+		}
+	}
+	b, err := OpenBlock(dir, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "open block")
+	}
+	defer b.Close()
+
+	meta := b.Meta()
+
+	c, err := NewLeveledCompactor(nil, logger, []int64{meta.MaxTime - meta.MinTime}, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "create compactor")
+	}
+	var ids []ulid.ULID
+
+	for i := 0; i < n; i++ {
+		// Like compactions, keep samples at the exclusive end of the block's time range.
+		r := &splitReader{b: b, mint: meta.MinTime, maxt: meta.MaxTime}
+		mint, maxt := meta.MinTime, meta.MaxTime
+
+		switch mode {
+		case SplitByTime:
+			width := (meta.MaxTime - meta.MinTime + int64(n) - 1) / int64(n)
+			mint = meta.MinTime + int64(i)*width
+			if mint >= meta.MaxTime {
+				continue
+			}
+			if maxt = mint + width; maxt < meta.MaxTime {
+				r.maxt = maxt - 1
+			} else {
+				maxt = meta.MaxTime
+			}
+			r.mint = mint
+		case SplitBySeries:
+			r.shard, r.shards = uint64(i), uint64(n)
+		default:
+			return nil, errors.Errorf("unknown split mode %d", mode)
+		}
+		id, err := c.Write(dest, r, mint, maxt, &meta)
+		if err != nil {
+			return nil, errors.Wrapf(err, "write block %d", i)
+		}
+		bdir := filepath.Join(dest, id.String())
+
+		nmeta, err := readMetaFile(bdir)
+		if err != nil {
+			return nil, errors.Wrap(err, "read meta")
+		}
+		if nmeta.Stats.NumSamples == 0 {
+			if err := os.RemoveAll(bdir); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		nmeta.Compaction.Level = meta.Compaction.Level
+		nmeta.Compaction.Sources = meta.Compaction.Sources
+		nmeta.Compaction.Parents = nil
+
+		if err := writeMetaFile(bdir, nmeta); err != nil {
+			return nil, errors.Wrap(err, "write meta")
+		}
+		level.Info(logger).Log("msg", "split block", "ulid", id, "mint", mint, "maxt", maxt, "samples", nmeta.Stats.NumSamples)
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// sameDir reports whether the directories a and b are the same. The directory
+// b may not exist.
+func sameDir(a, b string) (bool, error) {
+	fa, err := os.Stat(a)
+	if err != nil {
+		return false, err
+	}
+	fb, err := os.Stat(b)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return os.SameFile(fa, fb), nil
+}
+
+// isDBDir reports whether dir holds blocks or a WAL that a DB would load.
+func isDBDir(dir string) (bool, error) {
+	_, err := os.Stat(filepath.Join(dir, "wal"))
+	if err == nil {
+		return true, nil
+	}
+	if !os.IsNotExist(err) {
+		return false, err
+	}
+	dirs, err := blockDirs(dir)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return len(dirs) > 0, err
+}
+
+// splitReader exposes the samples of a block within the time range [mint, maxt]
+// and, if shards is non-zero, only the series of the given shard.
+// Unlike other readers, its index and chunk readers share the chunks clipped
+// for the most recently read series and must be used by a single goroutine.
+type splitReader struct {
+	b             BlockReader
+	mint, maxt    int64
+	shard, shards uint64
+
+	// clipped holds the re-encoded chunks of the current series that were
+	// cut at the time range boundaries.
+	clipped map[uint64]chunkenc.Chunk
+}
+
+func (r *splitReader) Index() (IndexReader, error) {
+	ir, err := r.b.Index()
+	if err != nil {
+		return nil, err
+	}
+	cr, err := r.b.Chunks()
+	if err != nil {
+		ir.Close()
+		return nil, err
+	}
+	r.clipped = map[uint64]chunkenc.Chunk{}
+	return &splitIndexReader{IndexReader: ir, chunks: cr, r: r}, nil
+}
+
+func (r *splitReader) Chunks() (ChunkReader, error) {
+	cr, err := r.b.Chunks()
+	if err != nil {
+		return nil, err
+	}
+	return &splitChunkReader{ChunkReader: cr, r: r}, nil
+}
+
+func (r *splitReader) Tombstones() (TombstoneReader, error) {
+	return r.b.Tombstones()
+}
+
+type splitIndexReader struct {
+	IndexReader
+	chunks ChunkReader
+	r      *splitReader
+}
+
+// Series returns the chunks of the series within the time range of the reader.
+// Series outside of the reader's shard have no chunks.
+func (ir *splitIndexReader) Series(ref uint64, lset *labels.Labels, chks *[]chunks.Meta) error {
+	if err := ir.IndexReader.Series(ref, lset, chks); err != nil {
+		return err
+	}
+	r := ir.r
+
+	for k := range r.clipped {
+		delete(r.clipped, k)
+	}
+	if r.shards > 0 && seriesShard(*lset, r.shards) != r.shard {
+		*chks = (*chks)[:0]
+		return nil
+	}
+	res := (*chks)[:0]
+
+	for _, c := range *chks {
+		if c.MaxTime < r.mint || c.MinTime > r.maxt {
+			continue
+		}
+		if c.MinTime < r.mint || c.MaxTime > r.maxt {
+			chk, err := ir.chunks.Chunk(c.Ref)
+			if err != nil {
+				return errors.Wrapf(err, "read chunk %d", c.Ref)
+			}
+			clipped, mint, maxt, err := clipChunk(chk, r.mint, r.maxt)
+			if err != nil {
+				return errors.Wrapf(err, "clip chunk %d", c.Ref)
+			}
+			if clipped.NumSamples() == 0 {
+				continue
+			}
+			r.clipped[c.Ref] = clipped
+			c.MinTime, c.MaxTime = mint, maxt
+		}
+		res = append(res, c)
+	}
+	*chks = res
+	return nil
+}
+
+func (ir *splitIndexReader) Close() error {
+	var merr MultiError
+	merr.Add(ir.IndexReader.Close())
+	merr.Add(ir.chunks.Close())
+	return merr.Err()
+}
+
+type splitChunkReader struct {
+	ChunkReader
+	r *splitReader
+}
+
+func (cr *splitChunkReader) Chunk(ref uint64) (chunkenc.Chunk, error) {
+	if c, ok := cr.r.clipped[ref]; ok {
+		return c, nil
+	}
+	return cr.ChunkReader.Chunk(ref)
+}
+
+// clipChunk re-encodes the samples of c within [mint, maxt] into a new chunk and
+// returns it along with the time range of its samples.
+func clipChunk(c chunkenc.Chunk, mint, maxt int64) (chunkenc.Chunk, int64, int64, error) {
+	res := newChunkLike(c)
+	app, err := res.Appender()
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	var (
+		cmint int64 = math.MaxInt64
+		cmaxt int64 = math.MinInt64
+	)
+	it := c.Iterator()
+	for it.Next() {
+		t, _ := it.At()
+		if t < mint || t > maxt {
+			continue
+		}
+		appendSample(app, it)
+
+		if t < cmint {
+			cmint = t
+		}
+		cmaxt = t
+	}
+	return res, cmint, cmaxt, it.Err()
+}
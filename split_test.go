@@ -0,0 +1,98 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/prometheus/tsdb/labels"
+	"github.com/prometheus/tsdb/testutil"
+)
+
+func TestSplitBlock(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "test")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	b := createPopulatedBlock(t, tmpdir, 10, 300)
+	defer b.Close()
+	orig := b.Meta()
+
+	q, err := NewBlockQuerier(b, math.MinInt64, math.MaxInt64)
+	testutil.Ok(t, err)
+	m := labels.NewMustRegexpMatcher("", ".*")
+	exp := query(t, q, m)
+	testutil.Ok(t, q.Close())
+
+	for _, c := range []struct {
+		mode SplitMode
+		n    int
+	}{
+		{mode: SplitByTime, n: 4},
+		{mode: SplitBySeries, n: 3},
+	} {
+		dest := filepath.Join(tmpdir, "split", strconv.Itoa(int(c.mode)))
+
+		ids, err := SplitBlock(nil, b.Dir(), dest, c.n, c.mode)
+		testutil.Ok(t, err)
+		testutil.Equals(t, c.n, len(ids))
+
+		var (
+			res     = map[string][]sample{}
+			samples uint64
+			series  uint64
+		)
+		for i, id := range ids {
+			sb, err := OpenBlock(filepath.Join(dest, id.String()), nil)
+			testutil.Ok(t, err)
+
+			meta := sb.Meta()
+			samples += meta.Stats.NumSamples
+			series += meta.Stats.NumSeries
+			testutil.Equals(t, orig.Compaction.Level, meta.Compaction.Level)
+			testutil.Equals(t, orig.Compaction.Sources, meta.Compaction.Sources)
+			testutil.Equals(t, 0, len(meta.Compaction.Parents))
+
+			if c.mode == SplitByTime && i > 0 {
+				prev, err := readMetaFile(filepath.Join(dest, ids[i-1].String()))
+				testutil.Ok(t, err)
+				testutil.Equals(t, prev.MaxTime, meta.MinTime)
+			}
+			q, err := NewBlockQuerier(sb, math.MinInt64, math.MaxInt64)
+			testutil.Ok(t, err)
+			for s, smpls := range query(t, q, m) {
+				res[s] = append(res[s], smpls...)
+			}
+			testutil.Ok(t, q.Close())
+			testutil.Ok(t, sb.Close())
+		}
+		testutil.Equals(t, orig.Stats.NumSamples, samples)
+		if c.mode == SplitBySeries {
+			testutil.Equals(t, orig.Stats.NumSeries, series)
+		}
+		testutil.Equals(t, exp, res)
+	}
+
+	// The new blocks would overlap with the original block.
+	_, err = SplitBlock(nil, b.Dir(), tmpdir, 2, SplitByTime)
+	testutil.NotOk(t, err)
+	// Blocks split by series overlap with each other.
+	_, err = SplitBlock(nil, b.Dir(), filepath.Join(tmpdir, "split", "0"), 2, SplitBySeries)
+	testutil.NotOk(t, err)
+}
@@ -0,0 +1,81 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// TimestampUnit is the unit of the int64 timestamps of samples since the Unix
+// epoch. The empty unit is the default of milliseconds.
+type TimestampUnit string
+
+// Supported timestamp units.
+const (
+	TimestampMilliseconds TimestampUnit = "ms"
+	TimestampNanoseconds  TimestampUnit = "ns"
+)
+
+// Duration returns the length of one unit.
+func (u TimestampUnit) Duration() time.Duration {
+	if u == TimestampNanoseconds {
+		return time.Nanosecond
+	}
+	return time.Millisecond
+}
+
+// FromDuration converts d into a number of units.
+func (u TimestampUnit) FromDuration(d time.Duration) int64 {
+	return int64(d / u.Duration())
+}
+
+// Now returns the current time in the unit.
+func (u TimestampUnit) Now() int64 {
+	return time.Now().UnixNano() / int64(u.Duration())
+}
+
+// Equal returns whether both units are the same, treating the empty unit as
+// milliseconds.
+func (u TimestampUnit) Equal(o TimestampUnit) bool {
+	return u.Duration() == o.Duration()
+}
+
+func (u TimestampUnit) String() string {
+	if u == "" {
+		return string(TimestampMilliseconds)
+	}
+	return string(u)
+}
+
+func (u TimestampUnit) validate() error {
+	switch u {
+	case "", TimestampMilliseconds, TimestampNanoseconds:
+		return nil
+	}
+	return errors.Errorf("unknown timestamp unit %q", string(u))
+}
+
+// checkTimestampUnits returns an error if the blocks do not all have the same
+// timestamp unit.
+func checkTimestampUnits(metas ...*BlockMeta) error {
+	for _, m := range metas[1:] {
+		if !m.TimestampUnit.Equal(metas[0].TimestampUnit) {
+			return errors.Errorf("block %s has timestamp unit %s but block %s has %s",
+				m.ULID, m.TimestampUnit, metas[0].ULID, metas[0].TimestampUnit)
+		}
+	}
+	return nil
+}
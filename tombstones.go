@@ -114,7 +114,9 @@ type Stone struct {
 }
 
 func readTombstones(dir string) (*memTombstones, error) {
-	b, err := ioutil.ReadFile(filepath.Join(dir, tombstoneFilename))
+	fn := filepath.Join(dir, tombstoneFilename)
+
+	b, err := ioutil.ReadFile(fn)
 	if os.IsNotExist(err) {
 		return NewMemTombstones(), nil
 	} else if err != nil {
@@ -122,15 +124,15 @@ func readTombstones(dir string) (*memTombstones, error) {
 	}
 
 	if len(b) < 5 {
-		return nil, errors.Wrap(errInvalidSize, "tombstones header")
+		return nil, &ErrCorrupt{File: fn, Reason: fmt.Sprintf("tombstones header exceeds size %d", len(b))}
 	}
 
 	d := &decbuf{b: b[:len(b)-4]} // 4 for the checksum.
 	if mg := d.be32(); mg != MagicTombstone {
-		return nil, fmt.Errorf("invalid magic number %x", mg)
+		return nil, &ErrCorrupt{File: fn, Reason: fmt.Sprintf("invalid magic number %x", mg)}
 	}
 	if flag := d.byte(); flag != tombstoneFormatV1 {
-		return nil, fmt.Errorf("invalid tombstone format %x", flag)
+		return nil, &ErrCorrupt{File: fn, Offset: 4, Reason: fmt.Sprintf("invalid tombstone format %x", flag)}
 	}
 
 	if d.err() != nil {
@@ -143,17 +145,19 @@ func readTombstones(dir string) (*memTombstones, error) {
 		return nil, errors.Wrap(err, "write to hash")
 	}
 	if binary.BigEndian.Uint32(b[len(b)-4:]) != hash.Sum32() {
-		return nil, errors.New("checksum did not match")
+		return nil, &ErrCorrupt{File: fn, Offset: int64(len(b) - 4), Reason: "checksum mismatch"}
 	}
 
 	stonesMap := NewMemTombstones()
 
 	for d.len() > 0 {
+		off := len(b) - 4 - d.len()
+
 		k := d.uvarint64()
 		mint := d.varint64()
 		maxt := d.varint64()
 		if d.err() != nil {
-			return nil, d.err()
+			return nil, &ErrCorrupt{File: fn, Offset: int64(off), Reason: d.err().Error()}
 		}
 
 		stonesMap.addInterval(k, Interval{mint, maxt})
@@ -0,0 +1,115 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/tsdb/chunks"
+	"github.com/prometheus/tsdb/labels"
+)
+
+// Tracer starts spans for operations on the read path. It allows attaching
+// tracing systems such as OpenTelemetry without depending on them directly.
+type Tracer interface {
+	// StartSpan starts a new span. The parent is nil for root spans.
+	StartSpan(name string, parent Span) Span
+}
+
+// Span is a single traced operation.
+type Span interface {
+	// SetAttribute annotates the span with a key-value pair.
+	SetAttribute(key string, value interface{})
+	// End completes the span.
+	End()
+}
+
+// Names of the spans started on the read path.
+const (
+	// SpanBlockQuery covers the lifetime of a querier against a single block.
+	// On completion it carries the number of series and chunks read along with
+	// the total time spent reading them from the index and chunk files.
+	SpanBlockQuery = "tsdb.block_query"
+	// SpanPostings covers resolving the postings of a Select call.
+	SpanPostings = "tsdb.postings"
+)
+
+// queryTrace accumulates the reads of a block querier into its span.
+// Series and chunks are read lazily and far too often to trace each of
+// them with a span of its own.
+type queryTrace struct {
+	tracer Tracer
+	span   Span
+
+	// Accessed atomically. Durations are in nanoseconds.
+	series, chunks                 int64
+	seriesDuration, chunksDuration int64
+}
+
+func newQueryTrace(tr Tracer, b BlockReader, mint, maxt int64) *queryTrace {
+	span := tr.StartSpan(SpanBlockQuery, nil)
+	span.SetAttribute("mint", mint)
+	span.SetAttribute("maxt", maxt)
+
+	if m, ok := b.(interface{ Meta() BlockMeta }); ok {
+		span.SetAttribute("block", m.Meta().ULID.String())
+	} else {
+		span.SetAttribute("block", "head")
+	}
+	return &queryTrace{tracer: tr, span: span}
+}
+
+func (t *queryTrace) startSpan(name string) Span {
+	return t.tracer.StartSpan(name, t.span)
+}
+
+func (t *queryTrace) end() {
+	t.span.SetAttribute("series", atomic.LoadInt64(&t.series))
+	t.span.SetAttribute("series_duration", time.Duration(atomic.LoadInt64(&t.seriesDuration)))
+	t.span.SetAttribute("chunks", atomic.LoadInt64(&t.chunks))
+	t.span.SetAttribute("chunks_duration", time.Duration(atomic.LoadInt64(&t.chunksDuration)))
+	t.span.End()
+}
+
+// tracingIndexReader records series reads in a query trace.
+type tracingIndexReader struct {
+	IndexReader
+	trace *queryTrace
+}
+
+func (r *tracingIndexReader) Series(ref uint64, lset *labels.Labels, chks *[]chunks.Meta) error {
+	start := time.Now()
+	err := r.IndexReader.Series(ref, lset, chks)
+
+	atomic.AddInt64(&r.trace.series, 1)
+	atomic.AddInt64(&r.trace.seriesDuration, int64(time.Since(start)))
+	return err
+}
+
+// tracingChunkReader records chunk reads in a query trace.
+type tracingChunkReader struct {
+	ChunkReader
+	trace *queryTrace
+}
+
+func (r *tracingChunkReader) Chunk(ref uint64) (chunkenc.Chunk, error) {
+	start := time.Now()
+	c, err := r.ChunkReader.Chunk(ref)
+
+	atomic.AddInt64(&r.trace.chunks, 1)
+	atomic.AddInt64(&r.trace.chunksDuration, int64(time.Since(start)))
+	return c, err
+}
@@ -0,0 +1,87 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/prometheus/tsdb/labels"
+	"github.com/prometheus/tsdb/testutil"
+)
+
+type mockTracer struct {
+	mtx   sync.Mutex
+	spans []*mockSpan
+}
+
+func (t *mockTracer) StartSpan(name string, parent Span) Span {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	s := &mockSpan{name: name, attrs: map[string]interface{}{}}
+	if parent != nil {
+		s.parent = parent.(*mockSpan)
+	}
+	t.spans = append(t.spans, s)
+	return s
+}
+
+type mockSpan struct {
+	name   string
+	parent *mockSpan
+	attrs  map[string]interface{}
+	ended  bool
+}
+
+func (s *mockSpan) SetAttribute(key string, value interface{}) { s.attrs[key] = value }
+func (s *mockSpan) End()                                       { s.ended = true }
+
+func TestQuerier_Tracing(t *testing.T) {
+	tr := &mockTracer{}
+
+	db, close := openTestDB(t, &Options{Tracer: tr})
+	defer close()
+	defer db.Close()
+
+	app := db.Appender()
+	for i := int64(0); i < 10; i++ {
+		_, err := app.Add(labels.FromStrings("a", "1"), i, 1)
+		testutil.Ok(t, err)
+		_, err = app.Add(labels.FromStrings("a", "2"), i, 2)
+		testutil.Ok(t, err)
+	}
+	testutil.Ok(t, app.Commit())
+
+	q, err := db.Querier(0, 10)
+	testutil.Ok(t, err)
+
+	res := query(t, q, labels.NewEqualMatcher("a", "1"))
+	testutil.Equals(t, 1, len(res))
+	testutil.Ok(t, q.Close())
+
+	testutil.Equals(t, 2, len(tr.spans))
+
+	block, postings := tr.spans[0], tr.spans[1]
+
+	testutil.Equals(t, SpanBlockQuery, block.name)
+	testutil.Assert(t, block.ended, "block span not ended")
+	testutil.Equals(t, "head", block.attrs["block"])
+	testutil.Equals(t, int64(1), block.attrs["series"])
+	testutil.Equals(t, int64(1), block.attrs["chunks"])
+
+	testutil.Equals(t, SpanPostings, postings.name)
+	testutil.Assert(t, postings.ended, "postings span not ended")
+	testutil.Assert(t, postings.parent == block, "postings span not a child of the block span")
+}
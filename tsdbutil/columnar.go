@@ -0,0 +1,102 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdbutil
+
+import (
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/labels"
+)
+
+// ColumnBatch holds consecutive samples of a single series as a column of
+// timestamps and a column of values. It is not an Apache Arrow record batch,
+// but consumers can copy each column into an Arrow array at once.
+type ColumnBatch struct {
+	Labels     labels.Labels
+	Timestamps []int64
+	Values     []float64
+}
+
+// Len returns the number of samples in the batch.
+func (b ColumnBatch) Len() int {
+	return len(b.Timestamps)
+}
+
+// ColumnarExporter converts the series of a SeriesSet into column batches.
+// Series with more samples than fit into a single batch are split across
+// consecutive batches with the same labels.
+type ColumnarExporter struct {
+	ss      tsdb.SeriesSet
+	maxRows int
+
+	lset labels.Labels
+	it   tsdb.SeriesIterator
+	cur  ColumnBatch
+	err  error
+}
+
+// NewColumnarExporter returns an exporter over the series of ss that emits
+// batches of at most maxRows samples.
+func NewColumnarExporter(ss tsdb.SeriesSet, maxRows int) *ColumnarExporter {
+	if maxRows <= 0 {
+		maxRows = 1
+	}
+	return &ColumnarExporter{ss: ss, maxRows: maxRows}
+}
+
+// Next advances the exporter to the next column batch.
+func (e *ColumnarExporter) Next() bool {
+	if e.err != nil {
+		return false
+	}
+	for {
+		if e.it == nil {
+			if !e.ss.Next() {
+				e.err = e.ss.Err()
+				return false
+			}
+			s := e.ss.At()
+			e.lset, e.it = s.Labels(), s.Iterator()
+		}
+		// Batches are handed out to consumers, which may retain them. Thus
+		// the columns are allocated anew for every batch and grow with the
+		// samples of the series instead of being sized for maxRows.
+		b := ColumnBatch{Labels: e.lset}
+		for b.Len() < e.maxRows && e.it.Next() {
+			t, v := e.it.At()
+			b.Timestamps = append(b.Timestamps, t)
+			b.Values = append(b.Values, v)
+		}
+		if err := e.it.Err(); err != nil {
+			e.err = err
+			return false
+		}
+		if b.Len() < e.maxRows {
+			e.it = nil
+		}
+		if b.Len() > 0 {
+			e.cur = b
+			return true
+		}
+	}
+}
+
+// At returns the current column batch.
+func (e *ColumnarExporter) At() ColumnBatch {
+	return e.cur
+}
+
+// Err returns the error that ended the export, if any.
+func (e *ColumnarExporter) Err() error {
+	return e.err
+}
@@ -0,0 +1,76 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdbutil
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/labels"
+	"github.com/prometheus/tsdb/testutil"
+)
+
+func TestColumnarExporter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_columnar")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := tsdb.Open(dir, nil, nil, nil)
+	testutil.Ok(t, err)
+	defer db.Close()
+
+	a, b := labels.FromStrings("a", "1"), labels.FromStrings("a", "2")
+
+	app := db.Appender()
+	for i := int64(0); i < 5; i++ {
+		_, err := app.Add(a, i, float64(i))
+		testutil.Ok(t, err)
+	}
+	_, err = app.Add(b, 10, 100)
+	testutil.Ok(t, err)
+	testutil.Ok(t, app.Commit())
+
+	q, err := db.Querier(0, 100)
+	testutil.Ok(t, err)
+	defer q.Close()
+
+	ss, err := q.Select(labels.NewMustRegexpMatcher("a", ".+"))
+	testutil.Ok(t, err)
+
+	var res []ColumnBatch
+	e := NewColumnarExporter(ss, 2)
+	for e.Next() {
+		res = append(res, e.At())
+	}
+	testutil.Ok(t, e.Err())
+
+	testutil.Equals(t, []ColumnBatch{
+		{Labels: a, Timestamps: []int64{0, 1}, Values: []float64{0, 1}},
+		{Labels: a, Timestamps: []int64{2, 3}, Values: []float64{2, 3}},
+		{Labels: a, Timestamps: []int64{4}, Values: []float64{4}},
+		{Labels: b, Timestamps: []int64{10}, Values: []float64{100}},
+	}, res)
+
+	// Columns are not sized for the maximum batch size.
+	ss, err = q.Select(labels.NewEqualMatcher("a", "2"))
+	testutil.Ok(t, err)
+
+	e = NewColumnarExporter(ss, 1<<30)
+	testutil.Assert(t, e.Next(), "no batch exported")
+	testutil.Assert(t, cap(e.At().Timestamps) < 1<<10, "timestamp column preallocated to %d", cap(e.At().Timestamps))
+	testutil.Assert(t, !e.Next(), "unexpected second batch")
+	testutil.Ok(t, e.Err())
+}
@@ -0,0 +1,287 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdbutil
+
+import (
+	"bufio"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/labels"
+)
+
+// ParseLineProtocol parses a single line of the InfluxDB line protocol.
+// Every numeric or boolean field becomes a series named after the measurement
+// and the field, joined by an underscore, with the tags as further labels.
+// Fields named "value" map to the measurement name alone. String fields are
+// skipped. The timestamp is given in units of precision and is converted to
+// milliseconds.
+func ParseLineProtocol(line string, precision time.Duration) ([]TimeSeries, error) {
+	parts := splitLineProtocol(line, ' ', true)
+	if len(parts) != 3 {
+		if len(parts) == 2 {
+			return nil, errors.New("missing timestamp")
+		}
+		return nil, errors.New("invalid number of sections")
+	}
+	ts, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse timestamp")
+	}
+	if precision >= time.Millisecond {
+		ts *= int64(precision / time.Millisecond)
+	} else {
+		ts /= int64(time.Millisecond / precision)
+	}
+
+	key := splitLineProtocol(parts[0], ',', false)
+	measurement := unescapeLineProtocol(key[0])
+	if measurement == "" {
+		return nil, errors.New("empty measurement")
+	}
+	var tags labels.Labels
+
+	for _, t := range key[1:] {
+		kv := splitLineProtocol(t, '=', false)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, errors.Errorf("invalid tag %q", t)
+		}
+		tags = append(tags, labels.Label{
+			Name:  sanitizeName(unescapeLineProtocol(kv[0]), false),
+			Value: unescapeLineProtocol(kv[1]),
+		})
+	}
+	var res []TimeSeries
+
+	for _, f := range splitLineProtocol(parts[1], ',', true) {
+		kv := splitLineProtocol(f, '=', true)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, errors.Errorf("invalid field %q", f)
+		}
+		// String values cannot be represented as samples.
+		if kv[1][0] == '"' {
+			continue
+		}
+		v, err := parseFieldValue(kv[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid field %q", f)
+		}
+		name := measurement
+		if field := unescapeLineProtocol(kv[0]); field != "value" {
+			name += "_" + field
+		}
+		lset := make(labels.Labels, 0, len(tags)+1)
+		lset = append(lset, labels.Label{Name: "__name__", Value: sanitizeName(name, true)})
+		lset = append(lset, tags...)
+		sort.Sort(lset)
+
+		res = append(res, TimeSeries{Labels: lset, Samples: []Sample{{T: ts, V: v}}})
+	}
+	return res, nil
+}
+
+func parseFieldValue(s string) (float64, error) {
+	switch s {
+	case "t", "T", "true", "True", "TRUE":
+		return 1, nil
+	case "f", "F", "false", "False", "FALSE":
+		return 0, nil
+	}
+	switch s[len(s)-1] {
+	case 'i':
+		v, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+		return float64(v), err
+	case 'u':
+		v, err := strconv.ParseUint(s[:len(s)-1], 10, 64)
+		return float64(v), err
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+// splitLineProtocol splits s at all occurrences of sep that are neither
+// escaped by a backslash nor, if quoted is set, within double quotes.
+func splitLineProtocol(s string, sep byte, quoted bool) []string {
+	var (
+		res      []string
+		start    int
+		inQuotes bool
+	)
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\':
+			i++
+		case c == '"' && quoted:
+			inQuotes = !inQuotes
+		case c == sep && !inQuotes:
+			res = append(res, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(res, s[start:])
+}
+
+// unescapeLineProtocol removes the backslashes escaping commas, spaces and
+// equal signs.
+func unescapeLineProtocol(s string) string {
+	if strings.IndexByte(s, '\\') < 0 {
+		return s
+	}
+	b := make([]byte, 0, len(s))
+
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			switch s[i+1] {
+			case ',', ' ', '=', '\\':
+				i++
+			}
+		}
+		b = append(b, s[i])
+	}
+	return string(b)
+}
+
+// sanitizeName replaces all characters that are invalid in metric names, or
+// label names if metric is false, with underscores.
+func sanitizeName(s string, metric bool) string {
+	b := []byte(s)
+
+	for i, c := range b {
+		valid := c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' ||
+			(c >= '0' && c <= '9' && i > 0) || (c == ':' && metric)
+		if !valid {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+// ImportLineProtocol backfills the samples of InfluxDB line protocol read from
+// r into new blocks in dir. Timestamps are given in units of precision. The
+// blocks are aligned to and cover at most blockDuration milliseconds.
+// All samples are buffered in memory before writing the blocks. The imported
+// range must not overlap with blocks that already exist in dir.
+func ImportLineProtocol(logger log.Logger, r io.Reader, dir string, blockDuration int64, precision time.Duration) ([]ulid.ULID, error) {
+	if blockDuration <= 0 {
+		return nil, errors.Errorf("invalid block duration %d", blockDuration)
+	}
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	// Series of each block keyed by their labels.
+	blocks := map[int64]map[string]*TimeSeries{}
+
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		series, err := ParseLineProtocol(line, precision)
+		if err != nil {
+			return nil, errors.Wrapf(err, "line %d", n)
+		}
+		for _, s := range series {
+			t := s.Samples[0].T
+			mint := t - t%blockDuration
+			if t < 0 && t%blockDuration != 0 {
+				mint -= blockDuration
+			}
+			b, ok := blocks[mint]
+			if !ok {
+				b = map[string]*TimeSeries{}
+				blocks[mint] = b
+			}
+			k := s.Labels.String()
+			if cur, ok := b[k]; ok {
+				cur.Samples = append(cur.Samples, s.Samples...)
+			} else {
+				s := s
+				b[k] = &s
+			}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, errors.Wrap(err, "read input")
+	}
+
+	mints := make([]int64, 0, len(blocks))
+	for mint := range blocks {
+		mints = append(mints, mint)
+	}
+	sort.Slice(mints, func(i, j int) bool { return mints[i] < mints[j] })
+
+	c, err := tsdb.NewLeveledCompactor(nil, logger, []int64{blockDuration}, nil)
+	if err != nil {
+		return nil, err
+	}
+	var ids []ulid.ULID
+
+	for _, mint := range mints {
+		id, err := writeBlock(logger, c, dir, blocks[mint], mint, mint+blockDuration)
+		if err != nil {
+			return ids, errors.Wrapf(err, "write block for %d", mint)
+		}
+		ids = append(ids, id)
+
+		// Free the samples of written blocks early.
+		delete(blocks, mint)
+	}
+	return ids, nil
+}
+
+func writeBlock(logger log.Logger, c *tsdb.LeveledCompactor, dir string, series map[string]*TimeSeries, mint, maxt int64) (ulid.ULID, error) {
+	// The head only accepts samples within half its chunk range of the most
+	// recent one. Doubling it allows the full block range.
+	head, err := tsdb.NewHead(nil, logger, nil, 2*(maxt-mint))
+	if err != nil {
+		return ulid.ULID{}, err
+	}
+	defer head.Close()
+
+	for _, s := range series {
+		// Samples must be in order and the last one wins for equal timestamps.
+		sort.SliceStable(s.Samples, func(i, j int) bool { return s.Samples[i].T < s.Samples[j].T })
+
+		app := head.Appender()
+		var ref uint64
+
+		for i, smpl := range s.Samples {
+			if i+1 < len(s.Samples) && s.Samples[i+1].T == smpl.T {
+				continue
+			}
+			if ref == 0 {
+				ref, err = app.Add(s.Labels, smpl.T, smpl.V)
+			} else {
+				err = app.AddFast(ref, smpl.T, smpl.V)
+			}
+			if err != nil {
+				app.Rollback()
+				return ulid.ULID{}, errors.Wrapf(err, "add sample for %s", s.Labels)
+			}
+		}
+		if err := app.Commit(); err != nil {
+			return ulid.ULID{}, err
+		}
+	}
+	return c.Write(dir, head, mint, maxt, nil)
+}
@@ -0,0 +1,126 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdbutil
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/labels"
+	"github.com/prometheus/tsdb/testutil"
+)
+
+func TestParseLineProtocol(t *testing.T) {
+	cases := []struct {
+		line string
+		res  []TimeSeries
+		err  bool
+	}{
+		{
+			line: `cpu,host=a,region=eu-west usage=0.5,cores=4i,up=true,name="x y" 1500000000000000000`,
+			res: []TimeSeries{
+				{
+					Labels:  labels.FromStrings("__name__", "cpu_usage", "host", "a", "region", "eu-west"),
+					Samples: []Sample{{T: 1500000000000, V: 0.5}},
+				},
+				{
+					Labels:  labels.FromStrings("__name__", "cpu_cores", "host", "a", "region", "eu-west"),
+					Samples: []Sample{{T: 1500000000000, V: 4}},
+				},
+				{
+					Labels:  labels.FromStrings("__name__", "cpu_up", "host", "a", "region", "eu-west"),
+					Samples: []Sample{{T: 1500000000000, V: 1}},
+				},
+			},
+		},
+		{
+			// Escaped characters and names invalid in Prometheus.
+			line: `disk\ io,mount\=point=/var\,lib value=2u 1500000000000000000`,
+			res: []TimeSeries{
+				{
+					Labels:  labels.FromStrings("__name__", "disk_io", "mount_point", "/var,lib"),
+					Samples: []Sample{{T: 1500000000000, V: 2}},
+				},
+			},
+		},
+		{line: `cpu usage=1`, err: true},
+		{line: `cpu usage=x 1`, err: true},
+		{line: `cpu,host usage=1 1`, err: true},
+	}
+	for _, c := range cases {
+		res, err := ParseLineProtocol(c.line, time.Nanosecond)
+		if c.err {
+			testutil.NotOk(t, err)
+			continue
+		}
+		testutil.Ok(t, err)
+		testutil.Equals(t, c.res, res)
+	}
+
+	res, err := ParseLineProtocol(`cpu usage=1 1500000000`, time.Second)
+	testutil.Ok(t, err)
+	testutil.Equals(t, int64(1500000000000), res[0].Samples[0].T)
+}
+
+func TestImportLineProtocol(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_import")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	// Samples out of order and across two blocks.
+	input := `
+# comment
+cpu,host=a usage=3 3000
+cpu,host=a usage=1 1000
+cpu,host=b usage=5 1000
+
+cpu,host=a usage=2 2000
+cpu,host=a usage=4 12000
+`
+	ids, err := ImportLineProtocol(nil, strings.NewReader(input), dir, 10000, time.Millisecond)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 2, len(ids))
+
+	db, err := tsdb.Open(dir, nil, nil, nil)
+	testutil.Ok(t, err)
+	defer db.Close()
+
+	testutil.Equals(t, 2, len(db.Blocks()))
+	testutil.Equals(t, int64(0), db.Blocks()[0].Meta().MinTime)
+	testutil.Equals(t, int64(10000), db.Blocks()[1].Meta().MinTime)
+
+	q, err := db.Querier(0, 20000)
+	testutil.Ok(t, err)
+	defer q.Close()
+
+	ss, err := q.Select(labels.NewEqualMatcher("host", "a"))
+	testutil.Ok(t, err)
+	testutil.Assert(t, ss.Next(), "missing series")
+	testutil.Equals(t, labels.FromStrings("__name__", "cpu_usage", "host", "a"), ss.At().Labels())
+
+	var res []Sample
+	it := ss.At().Iterator()
+	for it.Next() {
+		t, v := it.At()
+		res = append(res, Sample{T: t, V: v})
+	}
+	testutil.Ok(t, it.Err())
+	testutil.Equals(t, []Sample{{1000, 1}, {2000, 2}, {3000, 3}, {12000, 4}}, res)
+	testutil.Assert(t, !ss.Next(), "unexpected series")
+	testutil.Ok(t, ss.Err())
+}
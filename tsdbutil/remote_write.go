@@ -0,0 +1,262 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdbutil
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/labels"
+)
+
+// TimeSeries is a series of a remote write request.
+type TimeSeries struct {
+	Labels  labels.Labels
+	Samples []Sample
+}
+
+// Sample is a single sample of a remote write request.
+type Sample struct {
+	T int64
+	V float64
+}
+
+// The messages below are wire-compatible with prometheus.WriteRequest and the
+// types it uses in Prometheus' prompb/remote.proto and prompb/types.proto.
+// Fields the receiver does not use, e.g. metadata, are skipped.
+
+type writeRequest struct {
+	Timeseries []*writeSeries `protobuf:"bytes,1,rep,name=timeseries,proto3" json:"timeseries,omitempty"`
+}
+
+func (m *writeRequest) Reset()         { *m = writeRequest{} }
+func (m *writeRequest) String() string { return proto.CompactTextString(m) }
+func (*writeRequest) ProtoMessage()    {}
+
+type writeSeries struct {
+	Labels  []*writeLabel  `protobuf:"bytes,1,rep,name=labels,proto3" json:"labels,omitempty"`
+	Samples []*writeSample `protobuf:"bytes,2,rep,name=samples,proto3" json:"samples,omitempty"`
+}
+
+func (m *writeSeries) Reset()         { *m = writeSeries{} }
+func (m *writeSeries) String() string { return proto.CompactTextString(m) }
+func (*writeSeries) ProtoMessage()    {}
+
+type writeLabel struct {
+	Name  string `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Value string `protobuf:"bytes,2,opt,name=value,proto3" json:"value,omitempty"`
+}
+
+func (m *writeLabel) Reset()         { *m = writeLabel{} }
+func (m *writeLabel) String() string { return proto.CompactTextString(m) }
+func (*writeLabel) ProtoMessage()    {}
+
+type writeSample struct {
+	Value     float64 `protobuf:"fixed64,1,opt,name=value,proto3" json:"value,omitempty"`
+	Timestamp int64   `protobuf:"varint,2,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+}
+
+func (m *writeSample) Reset()         { *m = writeSample{} }
+func (m *writeSample) String() string { return proto.CompactTextString(m) }
+func (*writeSample) ProtoMessage()    {}
+
+// DecodeWriteRequest decodes the series of a Prometheus remote write request.
+// The request must already be decompressed, i.e. b is the plain protobuf
+// encoding of a prometheus.WriteRequest message.
+func DecodeWriteRequest(b []byte) ([]TimeSeries, error) {
+	var req writeRequest
+
+	if err := proto.Unmarshal(b, &req); err != nil {
+		return nil, err
+	}
+	res := make([]TimeSeries, 0, len(req.Timeseries))
+
+	for _, ts := range req.Timeseries {
+		s := TimeSeries{
+			Labels:  make(labels.Labels, 0, len(ts.Labels)),
+			Samples: make([]Sample, 0, len(ts.Samples)),
+		}
+		for _, l := range ts.Labels {
+			s.Labels = append(s.Labels, labels.Label{Name: l.Name, Value: l.Value})
+		}
+		for _, smpl := range ts.Samples {
+			s.Samples = append(s.Samples, Sample{T: smpl.Timestamp, V: smpl.Value})
+		}
+		s.Labels = labels.New(s.Labels...)
+		res = append(res, s)
+	}
+	return res, nil
+}
+
+// Appendable allows creating appenders.
+type Appendable interface {
+	Appender() tsdb.Appender
+}
+
+// WriteError is returned if some samples of a write were rejected by the storage.
+// All other samples were appended successfully.
+type WriteError struct {
+	OutOfOrder  int
+	OutOfBounds int
+	Duplicate   int
+}
+
+func (e *WriteError) Error() string {
+	return fmt.Sprintf("rejected samples: %d out of order, %d out of bounds, %d duplicate",
+		e.OutOfOrder, e.OutOfBounds, e.Duplicate)
+}
+
+// Receiver appends the series of remote write requests to a storage. It caches
+// series references across requests. It is safe for concurrent use.
+type Receiver struct {
+	app Appendable
+
+	mtx sync.Mutex
+	// References used in the current and the previous expiry interval.
+	// References unused for a whole interval are dropped, so that those of
+	// series that no longer receive samples do not accumulate.
+	refs, prevRefs map[uint64]receiverRef
+	rotated        time.Time
+}
+
+// receiverRefExpiry is the interval after which unused series references are
+// dropped by a Receiver.
+const receiverRefExpiry = time.Hour
+
+type receiverRef struct {
+	ref  uint64
+	lset labels.Labels
+}
+
+// NewReceiver returns a new Receiver appending to app.
+func NewReceiver(app Appendable) *Receiver {
+	return &Receiver{
+		app:      app,
+		refs:     map[uint64]receiverRef{},
+		prevRefs: map[uint64]receiverRef{},
+		rotated:  time.Now(),
+	}
+}
+
+// Receive decodes a decompressed remote write request and writes its series.
+func (r *Receiver) Receive(b []byte) error {
+	series, err := DecodeWriteRequest(b)
+	if err != nil {
+		return errors.Wrap(err, "decode write request")
+	}
+	return r.Write(series)
+}
+
+// Write appends the samples of all series and commits them. Samples rejected
+// because they are out of order, out of bounds, or duplicate timestamps with
+// different values are skipped and reported in a *WriteError. On any other
+// error nothing is committed.
+func (r *Receiver) Write(series []TimeSeries) error {
+	var (
+		app  = r.app.Appender()
+		werr WriteError
+	)
+	r.expireRefs(time.Now())
+
+	for _, s := range series {
+		ref, ok := r.getRef(s.Labels)
+
+		for _, smpl := range s.Samples {
+			var err error
+			if ok {
+				err = app.AddFast(ref, smpl.T, smpl.V)
+			}
+			// The series of the cached reference may have been removed.
+			if ok && errors.Cause(err) == tsdb.ErrNotFound {
+				ok = false
+				r.deleteRef(s.Labels)
+			}
+			if !ok {
+				ref, err = app.Add(s.Labels, smpl.T, smpl.V)
+				if err == nil && ref != 0 {
+					ok = true
+					r.setRef(s.Labels, ref)
+				}
+			}
+			switch errors.Cause(err) {
+			case nil:
+			case tsdb.ErrOutOfOrderSample:
+				werr.OutOfOrder++
+			case tsdb.ErrOutOfBounds:
+				werr.OutOfBounds++
+			case tsdb.ErrAmendSample:
+				werr.Duplicate++
+			default:
+				app.Rollback()
+				return errors.Wrapf(err, "append sample for series %s", s.Labels)
+			}
+		}
+	}
+	if err := app.Commit(); err != nil {
+		return errors.Wrap(err, "commit")
+	}
+	if werr != (WriteError{}) {
+		return &werr
+	}
+	return nil
+}
+
+func (r *Receiver) getRef(lset labels.Labels) (uint64, bool) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	h := lset.Hash()
+
+	e, ok := r.refs[h]
+	if !ok {
+		// References used again are kept for another interval.
+		if e, ok = r.prevRefs[h]; ok {
+			delete(r.prevRefs, h)
+			r.refs[h] = e
+		}
+	}
+	if !ok || !e.lset.Equals(lset) {
+		return 0, false
+	}
+	return e.ref, true
+}
+
+func (r *Receiver) setRef(lset labels.Labels, ref uint64) {
+	r.mtx.Lock()
+	r.refs[lset.Hash()] = receiverRef{ref: ref, lset: lset}
+	r.mtx.Unlock()
+}
+
+func (r *Receiver) deleteRef(lset labels.Labels) {
+	r.mtx.Lock()
+	delete(r.refs, lset.Hash())
+	r.mtx.Unlock()
+}
+
+// expireRefs drops the references that were not used during the previous
+// expiry interval once the current one is over.
+func (r *Receiver) expireRefs(now time.Time) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if now.Sub(r.rotated) < receiverRefExpiry {
+		return
+	}
+	r.prevRefs, r.refs = r.refs, map[uint64]receiverRef{}
+	r.rotated = now
+}
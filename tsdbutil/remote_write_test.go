@@ -0,0 +1,128 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdbutil
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/labels"
+	"github.com/prometheus/tsdb/testutil"
+)
+
+// encodeWriteRequest encodes series as a protobuf prometheus.WriteRequest.
+func encodeWriteRequest(t *testing.T, series []TimeSeries) []byte {
+	var req writeRequest
+
+	for _, s := range series {
+		ts := &writeSeries{}
+		for _, l := range s.Labels {
+			ts.Labels = append(ts.Labels, &writeLabel{Name: l.Name, Value: l.Value})
+		}
+		for _, smpl := range s.Samples {
+			ts.Samples = append(ts.Samples, &writeSample{Timestamp: smpl.T, Value: smpl.V})
+		}
+		req.Timeseries = append(req.Timeseries, ts)
+	}
+	b, err := proto.Marshal(&req)
+	testutil.Ok(t, err)
+
+	// Unknown fields such as metadata must be skipped.
+	return append(b, 0x1a, 0x08, 'm', 'e', 't', 'a', 'd', 'a', 't', 'a')
+}
+
+func TestDecodeWriteRequest(t *testing.T) {
+	series := []TimeSeries{
+		{
+			Labels:  labels.FromStrings("__name__", "up", "job", "a"),
+			Samples: []Sample{{T: 1, V: 1}, {T: 2, V: -0.5}},
+		},
+		{
+			Labels:  labels.FromStrings("__name__", "up", "job", "b"),
+			Samples: []Sample{{T: -1, V: math.MaxFloat64}},
+		},
+	}
+	res, err := DecodeWriteRequest(encodeWriteRequest(t, series))
+	testutil.Ok(t, err)
+	testutil.Equals(t, series, res)
+
+	_, err = DecodeWriteRequest([]byte{0x0a, 0x05, 0x01})
+	testutil.NotOk(t, err)
+}
+
+func TestReceiver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_receiver")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := tsdb.Open(dir, nil, nil, nil)
+	testutil.Ok(t, err)
+	defer db.Close()
+
+	r := NewReceiver(db)
+
+	lset := labels.FromStrings("__name__", "up", "job", "a")
+	testutil.Ok(t, r.Receive(encodeWriteRequest(t, []TimeSeries{
+		{Labels: lset, Samples: []Sample{{T: 10, V: 1}, {T: 20, V: 1}}},
+	})))
+	_, ok := r.getRef(lset)
+	testutil.Assert(t, ok, "series reference not cached")
+
+	// Rejected samples are reported while valid ones are still appended.
+	err = r.Write([]TimeSeries{
+		{Labels: lset, Samples: []Sample{{T: 5, V: 1}, {T: 20, V: 2}, {T: 30, V: 1}}},
+	})
+	werr, ok := err.(*WriteError)
+	testutil.Assert(t, ok, "unexpected error %v", err)
+	testutil.Equals(t, WriteError{OutOfOrder: 1, Duplicate: 1}, *werr)
+
+	q, err := db.Querier(0, 100)
+	testutil.Ok(t, err)
+	defer q.Close()
+
+	ss, err := q.Select(labels.NewEqualMatcher("job", "a"))
+	testutil.Ok(t, err)
+	testutil.Assert(t, ss.Next(), "missing series")
+
+	var ts []int64
+	it := ss.At().Iterator()
+	for it.Next() {
+		t, _ := it.At()
+		ts = append(ts, t)
+	}
+	testutil.Ok(t, it.Err())
+	testutil.Equals(t, []int64{10, 20, 30}, ts)
+
+	// References unused for a whole expiry interval are dropped.
+	r.expireRefs(time.Now().Add(receiverRefExpiry))
+	_, ok = r.getRef(lset)
+	testutil.Assert(t, ok, "used series reference dropped")
+
+	r.expireRefs(time.Now().Add(2 * receiverRefExpiry))
+	r.expireRefs(time.Now().Add(3 * receiverRefExpiry))
+	_, ok = r.getRef(lset)
+	testutil.Assert(t, !ok, "unused series reference kept")
+
+	// References of series removed from the head are dropped.
+	r.setRef(lset, 1<<40)
+	testutil.Ok(t, r.Write([]TimeSeries{{Labels: lset, Samples: []Sample{{T: 40, V: 1}}}}))
+	ref, ok := r.getRef(lset)
+	testutil.Assert(t, ok, "series reference not cached")
+	testutil.Assert(t, ref != 1<<40, "stale series reference kept")
+}
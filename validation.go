@@ -0,0 +1,198 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/tsdb/labels"
+)
+
+// Reasons for which label sets are rejected by a LabelValidation.
+var (
+	// ErrLabelsNotSorted is returned if label names are not in ascending order.
+	ErrLabelsNotSorted = errors.New("label names not sorted")
+	// ErrDuplicateLabelName is returned if a label name occurs more than once.
+	ErrDuplicateLabelName = errors.New("duplicate label name")
+	// ErrEmptyLabelName is returned for labels with an empty name.
+	ErrEmptyLabelName = errors.New("empty label name")
+	// ErrMissingMetricName is returned if the metric name is required but not set.
+	ErrMissingMetricName = errors.New("missing metric name")
+	// ErrInvalidUTF8 is returned if a label name or value is not valid UTF-8.
+	ErrInvalidUTF8 = errors.New("invalid UTF-8")
+	// ErrInvalidLabelChar is returned if a label name holds a character that is
+	// not allowed.
+	ErrInvalidLabelChar = errors.New("invalid character in label name")
+	// ErrMissingLabel is returned if a label required by the schema of the
+	// metric is not set.
+	ErrMissingLabel = errors.New("missing required label")
+	// ErrLabelNotAllowed is returned if a label is not allowed by the schema
+	// of the metric.
+	ErrLabelNotAllowed = errors.New("label not allowed")
+)
+
+const metricNameLabel = "__name__"
+
+// LabelValidation configures the checks applied to the label sets of new series.
+// Label names must always be sorted, unique and non-empty, and all names and
+// values must be valid UTF-8.
+type LabelValidation struct {
+	// RequireMetricName rejects series without a non-empty metric name.
+	RequireMetricName bool
+	// AllowedNameChar, if set, reports whether r may appear at position i of
+	// a label name.
+	AllowedNameChar func(i int, r rune) bool
+	// Schemas constrain the labels of the series of the metrics they are
+	// keyed by.
+	Schemas map[string]MetricSchema
+}
+
+// MetricSchema constrains the label names of the series of a metric.
+type MetricSchema struct {
+	// Required lists the labels all series of the metric must have.
+	Required []string
+	// Allowed, if not empty, lists the labels series may have in addition to
+	// the metric name and the required labels.
+	Allowed []string
+	// DropDisallowed removes labels that are not allowed from series instead
+	// of rejecting them. Series missing required labels are always rejected.
+	DropDisallowed bool
+}
+
+// conform applies the schema of the metric of lset. It returns the labels
+// with disallowed ones removed if the schema drops them, and whether any were
+// removed. Nonconforming label sets fail with an *InvalidLabelsError.
+func (s *MetricSchema) conform(lset labels.Labels) (labels.Labels, bool, error) {
+	for _, n := range s.Required {
+		if lset.Get(n) == "" {
+			return nil, false, &InvalidLabelsError{Labels: lset, Label: n, Reason: ErrMissingLabel}
+		}
+	}
+	if len(s.Allowed) == 0 {
+		return lset, false, nil
+	}
+	allowed := func(n string) bool {
+		return n == metricNameLabel || containsString(s.Required, n) || containsString(s.Allowed, n)
+	}
+	var res labels.Labels
+
+	for i, l := range lset {
+		if allowed(l.Name) {
+			if res != nil {
+				res = append(res, l)
+			}
+			continue
+		}
+		if !s.DropDisallowed {
+			return nil, false, &InvalidLabelsError{Labels: lset, Label: l.Name, Reason: ErrLabelNotAllowed}
+		}
+		if res == nil {
+			res = append(make(labels.Labels, 0, len(lset)), lset[:i]...)
+		}
+	}
+	if res == nil {
+		return lset, false, nil
+	}
+	return res, true, nil
+}
+
+// PrometheusNameChar allows the characters of label names accepted by Prometheus.
+func PrometheusNameChar(i int, r rune) bool {
+	return r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (i > 0 && r >= '0' && r <= '9')
+}
+
+// InvalidLabelsError is returned by appenders for label sets that fail validation.
+type InvalidLabelsError struct {
+	Labels labels.Labels
+	// Label is the name of the offending label, if any.
+	Label string
+	// Reason is one of the errors listed for LabelValidation.
+	Reason error
+}
+
+func (e *InvalidLabelsError) Error() string {
+	if e.Label == "" {
+		return fmt.Sprintf("invalid label set %s: %s", e.Labels, e.Reason)
+	}
+	return fmt.Sprintf("invalid label set %s: %s: %q", e.Labels, e.Reason, e.Label)
+}
+
+// validate applies the label validation of the head to the labels of a new
+// series and returns the labels the series is stored with and whether they
+// differ from lset. Relabeled series may exist already, so callers count them
+// once they created the series.
+func (h *Head) validate(lset labels.Labels) (labels.Labels, bool, error) {
+	v := h.validation
+	if err := v.validate(lset); err != nil {
+		return nil, false, err
+	}
+	if v == nil || len(v.Schemas) == 0 {
+		return lset, false, nil
+	}
+	s, ok := v.Schemas[lset.Get(metricNameLabel)]
+	if !ok {
+		return lset, false, nil
+	}
+	res, relabeled, err := s.conform(lset)
+	if err != nil {
+		h.metrics.schemaViolations.WithLabelValues("rejected").Inc()
+		return nil, false, err
+	}
+	return res, relabeled, nil
+}
+
+// validate returns an *InvalidLabelsError if lset fails validation. A nil
+// validation accepts all label sets.
+func (v *LabelValidation) validate(lset labels.Labels) error {
+	if v == nil {
+		return nil
+	}
+	invalid := func(l string, reason error) error {
+		return &InvalidLabelsError{Labels: lset, Label: l, Reason: reason}
+	}
+	hasName := false
+
+	for i, l := range lset {
+		if l.Name == "" {
+			return invalid("", ErrEmptyLabelName)
+		}
+		if i > 0 {
+			switch prev := lset[i-1].Name; {
+			case l.Name == prev:
+				return invalid(l.Name, ErrDuplicateLabelName)
+			case l.Name < prev:
+				return invalid(l.Name, ErrLabelsNotSorted)
+			}
+		}
+		if !utf8.ValidString(l.Name) || !utf8.ValidString(l.Value) {
+			return invalid(l.Name, ErrInvalidUTF8)
+		}
+		if v.AllowedNameChar != nil {
+			for j, r := range l.Name {
+				if !v.AllowedNameChar(j, r) {
+					return invalid(l.Name, ErrInvalidLabelChar)
+				}
+			}
+		}
+		if l.Name == metricNameLabel && l.Value != "" {
+			hasName = true
+		}
+	}
+	if v.RequireMetricName && !hasName {
+		return invalid("", ErrMissingMetricName)
+	}
+	return nil
+}
@@ -139,6 +139,15 @@ type RefSample struct {
 	series *memSeries
 }
 
+// RefIntSample is a timestamp/value pair of a series storing integer values.
+type RefIntSample struct {
+	Ref uint64
+	T   int64
+	V   int64
+
+	series *memSeries
+}
+
 // segmentFile wraps a file object of a segment and tracks the highest timestamp
 // it contains. During WAL truncating, all segments with no higher timestamp than
 // the truncation threshold can be compacted.
@@ -1138,7 +1147,8 @@ func (r *walReader) decodeSeries(flag byte, b []byte, res *[]RefSeries) error {
 	for len(dec.b) > 0 && dec.err() == nil {
 		ref := dec.be64()
 
-		lset := make(labels.Labels, dec.uvarint())
+		// Label names and values take at least a byte each.
+		lset := make(labels.Labels, dec.uvarintLen(2))
 
 		for i := range lset {
 			lset[i].Name = dec.uvarintStr()
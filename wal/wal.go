@@ -39,6 +39,9 @@ const (
 	defaultSegmentSize = 128 * 1024 * 1024 // 128 MB
 	pageSize           = 32 * 1024         // 32KB
 	recordHeaderSize   = 7
+	// corruptedDirPrefix is the prefix of the directories within the WAL
+	// directory that Repair moves damaged segments into.
+	corruptedDirPrefix = "corrupted."
 )
 
 // The table gets initialized with sync.Once but may still cause a race
@@ -164,6 +167,7 @@ type WAL struct {
 	pageCompletions prometheus.Counter
 	truncateFail    prometheus.Counter
 	truncateTotal   prometheus.Counter
+	repairDiscarded prometheus.Counter
 }
 
 // New returns a new WAL over the given directory.
@@ -211,8 +215,12 @@ func NewSize(logger log.Logger, reg prometheus.Registerer, dir string, segmentSi
 		Name: "prometheus_tsdb_wal_truncations_total",
 		Help: "Total number of WAL truncations attempted.",
 	})
+	w.repairDiscarded = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "prometheus_tsdb_wal_repair_discarded_bytes_total",
+		Help: "Total number of bytes of WAL segments discarded by corruption repairs.",
+	})
 	if reg != nil {
-		reg.MustRegister(w.fsyncDuration, w.pageFlushes, w.pageCompletions, w.truncateFail, w.truncateTotal)
+		reg.MustRegister(w.fsyncDuration, w.pageFlushes, w.pageCompletions, w.truncateFail, w.truncateTotal, w.repairDiscarded)
 	}
 
 	_, j, err := w.Segments()
@@ -264,7 +272,9 @@ Loop:
 }
 
 // Repair attempts to repair the WAL based on the error.
-// It discards all data after the corruption.
+// It discards all data after the corruption. The damaged segments are moved
+// aside into a directory within the WAL directory instead of being deleted,
+// so that the discarded data can still be inspected.
 func (w *WAL) Repair(origErr error) error {
 	// We could probably have a mode that only discards torn records right around
 	// the corruption to preserve as data much as possible.
@@ -289,14 +299,20 @@ func (w *WAL) Repair(origErr error) error {
 	if err != nil {
 		return errors.Wrap(err, "list segments")
 	}
-	level.Warn(w.logger).Log("msg", "deleting all segments behind corruption", "segment", cerr.Segment)
+	aside := filepath.Join(w.dir, fmt.Sprintf("%s%d", corruptedDirPrefix, time.Now().UnixNano()))
+	if err := os.MkdirAll(aside, 0777); err != nil {
+		return errors.Wrap(err, "create directory for corrupted segments")
+	}
+	level.Warn(w.logger).Log("msg", "moving all segments behind corruption aside", "segment", cerr.Segment, "dir", aside)
+
+	var discarded int64
 
 	for _, s := range segs {
 		if s.index <= cerr.Segment {
 			continue
 		}
 		if w.segment.i == s.index {
-			// The active segment needs to be removed,
+			// The active segment needs to be moved,
 			// close it first (Windows!). Can be closed safely
 			// as we set the current segment to repaired file
 			// below.
@@ -304,19 +320,26 @@ func (w *WAL) Repair(origErr error) error {
 				return errors.Wrap(err, "close active segment")
 			}
 		}
-		if err := os.Remove(filepath.Join(w.dir, s.name)); err != nil {
-			return errors.Wrapf(err, "delete segment:%v", s.index)
+		fn := filepath.Join(w.dir, s.name)
+		if fi, err := os.Stat(fn); err == nil {
+			discarded += fi.Size()
+		}
+		if err := fileutil.Rename(fn, filepath.Join(aside, s.name)); err != nil {
+			return errors.Wrapf(err, "move segment:%v", s.index)
 		}
 	}
 	// Regardless of the corruption offset, no record reaches into the previous segment.
-	// So we can safely repair the WAL by removing the segment and re-inserting all
+	// So we can safely repair the WAL by moving the segment aside and re-inserting all
 	// its records up to the corruption.
 	level.Warn(w.logger).Log("msg", "rewrite corrupted segment", "segment", cerr.Segment)
 
 	fn := SegmentName(w.dir, cerr.Segment)
-	tmpfn := fn + ".repair"
+	asidefn := filepath.Join(aside, filepath.Base(fn))
 
-	if err := fileutil.Rename(fn, tmpfn); err != nil {
+	if fi, err := os.Stat(fn); err == nil && fi.Size() > cerr.Offset {
+		discarded += fi.Size() - cerr.Offset
+	}
+	if err := fileutil.Rename(fn, asidefn); err != nil {
 		return err
 	}
 	// Create a clean segment and make it the active one.
@@ -326,7 +349,7 @@ func (w *WAL) Repair(origErr error) error {
 	}
 	w.segment = s
 
-	f, err := os.Open(tmpfn)
+	f, err := os.Open(asidefn)
 	if err != nil {
 		return errors.Wrap(err, "open segment")
 	}
@@ -341,15 +364,13 @@ func (w *WAL) Repair(origErr error) error {
 	}
 	// We expect an error here from r.Err(), so nothing to handle.
 
-	// We explicitly close even when there is a defer for Windows to be
-	// able to delete it. The defer is in place to close it in-case there
-	// are errors above.
 	if err := f.Close(); err != nil {
 		return errors.Wrap(err, "close corrupted file")
 	}
-	if err := os.Remove(tmpfn); err != nil {
-		return errors.Wrap(err, "delete corrupted segment")
-	}
+	w.repairDiscarded.Add(float64(discarded))
+
+	level.Warn(w.logger).Log("msg", "WAL repaired, data behind corruption was discarded",
+		"segment", cerr.Segment, "offset", cerr.Offset, "discarded_bytes", discarded, "dir", aside)
 	return nil
 }
 
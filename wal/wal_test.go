@@ -21,9 +21,11 @@ import (
 	"io/ioutil"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/pkg/errors"
+	"github.com/prometheus/tsdb/fileutil"
 	"github.com/prometheus/tsdb/testutil"
 )
 
@@ -291,6 +293,15 @@ func TestWAL_Repair(t *testing.T) {
 			testutil.Ok(t, sr.Close())
 			testutil.Ok(t, w.Repair(r.Err()))
 
+			// The damaged segments must have been moved aside.
+			asideDirs, err := filepath.Glob(filepath.Join(dir, corruptedDirPrefix+"*"))
+			testutil.Ok(t, err)
+			testutil.Equals(t, 1, len(asideDirs))
+
+			aside, err := fileutil.ReadDir(asideDirs[0])
+			testutil.Ok(t, err)
+			testutil.Equals(t, []string{"00000001", "00000002"}, aside)
+
 			// See https://github.com/prometheus/prometheus/issues/4603
 			// We need to close w.segment because it needs to be deleted.
 			// But this is to mainly artificially test Repair() again.